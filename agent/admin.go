@@ -0,0 +1,60 @@
+package agent
+
+// KillSessionResponse answers a "kill_session" message.
+type KillSessionResponse struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	PID   int    `json:"pid"`
+	Error string `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// killSession ends the database session msg.PID with pg_terminate_backend,
+// or only cancels its current query with mode "cancel". It is refused unless
+// the connection is configured with admin enabled, and every attempt is
+// audited.
+func killSession(msg Message) KillSessionResponse {
+	resp := KillSessionResponse{ID: msg.ID, Type: "kill_session_result", PID: msg.PID}
+	event := AuditEvent{Action: "kill_session", MessageID: msg.ID, PID: msg.PID, Detail: msg.Mode}
+	defer func() {
+		event.Connection = resp.Connection
+		event.Error = resp.Error
+		msg.agent().audit(event)
+	}()
+
+	fail := func(err error) KillSessionResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	if !c.Admin {
+		return fail(codedErrorf(codePolicyDenied, "kill_session requires admin to be enabled for connection %q", c.Name))
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return fail(codedErrorf(codeNotSupported, "kill_session is not supported for %s", c.Flavor()))
+	}
+	if msg.PID <= 0 {
+		return fail(codedErrorf(codeInvalidRequest, "pid is required"))
+	}
+
+	fn := "pg_terminate_backend"
+	switch msg.Mode {
+	case "", "terminate":
+	case "cancel":
+		fn = "pg_cancel_backend"
+	default:
+		return fail(codedErrorf(codeInvalidRequest, "unknown mode %q: expected cancel or terminate", msg.Mode))
+	}
+	if err := sc.signalBackend(fn, msg.PID); err != nil {
+		return fail(err)
+	}
+	return resp
+}
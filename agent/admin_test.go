@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestKillSession(t *testing.T) {
+	adminDB, mock, err := sqlmock.NewWithDSN("peekdb-kill-test")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer adminDB.Close()
+	pg := &sqlConnector{db: adminDB, flavor: "postgres", driver: "sqlmock", dsn: "peekdb-kill-test"}
+
+	tn := testTenant(&connection{Name: "prod", Admin: true, Connector: pg}, &connection{Name: "readonly", Connector: pg})
+	auditLogPath := filepath.Join(t.TempDir(), "audit.log")
+	tn.agent.opts.AuditLog = auditLogPath
+
+	testCases := []struct {
+		name      string
+		msg       Message
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   string
+	}{
+		{
+			name: "terminate",
+			msg:  Message{ID: "k1", PID: 101},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT pg_terminate_backend\(\$1\)`).WithArgs(101).
+					WillReturnRows(sqlmock.NewRows([]string{"pg_terminate_backend"}).AddRow(true))
+			},
+		},
+		{
+			name: "cancel",
+			msg:  Message{ID: "k2", PID: 102, Mode: "cancel"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT pg_cancel_backend\(\$1\)`).WithArgs(102).
+					WillReturnRows(sqlmock.NewRows([]string{"pg_cancel_backend"}).AddRow(true))
+			},
+		},
+		{
+			name:      "admin disabled",
+			msg:       Message{ID: "k3", PID: 103, Target: "readonly"},
+			mockSetup: func(sqlmock.Sqlmock) {},
+			wantErr:   `kill_session requires admin to be enabled for connection "readonly"`,
+		},
+		{
+			name:      "missing pid",
+			msg:       Message{ID: "k4"},
+			mockSetup: func(sqlmock.Sqlmock) {},
+			wantErr:   "pid is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.mockSetup(mock)
+			tc.msg.tenant = tn
+			resp := killSession(tc.msg)
+			if resp.Error != tc.wantErr {
+				t.Errorf("error = %q, want %q", resp.Error, tc.wantErr)
+			}
+			if resp.PID != tc.msg.PID {
+				t.Errorf("expected pid %d, got %d", tc.msg.PID, resp.PID)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+
+	buf, err := os.ReadFile(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != len(testCases) {
+		t.Fatalf("expected %d audit lines, got %d", len(testCases), len(lines))
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[2]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Action != "kill_session" || event.PID != 103 || event.Connection != "readonly" || event.Error == "" {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+}
@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The advisor runs well-known maintenance heuristics against the Postgres
+// statistics views and reports what looks worth a DBA's attention. Each
+// check is independent; one failing (say, for lack of privileges) doesn't
+// stop the others.
+
+type AdvisorResponse struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Findings []AdvisorFinding `json:"findings"`
+	Errors   []AdvisorError   `json:"errors,omitempty"`
+	Error    string           `json:"error,omitempty"`
+
+	Connection string `json:"connection,omitempty"`
+}
+
+type AdvisorFinding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Schema   string `json:"schema"`
+	Table    string `json:"table"`
+	Index    string `json:"index,omitempty"`
+	Message  string `json:"message"`
+	// Suggestion is SQL that would address the finding. The agent never
+	// runs it.
+	Suggestion string           `json:"suggestion,omitempty"`
+	Metrics    map[string]int64 `json:"metrics,omitempty"`
+}
+
+type AdvisorError struct {
+	Check string `json:"check"`
+	Error string `json:"error"`
+}
+
+type advisorCheck struct {
+	name string
+	run  func(q queryer) ([]AdvisorFinding, error)
+}
+
+var advisorChecks = []advisorCheck{
+	{"unused_index", unusedIndexes},
+	{"duplicate_index", duplicateIndexes},
+	{"dead_tuples", deadTuples},
+	{"missing_index", missingIndexes},
+	{"never_analyzed", neverAnalyzed},
+}
+
+func runAdvisor(msg Message) AdvisorResponse {
+	resp := AdvisorResponse{ID: msg.ID, Type: "advisor", Findings: []AdvisorFinding{}}
+	c, err := msg.route()
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		resp.Error = fmt.Sprintf("advisor is not supported for %s", c.Flavor())
+		return resp
+	}
+
+	log.Printf("[advisor:%s] Running %d checks", msg.ID, len(advisorChecks))
+	start := time.Now()
+	for _, check := range advisorChecks {
+		findings, err := check.run(sc.db)
+		if err != nil {
+			log.Printf("[advisor:%s] %s failed: %v", msg.ID, check.name, err)
+			resp.Errors = append(resp.Errors, AdvisorError{Check: check.name, Error: err.Error()})
+			continue
+		}
+		resp.Findings = append(resp.Findings, findings...)
+	}
+	log.Printf("[advisor:%s] Completed in %v, %d findings", msg.ID, time.Since(start), len(resp.Findings))
+	return resp
+}
+
+func qualified(schema, name string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+}
+
+const unusedIndexQuery = `
+SELECT s.schemaname, s.relname, s.indexrelname, pg_relation_size(s.indexrelid)
+FROM pg_stat_user_indexes s
+JOIN pg_index i ON i.indexrelid = s.indexrelid
+WHERE s.idx_scan = 0
+  AND NOT i.indisunique
+  AND NOT i.indisprimary
+  AND pg_relation_size(s.indexrelid) > 1048576
+ORDER BY pg_relation_size(s.indexrelid) DESC`
+
+// unusedIndexes finds non-unique indexes over 1 MiB that have not been
+// scanned since statistics were last reset.
+func unusedIndexes(q queryer) ([]AdvisorFinding, error) {
+	rows, err := q.Query(unusedIndexQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []AdvisorFinding
+	for rows.Next() {
+		var schema, table, index string
+		var size int64
+		if err := rows.Scan(&schema, &table, &index, &size); err != nil {
+			return nil, err
+		}
+		findings = append(findings, AdvisorFinding{
+			Check:      "unused_index",
+			Severity:   "warning",
+			Schema:     schema,
+			Table:      table,
+			Index:      index,
+			Message:    fmt.Sprintf("Index %s has never been scanned but takes %d bytes and slows every write", index, size),
+			Suggestion: "DROP INDEX CONCURRENTLY " + qualified(schema, index),
+			Metrics:    map[string]int64{"size_bytes": size},
+		})
+	}
+	return findings, rows.Err()
+}
+
+const duplicateIndexQuery = `
+SELECT n.nspname, t.relname, ci.relname, cd.relname, pg_relation_size(i.indexrelid)
+FROM pg_index i
+JOIN pg_index d ON d.indrelid = i.indrelid
+  AND d.indexrelid < i.indexrelid
+  AND d.indkey = i.indkey
+  AND d.indclass = i.indclass
+  AND coalesce(pg_get_expr(d.indexprs, d.indrelid), '') = coalesce(pg_get_expr(i.indexprs, i.indrelid), '')
+  AND coalesce(pg_get_expr(d.indpred, d.indrelid), '') = coalesce(pg_get_expr(i.indpred, i.indrelid), '')
+JOIN pg_class ci ON ci.oid = i.indexrelid
+JOIN pg_class cd ON cd.oid = d.indexrelid
+JOIN pg_class t ON t.oid = i.indrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+WHERE NOT i.indisprimary
+  AND NOT i.indisunique
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+ORDER BY n.nspname, t.relname, ci.relname`
+
+// duplicateIndexes finds indexes with the same columns, operator classes,
+// expressions and predicate as an older index on the same table.
+func duplicateIndexes(q queryer) ([]AdvisorFinding, error) {
+	rows, err := q.Query(duplicateIndexQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []AdvisorFinding
+	for rows.Next() {
+		var schema, table, index, original string
+		var size int64
+		if err := rows.Scan(&schema, &table, &index, &original, &size); err != nil {
+			return nil, err
+		}
+		findings = append(findings, AdvisorFinding{
+			Check:      "duplicate_index",
+			Severity:   "warning",
+			Schema:     schema,
+			Table:      table,
+			Index:      index,
+			Message:    fmt.Sprintf("Index %s duplicates %s", index, original),
+			Suggestion: "DROP INDEX CONCURRENTLY " + qualified(schema, index),
+			Metrics:    map[string]int64{"size_bytes": size},
+		})
+	}
+	return findings, rows.Err()
+}
+
+const deadTuplesQuery = `
+SELECT schemaname, relname, n_live_tup, n_dead_tup,
+       coalesce(extract(epoch FROM now() - greatest(last_vacuum, last_autovacuum)), -1)::bigint
+FROM pg_stat_user_tables
+WHERE n_dead_tup > 10000
+  AND n_dead_tup > 0.2 * (n_live_tup + n_dead_tup)
+ORDER BY n_dead_tup DESC`
+
+// deadTuples finds tables where more than a fifth of the rows are dead,
+// a sign that autovacuum is falling behind and the table is bloating.
+func deadTuples(q queryer) ([]AdvisorFinding, error) {
+	rows, err := q.Query(deadTuplesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []AdvisorFinding
+	for rows.Next() {
+		var schema, table string
+		var live, dead, sinceVacuum int64
+		if err := rows.Scan(&schema, &table, &live, &dead, &sinceVacuum); err != nil {
+			return nil, err
+		}
+		findings = append(findings, AdvisorFinding{
+			Check:      "dead_tuples",
+			Severity:   "warning",
+			Schema:     schema,
+			Table:      table,
+			Message:    fmt.Sprintf("%d of %d rows in %s are dead; autovacuum may be falling behind", dead, live+dead, table),
+			Suggestion: "VACUUM (ANALYZE) " + qualified(schema, table),
+			Metrics:    map[string]int64{"live_tuples": live, "dead_tuples": dead, "seconds_since_vacuum": sinceVacuum},
+		})
+	}
+	return findings, rows.Err()
+}
+
+const missingIndexQuery = `
+SELECT schemaname, relname, seq_scan, seq_tup_read, coalesce(idx_scan, 0), n_live_tup
+FROM pg_stat_user_tables
+WHERE n_live_tup > 10000
+  AND seq_scan > 100
+  AND seq_scan > 10 * coalesce(idx_scan, 0)
+ORDER BY seq_tup_read DESC
+LIMIT 50`
+
+// missingIndexes finds sizeable tables read mostly by sequential scans,
+// which often means a frequent filter lacks an index.
+func missingIndexes(q queryer) ([]AdvisorFinding, error) {
+	rows, err := q.Query(missingIndexQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []AdvisorFinding
+	for rows.Next() {
+		var schema, table string
+		var seqScan, seqRead, idxScan, live int64
+		if err := rows.Scan(&schema, &table, &seqScan, &seqRead, &idxScan, &live); err != nil {
+			return nil, err
+		}
+		findings = append(findings, AdvisorFinding{
+			Check:    "missing_index",
+			Severity: "info",
+			Schema:   schema,
+			Table:    table,
+			Message:  fmt.Sprintf("%s has had %d sequential scans against %d index scans; a frequent filter may need an index", table, seqScan, idxScan),
+			Metrics:  map[string]int64{"seq_scan": seqScan, "seq_tup_read": seqRead, "idx_scan": idxScan, "live_tuples": live},
+		})
+	}
+	return findings, rows.Err()
+}
+
+const neverAnalyzedQuery = `
+SELECT schemaname, relname, n_live_tup
+FROM pg_stat_user_tables
+WHERE last_analyze IS NULL
+  AND last_autoanalyze IS NULL
+  AND n_live_tup > 1000
+ORDER BY n_live_tup DESC`
+
+// neverAnalyzed finds tables the planner has no statistics for.
+func neverAnalyzed(q queryer) ([]AdvisorFinding, error) {
+	rows, err := q.Query(neverAnalyzedQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []AdvisorFinding
+	for rows.Next() {
+		var schema, table string
+		var live int64
+		if err := rows.Scan(&schema, &table, &live); err != nil {
+			return nil, err
+		}
+		findings = append(findings, AdvisorFinding{
+			Check:      "never_analyzed",
+			Severity:   "info",
+			Schema:     schema,
+			Table:      table,
+			Message:    fmt.Sprintf("%s has never been analyzed, so the planner is guessing its row counts", table),
+			Suggestion: "ANALYZE " + qualified(schema, table),
+			Metrics:    map[string]int64{"live_tuples": live},
+		})
+	}
+	return findings, rows.Err()
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRunAdvisor(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "default", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	mock.ExpectQuery("FROM pg_stat_user_indexes").WillReturnRows(
+		sqlmock.NewRows([]string{"schemaname", "relname", "indexrelname", "size"}).
+			AddRow("public", "orders", "orders_note_idx", 52428800))
+	mock.ExpectQuery("JOIN pg_index d").WillReturnError(errors.New("permission denied for table pg_index"))
+	mock.ExpectQuery("n_dead_tup > 10000").WillReturnRows(
+		sqlmock.NewRows([]string{"schemaname", "relname", "n_live_tup", "n_dead_tup", "since"}).
+			AddRow("public", "events", 100000, 60000, 86400))
+	mock.ExpectQuery("seq_scan > 100").WillReturnRows(
+		sqlmock.NewRows([]string{"schemaname", "relname", "seq_scan", "seq_tup_read", "idx_scan", "n_live_tup"}))
+	mock.ExpectQuery("last_analyze IS NULL").WillReturnRows(
+		sqlmock.NewRows([]string{"schemaname", "relname", "n_live_tup"}).
+			AddRow("Sales", "Leads", 5000))
+
+	resp := runAdvisor(Message{ID: "a1", tenant: tn})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+
+	want := []struct{ check, suggestion string }{
+		{"unused_index", `DROP INDEX CONCURRENTLY "public"."orders_note_idx"`},
+		{"dead_tuples", `VACUUM (ANALYZE) "public"."events"`},
+		{"never_analyzed", `ANALYZE "Sales"."Leads"`},
+	}
+	if len(resp.Findings) != len(want) {
+		t.Fatalf("expected %d findings, got %+v", len(want), resp.Findings)
+	}
+	for i, w := range want {
+		if resp.Findings[i].Check != w.check || resp.Findings[i].Suggestion != w.suggestion {
+			t.Errorf("finding %d: expected %s %q, got %+v", i, w.check, w.suggestion, resp.Findings[i])
+		}
+	}
+	if resp.Findings[1].Metrics["dead_tuples"] != 60000 {
+		t.Errorf("unexpected metrics: %v", resp.Findings[1].Metrics)
+	}
+
+	if len(resp.Errors) != 1 || resp.Errors[0].Check != "duplicate_index" {
+		t.Errorf("expected the duplicate_index check to fail, got %+v", resp.Errors)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
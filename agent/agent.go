@@ -0,0 +1,1379 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/lib/pq"
+)
+
+type Message struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Token  string `json:"token,omitempty"`
+	SQL    string `json:"sql,omitempty"`
+	Params []any  `json:"params,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+
+	AsOfSystemTime string `json:"as_of_system_time,omitempty"`
+	PageSize       int    `json:"page_size,omitempty"`
+	Cursor         string `json:"cursor,omitempty"`
+	Schema         string `json:"schema,omitempty"`
+
+	Index string          `json:"index,omitempty"`
+	DSL   json.RawMessage `json:"dsl,omitempty"`
+
+	Target    string `json:"target,omitempty"`
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	// AcceptEncoding lists the encodings the reply may be compressed
+	// with, and CompressMinBytes overrides --compress-min-bytes; see
+	// writeCompressed.
+	AcceptEncoding   []string `json:"accept_encoding,omitempty"`
+	CompressMinBytes int      `json:"compress_min_bytes,omitempty"`
+	// Spill lets a result over --max-result-bytes go to disk and be sent
+	// from there, in chunks, instead of failing.
+	Spill bool `json:"spill,omitempty"`
+
+	Cell   string `json:"cell,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Length int    `json:"length,omitempty"`
+
+	QueryID string `json:"query_id,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+
+	OrderBy string `json:"order_by,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+
+	JobID string `json:"job_id,omitempty"`
+	// Sensitive keeps every parameter of the query out of the logs.
+	Sensitive bool `json:"sensitive,omitempty"`
+
+	Sample *SampleOption `json:"sample,omitempty"`
+
+	// Version and Settings carry a config_update; see configUpdate.
+	Version  int64           `json:"version,omitempty"`
+	Settings json.RawMessage `json:"settings,omitempty"`
+	// StableOrder breaks ties in the query's order with the table's primary
+	// key, for LIMIT/OFFSET pagination; see stableOrder.
+	StableOrder bool `json:"stable_order,omitempty"`
+	// User is the PeekDB user who sent the query, for query comments.
+	User string `json:"user,omitempty"`
+	// NumberFormats, on the auth message, lists the number formats the
+	// agent can send; the auth response picks one.
+	NumberFormats []string `json:"number_formats,omitempty"`
+	// Encodings, on the auth message, lists the encodings the agent can
+	// compress results with.
+	Encodings []string `json:"encodings,omitempty"`
+	// SentAt and Time carry the hub's answer to a ClockMessage.
+	SentAt *time.Time `json:"sent_at,omitempty"`
+	Time   *time.Time `json:"time,omitempty"`
+	// AgentID and InstanceID, on the auth message, identify this agent
+	// process, and Takeover asks the hub to disconnect other instances
+	// with the same token and agent ID. A replaced message's InstanceID
+	// is the instance that took over; see duplicate.go.
+	AgentID    string `json:"agent_id,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Takeover   bool   `json:"takeover,omitempty"`
+	// Build, on the auth message, describes the agent binary.
+	Build *BuildInfo `json:"build,omitempty"`
+	// Shared keeps a query's result for several viewers to page through,
+	// ViewerID says whose page a query or page message wants, and From
+	// moves that viewer; see shared.go.
+	Shared   bool   `json:"shared,omitempty"`
+	ViewerID string `json:"viewer_id,omitempty"`
+	From     *int   `json:"from,omitempty"`
+	// Search is what a search_schema message looks for.
+	Search string `json:"search,omitempty"`
+	// Identifier is what a validate_identifier message checks, and the
+	// table or view a preview_table, estimate_count, refresh_matview or
+	// set_comment message names, the view or routine a get_definition
+	// message names, and the table an apply_changes or insert_row message
+	// edits.
+	Identifier string `json:"identifier,omitempty"`
+	// Comment is what a set_comment message sets; empty removes it.
+	Comment *string `json:"comment,omitempty"`
+	// Routine and Args are the function or procedure a call message calls
+	// and its arguments.
+	Routine string    `json:"routine,omitempty"`
+	Args    []CallArg `json:"args,omitempty"`
+	// Changes are the row edits an apply_changes message makes, and
+	// Values the columns of the row an insert_row message adds.
+	Changes []RowChange    `json:"changes,omitempty"`
+	Values  map[string]any `json:"values,omitempty"`
+	// Review holds a query's DDL until a "confirm" message with the same
+	// ID; see review.go.
+	Review bool `json:"review,omitempty"`
+	// Direction ("up", "down" or "status"), Steps and Migrations are a
+	// migrate message's; see migrate.go.
+	Direction  string          `json:"direction,omitempty"`
+	Steps      int             `json:"steps,omitempty"`
+	Migrations []MigrationFile `json:"migrations,omitempty"`
+	// Scan is what a scan_pii message scans; see pii.go.
+	Scan *PIIScan `json:"scan,omitempty"`
+	// Backup is the configured backup a backup message starts, or whose
+	// Dump a restore_scratch message restores, kept for TTL; see scratch.go.
+	Backup string `json:"backup,omitempty"`
+	Dump   string `json:"dump,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+	// Bucket is the interval a time_buckets message groups chunks by; see
+	// timescale.go.
+	Bucket string `json:"bucket,omitempty"`
+
+	// tenant is the token the message arrived on; see Message.route.
+	tenant *tenant
+	// ctx is cancelled when the agent shuts down; see Message.context.
+	ctx context.Context
+	// received is when the message arrived from the hub.
+	received time.Time
+	// confirmed is set on a query held for review once it is confirmed.
+	confirmed bool
+}
+
+// context returns the context the work msg asks for runs under: the
+// agent's root context for messages from the hub, and a context that is
+// never cancelled for messages built without one.
+func (m Message) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+type AuthResponse struct {
+	Type    string `json:"type"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// NumberFormat picks one of the auth message's number_formats; see
+	// formatNumbers.
+	NumberFormat string `json:"number_format,omitempty"`
+	// Time is the hub's clock; a hub that sends it answers clock messages.
+	Time *time.Time `json:"time,omitempty"`
+	// Duplicates are the other agents connected with the same token and
+	// agent ID.
+	Duplicates []DuplicateAgent `json:"duplicates,omitempty"`
+}
+
+type QueryResponse struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Columns []string `json:"columns,omitempty"`
+	Rows    [][]any  `json:"rows,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Cursor  string   `json:"cursor,omitempty"`
+
+	Connection   string          `json:"connection,omitempty"`
+	CostEstimate *CostEstimate   `json:"cost_estimate,omitempty"`
+	Truncated    []TruncatedCell `json:"truncated,omitempty"`
+	BackendPID   int             `json:"backend_pid,omitempty"`
+	Explain      string          `json:"explain,omitempty"`
+	ErrorCode    string          `json:"error_code,omitempty"`
+	// ColdStartMillis is how long reconnecting took when an idle policy had
+	// closed the database connections.
+	ColdStartMillis int64        `json:"cold_start_ms,omitempty"`
+	ErrorDetail     *ErrorDetail `json:"error_detail,omitempty"`
+	// RowLimit is set to the token's max_rows when the rows were cut to it.
+	RowLimit int `json:"row_limit,omitempty"`
+	// TieBreaker lists the primary key columns stable_order added to the
+	// query's ORDER BY.
+	TieBreaker []string `json:"tie_breaker,omitempty"`
+	// PlanEstimate accompanies query_too_expensive errors.
+	PlanEstimate *PlanEstimate `json:"plan_estimate,omitempty"`
+	// ColumnTypes are the columns' database types, sent to tokens that
+	// asked for numbers as strings; see formatNumbers.
+	ColumnTypes []string `json:"column_types,omitempty"`
+	// Annotations explain what was done to the result; see annotate.
+	Annotations []Annotation `json:"annotations,omitempty"`
+	Timing      *QueryTiming `json:"timing,omitempty"`
+	// Page places the rows in a shared result; see shared.go.
+	Page *SharedPage `json:"page,omitempty"`
+	// Preview describes a preview_table message's table; see preview.go.
+	Preview *TablePreview `json:"preview,omitempty"`
+	// ResultSets are the results after the first: the cursors a call
+	// message's routine returned (see calls.go), or those of the later
+	// statements of a batch (see fetchResults).
+	ResultSets []ResultSet `json:"result_sets,omitempty"`
+	// Notices are what the database reported while running the query,
+	// such as RAISE NOTICE; see notices.go. NoticesDropped counts those
+	// past maxNotices.
+	Notices        []Notice `json:"notices,omitempty"`
+	NoticesDropped int      `json:"notices_dropped,omitempty"`
+	// Review describes a query held for review instead of run, in a
+	// response of type "review"; see review.go.
+	Review *DDLReview `json:"review,omitempty"`
+
+	// spill holds the rows instead of Rows when they were too big to keep
+	// in memory; see writeSpilled.
+	spill *spilledRows
+}
+
+// readConfig loads the --config file, or returns an empty Config when there
+// is none.
+func readConfig(path string) (*Config, error) {
+	if path == "" {
+		return &Config{}, nil
+	}
+	return loadConfig(path)
+}
+
+// connectDB opens the --db database (if any) followed by the connections
+// from the config file.
+func (a *Agent) connectDB(cfg *Config) error {
+	o := a.opts
+	var configs []ConnectionConfig
+	if o.DatabaseURL != "" {
+		name := o.ConnName
+		if name == "" {
+			name = "default"
+		}
+		cc := ConnectionConfig{Name: name, URL: o.DatabaseURL, Flavor: o.Flavor, Admin: o.Admin, IdleTimeout: duration(o.IdleTimeout), ReadOnly: o.ReadOnly, LeaderElection: o.LeaderElection}
+		if o.MaxQueryCost > 0 || o.MaxQueryRows > 0 {
+			cc.CostLimit = &CostLimit{MaxCost: o.MaxQueryCost, MaxRows: o.MaxQueryRows}
+		}
+		if o.DBTLS != (DBTLS{}) {
+			t := o.DBTLS
+			cc.TLS = &t
+		}
+		if o.AzureAD.Auth != "" {
+			az := o.AzureAD
+			cc.AzureAD = &az
+		}
+		configs = append(configs, cc)
+	}
+	configs = append(configs, cfg.Connections...)
+
+	var err error
+	a.connections, err = a.openConnections(configs)
+	return err
+}
+
+// runQuery sends a query message to the connection it targets.
+func runQuery(msg Message) QueryResponse {
+	a := msg.agent()
+	tm := &queryTimer{}
+	c, err := msg.route()
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	release, err := a.scheduler.acquire(msg.context(), msg.User)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	defer release()
+	if !msg.received.IsZero() {
+		tm.record(phaseQueue, msg.received)
+	}
+	msg.ctx = withTimer(msg.context(), tm)
+	resp := a.handler(&Query{Message: msg, Connection: c.Name, Flavor: c.Flavor(), conn: c})
+	resp.Timing = tm.timing()
+	return resp
+}
+
+// execute runs msg on c, registering it so it can be cancelled. A panic in
+// the connector or its driver fails the query instead of the agent.
+func (a *Agent) execute(c *connection, msg Message) (resp QueryResponse) {
+	start := time.Now()
+	defer timerFrom(msg.context()).settle(start)
+	defer func() {
+		if v := recover(); v != nil {
+			resp = queryError(msg.ID, a.panicError("query:"+msg.ID, v))
+		}
+		a.recording.record(msg.tenant, "db", resp)
+	}()
+	if err := a.opts.chaos.injectDBError(); err != nil {
+		return queryError(msg.ID, err)
+	}
+	if cq, ok := c.Connector.(contextQuerier); ok && msg.ID != "" {
+		ctx := msg.context()
+		if msg.Spill {
+			ctx = withSpill(ctx)
+		}
+		ctx, done := a.running.start(ctx, msg.ID, msg.tenant, c.Connector)
+		defer done()
+		resp := cq.QueryContext(ctx, msg)
+		if resp.Error != "" && errors.Is(ctx.Err(), context.Canceled) {
+			// Drivers word a cancelled query their own way.
+			resp.ErrorCode = codeCanceled
+		}
+		return resp
+	}
+	return c.Query(msg)
+}
+
+func (c *sqlConnector) executeQuery(ctx context.Context, id, sqlQuery string, params []any) QueryResponse {
+	log.Printf("[query:%s] Executing: %s", id, logSQL(sqlQuery))
+	start := time.Now()
+
+	cold := c.suspended()
+	if c.lastQuery != nil {
+		c.lastQuery.Store(start.UnixNano())
+	}
+	tm := timerFrom(ctx)
+	conn, err := c.db.Conn(ctx)
+	tm.record(phaseConnect, start)
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		return queryError(id, err)
+	}
+	defer conn.Close()
+	var coldStart int64
+	if cold {
+		coldStart = time.Since(start).Milliseconds()
+		log.Printf("[query:%s] Resumed idle database in %v", id, time.Since(start))
+	}
+
+	// The backend PID lets a stuck query be cancelled server-side.
+	var pid int
+	if c.flavor == "postgres" {
+		if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+			log.Printf("[query:%s] Could not read backend pid: %v", id, err)
+		} else {
+			setBackendPID(ctx, id, pid)
+		}
+	}
+
+	// Notices, such as a script's RAISE NOTICE, are kept from the attempt
+	// that finished.
+	var notices noticeLog
+	defer c.captureNotices(conn, &notices)()
+
+	var columns, types []string
+	var results [][]any
+	var sets []ResultSet
+	lim := c.owner().resultLimit(ctx, id)
+	call := callFrom(ctx)
+	err = c.withRetry(id, func() error {
+		notices.reset()
+		if !c.readOnly && len(c.session) == 0 && !call.inTransaction(c.flavor) {
+			var err error
+			columns, types, results, sets, err = fetchResults(connQueryer{ctx, conn}, c.flavor, sqlQuery, params, lim, tm, progressFrom(ctx))
+			return err
+		}
+		tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: c.readOnly})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := setLocal(ctx, tx, c.session); err != nil {
+			return err
+		}
+		if call != nil {
+			columns, types, results, sets, err = c.fetchCall(ctx, tx, call, sqlQuery, params, lim, tm)
+		} else {
+			columns, types, results, sets, err = fetchResults(tx, c.flavor, sqlQuery, params, lim, tm, progressFrom(ctx))
+		}
+		if err != nil || c.readOnly {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		resp := queryError(id, err)
+		resp.BackendPID = pid
+		resp.ColdStartMillis = coldStart
+		resp.Explain = c.explainFailure(id, sqlQuery, params, err)
+		resp.Notices, resp.NoticesDropped = notices.notices, notices.dropped
+		return resp
+	}
+
+	resp := QueryResponse{
+		ID:              id,
+		Type:            "result",
+		Columns:         columns,
+		ColumnTypes:     types,
+		Rows:            results,
+		ResultSets:      sets,
+		BackendPID:      pid,
+		ColdStartMillis: coldStart,
+		Notices:         notices.notices,
+		NoticesDropped:  notices.dropped,
+	}
+	if lim != nil && lim.spilled != nil {
+		resp.spill = lim.spilled
+		log.Printf("[query:%s] Completed in %v, %d rows spilled to disk", id, time.Since(start), resp.spill.rows)
+		return resp
+	}
+	log.Printf("[query:%s] Completed in %v, %d rows", id, time.Since(start), len(results))
+	return resp
+}
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// connect runs one hub connection for t until it fails or ctx is
+// cancelled, which closes the connection wherever it is: dialing,
+// authenticating or waiting for messages.
+func connect(ctx context.Context, t *tenant) error {
+	a := t.agent
+	t.progressf("Connecting to hub: %s", t.hubURL())
+	a.reporter.breadcrumb("hub", "connecting tenant=%q", t.name)
+
+	conn, _, err := hubDialer(a.opts.IPFamily).DialContext(ctx, t.hubURL(), nil)
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Send auth
+	t.progressf("Authenticating...")
+	t.clock.reset()
+	authSent := time.Now()
+	build := a.currentBuild()
+	auth := Message{Type: "auth", Token: t.token, NumberFormats: numberFormats, Encodings: encodings,
+		AgentID: a.opts.AgentID, InstanceID: a.instanceID, Takeover: a.opts.OnDuplicate == "takeover", Build: &build}
+	if err := conn.WriteJSON(auth); err != nil {
+		return fmt.Errorf("auth send failed: %w", err)
+	}
+
+	// Wait for auth response
+	var authResp AuthResponse
+	if err := conn.ReadJSON(&authResp); err != nil {
+		return fmt.Errorf("auth read failed: %w", err)
+	}
+	if !authResp.Success {
+		return withExitCode(ExitAuth, fmt.Errorf("authentication failed: %s", authResp.Error))
+	}
+	a.recording.record(t, "auth", authResp)
+	if err := t.duplicates(authResp.Duplicates); err != nil {
+		return err
+	}
+	clockSupported := authResp.Time != nil
+	if clockSupported {
+		t.clock.observe(authSent, *authResp.Time, time.Now())
+	}
+	t.progressf("✓ Authenticated successfully")
+	t.sessions.Add(1)
+	a.startup.hub(t, nil)
+	a.reporter.breadcrumb("hub", "authenticated tenant=%q", t.name)
+	t.setCapabilities(authResp.Capabilities)
+	t.setNumberFormat(authResp.NumberFormat)
+	if a.jobs != nil && a.standby.active() {
+		a.jobs.resume(ctx, t)
+	}
+
+	status := t.status()
+	a.recording.record(t, "out", status)
+	if err := conn.WriteJSON(status); err != nil {
+		return fmt.Errorf("status send failed: %w", err)
+	}
+	if err := t.attach(conn); err != nil {
+		return err
+	}
+	defer t.detach()
+	t.progressf("Ready and waiting for queries...")
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// A connection that silently stopped delivering anything would leave
+	// ReadJSON blocked forever, so ping the hub and let the watchdog close
+	// the connection, and with it start a reconnect, if nothing comes back.
+	watchName := "hub"
+	if t.name != "" {
+		watchName += ":" + t.name
+	}
+	a.watcher.watch(watchName, 3*hubPingInterval, func() { conn.Close() })
+	defer a.watcher.unwatch(watchName)
+	conn.SetPongHandler(func(data string) error {
+		a.watcher.beat(watchName)
+		t.clock.pong([]byte(data), time.Now())
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(hubPingInterval)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			conn.WriteControl(websocket.PingMessage, pingPayload(now), now.Add(10*time.Second))
+			if clockSupported {
+				t.writeMu.Lock()
+				conn.WriteJSON(ClockMessage{Type: "clock", SentAt: now})
+				t.writeMu.Unlock()
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	// Main loop. Each message is handled on its own goroutine so a long
+	// query doesn't hold up others, or the cancel message meant for it.
+	// Replies are written whole, one at a time; see tenant.reply.
+	if a.opts.StatusInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(a.opts.StatusInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					status := t.status()
+					a.recording.record(t, "out", status)
+					t.writeMu.Lock()
+					err := conn.WriteJSON(status)
+					t.writeMu.Unlock()
+					if err != nil {
+						t.logf("Status send failed: %v", err)
+						conn.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("read failed: %w", err)
+		}
+		a.watcher.beat(watchName)
+		a.recording.record(t, "in", msg)
+		if msg.Type == "replaced" {
+			return replaced(a.opts.AgentID, msg.InstanceID)
+		}
+		if msg.Type == "clock" {
+			if msg.SentAt != nil && msg.Time != nil {
+				t.clock.observe(*msg.SentAt, *msg.Time, time.Now())
+			}
+			continue
+		}
+		msg.tenant, msg.ctx, msg.received = t, ctx, time.Now()
+		a.reporter.breadcrumb("message", "%s id=%q target=%q", msg.Type, msg.ID, msg.Target)
+		if chaos := a.opts.chaos; chaos.hit(chaos.Disconnect) {
+			t.logf("Chaos: dropping the hub connection")
+			conn.Close()
+		}
+
+		go func(msg Message) {
+			// Queries turn a panic into an error reply (see execute); a
+			// panic anywhere else loses only this message's reply.
+			defer func() {
+				if v := recover(); v != nil {
+					a.panicError(msg.Type+":"+msg.ID, v)
+				}
+			}()
+			if chaos := a.opts.chaos; chaos.hit(chaos.Slow) {
+				time.Sleep(chaos.SlowDelay)
+			}
+			if resp := handleMessage(msg); resp != nil {
+				t.reply(msg, resp)
+			}
+		}(msg)
+	}
+}
+
+// handleMessage returns the reply for a hub message, or nil for message
+// types the agent does not handle.
+func handleMessage(msg Message) any {
+	a := msg.agent()
+	if resp := refuseOnStandby(msg); resp != nil {
+		return resp
+	}
+	if resp := refuseAggregateOnly(msg); resp != nil {
+		return resp
+	}
+	resp, done := a.maintenance.admit(msg)
+	if resp != nil {
+		return resp
+	}
+	defer done()
+	switch msg.Type {
+	case "query", "fetch":
+		return runQuery(msg)
+	case "schema":
+		c, err := msg.route()
+		if err != nil {
+			return SchemaResponse{ID: msg.ID, Type: "schema", Error: err.Error(), ErrorCode: errorCode(err)}
+		}
+		caps := msg.capabilities()
+		if msg.Schema != "" && !caps.schemaAllowed(msg.Schema) {
+			err := codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", msg.Schema)
+			return SchemaResponse{ID: msg.ID, Type: "schema", Error: err.Error(), ErrorCode: errorCode(err)}
+		}
+		resp := c.Schema(msg.ID, msg.Schema)
+		a.recording.record(msg.tenant, "db", resp)
+		if msg.Schema == "" {
+			a.schemas.put(c.Connector, resp)
+		}
+		resp.Connection = c.Name
+		caps.filterSchema(&resp)
+		return resp
+	case "validate_identifier":
+		return validateIdentifier(msg)
+	case "search_schema":
+		return searchSchema(msg)
+	case "preview_table":
+		return previewTable(msg)
+	case "estimate_count":
+		return estimateCount(msg)
+	case "advisor":
+		return runAdvisor(msg)
+	case "top_queries":
+		return topQueries(msg)
+	case "locks":
+		return listLocks(msg)
+	case "kill_session":
+		return killSession(msg)
+	case "matviews":
+		return listMatViews(msg)
+	case "time_buckets":
+		return timeBuckets(msg)
+	case "refresh_matview":
+		return refreshMatView(msg)
+	case "set_comment":
+		return setComment(msg)
+	case "get_definition":
+		return getDefinition(msg)
+	case "call":
+		return callRoutine(msg)
+	case "apply_changes":
+		return applyChanges(msg)
+	case "insert_row":
+		return insertRow(msg)
+	case "confirm":
+		return confirmQuery(msg)
+	case "migrate":
+		return runMigrations(msg)
+	case "backup":
+		return triggerBackup(msg)
+	case "alerts":
+		return alertStatus(msg)
+	case "restore_scratch":
+		return restoreScratch(msg)
+	case "drop_scratch":
+		return dropScratch(msg)
+	case "cancel":
+		return cancelQuery(msg)
+	case "download_blob":
+		return downloadBlob(msg)
+	case "fetch_cell":
+		return fetchCell(msg)
+	case "export":
+		return startExport(msg)
+	case "scan_pii":
+		return startPIIScan(msg)
+	case "job_status":
+		return jobStatus(msg)
+	case "job_result":
+		return jobResultPage(msg)
+	case "page":
+		return sharedPage(msg)
+	case "usage_report":
+		return a.usage.report(msg.ID)
+	case "history":
+		return historyReport(msg)
+	case "config_update":
+		return configUpdate(msg)
+	case "promote":
+		return promote(msg)
+	}
+	return nil
+}
+
+// Options configure an Agent. DefaultOptions holds the defaults the
+// command line starts from; an empty path or address leaves its feature off.
+type Options struct {
+	// HubURL is the hub's websocket URL, and Token the token the agent
+	// authenticates with; the config file can add more tokens.
+	HubURL string
+	Token  string
+
+	// DatabaseURL and the fields up to ConfigPath describe the --db
+	// connection; the config file can add more connections.
+	DatabaseURL    string
+	ConnName       string
+	Flavor         string
+	Admin          bool
+	IdleTimeout    time.Duration
+	ReadOnly       bool
+	MaxQueryCost   float64
+	MaxQueryRows   float64
+	LeaderElection string
+	// ConfigPath is a JSON config file; see Config.
+	ConfigPath string
+
+	MaxCellBytes     int
+	MaxResultBytes   int64
+	SpillDir         string
+	CompressMinBytes int
+	StatusInterval   time.Duration
+	ExplainOnError   bool
+	SlowQuery        time.Duration
+	QueryComment     string
+	SettingsOverride string
+	AgentID          string
+	Standby          bool
+
+	// MaxConcurrentQueries caps the queries running at once, queueing the
+	// rest fairly by user; 0 is no cap. See fairScheduler.
+	MaxConcurrentQueries int
+
+	// MaxUploadMbps caps the rate replies are sent to hubs, in megabits
+	// per second; 0 is no cap. See uploadLimiter.
+	MaxUploadMbps float64
+
+	// Files the agent keeps jobs, replies, history, admin actions and
+	// recordings in.
+	JobsDB       string
+	JobRetention time.Duration
+	// SharedResultTTL is how long a shared result is kept after it was
+	// last paged.
+	SharedResultTTL time.Duration
+	Outbox          string
+	OutboxMaxBytes  int64
+	History         string
+	HistorySize     int
+	AuditLog        string
+	Record          string
+
+	// DataDir is where spill files and the outbox go when SpillDir and
+	// Outbox aren't set. MaxDiskUsage caps the bytes they take together;
+	// 0 is no cap. See diskQuota.
+	DataDir      string
+	MaxDiskUsage int64
+
+	// Addresses to serve the metrics and the admin endpoints on.
+	MetricsAddr string
+	AdminAddr   string
+
+	SentryDSN string
+	// Quiet drops the startup banner and connection progress from the
+	// log. StatusJSON, when set, is a file ("-" for stdout) to write a
+	// StartupStatus to once every hub has answered.
+	Quiet      bool
+	StatusJSON string
+	// FailFast stops the agent at the first failure to reach or stay
+	// connected to a hub, and MaxReconnects after that many failed
+	// attempts in a row (0 keeps trying), rather than retrying forever.
+	FailFast      bool
+	MaxReconnects int
+	// OnDuplicate is what to do about another agent with the same token
+	// and agent ID: "warn" (the default), "refuse" or "takeover"; see
+	// duplicate.go.
+	OnDuplicate string
+	// IPFamily limits hub and database connections to "ipv4" or "ipv6".
+	IPFamily string
+	// DBTLS is the --db connection's TLS. RequireVerifyFull refuses
+	// Postgres connections that don't verify the server's certificate.
+	DBTLS             DBTLS
+	RequireVerifyFull bool
+	// Kerberos authenticates Postgres connections with GSSAPI.
+	Kerberos Kerberos
+	// AzureAD logs the --db connection in with Azure AD tokens when its
+	// Auth is set.
+	AzureAD AzureAD
+	// Version is the agent's release, for logs and crash reports, and
+	// Commit and BuildDate the commit and time it was built from; see
+	// BuildInfo.
+	Version   string
+	Commit    string
+	BuildDate string
+
+	// QueryMiddleware runs around every query, after the config file's
+	// query_middleware; see QueryMiddleware.
+	QueryMiddleware []QueryMiddleware
+
+	// chaos is set only by the hidden --chaos-* flags.
+	chaos chaosConfig
+}
+
+// DefaultOptions returns the options the command line starts from.
+func DefaultOptions() Options {
+	return Options{
+		HubURL:           "wss://connect.peekdb.com/agent",
+		Flavor:           "postgres",
+		MaxCellBytes:     1 << 20,
+		CompressMinBytes: 64 << 10,
+		StatusInterval:   5 * time.Minute,
+		AgentID:          defaultAgentID(),
+		JobRetention:     24 * time.Hour,
+		SharedResultTTL:  10 * time.Minute,
+		OutboxMaxBytes:   64 << 20,
+		HistorySize:      200,
+		Kerberos:         Kerberos{Renew: time.Hour},
+		Version:          "dev",
+		chaos:            chaosConfig{SlowDelay: 2 * time.Second},
+	}
+}
+
+// RegisterFlags defines the agent's flags on fs, storing into o. Flags
+// default to o's values, or for some to environment variables.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Token, "token", os.Getenv("PEEKDB_TOKEN"), "PeekDB connection token")
+	fs.StringVar(&o.DatabaseURL, "db", os.Getenv("DATABASE_URL"), "Database connection URL")
+	fs.StringVar(&o.HubURL, "hub", o.HubURL, "Hub WebSocket URL")
+	fs.StringVar(&o.ConnName, "name", o.ConnName, "Connection name (optional)")
+	fs.StringVar(&o.Flavor, "flavor", o.Flavor, "Postgres-protocol dialect: postgres or cockroach")
+	fs.StringVar(&o.ConfigPath, "config", os.Getenv("PEEKDB_CONFIG"), "Path to JSON config file (optional)")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", os.Getenv("PEEKDB_METRICS_ADDR"), "Serve Prometheus metrics on this address, e.g. :9187 (optional)")
+	fs.IntVar(&o.MaxCellBytes, "max-cell-bytes", o.MaxCellBytes, "Truncate text cells longer than this; 0 disables")
+	fs.Int64Var(&o.MaxResultBytes, "max-result-bytes", o.MaxResultBytes, "Fail, or spill, results whose rows take more memory than this; 0 disables")
+	fs.StringVar(&o.SpillDir, "spill-dir", os.Getenv("PEEKDB_SPILL_DIR"), "Let queries that ask spill results over --max-result-bytes to files in this directory (optional)")
+	fs.IntVar(&o.CompressMinBytes, "compress-min-bytes", o.CompressMinBytes, "Compress results at least this large for hubs that accept it")
+	fs.BoolVar(&o.Admin, "admin", o.Admin, "Allow admin actions such as kill_session on the --db connection")
+	fs.StringVar(&o.AuditLog, "audit-log", os.Getenv("PEEKDB_AUDIT_LOG"), "Append admin actions to this file as JSON lines (optional)")
+	fs.DurationVar(&o.StatusInterval, "status-interval", o.StatusInterval, "Resend the status report this often; 0 sends it only on connect")
+	fs.BoolVar(&o.ExplainOnError, "explain-on-error", o.ExplainOnError, "Attach EXPLAIN output to queries that fail on memory, disk or statement timeout")
+	fs.DurationVar(&o.IdleTimeout, "idle-timeout", o.IdleTimeout, "Close database connections after this long without queries, e.g. 10m (optional)")
+	fs.BoolVar(&o.ReadOnly, "read-only", o.ReadOnly, "Allow only reads on the --db connection")
+	fs.Float64Var(&o.MaxQueryCost, "max-query-cost", o.MaxQueryCost, "Reject queries on the --db connection whose EXPLAIN cost is higher (optional)")
+	fs.Float64Var(&o.MaxQueryRows, "max-query-rows", o.MaxQueryRows, "Reject queries on the --db connection that EXPLAIN expects to return more rows (optional)")
+	fs.DurationVar(&o.SlowQuery, "slow-query", o.SlowQuery, "Log queries that take at least this long, e.g. 2s (optional)")
+	fs.StringVar(&o.JobsDB, "jobs-db", os.Getenv("PEEKDB_JOBS_DB"), "Keep export jobs in this file; exports are disabled without it")
+	fs.StringVar(&o.Outbox, "outbox", os.Getenv("PEEKDB_OUTBOX"), "Spool replies to this file while the hub is unreachable (optional)")
+	fs.Int64Var(&o.OutboxMaxBytes, "outbox-max-bytes", o.OutboxMaxBytes, "Most bytes of replies to spool")
+	fs.StringVar(&o.DataDir, "data-dir", os.Getenv("PEEKDB_DATA_DIR"), "Keep spill files and the outbox in this directory unless --spill-dir or --outbox say otherwise (optional)")
+	fs.Int64Var(&o.MaxDiskUsage, "max-disk-usage", o.MaxDiskUsage, "Most bytes of spill files and spooled replies together, evicting the oldest replies to make room (default 0: no limit)")
+	fs.IntVar(&o.MaxConcurrentQueries, "max-concurrent-queries", o.MaxConcurrentQueries, "Run at most this many queries at once, queueing the rest fairly by user (default 0: no limit)")
+	fs.Float64Var(&o.MaxUploadMbps, "max-upload-mbps", o.MaxUploadMbps, "Send query results to the hub at most this many megabits per second, so big exports leave room for other traffic (default 0: no limit)")
+	fs.DurationVar(&o.JobRetention, "job-retention", o.JobRetention, "Delete finished export jobs after this long")
+	fs.DurationVar(&o.SharedResultTTL, "shared-result-ttl", o.SharedResultTTL, "Drop a shared query result when no one has paged it for this long")
+	fs.IntVar(&o.HistorySize, "history-size", o.HistorySize, "Remember this many recent queries; 0 disables the history")
+	fs.StringVar(&o.History, "history", os.Getenv("PEEKDB_HISTORY"), "Keep the query history in this file across restarts (optional)")
+	fs.StringVar(&o.QueryComment, "query-comment", os.Getenv("PEEKDB_QUERY_COMMENT"), "Append this comment to SQL, e.g. \"peekdb:query_id={query_id} user={user}\" (optional)")
+	fs.StringVar(&o.SettingsOverride, "settings-override", os.Getenv("PEEKDB_SETTINGS_OVERRIDE"), "JSON file of settings the hub may not change (optional)")
+	fs.StringVar(&o.AgentID, "agent-id", o.AgentID, "Name of this agent among agents serving the same databases")
+	fs.StringVar(&o.LeaderElection, "leader-election", o.LeaderElection, "Elect one leader among agents in this group on the --db database (optional)")
+	fs.StringVar(&o.Record, "record", os.Getenv("PEEKDB_RECORD"), "Append every hub message, reply and database answer to this file, for replay (optional)")
+	fs.StringVar(&o.AdminAddr, "admin-addr", os.Getenv("PEEKDB_ADMIN_ADDR"), "Serve the local admin endpoints, such as maintenance mode, on this address, e.g. 127.0.0.1:9188 (optional)")
+	fs.BoolVar(&o.Standby, "standby", o.Standby, "Start as a warm standby that serves nothing until promoted")
+	fs.StringVar(&o.SentryDSN, "sentry-dsn", os.Getenv("PEEKDB_SENTRY_DSN"), "Report crashes and errors to this Sentry DSN (optional)")
+	fs.StringVar(&o.DBTLS.Mode, "db-ssl-mode", os.Getenv("PEEKDB_DB_SSL_MODE"), "TLS for the --db connection: disable, require, verify-ca or verify-full (default from the URL)")
+	fs.StringVar(&o.DBTLS.RootCert, "db-ssl-root-cert", os.Getenv("PEEKDB_DB_SSL_ROOT_CERT"), "PEM file of the CAs that sign the --db server's certificate (optional)")
+	fs.StringVar(&o.DBTLS.Cert, "db-ssl-cert", os.Getenv("PEEKDB_DB_SSL_CERT"), "Client certificate for the --db connection (optional)")
+	fs.StringVar(&o.DBTLS.Key, "db-ssl-key", os.Getenv("PEEKDB_DB_SSL_KEY"), "Client certificate key for the --db connection (optional)")
+	fs.BoolVar(&o.RequireVerifyFull, "db-require-verify-full", o.RequireVerifyFull, "Refuse Postgres and CockroachDB connections without sslmode verify-full, except over unix sockets")
+	fs.StringVar(&o.Kerberos.Principal, "krb-principal", os.Getenv("PEEKDB_KRB_PRINCIPAL"), "Kerberos principal to authenticate to databases as, e.g. peekdb/agent01@EXAMPLE.COM (optional)")
+	fs.StringVar(&o.Kerberos.Keytab, "krb-keytab", os.Getenv("PEEKDB_KRB_KEYTAB"), "Keytab holding the principal's key (optional)")
+	fs.StringVar(&o.Kerberos.CCache, "krb-ccache", os.Getenv("PEEKDB_KRB_CCACHE"), "Kerberos ticket cache file (default from KRB5CCNAME)")
+	fs.DurationVar(&o.Kerberos.Renew, "krb-renew", o.Kerberos.Renew, "Get a fresh Kerberos ticket this often")
+	fs.StringVar(&o.AzureAD.Auth, "db-azure-auth", os.Getenv("PEEKDB_DB_AZURE_AUTH"), "Log in to the --db database with Azure AD tokens from managed-identity or client-credentials (optional)")
+	fs.StringVar(&o.AzureAD.ClientID, "azure-client-id", os.Getenv("AZURE_CLIENT_ID"), "Client ID of the user-assigned managed identity, or of the app for client-credentials")
+	fs.StringVar(&o.AzureAD.TenantID, "azure-tenant-id", os.Getenv("AZURE_TENANT_ID"), "Tenant of the app for client-credentials")
+	fs.BoolVar(&o.Quiet, "quiet", o.Quiet, "Leave the startup banner and connection progress out of the log")
+	fs.StringVar(&o.StatusJSON, "status-json", os.Getenv("PEEKDB_STATUS_JSON"), "Write the startup result as JSON to this file, or - for stdout, once every hub has answered (optional)")
+	fs.BoolVar(&o.FailFast, "fail-fast", o.FailFast, "Exit when the hub can't be reached or the connection to it is lost, instead of reconnecting")
+	fs.IntVar(&o.MaxReconnects, "max-reconnects", o.MaxReconnects, "Exit after this many failed attempts in a row to connect to a hub; 0 keeps trying")
+	fs.StringVar(&o.OnDuplicate, "on-duplicate", os.Getenv("PEEKDB_ON_DUPLICATE"), "When another agent runs with the same token and agent ID: warn, refuse or takeover (default warn)")
+	fs.StringVar(&o.IPFamily, "ip-family", os.Getenv("PEEKDB_IP_FAMILY"), "Connect to the hub and databases over only ipv4 or ipv6 (default any)")
+	registerChaosFlags(fs, &o.chaos)
+}
+
+// resolveSecrets replaces the settings given as secret:NAME with the
+// secrets they name.
+func (o *Options) resolveSecrets() error {
+	var err error
+	if o.Token, err = resolveSecret(o.Token); err != nil {
+		return fmt.Errorf("--token: %w", err)
+	}
+	if o.DatabaseURL, err = resolveSecret(o.DatabaseURL); err != nil {
+		return fmt.Errorf("--db: %w", err)
+	}
+	return nil
+}
+
+// Agent connects databases to the hub. Its settings, what it opens and
+// what it keeps in memory all live on it, so a process can run several
+// Agents at once.
+type Agent struct {
+	opts       Options
+	cfg        *Config
+	anonymize  *anonymizer
+	middleware []QueryMiddleware
+	// instanceID tells this Agent apart from other agents with the same
+	// token and agent ID; see duplicate.go.
+	instanceID string
+	// handler runs a query through the middleware chain; see queryChain.
+	handler QueryHandler
+	// settings are those the hub can change; see Settings.
+	settings liveSettings
+	// active is set while Run runs.
+	active atomic.Bool
+
+	// Opened by Run and closed, and set back to nil, when it returns; nil
+	// also when the options leave them off.
+	connections []*connection
+	quota       *diskQuota
+	scheduler   *fairScheduler
+	uploads     *uploadLimiter
+	reporter    *sentryReporter
+	startup     *startupReport
+	jobs        *jobStore
+	recording   *recorder
+	spool       *outbox
+	backups     *backupScheduler
+	alerts      *alertScheduler
+	publishers  *publishScheduler
+
+	// Kept in memory for as long as the Agent lives.
+	history     *queryHistory
+	running     *runningQueries
+	scratch     *scratchRegistry
+	standby     *standbyState
+	maintenance *maintenanceState
+	watcher     *watchdog
+	shared      *sharedResults
+	reviews     *heldReviews
+	usage       *usageStats
+	cells       *cellCache
+	refreshes   *refreshLog
+	schemas     *schemaCache
+}
+
+// New checks opts and reads the config file it names. Its errors have the
+// exit code ExitConfig.
+func New(opts Options) (*Agent, error) {
+	a, err := newAgent(opts)
+	return a, withExitCode(ExitConfig, err)
+}
+
+func newAgent(opts Options) (*Agent, error) {
+	if err := opts.resolveSecrets(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if opts.Token == "" && opts.ConfigPath == "" {
+		return nil, errors.New("token required: --token or PEEKDB_TOKEN env, or tokens in --config")
+	}
+	if opts.DatabaseURL == "" && opts.ConfigPath == "" {
+		return nil, errors.New("database URL required: --db or DATABASE_URL env, or connections in --config")
+	}
+	cfg, err := readConfig(opts.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := checkQueryComment(opts.QueryComment); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if opts.DBTLS != (DBTLS{}) {
+		if err := opts.DBTLS.check(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: --db TLS: %w", err)
+		}
+	}
+	if opts.AzureAD.Auth != "" {
+		if err := opts.AzureAD.check(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: --db-azure-auth: %w", err)
+		}
+	}
+	if err := opts.Kerberos.check(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := checkOnDuplicate(opts.OnDuplicate); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := checkIPFamily(opts.IPFamily); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := checkURLHost("hub URL", opts.HubURL, opts.IPFamily); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	for _, t := range cfg.Tokens {
+		if err := checkURLHost(fmt.Sprintf("hub URL of token %q", t.Name), t.Hub, opts.IPFamily); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+	if err := checkMaxDiskUsage(opts.MaxDiskUsage); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := checkMaxUploadMbps(opts.MaxUploadMbps); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := checkUserWeights(cfg.UserWeights); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	s, err := newScrubber(cfg.Scrub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scrub configuration: %w", err)
+	}
+	an, err := newAnonymizer(cfg.Anonymize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	mws, err := buildQueryMiddleware(cfg.QueryMiddleware)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	a := bareAgent(opts, append(mws, opts.QueryMiddleware...))
+	a.cfg, a.anonymize, a.settings.scrub = cfg, an, s
+	return a, nil
+}
+
+// bareAgent returns an Agent with opts and middleware that has nothing
+// open yet: what newAgent builds on, and what messages and connectors
+// built without one, as in tests, fall back to.
+func bareAgent(opts Options, middleware []QueryMiddleware) *Agent {
+	a := &Agent{
+		opts:        opts,
+		cfg:         &Config{},
+		middleware:  middleware,
+		instanceID:  newInstanceID(),
+		settings:    newLiveSettings(opts),
+		history:     newQueryHistory(opts.HistorySize),
+		running:     newRunningQueries(),
+		scratch:     newScratchRegistry(),
+		standby:     &standbyState{},
+		maintenance: &maintenanceState{},
+		watcher:     newWatchdog(),
+		shared:      newSharedResults(opts.SharedResultTTL),
+		reviews:     newHeldReviews(),
+		usage:       newUsageStats(),
+		cells:       newCellCache(cellCacheBytes),
+		refreshes:   newRefreshLog(),
+		schemas:     newSchemaCache(),
+	}
+	a.handler = a.queryChain(middleware)
+	return a
+}
+
+// Doctor opens the connections opts describe and writes a report on them
+// to w, returning the process exit code.
+func Doctor(opts Options, w io.Writer) int {
+	if err := opts.resolveSecrets(); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	return bareAgent(opts, nil).runDoctor(w)
+}
+
+// Run serves the hub until ctx is cancelled, then closes everything it
+// opened. It returns an error if the agent can't start. An Agent runs once
+// at a time; other Agents may run alongside it.
+func (a *Agent) Run(ctx context.Context) error {
+	if !a.active.CompareAndSwap(false, true) {
+		return errors.New("the agent is already running")
+	}
+	defer a.active.Store(false)
+	a.startup = newStartupReport(a.opts.StatusJSON, a.opts.AgentID, a.opts.Version)
+	defer func() { a.startup = nil }()
+	err := a.run(ctx)
+	if err != nil {
+		a.startup.fail(err)
+	}
+	return err
+}
+
+func (a *Agent) run(ctx context.Context) error {
+	// Cancelled early when a tenant gives up on its hub.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := a.useDataDir(); err != nil {
+		return withExitCode(ExitConfig, fmt.Errorf("invalid --data-dir: %w", err))
+	}
+	cleanSpillDir(a.opts.SpillDir)
+	a.quota = newDiskQuota(a.opts.MaxDiskUsage)
+	defer func() { a.quota = nil }()
+	cfg := a.cfg
+	a.scheduler = newFairScheduler(a.opts.MaxConcurrentQueries, cfg.UserWeights)
+	defer func() { a.scheduler = nil }()
+	a.uploads = newUploadLimiter(a.opts.MaxUploadMbps)
+	defer func() { a.uploads = nil }()
+	if a.opts.SettingsOverride != "" {
+		if err := a.loadSettingsOverride(a.opts.SettingsOverride); err != nil {
+			return withExitCode(ExitConfig, fmt.Errorf("invalid settings override: %w", err))
+		}
+	}
+	logOut, err := openLogSinks(cfg.Logs, a.opts.ConnName)
+	if err != nil {
+		return withExitCode(ExitConfig, fmt.Errorf("invalid log configuration: %w", err))
+	}
+	restoreLog := redirectLog(scrubWriter{logOut, a.currentScrub})
+	defer func() {
+		restoreLog()
+		logOut.Close()
+	}()
+	if a.opts.SentryDSN != "" {
+		if a.reporter, err = newSentryReporter(a.opts.SentryDSN, a.opts.Version); err != nil {
+			return withExitCode(ExitConfig, fmt.Errorf("invalid Sentry DSN: %w", err))
+		}
+		a.reporter.name, a.reporter.scrub = a.opts.ConnName, a.currentScrub
+		defer func() { a.reporter = nil }()
+	}
+	defer a.reporter.reportPanic()
+
+	a.progressf("PeekDB Agent %s starting...", a.opts.Version)
+	if err := a.opts.chaos.check(); err != nil {
+		return err
+	}
+	if a.opts.Standby {
+		a.standby.wait()
+		a.progressf("Starting as a standby")
+	}
+	a.progressf("Hub: %s", a.opts.HubURL)
+
+	if err := a.startKerberos(ctx); err != nil {
+		return a.reporter.reportFatal(err)
+	}
+
+	// Connect to database
+	if err := a.connectDB(cfg); err != nil {
+		return a.reporter.reportFatal(withExitCode(ExitDatabase, fmt.Errorf("database connection failed: %w", err)))
+	}
+	defer func() {
+		closeConnections(a.connections)
+		a.connections = nil
+	}()
+	a.progressf("✓ Database connected")
+	for _, c := range a.connections {
+		logPrivilegeFindings(checkPrivileges(c))
+		if sc, ok := c.Connector.(*sqlConnector); ok && sc.elector != nil {
+			if a.opts.Standby {
+				name := c.Name
+				sc.elector.onLead = func() { a.standby.promote("elected leader on "+name, a.reporter) }
+			}
+			go sc.elector.run(ctx)
+		}
+	}
+
+	tenants, err := newTenants(a, cfg.Tokens, a.connections)
+	if err != nil {
+		return withExitCode(ExitConfig, fmt.Errorf("invalid token configuration: %w", err))
+	}
+	if a.opts.Token != "" {
+		tenants = append([]*tenant{{agent: a, token: a.opts.Token, conns: a.connections}}, tenants...)
+	}
+	if len(tenants) == 0 {
+		return withExitCode(ExitConfig, errors.New("token required: --token or PEEKDB_TOKEN env, or tokens in --config"))
+	}
+	for _, t := range tenants {
+		l, err := a.lockInstance(t.name, t.token)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+
+	if a.opts.JobsDB != "" {
+		if a.jobs, err = openJobStore(a, a.opts.JobsDB); err != nil {
+			return a.reporter.reportFatal(fmt.Errorf("could not open jobs database: %w", err))
+		}
+		defer func() {
+			a.jobs.Close()
+			a.jobs = nil
+		}()
+
+		// A standby resumes interrupted exports when promoted rather than
+		// when it authenticates; tenants still away resume on reconnecting.
+		a.standby.whenPromoted(func() {
+			for _, t := range tenants {
+				if t.connected() {
+					a.jobs.resume(ctx, t)
+				}
+			}
+		})
+		defer a.standby.whenPromoted(nil)
+	}
+
+	if a.opts.Record != "" {
+		if a.recording, err = openRecorder(a.opts.Record); err != nil {
+			return a.reporter.reportFatal(fmt.Errorf("could not open recording: %w", err))
+		}
+		defer func() {
+			a.recording.Close()
+			a.recording = nil
+		}()
+		log.Printf("Recording the hub conversation to %s", a.opts.Record)
+	}
+
+	if a.opts.Outbox != "" {
+		if a.spool, err = openOutbox(a.opts.Outbox, a.opts.OutboxMaxBytes, a.quota); err != nil {
+			return a.reporter.reportFatal(fmt.Errorf("could not open outbox: %w", err))
+		}
+		defer func() {
+			a.spool.Close()
+			a.spool = nil
+		}()
+	}
+
+	if len(cfg.Backups) > 0 {
+		// After the outbox, which keeps the reports of backups that
+		// finish while the hub is away.
+		if a.backups, err = startBackups(ctx, a, cfg.Backups, tenants); err != nil {
+			return withExitCode(ExitConfig, fmt.Errorf("invalid backup configuration: %w", err))
+		}
+		defer func() { a.backups = nil }()
+	}
+	if len(cfg.Alerts) > 0 {
+		// After the outbox too, for the same reason.
+		if a.alerts, err = startAlerts(ctx, a, cfg.Alerts, tenants); err != nil {
+			return withExitCode(ExitConfig, fmt.Errorf("invalid alert configuration: %w", err))
+		}
+		defer func() { a.alerts = nil }()
+	}
+	if len(cfg.Publish) > 0 {
+		// After the job store, which keeps their cursors.
+		if a.publishers, err = startPublishing(ctx, a, cfg.Sinks, cfg.Publish); err != nil {
+			return withExitCode(ExitConfig, fmt.Errorf("invalid publish configuration: %w", err))
+		}
+		defer func() {
+			a.publishers.Close()
+			a.publishers = nil
+		}()
+	}
+	a.startScratchSweeper(ctx, tenants)
+	defer a.scratch.closeAll()
+
+	if a.opts.History != "" && a.opts.HistorySize > 0 {
+		if a.history, err = openHistory(a.opts.History, a.opts.HistorySize); err != nil {
+			return a.reporter.reportFatal(fmt.Errorf("could not open query history: %w", err))
+		}
+	}
+	defer a.history.Close()
+
+	if a.opts.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", a.metricsHandler)
+		mux.HandleFunc("/history", a.historyHandler)
+		mux.HandleFunc("/healthz", a.healthHandler)
+		defer serveHTTP("metrics", a.opts.MetricsAddr, mux).Close()
+	}
+
+	a.maintenance.whenChanged(func() {
+		for _, t := range tenants {
+			t.sendStatus()
+		}
+	})
+	defer a.maintenance.whenChanged(nil)
+	if a.opts.AdminAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/maintenance", a.maintenanceHandler)
+		mux.HandleFunc("/healthz", a.healthHandler)
+		defer serveHTTP("admin endpoints", a.opts.AdminAddr, mux).Close()
+	}
+
+	a.startup.started(ctx, a.connections, tenants)
+	var serving sync.WaitGroup
+	gaveUp := make(chan error, len(tenants))
+	for _, t := range tenants {
+		serving.Add(1)
+		go func(t *tenant) {
+			defer serving.Done()
+			if err := serve(ctx, t); err != nil {
+				gaveUp <- err
+			}
+		}(t)
+	}
+	go a.watcher.run(ctx, 10*time.Second, a.reporter)
+
+	select {
+	case <-ctx.Done():
+	case err = <-gaveUp:
+		log.Printf("✗ %v", err)
+		cancel()
+	}
+	log.Println("Shutting down...")
+	// Cancelling ctx closed the hub connections and cancelled the queries
+	// in flight; let each connection finish closing before the stores go.
+	serving.Wait()
+	return err
+}
+
+// serveHTTP serves handler on addr in the background until the returned
+// server is closed.
+func serveHTTP(what, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		log.Printf("Serving %s on %s", what, addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Server for %s stopped: %v", what, err)
+		}
+	}()
+	return srv
+}
+
+// serve keeps t connected to the hub, reconnecting with backoff, until ctx
+// is cancelled. With --fail-fast it gives up on the first failure, and
+// with --max-reconnects after that many failed attempts in a row, and
+// returns why.
+func serve(ctx context.Context, t *tenant) error {
+	a := t.agent
+	defer a.reporter.reportPanic()
+	backoff := time.Second
+	failures := 0
+	for {
+		sessions := t.sessions.Load()
+		err := connect(ctx, t)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if t.sessions.Load() != sessions {
+			// It got in this time, so start over.
+			backoff, failures = time.Second, 0
+		}
+		if err != nil {
+			t.logf("Connection error: %v", err)
+			a.startup.hub(t, err)
+			a.reporter.breadcrumb("hub", "disconnected tenant=%q", t.name)
+			failures++
+			if ExitCode(err) == ExitDuplicate {
+				return err
+			}
+			if a.opts.FailFast || (a.opts.MaxReconnects > 0 && failures > a.opts.MaxReconnects) {
+				return giveUp(t, err, failures)
+			}
+			if backoff == 30*time.Second {
+				// Failing for a couple of minutes means the agent is up
+				// but useless; report it once per outage.
+				a.reporter.reportError(err)
+			}
+			t.logf("Reconnecting in %v...", backoff)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			// Exponential backoff capped at 60s
+			backoff *= 2
+			if backoff > 60*time.Second {
+				backoff = 60 * time.Second
+			}
+		}
+	}
+}
+
+// giveUp is the error serve stops with: ExitAuth if the hub rejected the
+// token, otherwise ExitHub.
+func giveUp(t *tenant, err error, attempts int) error {
+	prefix := "hub"
+	if t.name != "" {
+		prefix = fmt.Sprintf("hub for %q", t.name)
+	}
+	if t.agent.opts.FailFast {
+		err = fmt.Errorf("%s: %w (--fail-fast)", prefix, err)
+	} else {
+		err = fmt.Errorf("%s: gave up after %d attempts: %w", prefix, attempts, err)
+	}
+	if ExitCode(err) == ExitAuth {
+		return err
+	}
+	return withExitCode(ExitHub, err)
+}
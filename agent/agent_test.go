@@ -1,6 +1,12 @@
-package main
+package agent
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -132,15 +138,13 @@ func TestExecuteQuery(t *testing.T) {
 			}
 			defer mockDB.Close()
 
-			// Replace global db with mock
-			originalDB := db
-			db = mockDB
-			defer func() { db = originalDB }()
+			c := &sqlConnector{db: mockDB, flavor: "postgres"}
 
+			mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
 			tc.mockSetup(mock)
 
 			// Execute query
-			result := executeQuery(tc.queryID, tc.sql, tc.params)
+			result := c.executeQuery(context.Background(), tc.queryID, tc.sql, tc.params)
 
 			// Verify result
 			if result.ID != tc.queryID {
@@ -149,6 +153,9 @@ func TestExecuteQuery(t *testing.T) {
 			if result.Type != "result" {
 				t.Errorf("expected Type 'result', got %q", result.Type)
 			}
+			if result.BackendPID != 4242 {
+				t.Errorf("expected backend pid 4242, got %d", result.BackendPID)
+			}
 
 			if tc.expectedError != "" {
 				if result.Error == "" {
@@ -314,13 +321,12 @@ func TestExecuteQuery_TypeConversion(t *testing.T) {
 			}
 			defer mockDB.Close()
 
-			originalDB := db
-			db = mockDB
-			defer func() { db = originalDB }()
+			c := &sqlConnector{db: mockDB, flavor: "postgres"}
 
+			mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
 			tc.mockSetup(mock)
 
-			result := executeQuery(tc.queryID, tc.sql, nil)
+			result := c.executeQuery(context.Background(), tc.queryID, tc.sql, nil)
 			tc.checkResult(t, result)
 
 			if err := mock.ExpectationsWereMet(); err != nil {
@@ -329,3 +335,190 @@ func TestExecuteQuery_TypeConversion(t *testing.T) {
 		})
 	}
 }
+
+func TestServeStopsOnShutdown(t *testing.T) {
+	// Nothing listens here, so serve keeps dialing and backing off.
+	tn := testTenant()
+	tn.name, tn.hub = "acme", "ws://127.0.0.1:1/agent"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serve(ctx, tn)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve did not return after its context was cancelled")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"no token", Options{DatabaseURL: "postgres://localhost/app"}, "token required"},
+		{"no database", Options{Token: "t"}, "database URL required"},
+		{"missing config", Options{ConfigPath: "/nonexistent/peekdb.json"}, "invalid configuration"},
+		{"bad comment", Options{Token: "t", DatabaseURL: "postgres://localhost/app", QueryComment: "*/ DROP"}, "invalid configuration"},
+		{"bad IP family", Options{Token: "t", DatabaseURL: "postgres://localhost/app", IPFamily: "ipv5"}, "unknown IP family"},
+		{"hub outside IP family", Options{Token: "t", DatabaseURL: "postgres://localhost/app", HubURL: "ws://127.0.0.1:8765/agent", IPFamily: "ipv6"}, "is an IPv4 address"},
+		{"ok", Options{Token: "t", DatabaseURL: "postgres://localhost/app"}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.opts)
+			if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestAgentRun(t *testing.T) {
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer search.Close()
+	h := newDevHub("dev")
+	hub := httptest.NewServer(h.handler())
+	defer hub.Close()
+
+	opts := DefaultOptions()
+	opts.Token = "dev"
+	opts.HubURL = "ws" + strings.TrimPrefix(hub.URL, "http") + "/agent"
+	opts.DatabaseURL = "elasticsearch://" + strings.TrimPrefix(search.URL, "http://") + "?tls=false"
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	var frames []json.RawMessage
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if frames, err = h.send(map[string]any{"type": "history"}, time.Second); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the agent to connect and answer, got %v", err)
+	}
+	var reply HistoryResponse
+	if len(frames) != 1 || json.Unmarshal(frames[0], &reply) != nil || reply.Type != "history" {
+		t.Errorf("expected a history reply, got %s", frames)
+	}
+
+	// An Agent runs once at a time.
+	if err := a.Run(ctx); err == nil {
+		t.Error("expected a second Run to be refused while the first runs")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after its context was cancelled")
+	}
+	if a.connections != nil || a.jobs != nil {
+		t.Error("expected Run to clear what it opened")
+	}
+}
+
+func TestAgentsSideBySide(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two agents, each with its own hub and database, run in one process.
+	type running struct {
+		agent *Agent
+		hub   *devHub
+		done  chan error
+	}
+	var agents []running
+	for _, name := range []string{"a", "b"} {
+		search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{}`))
+		}))
+		defer search.Close()
+		h := newDevHub("dev")
+		hub := httptest.NewServer(h.handler())
+		defer hub.Close()
+
+		opts := DefaultOptions()
+		opts.Token = "dev"
+		opts.AgentID = "agent-" + name
+		opts.HubURL = "ws" + strings.TrimPrefix(hub.URL, "http") + "/agent"
+		opts.DatabaseURL = "elasticsearch://" + strings.TrimPrefix(search.URL, "http://") + "?tls=false"
+		a, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := running{agent: a, hub: h, done: make(chan error, 1)}
+		go func() { r.done <- a.Run(ctx) }()
+		agents = append(agents, r)
+	}
+
+	for i, r := range agents {
+		sql := fmt.Sprintf("SELECT * FROM orders_%d", i)
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			if _, err = r.hub.send(map[string]any{"type": "query", "sql": sql}, time.Second); err == nil || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("expected agent %d to connect and answer, got %v", i, err)
+		}
+	}
+
+	// Each keeps its own history.
+	for i, r := range agents {
+		frames, err := r.hub.send(map[string]any{"type": "history"}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply HistoryResponse
+		if len(frames) != 1 || json.Unmarshal(frames[0], &reply) != nil {
+			t.Fatalf("expected a history reply, got %s", frames)
+		}
+		if want := fmt.Sprintf("select * from orders_%d", i); len(reply.Entries) != 1 || reply.Entries[0].Query != want {
+			t.Errorf("expected agent %d's history to hold only %q, got %+v", i, want, reply.Entries)
+		}
+	}
+
+	// And its own settings.
+	frames, err := agents[0].hub.send(map[string]any{"type": "config_update", "version": 1, "settings": map[string]any{"max_cell_bytes": 10}}, time.Second)
+	var update ConfigUpdateResponse
+	if err != nil || len(frames) != 1 || json.Unmarshal(frames[0], &update) != nil || update.Error != "" {
+		t.Fatalf("expected the update applied, got %s (%v)", frames, err)
+	}
+	if a, b := agents[0].agent.currentMaxCellBytes(), agents[1].agent.currentMaxCellBytes(); a != 10 || b != DefaultOptions().MaxCellBytes {
+		t.Errorf("expected only the first agent's max_cell_bytes changed, got %d and %d", a, b)
+	}
+
+	cancel()
+	for i, r := range agents {
+		select {
+		case err := <-r.done:
+			if err != nil {
+				t.Errorf("expected agent %d to shut down cleanly, got %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("agent %d did not return after its context was cancelled", i)
+		}
+	}
+}
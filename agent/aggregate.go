@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An aggregate-only connection answers aggregate queries and nothing that
+// returns individual rows, for connections shared with analysts who must
+// not see individual records. A query must aggregate or group at its top
+// level, and every group it returns must cover at least MinGroupSize rows:
+// the agent adds a HAVING count(*) condition so smaller groups are left
+// out. This keeps row-level reads out of the analyst's reach; it is not
+// differential privacy, and a determined analyst can still learn about
+// one record by comparing aggregates over sets that differ by it.
+
+// defaultMinGroupSize is the least number of rows an aggregate-only
+// connection lets a group cover unless configured.
+const defaultMinGroupSize = 10
+
+// aggregateFuncs are the aggregates an aggregate-only query may use to
+// summarize rows; each returns one value for many.
+var aggregateFuncs = map[string]bool{
+	"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true,
+	"STDDEV": true, "STDDEV_POP": true, "STDDEV_SAMP": true,
+	"VARIANCE": true, "VAR_POP": true, "VAR_SAMP": true,
+	"PERCENTILE_CONT": true, "PERCENTILE_DISC": true, "MEDIAN": true, "MODE": true,
+	"CORR": true, "COVAR_POP": true, "COVAR_SAMP": true,
+	"REGR_SLOPE": true, "REGR_INTERCEPT": true, "REGR_R2": true, "REGR_COUNT": true,
+	"REGR_AVGX": true, "REGR_AVGY": true, "REGR_SXX": true, "REGR_SYY": true, "REGR_SXY": true,
+	"BOOL_AND": true, "BOOL_OR": true, "EVERY": true,
+	"APPROX_COUNT_DISTINCT": true, "APPROX_PERCENTILE": true,
+}
+
+// rowAggregates collect the rows they aggregate into one value, which
+// hands back every record of a group, so they are refused anywhere in an
+// aggregate-only query.
+var rowAggregates = map[string]bool{
+	"ARRAY_AGG": true, "STRING_AGG": true, "JSON_AGG": true, "JSONB_AGG": true,
+	"JSON_OBJECT_AGG": true, "JSONB_OBJECT_AGG": true, "JSON_ARRAYAGG": true,
+	"JSON_OBJECTAGG": true, "XMLAGG": true, "LISTAGG": true, "GROUP_CONCAT": true,
+	"ARRAY_CONCAT_AGG": true, "ANY_VALUE": true, "ARBITRARY": true,
+}
+
+// aggregateOnlyAllowed are the messages an aggregate-only connection
+// serves: queries, checked by aggregateSQL, and messages that read the
+// schema, statistics or the agent's own state rather than rows. Others,
+// such as preview_table or fetch_cell, are refused.
+var aggregateOnlyAllowed = map[string]bool{
+	"query": true, "fetch": true, "confirm": true, "export": true, "scan_pii": true,
+	"schema": true, "validate_identifier": true, "search_schema": true,
+	"estimate_count": true, "get_definition": true, "matviews": true, "time_buckets": true,
+	"advisor": true, "top_queries": true,
+	"cancel": true, "job_status": true, "job_result": true, "page": true,
+	"usage_report": true, "history": true, "alerts": true, "config_update": true, "promote": true,
+}
+
+// refuseAggregateOnly returns the reply for a message an aggregate-only
+// connection won't serve, or nil to handle it.
+func refuseAggregateOnly(msg Message) any {
+	if aggregateOnlyAllowed[msg.Type] {
+		return nil
+	}
+	c, err := msg.route()
+	if err != nil || !c.AggregateOnly {
+		return nil
+	}
+	return queryError(msg.ID, codedErrorf(codePolicyDenied, "connection %q is aggregate-only; %s is not allowed", c.Name, msg.Type))
+}
+
+// aggregateSQL checks that q, for the aggregate-only connection c, is a
+// single SELECT that aggregates or groups at its top level, and returns
+// it rewritten so that only groups of at least c.MinGroupSize rows come
+// back. A query is refused if it could hand back individual rows by
+// other means: set operations, window functions, aggregates that collect
+// their rows, subqueries among the selected columns, or SELECT INTO.
+func aggregateSQL(c *connection, q string) (string, error) {
+	refuse := func(format string, args ...any) (string, error) {
+		return "", codedErrorf(codePolicyDenied, "connection %q is aggregate-only: "+format, append([]any{c.Name}, args...)...)
+	}
+	if sc, ok := c.Connector.(*sqlConnector); !ok {
+		return refuse("%s is not supported", c.Flavor())
+	} else if sc.flavor == "cassandra" {
+		return refuse("cassandra is not supported")
+	}
+	stmts := splitStatements(q)
+	if len(stmts) != 1 {
+		return refuse("send one statement at a time")
+	}
+	// The statement without its semicolon, so a condition can go at its
+	// end.
+	q = stmts[0]
+	if kind, _ := classifyStatement(q); kind != "select" {
+		return refuse("only SELECT statements are allowed, not %s", strings.ToUpper(kind))
+	}
+
+	toks := sqlTokens(q)
+	// The main SELECT is the first one outside parentheses; a WITH list
+	// comes before it.
+	depth, main := 0, -1
+	for i, t := range toks {
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		w := t.word()
+		if i+1 < len(toks) && toks[i+1].text == "(" {
+			if rowAggregates[w] {
+				return refuse("%s returns every row it aggregates", strings.ToLower(w))
+			}
+		}
+		if w == "OVER" {
+			return refuse("window functions return a value for every row")
+		}
+		if depth == 0 && w == "SELECT" && main < 0 {
+			main = i
+		}
+	}
+	if main < 0 {
+		return refuse("only SELECT statements are allowed")
+	}
+
+	// Walk the main query's clauses at its own depth, noting where a
+	// HAVING condition goes.
+	var (
+		clause     = "SELECT"
+		aggregates bool
+		grouped    bool
+		havingAt   = -1 // the offset just past HAVING
+		insertAt   = len(q)
+	)
+	depth = 0
+	for i := main + 1; i < len(toks); i++ {
+		t := toks[i]
+		switch t.text {
+		case "(":
+			if clause == "SELECT" && i+1 < len(toks) && (toks[i+1].word() == "SELECT" || toks[i+1].word() == "WITH") {
+				return refuse("subqueries are not allowed among the selected columns")
+			}
+			depth++
+			continue
+		case ")":
+			depth--
+			continue
+		}
+		w := t.word()
+		if clause == "SELECT" && aggregateFuncs[w] && i+1 < len(toks) && toks[i+1].text == "(" {
+			aggregates = true
+		}
+		if depth > 0 {
+			continue
+		}
+		switch w {
+		case "UNION", "INTERSECT", "EXCEPT", "MINUS":
+			return refuse("%s is not allowed", w)
+		case "INTO":
+			if clause == "SELECT" {
+				return refuse("SELECT INTO is not allowed")
+			}
+		case "WINDOW":
+			return refuse("window functions return a value for every row")
+		case "FROM", "WHERE":
+			clause = w
+		case "GROUP":
+			clause, grouped = w, true
+		case "HAVING":
+			clause, havingAt = w, t.end
+		case "ORDER", "LIMIT", "OFFSET", "FETCH", "FOR":
+			if clause != "ORDER" && clause != "LIMIT" && insertAt == len(q) {
+				insertAt = t.end - len(t.text)
+			}
+			clause = "LIMIT"
+			if w == "ORDER" {
+				clause = "ORDER"
+			}
+		}
+	}
+	if !aggregates && !grouped {
+		return refuse("queries must aggregate, with functions such as count() or sum(), or GROUP BY")
+	}
+
+	size := c.MinGroupSize
+	if size <= 0 {
+		size = defaultMinGroupSize
+	}
+	// The condition starts on a line of its own, so a comment before it
+	// can't swallow it.
+	cond := fmt.Sprintf("\nHAVING count(*) >= %d", size)
+	if havingAt >= 0 {
+		// The query's own condition is kept intact, whatever its
+		// operators.
+		cond = fmt.Sprintf("\nHAVING (%s\n) AND count(*) >= %d", strings.TrimSpace(q[havingAt:insertAt]), size)
+		q = q[:havingAt-len("HAVING")] + q[insertAt:]
+		insertAt = havingAt - len("HAVING")
+	}
+	if insertAt < len(q) {
+		cond += "\n"
+	}
+	return q[:insertAt] + cond + q[insertAt:], nil
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAggregateSQL(t *testing.T) {
+	c := &connection{Name: "stats", AggregateOnly: true, MinGroupSize: 5, Connector: &sqlConnector{flavor: "postgres"}}
+	tests := []struct {
+		sql  string
+		want string
+		err  string
+	}{
+		{sql: "SELECT count(*) FROM users", want: "SELECT count(*) FROM users\nHAVING count(*) >= 5"},
+		{sql: "SELECT country, round(avg(age), 1) FROM users GROUP BY country ORDER BY 2 DESC LIMIT 10;",
+			want: "SELECT country, round(avg(age), 1) FROM users GROUP BY country \nHAVING count(*) >= 5\nORDER BY 2 DESC LIMIT 10"},
+		{sql: "SELECT plan FROM users GROUP BY plan HAVING sum(seats) > 3 OR max(seats) = 1 -- big plans",
+			want: "SELECT plan FROM users GROUP BY plan \nHAVING (sum(seats) > 3 OR max(seats) = 1 -- big plans\n) AND count(*) >= 5"},
+		{sql: "WITH active AS (SELECT * FROM users WHERE active) SELECT count(*) FROM active -- note",
+			want: "WITH active AS (SELECT * FROM users WHERE active) SELECT count(*) FROM active -- note\nHAVING count(*) >= 5"},
+		{sql: "SELECT extract(year FROM created_at) AS y, count(*) FROM orders WHERE id IN (SELECT order_id FROM items) GROUP BY 1",
+			want: "SELECT extract(year FROM created_at) AS y, count(*) FROM orders WHERE id IN (SELECT order_id FROM items) GROUP BY 1\nHAVING count(*) >= 5"},
+		{sql: "SELECT * FROM users", err: "queries must aggregate"},
+		{sql: "SELECT email FROM users WHERE id = 1", err: "queries must aggregate"},
+		{sql: "SELECT count(*) FROM users UNION SELECT count(*) FROM orders", err: "UNION is not allowed"},
+		{sql: "SELECT string_agg(email, ',') FROM users", err: "string_agg returns every row it aggregates"},
+		{sql: "SELECT id, count(*) OVER () FROM users", err: "window functions"},
+		{sql: "SELECT count(*), (SELECT email FROM users LIMIT 1) FROM users", err: "subqueries are not allowed among the selected columns"},
+		{sql: "SELECT count(*) INTO tally FROM users", err: "SELECT INTO is not allowed"},
+		{sql: "DELETE FROM users", err: "only SELECT statements are allowed, not DELETE"},
+		{sql: "SELECT count(*) FROM users; SELECT * FROM users", err: "send one statement at a time"},
+	}
+	for _, tc := range tests {
+		got, err := aggregateSQL(c, tc.sql)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) || errorCode(err) != codePolicyDenied {
+				t.Errorf("aggregateSQL(%q) = %q, %v, want an error with %q", tc.sql, got, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("aggregateSQL(%q) = %q, %v, want %q", tc.sql, got, err, tc.want)
+		}
+	}
+
+	c.MinGroupSize = 0
+	if got, _ := aggregateSQL(c, "SELECT count(*) FROM t"); !strings.HasSuffix(got, "count(*) >= 10") {
+		t.Errorf("expected the default minimum group size, got %q", got)
+	}
+}
+
+func TestAggregateOnlyConnection(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	tn := testTenant(&connection{Name: "stats", AggregateOnly: true, Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT plan, count(*) FROM users GROUP BY plan\nHAVING count(*) >= 10")).
+		WillReturnRows(sqlmock.NewRows([]string{"plan", "count"}).AddRow("pro", 12))
+	resp := runQuery(Message{ID: "q1", Type: "query", SQL: "SELECT plan, count(*) FROM users GROUP BY plan", tenant: tn})
+	if resp.Error != "" || len(resp.Rows) != 1 {
+		t.Errorf("unexpected aggregate result: %+v", resp)
+	}
+
+	if resp := runQuery(Message{ID: "q2", Type: "query", SQL: "SELECT * FROM users", tenant: tn}); resp.ErrorCode != codePolicyDenied {
+		t.Errorf("expected a row-level query to be refused, got %+v", resp)
+	}
+	for _, typ := range []string{"preview_table", "fetch_cell", "download_blob", "call"} {
+		if resp, ok := handleMessage(Message{ID: "m1", Type: typ, tenant: tn}).(QueryResponse); !ok || resp.ErrorCode != codePolicyDenied {
+			t.Errorf("expected %s to be refused, got %+v", typ, resp)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
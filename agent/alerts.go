@@ -0,0 +1,389 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertConfig is a threshold alert the agent evaluates itself: SQL runs
+// on Connection every Every, and the alert fires once Condition has held
+// for For. Notifications go to the hub as "alert" messages and, when
+// Webhook is set, are posted there as JSON with Headers.
+type AlertConfig struct {
+	Name       string   `json:"name"`
+	Connection string   `json:"connection"`
+	SQL        string   `json:"sql"`
+	Every      duration `json:"every"`
+	// Condition compares the first column of the query's first row, or
+	// 0 when it returns no rows, with a number, such as "> 100".
+	Condition string `json:"condition"`
+	// For is how long the condition must hold before the alert fires;
+	// zero fires on the first evaluation that meets it. Repeat, when
+	// set, sends a firing alert again that often.
+	For     duration          `json:"for,omitempty"`
+	Repeat  duration          `json:"repeat,omitempty"`
+	Webhook string            `json:"webhook,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// check reports mistakes in the settings before anything connects.
+func (a *AlertConfig) check() error {
+	switch {
+	case a.Name == "" || a.Connection == "" || a.SQL == "" || a.Condition == "":
+		return fmt.Errorf("name, connection, sql and condition are required")
+	case time.Duration(a.Every) < 10*time.Second:
+		return fmt.Errorf("every must be at least 10s")
+	case a.For < 0 || a.Repeat < 0:
+		return fmt.Errorf("for and repeat must not be negative")
+	case a.Webhook != "" && !strings.HasPrefix(a.Webhook, "http://") && !strings.HasPrefix(a.Webhook, "https://"):
+		return fmt.Errorf("webhook must be an http or https url")
+	}
+	_, err := parseAlertCondition(a.Condition)
+	return err
+}
+
+// alertCondition is a parsed Condition: a comparison with a threshold.
+type alertCondition struct {
+	op        string
+	threshold float64
+}
+
+func parseAlertCondition(s string) (alertCondition, error) {
+	s = strings.TrimSpace(s)
+	// Two-character operators first, so ">=" isn't read as ">".
+	for _, op := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		if rest, ok := strings.CutPrefix(s, op); ok {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(rest), 64); err == nil {
+				return alertCondition{op: op, threshold: v}, nil
+			}
+			break
+		}
+	}
+	return alertCondition{}, fmt.Errorf("condition %q must be >, >=, <, <=, == or != and a number, such as \"> 100\"", s)
+}
+
+func (c alertCondition) met(v float64) bool {
+	switch c.op {
+	case ">":
+		return v > c.threshold
+	case ">=":
+		return v >= c.threshold
+	case "<":
+		return v < c.threshold
+	case "<=":
+		return v <= c.threshold
+	case "==":
+		return v == c.threshold
+	default:
+		return v != c.threshold
+	}
+}
+
+// alertValue is the number an alert's query returned: its first row's
+// first column, or 0 when it returned no rows, so a query that looks for
+// bad rows can alert on "> 0".
+func alertValue(resp QueryResponse) (float64, error) {
+	if len(resp.Rows) == 0 || len(resp.Rows[0]) == 0 {
+		return 0, nil
+	}
+	switch v := resp.Rows[0][0].(type) {
+	case nil:
+		return 0, fmt.Errorf("the query returned null")
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case []byte:
+		return alertValue(QueryResponse{Rows: [][]any{{string(v)}}})
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("the query returned %q, not a number", v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("the query returned a %T, not a number", v)
+	}
+}
+
+// AlertEvent is an alert notification. Status is "firing" once the
+// condition has held for For, and again every Repeat while it does;
+// "resolved" when a firing alert's condition stops holding; or "error"
+// when its query starts failing.
+type AlertEvent struct {
+	Agent      string    `json:"agent,omitempty"`
+	Name       string    `json:"name"`
+	Connection string    `json:"connection"`
+	Status     string    `json:"status"`
+	Condition  string    `json:"condition"`
+	Value      *float64  `json:"value,omitempty"`
+	Since      time.Time `json:"since,omitempty"`
+	At         time.Time `json:"at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AlertState is where an alert stands: State is "ok", "pending" while
+// the condition holds for less than For, or "firing". Since is when the
+// condition started holding, and Error the last evaluation's, if it
+// failed.
+type AlertState struct {
+	Name        string    `json:"name"`
+	Connection  string    `json:"connection"`
+	Condition   string    `json:"condition"`
+	State       string    `json:"state"`
+	Value       *float64  `json:"value,omitempty"`
+	Since       time.Time `json:"since,omitempty"`
+	EvaluatedAt time.Time `json:"evaluated_at,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// AlertResponse reports an alert notification to the hub as "alert", and
+// answers an "alerts" message with the state of every alert on the
+// token's connections.
+type AlertResponse struct {
+	ID        string       `json:"id,omitempty"`
+	Type      string       `json:"type"`
+	Alert     *AlertEvent  `json:"alert,omitempty"`
+	Alerts    []AlertState `json:"alerts,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	ErrorCode string       `json:"error_code,omitempty"`
+}
+
+// alertRule is a configured alert and its state between evaluations.
+type alertRule struct {
+	AlertConfig
+	cond alertCondition
+	conn *connection
+	// agent is the agent's --name, for notifications.
+	agent string
+
+	mu        sync.Mutex
+	state     string
+	since     time.Time
+	sent      time.Time
+	value     *float64
+	evaluated time.Time
+	err       string
+}
+
+// observe records one evaluation at now and returns the notification it
+// calls for, if any. A failure is reported once, when the query starts
+// failing, and leaves the alert's state as it was.
+func (r *alertRule) observe(v float64, err error, now time.Time) *AlertEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evaluated = now
+	ev := &AlertEvent{Agent: r.agent, Name: r.Name, Connection: r.Connection, Condition: r.Condition, At: now.UTC()}
+	if err != nil {
+		first := r.err == ""
+		r.err = err.Error()
+		if !first {
+			return nil
+		}
+		ev.Status, ev.Error = "error", r.err
+		return ev
+	}
+	r.err = ""
+	r.value = &v
+	ev.Value = &v
+
+	if !r.cond.met(v) {
+		was := r.state
+		r.state, r.since = "ok", time.Time{}
+		if was != "firing" {
+			return nil
+		}
+		ev.Status = "resolved"
+		return ev
+	}
+	if r.state == "ok" {
+		r.state, r.since = "pending", now
+	}
+	ev.Since = r.since.UTC()
+	switch {
+	case r.state == "pending" && now.Sub(r.since) >= time.Duration(r.For):
+		r.state = "firing"
+	case r.state == "firing" && r.Repeat > 0 && now.Sub(r.sent) >= time.Duration(r.Repeat):
+	default:
+		return nil
+	}
+	r.sent = now
+	ev.Status = "firing"
+	return ev
+}
+
+func (r *alertRule) status() AlertState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return AlertState{Name: r.Name, Connection: r.Connection, Condition: r.Condition, State: r.state, Value: r.value,
+		Since: r.since.UTC(), EvaluatedAt: r.evaluated.UTC(), Error: r.err}
+}
+
+// alertScheduler evaluates the configured alerts and notifies the
+// tenants serving their connections.
+type alertScheduler struct {
+	ctx     context.Context
+	agent   *Agent
+	rules   map[string]*alertRule
+	tenants []*tenant
+	client  *http.Client
+}
+
+// startAlerts checks the alerts against a's connections and evaluates
+// them until ctx is cancelled.
+func startAlerts(ctx context.Context, a *Agent, configs []AlertConfig, tenants []*tenant) (*alertScheduler, error) {
+	s := &alertScheduler{ctx: ctx, agent: a, rules: map[string]*alertRule{}, tenants: tenants, client: &http.Client{Timeout: 10 * time.Second}}
+	for _, cfg := range configs {
+		if s.rules[cfg.Name] != nil {
+			return nil, fmt.Errorf("alert %q is defined twice", cfg.Name)
+		}
+		var conn *connection
+		for _, c := range a.connections {
+			if c.Name == cfg.Connection {
+				conn = c
+			}
+		}
+		if conn == nil {
+			return nil, fmt.Errorf("alert %q: no connection is named %q", cfg.Name, cfg.Connection)
+		}
+		if _, ok := conn.Connector.(*sqlConnector); ok {
+			if stmts := splitStatements(cfg.SQL); len(stmts) != 1 {
+				return nil, fmt.Errorf("alert %q: sql must be one statement", cfg.Name)
+			}
+			if kind, _ := classifyStatements(cfg.SQL); !readStatements[kind] {
+				return nil, fmt.Errorf("alert %q: sql must be a read, not %s", cfg.Name, strings.ToUpper(kind))
+			}
+		}
+		cond, err := parseAlertCondition(cfg.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("alert %q: %w", cfg.Name, err)
+		}
+		s.rules[cfg.Name] = &alertRule{AlertConfig: cfg, cond: cond, conn: conn, agent: a.opts.ConnName, state: "ok"}
+	}
+	for _, r := range s.rules {
+		log.Printf("Alert %q: %s every %s when %s", r.Name, r.Connection, time.Duration(r.Every), r.Condition)
+		go s.schedule(r)
+	}
+	return s, nil
+}
+
+// schedule evaluates r every Every. A standby agent, one in maintenance
+// mode, or one that isn't the connection's elected leader skips the
+// evaluation, so agents sharing a connection don't alert twice.
+func (s *alertScheduler) schedule(r *alertRule) {
+	a := s.agent
+	defer a.reporter.reportPanic()
+	ticker := time.NewTicker(time.Duration(r.Every))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if sc, ok := r.conn.Connector.(*sqlConnector); !a.standby.active() || a.maintenance.active() || ok && sc.elector != nil && !sc.elector.isLeader() {
+			continue
+		}
+		done := a.maintenance.begin()
+		s.evaluate(r)
+		done()
+	}
+}
+
+// evaluate runs r's query, given at most Every to finish, and sends the
+// notification the result calls for. An evaluation cut short by shutdown
+// is dropped.
+func (s *alertScheduler) evaluate(r *alertRule) *AlertEvent {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(r.Every))
+	defer cancel()
+	resp := s.agent.execute(r.conn, Message{Type: "query", ID: "alert:" + r.Name, SQL: r.SQL, ctx: ctx})
+	if s.ctx.Err() != nil {
+		return nil
+	}
+	var v float64
+	var err error
+	if resp.Error != "" {
+		err = fmt.Errorf("%s", resp.Error)
+	} else {
+		v, err = alertValue(resp)
+	}
+	ev := r.observe(v, err, time.Now())
+	if ev != nil {
+		s.notify(r, ev)
+	}
+	return ev
+}
+
+// notify reports ev to every tenant serving the alert's connection, where
+// the outbox keeps it for a tenant that is away, and to its webhook.
+func (s *alertScheduler) notify(r *alertRule, ev *AlertEvent) {
+	if ev.Error != "" {
+		log.Printf("[alert:%s] Evaluation failed: %s", r.Name, ev.Error)
+	} else {
+		log.Printf("[alert:%s] %s: %v, alerting when %s", r.Name, ev.Status, *ev.Value, r.Condition)
+	}
+	for _, t := range s.tenants {
+		if t.serves(r.conn) {
+			t.reply(Message{}, AlertResponse{Type: "alert", Alert: ev})
+		}
+	}
+	if r.Webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(ev)
+	req, err := http.NewRequestWithContext(s.ctx, "POST", r.Webhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[alert:%s] Webhook failed: %v", r.Name, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("[alert:%s] Webhook failed: %v", r.Name, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[alert:%s] Webhook failed: %s", r.Name, resp.Status)
+	}
+}
+
+// alertStatus answers an "alerts" message with the state of the alerts on
+// connections the token serves, by name.
+func alertStatus(msg Message) AlertResponse {
+	resp := AlertResponse{ID: msg.ID, Type: "alerts"}
+	alerts := msg.agent().alerts
+	if alerts == nil {
+		return resp
+	}
+	for _, r := range alerts.rules {
+		if msg.tenant == nil || msg.tenant.serves(r.conn) {
+			resp.Alerts = append(resp.Alerts, r.status())
+		}
+	}
+	sort.Slice(resp.Alerts, func(i, j int) bool { return resp.Alerts[i].Name < resp.Alerts[j].Name })
+	return resp
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAlertConfigCheck(t *testing.T) {
+	ok := AlertConfig{Name: "failed_jobs", Connection: "main", SQL: "SELECT count(*) FROM failed_jobs", Every: duration(time.Minute), Condition: "> 100"}
+	tests := []struct {
+		change func(*AlertConfig)
+		err    string
+	}{
+		{change: func(*AlertConfig) {}},
+		{change: func(a *AlertConfig) { a.Condition = "" }, err: "name, connection, sql and condition are required"},
+		{change: func(a *AlertConfig) { a.Every = duration(time.Second) }, err: "every must be at least 10s"},
+		{change: func(a *AlertConfig) { a.For = duration(-time.Minute) }, err: "for and repeat must not be negative"},
+		{change: func(a *AlertConfig) { a.Webhook = "hooks.example.com" }, err: "webhook must be an http or https url"},
+		{change: func(a *AlertConfig) { a.Condition = "above 100" }, err: `condition "above 100" must be >, >=, <, <=, == or != and a number, such as "> 100"`},
+		{change: func(a *AlertConfig) { a.Condition = ">= lots" }, err: `condition ">= lots" must be >, >=, <, <=, == or != and a number, such as "> 100"`},
+	}
+	for _, tc := range tests {
+		a := ok
+		tc.change(&a)
+		err := a.check()
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Errorf("check(%+v) = %v, want %q", a, err, tc.err)
+		}
+	}
+}
+
+func TestAlertCondition(t *testing.T) {
+	tests := []struct {
+		cond string
+		v    float64
+		want bool
+	}{
+		{">100", 101, true},
+		{"> 100", 100, false},
+		{">= 100", 100, true},
+		{"< 0.5", 0.25, true},
+		{"<= -1", 0, false},
+		{"== 0", 0, true},
+		{"!= 0", 0, false},
+	}
+	for _, tc := range tests {
+		c, err := parseAlertCondition(tc.cond)
+		if err != nil || c.met(tc.v) != tc.want {
+			t.Errorf("%q on %v = %v, %v, want %v", tc.cond, tc.v, c.met(tc.v), err, tc.want)
+		}
+	}
+}
+
+func TestAlertValue(t *testing.T) {
+	tests := []struct {
+		rows [][]any
+		want float64
+		err  string
+	}{
+		{rows: [][]any{{int64(120)}}, want: 120},
+		{rows: [][]any{{"12.5", "ignored"}}, want: 12.5},
+		{rows: [][]any{{[]byte("7")}}, want: 7},
+		{rows: [][]any{{true}}, want: 1},
+		{rows: nil, want: 0},
+		{rows: [][]any{{nil}}, err: "the query returned null"},
+		{rows: [][]any{{"stuck"}}, err: `the query returned "stuck", not a number`},
+	}
+	for _, tc := range tests {
+		got, err := alertValue(QueryResponse{Rows: tc.rows})
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err || got != tc.want {
+			t.Errorf("alertValue(%v) = %v, %v, want %v, %q", tc.rows, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestAlertObserve(t *testing.T) {
+	cond, _ := parseAlertCondition("> 100")
+	r := &alertRule{AlertConfig: AlertConfig{Name: "failed_jobs", For: duration(2 * time.Minute), Repeat: duration(10 * time.Minute)}, cond: cond, state: "ok"}
+	start := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	steps := []struct {
+		minute int
+		value  float64
+		err    error
+		want   string // the notification's status, if any
+		state  string
+	}{
+		{minute: 0, value: 5, state: "ok"},
+		{minute: 1, value: 150, state: "pending"},
+		{minute: 2, value: 150, state: "pending"},
+		{minute: 3, value: 150, want: "firing", state: "firing"},
+		{minute: 4, err: errors.New("connection refused"), want: "error", state: "firing"},
+		{minute: 5, err: errors.New("connection refused"), state: "firing"},
+		{minute: 6, value: 140, state: "firing"},
+		{minute: 13, value: 130, want: "firing", state: "firing"},
+		{minute: 14, value: 90, want: "resolved", state: "ok"},
+		{minute: 15, value: 200, state: "pending"},
+		{minute: 16, value: 20, state: "ok"},
+	}
+	for _, s := range steps {
+		ev := r.observe(s.value, s.err, start.Add(time.Duration(s.minute)*time.Minute))
+		got := ""
+		if ev != nil {
+			got = ev.Status
+		}
+		if got != s.want || r.state != s.state {
+			t.Fatalf("minute %d: got notification %q in state %q, want %q in %q", s.minute, got, r.state, s.want, s.state)
+		}
+		if got == "firing" && !ev.Since.Equal(start.Add(time.Minute)) {
+			t.Errorf("minute %d: expected the alert to be pending since minute 1, got %v", s.minute, ev.Since)
+		}
+	}
+}
+
+func TestAlertEvaluate(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	got := make(chan AlertEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev AlertEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		if r.Header.Get("Authorization") != "Bearer hook" {
+			ev.Status = "unauthorized"
+		}
+		got <- ev
+	}))
+	defer hook.Close()
+
+	conn := &connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}}
+	other := &connection{Name: "other", Connector: &sqlConnector{flavor: "postgres"}}
+	a := testAgent(conn, other)
+	s, err := startAlerts(context.Background(), a, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cond, _ := parseAlertCondition("> 100")
+	r := &alertRule{AlertConfig: AlertConfig{Name: "failed_jobs", Connection: "main", SQL: "SELECT count(*) FROM failed_jobs", Every: duration(time.Minute),
+		Condition: "> 100", Webhook: hook.URL, Headers: map[string]string{"Authorization": "Bearer hook"}}, cond: cond, conn: conn, state: "ok"}
+	s.rules[r.Name] = r
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT count").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(120)))
+	if ev := s.evaluate(r); ev == nil || ev.Status != "firing" || *ev.Value != 120 {
+		t.Fatalf("expected the alert to fire, got %+v", ev)
+	}
+	select {
+	case ev := <-got:
+		if ev.Status != "firing" || ev.Name != "failed_jobs" || ev.Value == nil || *ev.Value != 120 {
+			t.Errorf("unexpected webhook payload: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't called")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	a.alerts = s
+	if resp := alertStatus(Message{ID: "a1", tenant: &tenant{agent: a, conns: []*connection{other}}}); len(resp.Alerts) != 0 {
+		t.Errorf("expected no alerts for a token without the connection, got %+v", resp.Alerts)
+	}
+	resp := alertStatus(Message{ID: "a2", tenant: &tenant{agent: a, conns: []*connection{conn}}})
+	if len(resp.Alerts) != 1 || resp.Alerts[0].State != "firing" || *resp.Alerts[0].Value != 120 {
+		t.Errorf("unexpected alert states: %+v", resp.Alerts)
+	}
+
+	for _, cfg := range []AlertConfig{
+		{Name: "x", Connection: "nope", SQL: "SELECT 1", Condition: "> 0"},
+		{Name: "x", Connection: "main", SQL: "DELETE FROM failed_jobs", Condition: "> 0"},
+		{Name: "x", Connection: "main", SQL: "SELECT 1; SELECT 2", Condition: "> 0"},
+	} {
+		if _, err := startAlerts(context.Background(), testAgent(conn), []AlertConfig{cfg}, nil); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		}
+	}
+}
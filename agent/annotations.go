@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Annotation tells the user something about a result they might otherwise
+// misread, such as that it was cut short. The hub shows Text as is; Kind
+// lets it pick an icon or group annotations.
+type Annotation struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+// Kinds of the annotations the agent adds itself. Middleware may use its
+// own, e.g. "cache" or "masked".
+const (
+	annotationRowLimit   = "row_limit"
+	annotationTruncated  = "truncated"
+	annotationRouted     = "routed"
+	annotationSpilled    = "spilled"
+	annotationColdStart  = "cold_start"
+	annotationTieBreaker = "tie_breaker"
+)
+
+// Annotate adds an annotation of kind to resp.
+func (resp *QueryResponse) Annotate(kind, format string, args ...any) {
+	resp.Annotations = append(resp.Annotations, Annotation{Kind: kind, Text: fmt.Sprintf(format, args...)})
+}
+
+// annotationsMiddleware explains what the built-in steps did to a result.
+// It runs after the configured middleware's inner steps and before their
+// outer ones, so their annotations follow the agent's own.
+type annotationsMiddleware struct{ a *Agent }
+
+func (annotationsMiddleware) Name() string { return "annotations" }
+
+func (m annotationsMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		resp := next(q)
+		if resp.Error == "" {
+			m.a.annotate(q, &resp)
+		}
+		return resp
+	}
+}
+
+func (a *Agent) annotate(q *Query, resp *QueryResponse) {
+	if q.Target != "" && q.Target != q.Connection {
+		ro := ""
+		if q.conn.ReadOnly {
+			ro = " read-only"
+		}
+		resp.Annotate(annotationRouted, "Routed to%s connection %q for target %q", ro, q.Connection, q.Target)
+	}
+	if resp.ColdStartMillis > 0 {
+		resp.Annotate(annotationColdStart, "Reconnected in %dms: the connection had been closed while idle", resp.ColdStartMillis)
+	}
+	if len(resp.TieBreaker) > 0 {
+		resp.Annotate(annotationTieBreaker, "Also ordered by %s, so pages don't overlap", strings.Join(resp.TieBreaker, ", "))
+	}
+	if resp.spill != nil {
+		resp.Annotate(annotationSpilled, "Result is over %d bytes; sent from disk", a.opts.MaxResultBytes)
+	}
+	if resp.RowLimit > 0 {
+		resp.Annotate(annotationRowLimit, "Result cut to %d rows, the token's max_rows", resp.RowLimit)
+	}
+	a.annotateTruncated(resp, len(resp.Truncated))
+}
+
+// annotateTruncated notes n cells cut to --max-cell-bytes.
+func (a *Agent) annotateTruncated(resp *QueryResponse, n int) {
+	if n == 0 {
+		return
+	}
+	noun := "cells"
+	if n == 1 {
+		noun = "cell"
+	}
+	resp.Annotate(annotationTruncated, "%d %s cut to %d bytes; fetch_cell reads the rest", n, noun, a.currentMaxCellBytes())
+}
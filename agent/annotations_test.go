@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAnnotations(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(
+		&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+		&connection{Name: "db-ro-2", Labels: map[string]string{"role": "replica"}, ReadOnly: true, Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+	)
+	tn.agent.settings.maxCellBytes = 8
+	tn.setCapabilities(&Capabilities{MaxRows: 2})
+
+	tests := []struct {
+		name   string
+		target string
+		rows   *sqlmock.Rows
+		kinds  []string
+		text   string
+	}{
+		{"plain", "main", sqlmock.NewRows([]string{"id"}).AddRow(1), nil, ""},
+		{"row limit", "", sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3), []string{annotationRowLimit}, "Result cut to 2 rows"},
+		{"truncated", "main", sqlmock.NewRows([]string{"note"}).AddRow(strings.Repeat("x", 20)), []string{annotationTruncated}, "1 cell cut to 8 bytes"},
+		{"routed", "role=replica", sqlmock.NewRows([]string{"id"}).AddRow(1), []string{annotationRouted}, `Routed to read-only connection "db-ro-2" for target "role=replica"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+			mock.ExpectQuery("SELECT").WillReturnRows(tc.rows)
+			resp := runQuery(Message{ID: "q1", Type: "query", SQL: "SELECT * FROM orders", Target: tc.target, tenant: tn})
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			var kinds []string
+			for _, a := range resp.Annotations {
+				kinds = append(kinds, a.Kind)
+			}
+			if !reflect.DeepEqual(kinds, tc.kinds) {
+				t.Fatalf("expected annotations %v, got %+v", tc.kinds, resp.Annotations)
+			}
+			if tc.text != "" && !strings.Contains(resp.Annotations[0].Text, tc.text) {
+				t.Errorf("expected %q in %q", tc.text, resp.Annotations[0].Text)
+			}
+		})
+	}
+
+	// Middleware annotations follow the agent's own.
+	tn.agent.handler = tn.agent.queryChain([]QueryMiddleware{cacheMiddleware{}})
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3))
+	resp := runQuery(Message{ID: "q2", Type: "query", SQL: "SELECT id FROM orders", tenant: tn})
+	if len(resp.Annotations) != 2 || resp.Annotations[0].Kind != annotationRowLimit || resp.Annotations[1].Kind != "cache" {
+		t.Errorf("expected row_limit then cache, got %+v", resp.Annotations)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+type cacheMiddleware struct{}
+
+func (cacheMiddleware) Name() string { return "cache" }
+
+func (cacheMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		resp := next(q)
+		resp.Annotate("cache", "Served from cache")
+		return resp
+	}
+}
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnonymizeConfig rewrites columns of export job results before they are
+// stored, so a dataset taken out of production keeps its shape without its
+// personal data. It is the "anonymize" object of the config file.
+type AnonymizeConfig struct {
+	// Salt keys hash and fake, so a value maps to the same output in every
+	// export, which keeps joins between exports working, but can't be
+	// found by hashing likely values. An empty salt is random for each
+	// start of the agent.
+	Salt  string          `json:"salt,omitempty"`
+	Rules []AnonymizeRule `json:"rules"`
+}
+
+// AnonymizeRule rewrites the columns whose names match Column, a regular
+// expression, in exports from the connections Connections selects (names,
+// globs or label selectors, as in a message's target), or from every
+// connection when it is empty. The first matching rule applies.
+type AnonymizeRule struct {
+	Column      string   `json:"column"`
+	Connections []string `json:"connections,omitempty"`
+	// Transform is "hash", "fake", "bucket" or "null".
+	Transform string `json:"transform"`
+	// Fake is the kind of value fake substitutes; see fakeKinds.
+	Fake string `json:"fake,omitempty"`
+	// Size is the width of a bucket of numbers, and Unit the hour, day,
+	// month or year a bucket of times is truncated to.
+	Size float64 `json:"size,omitempty"`
+	Unit string  `json:"unit,omitempty"`
+}
+
+// fakeKinds are the values fake can substitute. text keeps the value's
+// shape, replacing letters with letters and digits with digits.
+var fakeKinds = map[string]bool{
+	"name": true, "first_name": true, "last_name": true, "email": true,
+	"phone": true, "city": true, "company": true, "uuid": true, "text": true,
+}
+
+var bucketUnits = map[string]bool{"hour": true, "day": true, "month": true, "year": true}
+
+var (
+	fakeFirstNames = []string{
+		"Ada", "Alan", "Amara", "Ben", "Carmen", "Chen", "Dana", "Diego", "Elena", "Farah",
+		"Grace", "Hiro", "Ines", "Jonas", "Kemal", "Lena", "Marta", "Noah", "Olu", "Priya",
+		"Quinn", "Rosa", "Sami", "Tomas", "Uma", "Viktor", "Wen", "Yara", "Zoe", "Leo",
+	}
+	fakeLastNames = []string{
+		"Abbott", "Berg", "Costa", "Dubois", "Eriksen", "Fischer", "Garcia", "Haddad", "Ito",
+		"Jensen", "Kowalski", "Lind", "Moreau", "Nakamura", "Okafor", "Petrov", "Quist",
+		"Rossi", "Silva", "Tanaka", "Ueda", "Varga", "Weber", "Xu", "Young", "Zimmer",
+	}
+	fakeCities = []string{
+		"Springfield", "Riverton", "Fairview", "Lakewood", "Greenville", "Ashford", "Milton",
+		"Clayton", "Brookside", "Oakridge", "Westport", "Hillcrest", "Kingsley", "Marlow",
+	}
+	fakeCompanies = []string{
+		"Acme", "Globex", "Initech", "Umbrella", "Hooli", "Vandelay", "Stark", "Wonka",
+		"Tyrell", "Cyberdyne", "Soylent", "Gringotts", "Monarch", "Oscorp",
+	}
+)
+
+type anonymizeRule struct {
+	AnonymizeRule
+	column *regexp.Regexp
+}
+
+type anonymizer struct {
+	salt  []byte
+	rules []anonymizeRule
+}
+
+func newAnonymizer(cfg *AnonymizeConfig) (*anonymizer, error) {
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	a := &anonymizer{salt: []byte(cfg.Salt)}
+	if cfg.Salt == "" {
+		a.salt = make([]byte, 32)
+		rand.Read(a.salt)
+	}
+	for i, r := range cfg.Rules {
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("anonymize rule %d: %w", i+1, err)
+		}
+		re, err := regexp.Compile(r.Column)
+		if err != nil {
+			return nil, fmt.Errorf("anonymize rule %d: column pattern %q: %w", i+1, r.Column, err)
+		}
+		a.rules = append(a.rules, anonymizeRule{AnonymizeRule: r, column: re})
+	}
+	return a, nil
+}
+
+func (r AnonymizeRule) check() error {
+	if r.Column == "" {
+		return fmt.Errorf("column is required")
+	}
+	switch r.Transform {
+	case "hash", "null":
+	case "fake":
+		if !fakeKinds[r.Fake] {
+			return fmt.Errorf("unknown fake %q: expected name, first_name, last_name, email, phone, city, company, uuid or text", r.Fake)
+		}
+	case "bucket":
+		if (r.Size > 0) == (r.Unit != "") {
+			return fmt.Errorf("bucket needs either a size, for numbers, or a unit, for times")
+		}
+		if r.Unit != "" && !bucketUnits[r.Unit] {
+			return fmt.Errorf("unknown unit %q: expected hour, day, month or year", r.Unit)
+		}
+	default:
+		return fmt.Errorf("unknown transform %q: expected hash, fake, bucket or null", r.Transform)
+	}
+	return nil
+}
+
+// rule returns the rule for column in exports from c, if any.
+func (a *anonymizer) rule(c *connection, column string) *anonymizeRule {
+	for i, r := range a.rules {
+		if !r.column.MatchString(column) {
+			continue
+		}
+		if len(r.Connections) == 0 {
+			return &a.rules[i]
+		}
+		for _, target := range r.Connections {
+			if c.matches(target) {
+				return &a.rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// apply rewrites resp's rows in place for an export from c and returns
+// the columns it rewrote.
+func (a *anonymizer) apply(c *connection, resp *QueryResponse) []string {
+	if a == nil {
+		return nil
+	}
+	var names []string
+	rules := make([]*anonymizeRule, len(resp.Columns))
+	for i, col := range resp.Columns {
+		if rules[i] = a.rule(c, col); rules[i] != nil {
+			names = append(names, col)
+		}
+	}
+	if names == nil {
+		return nil
+	}
+	for _, row := range resp.Rows {
+		for i, r := range rules {
+			if r != nil && i < len(row) {
+				row[i] = a.value(r, row[i])
+			}
+		}
+	}
+	return names
+}
+
+// value is v rewritten by r. Null stays null, and a value a bucket can't
+// read becomes null rather than leaving the export as it was.
+func (a *anonymizer) value(r *anonymizeRule, v any) any {
+	if v == nil {
+		return nil
+	}
+	switch r.Transform {
+	case "hash":
+		sum := a.sum(v)
+		return hex.EncodeToString(sum[:16])
+	case "fake":
+		return fakeValue(r.Fake, a.sum(v), fmt.Sprint(v))
+	case "bucket":
+		if r.Unit != "" {
+			return bucketTime(v, r.Unit)
+		}
+		return bucketNumber(v, r.Size)
+	}
+	return nil
+}
+
+// sum is the salted HMAC of v, the seed of hash and fake.
+func (a *anonymizer) sum(v any) []byte {
+	mac := hmac.New(sha256.New, a.salt)
+	fmt.Fprint(mac, v)
+	return mac.Sum(nil)
+}
+
+// fakeValue is a value of kind picked by sum; text keeps orig's shape.
+func fakeValue(kind string, sum []byte, orig string) string {
+	n := binary.BigEndian.Uint64(sum)
+	pick := func(list []string, salt uint64) string {
+		return list[(n/salt)%uint64(len(list))]
+	}
+	first, last := pick(fakeFirstNames, 1), pick(fakeLastNames, 97)
+	switch kind {
+	case "name":
+		return first + " " + last
+	case "first_name":
+		return first
+	case "last_name":
+		return last
+	case "email":
+		// The number keeps distinct addresses distinct in all but a few
+		// cases, for columns with a unique constraint.
+		return fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(first), strings.ToLower(last), n%10000)
+	case "phone":
+		// 555-01xx numbers are reserved for fiction.
+		return fmt.Sprintf("+1-%03d-555-01%02d", 200+n%800, (n/800)%100)
+	case "city":
+		return pick(fakeCities, 1)
+	case "company":
+		return pick(fakeCompanies, 1) + " " + pick([]string{"Inc", "LLC", "Ltd", "GmbH", "Group"}, 89)
+	case "uuid":
+		b := append([]byte(nil), sum[:16]...)
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		h := hex.EncodeToString(b)
+		return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	}
+	var sb strings.Builder
+	for i, ch := range orig {
+		k := sum[i%len(sum)] + byte(i/len(sum))
+		switch {
+		case ch >= 'a' && ch <= 'z':
+			sb.WriteByte('a' + k%26)
+		case ch >= 'A' && ch <= 'Z':
+			sb.WriteByte('A' + k%26)
+		case ch >= '0' && ch <= '9':
+			sb.WriteByte('0' + k%10)
+		default:
+			sb.WriteRune(ch)
+		}
+	}
+	return sb.String()
+}
+
+// bucketNumber rounds v down to a multiple of size, keeping its type:
+// numbers the driver returns as text, such as Postgres numerics, stay
+// text.
+func bucketNumber(v any, size float64) any {
+	floor := func(f float64) float64 { return math.Floor(f/size) * size }
+	switch v := v.(type) {
+	case int64:
+		if size == math.Trunc(size) {
+			return int64(floor(float64(v)))
+		}
+		return floor(float64(v))
+	case float64:
+		return floor(v)
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return strconv.FormatFloat(floor(f), 'f', -1, 64)
+		}
+	}
+	return nil
+}
+
+// bucketTime truncates v, a time as rows carry one, to unit, keeping its
+// format.
+func bucketTime(v any, unit string) any {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		y, m, d := t.Date()
+		switch unit {
+		case "hour":
+			t = time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+		case "day":
+			t = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		case "month":
+			t = time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+		case "year":
+			t = time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+		}
+		if layout == time.RFC3339Nano {
+			layout = time.RFC3339
+		}
+		return t.Format(layout)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAnonymizeRuleCheck(t *testing.T) {
+	tests := []struct {
+		rule AnonymizeRule
+		err  string
+	}{
+		{rule: AnonymizeRule{Column: "email", Transform: "fake", Fake: "email"}},
+		{rule: AnonymizeRule{Column: "age", Transform: "bucket", Size: 10}},
+		{rule: AnonymizeRule{Transform: "hash"}, err: "column is required"},
+		{rule: AnonymizeRule{Column: "x", Transform: "shuffle"}, err: `unknown transform "shuffle": expected hash, fake, bucket or null`},
+		{rule: AnonymizeRule{Column: "x", Transform: "fake", Fake: "ssn"}, err: `unknown fake "ssn": expected name, first_name, last_name, email, phone, city, company, uuid or text`},
+		{rule: AnonymizeRule{Column: "x", Transform: "bucket", Size: 5, Unit: "day"}, err: "bucket needs either a size, for numbers, or a unit, for times"},
+		{rule: AnonymizeRule{Column: "x", Transform: "bucket", Unit: "week"}, err: `unknown unit "week": expected hour, day, month or year`},
+	}
+	for _, tc := range tests {
+		err := tc.rule.check()
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Errorf("check(%+v) = %v, want %q", tc.rule, err, tc.err)
+		}
+	}
+	if _, err := newAnonymizer(&AnonymizeConfig{Rules: []AnonymizeRule{{Column: "(", Transform: "null"}}}); err == nil {
+		t.Error("expected a bad column pattern to be refused")
+	}
+}
+
+func TestAnonymizeApply(t *testing.T) {
+	a, err := newAnonymizer(&AnonymizeConfig{Salt: "pepper", Rules: []AnonymizeRule{
+		{Column: "^email$", Transform: "fake", Fake: "email"},
+		{Column: "^ssn$", Transform: "hash"},
+		{Column: "^ssn$", Transform: "null"},
+		{Column: "^age$", Transform: "bucket", Size: 10},
+		{Column: "^signed_up$", Transform: "bucket", Unit: "month"},
+		{Column: "^note$", Transform: "null", Connections: []string{"env=prod"}},
+		{Column: "^plate$", Transform: "fake", Fake: "text"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connection{Name: "staging", Labels: map[string]string{"env": "staging"}}
+	resp := QueryResponse{
+		Columns: []string{"id", "email", "ssn", "age", "signed_up", "note", "plate"},
+		Rows: [][]any{
+			{int64(1), "ann@corp.com", "123-45-6789", int64(37), "2026-03-14T09:26:53Z", "hi", "AB-123"},
+			{int64(2), "bob@corp.com", "123-45-6789", "41.5", "2026-10-02", nil, nil},
+		},
+	}
+	got := a.apply(c, &resp)
+	if strings.Join(got, ",") != "email,ssn,age,signed_up,plate" {
+		t.Errorf("unexpected anonymized columns: %v", got)
+	}
+
+	r1, r2 := resp.Rows[0], resp.Rows[1]
+	if r1[0] != int64(1) || r1[5] != "hi" {
+		t.Errorf("expected other columns to be kept, got %v", r1)
+	}
+	if !regexp.MustCompile(`^[a-z]+\.[a-z]+\d+@example\.com$`).MatchString(r1[1].(string)) || r1[1] == r2[1] {
+		t.Errorf("unexpected fake emails: %v, %v", r1[1], r2[1])
+	}
+	if s, _ := r1[2].(string); len(s) != 32 || r1[2] != r2[2] {
+		t.Errorf("expected equal values to hash alike, got %v, %v", r1[2], r2[2])
+	}
+	if r1[3] != int64(30) || r2[3] != "40" {
+		t.Errorf("unexpected age buckets: %v, %v", r1[3], r2[3])
+	}
+	if r1[4] != "2026-03-01T00:00:00Z" || r2[4] != "2026-10-01" {
+		t.Errorf("unexpected time buckets: %v, %v", r1[4], r2[4])
+	}
+	if s, _ := r1[6].(string); !regexp.MustCompile(`^[A-Z]{2}-\d{3}$`).MatchString(s) || s == "AB-123" || r2[6] != nil {
+		t.Errorf("unexpected fake text: %v, %v", r1[6], r2[6])
+	}
+
+	// The same salt gives the same output in another export.
+	b, _ := newAnonymizer(&AnonymizeConfig{Salt: "pepper", Rules: []AnonymizeRule{{Column: "^email$", Transform: "fake", Fake: "email"}}})
+	again := QueryResponse{Columns: []string{"email"}, Rows: [][]any{{"ann@corp.com"}}}
+	b.apply(c, &again)
+	if again.Rows[0][0] != r1[1] {
+		t.Errorf("expected a stable fake, got %v and %v", again.Rows[0][0], r1[1])
+	}
+
+	// A value a bucket can't read is dropped rather than kept.
+	odd := QueryResponse{Columns: []string{"age"}, Rows: [][]any{{"unknown"}}}
+	a.apply(c, &odd)
+	if odd.Rows[0][0] != nil {
+		t.Errorf("expected an unreadable value to become null, got %v", odd.Rows[0][0])
+	}
+}
+
+func TestAnonymizeExportJob(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.name = "acme"
+	tn.agent.anonymize, _ = newAnonymizer(&AnonymizeConfig{Rules: []AnonymizeRule{{Column: "email", Transform: "null"}}})
+	store, err := openJobStore(tn.agent, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT id, email FROM users").WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(1, "ann@corp.com"))
+	j := &Job{ID: "j1", Tenant: "acme", Connection: "main", SQL: "SELECT id, email FROM users", Status: "running", CreatedAt: time.Now()}
+	store.run(context.Background(), tn, j)
+
+	r, err := store.result("j1")
+	if err != nil || r == nil || len(r.Rows) != 1 || r.Rows[0][1] != nil {
+		t.Fatalf("expected the stored email to be anonymized, got %+v, %v", r, err)
+	}
+	if j.Status != "done" || strings.Join(j.Anonymized, ",") != "email" {
+		t.Errorf("unexpected job: %+v", j)
+	}
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditMu serializes writes to audit logs, which Agents may share.
+var auditMu sync.Mutex
+
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	MessageID  string    `json:"message_id,omitempty"`
+	Connection string    `json:"connection,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// audit logs an administrative action and, when --audit-log is set, adds
+// it to that file as a JSON line.
+func (a *Agent) audit(e AuditEvent) {
+	e.Time = time.Now().UTC()
+	buf, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[audit] Could not encode event: %v", err)
+		return
+	}
+	log.Printf("[audit] %s", buf)
+
+	auditLogPath := a.opts.AuditLog
+	if auditLogPath == "" {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("[audit] Could not open %s: %v", auditLogPath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(a.currentScrub().text(string(buf)) + "\n"); err != nil {
+		log.Printf("[audit] Could not write %s: %v", auditLogPath, err)
+	}
+}
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AzureAD authenticates to Azure Database for PostgreSQL with Microsoft
+// Entra ID (Azure AD) access tokens instead of a stored password. Each new
+// database connection sends a token as its password; tokens last about an
+// hour and are fetched again shortly before they expire. Open connections
+// stay logged in after their token expires.
+type AzureAD struct {
+	// Auth is "managed-identity", using the identity of the VM, container
+	// or App Service the agent runs on, or "client-credentials", using an
+	// app registration's secret.
+	Auth string `json:"auth"`
+	// ClientID picks a user-assigned managed identity, or is the app of
+	// client-credentials, which also needs TenantID and ClientSecret. An
+	// empty ClientSecret is read from AZURE_CLIENT_SECRET.
+	ClientID     string `json:"client_id,omitempty"`
+	TenantID     string `json:"tenant_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// azureAD is the --db connection's token authentication, from the
+// --db-azure-auth and --azure-* flags.
+var azureAD AzureAD
+
+// Where tokens come from. Tests point these at a local server.
+var (
+	azureIMDS  = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureLogin = "https://login.microsoftonline.com"
+)
+
+// azurePostgresResource is the audience of tokens Azure Postgres accepts.
+const azurePostgresResource = "https://ossrdbms-aad.database.windows.net"
+
+// azureRefreshBefore is how long before a token expires it is replaced.
+const azureRefreshBefore = 5 * time.Minute
+
+func (a *AzureAD) check() error {
+	if a.ClientSecret == "" {
+		a.ClientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	}
+	switch a.Auth {
+	case "managed-identity":
+	case "client-credentials":
+		var missing []string
+		for _, f := range [][2]string{{"tenant_id", a.TenantID}, {"client_id", a.ClientID}, {"client_secret", a.ClientSecret}} {
+			if f[1] == "" {
+				missing = append(missing, f[0])
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("client-credentials needs %s", strings.Join(missing, ", "))
+		}
+	default:
+		return fmt.Errorf("unknown auth %q: expected managed-identity or client-credentials", a.Auth)
+	}
+	return nil
+}
+
+// passwordFunc returns the password for a new database connection.
+type passwordFunc func(ctx context.Context) (string, error)
+
+// azureTokens fetches and caches one identity's tokens.
+type azureTokens struct {
+	cfg    AzureAD
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newAzureTokens fetches tokens for cfg, dialing in family; see
+// --ip-family.
+func newAzureTokens(cfg AzureAD, family string) *azureTokens {
+	return &azureTokens{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second, Transport: httpTransport(family)}}
+}
+
+// password returns a token valid for a while yet, fetching a new one if
+// needed. If fetching fails while the cached token is still valid, it
+// logs the failure and returns that token.
+func (a *azureTokens) password(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.token != "" && now.Before(a.expires.Add(-azureRefreshBefore)) {
+		return a.token, nil
+	}
+	token, expires, err := a.fetch(ctx)
+	if err != nil {
+		if a.token != "" && now.Before(a.expires) {
+			log.Printf("⚠ Azure AD: could not refresh the database token, using the current one until %s: %v", a.expires.Format(time.RFC3339), err)
+			return a.token, nil
+		}
+		return "", fmt.Errorf("azure ad token: %w", err)
+	}
+	a.token, a.expires = token, expires
+	return token, nil
+}
+
+// tokenResponse is what the identity endpoints and the login endpoint
+// return. Managed identity gives expires_in and expires_on as strings,
+// the login endpoint expires_in as a number.
+type tokenResponse struct {
+	AccessToken      string          `json:"access_token"`
+	ExpiresIn        json.RawMessage `json:"expires_in"`
+	ExpiresOn        json.RawMessage `json:"expires_on"`
+	Error            string          `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+	// App Service reports errors this way.
+	Message string `json:"message"`
+}
+
+func (a *azureTokens) fetch(ctx context.Context) (string, time.Time, error) {
+	req, err := a.request(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	sent := time.Now()
+	res, err := a.client.Do(req)
+	if err != nil {
+		if a.cfg.Auth == "managed-identity" {
+			return "", time.Time{}, fmt.Errorf("%w (is the agent running on Azure, with a managed identity assigned?)", err)
+		}
+		return "", time.Time{}, err
+	}
+	defer res.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned %s: %w", res.Status, err)
+	}
+	if res.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		msg := tr.ErrorDescription
+		if msg == "" {
+			msg = tr.Message
+		}
+		if tr.Error != "" {
+			msg = tr.Error + ": " + msg
+		}
+		return "", time.Time{}, fmt.Errorf("token endpoint returned %s: %s", res.Status, msg)
+	}
+	if on := jsonSeconds(tr.ExpiresOn); on > 0 {
+		return tr.AccessToken, time.Unix(on, 0), nil
+	}
+	if in := jsonSeconds(tr.ExpiresIn); in > 0 {
+		return tr.AccessToken, sent.Add(time.Duration(in) * time.Second), nil
+	}
+	// Tokens last at least this long.
+	return tr.AccessToken, sent.Add(10 * time.Minute), nil
+}
+
+// request builds the token request for a's kind of identity.
+func (a *azureTokens) request(ctx context.Context) (*http.Request, error) {
+	if a.cfg.Auth == "client-credentials" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {a.cfg.ClientID},
+			"client_secret": {a.cfg.ClientSecret},
+			"scope":         {azurePostgresResource + "/.default"},
+		}
+		u := azureLogin + "/" + url.PathEscape(a.cfg.TenantID) + "/oauth2/v2.0/token"
+		req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+
+	q := url.Values{"resource": {azurePostgresResource}}
+	if a.cfg.ClientID != "" {
+		q.Set("client_id", a.cfg.ClientID)
+	}
+	// App Service and Container Apps have their own identity endpoint.
+	if endpoint, header := os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER"); endpoint != "" && header != "" {
+		q.Set("api-version", "2019-08-01")
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", header)
+		return req, nil
+	}
+	q.Set("api-version", "2018-02-01")
+	req, err := http.NewRequestWithContext(ctx, "GET", azureIMDS+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
+
+// jsonSeconds reads a count of seconds written as a number or a string.
+func jsonSeconds(raw json.RawMessage) int64 {
+	s := strings.Trim(string(raw), `"`)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// passwordConnector opens lib/pq connections with a password fetched for
+// each, such as an access token that expires.
+type passwordConnector struct {
+	cfg      pq.Config
+	password passwordFunc
+	family   string
+}
+
+func newPasswordConnector(dsn string, password passwordFunc, family string) (*passwordConnector, error) {
+	cfg, err := pq.NewConfig(pqURL(dsn))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Password != "" {
+		return nil, errors.New("the URL has a password, which token authentication replaces: remove it")
+	}
+	return &passwordConnector{cfg: cfg, password: password, family: family}, nil
+}
+
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	pw, err := c.password(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.cfg.Clone()
+	cfg.Password = pw
+	pc, err := pq.NewConnectorConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pc.Dialer(newFamilyDialer(c.family))
+	return pc.Connect(ctx)
+}
+
+func (c *passwordConnector) Driver() driver.Driver { return &pq.Driver{} }
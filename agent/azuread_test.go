@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAzureADCheck(t *testing.T) {
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+	tests := []struct {
+		name string
+		cfg  AzureAD
+		err  string
+	}{
+		{"managed identity", AzureAD{Auth: "managed-identity"}, ""},
+		{"user-assigned identity", AzureAD{Auth: "managed-identity", ClientID: "c1"}, ""},
+		{"client credentials", AzureAD{Auth: "client-credentials", TenantID: "t1", ClientID: "c1", ClientSecret: "s"}, ""},
+		{"client credentials without secret", AzureAD{Auth: "client-credentials", TenantID: "t1", ClientID: "c1"}, "needs client_secret"},
+		{"client credentials without anything", AzureAD{Auth: "client-credentials"}, "needs tenant_id, client_id, client_secret"},
+		{"unknown auth", AzureAD{Auth: "password"}, `unknown auth "password"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.check()
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Setenv("AZURE_CLIENT_SECRET", "from-env")
+	cfg := AzureAD{Auth: "client-credentials", TenantID: "t1", ClientID: "c1"}
+	if err := cfg.check(); err != nil || cfg.ClientSecret != "from-env" {
+		t.Errorf("expected the secret from AZURE_CLIENT_SECRET, got %q (%v)", cfg.ClientSecret, err)
+	}
+}
+
+// tokenServer stands in for an Azure token endpoint, answering with
+// respond and counting requests.
+func tokenServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		respond(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	t.Setenv("IDENTITY_ENDPOINT", "")
+	expires := time.Now().Add(time.Hour).Unix()
+	srv, requests := tokenServer(t, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Header.Get("Metadata") != "true" || q.Get("resource") != azurePostgresResource || q.Get("client_id") != "c1" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "invalid_request", "error_description": "bad request %s"}`, r.URL)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "tok-1", "expires_in": "3599", "expires_on": "%d"}`, expires)
+	})
+	was := azureIMDS
+	azureIMDS = srv.URL
+	defer func() { azureIMDS = was }()
+
+	a := newAzureTokens(AzureAD{Auth: "managed-identity", ClientID: "c1"}, "")
+	for i := 0; i < 3; i++ {
+		tok, err := a.password(context.Background())
+		if err != nil || tok != "tok-1" {
+			t.Fatalf("expected tok-1, got %q (%v)", tok, err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected the token cached, got %d requests", n)
+	}
+	if a.expires.Unix() != expires {
+		t.Errorf("expected the token to expire at %d, got %d", expires, a.expires.Unix())
+	}
+}
+
+func TestAzureAppServiceIdentity(t *testing.T) {
+	srv, _ := tokenServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-IDENTITY-HEADER") != "secret-header" || r.URL.Query().Get("api-version") != "2019-08-01" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "no identity header"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "app-service", "expires_on": "4102444800"}`)
+	})
+	t.Setenv("IDENTITY_ENDPOINT", srv.URL)
+	t.Setenv("IDENTITY_HEADER", "secret-header")
+
+	tok, err := newAzureTokens(AzureAD{Auth: "managed-identity"}, "").password(context.Background())
+	if err != nil || tok != "app-service" {
+		t.Errorf("expected the App Service token, got %q (%v)", tok, err)
+	}
+}
+
+func TestAzureClientCredentials(t *testing.T) {
+	srv, requests := tokenServer(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != "POST" || r.URL.Path != "/t1/oauth2/v2.0/token" || r.PostForm.Get("client_secret") != "s3cret" ||
+			r.PostForm.Get("scope") != azurePostgresResource+"/.default" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided."}`)
+			return
+		}
+		// Shorter than azureRefreshBefore, so every call fetches again.
+		fmt.Fprint(w, `{"access_token": "cc", "expires_in": 60}`)
+	})
+	was := azureLogin
+	azureLogin = srv.URL
+	defer func() { azureLogin = was }()
+
+	a := newAzureTokens(AzureAD{Auth: "client-credentials", TenantID: "t1", ClientID: "c1", ClientSecret: "s3cret"}, "")
+	for i := 0; i < 2; i++ {
+		if tok, err := a.password(context.Background()); err != nil || tok != "cc" {
+			t.Fatalf("expected token cc, got %q (%v)", tok, err)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected a token about to expire to be fetched again, got %d requests", n)
+	}
+
+	// Fetching fails, but the cached token is still good for a minute.
+	a.cfg.ClientSecret = "wrong"
+	if tok, err := a.password(context.Background()); err != nil || tok != "cc" {
+		t.Errorf("expected the cached token while it lasts, got %q (%v)", tok, err)
+	}
+	a.expires = time.Now().Add(-time.Second)
+	_, err := a.password(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Invalid client secret") {
+		t.Errorf("expected the endpoint's error, got %v", err)
+	}
+}
+
+func TestPasswordConnector(t *testing.T) {
+	if _, err := newPasswordConnector("postgres://app:pw@db.postgres.database.azure.com/mydb", nil, ""); err == nil {
+		t.Error("expected a URL with a password to be refused")
+	}
+	c, err := newPasswordConnector("postgres://app@db.postgres.database.azure.com/mydb", func(context.Context) (string, error) {
+		return "", errors.New("no token")
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Connect(context.Background()); err == nil || err.Error() != "no token" {
+		t.Errorf("expected the token error before dialing, got %v", err)
+	}
+}
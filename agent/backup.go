@@ -0,0 +1,452 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pgDumpCommand and awsCommand are the pg_dump and AWS CLI backups run.
+var (
+	pgDumpCommand = "pg_dump"
+	awsCommand    = "aws"
+)
+
+// BackupConfig schedules logical backups of a Postgres connection with
+// pg_dump. A backup runs every Every, at times aligned to At ("15:04",
+// UTC) when given, and on a "backup" message from the hub. Path is a
+// directory, where Keep, when set, is how many of the backup's files to
+// keep, or an s3:// URL, uploaded to with the AWS CLI.
+type BackupConfig struct {
+	Name       string   `json:"name"`
+	Connection string   `json:"connection"`
+	Every      duration `json:"every"`
+	At         string   `json:"at,omitempty"`
+	Path       string   `json:"path"`
+	// Format is pg_dump's "custom" format, the default, or "plain" SQL.
+	// Compression is "gzip", the default, or "none".
+	Format      string `json:"format,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Keep        int    `json:"keep,omitempty"`
+}
+
+// check reports mistakes in the settings before anything connects.
+func (b *BackupConfig) check() error {
+	switch {
+	case b.Name == "" || b.Connection == "" || b.Path == "":
+		return fmt.Errorf("name, connection and path are required")
+	case strings.ContainsAny(b.Name, `/\`):
+		return fmt.Errorf("name %q can't contain a slash", b.Name)
+	case time.Duration(b.Every) < time.Minute:
+		return fmt.Errorf("every must be at least 1m")
+	case b.Format != "" && b.Format != "custom" && b.Format != "plain":
+		return fmt.Errorf("unknown format %q: expected custom or plain", b.Format)
+	case b.Compression != "" && b.Compression != "gzip" && b.Compression != "none":
+		return fmt.Errorf("unknown compression %q: expected gzip or none", b.Compression)
+	case b.Keep < 0:
+		return fmt.Errorf("keep must not be negative")
+	case b.Keep > 0 && strings.HasPrefix(b.Path, "s3://"):
+		return fmt.Errorf("keep is only supported for directories; use a lifecycle rule on the bucket")
+	}
+	if b.At != "" {
+		if _, err := time.Parse("15:04", b.At); err != nil {
+			return fmt.Errorf("at must be a UTC time such as \"02:30\"")
+		}
+	}
+	return nil
+}
+
+// ext is the extension of the backup's files.
+func (b *BackupConfig) ext() string {
+	ext := ".dump"
+	if b.Format == "plain" {
+		ext = ".sql"
+		if b.Compression != "none" {
+			ext += ".gz"
+		}
+	}
+	return ext
+}
+
+// BackupRun is one run of a backup. Trigger is "schedule" or "hub";
+// Status is "running", "done" or "failed". Location is the file or S3
+// object the dump was written to.
+type BackupRun struct {
+	Name       string    `json:"name"`
+	Connection string    `json:"connection"`
+	Trigger    string    `json:"trigger"`
+	Status     string    `json:"status"`
+	Location   string    `json:"location,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BackupResponse answers a "backup" message with a "backup_started"
+// reply, and reports each finished run to the hub as "backup_done".
+type BackupResponse struct {
+	ID        string     `json:"id,omitempty"`
+	Type      string     `json:"type"`
+	Backup    *BackupRun `json:"backup,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ErrorCode string     `json:"error_code,omitempty"`
+}
+
+// backupJob is a configured backup and whether it is running.
+type backupJob struct {
+	BackupConfig
+	conn *connection
+	sc   *sqlConnector
+
+	mu      sync.Mutex
+	running bool
+}
+
+// backupScheduler runs the configured backups and reports them to the
+// tenants serving their connections.
+type backupScheduler struct {
+	ctx     context.Context
+	agent   *Agent
+	jobs    map[string]*backupJob
+	tenants []*tenant
+}
+
+// startBackups checks the backups against a's connections and schedules
+// them until ctx is cancelled.
+func startBackups(ctx context.Context, a *Agent, configs []BackupConfig, tenants []*tenant) (*backupScheduler, error) {
+	s := &backupScheduler{ctx: ctx, agent: a, jobs: map[string]*backupJob{}, tenants: tenants}
+	for _, cfg := range configs {
+		if s.jobs[cfg.Name] != nil {
+			return nil, fmt.Errorf("backup %q is defined twice", cfg.Name)
+		}
+		var conn *connection
+		for _, c := range a.connections {
+			if c.Name == cfg.Connection {
+				conn = c
+			}
+		}
+		if conn == nil {
+			return nil, fmt.Errorf("backup %q: no connection is named %q", cfg.Name, cfg.Connection)
+		}
+		sc, ok := conn.Connector.(*sqlConnector)
+		if !ok || sc.flavor != "postgres" {
+			return nil, fmt.Errorf("backup %q: backups are only supported for postgres", cfg.Name)
+		}
+		s.jobs[cfg.Name] = &backupJob{BackupConfig: cfg, conn: conn, sc: sc}
+	}
+	for _, j := range s.jobs {
+		log.Printf("Backup %q: %s every %s to %s", j.Name, j.Connection, time.Duration(j.Every), j.Path)
+		go s.schedule(j)
+	}
+	return s, nil
+}
+
+// nextBackup returns when a backup run every every, aligned to at, next
+// runs after now.
+func nextBackup(now time.Time, every time.Duration, at string) time.Time {
+	if at == "" {
+		return now.Add(every)
+	}
+	hm, _ := time.Parse("15:04", at)
+	now = now.UTC()
+	t := time.Date(now.Year(), now.Month(), now.Day(), hm.Hour(), hm.Minute(), 0, 0, time.UTC)
+	for t.Add(-every).After(now) {
+		t = t.Add(-every)
+	}
+	for !t.After(now) {
+		t = t.Add(every)
+	}
+	return t
+}
+
+// schedule runs j at its times. A standby agent, one in maintenance mode,
+// or one that isn't its connection's elected leader skips the run.
+func (s *backupScheduler) schedule(j *backupJob) {
+	a := s.agent
+	defer a.reporter.reportPanic()
+	for {
+		timer := time.NewTimer(time.Until(nextBackup(time.Now(), time.Duration(j.Every), j.At)))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		switch {
+		case !a.standby.active():
+			log.Printf("[backup:%s] Skipped: the agent is a standby", j.Name)
+		case a.maintenance.active():
+			log.Printf("[backup:%s] Skipped: the agent is in maintenance mode", j.Name)
+		case j.sc.elector != nil && !j.sc.elector.isLeader():
+			log.Printf("[backup:%s] Skipped: another agent leads %q", j.Name, j.Connection)
+		case !j.begin():
+			log.Printf("[backup:%s] Skipped: the last run hasn't finished", j.Name)
+		default:
+			done := a.maintenance.begin()
+			s.run(j, "schedule")
+			done()
+		}
+	}
+}
+
+// begin marks j running, unless it already is.
+func (j *backupJob) begin() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return false
+	}
+	j.running = true
+	return true
+}
+
+func (j *backupJob) end() {
+	j.mu.Lock()
+	j.running = false
+	j.mu.Unlock()
+}
+
+// run dumps j's database, audits the run, and reports it to every tenant
+// serving the connection; the outbox keeps the report for a tenant that is
+// away. A run cut short by shutdown isn't reported.
+func (s *backupScheduler) run(j *backupJob, trigger string) BackupRun {
+	defer j.end()
+	r := BackupRun{Name: j.Name, Connection: j.Connection, Trigger: trigger, StartedAt: time.Now().UTC()}
+	log.Printf("[backup:%s] Dumping %q", j.Name, j.Connection)
+	var err error
+	r.Location, r.Bytes, err = j.dump(s.ctx, r.StartedAt)
+	r.FinishedAt = time.Now().UTC()
+	if s.ctx.Err() != nil {
+		log.Printf("[backup:%s] Interrupted by shutdown", j.Name)
+		return r
+	}
+	if err != nil {
+		r.Status, r.Error = "failed", err.Error()
+		log.Printf("[backup:%s] Failed: %v", j.Name, err)
+	} else {
+		r.Status = "done"
+		log.Printf("[backup:%s] Wrote %d bytes to %s in %v", j.Name, r.Bytes, r.Location, r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond))
+		if j.Keep > 0 {
+			pruneBackups(j.Path, j.Name, j.ext(), j.Keep)
+		}
+	}
+	s.agent.audit(AuditEvent{Action: "backup", Connection: j.Connection, Detail: j.Name + " (" + trigger + "): " + r.Location, Error: r.Error})
+	for _, t := range s.tenants {
+		if t.serves(j.conn) {
+			t.reply(Message{}, BackupResponse{Type: "backup_done", Backup: &r})
+		}
+	}
+	return r
+}
+
+// dump runs pg_dump into the backup's file, named for its start time,
+// and uploads it when the path is on S3. It returns where the dump went
+// and its size.
+func (j *backupJob) dump(ctx context.Context, started time.Time) (string, int64, error) {
+	name := j.Name + "-" + started.Format("20060102T150405Z") + j.ext()
+	s3 := strings.HasPrefix(j.Path, "s3://")
+	dir := j.Path
+	if s3 {
+		dir = os.TempDir()
+	}
+	file := filepath.Join(dir, name)
+	partial := file + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(partial)
+	defer f.Close()
+
+	conn, password, err := dumpConnString(j.sc.dsn)
+	if err != nil {
+		return "", 0, err
+	}
+	if j.sc.password != nil {
+		if password, err = j.sc.password(ctx); err != nil {
+			return "", 0, err
+		}
+	}
+	args := []string{"--dbname=" + conn, "--no-password"}
+	var out io.Writer = f
+	var gz *gzip.Writer
+	switch {
+	case j.Format == "plain" && j.Compression != "none":
+		gz = gzip.NewWriter(f)
+		out = gz
+		args = append(args, "--format=plain")
+	case j.Format == "plain":
+		args = append(args, "--format=plain")
+	case j.Compression == "none":
+		args = append(args, "--format=custom", "--compress=0")
+	default:
+		args = append(args, "--format=custom")
+	}
+	cmd := exec.CommandContext(ctx, pgDumpCommand, args...)
+	cmd.Env = os.Environ()
+	if password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+password)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = out, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", 0, commandError(pgDumpCommand, err, stderr.String())
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+	info, err := os.Stat(partial)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(partial, file); err != nil {
+		return "", 0, err
+	}
+	if !s3 {
+		return file, info.Size(), nil
+	}
+
+	defer os.Remove(file)
+	dest := strings.TrimSuffix(j.Path, "/") + "/" + name
+	cmd = exec.CommandContext(ctx, awsCommand, "s3", "cp", "--only-show-errors", file, dest)
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", 0, commandError(awsCommand, err, stderr.String())
+	}
+	return dest, info.Size(), nil
+}
+
+// commandError is err from running name, with the last line it wrote to
+// stderr, which is usually the one that explains it.
+func commandError(name string, err error, stderr string) error {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Errorf("%s: %w: %s", name, err, last)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// dumpConnString takes the password out of a connection's DSN, a URL or
+// key=value pairs, so it goes to pg_dump in PGPASSWORD rather than on a
+// command line other users can see.
+func dumpConnString(dsn string) (string, string, error) {
+	if urlScheme(dsn) != "" {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", "", err
+		}
+		password, _ := u.User.Password()
+		if u.User != nil {
+			u.User = url.User(u.User.Username())
+		}
+		return u.String(), password, nil
+	}
+	var kept []string
+	password := ""
+	for _, kv := range splitConnInfo(dsn) {
+		if v, ok := strings.CutPrefix(kv, "password="); ok {
+			password = strings.ReplaceAll(strings.Trim(v, "'"), `\'`, "'")
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return strings.Join(kept, " "), password, nil
+}
+
+// splitConnInfo splits key=value connection settings at the spaces
+// outside quoted values.
+func splitConnInfo(s string) []string {
+	var parts []string
+	var cur strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quoted && i+1 < len(s):
+			cur.WriteByte(c)
+			i++
+			c = s[i]
+		case c == '\'':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if cur.Len() > 0 {
+				parts = append(parts, cur.String())
+				cur.Reset()
+			}
+			continue
+		}
+		cur.WriteByte(c)
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
+
+// backupFiles lists a backup's files in dir, oldest first: their names
+// sort by the time they were taken.
+func backupFiles(dir, name, ext string) []string {
+	stamp := "[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T[0-9][0-9][0-9][0-9][0-9][0-9]Z"
+	matches, _ := filepath.Glob(filepath.Join(dir, name+"-"+stamp+ext))
+	sort.Strings(matches)
+	return matches
+}
+
+// pruneBackups removes all but the newest keep of a backup's files in dir.
+func pruneBackups(dir, name, ext string, keep int) {
+	matches := backupFiles(dir, name, ext)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			log.Printf("[backup:%s] Could not remove old backup: %v", name, err)
+		}
+		matches = matches[1:]
+	}
+}
+
+// triggerBackup answers a "backup" message by starting the configured
+// backup msg.Backup now, on a connection the token serves. The reply says
+// it started; a "backup_done" message follows when it finishes.
+func triggerBackup(msg Message) BackupResponse {
+	fail := func(err error) BackupResponse {
+		return BackupResponse{ID: msg.ID, Type: "backup_started", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	a := msg.agent()
+	s := a.backups
+	var j *backupJob
+	if s != nil {
+		j = s.jobs[msg.Backup]
+	}
+	if j == nil || (msg.tenant != nil && !msg.tenant.serves(j.conn)) {
+		return fail(codedErrorf(codeInvalidRequest, "no backup %q is configured", msg.Backup))
+	}
+	if !j.begin() {
+		return fail(codedErrorf(codeInvalidRequest, "backup %q is already running", msg.Backup))
+	}
+	done := a.maintenance.begin()
+	go func() {
+		defer done()
+		defer a.reporter.reportPanic()
+		s.run(j, "hub")
+	}()
+	return BackupResponse{ID: msg.ID, Type: "backup_started", Backup: &BackupRun{
+		Name: j.Name, Connection: j.Connection, Trigger: "hub", Status: "running", StartedAt: time.Now().UTC(),
+	}}
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePgDump makes pgDumpCommand a script that writes its arguments and
+// PGPASSWORD to stdout, and exits with code.
+func fakePgDump(t *testing.T, code string) {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "pg_dump")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$@ password=$PGPASSWORD\"\necho 'pg_dump: error: connection refused' >&2\nexit "+code+"\n"), 0o755)
+	was := pgDumpCommand
+	pgDumpCommand = script
+	t.Cleanup(func() { pgDumpCommand = was })
+}
+
+func TestNextBackup(t *testing.T) {
+	now := time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		every time.Duration
+		at    string
+		want  time.Time
+	}{
+		{every: time.Hour, want: now.Add(time.Hour)},
+		{every: 24 * time.Hour, at: "02:30", want: time.Date(2026, 10, 18, 2, 30, 0, 0, time.UTC)},
+		{every: 6 * time.Hour, at: "02:00", want: time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)},
+		{every: 6 * time.Hour, at: "23:30", want: time.Date(2026, 10, 17, 23, 30, 0, 0, time.UTC)},
+		{every: 15 * time.Minute, at: "00:05", want: time.Date(2026, 10, 17, 23, 5, 0, 0, time.UTC)},
+		{every: 24 * time.Hour, at: "23:00", want: time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range tests {
+		if got := nextBackup(now, tc.every, tc.at); !got.Equal(tc.want) {
+			t.Errorf("nextBackup(every %v at %q) = %v, want %v", tc.every, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestDumpConnString(t *testing.T) {
+	tests := []struct {
+		dsn, conn, password string
+	}{
+		{"postgres://peek:s3cret@db:5432/app?sslmode=require", "postgres://peek@db:5432/app?sslmode=require", "s3cret"},
+		{"postgres://db/app", "postgres://db/app", ""},
+		{"host=db dbname=app password=secret user=peek", "host=db dbname=app user=peek", "secret"},
+		{`host=db password='a b\'c'`, "host=db", "a b'c"},
+	}
+	for _, tc := range tests {
+		conn, password, err := dumpConnString(tc.dsn)
+		if err != nil || conn != tc.conn || password != tc.password {
+			t.Errorf("dumpConnString(%q) = %q, %q, %v, want %q, %q", tc.dsn, conn, password, err, tc.conn, tc.password)
+		}
+	}
+}
+
+func TestBackupConfigCheck(t *testing.T) {
+	ok := BackupConfig{Name: "nightly", Connection: "main", Every: duration(24 * time.Hour), Path: "/backups"}
+	tests := []struct {
+		change func(*BackupConfig)
+		err    string
+	}{
+		{change: func(*BackupConfig) {}},
+		{change: func(b *BackupConfig) { b.Path = "" }, err: "name, connection and path are required"},
+		{change: func(b *BackupConfig) { b.Every = duration(time.Second) }, err: "every must be at least 1m"},
+		{change: func(b *BackupConfig) { b.At = "2am" }, err: `at must be a UTC time such as "02:30"`},
+		{change: func(b *BackupConfig) { b.Format = "tar" }, err: `unknown format "tar": expected custom or plain`},
+		{change: func(b *BackupConfig) { b.Path, b.Keep = "s3://bucket/pg", 7 }, err: "keep is only supported for directories; use a lifecycle rule on the bucket"},
+	}
+	for _, tc := range tests {
+		b := ok
+		tc.change(&b)
+		err := b.check()
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Errorf("check(%+v) = %v, want %q", b, err, tc.err)
+		}
+	}
+}
+
+func TestBackupRun(t *testing.T) {
+	fakePgDump(t, "0")
+	dir := t.TempDir()
+	old := filepath.Join(dir, "nightly-20261001T020000Z.sql.gz")
+	other := filepath.Join(dir, "nightly-extra-20261001T020000Z.sql.gz")
+	os.WriteFile(old, nil, 0o600)
+	os.WriteFile(other, nil, 0o600)
+
+	conn := &connection{Name: "main", Connector: &sqlConnector{flavor: "postgres", dsn: "postgres://peek:s3cret@db/app"}}
+	s, err := startBackups(context.Background(), testAgent(conn), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &backupJob{BackupConfig: BackupConfig{Name: "nightly", Connection: "main", Path: dir, Format: "plain", Keep: 1}, conn: conn, sc: conn.Connector.(*sqlConnector)}
+	j.begin()
+	r := s.run(j, "hub")
+	if r.Status != "done" || !strings.HasSuffix(r.Location, ".sql.gz") || r.Bytes == 0 {
+		t.Fatalf("unexpected run: %+v", r)
+	}
+	f, err := os.Open(r.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(gz)
+	if got := strings.TrimSpace(string(out)); got != "--dbname=postgres://peek@db/app --no-password --format=plain password=s3cret" {
+		t.Errorf("unexpected pg_dump call: %s", got)
+	}
+
+	// keep removes the older file, but not another backup's.
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be pruned, got %v", old, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected %s to be kept, got %v", other, err)
+	}
+	if !j.begin() {
+		t.Error("expected the run to end")
+	}
+	j.end()
+
+	fakePgDump(t, "1")
+	j.begin()
+	r = s.run(j, "schedule")
+	if r.Status != "failed" || !strings.HasSuffix(r.Error, "pg_dump: exit status 1: pg_dump: error: connection refused") {
+		t.Errorf("unexpected failed run: %+v", r)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.partial")); len(files) != 0 {
+		t.Errorf("expected the partial dump to be removed, got %v", files)
+	}
+}
+
+func TestTriggerBackup(t *testing.T) {
+	conn := &connection{Name: "main", Connector: &sqlConnector{flavor: "postgres"}}
+	other := &connection{Name: "other", Connector: &sqlConnector{flavor: "postgres"}}
+	a := testAgent(conn, other)
+	s, err := startBackups(context.Background(), a, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &backupJob{BackupConfig: BackupConfig{Name: "nightly", Connection: "main"}, conn: conn}
+	s.jobs["nightly"] = j
+	a.backups = s
+
+	tn := &tenant{agent: a, conns: []*connection{other}}
+	if resp := triggerBackup(Message{ID: "b1", Backup: "nightly", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for a connection the token doesn't serve, got %+v", codeInvalidRequest, resp)
+	}
+	j.begin()
+	tn.conns = append(tn.conns, conn)
+	if resp := triggerBackup(Message{ID: "b2", Backup: "nightly", tenant: tn}); resp.ErrorCode != codeInvalidRequest || !strings.Contains(resp.Error, "already running") {
+		t.Errorf("expected a running backup to be refused, got %+v", resp)
+	}
+
+	if _, err := startBackups(context.Background(), testAgent(conn), []BackupConfig{{Name: "x", Connection: "nope"}}, nil); err == nil {
+		t.Error("expected an unknown connection to be refused")
+	}
+}
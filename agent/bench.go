@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchOptions configure a "bench" run: SQL is run by Concurrency workers
+// until Requests have been sent or, when Requests is 0, for Duration.
+type benchOptions struct {
+	SQL         string
+	Concurrency int
+	Requests    int
+	Duration    time.Duration
+	ChunkSize   int
+}
+
+// benchSample is one query of a bench run.
+type benchSample struct {
+	// Query is the time handleMessage took, Encode the time writing its
+	// reply as frames took.
+	Query  time.Duration
+	Encode time.Duration
+	Bytes  int
+	Frames int
+	Rows   int
+	Err    string
+}
+
+// countingWriter is a replyWriter that keeps only the size of what is
+// written to it.
+type countingWriter struct {
+	bytes, frames int
+}
+
+func (w *countingWriter) WriteJSON(v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.bytes += len(buf)
+	w.frames++
+	return nil
+}
+
+func (w *countingWriter) WriteMessage(messageType int, data []byte) error {
+	w.bytes += len(data)
+	w.frames++
+	return nil
+}
+
+// runBenchLoad sends opts.SQL through the same path as a hub message from
+// t, handleMessage then writeReply, without a hub, and times both halves.
+func runBenchLoad(t *tenant, opts benchOptions) []benchSample {
+	var (
+		mu      sync.Mutex
+		samples []benchSample
+		sent    atomic.Int64
+		wg      sync.WaitGroup
+	)
+	deadline := time.Now().Add(opts.Duration)
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := sent.Add(1)
+				if opts.Requests > 0 && n > int64(opts.Requests) || opts.Requests == 0 && time.Now().After(deadline) {
+					return
+				}
+				msg := Message{Type: "query", ID: fmt.Sprintf("bench-%d", n), SQL: opts.SQL, ChunkSize: opts.ChunkSize, tenant: t}
+				start := time.Now()
+				resp := handleMessage(msg)
+				s := benchSample{Query: time.Since(start)}
+				if qr, ok := resp.(QueryResponse); ok {
+					s.Err, s.Rows = qr.Error, len(qr.Rows)
+				}
+				w := &countingWriter{}
+				start = time.Now()
+				if err := writeReply(w, msg, resp); err != nil && s.Err == "" {
+					s.Err = err.Error()
+				}
+				s.Encode, s.Bytes, s.Frames = time.Since(start), w.bytes, w.frames
+				mu.Lock()
+				samples = append(samples, s)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return samples
+}
+
+// benchReport sums up a bench run.
+type benchReport struct {
+	Queries, Errors int
+	FirstError      string
+	Elapsed         time.Duration
+	PerSecond       float64
+	P50, P95, P99   time.Duration
+	MeanQuery       time.Duration
+	MeanEncode      time.Duration
+	MeanBytes       int
+	MaxBytes        int
+	MeanFrames      float64
+	MeanRows        float64
+}
+
+func summarizeBench(samples []benchSample, elapsed time.Duration) benchReport {
+	r := benchReport{Queries: len(samples), Elapsed: elapsed}
+	if len(samples) == 0 {
+		return r
+	}
+	var total []time.Duration
+	var query, encode time.Duration
+	var bytes, frames, rows int
+	for _, s := range samples {
+		if s.Err != "" {
+			r.Errors++
+			if r.FirstError == "" {
+				r.FirstError = s.Err
+			}
+		}
+		total = append(total, s.Query+s.Encode)
+		query += s.Query
+		encode += s.Encode
+		bytes += s.Bytes
+		frames += s.Frames
+		rows += s.Rows
+		if s.Bytes > r.MaxBytes {
+			r.MaxBytes = s.Bytes
+		}
+	}
+	sort.Slice(total, func(i, j int) bool { return total[i] < total[j] })
+	pct := func(p float64) time.Duration { return total[int(p*float64(len(total)-1))] }
+	n := len(samples)
+	r.P50, r.P95, r.P99 = pct(0.50), pct(0.95), pct(0.99)
+	r.MeanQuery = query / time.Duration(n)
+	r.MeanEncode = encode / time.Duration(n)
+	r.MeanBytes = bytes / n
+	r.MeanFrames = float64(frames) / float64(n)
+	r.MeanRows = float64(rows) / float64(n)
+	if elapsed > 0 {
+		r.PerSecond = float64(n) / elapsed.Seconds()
+	}
+	return r
+}
+
+func (r benchReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Queries:        %d in %v (%.1f/s), %d failed\n", r.Queries, r.Elapsed.Round(time.Millisecond), r.PerSecond, r.Errors)
+	if r.FirstError != "" {
+		fmt.Fprintf(w, "First error:    %s\n", r.FirstError)
+	}
+	if r.Queries == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Latency:        p50 %v, p95 %v, p99 %v\n", r.P50.Round(time.Microsecond), r.P95.Round(time.Microsecond), r.P99.Round(time.Microsecond))
+	share := 0.0
+	if total := r.MeanQuery + r.MeanEncode; total > 0 {
+		share = 100 * float64(r.MeanEncode) / float64(total)
+	}
+	fmt.Fprintf(w, "Per query:      %v running, %v serializing (%.0f%%)\n", r.MeanQuery.Round(time.Microsecond), r.MeanEncode.Round(time.Microsecond), share)
+	fmt.Fprintf(w, "Payload:        %d bytes mean, %d max, %.1f frames, %.1f rows\n", r.MeanBytes, r.MaxBytes, r.MeanFrames, r.MeanRows)
+}
+
+// RunBench is the "bench" command: it measures how many queries a second
+// the agent can serve from one database, and what they cost to serialize,
+// to help size agent hosts. It returns the process exit code.
+func RunBench(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(w)
+	url := fs.String("db", os.Getenv("DATABASE_URL"), "Database connection URL")
+	dbFlavor := fs.String("flavor", "postgres", "Postgres-protocol dialect: postgres or cockroach")
+	o := DefaultOptions()
+	opts := benchOptions{}
+	fs.StringVar(&opts.SQL, "query", "", "SQL to run")
+	fs.IntVar(&opts.Concurrency, "concurrency", 8, "Queries in flight at once")
+	fs.IntVar(&opts.Requests, "requests", 0, "Stop after this many queries instead of --duration")
+	fs.DurationVar(&opts.Duration, "duration", 10*time.Second, "How long to run")
+	fs.IntVar(&opts.ChunkSize, "chunk-size", 0, "Split results into chunks of this many rows, as the hub may ask")
+	fs.IntVar(&o.MaxCellBytes, "max-cell-bytes", o.MaxCellBytes, "Truncate text cells longer than this; 0 disables")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *url == "" || opts.SQL == "" || opts.Concurrency < 1 {
+		fmt.Fprintln(w, "Usage: peekdb-agent bench --db URL --query SQL [--concurrency 8] [--duration 10s | --requests n]")
+		return 2
+	}
+
+	a := bareAgent(o, nil)
+	conns, err := a.openConnections([]ConnectionConfig{{Name: "bench", URL: *url, Flavor: *dbFlavor}})
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	defer closeConnections(conns)
+	// Per-query log lines would cost more than some queries.
+	log.SetOutput(io.Discard)
+
+	fmt.Fprintf(w, "Running %q with %d workers...\n", opts.SQL, opts.Concurrency)
+	start := time.Now()
+	samples := runBenchLoad(&tenant{agent: a, name: "bench", conns: conns}, opts)
+	report := summarizeBench(samples, time.Since(start))
+	report.print(w)
+	if report.Errors == report.Queries {
+		return 1
+	}
+	return 0
+}
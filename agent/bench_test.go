@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRunBenchLoad(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	tn := testTenant(&connection{Name: "default", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+		mock.ExpectQuery("SELECT id FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	}
+
+	samples := runBenchLoad(tn, benchOptions{SQL: "SELECT id FROM orders", Concurrency: 1, Requests: 3, ChunkSize: 1})
+	if len(samples) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(samples))
+	}
+	for _, s := range samples {
+		if s.Err != "" || s.Rows != 2 || s.Frames != 3 || s.Bytes == 0 {
+			t.Errorf("expected 2 rows in 2 chunks and an end frame, got %+v", s)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestSummarizeBench(t *testing.T) {
+	var samples []benchSample
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, benchSample{Query: time.Duration(i) * time.Millisecond, Encode: time.Millisecond, Bytes: i, Frames: 1, Rows: 1})
+	}
+	samples[0].Err = "boom"
+
+	r := summarizeBench(samples, 2*time.Second)
+	if r.Queries != 100 || r.Errors != 1 || r.FirstError != "boom" || r.PerSecond != 50 {
+		t.Errorf("unexpected totals: %+v", r)
+	}
+	if r.P50 != 51*time.Millisecond || r.P99 != 100*time.Millisecond || r.MaxBytes != 100 {
+		t.Errorf("unexpected distribution: %+v", r)
+	}
+
+	var out bytes.Buffer
+	r.print(&out)
+	if !strings.Contains(out.String(), "100 in 2s (50.0/s), 1 failed") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
@@ -0,0 +1,572 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bigQueryAPI        = "https://bigquery.googleapis.com/bigquery/v2"
+	bigQueryScope      = "https://www.googleapis.com/auth/bigquery"
+	gceMetadataToken   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	bigQueryPricePerTB = 6.25 // on-demand USD per TiB scanned
+)
+
+// CostEstimate is the result of a BigQuery dry run.
+type CostEstimate struct {
+	BytesProcessed int64   `json:"bytes_processed"`
+	EstimatedUSD   float64 `json:"estimated_usd"`
+}
+
+type accessToken struct {
+	Token   string
+	Expires time.Time
+}
+
+type tokenSource interface {
+	token(ctx context.Context) (accessToken, error)
+}
+
+type bigQueryClient struct {
+	project  string
+	location string
+	baseURL  string
+	http     *http.Client
+	tokens   tokenSource
+
+	mu     sync.Mutex
+	cached accessToken
+}
+
+// newBigQuery parses a bigquery://PROJECT?credentials=key.json&location=US
+// URL. Without a credentials file (or GOOGLE_APPLICATION_CREDENTIALS) the
+// metadata server is used, which covers GKE workload identity.
+func newBigQuery(rawURL string) (*bigQueryClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bigquery URL: %w", err)
+	}
+	c := &bigQueryClient{
+		project:  u.Host,
+		location: u.Query().Get("location"),
+		baseURL:  bigQueryAPI,
+		http:     &http.Client{Timeout: 5 * time.Minute},
+	}
+
+	credsPath := u.Query().Get("credentials")
+	if credsPath == "" {
+		credsPath = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credsPath != "" {
+		sa, err := loadServiceAccount(credsPath)
+		if err != nil {
+			return nil, err
+		}
+		sa.http = c.http
+		c.tokens = sa
+		if c.project == "" {
+			c.project = sa.ProjectID
+		}
+	} else {
+		c.tokens = &metadataTokenSource{http: c.http}
+	}
+
+	if c.project == "" {
+		return nil, errors.New("bigquery URL must name a project: bigquery://PROJECT_ID")
+	}
+	return c, nil
+}
+
+func (c *bigQueryClient) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached.Token != "" && time.Until(c.cached.Expires) > time.Minute {
+		return c.cached.Token, nil
+	}
+	tok, err := c.tokens.token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("bigquery auth failed: %w", err)
+	}
+	c.cached = tok
+	return tok.Token, nil
+}
+
+// do sends a request to the API, giving up when ctx is cancelled.
+func (c *bigQueryClient) do(ctx context.Context, method, path string, body any, out any) error {
+	tok, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error.Message != "" {
+			return &httpError{status: resp.StatusCode, msg: apiErr.Error.Message}
+		}
+		return &httpError{status: resp.StatusCode, msg: "bigquery: unexpected status " + resp.Status}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type bqParameter struct {
+	ParameterType  bqParameterType  `json:"parameterType"`
+	ParameterValue bqParameterValue `json:"parameterValue"`
+}
+
+type bqParameterType struct {
+	Type string `json:"type"`
+}
+
+type bqParameterValue struct {
+	Value *string `json:"value,omitempty"`
+}
+
+type bqField struct {
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Mode   string    `json:"mode"`
+	Fields []bqField `json:"fields"`
+}
+
+type bqRow struct {
+	F []struct {
+		V any `json:"v"`
+	} `json:"f"`
+}
+
+type bqQueryResponse struct {
+	JobComplete  bool `json:"jobComplete"`
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Schema struct {
+		Fields []bqField `json:"fields"`
+	} `json:"schema"`
+	Rows                []bqRow `json:"rows"`
+	PageToken           string  `json:"pageToken"`
+	TotalBytesProcessed string  `json:"totalBytesProcessed"`
+}
+
+// bigQueryParams maps JSON-decoded params onto positional query parameters.
+// Queries reference them with ? placeholders.
+func bigQueryParams(params []any) []bqParameter {
+	out := make([]bqParameter, len(params))
+	for i, p := range params {
+		param := bqParameter{ParameterType: bqParameterType{Type: "STRING"}}
+		var s string
+		switch v := p.(type) {
+		case nil:
+			out[i] = param
+			continue
+		case bool:
+			param.ParameterType.Type = "BOOL"
+			s = strconv.FormatBool(v)
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				param.ParameterType.Type = "INT64"
+				s = strconv.FormatInt(int64(v), 10)
+			} else {
+				param.ParameterType.Type = "FLOAT64"
+				s = strconv.FormatFloat(v, 'g', -1, 64)
+			}
+		case int:
+			param.ParameterType.Type = "INT64"
+			s = strconv.Itoa(v)
+		case int64:
+			param.ParameterType.Type = "INT64"
+			s = strconv.FormatInt(v, 10)
+		case string:
+			s = v
+		default:
+			s = fmt.Sprint(v)
+		}
+		param.ParameterValue.Value = &s
+		out[i] = param
+	}
+	return out
+}
+
+func (c *bigQueryClient) Flavor() string { return "bigquery" }
+
+func (c *bigQueryClient) Close() error { return nil }
+
+func (c *bigQueryClient) Query(msg Message) QueryResponse {
+	return c.QueryContext(context.Background(), msg)
+}
+
+func (c *bigQueryClient) QueryContext(ctx context.Context, msg Message) QueryResponse {
+	if e := unsupportedOption(c, msg, "dry_run"); e != "" {
+		return QueryResponse{ID: msg.ID, Type: "result", Error: e, ErrorCode: codeNotSupported}
+	}
+	return c.query(ctx, msg.ID, msg.SQL, msg.Params, msg.DryRun)
+}
+
+func (c *bigQueryClient) Schema(id, schema string) SchemaResponse {
+	return SchemaResponse{ID: id, Type: "schema", Error: "schema introspection is not supported for bigquery"}
+}
+
+// estimate runs the statement as a dry run, which validates it and reports
+// how many bytes it would scan without running it.
+func (c *bigQueryClient) estimate(ctx context.Context, sqlQuery string, params []any) (*CostEstimate, error) {
+	var resp bqQueryResponse
+	err := c.do(ctx, "POST", "/projects/"+url.PathEscape(c.project)+"/queries", map[string]any{
+		"query":           sqlQuery,
+		"useLegacySql":    false,
+		"dryRun":          true,
+		"location":        c.location,
+		"parameterMode":   "POSITIONAL",
+		"queryParameters": bigQueryParams(params),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	bytesProcessed, _ := strconv.ParseInt(resp.TotalBytesProcessed, 10, 64)
+	return &CostEstimate{
+		BytesProcessed: bytesProcessed,
+		EstimatedUSD:   float64(bytesProcessed) / (1 << 40) * bigQueryPricePerTB,
+	}, nil
+}
+
+// query dry-runs the statement for a cost estimate and then, unless dryRun is
+// set, runs it as a query job and collects every result page. Cancelling ctx
+// stops waiting for the job and cancels it.
+func (c *bigQueryClient) query(ctx context.Context, id, sqlQuery string, params []any, dryRun bool) QueryResponse {
+	log.Printf("[query:%s] Executing on BigQuery: %s", id, logSQL(sqlQuery))
+	start := time.Now()
+
+	estimate, err := c.estimate(ctx, sqlQuery, params)
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		return queryError(id, err)
+	}
+	if dryRun {
+		return QueryResponse{ID: id, Type: "result", CostEstimate: estimate}
+	}
+
+	var resp bqQueryResponse
+	err = c.do(ctx, "POST", "/projects/"+url.PathEscape(c.project)+"/queries", map[string]any{
+		"query":           sqlQuery,
+		"useLegacySql":    false,
+		"location":        c.location,
+		"parameterMode":   "POSITIONAL",
+		"queryParameters": bigQueryParams(params),
+		"timeoutMs":       10000,
+	}, &resp)
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		r := queryError(id, err)
+		r.CostEstimate = estimate
+		return r
+	}
+
+	var results [][]any
+	for {
+		select {
+		case <-ctx.Done():
+			c.cancelJob(id, resp.JobReference.JobID, resp.JobReference.Location)
+			log.Printf("[query:%s] Error: %v", id, ctx.Err())
+			r := queryError(id, ctx.Err())
+			r.CostEstimate = estimate
+			return r
+		default:
+		}
+		if resp.JobComplete {
+			for _, r := range resp.Rows {
+				results = append(results, bigQueryRow(resp.Schema.Fields, r))
+			}
+			if resp.PageToken == "" {
+				break
+			}
+		}
+
+		q := url.Values{}
+		q.Set("timeoutMs", "10000")
+		if loc := resp.JobReference.Location; loc != "" {
+			q.Set("location", loc)
+		}
+		if resp.PageToken != "" {
+			q.Set("pageToken", resp.PageToken)
+		}
+		path := "/projects/" + url.PathEscape(c.project) + "/queries/" + url.PathEscape(resp.JobReference.JobID) + "?" + q.Encode()
+		// Keep the schema from the first page; later pages may omit it.
+		schema := resp.Schema
+		job := resp.JobReference
+		resp = bqQueryResponse{}
+		if err := c.do(ctx, "GET", path, nil, &resp); err != nil {
+			if ctx.Err() != nil {
+				c.cancelJob(id, job.JobID, job.Location)
+			}
+			log.Printf("[query:%s] Error: %v", id, err)
+			r := queryError(id, err)
+			r.CostEstimate = estimate
+			return r
+		}
+		if len(resp.Schema.Fields) == 0 {
+			resp.Schema = schema
+		}
+	}
+
+	columns := make([]string, len(resp.Schema.Fields))
+	for i, f := range resp.Schema.Fields {
+		columns[i] = f.Name
+	}
+
+	log.Printf("[query:%s] Completed in %v, %d rows", id, time.Since(start), len(results))
+
+	return QueryResponse{
+		ID:           id,
+		Type:         "result",
+		Columns:      columns,
+		Rows:         results,
+		CostEstimate: estimate,
+	}
+}
+
+// cancelJob asks BigQuery to stop job, whose results are no longer wanted.
+// It is best effort: the job may already be done.
+func (c *bigQueryClient) cancelJob(id, job, location string) {
+	if job == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	path := "/projects/" + url.PathEscape(c.project) + "/jobs/" + url.PathEscape(job) + "/cancel"
+	if location != "" {
+		path += "?" + url.Values{"location": {location}}.Encode()
+	}
+	if err := c.do(ctx, "POST", path, nil, &map[string]any{}); err != nil {
+		log.Printf("[query:%s] Could not cancel BigQuery job %s: %v", id, job, err)
+	}
+}
+
+func bigQueryRow(fields []bqField, r bqRow) []any {
+	row := make([]any, len(fields))
+	for i, f := range fields {
+		if i < len(r.F) {
+			row[i] = bigQueryValue(f, r.F[i].V)
+		}
+	}
+	return row
+}
+
+// bigQueryValue converts the REST API's string-encoded cells into the same
+// JSON shapes executeQuery produces for Postgres.
+func bigQueryValue(f bqField, v any) any {
+	if v == nil {
+		return nil
+	}
+	if f.Mode == "REPEATED" {
+		items, _ := v.([]any)
+		out := make([]any, len(items))
+		elem := f
+		elem.Mode = ""
+		for i, item := range items {
+			if m, ok := item.(map[string]any); ok {
+				out[i] = bigQueryValue(elem, m["v"])
+			}
+		}
+		return out
+	}
+
+	if f.Type == "RECORD" || f.Type == "STRUCT" {
+		m, _ := v.(map[string]any)
+		cells, _ := m["f"].([]any)
+		out := make(map[string]any, len(f.Fields))
+		for i, sub := range f.Fields {
+			if i < len(cells) {
+				if cell, ok := cells[i].(map[string]any); ok {
+					out[sub.Name] = bigQueryValue(sub, cell["v"])
+				}
+			}
+		}
+		return out
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch f.Type {
+	case "INTEGER", "INT64":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case "FLOAT", "FLOAT64":
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	case "BOOLEAN", "BOOL":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "TIMESTAMP":
+		// Timestamps arrive as fractional seconds since the epoch.
+		if secs, err := strconv.ParseFloat(s, 64); err == nil {
+			whole, frac := math.Modf(secs)
+			return time.Unix(int64(whole), int64(frac*1e9)).UTC().Format(time.RFC3339)
+		}
+	}
+	return s
+}
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	ProjectID   string `json:"project_id"`
+
+	key  *rsa.PrivateKey
+	http *http.Client
+}
+
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials: %w", err)
+	}
+	var sa serviceAccount
+	if err := json.Unmarshal(buf, &sa); err != nil {
+		return nil, fmt.Errorf("parse credentials: %w", err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("credentials: private_key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("credentials: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("credentials: private_key is not an RSA key")
+	}
+	sa.key = key
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &sa, nil
+}
+
+// token exchanges a self-signed JWT for an access token (RFC 7523).
+func (sa *serviceAccount) token(ctx context.Context) (accessToken, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": bigQueryScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return accessToken{}, err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return accessToken{}, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sa.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := sa.http.Do(req)
+	if err != nil {
+		return accessToken{}, err
+	}
+	defer resp.Body.Close()
+	return decodeTokenResponse(resp)
+}
+
+type metadataTokenSource struct {
+	http *http.Client
+}
+
+func (m *metadataTokenSource) token(ctx context.Context) (accessToken, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", gceMetadataToken, nil)
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	return decodeTokenResponse(resp)
+}
+
+func decodeTokenResponse(resp *http.Response) (accessToken, error) {
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return accessToken{}, fmt.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return accessToken{}, err
+	}
+	return accessToken{
+		Token:   tok.AccessToken,
+		Expires: time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+	}, nil
+}
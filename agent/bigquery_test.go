@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type staticToken string
+
+func (s staticToken) token(ctx context.Context) (accessToken, error) {
+	return accessToken{Token: string(s), Expires: time.Now().Add(time.Hour)}, nil
+}
+
+func TestBigQueryParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     any
+		wantType  string
+		wantValue string
+		wantNull  bool
+	}{
+		{name: "integral number", input: float64(42), wantType: "INT64", wantValue: "42"},
+		{name: "fractional number", input: 1.5, wantType: "FLOAT64", wantValue: "1.5"},
+		{name: "string", input: "alice", wantType: "STRING", wantValue: "alice"},
+		{name: "bool", input: true, wantType: "BOOL", wantValue: "true"},
+		{name: "null", input: nil, wantType: "STRING", wantNull: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := bigQueryParams([]any{tc.input})[0]
+			if p.ParameterType.Type != tc.wantType {
+				t.Errorf("type = %q, want %q", p.ParameterType.Type, tc.wantType)
+			}
+			if tc.wantNull {
+				if p.ParameterValue.Value != nil {
+					t.Errorf("expected null value, got %q", *p.ParameterValue.Value)
+				}
+				return
+			}
+			if p.ParameterValue.Value == nil || *p.ParameterValue.Value != tc.wantValue {
+				t.Errorf("value = %v, want %q", p.ParameterValue.Value, tc.wantValue)
+			}
+		})
+	}
+}
+
+func TestBigQueryValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    bqField
+		input    any
+		expected any
+	}{
+		{name: "integer", field: bqField{Type: "INTEGER"}, input: "7", expected: int64(7)},
+		{name: "float", field: bqField{Type: "FLOAT"}, input: "2.5", expected: 2.5},
+		{name: "boolean", field: bqField{Type: "BOOLEAN"}, input: "true", expected: true},
+		{name: "timestamp", field: bqField{Type: "TIMESTAMP"}, input: "1.7394567E9", expected: "2025-02-13T14:25:00Z"},
+		{name: "string", field: bqField{Type: "STRING"}, input: "x", expected: "x"},
+		{name: "null", field: bqField{Type: "STRING"}, input: nil, expected: nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := bigQueryValue(tc.field, tc.input)
+			if result != tc.expected {
+				t.Errorf("bigQueryValue(%v) = %v (%T), want %v (%T)", tc.input, result, result, tc.expected, tc.expected)
+			}
+		})
+	}
+}
+
+func TestBigQueryQuery(t *testing.T) {
+	var dryRuns, runs int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("missing bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/projects/proj/queries":
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["dryRun"] == true {
+				dryRuns++
+				w.Write([]byte(`{"jobComplete":true,"totalBytesProcessed":"1099511627776"}`))
+				return
+			}
+			runs++
+			w.Write([]byte(`{
+				"jobComplete": true,
+				"jobReference": {"jobId": "job1", "location": "US"},
+				"schema": {"fields": [{"name": "id", "type": "INTEGER"}, {"name": "name", "type": "STRING"}]},
+				"rows": [{"f": [{"v": "1"}, {"v": "Alice"}]}],
+				"pageToken": "p2"
+			}`))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/projects/proj/queries/job1"):
+			if r.URL.Query().Get("pageToken") != "p2" {
+				t.Errorf("expected pageToken p2, got %q", r.URL.Query().Get("pageToken"))
+			}
+			w.Write([]byte(`{"jobComplete": true, "rows": [{"f": [{"v": "2"}, {"v": null}]}]}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := &bigQueryClient{project: "proj", baseURL: server.URL, http: server.Client(), tokens: staticToken("test-token")}
+
+	resp := c.query(context.Background(), "q1", "SELECT id, name FROM t", nil, false)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if resp.CostEstimate == nil || resp.CostEstimate.BytesProcessed != 1<<40 || resp.CostEstimate.EstimatedUSD != bigQueryPricePerTB {
+		t.Errorf("unexpected cost estimate: %+v", resp.CostEstimate)
+	}
+	if len(resp.Columns) != 2 || resp.Columns[0] != "id" || resp.Columns[1] != "name" {
+		t.Errorf("unexpected columns: %v", resp.Columns)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("expected 2 rows across pages, got %d", len(resp.Rows))
+	}
+	if resp.Rows[1][0] != int64(2) || resp.Rows[1][1] != nil {
+		t.Errorf("unexpected second row: %v", resp.Rows[1])
+	}
+
+	resp = c.query(context.Background(), "q2", "SELECT id, name FROM t", nil, true)
+	if resp.Error != "" || resp.CostEstimate == nil || len(resp.Rows) != 0 {
+		t.Errorf("dry run should only return an estimate, got %+v", resp)
+	}
+	if dryRuns != 2 || runs != 1 {
+		t.Errorf("expected 2 dry runs and 1 run, got %d and %d", dryRuns, runs)
+	}
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// A "download_blob" message runs a query that selects a single bytea or BLOB
+// value and streams it back as binary websocket frames, avoiding the base64
+// overhead of JSON. The transfer is framed as
+//
+//	{"type": "blob_start", "id": ..., "size": N}   (JSON)
+//	binary frames, see blobFrame
+//	{"type": "blob_end", "id": ..., "size": N, "checksum": "crc32c:..."}   (JSON)
+//
+// A failure before the first byte is sent as a blob_end with an error.
+
+const blobFrameSize = 256 << 10
+
+type BlobStart struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+type BlobEnd struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// blobDownload is the reply to a download_blob message; writeReply streams
+// it.
+type blobDownload struct {
+	id         string
+	connection string
+	data       []byte
+}
+
+// blobFrame lays out one binary frame: a byte with the length of the
+// message ID, the ID, the big-endian uint64 offset of the data within the
+// value, the big-endian uint32 data length, then the data.
+func blobFrame(id string, offset int, data []byte) []byte {
+	buf := make([]byte, 0, 1+len(id)+12+len(data))
+	buf = append(buf, byte(len(id)))
+	buf = append(buf, id...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(offset))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+func downloadBlob(msg Message) any {
+	fail := func(err error) BlobEnd {
+		log.Printf("[blob:%s] Error: %v", msg.ID, err)
+		return BlobEnd{ID: msg.ID, Type: "blob_end", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	if len(msg.ID) > 255 {
+		return fail(codedErrorf(codeInvalidRequest, "id is longer than 255 bytes"))
+	}
+
+	caps := msg.capabilities()
+	if !caps.CanExport {
+		return fail(codedErrorf(codePolicyDenied, "download_blob is not allowed for this token"))
+	}
+	if err := caps.checkStatement(msg.SQL); err != nil {
+		return fail(err)
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok {
+		return fail(codedErrorf(codeNotSupported, "download_blob is not supported for %s", c.Flavor()))
+	}
+
+	query := msg.SQL
+	if sc.flavor == "oracle" {
+		query = oraclePlaceholders(query)
+	}
+	log.Printf("[blob:%s] Executing: %s", msg.ID, logSQL(query))
+	data, err := fetchBlob(sc.db, query, msg.Params)
+	if err != nil {
+		end := fail(err)
+		end.Connection = c.Name
+		return end
+	}
+	return &blobDownload{id: msg.ID, connection: c.Name, data: data}
+}
+
+func fetchBlob(q queryer, query string, params []any) ([]byte, error) {
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) != 1 {
+		return nil, codedErrorf(codeInvalidRequest, "download_blob query must select one column, got %d", len(columns))
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, codedErrorf(codeInvalidRequest, "download_blob query returned no rows")
+	}
+	var data []byte
+	if err := rows.Scan(&data); err != nil {
+		return nil, err
+	}
+	return data, rows.Err()
+}
+
+func writeBlob(w replyWriter, b *blobDownload) error {
+	if err := w.WriteJSON(BlobStart{ID: b.id, Type: "blob_start", Size: len(b.data)}); err != nil {
+		return err
+	}
+	for offset := 0; offset < len(b.data); offset += blobFrameSize {
+		end := offset + blobFrameSize
+		if end > len(b.data) {
+			end = len(b.data)
+		}
+		if err := w.WriteMessage(websocket.BinaryMessage, blobFrame(b.id, offset, b.data[offset:end])); err != nil {
+			return err
+		}
+	}
+	log.Printf("[blob:%s] Sent %d bytes", b.id, len(b.data))
+	return w.WriteJSON(BlobEnd{
+		ID:         b.id,
+		Type:       "blob_end",
+		Size:       len(b.data),
+		Checksum:   fmt.Sprintf("crc32c:%08x", crc32.Checksum(b.data, castagnoli)),
+		Connection: b.connection,
+	})
+}
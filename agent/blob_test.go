@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDownloadBlob(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "default", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	data := bytes.Repeat([]byte{0, 1, 2, 0xff}, blobFrameSize/2)
+	mock.ExpectQuery("SELECT content FROM files").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow(data))
+
+	resp := downloadBlob(Message{Type: "download_blob", ID: "b1", SQL: "SELECT content FROM files WHERE id = $1", Params: []any{42}, tenant: tn})
+	w := &recordingWriter{}
+	if err := writeReply(w, Message{}, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(w.frames) != 2 || w.frames[0]["type"] != "blob_start" || w.frames[1]["type"] != "blob_end" {
+		t.Fatalf("expected blob_start and blob_end, got %v", w.frames)
+	}
+	if w.frames[0]["size"] != float64(len(data)) {
+		t.Errorf("expected size %d, got %v", len(data), w.frames[0]["size"])
+	}
+	wantSum := fmt.Sprintf("crc32c:%08x", crc32.Checksum(data, castagnoli))
+	if w.frames[1]["checksum"] != wantSum {
+		t.Errorf("expected checksum %s, got %v", wantSum, w.frames[1]["checksum"])
+	}
+
+	if len(w.binary) != 2 {
+		t.Fatalf("expected 2 binary frames, got %d", len(w.binary))
+	}
+	var got []byte
+	for i, frame := range w.binary {
+		if int(frame[0]) != 2 || string(frame[1:3]) != "b1" {
+			t.Fatalf("frame %d: bad id header %q", i, frame[:3])
+		}
+		offset := binary.BigEndian.Uint64(frame[3:11])
+		length := binary.BigEndian.Uint32(frame[11:15])
+		if int(offset) != len(got) || int(length) != len(frame)-15 {
+			t.Fatalf("frame %d: offset %d length %d, have %d bytes", i, offset, length, len(got))
+		}
+		got = append(got, frame[15:]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("reassembled blob does not match")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDownloadBlobErrors(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "default", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	testCases := []struct {
+		name    string
+		rows    *sqlmock.Rows
+		wantErr string
+	}{
+		{
+			name:    "no rows",
+			rows:    sqlmock.NewRows([]string{"content"}),
+			wantErr: "download_blob query returned no rows",
+		},
+		{
+			name:    "several columns",
+			rows:    sqlmock.NewRows([]string{"name", "content"}).AddRow("a", []byte("x")),
+			wantErr: "download_blob query must select one column, got 2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock.ExpectQuery("SELECT").WillReturnRows(tc.rows)
+			resp := downloadBlob(Message{ID: "b1", SQL: "SELECT * FROM files", tenant: tn})
+			end, ok := resp.(BlobEnd)
+			if !ok {
+				t.Fatalf("expected BlobEnd, got %T", resp)
+			}
+			if end.Error != tc.wantErr {
+				t.Errorf("expected error %q, got %q", tc.wantErr, end.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// started is when the agent process started, for /healthz.
+var started = time.Now()
+
+// features are the protocol features this build supports, so the hub can
+// gate on them rather than on version numbers. Add one with each new
+// message type or message option the hub may send.
+var features = []string{
+	"advisor", "alerts", "apply_changes", "backups", "call", "cancel", "chunked_results",
+	"clock", "compression", "config_update", "ddl_review", "download_blob", "duplicates",
+	"estimate_count", "export_jobs", "fetch_cell", "foreign_keys", "get_definition",
+	"history", "insert_row", "job_progress", "kill_session", "locks", "matviews", "migrate",
+	"notices", "number_formats", "partitions", "preview_table", "promote", "result_sets",
+	"sample", "scan_pii", "scratch_databases", "search_schema", "sequences", "set_comment",
+	"shared_results", "spill", "stable_order", "time_buckets", "top_queries", "usage_report",
+	"user_types", "validate_identifier",
+}
+
+// BuildInfo describes the agent binary: its release, the commit and date
+// it was built from, and what it supports.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Date      string   `json:"date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+}
+
+// currentBuild returns the running agent's BuildInfo.
+func (a *Agent) currentBuild() BuildInfo {
+	return completeBuild(BuildInfo{Version: a.opts.Version, Commit: a.opts.Commit, Date: a.opts.BuildDate})
+}
+
+// completeBuild fills in the rest of b from the binary. A commit and date
+// not set with -ldflags come from the version control information Go
+// records when building from a checkout.
+func completeBuild(b BuildInfo) BuildInfo {
+	b.GoVersion, b.Platform = runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH
+	ldflags := b.Commit != ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var modified bool
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.Date == "" {
+					b.Date = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && !ldflags && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	b.Features = append([]string(nil), features...)
+	if newGSS != nil {
+		b.Features = append(b.Features, "kerberos")
+	}
+	return b
+}
+
+// Health is what /healthz serves.
+type Health struct {
+	Status        string    `json:"status"`
+	Build         BuildInfo `json:"build"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	InstanceID    string    `json:"instance_id"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+func (a *Agent) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Health{
+		Status:        "ok",
+		Build:         a.currentBuild(),
+		AgentID:       a.opts.AgentID,
+		InstanceID:    a.instanceID,
+		UptimeSeconds: int64(time.Since(started).Seconds()),
+	})
+}
+
+// RunVersion prints the BuildInfo of the binary whose version, commit and
+// date build gives, returning the process exit code.
+func RunVersion(args []string, build BuildInfo, w io.Writer) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	fs.SetOutput(w)
+	asJSON := fs.Bool("json", false, "Print the build information as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	b := completeBuild(build)
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(b)
+		return 0
+	}
+	fmt.Fprintf(w, "peekdb-agent %s\n", b.Version)
+	if b.Commit != "" {
+		fmt.Fprintf(w, "commit:   %s\n", b.Commit)
+	}
+	if b.Date != "" {
+		fmt.Fprintf(w, "built:    %s\n", b.Date)
+	}
+	fmt.Fprintf(w, "go:       %s %s\n", b.GoVersion, b.Platform)
+	fmt.Fprintf(w, "features: %s\n", strings.Join(b.Features, ", "))
+	return 0
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompleteBuild(t *testing.T) {
+	b := completeBuild(BuildInfo{Version: "v1.9.0", Commit: "abc123", Date: "2026-10-01T12:00:00Z"})
+	if b.Version != "v1.9.0" || b.Commit != "abc123" || b.Date != "2026-10-01T12:00:00Z" {
+		t.Errorf("expected the -ldflags values kept, got %+v", b)
+	}
+	if b.GoVersion == "" || !strings.Contains(b.Platform, "/") {
+		t.Errorf("expected the Go version and platform, got %+v", b)
+	}
+	if !slices.Contains(b.Features, "shared_results") || slices.Contains(b.Features, "kerberos") {
+		t.Errorf("expected this build's features, got %v", b.Features)
+	}
+}
+
+func TestRunVersion(t *testing.T) {
+	var out bytes.Buffer
+	if code := RunVersion([]string{"--json"}, BuildInfo{Version: "v1.9.0", Commit: "abc123"}, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	var b BuildInfo
+	if err := json.Unmarshal(out.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Version != "v1.9.0" || b.Commit != "abc123" || len(b.Features) == 0 {
+		t.Errorf("unexpected build info: %+v", b)
+	}
+
+	out.Reset()
+	RunVersion(nil, BuildInfo{Version: "v1.9.0"}, &out)
+	if !strings.HasPrefix(out.String(), "peekdb-agent v1.9.0\n") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	o := DefaultOptions()
+	o.Version, o.Commit = "v1.9.0", "abc123"
+	a := bareAgent(o, nil)
+	w := httptest.NewRecorder()
+	a.healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	var h Health
+	if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Status != "ok" || h.Build.Version != "v1.9.0" || h.Build.Commit != "abc123" || h.InstanceID != a.instanceID {
+		t.Errorf("unexpected health: %+v", h)
+	}
+}
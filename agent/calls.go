@@ -0,0 +1,540 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	go_ora "github.com/sijms/go-ora/v2"
+)
+
+// CallArg is an argument of a call message. Name, when set, is the
+// parameter it is for, and Type, when set, that parameter's declared type;
+// either picks between the overloads of a routine. The value is cast to
+// the type the routine declares.
+type CallArg struct {
+	Name  string `json:"name,omitempty"`
+	Value any    `json:"value"`
+	Type  string `json:"type,omitempty"`
+}
+
+// ResultSet is a result after a response's first, such as a cursor a
+// called routine opened or a later query of a batch. Its rows are limited and formatted like the
+// first result's.
+type ResultSet struct {
+	Name        string          `json:"name,omitempty"`
+	Columns     []string        `json:"columns"`
+	ColumnTypes []string        `json:"column_types,omitempty"`
+	Rows        [][]any         `json:"rows"`
+	Truncated   []TruncatedCell `json:"truncated,omitempty"`
+	RowLimit    int             `json:"row_limit,omitempty"`
+}
+
+// eachResultSet calls f with each of resp's result sets as a response of
+// its own, so what shapes the rows of a response shapes theirs too. A
+// set's truncated cells are kept under the response's ID and the set's
+// number.
+func (resp *QueryResponse) eachResultSet(f func(*QueryResponse)) {
+	for i := range resp.ResultSets {
+		s := &resp.ResultSets[i]
+		r := QueryResponse{ID: resp.ID + "." + strconv.Itoa(i+1), Columns: s.Columns, ColumnTypes: s.ColumnTypes, Rows: s.Rows}
+		f(&r)
+		s.ColumnTypes, s.Rows, s.Truncated, s.RowLimit = r.ColumnTypes, r.Rows, r.Truncated, r.RowLimit
+	}
+}
+
+// routineParam is a parameter of a routine as the catalog declares it.
+// Mode is "in", "out" or "inout"; a function's result is an "out"
+// parameter named after the function on Oracle.
+type routineParam struct {
+	name, mode, typ string
+	hasDefault      bool
+}
+
+func (p routineParam) input() bool { return p.mode != "out" }
+
+// routine is one overload of a function or procedure. cursors is set
+// when it returns cursors.
+type routine struct {
+	schema, name string
+	procedure    bool
+	params       []routineParam
+	cursors      bool
+}
+
+// callBind is a value the call statement binds: an argument, or on
+// Oracle also a place for an OUT parameter's value.
+type callBind struct {
+	param routineParam
+	value any
+}
+
+// routineCall is a call message's routine and what its statement binds.
+// It reaches executeQuery with the query's context; see withCall.
+type routineCall struct {
+	routine
+	binds []callBind
+}
+
+type callKey struct{}
+
+// withCall marks ctx's query as a call of c.
+func withCall(ctx context.Context, c *routineCall) context.Context {
+	return context.WithValue(ctx, callKey{}, c)
+}
+
+func callFrom(ctx context.Context) *routineCall {
+	c, _ := ctx.Value(callKey{}).(*routineCall)
+	return c
+}
+
+// inTransaction reports whether c has to run in a transaction: on Oracle
+// to read its binds back, and elsewhere when it returns cursors, which
+// are closed at the end of the transaction. Otherwise a procedure may
+// commit as it goes, which it can't inside one.
+func (c *routineCall) inTransaction(flavor string) bool {
+	return c != nil && (flavor == "oracle" || c.cursors)
+}
+
+// routinesQuery reads the overloads of the functions and procedures named
+// $1, in schema $2 or, when that is empty, on the search path. Table
+// columns of a RETURNS TABLE function are OUT parameters, and a VARIADIC
+// parameter takes its array as one argument.
+const routinesQuery = `
+SELECT n.nspname, p.proname, p.prokind = 'p', format_type(p.prorettype, NULL), p.pronargdefaults,
+       coalesce(p.proargnames, '{}')::text[],
+       coalesce(p.proargmodes::text[], '{}')::text[],
+       array(SELECT format_type(a.t, NULL)
+             FROM unnest(coalesce(p.proallargtypes, p.proargtypes::oid[])) WITH ORDINALITY AS a(t, i)
+             ORDER BY a.i)::text[]
+FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace
+WHERE p.prokind IN ('f', 'p') AND p.proname = $1
+  AND (n.nspname = $2 OR $2 = '' AND pg_function_is_visible(p.oid))
+ORDER BY p.oid`
+
+var argModes = map[string]string{
+	"i": "in",
+	"v": "in",
+	"o": "out",
+	"t": "out",
+	"b": "inout",
+}
+
+// oracleRoutinesQuery is routinesQuery for Oracle, one row per parameter.
+// Position 0 is a function's result; a procedure without parameters has
+// a row with no data type.
+const oracleRoutinesQuery = `
+SELECT owner, object_name, NVL(overload, '0'), NVL(argument_name, ' '), position, in_out,
+       NVL(data_type, ' '), defaulted
+FROM all_arguments
+WHERE object_name = :1 AND owner = NVL(:2, SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA'))
+  AND package_name IS NULL AND data_level = 0
+ORDER BY overload, position`
+
+var oracleArgModes = map[string]string{
+	"IN":     "in",
+	"OUT":    "out",
+	"IN/OUT": "inout",
+}
+
+// callRoutine answers a "call" message, which calls the function or
+// procedure msg.Routine names, written as in a statement, with msg.Args.
+// The call is a query with the message's ID, so the connection's and
+// token's policies, limits and "cancel" apply; its rows are the
+// function's result or the procedure's OUT parameters, and the cursors
+// it returns are read into result sets.
+func callRoutine(msg Message) QueryResponse {
+	c, err := msg.route()
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || (sc.flavor != "postgres" && sc.flavor != "oracle") {
+		return queryError(msg.ID, codedErrorf(codeNotSupported, "call is not supported for %s", c.Flavor()))
+	}
+	parts, err := identifierParts(msg.Routine)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	if len(parts) > 2 {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "%q is not a routine: expected name or schema.name", msg.Routine))
+	}
+	d := dialectFor(sc.flavor)
+	name, schema := d.name(parts[len(parts)-1]), ""
+	if len(parts) == 2 {
+		schema = d.name(parts[0])
+	}
+	caps := msg.capabilities()
+	if schema != "" && !caps.schemaAllowed(schema) {
+		return queryError(msg.ID, codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", schema))
+	}
+
+	overloads, err := loadRoutines(msg.context(), sc, name, schema)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	r, err := pickOverload(overloads, msg.Args, d.qualifiedSQL(parts))
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	if !caps.schemaAllowed(r.schema) {
+		return queryError(msg.ID, codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", r.schema))
+	}
+	call := &routineCall{routine: r}
+	stmt, err := call.statement(sc.flavor, msg.Args)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+
+	q := msg
+	q.Type, q.Routine, q.Args = "query", "", nil
+	q.SQL, q.Params = stmt, nil
+	for _, b := range call.binds {
+		if b.param.input() {
+			q.Params = append(q.Params, b.value)
+		}
+	}
+	q.ctx = withCall(msg.context(), call)
+	return runQuery(q)
+}
+
+// loadRoutines reads the overloads of the routines named name in schema,
+// or on the search path when schema is empty.
+func loadRoutines(ctx context.Context, sc *sqlConnector, name, schema string) ([]routine, error) {
+	if sc.flavor == "oracle" {
+		return loadOracleRoutines(ctx, sc, name, schema)
+	}
+	rows, err := sc.db.QueryContext(ctx, routinesQuery, name, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var routines []routine
+	for rows.Next() {
+		var r routine
+		var returns string
+		var defaults int
+		var names, modes, types []string
+		if err := rows.Scan(&r.schema, &r.name, &r.procedure, &returns, &defaults, pq.Array(&names), pq.Array(&modes), pq.Array(&types)); err != nil {
+			return nil, err
+		}
+		r.cursors = returns == "refcursor" || slices.Contains(types, "refcursor")
+		for i, typ := range types {
+			p := routineParam{mode: "in", typ: typ}
+			if i < len(names) {
+				p.name = names[i]
+			}
+			if i < len(modes) {
+				p.mode = argModes[modes[i]]
+			}
+			r.params = append(r.params, p)
+		}
+		// The defaults are those of the last inputs.
+		for i := len(r.params) - 1; i >= 0 && defaults > 0; i-- {
+			if r.params[i].input() {
+				r.params[i].hasDefault = true
+				defaults--
+			}
+		}
+		routines = append(routines, r)
+	}
+	return routines, rows.Err()
+}
+
+func loadOracleRoutines(ctx context.Context, sc *sqlConnector, name, schema string) ([]routine, error) {
+	rows, err := sc.db.QueryContext(ctx, oracleRoutinesQuery, name, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var routines []routine
+	last := ""
+	for rows.Next() {
+		var owner, object, overload, arg, inOut, typ, defaulted string
+		var position int
+		if err := rows.Scan(&owner, &object, &overload, &arg, &position, &inOut, &typ, &defaulted); err != nil {
+			return nil, err
+		}
+		if len(routines) == 0 || overload != last {
+			routines = append(routines, routine{schema: owner, name: object, procedure: true})
+			last = overload
+		}
+		r := &routines[len(routines)-1]
+		switch {
+		case position == 0:
+			// A function's result comes first, bound as :1 := f(...).
+			r.procedure = false
+			r.params = append(r.params, routineParam{name: object, mode: "out", typ: typ})
+		case strings.TrimSpace(typ) != "":
+			r.params = append(r.params, routineParam{name: arg, mode: oracleArgModes[inOut], typ: typ, hasDefault: defaulted == "Y"})
+		}
+		r.cursors = r.cursors || typ == "REF CURSOR"
+	}
+	return routines, rows.Err()
+}
+
+// pickOverload returns the overload args fit: given by name or position,
+// leaving out only parameters with defaults, and of the types they give.
+func pickOverload(overloads []routine, args []CallArg, name string) (routine, error) {
+	if len(overloads) == 0 {
+		return routine{}, codedErrorf(codeInvalidRequest, "no function or procedure named %s", name)
+	}
+	named := len(args) > 0 && args[0].Name != ""
+	for _, a := range args {
+		if (a.Name != "") != named {
+			return routine{}, codedErrorf(codeInvalidRequest, "arguments must all be named or all be positional")
+		}
+	}
+	var fits []routine
+	for _, r := range overloads {
+		if r.fits(args, named) {
+			fits = append(fits, r)
+		}
+	}
+	switch len(fits) {
+	case 0:
+		return routine{}, codedErrorf(codeInvalidRequest, "no overload of %s takes these arguments", name)
+	case 1:
+		return fits[0], nil
+	}
+	return routine{}, codedErrorf(codeInvalidRequest, "%s has %d overloads that take these arguments; give each argument's type", name, len(fits))
+}
+
+func (r routine) fits(args []CallArg, named bool) bool {
+	given := map[int]CallArg{}
+	var inputs []int
+	for i, p := range r.params {
+		if p.input() {
+			inputs = append(inputs, i)
+		}
+	}
+	if named {
+		for _, a := range args {
+			i := slices.IndexFunc(r.params, func(p routineParam) bool { return p.input() && strings.EqualFold(p.name, a.Name) })
+			if i < 0 {
+				return false
+			}
+			given[i] = a
+		}
+	} else {
+		if len(args) > len(inputs) {
+			return false
+		}
+		for j, a := range args {
+			given[inputs[j]] = a
+		}
+	}
+	for _, i := range inputs {
+		a, ok := given[i]
+		if !ok && !r.params[i].hasDefault {
+			return false
+		}
+		if ok && a.Type != "" && !strings.EqualFold(strings.TrimSpace(a.Type), r.params[i].typ) {
+			return false
+		}
+	}
+	return true
+}
+
+// statement writes the statement that calls c with args, which must fit
+// it, and fills in c.binds. Parameters are passed by position until one
+// is left out for its default, and by name from there on, as all of them
+// are when args are named. Postgres takes a procedure's OUT parameters as
+// NULLs; Oracle binds a place for each, and for a function's result.
+func (c *routineCall) statement(flavor string, args []CallArg) (string, error) {
+	d := dialectFor(flavor)
+	named := len(args) > 0 && args[0].Name != ""
+	argFor := func(i, input int) (CallArg, bool) {
+		p := c.params[i]
+		if named {
+			for _, a := range args {
+				if strings.EqualFold(a.Name, p.name) {
+					return a, true
+				}
+			}
+			return CallArg{}, false
+		}
+		if input < len(args) {
+			return args[input], true
+		}
+		return CallArg{}, false
+	}
+
+	var list []string
+	byName := named
+	input := 0
+	result := ""
+	for i, p := range c.params {
+		a, given := CallArg{}, false
+		if p.input() {
+			a, given = argFor(i, input)
+			input++
+		}
+		var expr string
+		switch {
+		case flavor == "oracle" && !c.procedure && i == 0:
+			c.binds = append(c.binds, callBind{param: p})
+			result = ":1 := "
+			continue
+		case p.input() && !given:
+			byName = true
+			continue
+		case flavor == "oracle":
+			c.binds = append(c.binds, callBind{param: p, value: a.Value})
+			expr = ":" + strconv.Itoa(len(c.binds))
+		case p.input():
+			c.binds = append(c.binds, callBind{param: p, value: a.Value})
+			expr = fmt.Sprintf("$%d::%s", len(c.binds), p.typ)
+		case c.procedure:
+			expr = "NULL::" + p.typ
+		default:
+			// A function's OUT parameters are its result's columns.
+			continue
+		}
+		if byName {
+			if p.name == "" {
+				return "", codedErrorf(codeInvalidRequest, "parameter %d of %s has no name, so it can't be passed after one left to its default", i+1, c.name)
+			}
+			expr = d.quoted(p.name) + " => " + expr
+		}
+		list = append(list, expr)
+	}
+	routine := d.quoted(c.schema) + "." + d.quoted(c.name) + "(" + strings.Join(list, ", ") + ")"
+	switch {
+	case flavor == "oracle":
+		return "BEGIN " + result + routine + "; END;", nil
+	case c.procedure:
+		return "CALL " + routine, nil
+	}
+	return "SELECT * FROM " + routine, nil
+}
+
+// fetchCall runs a call's statement in tx, where the cursors it opens
+// stay open to be read into result sets.
+func (c *sqlConnector) fetchCall(ctx context.Context, tx *sql.Tx, call *routineCall, query string, params []any, lim *resultLimit, tm *queryTimer) ([]string, []string, [][]any, []ResultSet, error) {
+	if c.flavor == "oracle" {
+		return c.fetchOracleCall(ctx, tx, call, query, tm)
+	}
+	columns, types, rows, err := fetchRows(tx, c.flavor, query, params, lim, tm, progressFrom(ctx))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var sets []ResultSet
+	d := dialectFor(c.flavor)
+	for j, typ := range types {
+		if typ != "refcursor" {
+			continue
+		}
+		for i, row := range rows {
+			cursor, ok := row[j].(string)
+			if !ok {
+				continue
+			}
+			name := columns[j]
+			if len(rows) > 1 {
+				name += "." + strconv.Itoa(i+1)
+			}
+			set, err := fetchResultSet(tx, c.flavor, name, "FETCH ALL FROM "+d.quoted(cursor), c.owner().resultLimit(context.Background(), "cursor"), tm)
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("fetch cursor %s: %w", name, err)
+			}
+			sets = append(sets, set)
+		}
+	}
+	return columns, types, rows, sets, nil
+}
+
+// fetchOracleCall runs an Oracle call's PL/SQL block. Its one row is the
+// function's result or the procedure's OUT parameters.
+func (c *sqlConnector) fetchOracleCall(ctx context.Context, tx *sql.Tx, call *routineCall, query string, tm *queryTimer) ([]string, []string, [][]any, []ResultSet, error) {
+	args := make([]any, len(call.binds))
+	outs := make([]any, len(call.binds))
+	for i, b := range call.binds {
+		switch {
+		case b.param.mode == "in":
+			args[i] = b.value
+		case b.param.typ == "REF CURSOR":
+			var cursor go_ora.RefCursor
+			outs[i], args[i] = &cursor, sql.Out{Dest: &cursor}
+		case strings.HasPrefix(b.param.typ, "DATE") || strings.HasPrefix(b.param.typ, "TIMESTAMP"):
+			v := sql.NullTime{}
+			if t, ok := b.value.(string); ok {
+				v.Time, _ = time.Parse(time.RFC3339Nano, t)
+				v.Valid = !v.Time.IsZero()
+			}
+			outs[i], args[i] = &v, go_ora.Out{Dest: &v, In: b.param.mode == "inout"}
+		default:
+			v := sql.NullString{}
+			if b.value != nil {
+				v = sql.NullString{String: fmt.Sprint(b.value), Valid: true}
+			}
+			outs[i], args[i] = &v, go_ora.Out{Dest: &v, Size: 32767, In: b.param.mode == "inout"}
+		}
+	}
+	start := time.Now()
+	_, err := tx.ExecContext(ctx, query, args...)
+	tm.record(phaseExecute, start)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	var columns, types []string
+	var row []any
+	var sets []ResultSet
+	for i, b := range call.binds {
+		switch v := outs[i].(type) {
+		case *go_ora.RefCursor:
+			rows, err := go_ora.WrapRefCursor(ctx, tx, v)
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("fetch cursor %s: %w", b.param.name, err)
+			}
+			set, err := fetchResultSet(openRows{rows}, c.flavor, b.param.name, "", c.owner().resultLimit(context.Background(), "cursor"), tm)
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("fetch cursor %s: %w", b.param.name, err)
+			}
+			sets = append(sets, set)
+			continue
+		case *sql.NullTime:
+			row = append(row, nil)
+			if v.Valid {
+				row[len(row)-1] = v.Time
+			}
+		case *sql.NullString:
+			row = append(row, nil)
+			if v.Valid {
+				row[len(row)-1] = oracleValue(b.param.typ, v.String)
+			}
+		default:
+			continue
+		}
+		columns = append(columns, b.param.name)
+		types = append(types, strings.ToLower(b.param.typ))
+	}
+	var rows [][]any
+	if len(columns) > 0 {
+		rows = [][]any{row}
+	}
+	return columns, types, rows, sets, nil
+}
+
+// fetchResultSet reads query's rows into a result set. lim, which must not
+// spill, keeps it to --max-result-bytes.
+func fetchResultSet(q queryer, flavor, name, query string, lim *resultLimit, tm *queryTimer) (ResultSet, error) {
+	columns, types, rows, err := fetchRows(q, flavor, query, nil, lim, tm, nil)
+	if err != nil {
+		return ResultSet{}, err
+	}
+	return ResultSet{Name: name, Columns: columns, ColumnTypes: types, Rows: rows}, nil
+}
+
+// openRows hands fetchRows rows that are already open, such as an Oracle
+// cursor's.
+type openRows struct{ rows *sql.Rows }
+
+func (o openRows) Query(string, ...any) (*sql.Rows, error) { return o.rows, nil }
@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCallRoutine(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(
+		&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+		&connection{Name: "ro", ReadOnly: true, Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+	)
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public"}})
+	routines := []string{"nspname", "proname", "procedure", "returns", "defaults", "names", "modes", "types"}
+	addUser := func() *sqlmock.Rows {
+		return sqlmock.NewRows(routines).
+			AddRow("public", "add_user", false, "integer", 1, "{email,admin}", "{}", "{text,boolean}").
+			AddRow("public", "add_user", false, "integer", 0, "{email,team}", "{}", "{text,integer}")
+	}
+
+	tests := []struct {
+		name     string
+		msg      Message
+		routines *sqlmock.Rows
+		expect   func()
+		sets     int
+		wantCode string
+		wantErr  string
+	}{
+		{
+			name: "function, by position",
+			msg:  Message{ID: "k1", Routine: "add_user", Args: []CallArg{{Value: "a@example.com"}, {Value: true}}},
+			routines: sqlmock.NewRows(routines).
+				AddRow("public", "add_user", false, "integer", 1, "{email,admin}", "{}", "{text,boolean}"),
+			expect: func() {
+				mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "public"."add_user"($1::text, $2::boolean)`)).
+					WithArgs("a@example.com", true).WillReturnRows(sqlmock.NewRows([]string{"add_user"}).AddRow(7))
+			},
+		},
+		{
+			name:     "overload picked by type",
+			msg:      Message{ID: "k2", Routine: "public.add_user", Args: []CallArg{{Value: "a@example.com"}, {Value: 3, Type: "integer"}}},
+			routines: addUser(),
+			expect: func() {
+				mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "public"."add_user"($1::text, $2::integer)`)).
+					WillReturnRows(sqlmock.NewRows([]string{"add_user"}).AddRow(8))
+			},
+		},
+		{
+			name:     "ambiguous",
+			msg:      Message{ID: "k3", Routine: "add_user", Args: []CallArg{{Value: "a@example.com"}, {Value: 3}}},
+			routines: addUser(),
+			wantErr:  `"add_user" has 2 overloads that take these arguments; give each argument's type`,
+		},
+		{
+			name: "procedure with OUT parameters and a cursor",
+			msg:  Message{ID: "k4", Routine: "report", Args: []CallArg{{Name: "since", Value: "2026-01-01"}}},
+			routines: sqlmock.NewRows(routines).
+				AddRow("public", "report", true, "void", 2, "{since,region,total,details}", "{i,i,o,b}", "{date,text,bigint,refcursor}"),
+			expect: func() {
+				mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`CALL "public"."report"("since" => $1::date, "total" => NULL::bigint)`)).
+					WithArgs("2026-01-01").
+					WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+						sqlmock.NewColumn("total").OfType("INT8", int64(0)),
+						sqlmock.NewColumn("details").OfType("REFCURSOR", ""),
+					).AddRow(int64(2), "<unnamed portal 1>"))
+				mock.ExpectQuery(regexp.QuoteMeta(`FETCH ALL FROM "<unnamed portal 1>"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"region", "total"}).AddRow("eu", 1).AddRow("us", 1))
+				mock.ExpectCommit()
+			},
+			sets: 1,
+		},
+		{
+			name: "procedure on a read-only connection",
+			msg:  Message{ID: "k5", Routine: "report", Target: "ro", Args: []CallArg{{Value: "2026-01-01"}}},
+			routines: sqlmock.NewRows(routines).
+				AddRow("public", "report", true, "void", 0, "{since}", "{}", "{date}"),
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "unknown parameter",
+			msg:      Message{ID: "k6", Routine: "add_user", Args: []CallArg{{Name: "nope", Value: 1}}},
+			routines: addUser(),
+			wantErr:  `no overload of "add_user" takes these arguments`,
+		},
+		{
+			name:     "hidden schema",
+			msg:      Message{ID: "k7", Routine: "hr.raise"},
+			wantCode: codePolicyDenied,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.routines != nil {
+				mock.ExpectQuery("FROM pg_proc").WillReturnRows(tc.routines)
+			}
+			if tc.expect != nil {
+				tc.expect()
+			}
+			resp := callRoutine(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			switch {
+			case tc.wantCode != "":
+				if resp.ErrorCode != tc.wantCode {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+			case tc.wantErr != "":
+				if resp.Error != tc.wantErr {
+					t.Errorf("error = %q, want %q", resp.Error, tc.wantErr)
+				}
+			case resp.Error != "" || len(resp.Rows) != 1 || len(resp.ResultSets) != tc.sets:
+				t.Errorf("unexpected response: %+v", resp)
+			case tc.sets > 0 && (resp.ResultSets[0].Name != "details" || len(resp.ResultSets[0].Rows) != 2):
+				t.Errorf("unexpected result set: %+v", resp.ResultSets[0])
+			}
+		})
+	}
+}
+
+func TestCallStatement(t *testing.T) {
+	tests := []struct {
+		name   string
+		flavor string
+		r      routine
+		args   []CallArg
+		want   string
+		binds  int
+	}{
+		{
+			name:   "function skipping a default",
+			flavor: "postgres",
+			r: routine{schema: "public", name: "search", params: []routineParam{
+				{name: "q", mode: "in", typ: "text"},
+				{name: "lim", mode: "in", typ: "integer", hasDefault: true},
+				{name: "exact", mode: "in", typ: "boolean", hasDefault: true},
+				{name: "id", mode: "out", typ: "bigint"},
+			}},
+			args:  []CallArg{{Name: "q", Value: "x"}, {Name: "exact", Value: true}},
+			want:  `SELECT * FROM "public"."search"("q" => $1::text, "exact" => $2::boolean)`,
+			binds: 2,
+		},
+		{
+			name:   "oracle function",
+			flavor: "oracle",
+			r: routine{schema: "APP", name: "TOTAL", params: []routineParam{
+				{name: "TOTAL", mode: "out", typ: "NUMBER"},
+				{name: "P_ID", mode: "in", typ: "NUMBER"},
+				{name: "P_ROWS", mode: "out", typ: "REF CURSOR"},
+			}},
+			args:  []CallArg{{Value: 42}},
+			want:  `BEGIN :1 := "APP"."TOTAL"(:2, :3); END;`,
+			binds: 3,
+		},
+		{
+			name:   "oracle procedure",
+			flavor: "oracle",
+			r: routine{schema: "APP", name: "CLOSE_MONTH", procedure: true, params: []routineParam{
+				{name: "P_MONTH", mode: "inout", typ: "DATE"},
+			}},
+			args:  []CallArg{{Value: "2026-09-01T00:00:00Z"}},
+			want:  `BEGIN "APP"."CLOSE_MONTH"(:1); END;`,
+			binds: 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &routineCall{routine: tc.r}
+			got, err := c.statement(tc.flavor, tc.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want || len(c.binds) != tc.binds {
+				t.Errorf("got %s with %d binds, want %s with %d", got, len(c.binds), tc.want, tc.binds)
+			}
+		})
+	}
+}
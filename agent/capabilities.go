@@ -0,0 +1,103 @@
+package agent
+
+import "strings"
+
+// Capabilities is the policy the hub attaches to a token in its auth
+// response. The agent enforces it itself rather than trusting the hub to
+// only send what the token allows.
+type Capabilities struct {
+	// ReadOnly refuses statements that aren't reads on every connection.
+	ReadOnly bool `json:"read_only"`
+	// MaxRows cuts query results to this many rows; 0 means no limit.
+	MaxRows int `json:"max_rows,omitempty"`
+	// AllowedSchemas, when set, limits the schema browser and schema-
+	// qualified table names in queries to these schemas.
+	AllowedSchemas []string `json:"allowed_schemas,omitempty"`
+	// CanExport allows downloading values as files (download_blob).
+	CanExport bool `json:"can_export"`
+}
+
+// schemaAllowed reports whether schema may be used under c.
+func (c Capabilities) schemaAllowed(schema string) bool {
+	if len(c.AllowedSchemas) == 0 {
+		return true
+	}
+	for _, s := range c.AllowedSchemas {
+		if s == schema {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStatement refuses a statement that the capabilities forbid. Only
+// schema-qualified table names can be checked against allowed_schemas;
+// unqualified ones resolve through the database's search_path.
+func (c Capabilities) checkStatement(q string) error {
+	kind, tables := classifyStatements(q)
+	if c.ReadOnly && !readStatements[kind] {
+		return codedErrorf(codePolicyDenied, "this token is read-only; %s statements are not allowed", strings.ToUpper(kind))
+	}
+	for _, t := range tables {
+		parts := strings.Split(t, ".")
+		if len(parts) < 2 {
+			continue
+		}
+		if schema := parts[len(parts)-2]; !c.schemaAllowed(schema) {
+			return codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", schema)
+		}
+	}
+	return nil
+}
+
+// limitRows cuts resp to the row limit, flagging the cut.
+func (c Capabilities) limitRows(resp *QueryResponse) {
+	if s := resp.spill; s != nil && c.MaxRows > 0 && s.rows > c.MaxRows {
+		s.limit = c.MaxRows
+		resp.RowLimit = c.MaxRows
+		return
+	}
+	if c.MaxRows > 0 && len(resp.Rows) > c.MaxRows {
+		resp.Rows = resp.Rows[:c.MaxRows]
+		resp.RowLimit = c.MaxRows
+		resp.Cursor = ""
+	}
+}
+
+// filterSchema drops tables outside the allowed schemas.
+func (c Capabilities) filterSchema(resp *SchemaResponse) {
+	if len(c.AllowedSchemas) == 0 {
+		return
+	}
+	tables := resp.Tables[:0]
+	for _, t := range resp.Tables {
+		if c.schemaAllowed(t.Schema) {
+			t.Partitions = c.allowedPartitions(t.Partitions)
+			tables = append(tables, t)
+		}
+	}
+	resp.Tables = tables
+	// A key between an allowed schema and another would name a table
+	// the token may not see.
+	keys := resp.ForeignKeys[:0]
+	for _, fk := range resp.ForeignKeys {
+		if c.schemaAllowed(fk.Schema) && c.schemaAllowed(fk.RefSchema) {
+			keys = append(keys, fk)
+		}
+	}
+	resp.ForeignKeys = keys
+	types := resp.Types[:0]
+	for _, t := range resp.Types {
+		if c.schemaAllowed(t.Schema) {
+			types = append(types, t)
+		}
+	}
+	resp.Types = types
+	seqs := resp.Sequences[:0]
+	for _, s := range resp.Sequences {
+		if c.schemaAllowed(s.Schema) && (s.OwnedBy == nil || c.schemaAllowed(s.OwnedBy.Schema)) {
+			seqs = append(seqs, s)
+		}
+	}
+	resp.Sequences = seqs
+}
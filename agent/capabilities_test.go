@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCapabilitiesCheckStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		caps    Capabilities
+		sql     string
+		allowed bool
+	}{
+		{name: "no restrictions", caps: Capabilities{}, sql: "DELETE FROM orders", allowed: true},
+		{name: "read-only select", caps: Capabilities{ReadOnly: true}, sql: "SELECT * FROM orders", allowed: true},
+		{name: "read-only update", caps: Capabilities{ReadOnly: true}, sql: "UPDATE orders SET paid = true", allowed: false},
+		{name: "read-only second statement", caps: Capabilities{ReadOnly: true}, sql: "SELECT 1; DELETE FROM users", allowed: false},
+		{name: "read-only writable CTE", caps: Capabilities{ReadOnly: true}, sql: "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", allowed: false},
+		{name: "read-only commit", caps: Capabilities{ReadOnly: true}, sql: "SELECT 1; COMMIT; DROP TABLE users", allowed: false},
+		{name: "second statement in other schema", caps: Capabilities{AllowedSchemas: []string{"sales"}}, sql: "SELECT 1; SELECT * FROM hr.salaries", allowed: false},
+		{name: "allowed schema", caps: Capabilities{AllowedSchemas: []string{"sales"}}, sql: "SELECT * FROM sales.orders", allowed: true},
+		{name: "other schema", caps: Capabilities{AllowedSchemas: []string{"sales"}}, sql: "SELECT * FROM sales.orders JOIN hr.salaries USING (id)", allowed: false},
+		{name: "unqualified table", caps: Capabilities{AllowedSchemas: []string{"sales"}}, sql: "SELECT * FROM orders", allowed: true},
+		{name: "three-part name", caps: Capabilities{AllowedSchemas: []string{"sales"}}, sql: "SELECT * FROM db.hr.salaries", allowed: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.caps.checkStatement(tc.sql)
+			if tc.allowed && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.allowed {
+				if err == nil {
+					t.Fatal("expected the statement to be refused")
+				}
+				if code := errorCode(err); code != codePolicyDenied {
+					t.Errorf("expected %s, got %s", codePolicyDenied, code)
+				}
+			}
+		})
+	}
+}
+
+func TestCapabilitiesEnforced(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.setCapabilities(&Capabilities{ReadOnly: true, MaxRows: 2, AllowedSchemas: []string{"public"}})
+
+	resp := runQuery(Message{ID: "c1", Type: "query", SQL: "DROP TABLE orders", tenant: tn})
+	if resp.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s for DROP, got %q (%s)", codePolicyDenied, resp.ErrorCode, resp.Error)
+	}
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3))
+	mock.ExpectRollback()
+	resp = runQuery(Message{Type: "query", SQL: "SELECT id FROM orders", tenant: tn})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if len(resp.Rows) != 2 || resp.RowLimit != 2 {
+		t.Errorf("expected 2 rows with row_limit 2, got %d rows, row_limit %d", len(resp.Rows), resp.RowLimit)
+	}
+
+	schema := handleMessage(Message{ID: "s1", Type: "schema", Schema: "hr", tenant: tn}).(SchemaResponse)
+	if schema.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s for a disallowed schema, got %q", codePolicyDenied, schema.ErrorCode)
+	}
+
+	blob := downloadBlob(Message{ID: "b1", Type: "download_blob", SQL: "SELECT data FROM files", tenant: tn}).(BlobEnd)
+	if blob.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s for download_blob without can_export, got %q", codePolicyDenied, blob.ErrorCode)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCapabilitiesFilterSchema(t *testing.T) {
+	resp := SchemaResponse{
+		Tables: []SchemaTable{{Schema: "public", Name: "a"}, {Schema: "hr", Name: "b"}, {Schema: "public", Name: "c", Partitions: []Partition{
+			{Schema: "public", Name: "c_2025"}, {Schema: "hr", Name: "c_2026"},
+		}}},
+		ForeignKeys: []ForeignKey{
+			{Name: "c_a_fkey", Schema: "public", Table: "c", RefSchema: "public", RefTable: "a"},
+			{Name: "b_a_fkey", Schema: "hr", Table: "b", RefSchema: "public", RefTable: "a"},
+			{Name: "a_b_fkey", Schema: "public", Table: "a", RefSchema: "hr", RefTable: "b"},
+		},
+	}
+	Capabilities{AllowedSchemas: []string{"public"}}.filterSchema(&resp)
+	if len(resp.Tables) != 2 || resp.Tables[0].Name != "a" || resp.Tables[1].Name != "c" {
+		t.Errorf("unexpected tables: %+v", resp.Tables)
+	}
+	if parts := resp.Tables[1].Partitions; len(parts) != 1 || parts[0].Name != "c_2025" {
+		t.Errorf("expected partitions in other schemas dropped, got %+v", parts)
+	}
+	if len(resp.ForeignKeys) != 1 || resp.ForeignKeys[0].Name != "c_a_fkey" {
+		t.Errorf("expected keys to other schemas dropped, got %+v", resp.ForeignKeys)
+	}
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	cellCacheBytes   = 64 << 20
+	defaultCellChunk = 1 << 20
+)
+
+type TruncatedCell struct {
+	Row    int    `json:"row"`
+	Column int    `json:"column"`
+	Size   int    `json:"size"`
+	Cell   string `json:"cell"`
+}
+
+// CellResponse answers a "fetch_cell" message with part of a value,
+// base64-encoded. The hub asks for the next offset until eof is set.
+type CellResponse struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Cell   string `json:"cell,omitempty"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	Data   string `json:"data,omitempty"`
+	EOF    bool   `json:"eof,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cellCache holds full values of truncated cells, dropping the oldest once
+// the total passes limit bytes.
+type cellCache struct {
+	mu     sync.Mutex
+	limit  int
+	size   int
+	values map[string]string
+	order  []string
+}
+
+func newCellCache(limit int) *cellCache {
+	return &cellCache{limit: limit, values: map[string]string{}}
+}
+
+func (c *cellCache) put(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.values[key]; ok {
+		c.size -= len(old)
+	} else {
+		c.order = append(c.order, key)
+	}
+	c.values[key] = value
+	c.size += len(value)
+
+	for c.size > c.limit && len(c.order) > 1 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.size -= len(c.values[oldest])
+		delete(c.values, oldest)
+	}
+}
+
+func (c *cellCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	return v, ok
+}
+
+// truncateCells cuts text cells longer than the max_cell_bytes setting, on
+// a UTF-8 boundary, and keeps the originals in the agent's cell cache so the
+// hub can fetch them with a "fetch_cell" message.
+func (a *Agent) truncateCells(resp *QueryResponse) {
+	a.truncateCellsFrom(resp, 0)
+}
+
+// truncateCellsFrom is truncateCells for rows that start at row first of
+// the result.
+func (a *Agent) truncateCellsFrom(resp *QueryResponse, first int) {
+	maxCellBytes := a.currentMaxCellBytes()
+	if maxCellBytes <= 0 {
+		return
+	}
+	for i, row := range resp.Rows {
+		for j, v := range row {
+			s, ok := v.(string)
+			if !ok || len(s) <= maxCellBytes {
+				continue
+			}
+			cut := maxCellBytes
+			for cut > 0 && !utf8.RuneStart(s[cut]) {
+				cut--
+			}
+			key := fmt.Sprintf("%s:%d:%d", resp.ID, first+i, j)
+			a.cells.put(key, s)
+			row[j] = s[:cut]
+			resp.Truncated = append(resp.Truncated, TruncatedCell{Row: first + i, Column: j, Size: len(s), Cell: key})
+		}
+	}
+}
+
+func fetchCell(msg Message) CellResponse {
+	resp := CellResponse{ID: msg.ID, Type: "cell", Cell: msg.Cell, Offset: msg.Offset}
+	v, ok := msg.agent().cells.get(msg.Cell)
+	if !ok {
+		resp.Error = fmt.Sprintf("cell %q is no longer cached; run the query again", msg.Cell)
+		return resp
+	}
+	if msg.Offset < 0 || msg.Offset > len(v) {
+		resp.Error = fmt.Sprintf("offset %d is outside the value (%d bytes)", msg.Offset, len(v))
+		return resp
+	}
+
+	length := msg.Length
+	if length <= 0 {
+		length = defaultCellChunk
+	}
+	end := msg.Offset + length
+	if end >= len(v) {
+		end = len(v)
+		resp.EOF = true
+	}
+	resp.Size = len(v)
+	resp.Data = base64.StdEncoding.EncodeToString([]byte(v[msg.Offset:end]))
+	return resp
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestTruncateCells(t *testing.T) {
+	a := bareAgent(DefaultOptions(), nil)
+	a.settings.maxCellBytes = 5
+
+	resp := QueryResponse{
+		ID:   "q1",
+		Type: "result",
+		Rows: [][]any{
+			{int64(1), "short", "0123456789"},
+			{int64(2), "éééééé", nil},
+		},
+	}
+	a.truncateCells(&resp)
+
+	if resp.Rows[0][2] != "01234" {
+		t.Errorf("expected cut value, got %q", resp.Rows[0][2])
+	}
+	if resp.Rows[1][1] != "éé" {
+		t.Errorf("expected cut on a rune boundary, got %q", resp.Rows[1][1])
+	}
+	if resp.Rows[0][1] != "short" {
+		t.Errorf("expected short value untouched, got %q", resp.Rows[0][1])
+	}
+
+	want := []TruncatedCell{
+		{Row: 0, Column: 2, Size: 10, Cell: "q1:0:2"},
+		{Row: 1, Column: 1, Size: len("éééééé"), Cell: "q1:1:1"},
+	}
+	if len(resp.Truncated) != len(want) {
+		t.Fatalf("expected %d truncated cells, got %+v", len(want), resp.Truncated)
+	}
+	for i := range want {
+		if resp.Truncated[i] != want[i] {
+			t.Errorf("truncated %d: expected %+v, got %+v", i, want[i], resp.Truncated[i])
+		}
+	}
+}
+
+func TestFetchCell(t *testing.T) {
+	tn := testTenant()
+	tn.agent.cells.put("q1:0:2", "0123456789")
+
+	testCases := []struct {
+		name    string
+		msg     Message
+		want    string
+		wantEOF bool
+		wantErr string
+	}{
+		{name: "whole value", msg: Message{Cell: "q1:0:2"}, want: "0123456789", wantEOF: true},
+		{name: "first part", msg: Message{Cell: "q1:0:2", Length: 4}, want: "0123"},
+		{name: "last part", msg: Message{Cell: "q1:0:2", Offset: 8, Length: 4}, want: "89", wantEOF: true},
+		{name: "bad offset", msg: Message{Cell: "q1:0:2", Offset: 11}, wantErr: "outside the value"},
+		{name: "unknown cell", msg: Message{Cell: "q9:0:0"}, wantErr: "no longer cached"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			resp := fetchCell(tc.msg)
+			if tc.wantErr != "" {
+				if !strings.Contains(resp.Error, tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %q", tc.wantErr, resp.Error)
+				}
+				return
+			}
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			data, err := base64.StdEncoding.DecodeString(resp.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.want || resp.EOF != tc.wantEOF || resp.Size != 10 {
+				t.Errorf("expected %q (eof %v), got %q (eof %v, size %d)", tc.want, tc.wantEOF, data, resp.EOF, resp.Size)
+			}
+		})
+	}
+}
+
+func TestCellCacheEviction(t *testing.T) {
+	c := newCellCache(10)
+	c.put("a", "123456")
+	c.put("b", "123456")
+	if _, ok := c.get("a"); ok {
+		t.Error("expected the oldest value to be evicted")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Error("expected the newest value to be kept")
+	}
+}
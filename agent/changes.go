@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxChanges caps the changes one apply_changes message may carry.
+const maxChanges = 1000
+
+// RowChange is one edit from a grid: an "update" or "delete" of the row
+// whose primary key is Key, or an "insert" of a new row. Values are the
+// columns an update or insert sets.
+type RowChange struct {
+	Op     string         `json:"op"`
+	Key    map[string]any `json:"key,omitempty"`
+	Values map[string]any `json:"values,omitempty"`
+}
+
+// ChangesResponse answers an "apply_changes" message. Results line up with
+// the message's changes. Committed is false when a change failed, or the
+// message was a dry run, and nothing was kept.
+type ChangesResponse struct {
+	ID        string         `json:"id"`
+	Type      string         `json:"type"`
+	Schema    string         `json:"schema,omitempty"`
+	Table     string         `json:"table,omitempty"`
+	Results   []ChangeResult `json:"results,omitempty"`
+	Committed bool           `json:"committed"`
+	Error     string         `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// ChangeResult is what became of one change. Status is "applied",
+// "rolled_back" when it ran but the transaction was not committed,
+// "failed", or "not_run" when an earlier change failed. Key is the
+// primary key of the row an insert or update left.
+type ChangeResult struct {
+	Status      string         `json:"status"`
+	Statement   string         `json:"statement"`
+	Key         map[string]any `json:"key,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	ErrorCode   string         `json:"error_code,omitempty"`
+	ErrorDetail *ErrorDetail   `json:"error_detail,omitempty"`
+}
+
+// editableKinds are the kinds of table whose rows apply_changes edits.
+var editableKinds = map[string]bool{"table": true, "partitioned_table": true}
+
+// changeStatement is a change's parameterized statement and its values.
+type changeStatement struct {
+	sql  string
+	args []any
+}
+
+// applyChanges answers an "apply_changes" message: it checks msg.Changes
+// against the columns and primary key of the table msg.Identifier names,
+// then runs them in one transaction, which is committed only when every
+// change succeeds and the message is not a dry run. Every attempt is
+// audited.
+func applyChanges(msg Message) ChangesResponse {
+	resp := ChangesResponse{ID: msg.ID, Type: "apply_changes_result"}
+	event := AuditEvent{Action: "apply_changes", MessageID: msg.ID, Detail: fmt.Sprintf("%s: %d changes", msg.Identifier, len(msg.Changes))}
+	defer func() {
+		event.Connection = resp.Connection
+		event.Error = resp.Error
+		msg.agent().audit(event)
+	}()
+	fail := func(err error) ChangesResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	caps := msg.capabilities()
+	if c.ReadOnly || caps.ReadOnly {
+		return fail(codedErrorf(codePolicyDenied, "apply_changes is not allowed on a read-only connection"))
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || (sc.flavor != "postgres" && sc.flavor != "cockroach") {
+		return fail(codedErrorf(codeNotSupported, "apply_changes is not supported for %s", c.Flavor()))
+	}
+	if len(msg.Changes) == 0 {
+		return fail(codedErrorf(codeInvalidRequest, "apply_changes needs at least one change"))
+	}
+	if len(msg.Changes) > maxChanges {
+		return fail(codedErrorf(codeTooLarge, "apply_changes takes at most %d changes, got %d", maxChanges, len(msg.Changes)))
+	}
+
+	table, types, err := editableTable(c, msg)
+	if err != nil {
+		return fail(err)
+	}
+	resp.Schema, resp.Table = table.Schema, table.Name
+	d := dialectFor(sc.flavor)
+	key, err := primaryKey(sc, d.quoted(table.Schema)+"."+d.quoted(table.Name))
+	if err != nil {
+		return fail(err)
+	}
+	if len(key) == 0 {
+		return fail(codedErrorf(codeInvalidRequest, "%s.%s has no primary key, so its rows can't be edited", table.Schema, table.Name))
+	}
+
+	returning := make([]string, len(key))
+	for i, k := range key {
+		returning[i] = d.quoted(k)
+	}
+	stmts := make([]changeStatement, len(msg.Changes))
+	for i, change := range msg.Changes {
+		stmts[i], err = rowChangeStatement(d, table, types, key, change)
+		if err != nil {
+			return fail(fmt.Errorf("change %d: %w", i+1, err))
+		}
+		stmts[i].sql += " RETURNING " + strings.Join(returning, ", ")
+		if err := caps.checkStatement(stmts[i].sql); err != nil {
+			return fail(err)
+		}
+	}
+
+	ctx, done := msg.agent().running.start(msg.context(), msg.ID, msg.tenant, sc)
+	defer done()
+	resp.Results, resp.Committed, err = runChanges(ctx, sc, msg.ID, stmts, key, msg.DryRun)
+	if err != nil {
+		log.Printf("[changes:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	return resp
+}
+
+// editableTable finds the table msg.Identifier names in c's schema and
+// checks that the token may edit it. It returns the schema's types too,
+// for checking values; see checkValue.
+func editableTable(c *connection, msg Message) (SchemaTable, []SchemaType, error) {
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return SchemaTable{}, nil, err
+	}
+	if len(parts) > 2 {
+		return SchemaTable{}, nil, codedErrorf(codeInvalidRequest, "%q is not a table: expected table or schema.table", msg.Identifier)
+	}
+	d := dialectFor(c.Flavor())
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = d.name(p)
+	}
+	schema, _ := msg.agent().schemas.get(c, msg.ID)
+	if schema.Error != "" {
+		return SchemaTable{}, nil, &codedError{code: schema.ErrorCode, msg: schema.Error}
+	}
+	target := lookupIdentifier(schema.Tables, names, false)
+	if target == nil {
+		return SchemaTable{}, nil, codedErrorf(codeInvalidRequest, "%s not found", d.qualifiedSQL(parts))
+	}
+	if !msg.capabilities().schemaAllowed(target.Schema) {
+		return SchemaTable{}, nil, codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", target.Schema)
+	}
+	if !editableKinds[target.Kind] {
+		return SchemaTable{}, nil, codedErrorf(codeInvalidRequest, "%s is a %s; only the rows of tables can be edited", d.qualifiedSQL(parts), strings.ReplaceAll(target.Kind, "_", " "))
+	}
+	i := slices.IndexFunc(schema.Tables, func(t SchemaTable) bool { return t.Schema == target.Schema && t.Name == target.Table })
+	return schema.Tables[i], schema.Types, nil
+}
+
+// rowChangeStatement writes change as a statement on table, with types
+// the schema's user-defined types. Columns are set in the table's order,
+// every value is checked against its column's type, and every value is a
+// parameter. An update or delete finds its row by key, the primary key.
+func rowChangeStatement(d identDialect, table SchemaTable, types []SchemaType, key []string, change RowChange) (changeStatement, error) {
+	var st changeStatement
+	columns := make(map[string]SchemaColumn, len(table.Columns))
+	for _, col := range table.Columns {
+		columns[col.Name] = col
+	}
+	param := func(name string, v any) (string, error) {
+		col := columns[name]
+		if err := checkValue(col.Type, userType(types, col), v); err != nil {
+			return "", codedErrorf(codeInvalidRequest, "column %q: %v", name, err)
+		}
+		st.args = append(st.args, columnParam(col.Type, v))
+		return "$" + strconv.Itoa(len(st.args)), nil
+	}
+	for name := range change.Values {
+		if _, ok := columns[name]; !ok {
+			return st, codedErrorf(codeInvalidRequest, "%s.%s has no column %q", table.Schema, table.Name, name)
+		}
+	}
+	var cols []SchemaColumn
+	for _, col := range table.Columns {
+		v, ok := change.Values[col.Name]
+		if !ok {
+			if change.Op == "insert" && required(col) {
+				return st, codedErrorf(codeInvalidRequest, "column %q is required: it can't be null and has no default", col.Name)
+			}
+			continue
+		}
+		if col.Identity == "always" {
+			return st, codedErrorf(codeInvalidRequest, "column %q is generated always as identity and can't be set", col.Name)
+		}
+		if v == nil && !col.Nullable {
+			return st, codedErrorf(codeInvalidRequest, "column %q can't be null", col.Name)
+		}
+		cols = append(cols, col)
+	}
+
+	rel := d.quoted(table.Schema) + "." + d.quoted(table.Name)
+	where := func() (string, error) {
+		quoted := make([]string, len(key))
+		for i, k := range key {
+			quoted[i] = d.quoted(k)
+		}
+		if len(change.Key) != len(key) {
+			return "", codedErrorf(codeInvalidRequest, "key must give the primary key columns %s", strings.Join(quoted, ", "))
+		}
+		terms := make([]string, len(key))
+		for i, k := range key {
+			v, ok := change.Key[k]
+			if !ok || v == nil {
+				return "", codedErrorf(codeInvalidRequest, "key must give the primary key columns %s", strings.Join(quoted, ", "))
+			}
+			p, err := param(k, v)
+			if err != nil {
+				return "", err
+			}
+			terms[i] = quoted[i] + " = " + p
+		}
+		return " WHERE " + strings.Join(terms, " AND "), nil
+	}
+
+	switch change.Op {
+	case "update":
+		if len(cols) == 0 {
+			return st, codedErrorf(codeInvalidRequest, "an update needs values to set")
+		}
+		set := make([]string, len(cols))
+		for i, col := range cols {
+			p, err := param(col.Name, change.Values[col.Name])
+			if err != nil {
+				return st, err
+			}
+			set[i] = d.quoted(col.Name) + " = " + p
+		}
+		w, err := where()
+		if err != nil {
+			return st, err
+		}
+		st.sql = "UPDATE " + rel + " SET " + strings.Join(set, ", ") + w
+	case "insert":
+		if len(change.Key) > 0 {
+			return st, codedErrorf(codeInvalidRequest, "an insert takes its key from values, not key")
+		}
+		if len(cols) == 0 {
+			st.sql = "INSERT INTO " + rel + " DEFAULT VALUES"
+			break
+		}
+		names, values := make([]string, len(cols)), make([]string, len(cols))
+		for i, col := range cols {
+			p, err := param(col.Name, change.Values[col.Name])
+			if err != nil {
+				return st, err
+			}
+			names[i], values[i] = d.quoted(col.Name), p
+		}
+		st.sql = "INSERT INTO " + rel + " (" + strings.Join(names, ", ") + ") VALUES (" + strings.Join(values, ", ") + ")"
+	case "delete":
+		if len(change.Values) > 0 {
+			return st, codedErrorf(codeInvalidRequest, "a delete takes no values")
+		}
+		w, err := where()
+		if err != nil {
+			return st, err
+		}
+		st.sql = "DELETE FROM " + rel + w
+	default:
+		return st, codedErrorf(codeInvalidRequest, "unknown op %q: expected update, insert or delete", change.Op)
+	}
+	return st, nil
+}
+
+// columnParam turns a JSON value for a column of type typ into one the
+// driver can send. A JSON array for an array column goes as an array
+// literal; other arrays and objects go as JSON text, which Postgres reads
+// into json and jsonb columns.
+func columnParam(typ string, v any) any {
+	switch v := v.(type) {
+	case []any:
+		if strings.HasSuffix(typ, "[]") {
+			return pq.Array(v)
+		}
+	case map[string]any:
+	default:
+		return v
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// runChanges runs stmts in one transaction and reports each one's
+// outcome. An update or delete that finds no row with its key fails, as
+// the row was changed or deleted since the grid read it. It returns an
+// error only when the transaction could not be started or committed.
+func runChanges(ctx context.Context, sc *sqlConnector, id string, stmts []changeStatement, key []string, dryRun bool) ([]ChangeResult, bool, error) {
+	results := make([]ChangeResult, len(stmts))
+	for i, st := range stmts {
+		results[i] = ChangeResult{Status: "not_run", Statement: st.sql}
+	}
+	tx, err := sc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	failed := -1
+	for i, st := range stmts {
+		log.Printf("[changes:%s] %s", id, st.sql)
+		row, err := changedRow(ctx, tx, st, key)
+		if err != nil {
+			results[i].Status = "failed"
+			results[i].Error, results[i].ErrorCode, results[i].ErrorDetail = err.Error(), errorCode(err), errorDetail(err)
+			failed = i
+			break
+		}
+		results[i].Status, results[i].Key = "rolled_back", row
+		if strings.HasPrefix(st.sql, "DELETE") {
+			results[i].Key = nil
+		}
+	}
+	if failed >= 0 {
+		log.Printf("[changes:%s] Change %d failed; rolling back", id, failed+1)
+	}
+	if failed >= 0 || dryRun {
+		// A rollback that fails leaves nothing to undo either: the
+		// server drops the transaction with the connection.
+		tx.Rollback()
+		return results, false, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	for i := range results {
+		results[i].Status = "applied"
+	}
+	return results, true, nil
+}
+
+// changedRow runs st in tx and returns the key of the row it touched.
+func changedRow(ctx context.Context, tx *sql.Tx, st changeStatement, key []string) (map[string]any, error) {
+	rows, err := tx.QueryContext(ctx, st.sql, st.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cells := make([]cell, len(key))
+	dest := make([]any, len(key))
+	for i := range cells {
+		dest[i] = &cells[i]
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, codedErrorf(codeInvalidRequest, "no row has this key; it may have been changed or deleted since it was read")
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(key))
+	for i, k := range key {
+		row[k] = cells[i].v
+	}
+	return row, rows.Close()
+}
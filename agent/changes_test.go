@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestApplyChanges(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+	tn := testTenant(
+		&connection{Name: "main", Connector: pg},
+		&connection{Name: "ro", ReadOnly: true, Connector: pg},
+	)
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public"}})
+	tn.agent.schemas.put(pg, SchemaResponse{Tables: []SchemaTable{
+		{Schema: "public", Name: "users", Kind: "table", Columns: []SchemaColumn{
+			{Name: "id", Type: "bigint", Identity: "by_default"},
+			{Name: "email", Type: "text"},
+			{Name: "tags", Type: "text[]", Nullable: true},
+			{Name: "prefs", Type: "jsonb", Nullable: true},
+			{Name: "row_id", Type: "bigint", Identity: "always"},
+		}},
+		{Schema: "public", Name: "active_users", Kind: "view"},
+		{Schema: "hr", Name: "salaries", Kind: "table"},
+	}})
+	key := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"attname"}).AddRow("id") }
+	ids := func(id int64) *sqlmock.Rows { return sqlmock.NewRows([]string{"id"}).AddRow(id) }
+
+	tests := []struct {
+		name      string
+		msg       Message
+		expect    func()
+		statuses  []string
+		committed bool
+		wantCode  string
+		check     func(*testing.T, ChangesResponse)
+	}{
+		{
+			name: "update, insert and delete",
+			msg: Message{ID: "c1", Identifier: "users", Changes: []RowChange{
+				{Op: "update", Key: map[string]any{"id": float64(7)}, Values: map[string]any{"prefs": map[string]any{"theme": "dark"}, "email": "a@example.com"}},
+				{Op: "insert", Values: map[string]any{"email": "b@example.com", "tags": []any{"new"}}},
+				{Op: "delete", Key: map[string]any{"id": float64(9)}},
+			}},
+			expect: func() {
+				mock.ExpectQuery("FROM pg_index").WithArgs(`"public"."users"`).WillReturnRows(key())
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`UPDATE "public"."users" SET "email" = $1, "prefs" = $2 WHERE "id" = $3 RETURNING "id"`)).
+					WithArgs("a@example.com", `{"theme":"dark"}`, float64(7)).WillReturnRows(ids(7))
+				mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "public"."users" ("email", "tags") VALUES ($1, $2) RETURNING "id"`)).
+					WithArgs("b@example.com", `{"new"}`).WillReturnRows(ids(12))
+				mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM "public"."users" WHERE "id" = $1 RETURNING "id"`)).
+					WithArgs(float64(9)).WillReturnRows(ids(9))
+				mock.ExpectCommit()
+			},
+			statuses:  []string{"applied", "applied", "applied"},
+			committed: true,
+			check: func(t *testing.T, resp ChangesResponse) {
+				if resp.Results[1].Key["id"] != int64(12) || resp.Results[2].Key != nil {
+					t.Errorf("unexpected keys: %+v", resp.Results)
+				}
+			},
+		},
+		{
+			name: "row gone",
+			msg: Message{ID: "c2", Identifier: "public.users", Changes: []RowChange{
+				{Op: "update", Key: map[string]any{"id": float64(7)}, Values: map[string]any{"email": "a@example.com"}},
+				{Op: "update", Key: map[string]any{"id": float64(8)}, Values: map[string]any{"email": "c@example.com"}},
+				{Op: "delete", Key: map[string]any{"id": float64(9)}},
+			}},
+			expect: func() {
+				mock.ExpectQuery("FROM pg_index").WillReturnRows(key())
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE").WillReturnRows(ids(7))
+				mock.ExpectQuery("UPDATE").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			statuses: []string{"rolled_back", "failed", "not_run"},
+			check: func(t *testing.T, resp ChangesResponse) {
+				if resp.Results[1].ErrorCode != codeInvalidRequest {
+					t.Errorf("unexpected failure: %+v", resp.Results[1])
+				}
+			},
+		},
+		{
+			name: "dry run",
+			msg: Message{ID: "c3", Identifier: "users", DryRun: true, Changes: []RowChange{
+				{Op: "delete", Key: map[string]any{"id": "7"}},
+			}},
+			expect: func() {
+				mock.ExpectQuery("FROM pg_index").WillReturnRows(key())
+				mock.ExpectBegin()
+				mock.ExpectQuery("DELETE").WithArgs("7").WillReturnRows(ids(7))
+				mock.ExpectRollback()
+			},
+			statuses: []string{"rolled_back"},
+		},
+		{
+			name: "constraint violation",
+			msg: Message{ID: "c4", Identifier: "users", Changes: []RowChange{
+				{Op: "insert", Values: map[string]any{"email": "a@example.com"}},
+			}},
+			expect: func() {
+				mock.ExpectQuery("FROM pg_index").WillReturnRows(key())
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT").WillReturnError(&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint", Constraint: "users_email_key"})
+				mock.ExpectRollback()
+			},
+			statuses: []string{"failed"},
+			check: func(t *testing.T, resp ChangesResponse) {
+				if d := resp.Results[0].ErrorDetail; d == nil || d.Constraint != "users_email_key" {
+					t.Errorf("expected the constraint in the error detail, got %+v", resp.Results[0])
+				}
+			},
+		},
+		{
+			name: "unknown column",
+			msg: Message{ID: "c5", Identifier: "users", Changes: []RowChange{
+				{Op: "update", Key: map[string]any{"id": 1}, Values: map[string]any{"nope": 1}},
+			}},
+			expect:   func() { mock.ExpectQuery("FROM pg_index").WillReturnRows(key()) },
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name: "identity always",
+			msg: Message{ID: "c6", Identifier: "users", Changes: []RowChange{
+				{Op: "insert", Values: map[string]any{"email": "a@example.com", "row_id": 1}},
+			}},
+			expect:   func() { mock.ExpectQuery("FROM pg_index").WillReturnRows(key()) },
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name: "partial key",
+			msg: Message{ID: "c7", Identifier: "users", Changes: []RowChange{
+				{Op: "delete", Key: map[string]any{"email": "a@example.com"}},
+			}},
+			expect:   func() { mock.ExpectQuery("FROM pg_index").WillReturnRows(key()) },
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name: "no primary key",
+			msg: Message{ID: "c8", Identifier: "users", Changes: []RowChange{
+				{Op: "delete", Key: map[string]any{"id": 1}},
+			}},
+			expect:   func() { mock.ExpectQuery("FROM pg_index").WillReturnRows(sqlmock.NewRows([]string{"attname"})) },
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "view",
+			msg:      Message{ID: "c9", Identifier: "active_users", Changes: []RowChange{{Op: "delete", Key: map[string]any{"id": 1}}}},
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "hidden schema",
+			msg:      Message{ID: "c10", Identifier: "hr.salaries", Changes: []RowChange{{Op: "delete", Key: map[string]any{"id": 1}}}},
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "read-only connection",
+			msg:      Message{ID: "c11", Identifier: "users", Target: "ro", Changes: []RowChange{{Op: "delete", Key: map[string]any{"id": 1}}}},
+			wantCode: codePolicyDenied,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.expect != nil {
+				tc.expect()
+			}
+			resp := applyChanges(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			if tc.wantCode != "" {
+				if resp.ErrorCode != tc.wantCode || resp.Results != nil {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+				return
+			}
+			if resp.Error != "" || resp.Committed != tc.committed || len(resp.Results) != len(tc.statuses) {
+				t.Fatalf("unexpected response: %+v", resp)
+			}
+			for i, r := range resp.Results {
+				if r.Status != tc.statuses[i] {
+					t.Errorf("change %d: status %q, want %q", i+1, r.Status, tc.statuses[i])
+				}
+			}
+			if tc.check != nil {
+				tc.check(t, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// chaosConfig injects faults at the given rates, each the probability, from
+// 0 to 1, that one message or query is hit. It exists to test the hub's
+// retries and the agent's reconnects in staging, so its flags are left out
+// of --help.
+type chaosConfig struct {
+	// Disconnect drops the hub connection on receiving a message.
+	Disconnect float64
+	// Slow delays handling a message by SlowDelay.
+	Slow      float64
+	SlowDelay time.Duration
+	// DBError fails a query as if the database connection had broken.
+	DBError float64
+}
+
+// chaosRoll returns a number in [0, 1) to test a rate against.
+var chaosRoll = rand.Float64
+
+// hit reports whether a fault injected at rate happens this time.
+func (c chaosConfig) hit(rate float64) bool {
+	return rate > 0 && chaosRoll() < rate
+}
+
+func (c chaosConfig) enabled() bool {
+	return c.Disconnect > 0 || c.Slow > 0 || c.DBError > 0
+}
+
+// check validates the rates and warns, loudly, that faults are on.
+func (c chaosConfig) check() error {
+	for name, rate := range map[string]float64{"chaos-disconnect": c.Disconnect, "chaos-slow": c.Slow, "chaos-db-error": c.DBError} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("--%s must be between 0 and 1, not %v", name, rate)
+		}
+	}
+	if c.enabled() {
+		log.Printf("WARNING: injecting faults: disconnect=%v slow=%v (%v) db_error=%v; never use this in production",
+			c.Disconnect, c.Slow, c.SlowDelay, c.DBError)
+	}
+	return nil
+}
+
+// injectDBError returns the error a chaos-hit query fails with, or nil.
+func (c chaosConfig) injectDBError() error {
+	if !c.hit(c.DBError) {
+		return nil
+	}
+	return codedErrorf(codeConnectionLost, "chaos: injected database error")
+}
+
+// registerChaosFlags adds the chaos flags to fs, storing into c, and hides
+// them from its usage message.
+func registerChaosFlags(fs *flag.FlagSet, c *chaosConfig) {
+	fs.Float64Var(&c.Disconnect, "chaos-disconnect", c.Disconnect, "Drop the hub connection on this fraction of messages")
+	fs.Float64Var(&c.Slow, "chaos-slow", c.Slow, "Delay this fraction of messages by --chaos-slow-delay")
+	fs.DurationVar(&c.SlowDelay, "chaos-slow-delay", c.SlowDelay, "How long --chaos-slow delays a message")
+	fs.Float64Var(&c.DBError, "chaos-db-error", c.DBError, "Fail this fraction of queries with connection_lost")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", os.Args[0])
+		fs.VisitAll(func(f *flag.Flag) {
+			if strings.HasPrefix(f.Name, "chaos-") {
+				return
+			}
+			name, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(fs.Output(), "  -%s %s\n    \t%s", f.Name, name, strings.ReplaceAll(usage, "\n", "\n    \t"))
+			if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" {
+				fmt.Fprintf(fs.Output(), " (default %v)", f.DefValue)
+			}
+			fmt.Fprintln(fs.Output())
+		})
+	}
+}
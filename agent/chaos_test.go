@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestChaos(t *testing.T) {
+	defer func(old func() float64) { chaosRoll = old }(chaosRoll)
+	chaosRoll = func() float64 { return 0.5 }
+
+	tests := []struct {
+		rate float64
+		want bool
+	}{
+		{rate: 0, want: false},
+		{rate: 0.4, want: false},
+		{rate: 0.6, want: true},
+		{rate: 1, want: true},
+	}
+	for _, tc := range tests {
+		if got := (chaosConfig{}).hit(tc.rate); got != tc.want {
+			t.Errorf("hit(%v) = %v, want %v", tc.rate, got, tc.want)
+		}
+	}
+
+	if err := (chaosConfig{DBError: 1}).injectDBError(); errorCode(err) != codeConnectionLost {
+		t.Errorf("expected an injected %s, got %v", codeConnectionLost, err)
+	}
+	if err := (chaosConfig{DBError: 1.5}).check(); err == nil {
+		t.Error("expected a rate over 1 to be rejected")
+	}
+}
+
+func TestChaosFlagsHidden(t *testing.T) {
+	var c chaosConfig
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.String("db", "", "Database connection URL")
+	registerChaosFlags(fs, &c)
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+
+	if err := fs.Parse([]string{"--chaos-db-error", "0.25"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.DBError != 0.25 {
+		t.Errorf("expected the flag to set the rate, got %v", c.DBError)
+	}
+	fs.Usage()
+	if strings.Contains(out.String(), "chaos") || !strings.Contains(out.String(), "-db") {
+		t.Errorf("expected usage without the chaos flags, got:\n%s", out.String())
+	}
+}
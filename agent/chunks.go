@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Results can be split into frames when the hub sets chunk_size on a query:
+// one or more "result_chunk" frames carrying the rows, then a "result_end"
+// frame with the row count and a checksum so the hub can tell a complete
+// transfer from a truncated or corrupted one. Errors are still sent as a
+// single "result" frame.
+
+type ResultChunk struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Seq     int      `json:"seq"`
+	Columns []string `json:"columns,omitempty"`
+	// ColumnTypes, like Columns, is only on the first chunk.
+	ColumnTypes []string `json:"column_types,omitempty"`
+	Rows        [][]any  `json:"rows"`
+}
+
+type ResultEnd struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Chunks   int    `json:"chunks"`
+	RowCount int    `json:"row_count"`
+	// Checksum is "crc32c:" followed by the hex CRC-32C of every row's JSON
+	// encoding, each terminated by a newline, in order.
+	Checksum string `json:"checksum"`
+	Cursor   string `json:"cursor,omitempty"`
+
+	Connection      string          `json:"connection,omitempty"`
+	CostEstimate    *CostEstimate   `json:"cost_estimate,omitempty"`
+	Truncated       []TruncatedCell `json:"truncated,omitempty"`
+	BackendPID      int             `json:"backend_pid,omitempty"`
+	ColdStartMillis int64           `json:"cold_start_ms,omitempty"`
+	RowLimit        int             `json:"row_limit,omitempty"`
+	TieBreaker      []string        `json:"tie_breaker,omitempty"`
+	// Spilled is set when the rows were sent from disk; see writeSpilled.
+	Spilled     bool         `json:"spilled,omitempty"`
+	Annotations []Annotation `json:"annotations,omitempty"`
+	ResultSets  []ResultSet  `json:"result_sets,omitempty"`
+	Timing      *QueryTiming `json:"timing,omitempty"`
+
+	Notices        []Notice `json:"notices,omitempty"`
+	NoticesDropped int      `json:"notices_dropped,omitempty"`
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// replyWriter is the part of the websocket connection replies are written
+// to.
+type replyWriter interface {
+	WriteJSON(v any) error
+	WriteMessage(messageType int, data []byte) error
+}
+
+// writeReply sends resp, splitting query results into chunks when msg asked
+// for them, compressing whole results when msg accepts it, streaming them
+// row by row otherwise where w allows it, and blob downloads as binary
+// frames.
+func writeReply(w replyWriter, msg Message, resp any) error {
+	if b, ok := resp.(*blobDownload); ok {
+		return writeBlob(w, b)
+	}
+	qr, ok := resp.(QueryResponse)
+	if !ok || qr.Error != "" {
+		return w.WriteJSON(resp)
+	}
+	if qr.spill != nil {
+		return writeSpilled(w, msg, qr)
+	}
+	if msg.ChunkSize > 0 {
+		return writeChunks(w, qr, msg.ChunkSize)
+	}
+	if msg.acceptsEncoding(encodingGzip) && len(qr.ID) <= 255 {
+		return writeCompressed(w, msg, qr)
+	}
+	if sw, ok := w.(streamWriter); ok {
+		return streamResult(sw, qr)
+	}
+	return w.WriteJSON(resp)
+}
+
+func writeChunks(w replyWriter, resp QueryResponse, size int) error {
+	start := time.Now()
+	sum, err := rowsChecksum(resp.Rows)
+	if err != nil {
+		return w.WriteJSON(QueryResponse{ID: resp.ID, Type: "result", Error: err.Error()})
+	}
+
+	seq := 0
+	for start := 0; start == 0 || start < len(resp.Rows); start += size {
+		end := start + size
+		if end > len(resp.Rows) {
+			end = len(resp.Rows)
+		}
+		chunk := ResultChunk{ID: resp.ID, Type: "result_chunk", Seq: seq, Rows: resp.Rows[start:end]}
+		if seq == 0 {
+			chunk.Columns, chunk.ColumnTypes = resp.Columns, resp.ColumnTypes
+		}
+		if chunk.Rows == nil {
+			chunk.Rows = [][]any{}
+		}
+		if err := w.WriteJSON(chunk); err != nil {
+			return err
+		}
+		seq++
+	}
+
+	end := resultEnd(resp, seq, len(resp.Rows), sum)
+	end.Cursor = resp.Cursor
+	end.Timing = resp.Timing.withSerialize(start, w)
+	return w.WriteJSON(end)
+}
+
+// resultEnd is the result_end frame closing resp's chunks, carrying the
+// response's fields that aren't rows.
+func resultEnd(resp QueryResponse, chunks, rows int, checksum string) ResultEnd {
+	return ResultEnd{
+		ID:              resp.ID,
+		Type:            "result_end",
+		Chunks:          chunks,
+		RowCount:        rows,
+		Checksum:        checksum,
+		Connection:      resp.Connection,
+		CostEstimate:    resp.CostEstimate,
+		Truncated:       resp.Truncated,
+		BackendPID:      resp.BackendPID,
+		ColdStartMillis: resp.ColdStartMillis,
+		RowLimit:        resp.RowLimit,
+		TieBreaker:      resp.TieBreaker,
+		Annotations:     resp.Annotations,
+		ResultSets:      resp.ResultSets,
+		Notices:         resp.Notices,
+		NoticesDropped:  resp.NoticesDropped,
+	}
+}
+
+func rowsChecksum(rows [][]any) (string, error) {
+	var crc uint32
+	for _, row := range rows {
+		buf, err := json.Marshal(row)
+		if err != nil {
+			return "", fmt.Errorf("encode row: %w", err)
+		}
+		crc = crc32.Update(crc, castagnoli, append(buf, '\n'))
+	}
+	return fmt.Sprintf("crc32c:%08x", crc), nil
+}
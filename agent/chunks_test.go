@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type recordingWriter struct {
+	frames []map[string]any
+	binary [][]byte
+}
+
+func (w *recordingWriter) WriteMessage(messageType int, data []byte) error {
+	w.binary = append(w.binary, data)
+	return nil
+}
+
+func (w *recordingWriter) WriteJSON(v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var frame map[string]any
+	if err := json.Unmarshal(buf, &frame); err != nil {
+		return err
+	}
+	w.frames = append(w.frames, frame)
+	return nil
+}
+
+func TestWriteReplyChunks(t *testing.T) {
+	resp := QueryResponse{
+		ID:      "q1",
+		Type:    "result",
+		Columns: []string{"id", "name"},
+		Rows:    [][]any{{1, "a"}, {2, "b"}, {3, "c"}},
+	}
+
+	testCases := []struct {
+		name       string
+		chunkSize  int
+		resp       QueryResponse
+		wantTypes  []string
+		wantCount  float64
+		wantChunks float64
+	}{
+		{
+			name:      "not chunked",
+			resp:      resp,
+			wantTypes: []string{"result"},
+		},
+		{
+			name:       "split rows",
+			chunkSize:  2,
+			resp:       resp,
+			wantTypes:  []string{"result_chunk", "result_chunk", "result_end"},
+			wantCount:  3,
+			wantChunks: 2,
+		},
+		{
+			name:       "empty result",
+			chunkSize:  2,
+			resp:       QueryResponse{ID: "q1", Type: "result", Columns: []string{"id"}},
+			wantTypes:  []string{"result_chunk", "result_end"},
+			wantCount:  0,
+			wantChunks: 1,
+		},
+		{
+			name:      "error is not chunked",
+			chunkSize: 2,
+			resp:      QueryResponse{ID: "q1", Type: "result", Error: "boom"},
+			wantTypes: []string{"result"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &recordingWriter{}
+			if err := writeReply(w, Message{ChunkSize: tc.chunkSize}, tc.resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(w.frames) != len(tc.wantTypes) {
+				t.Fatalf("expected %d frames, got %v", len(tc.wantTypes), w.frames)
+			}
+			for i, want := range tc.wantTypes {
+				if w.frames[i]["type"] != want {
+					t.Errorf("frame %d: expected type %s, got %v", i, want, w.frames[i]["type"])
+				}
+			}
+			if len(w.frames) < 2 {
+				return
+			}
+			if _, ok := w.frames[0]["columns"]; !ok {
+				t.Error("expected columns on the first chunk")
+			}
+			end := w.frames[len(w.frames)-1]
+			if end["row_count"] != tc.wantCount || end["chunks"] != tc.wantChunks {
+				t.Errorf("expected row_count %v and chunks %v, got %v", tc.wantCount, tc.wantChunks, end)
+			}
+			want, _ := rowsChecksum(tc.resp.Rows)
+			if end["checksum"] != want {
+				t.Errorf("expected checksum %s, got %v", want, end["checksum"])
+			}
+		})
+	}
+}
+
+func TestWriteChunksKeepsFields(t *testing.T) {
+	resp := QueryResponse{
+		ID:              "q1",
+		Type:            "result",
+		Columns:         []string{"id"},
+		ColumnTypes:     []string{"INT8"},
+		Rows:            [][]any{{"9007199254740993"}},
+		BackendPID:      4242,
+		ColdStartMillis: 350,
+		RowLimit:        1,
+		TieBreaker:      []string{"id"},
+	}
+	w := &recordingWriter{}
+	if err := writeReply(w, Message{ChunkSize: 10}, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.frames) != 2 {
+		t.Fatalf("expected a chunk and the end, got %v", w.frames)
+	}
+	if types, _ := w.frames[0]["column_types"].([]any); len(types) != 1 || types[0] != "INT8" {
+		t.Errorf("expected column_types on the first chunk, got %v", w.frames[0])
+	}
+	end := w.frames[1]
+	for field, want := range map[string]any{"backend_pid": float64(4242), "cold_start_ms": float64(350), "row_limit": float64(1)} {
+		if end[field] != want {
+			t.Errorf("expected %s %v on result_end, got %v", field, want, end[field])
+		}
+	}
+	if tb, _ := end["tie_breaker"].([]any); len(tb) != 1 || tb[0] != "id" {
+		t.Errorf("expected tie_breaker on result_end, got %v", end["tie_breaker"])
+	}
+}
+
+func TestRowsChecksum(t *testing.T) {
+	a, _ := rowsChecksum([][]any{{1, "a"}, {2, "b"}})
+	b, _ := rowsChecksum([][]any{{1, "a"}})
+	c, _ := rowsChecksum([][]any{{1, "a"}, {2, "b"}})
+	if a == b {
+		t.Error("expected a missing row to change the checksum")
+	}
+	if a != c {
+		t.Error("expected the checksum to be deterministic")
+	}
+	if empty, _ := rowsChecksum(nil); empty != "crc32c:00000000" {
+		t.Errorf("unexpected checksum for no rows: %s", empty)
+	}
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const crdbMaxRetries = 5
+
+// StatusMessage is sent to the hub after authenticating. Flavor and the
+// region fields describe the default connection.
+type StatusMessage struct {
+	Type          string   `json:"type"`
+	Name          string   `json:"name,omitempty"`
+	Flavor        string   `json:"flavor"`
+	Regions       []string `json:"regions,omitempty"`
+	GatewayRegion string   `json:"gateway_region,omitempty"`
+
+	Connections []ConnectionStatus `json:"connections"`
+
+	AgentID    string `json:"agent_id,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	// Standby is set while the agent waits to be promoted.
+	Standby bool `json:"standby,omitempty"`
+	// Maintenance is set while the agent is in maintenance mode and takes
+	// no new work.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// ConfigVersion is the version of the last config_update applied.
+	ConfigVersion int64 `json:"config_version,omitempty"`
+	// HubRTTMillis is the last round trip to the hub, and ClockSkewMillis
+	// how far the hub's clock is ahead of the agent's; see hubClock.
+	HubRTTMillis    float64  `json:"hub_rtt_ms,omitempty"`
+	ClockSkewMillis *float64 `json:"clock_skew_ms,omitempty"`
+}
+
+type ConnectionStatus struct {
+	Name          string            `json:"name"`
+	Flavor        string            `json:"flavor"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Admin         bool              `json:"admin,omitempty"`
+	ReadOnly      bool              `json:"read_only,omitempty"`
+	AggregateOnly bool              `json:"aggregate_only,omitempty"`
+	Regions       []string          `json:"regions,omitempty"`
+	GatewayRegion string            `json:"gateway_region,omitempty"`
+
+	// TopQueries is a pg_stat_statements snapshot by total time, when the
+	// extension is installed.
+	TopQueries []TopQuery `json:"top_queries,omitempty"`
+	// Suspended is set while an idle policy has closed every connection.
+	// The fields above that need the database are then left out rather
+	// than waking it, as they are whenever no query has run within the
+	// policy's timeout.
+	Suspended bool `json:"suspended,omitempty"`
+	// Leader is set on connections that take part in leader election.
+	Leader *bool `json:"leader,omitempty"`
+}
+
+func (a *Agent) status(conns []*connection) StatusMessage {
+	status := StatusMessage{Type: "status", Name: a.opts.ConnName, AgentID: a.opts.AgentID, InstanceID: a.instanceID, Standby: !a.standby.active(),
+		Maintenance: a.maintenance.active(), ConfigVersion: a.currentSettingsVersion()}
+	for _, c := range conns {
+		cs := ConnectionStatus{Name: c.Name, Flavor: c.Flavor(), Labels: c.Labels, Admin: c.Admin, ReadOnly: c.ReadOnly, AggregateOnly: c.AggregateOnly}
+		if sc, ok := c.Connector.(*sqlConnector); ok && sc.elector != nil {
+			leader := sc.elector.isLeader()
+			cs.Leader = &leader
+		}
+		if sc, ok := c.Connector.(*sqlConnector); ok && (sc.suspended() || sc.idle()) {
+			cs.Suspended = sc.suspended()
+			status.Connections = append(status.Connections, cs)
+			continue
+		}
+		if sc, ok := c.Connector.(*sqlConnector); ok && sc.flavor == "cockroach" {
+			regions, gateway, err := cockroachRegions(sc.db)
+			if err != nil {
+				log.Printf("Could not read cluster regions for %q: %v", c.Name, err)
+			}
+			cs.Regions, cs.GatewayRegion = regions, gateway
+		}
+		if sc, ok := c.Connector.(*sqlConnector); ok && sc.flavor == "postgres" {
+			top, err := loadTopQueries(sc.db, "", statusTopQueries)
+			if err != nil && !errors.Is(err, errNoStatStatements) {
+				log.Printf("Could not read pg_stat_statements for %q: %v", c.Name, err)
+			}
+			cs.TopQueries = top
+		}
+		status.Connections = append(status.Connections, cs)
+	}
+	if len(status.Connections) > 0 {
+		status.Flavor = status.Connections[0].Flavor
+		status.Regions = status.Connections[0].Regions
+		status.GatewayRegion = status.Connections[0].GatewayRegion
+	}
+	return status
+}
+
+// cockroachRegions lists the cluster's regions and the region of the node we
+// are connected through. Single-region clusters report neither.
+func cockroachRegions(q queryer) ([]string, string, error) {
+	rows, err := q.Query("SELECT region FROM [SHOW REGIONS FROM CLUSTER]")
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var regions []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, "", err
+		}
+		regions = append(regions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var gateway sql.NullString
+	gwRows, err := q.Query("SELECT gateway_region()")
+	if err != nil {
+		return regions, "", err
+	}
+	defer gwRows.Close()
+	if gwRows.Next() {
+		if err := gwRows.Scan(&gateway); err != nil {
+			return regions, "", err
+		}
+	}
+	return regions, gateway.String, gwRows.Err()
+}
+
+// isRetryable reports whether err is a CockroachDB transaction restart
+// (SQLSTATE 40001), which clients are expected to retry.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
+
+// withRetry runs fn, retrying restart errors with a short backoff when the
+// cockroach flavor is active.
+func (c *sqlConnector) withRetry(id string, fn func() error) error {
+	backoff := 50 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || c.flavor != "cockroach" || !isRetryable(err) || attempt >= crdbMaxRetries {
+			return err
+		}
+		log.Printf("[query:%s] Transaction restart (attempt %d): %v", id, attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// executeQueryAsOf runs a read at a historical timestamp, e.g. "-10s" or
+// "follower_read_timestamp()", so it can be served by follower replicas.
+func (c *sqlConnector) executeQueryAsOf(ctx context.Context, id, sqlQuery string, params []any, asOf string) QueryResponse {
+	log.Printf("[query:%s] Executing AS OF SYSTEM TIME %s: %s", id, asOf, logSQL(sqlQuery))
+	start := time.Now()
+
+	clause := pq.QuoteLiteral(asOf)
+	if asOf == "follower_read_timestamp()" {
+		clause = asOf
+	}
+
+	var columns, types []string
+	var results [][]any
+	var sets []ResultSet
+	lim := c.owner().resultLimit(ctx, id)
+	tm := timerFrom(ctx)
+	err := c.withRetry(id, func() error {
+		begin := time.Now()
+		tx, err := c.db.BeginTx(ctx, nil)
+		tm.record(phaseConnect, begin)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("SET TRANSACTION AS OF SYSTEM TIME " + clause); err != nil {
+			return err
+		}
+		if err := setLocal(ctx, tx, c.session); err != nil {
+			return err
+		}
+		columns, types, results, sets, err = fetchResults(tx, c.flavor, sqlQuery, params, lim, tm, progressFrom(ctx))
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		return queryError(id, err)
+	}
+
+	resp := QueryResponse{
+		ID:          id,
+		Type:        "result",
+		Columns:     columns,
+		ColumnTypes: types,
+		Rows:        results,
+		ResultSets:  sets,
+	}
+	if lim != nil && lim.spilled != nil {
+		resp.spill = lim.spilled
+		log.Printf("[query:%s] Completed in %v, %d rows spilled to disk", id, time.Since(start), resp.spill.rows)
+		return resp
+	}
+	log.Printf("[query:%s] Completed in %v, %d rows", id, time.Since(start), len(results))
+	return resp
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestExecuteQuery_CockroachRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		flavor        string
+		mockSetup     func(sqlmock.Sqlmock)
+		expectedRows  int
+		expectedError bool
+	}{
+		{
+			name:   "restart error retried",
+			flavor: "cockroach",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id FROM accounts").
+					WillReturnError(&pq.Error{Code: "40001", Message: "restart transaction"})
+				mock.ExpectQuery("SELECT id FROM accounts").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+			},
+			expectedRows: 2,
+		},
+		{
+			name:   "postgres flavor does not retry",
+			flavor: "postgres",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery("SELECT id FROM accounts").
+					WillReturnError(&pq.Error{Code: "40001", Message: "could not serialize access"})
+			},
+			expectedError: true,
+		},
+		{
+			name:   "other errors not retried",
+			flavor: "cockroach",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id FROM accounts").
+					WillReturnError(&pq.Error{Code: "42P01", Message: "relation does not exist"})
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+
+			c := &sqlConnector{db: mockDB, flavor: tc.flavor}
+
+			tc.mockSetup(mock)
+
+			result := c.executeQuery(context.Background(), "c1", "SELECT id FROM accounts", nil)
+			if tc.expectedError {
+				if result.Error == "" {
+					t.Errorf("expected error, got none")
+				}
+			} else {
+				if result.Error != "" {
+					t.Errorf("unexpected error: %s", result.Error)
+				}
+				if len(result.Rows) != tc.expectedRows {
+					t.Errorf("expected %d rows, got %d", tc.expectedRows, len(result.Rows))
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestExecuteQueryAsOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		asOf   string
+		clause string
+	}{
+		{name: "interval literal", asOf: "-10s", clause: "SET TRANSACTION AS OF SYSTEM TIME '-10s'"},
+		{name: "follower reads", asOf: "follower_read_timestamp()", clause: "SET TRANSACTION AS OF SYSTEM TIME follower_read_timestamp()"},
+		{name: "quotes escaped", asOf: "x'; DROP TABLE t; --", clause: "SET TRANSACTION AS OF SYSTEM TIME 'x''; DROP TABLE t; --'"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+
+			c := &sqlConnector{db: mockDB, flavor: "cockroach"}
+
+			mock.ExpectBegin()
+			mock.ExpectExec(tc.clause).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT id FROM accounts").
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			mock.ExpectCommit()
+
+			result := c.executeQueryAsOf(context.Background(), "c2", "SELECT id FROM accounts", nil, tc.asOf)
+			if result.Error != "" {
+				t.Fatalf("unexpected error: %s", result.Error)
+			}
+			if len(result.Rows) != 1 {
+				t.Errorf("expected 1 row, got %d", len(result.Rows))
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// checkQueryComment rejects templates that could end the comment early.
+func checkQueryComment(template string) error {
+	if strings.Contains(template, "*/") || strings.Contains(template, "/*") {
+		return fmt.Errorf("query comment must not contain /* or */")
+	}
+	return nil
+}
+
+// commentSQL appends the comment rendered from template to q. The
+// template, the query_comment setting, lets DBAs tie what they see in
+// pg_stat_activity or the server log back to a PeekDB query: {query_id},
+// {user}, {tenant} and {version} are replaced by the message's values, and
+// empty disables comments. Values are
+// URL-encoded as sqlcommenter does, which also keeps them from closing the
+// comment. The comment goes last, on its own line, so error positions the
+// database reports still point into the original statement and a trailing
+// -- comment can't swallow it.
+func commentSQL(q, template string, msg Message) string {
+	if template == "" {
+		return q
+	}
+	tenantName := ""
+	if msg.tenant != nil {
+		tenantName = msg.tenant.name
+	}
+	r := strings.NewReplacer(
+		"{query_id}", commentValue(msg.ID),
+		"{user}", commentValue(msg.User),
+		"{tenant}", commentValue(tenantName),
+		"{version}", commentValue(msg.agent().opts.Version),
+	)
+	return q + "\n/* " + r.Replace(template) + " */"
+}
+
+func commentValue(v string) string {
+	return strings.ReplaceAll(url.QueryEscape(v), "+", "%20")
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCommentSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		msg      Message
+		expected string
+	}{
+		{
+			name:     "disabled",
+			msg:      Message{ID: "q1", User: "alice"},
+			expected: "SELECT 1",
+		},
+		{
+			name:     "peekdb style",
+			template: "peekdb:query_id={query_id} user={user}",
+			msg:      Message{ID: "q123", User: "alice"},
+			expected: "SELECT 1\n/* peekdb:query_id=q123 user=alice */",
+		},
+		{
+			name:     "sqlcommenter style",
+			template: "application='peekdb',query_id='{query_id}',tenant='{tenant}'",
+			msg:      Message{ID: "q1", tenant: &tenant{name: "acme corp"}},
+			expected: "SELECT 1\n/* application='peekdb',query_id='q1',tenant='acme%20corp' */",
+		},
+		{
+			name:     "values cannot close the comment",
+			template: "user={user}",
+			msg:      Message{ID: "q1", User: "x */ DROP TABLE t; /*"},
+			expected: "SELECT 1\n/* user=x%20%2A%2F%20DROP%20TABLE%20t%3B%20%2F%2A */",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := commentSQL("SELECT 1", tc.template, tc.msg); got != tc.expected {
+				t.Errorf("got      %q\nexpected %q", got, tc.expected)
+			}
+		})
+	}
+
+	if err := checkQueryComment("a */ b"); err == nil {
+		t.Error("expected a template containing */ to be rejected")
+	}
+}
+
+func TestQueryCommentExecuted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := bareAgent(DefaultOptions(), nil)
+	a.settings.queryComment = "peekdb:query_id={query_id}"
+
+	mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT 1\n/* peekdb:query_id=q7 */")).WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+
+	c := &sqlConnector{db: db, flavor: "postgres", agent: a}
+	if resp := c.Query(Message{ID: "q7", SQL: "SELECT 1"}); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// CommentResponse answers a "set_comment" message.
+type CommentResponse struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Schema string `json:"schema,omitempty"`
+	Table  string `json:"table,omitempty"`
+	Column string `json:"column,omitempty"`
+	// Comment is the comment set, or empty when it was removed.
+	Comment string `json:"comment"`
+	Error   string `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// commentKinds is what Postgres's COMMENT ON calls each kind of table.
+// CockroachDB calls them all TABLE.
+var commentKinds = map[string]string{
+	"table":             "TABLE",
+	"partitioned_table": "TABLE",
+	"view":              "VIEW",
+	"materialized_view": "MATERIALIZED VIEW",
+	"foreign_table":     "FOREIGN TABLE",
+	"column":            "COLUMN",
+}
+
+// setComment sets the comment on the table, view or column msg.Identifier
+// names, written as in a statement, to *msg.Comment; an empty comment
+// removes it. Like kill_session it needs admin on the connection, and
+// every attempt is audited.
+func setComment(msg Message) CommentResponse {
+	resp := CommentResponse{ID: msg.ID, Type: "set_comment_result"}
+	event := AuditEvent{Action: "set_comment", MessageID: msg.ID, Detail: msg.Identifier}
+	defer func() {
+		event.Connection = resp.Connection
+		event.Error = resp.Error
+		msg.agent().audit(event)
+	}()
+	fail := func(err error) CommentResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	if !c.Admin {
+		return fail(codedErrorf(codePolicyDenied, "set_comment requires admin to be enabled for connection %q", c.Name))
+	}
+	caps := msg.capabilities()
+	if c.ReadOnly || caps.ReadOnly {
+		return fail(codedErrorf(codePolicyDenied, "set_comment is not allowed on a read-only connection"))
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || (sc.flavor != "postgres" && sc.flavor != "cockroach") {
+		return fail(codedErrorf(codeNotSupported, "set_comment is not supported for %s", c.Flavor()))
+	}
+	if msg.Comment == nil {
+		return fail(codedErrorf(codeInvalidRequest, "set_comment needs a comment; send an empty one to remove it"))
+	}
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return fail(err)
+	}
+	d := dialectFor(sc.flavor)
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = d.name(p)
+	}
+
+	schema := sc.Schema(msg.ID, "")
+	if schema.Error != "" {
+		resp.Error, resp.ErrorCode = schema.Error, schema.ErrorCode
+		return resp
+	}
+	target := lookupIdentifier(schema.Tables, names, false)
+	if target == nil {
+		return fail(codedErrorf(codeInvalidRequest, "%s not found", d.qualifiedSQL(parts)))
+	}
+	resp.Schema, resp.Table, resp.Column = target.Schema, target.Table, target.Column
+	if !caps.schemaAllowed(target.Schema) {
+		return fail(codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", target.Schema))
+	}
+
+	stmt := commentStatement(sc.flavor, target, *msg.Comment)
+	ctx, done := msg.agent().running.start(msg.context(), msg.ID, msg.tenant, sc)
+	defer done()
+	log.Printf("[comment:%s] %s", msg.ID, stmt)
+	if _, err := sc.db.ExecContext(ctx, stmt); err != nil {
+		log.Printf("[comment:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	msg.agent().schemas.forget(sc)
+	resp.Comment = *msg.Comment
+	return resp
+}
+
+// commentStatement is the COMMENT ON statement that sets the comment on
+// target, or removes it when comment is empty.
+func commentStatement(flavor string, target *IdentifierTarget, comment string) string {
+	d := dialectFor(flavor)
+	kind := commentKinds[target.Kind]
+	if flavor == "cockroach" && kind != "COLUMN" {
+		kind = "TABLE"
+	}
+	object := d.quoted(target.Schema) + "." + d.quoted(target.Table)
+	if target.Column != "" {
+		object += "." + d.quoted(target.Column)
+	}
+	value := "NULL"
+	if comment != "" {
+		value = pq.QuoteLiteral(comment)
+	}
+	return "COMMENT ON " + kind + " " + object + " IS " + value
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSetComment(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+	crdb := &sqlConnector{db: mockDB, flavor: "cockroach"}
+
+	tn := testTenant(
+		&connection{Name: "prod", Admin: true, Connector: pg},
+		&connection{Name: "crdb", Admin: true, Connector: crdb},
+		&connection{Name: "plain", Connector: pg},
+	)
+	tn.agent.opts.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public", "Sales"}})
+	text := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		msg      Message
+		stmt     string
+		wantErr  string
+		wantCode string
+	}{
+		{
+			name: "table",
+			msg:  Message{ID: "c1", Identifier: "orders", Comment: text("One row per checkout; see the payments team's wiki")},
+			stmt: `COMMENT ON TABLE "public"."orders" IS 'One row per checkout; see the payments team''s wiki'`,
+		},
+		{
+			name: "column",
+			msg:  Message{ID: "c2", Identifier: `"Sales"."Top Customers".spend`, Comment: text("Lifetime, in cents")},
+			stmt: `COMMENT ON COLUMN "Sales"."Top Customers"."spend" IS 'Lifetime, in cents'`,
+		},
+		{
+			name: "remove from a materialized view",
+			msg:  Message{ID: "c3", Identifier: `"Sales"."Top Customers"`, Comment: text("")},
+			stmt: `COMMENT ON MATERIALIZED VIEW "Sales"."Top Customers" IS NULL`,
+		},
+		{
+			name: "cockroach view",
+			msg:  Message{ID: "c4", Identifier: "active_orders", Target: "crdb", Comment: text("Open orders")},
+			stmt: `COMMENT ON TABLE "public"."active_orders" IS 'Open orders'`,
+		},
+		{
+			name:    "missing",
+			msg:     Message{ID: "c5", Identifier: "public.nope", Comment: text("x")},
+			wantErr: `"public"."nope" not found`,
+		},
+		{
+			name:     "hidden schema",
+			msg:      Message{ID: "c6", Identifier: "hr.salaries", Comment: text("x")},
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "admin disabled",
+			msg:      Message{ID: "c7", Identifier: "orders", Target: "plain", Comment: text("x")},
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "no comment",
+			msg:      Message{ID: "c8", Identifier: "orders"},
+			wantCode: codeInvalidRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.msg.Comment != nil && tc.msg.Target != "plain" {
+				mock.ExpectQuery("SELECT n.nspname, c.relname").WillReturnRows(
+					sqlmock.NewRows([]string{"nspname", "relname", "relkind", "attname", "type", "nullable", "default", "table_comment", "column_comment", "type_schema", "type_name"}).
+						AddRow("Sales", "Top Customers", "m", "spend", "bigint", true, nil, nil, nil, nil, nil).
+						AddRow("hr", "salaries", "r", "amount", "numeric", false, nil, nil, nil, nil, nil).
+						AddRow("public", "active_orders", "v", "id", "bigint", true, nil, nil, nil, nil, nil).
+						AddRow("public", "orders", "r", "id", "bigint", false, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("FROM pg_inherits").WillReturnRows(sqlmock.NewRows(nil))
+				mock.ExpectQuery("FROM pg_constraint").WillReturnRows(sqlmock.NewRows(nil))
+				mock.ExpectQuery("FROM pg_type").WillReturnRows(sqlmock.NewRows(nil))
+				mock.ExpectQuery("FROM pg_sequences").WillReturnRows(sqlmock.NewRows(nil))
+			}
+			if tc.stmt != "" {
+				mock.ExpectExec(regexp.QuoteMeta(tc.stmt)).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			resp := setComment(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			if tc.wantCode != "" {
+				if resp.ErrorCode != tc.wantCode {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+			} else if resp.Error != tc.wantErr {
+				t.Errorf("error = %q, want %q", resp.Error, tc.wantErr)
+			}
+		})
+	}
+
+	log, err := os.ReadFile(tn.agent.opts.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(log), `"action":"set_comment"`); n != len(tests) {
+		t.Errorf("expected %d audited comments, got %d:\n%s", len(tests), n, log)
+	}
+}
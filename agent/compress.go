@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// A query message can list the encodings the hub reads in accept_encoding.
+// The agent then compresses a whole result whose JSON is at least
+// --compress-min-bytes, or the message's compress_min_bytes, and sends it as
+//
+//	{"type": "result", "id": ..., "encoding": "gzip", "size": N, "encoded_size": M}   (JSON)
+//	binary frames of the encoded JSON, laid out as in blobFrame
+//
+// Smaller results, and any that compression wouldn't make smaller, are
+// sent as usual, with no encoding. Chunked results are never compressed.
+
+const encodingGzip = "gzip"
+
+// encodings are advertised in the auth message.
+var encodings = []string{encodingGzip}
+
+// EncodedResult announces a result sent in encoded binary frames.
+type EncodedResult struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	// Size is the length of the result's JSON, EncodedSize that of the
+	// frames' data.
+	Size        int `json:"size"`
+	EncodedSize int `json:"encoded_size"`
+}
+
+// acceptsEncoding reports whether msg lets the agent send enc.
+func (m Message) acceptsEncoding(enc string) bool {
+	for _, e := range m.AcceptEncoding {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// compressThreshold is the smallest result compressed for msg.
+func (m Message) compressThreshold() int {
+	if m.CompressMinBytes > 0 {
+		return m.CompressMinBytes
+	}
+	return m.agent().opts.CompressMinBytes
+}
+
+// writeCompressed sends resp gzipped if it is big enough for msg, and as a
+// plain text message otherwise.
+func writeCompressed(w replyWriter, msg Message, resp QueryResponse) error {
+	buf, err := marshalResult(resp)
+	if err != nil {
+		return err
+	}
+	if len(buf) < msg.compressThreshold() {
+		return w.WriteMessage(websocket.TextMessage, buf)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if gz.Len() >= len(buf) {
+		return w.WriteMessage(websocket.TextMessage, buf)
+	}
+
+	data := gz.Bytes()
+	head := EncodedResult{ID: resp.ID, Type: "result", Encoding: encodingGzip, Size: len(buf), EncodedSize: len(data)}
+	if err := w.WriteJSON(head); err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += blobFrameSize {
+		end := min(offset+blobFrameSize, len(data))
+		if err := w.WriteMessage(websocket.BinaryMessage, blobFrame(resp.ID, offset, data[offset:end])); err != nil {
+			return err
+		}
+	}
+	log.Printf("[query:%s] Sent %d bytes gzipped to %d", resp.ID, len(buf), len(data))
+	return nil
+}
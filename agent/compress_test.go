@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteReplyCompressed(t *testing.T) {
+	small := QueryResponse{ID: "q1", Type: "result", Columns: []string{"n"}, Rows: [][]any{{1}}}
+	var rows [][]any
+	for i := 0; i < 5000; i++ {
+		rows = append(rows, []any{i, strings.Repeat("x", 20)})
+	}
+	big := QueryResponse{ID: "q2", Type: "result", Columns: []string{"n", "s"}, Rows: rows}
+
+	testCases := []struct {
+		name       string
+		msg        Message
+		resp       QueryResponse
+		compressed bool
+	}{
+		{"not accepted", Message{}, big, false},
+		{"below the threshold", Message{AcceptEncoding: []string{"gzip"}}, small, false},
+		{"above the threshold", Message{AcceptEncoding: []string{"br", "gzip"}}, big, true},
+		{"threshold from the message", Message{AcceptEncoding: []string{"gzip"}, CompressMinBytes: 1 << 30}, big, false},
+		{"chunked", Message{AcceptEncoding: []string{"gzip"}, ChunkSize: 10000}, big, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &recordingWriter{}
+			if err := writeReply(w, tc.msg, tc.resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.compressed {
+				if len(w.frames) > 0 && w.frames[0]["encoding"] != nil {
+					t.Errorf("expected no encoding, got %v", w.frames[0])
+				}
+				return
+			}
+
+			if len(w.frames) != 1 || w.frames[0]["type"] != "result" || w.frames[0]["encoding"] != "gzip" {
+				t.Fatalf("expected one gzip result header, got %v", w.frames)
+			}
+			// Reassemble the frames, laid out as blob frames.
+			var data []byte
+			for _, f := range w.binary {
+				n := int(f[0])
+				if id := string(f[1 : 1+n]); id != tc.resp.ID {
+					t.Fatalf("expected frames for %s, got %s", tc.resp.ID, id)
+				}
+				if offset := binary.BigEndian.Uint64(f[1+n:]); int(offset) != len(data) {
+					t.Fatalf("expected offset %d, got %d", len(data), offset)
+				}
+				data = append(data, f[1+n+12:]...)
+			}
+			if int(w.frames[0]["encoded_size"].(float64)) != len(data) {
+				t.Errorf("expected encoded_size %d, got %v", len(data), w.frames[0]["encoded_size"])
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(w.frames[0]["size"].(float64)) != len(plain) {
+				t.Errorf("expected size %d, got %v", len(plain), w.frames[0]["size"])
+			}
+			var got QueryResponse
+			if err := json.Unmarshal(plain, &got); err != nil || got.ID != tc.resp.ID || len(got.Rows) != len(tc.resp.Rows) {
+				t.Errorf("expected the result back, got %d rows (%v)", len(got.Rows), err)
+			}
+		})
+	}
+}
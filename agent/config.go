@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON file given with --config. Values in it may
+// reference environment variables as $VAR or ${VAR}, and the secrets store
+// as ${secret:NAME}, which keeps passwords out of the file.
+type Config struct {
+	Connections []ConnectionConfig `json:"connections"`
+	Tokens      []TokenConfig      `json:"tokens,omitempty"`
+	Scrub       *ScrubConfig       `json:"scrub,omitempty"`
+	Logs        []LogSinkConfig    `json:"logs,omitempty"`
+	// QueryMiddleware adds registered middleware around every query, in
+	// order; see RegisterQueryMiddleware.
+	QueryMiddleware []QueryMiddlewareConfig `json:"query_middleware,omitempty"`
+	// UserWeights gives users more turns when --max-concurrent-queries
+	// queues queries; a user not listed has weight 1.
+	UserWeights map[string]int `json:"user_weights,omitempty"`
+	// Backups dump Postgres connections with pg_dump on a schedule; see
+	// BackupConfig.
+	Backups []BackupConfig `json:"backups,omitempty"`
+	// Alerts run queries on a schedule and notify the hub, or a
+	// webhook, when a result crosses a threshold; see AlertConfig.
+	Alerts []AlertConfig `json:"alerts,omitempty"`
+	// Sinks are Kafka clusters and NATS servers that Publish jobs send
+	// query results to; see PublishConfig.
+	Sinks   []SinkConfig    `json:"sinks,omitempty"`
+	Publish []PublishConfig `json:"publish,omitempty"`
+	// Anonymize rewrites columns of export results; see AnonymizeConfig.
+	Anonymize *AnonymizeConfig `json:"anonymize,omitempty"`
+}
+
+// TokenConfig registers one more PeekDB token with the hub, serving the
+// connections its targets select (names, globs or label selectors, as in a
+// message's target), or every connection when none are given.
+type TokenConfig struct {
+	Name        string   `json:"name,omitempty"`
+	Token       string   `json:"token"`
+	Connections []string `json:"connections,omitempty"`
+	// Hub is the hub to register with, e.g. a regional endpoint; empty
+	// means --hub. Each token keeps its own connection and reconnect loop.
+	Hub string `json:"hub,omitempty"`
+}
+
+type ConnectionConfig struct {
+	Name   string            `json:"name"`
+	URL    string            `json:"url"`
+	Flavor string            `json:"flavor,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Admin allows administrative messages such as kill_session.
+	Admin bool `json:"admin,omitempty"`
+	// IdleTimeout closes database connections after this long without a
+	// query, e.g. "10m", so serverless databases can scale to zero.
+	IdleTimeout duration `json:"idle_timeout,omitempty"`
+	// ReadOnly runs every query in a read-only transaction, where the
+	// database supports one, and refuses statements that aren't reads.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// ReviewDDL holds every query with DDL for review, as if it had set
+	// "review"; see review.go.
+	ReviewDDL bool `json:"review_ddl,omitempty"`
+	// Migrations is a directory of golang-migrate migration files for
+	// migrate messages that don't bring their own; see migrate.go.
+	Migrations string `json:"migrations,omitempty"`
+	// AggregateOnly refuses queries that don't aggregate and leaves out
+	// groups of fewer than MinGroupSize rows, 10 unless set; see
+	// aggregate.go.
+	AggregateOnly bool `json:"aggregate_only,omitempty"`
+	MinGroupSize  int  `json:"min_group_size,omitempty"`
+	// SessionSettings sets Postgres GUCs such as statement_timeout for
+	// each query class, "interactive" or "export".
+	SessionSettings map[string]map[string]string `json:"session_settings,omitempty"`
+	// CostLimit rejects queries whose EXPLAIN estimate is over it.
+	CostLimit *CostLimit `json:"cost_limit,omitempty"`
+	// LeaderElection names a group: of the agents whose connections to
+	// the same Postgres database share it, one is elected leader.
+	LeaderElection string `json:"leader_election,omitempty"`
+	// TLS sets the connection's sslmode and certificates; see DBTLS.
+	TLS *DBTLS `json:"tls,omitempty"`
+	// AzureAD logs in with Azure AD access tokens; see AzureAD.
+	AzureAD *AzureAD `json:"azure_ad,omitempty"`
+}
+
+// duration is a time.Duration written as a string such as "90s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func loadConfig(path string) (*Config, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text, err := expandConfig(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var cfg Config
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for i, c := range cfg.Connections {
+		if c.Name == "" || c.URL == "" {
+			return nil, fmt.Errorf("connection %d: name and url are required", i+1)
+		}
+	}
+	for i, t := range cfg.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %d: token is required", i+1)
+		}
+	}
+	for i, b := range cfg.Backups {
+		if err := b.check(); err != nil {
+			return nil, fmt.Errorf("backup %d: %w", i+1, err)
+		}
+	}
+	for i, a := range cfg.Alerts {
+		if err := a.check(); err != nil {
+			return nil, fmt.Errorf("alert %d: %w", i+1, err)
+		}
+	}
+	for i, s := range cfg.Sinks {
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("sink %d: %w", i+1, err)
+		}
+	}
+	for i, p := range cfg.Publish {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("publish %d: %w", i+1, err)
+		}
+	}
+	return &cfg, nil
+}
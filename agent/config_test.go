@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("STAGING_PASSWORD", "s3cret")
+
+	testCases := []struct {
+		name    string
+		content string
+		want    []ConnectionConfig
+		wantErr bool
+	}{
+		{
+			name: "connections with labels",
+			content: `{"connections": [
+				{"name": "analytics.events", "url": "postgres://a/db", "labels": {"env": "prod"}},
+				{"name": "orders", "url": "postgres://b/db", "flavor": "cockroach"}
+			]}`,
+			want: []ConnectionConfig{
+				{Name: "analytics.events", URL: "postgres://a/db", Labels: map[string]string{"env": "prod"}},
+				{Name: "orders", URL: "postgres://b/db", Flavor: "cockroach"},
+			},
+		},
+		{
+			name:    "environment expansion",
+			content: `{"connections": [{"name": "staging", "url": "postgres://u:${STAGING_PASSWORD}@c/db"}]}`,
+			want:    []ConnectionConfig{{Name: "staging", URL: "postgres://u:s3cret@c/db"}},
+		},
+		{
+			name:    "missing url",
+			content: `{"connections": [{"name": "orders"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "token without value",
+			content: `{"connections": [{"name": "orders", "url": "postgres://b/db"}], "tokens": [{"name": "acme", "connections": ["orders"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			content: `{"connections": [{"name": "orders", "url": "postgres://b/db", "lables": {}}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "peekdb.json")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfig(path)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(cfg.Connections) != len(tc.want) {
+				t.Fatalf("expected %d connections, got %d", len(tc.want), len(cfg.Connections))
+			}
+			for i, want := range tc.want {
+				got := cfg.Connections[i]
+				if got.Name != want.Name || got.URL != want.URL || got.Flavor != want.Flavor {
+					t.Errorf("connection %d: expected %+v, got %+v", i, want, got)
+				}
+				for k, v := range want.Labels {
+					if got.Labels[k] != v {
+						t.Errorf("connection %d: expected label %s=%s, got %q", i, k, v, got.Labels[k])
+					}
+				}
+			}
+		})
+	}
+}
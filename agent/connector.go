@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Connector is a database the agent serves queries from. Built-in connectors
+// are picked by the DATABASE_URL scheme; any other scheme is handed to an
+// adapter plugin (see plugin.go).
+type Connector interface {
+	// Flavor names the engine, e.g. "postgres" or "bigquery".
+	Flavor() string
+	Query(msg Message) QueryResponse
+	Schema(id, schema string) SchemaResponse
+	Close() error
+}
+
+// openConnector opens the database rawURL names. TCP connections are
+// dialed in family; see --ip-family.
+func openConnector(rawURL, flavor string, password passwordFunc, family string) (Connector, error) {
+	switch urlScheme(rawURL) {
+	case "", "postgres", "postgresql":
+		// No scheme means a key=value DSN, which lib/pq also accepts.
+		return openSQL("postgres", rawURL, flavor, password, family)
+	case "oracle":
+		return openSQL("oracle", rawURL, "oracle", nil, family)
+	case "bigquery":
+		return newBigQuery(rawURL)
+	case "cassandra", "scylla":
+		return newCassandra(rawURL, family)
+	case "elasticsearch", "opensearch":
+		c, err := newSearchClient(rawURL, family)
+		if err != nil {
+			return nil, err
+		}
+		return c, c.do(context.Background(), "GET", "/", nil, &map[string]any{})
+	case "duckdb":
+		d, err := newDuckDB(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return d, d.ping()
+	default:
+		return startPlugin(urlScheme(rawURL), rawURL)
+	}
+}
+
+// urlScheme returns the scheme of a database URL, or "" for a key=value
+// DSN.
+func urlScheme(rawURL string) string {
+	if i := strings.Index(rawURL, "://"); i > 0 {
+		return rawURL[:i]
+	}
+	return ""
+}
+
+// unsupportedOption reports the first query option in msg that isn't in
+// supported, as an error string for the response.
+func unsupportedOption(c Connector, msg Message, supported ...string) string {
+	used := map[string]bool{
+		"dry_run":           msg.DryRun,
+		"cursor":            msg.Cursor != "",
+		"as_of_system_time": msg.AsOfSystemTime != "",
+		"dsl":               len(msg.DSL) > 0,
+		"sample":            msg.Sample != nil,
+		"stable_order":      msg.StableOrder,
+	}
+	for _, s := range supported {
+		delete(used, s)
+	}
+	for _, name := range []string{"dry_run", "cursor", "as_of_system_time", "dsl", "sample", "stable_order"} {
+		if used[name] {
+			return fmt.Sprintf("%s is not supported for %s", name, c.Flavor())
+		}
+	}
+	return ""
+}
+
+// sqlConnector serves databases reached through database/sql: Postgres,
+// CockroachDB and Oracle.
+type sqlConnector struct {
+	db     *sql.DB
+	flavor string
+
+	// driver, dsn, password and family reopen the database for admin
+	// calls; see signalBackend.
+	driver, dsn string
+	password    passwordFunc
+	family      string
+	// agent is the Agent that opened the connector; see owner.
+	agent *Agent
+
+	// idleTimeout, when set, lets the pool drop to zero connections between
+	// queries; see setIdleTimeout. lastQuery is when executeQuery last ran,
+	// in Unix nanoseconds, shared with the per-query copies; see idle.
+	idleTimeout time.Duration
+	lastQuery   *atomic.Int64
+	// readOnly runs queries in read-only transactions.
+	readOnly bool
+	// settings holds the session settings of each query class, and session
+	// those of the query being run; see QueryContext.
+	settings map[string][]sessionSetting
+	session  []sessionSetting
+	// costLimit, when set, rejects queries the planner expects to be too
+	// expensive; see checkCost.
+	costLimit *CostLimit
+	// elector, when set, takes part in leader election; see elector.
+	elector *elector
+}
+
+// setIdleTimeout closes pooled connections once they have been idle for d.
+// database/sql reconnects on the next query, and that query reports how
+// long the reconnect took as cold_start_ms.
+func (c *sqlConnector) setIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
+	c.lastQuery = new(atomic.Int64)
+	c.db.SetConnMaxIdleTime(d)
+}
+
+// suspended reports whether an idle policy has closed every connection.
+// The leader election lock's connection is exempt from the policy and is
+// not counted: it stays open for as long as this agent leads.
+func (c *sqlConnector) suspended() bool {
+	if c.idleTimeout <= 0 {
+		return false
+	}
+	open := c.db.Stats().OpenConnections
+	if c.elector != nil {
+		open -= c.elector.sessions()
+	}
+	return open <= 0
+}
+
+// idle reports whether an idle policy is set and no query has run within
+// it, so that background lookups such as the status report's would keep
+// the database awake that the policy means to let sleep.
+func (c *sqlConnector) idle() bool {
+	if c.idleTimeout <= 0 || c.lastQuery == nil {
+		return false
+	}
+	return time.Since(time.Unix(0, c.lastQuery.Load())) >= c.idleTimeout
+}
+
+func openSQL(driverName, rawURL, flavor string, password passwordFunc, family string) (*sqlConnector, error) {
+	if err := checkURLHost("database URL", rawURL, family); err != nil {
+		return nil, err
+	}
+	db, err := openDB(driverName, rawURL, password, family)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, krbHint(peerAuthHint(tlsHint(err)))
+	}
+	return &sqlConnector{db: db, flavor: flavor, driver: driverName, dsn: rawURL, password: password, family: family}, nil
+}
+
+// owner returns the Agent that opened c, or a bare one for connectors
+// built directly, as in tests.
+func (c *sqlConnector) owner() *Agent {
+	if c.agent == nil {
+		return bareAgent(DefaultOptions(), nil)
+	}
+	return c.agent
+}
+
+// openDB is sql.Open, with Postgres connections dialed in family (see
+// --ip-family), and logging in with password, when set, rather than the
+// DSN's.
+func openDB(driverName, dsn string, password passwordFunc, family string) (*sql.DB, error) {
+	if driverName != "postgres" {
+		return sql.Open(driverName, dsn)
+	}
+	if password != nil {
+		c, err := newPasswordConnector(dsn, password, family)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(c), nil
+	}
+	c, err := pq.NewConnector(pqURL(dsn))
+	if err != nil {
+		return nil, err
+	}
+	c.Dialer(newFamilyDialer(family))
+	return sql.OpenDB(c), nil
+}
+
+func (c *sqlConnector) Flavor() string { return c.flavor }
+
+func (c *sqlConnector) Close() error {
+	if c.elector != nil {
+		c.elector.Close()
+	}
+	return c.db.Close()
+}
+
+func (c *sqlConnector) Query(msg Message) QueryResponse {
+	return c.QueryContext(context.Background(), msg)
+}
+
+func (c *sqlConnector) QueryContext(ctx context.Context, msg Message) QueryResponse {
+	supported := []string{}
+	if c.flavor == "cockroach" {
+		supported = append(supported, "as_of_system_time")
+	} else {
+		supported = append(supported, "sample")
+	}
+	if c.flavor != "oracle" {
+		supported = append(supported, "stable_order")
+	}
+	if e := unsupportedOption(c, msg, supported...); e != "" {
+		return QueryResponse{ID: msg.ID, Type: "result", Error: e, ErrorCode: codeNotSupported}
+	}
+
+	if msg.Sample != nil {
+		q, err := sampleQuery(msg.SQL, c.flavor, *msg.Sample)
+		if err != nil {
+			return queryError(msg.ID, err)
+		}
+		msg.SQL = q
+	}
+	var tieBreaker []string
+	if msg.StableOrder {
+		q, cols, err := c.stableOrder(ctx, msg.SQL)
+		if err != nil {
+			return queryError(msg.ID, err)
+		}
+		msg.SQL, tieBreaker = q, cols
+	}
+	if resp := c.checkCost(ctx, msg); resp != nil {
+		return *resp
+	}
+	msg.SQL = commentSQL(msg.SQL, c.owner().currentQueryComment(), msg)
+
+	ro := msg.capabilities().ReadOnly && !c.readOnly
+	if session := c.settings[queryClass(msg)]; ro || len(session) > 0 {
+		// The connector is shared by every query, so make the copy with
+		// this query's read-only mode and settings for it alone.
+		cc := *c
+		cc.readOnly = c.readOnly || ro
+		cc.session = session
+		c = &cc
+	}
+
+	var resp QueryResponse
+	switch {
+	case msg.AsOfSystemTime != "":
+		resp = c.executeQueryAsOf(ctx, msg.ID, msg.SQL, msg.Params, msg.AsOfSystemTime)
+	case c.flavor == "oracle":
+		resp = c.executeQuery(ctx, msg.ID, oraclePlaceholders(msg.SQL), msg.Params)
+	default:
+		resp = c.executeQuery(ctx, msg.ID, msg.SQL, msg.Params)
+	}
+	resp.TieBreaker = tieBreaker
+	return resp
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUnsupportedOption(t *testing.T) {
+	c := &sqlConnector{flavor: "postgres"}
+	tests := []struct {
+		name      string
+		msg       Message
+		supported []string
+		expected  string
+	}{
+		{name: "plain query", msg: Message{SQL: "SELECT 1"}, expected: ""},
+		{name: "dry run", msg: Message{DryRun: true}, expected: "dry_run is not supported for postgres"},
+		{name: "supported cursor", msg: Message{Cursor: "abc"}, supported: []string{"cursor"}, expected: ""},
+		{name: "sample", msg: Message{Sample: &SampleOption{Percent: 1}}, expected: "sample is not supported for postgres"},
+		{name: "dsl", msg: Message{DSL: json.RawMessage(`{}`)}, supported: []string{"cursor"}, expected: "dsl is not supported for postgres"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := unsupportedOption(c, tc.msg, tc.supported...); result != tc.expected {
+				t.Errorf("unsupportedOption = %q, want %q", result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSQLConnectorQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		flavor        string
+		msg           Message
+		mockSetup     func(sqlmock.Sqlmock)
+		expectedError string
+	}{
+		{
+			name:   "postgres query",
+			flavor: "postgres",
+			msg:    Message{ID: "q1", SQL: "SELECT $1::int", Params: []any{1}},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery(`SELECT \$1::int`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"int4"}).AddRow(1))
+			},
+		},
+		{
+			name:   "oracle placeholders rewritten",
+			flavor: "oracle",
+			msg:    Message{ID: "q2", SQL: "SELECT * FROM emp WHERE id = $1", Params: []any{1}},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT \* FROM emp WHERE id = :1`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"ID"}))
+			},
+		},
+		{
+			name:          "as of system time needs cockroach",
+			flavor:        "postgres",
+			msg:           Message{ID: "q3", SQL: "SELECT 1", AsOfSystemTime: "-10s"},
+			mockSetup:     func(sqlmock.Sqlmock) {},
+			expectedError: "as_of_system_time is not supported for postgres",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+
+			c := &sqlConnector{db: mockDB, flavor: tc.flavor}
+			tc.mockSetup(mock)
+
+			resp := c.Query(tc.msg)
+			if resp.Error != tc.expectedError {
+				t.Errorf("error = %q, want %q", resp.Error, tc.expectedError)
+			}
+			if resp.ID != tc.msg.ID {
+				t.Errorf("expected ID %q, got %q", tc.msg.ID, resp.ID)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutSuspends(t *testing.T) {
+	_, mock, err := sqlmock.NewWithDSN("peekdb-idle-test")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	// A second handle on the same mock starts with no open connections, as
+	// a pool does once the idle policy has closed them.
+	db, err := sql.Open("sqlmock", "peekdb-idle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := &sqlConnector{db: db, flavor: "postgres"}
+	if c.suspended() {
+		t.Error("expected a connector without an idle policy never to be suspended")
+	}
+	c.setIdleTimeout(time.Minute)
+	if !c.suspended() {
+		t.Fatal("expected an empty pool with an idle policy to be suspended")
+	}
+
+	a := testAgent(&connection{Name: "neon", Connector: c})
+
+	// The status report must not wake the database.
+	status := a.status(a.connections)
+	if len(status.Connections) != 1 || !status.Connections[0].Suspended {
+		t.Errorf("expected a suspended connection in status, got %+v", status.Connections)
+	}
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	resp := c.executeQuery(context.Background(), "i1", "SELECT 1", nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if c.suspended() {
+		t.Error("expected the query to resume the pool")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestIdleConnectionStaysSuspendedAcrossStatus(t *testing.T) {
+	_, mock, err := sqlmock.NewWithDSN("peekdb-idle-status-test")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	db, err := sql.Open("sqlmock", "peekdb-idle-status-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := &sqlConnector{db: db, flavor: "postgres"}
+	c.setIdleTimeout(time.Minute)
+	a := testAgent(&connection{Name: "neon", Connector: c})
+	mock.ExpectQuery("SELECT extversion FROM pg_extension").WillReturnRows(sqlmock.NewRows([]string{"extversion"}))
+
+	// Neither a suspended pool nor one whose last query is older than the
+	// idle timeout is touched by a status tick.
+	for _, open := range []bool{false, true} {
+		if open {
+			if err := db.Ping(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		status := a.status(a.connections)
+		if len(status.Connections) != 1 || status.Connections[0].Suspended != !open {
+			t.Errorf("open=%v: unexpected status %+v", open, status.Connections)
+		}
+		if !open && !c.suspended() {
+			t.Error("expected the status tick to leave the connection suspended")
+		}
+		if mock.ExpectationsWereMet() == nil {
+			t.Fatalf("open=%v: the status tick queried an idle database", open)
+		}
+	}
+
+	// After a query within the timeout the lookups run again.
+	c.lastQuery.Store(time.Now().UnixNano())
+	a.status(a.connections)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the status tick to read pg_stat_statements: %v", err)
+	}
+}
+
+func TestSuspendedIgnoresElectionLock(t *testing.T) {
+	_, _, err := sqlmock.NewWithDSN("peekdb-idle-leader-test")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	db, err := sql.Open("sqlmock", "peekdb-idle-leader-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newElector("neon", "jobs", db)
+	e.conn = conn
+	defer e.Close()
+
+	c := &sqlConnector{db: db, flavor: "postgres", elector: e}
+	c.setIdleTimeout(time.Minute)
+	if !c.suspended() {
+		t.Error("expected the election lock's connection not to keep the connector awake")
+	}
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// CostLimit rejects queries whose plan, as estimated by EXPLAIN before they
+// run, exceeds either threshold. Zero leaves a threshold unchecked.
+type CostLimit struct {
+	// MaxCost is in the planner's arbitrary cost units, the "Total Cost"
+	// of the top plan node.
+	MaxCost float64 `json:"max_cost,omitempty"`
+	// MaxRows bounds the rows the planner expects the query to return.
+	MaxRows float64 `json:"max_rows,omitempty"`
+}
+
+// PlanEstimate is the planner's estimate for a query, sent with a
+// query_too_expensive error so the user can see how far over it was.
+type PlanEstimate struct {
+	TotalCost float64 `json:"total_cost"`
+	PlanRows  float64 `json:"plan_rows"`
+}
+
+// explainable lists the statement kinds EXPLAIN accepts without running
+// them; anything else skips the cost check.
+var explainable = map[string]bool{
+	"select": true, "insert": true, "update": true, "delete": true,
+	"merge": true, "values": true, "table": true,
+}
+
+// estimatePlan asks the planner for q's cost and row estimate.
+func (c *sqlConnector) estimatePlan(ctx context.Context, q string, params []any) (*PlanEstimate, error) {
+	ctx, cancel := context.WithTimeout(ctx, explainTimeout)
+	defer cancel()
+	var out []byte
+	if err := c.db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+q, params...).Scan(&out); err != nil {
+		return nil, err
+	}
+	var plans []struct {
+		Plan struct {
+			TotalCost float64 `json:"Total Cost"`
+			PlanRows  float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal(out, &plans); err != nil || len(plans) == 0 {
+		return nil, fmt.Errorf("unexpected EXPLAIN output: %.100s", out)
+	}
+	return &PlanEstimate{TotalCost: plans[0].Plan.TotalCost, PlanRows: plans[0].Plan.PlanRows}, nil
+}
+
+// check returns a query_too_expensive error when e is over the limit.
+func (l *CostLimit) check(e *PlanEstimate) error {
+	switch {
+	case l.MaxCost > 0 && e.TotalCost > l.MaxCost:
+		return codedErrorf(codeTooExpensive, "estimated cost %.0f exceeds the limit of %.0f; add filters or a LIMIT", e.TotalCost, l.MaxCost)
+	case l.MaxRows > 0 && e.PlanRows > l.MaxRows:
+		return codedErrorf(codeTooExpensive, "estimated %.0f rows exceeds the limit of %.0f; add filters or a LIMIT", e.PlanRows, l.MaxRows)
+	}
+	return nil
+}
+
+// checkCost runs the cost gate for msg, returning the rejection to send
+// when the query is over the connection's limit.
+func (c *sqlConnector) checkCost(ctx context.Context, msg Message) *QueryResponse {
+	if c.costLimit == nil {
+		return nil
+	}
+	if kind, _ := classifyStatement(msg.SQL); !explainable[kind] {
+		return nil
+	}
+	est, err := c.estimatePlan(ctx, msg.SQL, msg.Params)
+	if err != nil {
+		// The query would most likely fail the same way; let it, so the
+		// user gets the database's own error.
+		log.Printf("[query:%s] Could not estimate cost: %v", msg.ID, err)
+		return nil
+	}
+	if err := c.costLimit.check(est); err != nil {
+		log.Printf("[query:%s] Rejected: %v", msg.ID, err)
+		resp := queryError(msg.ID, err)
+		resp.PlanEstimate = est
+		return &resp
+	}
+	return nil
+}
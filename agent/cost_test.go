@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCostLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		plan    string
+		code    string
+		explain bool
+	}{
+		{
+			name:    "over cost",
+			sql:     "SELECT * FROM events",
+			plan:    `[{"Plan": {"Node Type": "Seq Scan", "Total Cost": 250000.5, "Plan Rows": 900}}]`,
+			code:    codeTooExpensive,
+			explain: true,
+		},
+		{
+			name:    "over rows",
+			sql:     "SELECT * FROM events WHERE kind = $1",
+			plan:    `[{"Plan": {"Total Cost": 10, "Plan Rows": 5000000}}]`,
+			code:    codeTooExpensive,
+			explain: true,
+		},
+		{
+			name:    "within limits",
+			sql:     "SELECT * FROM events WHERE id = $1",
+			plan:    `[{"Plan": {"Total Cost": 8.3, "Plan Rows": 1}}]`,
+			explain: true,
+		},
+		{name: "not explainable", sql: "VACUUM events"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tc.explain {
+				mock.ExpectQuery(`EXPLAIN \(FORMAT JSON\) `).WillReturnRows(sqlmock.NewRows([]string{"QUERY PLAN"}).AddRow(tc.plan))
+			}
+			if tc.code == "" {
+				mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery("").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			}
+
+			c := &sqlConnector{db: db, flavor: "postgres", costLimit: &CostLimit{MaxCost: 100000, MaxRows: 1000000}}
+			resp := c.Query(Message{ID: "q1", SQL: tc.sql})
+			if resp.ErrorCode != tc.code {
+				t.Errorf("expected %q, got %q (%s)", tc.code, resp.ErrorCode, resp.Error)
+			}
+			if tc.code != "" && resp.PlanEstimate == nil {
+				t.Error("expected the plan estimate with the rejection")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
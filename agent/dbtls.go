@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// DBTLS configures TLS for a Postgres or CockroachDB connection. Its
+// fields override the sslmode, sslrootcert, sslcert and sslkey parameters
+// of the connection's URL.
+type DBTLS struct {
+	// Mode is disable, require, verify-ca or verify-full.
+	Mode string `json:"mode,omitempty"`
+	// RootCert is a PEM file of the CAs to trust for the server's
+	// certificate; Cert and Key are the agent's client certificate.
+	RootCert string `json:"root_cert,omitempty"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+}
+
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// check reports mistakes in the settings and their files up front, where
+// the driver would fail later with less to go on.
+func (t *DBTLS) check() error {
+	if t.Mode != "" && !slices.Contains(sslModes, t.Mode) {
+		return fmt.Errorf("unknown sslmode %q: expected one of %s", t.Mode, strings.Join(sslModes, ", "))
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("a client certificate needs both a cert and a key")
+	}
+	if t.RootCert != "" {
+		buf, err := os.ReadFile(t.RootCert)
+		if err != nil {
+			return fmt.Errorf("root certificate: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(buf) {
+			return fmt.Errorf("root certificate %s holds no PEM certificates", t.RootCert)
+		}
+	}
+	if t.Cert != "" {
+		if _, err := tls.LoadX509KeyPair(t.Cert, t.Key); err != nil {
+			return fmt.Errorf("client certificate: %w", err)
+		}
+		if fi, err := os.Stat(t.Key); err == nil && fi.Mode().Perm()&0o077 != 0 {
+			return fmt.Errorf("client key %s is readable by other users; chmod 600 it", t.Key)
+		}
+	}
+	return nil
+}
+
+// apply returns dsn, a URL or key=value DSN, with t's settings.
+func (t *DBTLS) apply(dsn string) (string, error) {
+	if err := t.check(); err != nil {
+		return "", err
+	}
+	params := [][2]string{{"sslmode", t.Mode}, {"sslrootcert", t.RootCert}, {"sslcert", t.Cert}, {"sslkey", t.Key}}
+	dsn = pqURL(dsn)
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		for _, p := range params {
+			if p[1] != "" {
+				q.Set(p[0], p[1])
+			}
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	// A key=value DSN, where a later value wins.
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	for _, p := range params {
+		if p[1] != "" {
+			dsn += " " + p[0] + "='" + quote.Replace(p[1]) + "'"
+		}
+	}
+	return dsn, nil
+}
+
+// checkVerifyFull, when require is set by --require-verify-full, refuses
+// the connection dsn opens if it is a Postgres connection over TCP that
+// doesn't verify the server's certificate and name.
+func checkVerifyFull(dsn string, require bool) error {
+	if !require {
+		return nil
+	}
+	cfg, err := pq.NewConfig(pqURL(dsn))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(cfg.Host, "/") || strings.HasPrefix(cfg.Host, "@") {
+		// Unix sockets don't leave the host.
+		return nil
+	}
+	if cfg.SSLMode != pq.SSLModeVerifyFull {
+		mode := string(cfg.SSLMode)
+		if mode == "" {
+			mode = "require"
+		}
+		return fmt.Errorf("sslmode is %s, but --db-require-verify-full is set: use sslmode verify-full with the server's CA as the root certificate", mode)
+	}
+	return nil
+}
+
+// tlsHint explains the certificate errors a connection can fail with.
+func tlsHint(err error) error {
+	var unknown x509.UnknownAuthorityError
+	var host x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &unknown) || strings.Contains(err.Error(), "certificate signed by unknown authority"):
+		return fmt.Errorf("%w (the server's certificate isn't signed by a CA the agent trusts: give that CA as --db-ssl-root-cert or tls.root_cert)", err)
+	case errors.As(err, &host) || strings.Contains(err.Error(), "certificate is valid for"):
+		return fmt.Errorf("%w (connect using a name the server's certificate lists, or use sslmode verify-ca to check only the CA)", err)
+	case errors.As(err, &invalid):
+		return fmt.Errorf("%w (check the certificate's dates and the clocks of both hosts)", err)
+	case errors.Is(err, pq.ErrSSLNotSupported):
+		return fmt.Errorf("%w (the server doesn't accept TLS: turn on ssl there, or use sslmode disable)", err)
+	}
+	return err
+}
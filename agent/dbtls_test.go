@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key to dir.
+func writeCert(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "peekdb"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certPath, keyPath
+}
+
+func TestDBTLSCheck(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir)
+	openKey := filepath.Join(dir, "open.pem")
+	buf, _ := os.ReadFile(key)
+	os.WriteFile(openKey, buf, 0o644)
+	notPEM := filepath.Join(dir, "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o644)
+
+	tests := []struct {
+		name string
+		tls  DBTLS
+		err  string
+	}{
+		{"verify-full with a CA", DBTLS{Mode: "verify-full", RootCert: cert}, ""},
+		{"client certificate", DBTLS{Mode: "require", Cert: cert, Key: key}, ""},
+		{"unknown mode", DBTLS{Mode: "prefer-ish"}, `unknown sslmode "prefer-ish"`},
+		{"cert without key", DBTLS{Cert: cert}, "needs both a cert and a key"},
+		{"missing CA", DBTLS{RootCert: filepath.Join(dir, "nope.pem")}, "no such file"},
+		{"CA not PEM", DBTLS{RootCert: notPEM}, "holds no PEM certificates"},
+		{"key and cert mismatch", DBTLS{Cert: cert, Key: notPEM}, "client certificate"},
+		{"key readable by others", DBTLS{Cert: cert, Key: openKey}, "chmod 600"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.tls.check()
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestDBTLSApply(t *testing.T) {
+	cert, _ := writeCert(t, t.TempDir())
+	tls := &DBTLS{Mode: "verify-full", RootCert: cert}
+
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"postgres://app@db.internal/mydb?sslmode=disable", "postgres://app@db.internal/mydb?sslmode=verify-full&sslrootcert=" + strings.ReplaceAll(cert, "/", "%2F")},
+		{"host=db.internal dbname=mydb", "host=db.internal dbname=mydb sslmode='verify-full' sslrootcert='" + cert + "'"},
+	}
+	for _, tc := range tests {
+		got, err := tls.apply(tc.dsn)
+		if err != nil || got != tc.want {
+			t.Errorf("apply(%q): expected %q, got %q (%v)", tc.dsn, tc.want, got, err)
+		}
+	}
+}
+
+func TestCheckVerifyFull(t *testing.T) {
+	tests := []struct {
+		dsn string
+		ok  bool
+	}{
+		{"postgres://app@db.internal/mydb?sslmode=verify-full", true},
+		{"postgres://app@db.internal/mydb?sslmode=verify-ca", false},
+		{"postgres://app@db.internal/mydb", false},
+		{"host=/var/run/postgresql dbname=mydb", true},
+		{"postgres://app@%2Fvar%2Frun%2Fpostgresql/mydb", true},
+	}
+	for _, tc := range tests {
+		if err := checkVerifyFull(tc.dsn, true); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok=%t, got %v", tc.dsn, tc.ok, err)
+		}
+	}
+}
+
+func TestTLSHint(t *testing.T) {
+	err := tlsHint(fmt.Errorf("pq: %w", x509.UnknownAuthorityError{}))
+	if !strings.Contains(err.Error(), "--db-ssl-root-cert") {
+		t.Errorf("expected a hint about the root certificate, got %v", err)
+	}
+	err = tlsHint(x509.HostnameError{Certificate: &x509.Certificate{DNSNames: []string{"db.internal"}}, Host: "10.0.0.5"})
+	if !strings.Contains(err.Error(), "verify-ca") {
+		t.Errorf("expected a hint about the name, got %v", err)
+	}
+}
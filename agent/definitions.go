@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// DefinitionResponse answers a "get_definition" message.
+type DefinitionResponse struct {
+	ID          string       `json:"id"`
+	Type        string       `json:"type"`
+	Definitions []Definition `json:"definitions,omitempty"`
+	Error       string       `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// Definition is the source of a view, materialized view, function or
+// procedure as a statement that would create it. Arguments tell apart
+// the overloads of a Postgres function, which are all returned.
+type Definition struct {
+	Kind       string `json:"kind"`
+	Schema     string `json:"schema"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments,omitempty"`
+	Definition string `json:"definition"`
+}
+
+// definitionsQuery finds the views and routines named $1, in schema $2 or,
+// when that is empty, on the search path, as an unqualified name in a
+// statement would. Views have only their SELECT; aggregates have no
+// definition to show.
+const definitionsQuery = `
+SELECT n.nspname, c.relname, CASE c.relkind WHEN 'm' THEN 'materialized_view' ELSE 'view' END,
+       '', pg_get_viewdef(c.oid, true)
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('v', 'm') AND c.relname = $1
+  AND (n.nspname = $2 OR $2 = '' AND pg_table_is_visible(c.oid))
+UNION ALL
+SELECT n.nspname, p.proname, CASE p.prokind WHEN 'p' THEN 'procedure' ELSE 'function' END,
+       pg_get_function_identity_arguments(p.oid), pg_get_functiondef(p.oid)
+FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace
+WHERE p.prokind IN ('f', 'p', 'w') AND p.proname = $1
+  AND (n.nspname = $2 OR $2 = '' AND pg_function_is_visible(p.oid))
+ORDER BY 1, 3, 4`
+
+// oracleDefinitionsQuery is definitionsQuery for Oracle, where
+// DBMS_METADATA writes the whole statement and an unqualified name is in
+// the current schema. A package has its specification and body.
+const oracleDefinitionsQuery = `
+SELECT owner, object_name, LOWER(REPLACE(object_type, ' ', '_')), '',
+       DBMS_METADATA.GET_DDL(REPLACE(object_type, ' ', '_'), object_name, owner)
+FROM all_objects
+WHERE object_name = :1 AND owner = NVL(:2, SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA'))
+  AND object_type IN ('VIEW', 'MATERIALIZED VIEW', 'FUNCTION', 'PROCEDURE', 'PACKAGE')
+ORDER BY object_type`
+
+// getDefinition answers a "get_definition" message with the source of the
+// view or routine msg.Identifier names, written as in a statement.
+func getDefinition(msg Message) DefinitionResponse {
+	resp := DefinitionResponse{ID: msg.ID, Type: "definition"}
+	fail := func(err error) DefinitionResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok {
+		return fail(codedErrorf(codeNotSupported, "get_definition is not supported for %s", c.Flavor()))
+	}
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return fail(err)
+	}
+	if len(parts) > 2 {
+		return fail(codedErrorf(codeInvalidRequest, "%q is not a view or routine: expected name or schema.name", msg.Identifier))
+	}
+	d := dialectFor(sc.flavor)
+	name, schema := d.name(parts[len(parts)-1]), ""
+	if len(parts) == 2 {
+		schema = d.name(parts[0])
+	}
+	caps := msg.capabilities()
+	if schema != "" && !caps.schemaAllowed(schema) {
+		return fail(codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", schema))
+	}
+
+	query := definitionsQuery
+	if sc.flavor == "oracle" {
+		query = oracleDefinitionsQuery
+	}
+	rows, err := sc.db.QueryContext(msg.context(), query, name, schema)
+	if err != nil {
+		log.Printf("[definition:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	defer rows.Close()
+	hidden := false
+	for rows.Next() {
+		var def Definition
+		if err := rows.Scan(&def.Schema, &def.Name, &def.Kind, &def.Arguments, &def.Definition); err != nil {
+			return fail(err)
+		}
+		if !caps.schemaAllowed(def.Schema) {
+			hidden = true
+			continue
+		}
+		def.Definition = createStatement(d, def)
+		resp.Definitions = append(resp.Definitions, def)
+	}
+	if err := rows.Err(); err != nil {
+		return fail(err)
+	}
+	if len(resp.Definitions) == 0 {
+		if hidden {
+			return fail(codedErrorf(codePolicyDenied, "%s is in a schema not allowed for this token", d.qualifiedSQL(parts)))
+		}
+		return fail(codedErrorf(codeInvalidRequest, "no view or routine named %s", d.qualifiedSQL(parts)))
+	}
+	return resp
+}
+
+// createStatement completes a view's SELECT, which is all Postgres keeps,
+// into the statement that creates it. Routines already are one.
+func createStatement(d identDialect, def Definition) string {
+	var kind string
+	switch def.Kind {
+	case "view":
+		kind = "VIEW"
+	case "materialized_view":
+		kind = "MATERIALIZED VIEW"
+	}
+	source := strings.TrimSpace(def.Definition)
+	if kind == "" || strings.HasPrefix(source, "CREATE") {
+		return source
+	}
+	return fmt.Sprintf("CREATE %s %s.%s AS\n%s", kind, d.quoted(def.Schema), d.quoted(def.Name), source)
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetDefinition(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(
+		&connection{Name: "pg", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+		&connection{Name: "ora", Connector: &sqlConnector{db: mockDB, flavor: "oracle"}},
+	)
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public", "Reports", "APP"}})
+	columns := []string{"schema", "name", "kind", "arguments", "definition"}
+
+	tests := []struct {
+		name     string
+		msg      Message
+		query    string
+		args     [2]string
+		rows     *sqlmock.Rows
+		want     []Definition
+		wantCode string
+	}{
+		{
+			name:  "view",
+			msg:   Message{ID: "d1", Identifier: `"Reports".Active_Users`},
+			query: "pg_get_viewdef",
+			args:  [2]string{"active_users", "Reports"},
+			rows: sqlmock.NewRows(columns).
+				AddRow("Reports", "active_users", "view", "", " SELECT users.id\n   FROM users\n  WHERE users.active;"),
+			want: []Definition{{Kind: "view", Schema: "Reports", Name: "active_users",
+				Definition: "CREATE VIEW \"Reports\".\"active_users\" AS\nSELECT users.id\n   FROM users\n  WHERE users.active;"}},
+		},
+		{
+			name:  "overloaded function on the search path",
+			msg:   Message{ID: "d2", Identifier: "add_user"},
+			query: "pg_get_functiondef",
+			args:  [2]string{"add_user", ""},
+			rows: sqlmock.NewRows(columns).
+				AddRow("public", "add_user", "function", "email text", "CREATE OR REPLACE FUNCTION public.add_user(email text)\n...\n").
+				AddRow("public", "add_user", "function", "email text, admin boolean", "CREATE OR REPLACE FUNCTION public.add_user(email text, admin boolean)\n...\n"),
+			want: []Definition{
+				{Kind: "function", Schema: "public", Name: "add_user", Arguments: "email text", Definition: "CREATE OR REPLACE FUNCTION public.add_user(email text)\n..."},
+				{Kind: "function", Schema: "public", Name: "add_user", Arguments: "email text, admin boolean", Definition: "CREATE OR REPLACE FUNCTION public.add_user(email text, admin boolean)\n..."},
+			},
+		},
+		{
+			name:  "oracle package",
+			msg:   Message{ID: "d3", Identifier: "app.billing", Target: "ora"},
+			query: "DBMS_METADATA.GET_DDL",
+			args:  [2]string{"BILLING", "APP"},
+			rows: sqlmock.NewRows(columns).
+				AddRow("APP", "BILLING", "package", "", "\n  CREATE OR REPLACE EDITIONABLE PACKAGE \"APP\".\"BILLING\" AS\n  ..."),
+			want: []Definition{{Kind: "package", Schema: "APP", Name: "BILLING",
+				Definition: "CREATE OR REPLACE EDITIONABLE PACKAGE \"APP\".\"BILLING\" AS\n  ..."}},
+		},
+		{
+			name:     "missing",
+			msg:      Message{ID: "d4", Identifier: "nope"},
+			query:    "pg_get_viewdef",
+			args:     [2]string{"nope", ""},
+			rows:     sqlmock.NewRows(columns),
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "only in a hidden schema",
+			msg:      Message{ID: "d5", Identifier: "payroll"},
+			query:    "pg_get_viewdef",
+			args:     [2]string{"payroll", ""},
+			rows:     sqlmock.NewRows(columns).AddRow("hr", "payroll", "view", "", " SELECT 1;"),
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "hidden schema",
+			msg:      Message{ID: "d6", Identifier: "hr.payroll"},
+			wantCode: codePolicyDenied,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.rows != nil {
+				mock.ExpectQuery(tc.query).WithArgs(tc.args[0], tc.args[1]).WillReturnRows(tc.rows)
+			}
+			resp := getDefinition(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			if tc.wantCode != "" {
+				if resp.ErrorCode != tc.wantCode {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+				return
+			}
+			if resp.Error != "" || len(resp.Definitions) != len(tc.want) {
+				t.Fatalf("unexpected response: %+v", resp)
+			}
+			for i, def := range resp.Definitions {
+				if def != tc.want[i] {
+					t.Errorf("definition %d:\n got %+v\nwant %+v", i, def, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// devHub is the "dev-hub" command's stand-in for the hub: it takes one
+// agent connection at a time on /agent and, from a web page or its small
+// JSON API, sends that agent messages and collects the replies. It has no
+// accounts or persistence and is meant for localhost.
+type devHub struct {
+	// token, when set, is the only token the dev hub accepts.
+	token string
+
+	mu       sync.Mutex
+	agent    *websocket.Conn
+	instance string // the agent's instance ID
+	status   json.RawMessage
+	pending  map[string]chan json.RawMessage
+	seq      int
+
+	// writeMu serialises writes to agent.
+	writeMu sync.Mutex
+}
+
+func newDevHub(token string) *devHub {
+	return &devHub{token: token, pending: map[string]chan json.RawMessage{}}
+}
+
+func (h *devHub) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/agent", h.serveAgent)
+	mux.HandleFunc("/api/send", h.serveSend)
+	mux.HandleFunc("/api/status", h.serveStatus)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, devHubPage)
+	})
+	return mux
+}
+
+var devHubUpgrader = websocket.Upgrader{ReadBufferSize: 64 * 1024, WriteBufferSize: 64 * 1024}
+
+// serveAgent authenticates an agent and then reads its frames, handing each
+// reply to the request waiting for it. A new agent replaces the old one,
+// which is sent a replaced message first unless it is the same instance
+// reconnecting.
+func (h *devHub) serveAgent(w http.ResponseWriter, r *http.Request) {
+	conn, err := devHubUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var auth Message
+	if err := conn.ReadJSON(&auth); err != nil || auth.Type != "auth" {
+		return
+	}
+	if h.token != "" && auth.Token != h.token {
+		conn.WriteJSON(AuthResponse{Type: "auth", Error: "invalid token"})
+		log.Printf("[dev-hub] Refused an agent with the wrong token")
+		return
+	}
+	now := time.Now()
+	if err := conn.WriteJSON(AuthResponse{Type: "auth", Success: true, Time: &now}); err != nil {
+		return
+	}
+	agentVersion := "(unknown version)"
+	if auth.Build != nil {
+		agentVersion = auth.Build.Version
+	}
+	log.Printf("[dev-hub] Agent %s connected from %s", agentVersion, r.RemoteAddr)
+
+	h.mu.Lock()
+	if h.agent != nil {
+		if h.instance != auth.InstanceID {
+			h.writeMu.Lock()
+			h.agent.WriteJSON(Message{Type: "replaced", InstanceID: auth.InstanceID})
+			h.writeMu.Unlock()
+			log.Printf("[dev-hub] Agent instance %s replaced %s", auth.InstanceID, h.instance)
+		}
+		h.agent.Close()
+	}
+	h.agent, h.instance = conn, auth.InstanceID
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		if h.agent == conn {
+			h.agent = nil
+		}
+		h.mu.Unlock()
+		log.Printf("[dev-hub] Agent disconnected")
+	}()
+
+	for {
+		kind, frame, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if kind != websocket.TextMessage {
+			continue
+		}
+		var f struct {
+			ID     string    `json:"id"`
+			Type   string    `json:"type"`
+			SentAt time.Time `json:"sent_at"`
+		}
+		if json.Unmarshal(frame, &f) != nil {
+			continue
+		}
+		if f.Type == "clock" {
+			now := time.Now()
+			h.writeMu.Lock()
+			conn.WriteJSON(Message{Type: "clock", SentAt: &f.SentAt, Time: &now})
+			h.writeMu.Unlock()
+			continue
+		}
+		h.mu.Lock()
+		if f.Type == "status" {
+			h.status = frame
+		} else if ch := h.pending[f.ID]; ch != nil {
+			// Never block the read loop on a request that gave up.
+			select {
+			case ch <- frame:
+			default:
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// send gives msg an ID, sends it to the agent and returns its reply frames:
+// one, or every frame of a chunked result or blob download.
+func (h *devHub) send(msg map[string]any, timeout time.Duration) ([]json.RawMessage, error) {
+	h.mu.Lock()
+	conn := h.agent
+	h.seq++
+	id := fmt.Sprintf("dev-%d", h.seq)
+	ch := make(chan json.RawMessage, 256)
+	if conn != nil {
+		h.pending[id] = ch
+	}
+	h.mu.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("no agent is connected; start one with --hub ws://<this address>/agent")
+	}
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+	}()
+
+	msg["id"] = id
+	if msg["type"] == nil {
+		msg["type"] = "query"
+	}
+	h.writeMu.Lock()
+	err := conn.WriteJSON(msg)
+	h.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []json.RawMessage
+	deadline := time.After(timeout)
+	for {
+		select {
+		case frame := <-ch:
+			frames = append(frames, frame)
+			var f struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(frame, &f)
+			if f.Type != "result_chunk" && f.Type != "blob_start" {
+				return frames, nil
+			}
+		case <-deadline:
+			return frames, fmt.Errorf("no reply to %s after %v", id, timeout)
+		}
+	}
+}
+
+func (h *devHub) serveSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var msg map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg == nil {
+		http.Error(w, "the body must be a JSON message", http.StatusBadRequest)
+		return
+	}
+	frames, err := h.send(msg, 5*time.Minute)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(frames)
+}
+
+func (h *devHub) serveStatus(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	status, connected := h.status, h.agent != nil
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Connected bool            `json:"connected"`
+		Status    json.RawMessage `json:"status,omitempty"`
+	}{connected, status})
+}
+
+// RunDevHub is the "dev-hub" command. It serves until killed and returns
+// the process exit code if it can't.
+func RunDevHub(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("dev-hub", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("addr", "127.0.0.1:8765", "Address to serve the dev hub on")
+	token := fs.String("token", "", "Accept only agents with this token (default: any)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	fmt.Fprintf(w, "PeekDB dev hub on http://%s\n", *addr)
+	fmt.Fprintf(w, "Start an agent with: peekdb-agent --hub ws://%s/agent --token dev --db ...\n", *addr)
+	if err := http.ListenAndServe(*addr, newDevHub(*token).handler()); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+const devHubPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PeekDB dev hub</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; max-width: 72em; }
+textarea { width: 100%; height: 8em; font-family: monospace; }
+table { border-collapse: collapse; margin-top: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; font-family: monospace; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; }
+#agent { color: #666; }
+</style>
+</head>
+<body>
+<h1>PeekDB dev hub</h1>
+<p id="agent">Waiting for an agent…</p>
+<p><label>Target <input id="target" placeholder="default connection"></label></p>
+<textarea id="sql">SELECT 1</textarea>
+<p><button id="run">Run</button> <label><input type="checkbox" id="raw"> Show raw frames</label></p>
+<div id="out"></div>
+<script>
+const $ = (id) => document.getElementById(id);
+
+async function refresh() {
+  const s = await (await fetch("/api/status")).json();
+  if (!s.connected) {
+    $("agent").textContent = "Waiting for an agent…";
+  } else {
+    const conns = ((s.status && s.status.connections) || []).map(c => c.name + " (" + c.flavor + ")");
+    $("agent").textContent = "Agent connected: " + (conns.join(", ") || "no status yet");
+  }
+}
+
+function cell(v) {
+  return v === null ? "NULL" : typeof v === "object" ? JSON.stringify(v) : String(v);
+}
+
+$("run").onclick = async () => {
+  const msg = {type: "query", sql: $("sql").value};
+  if ($("target").value) msg.target = $("target").value;
+  const res = await fetch("/api/send", {method: "POST", body: JSON.stringify(msg)});
+  const out = $("out");
+  out.textContent = "";
+  if (!res.ok) {
+    out.innerHTML = "<pre></pre>";
+    out.firstChild.textContent = await res.text();
+    return;
+  }
+  const frames = await res.json();
+  const reply = frames[frames.length - 1];
+  if ($("raw").checked || reply.error || !reply.columns) {
+    const pre = document.createElement("pre");
+    pre.textContent = frames.map(f => JSON.stringify(f, null, 2)).join("\n");
+    out.appendChild(pre);
+    if (!reply.columns) return;
+  }
+  const table = document.createElement("table");
+  const head = table.insertRow();
+  reply.columns.forEach(c => { const th = document.createElement("th"); th.textContent = c; head.appendChild(th); });
+  (reply.rows || []).forEach(r => { const tr = table.insertRow(); r.forEach(v => { tr.insertCell().textContent = cell(v); }); });
+  out.appendChild(table);
+};
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDevHub(t *testing.T) {
+	srv := httptest.NewServer(newDevHub("dev").handler())
+	defer srv.Close()
+
+	// Nothing to send to yet.
+	resp, err := http.Post(srv.URL+"/api/send", "application/json", strings.NewReader(`{"sql": "SELECT 1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 without an agent, got %d", resp.StatusCode)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/agent"
+	bad, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.WriteJSON(Message{Type: "auth", Token: "nope"})
+	var auth AuthResponse
+	if err := bad.ReadJSON(&auth); err != nil || auth.Success {
+		t.Errorf("expected the wrong token to be refused, got %+v (%v)", auth, err)
+	}
+	bad.Close()
+
+	agent, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	agent.WriteJSON(Message{Type: "auth", Token: "dev"})
+	if err := agent.ReadJSON(&auth); err != nil || !auth.Success {
+		t.Fatalf("expected the agent to be accepted, got %+v (%v)", auth, err)
+	}
+	agent.WriteJSON(StatusMessage{Type: "status", Connections: []ConnectionStatus{{Name: "main", Flavor: "postgres"}}})
+
+	// The dev hub tells the time, for clock skew.
+	if auth.Time == nil {
+		t.Error("expected the auth response to carry the hub's time")
+	}
+	sent := time.Now()
+	agent.WriteJSON(ClockMessage{Type: "clock", SentAt: sent})
+	var clock Message
+	if err := agent.ReadJSON(&clock); err != nil || clock.Type != "clock" || clock.Time == nil || !clock.SentAt.Equal(sent) {
+		t.Errorf("expected a clock reply, got %+v (%v)", clock, err)
+	}
+
+	// Play the agent: answer a chunked query with two frames.
+	go func() {
+		var msg Message
+		if err := agent.ReadJSON(&msg); err != nil {
+			return
+		}
+		agent.WriteJSON(ResultChunk{ID: msg.ID, Type: "result_chunk", Columns: []string{"n"}, Rows: [][]any{{1}}})
+		agent.WriteJSON(ResultEnd{ID: msg.ID, Type: "result_end", Chunks: 1, RowCount: 1})
+	}()
+
+	resp, err = http.Post(srv.URL+"/api/send", "application/json", strings.NewReader(`{"sql": "SELECT 1", "chunk_size": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var frames []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&frames); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[0]["type"] != "result_chunk" || frames[1]["type"] != "result_end" {
+		t.Errorf("expected a chunk and its end, got %v", frames)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Connected bool
+		Status    StatusMessage
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	if !status.Connected || len(status.Status.Connections) != 1 {
+		t.Errorf("expected the agent's status, got %+v", status)
+	}
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Features a diskQuota accounts for.
+const (
+	diskSpill  = "spill"
+	diskOutbox = "outbox"
+)
+
+// diskQuota keeps the agent's files under --max-disk-usage, so an agent on a
+// small VM doesn't fill its root partition. Features charge bytes before
+// writing them. What can be dropped without breaking a running query,
+// such as a spooled reply the hub can ask for again, is tracked as well;
+// when a charge would go over the limit, those are evicted least recently
+// used first. A charge that still doesn't fit fails. A nil diskQuota, as in
+// tests, accounts for nothing.
+type diskQuota struct {
+	max int64
+
+	mu   sync.Mutex
+	used map[string]int64
+	// lru holds the evictable entries, least recently used at the front.
+	lru       *list.List
+	evictions map[string]int64
+	rejected  int64
+}
+
+// diskEntry is bytes a feature can give up on demand.
+type diskEntry struct {
+	feature string
+	size    int64
+	evict   func()
+	elem    *list.Element
+}
+
+func newDiskQuota(limit int64) *diskQuota {
+	return &diskQuota{max: limit, used: map[string]int64{}, lru: list.New(), evictions: map[string]int64{}}
+}
+
+func checkMaxDiskUsage(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("--max-disk-usage must not be negative, got %d", n)
+	}
+	return nil
+}
+
+// useDataDir points the disk features without paths of their own into
+// --data-dir, spill files in spill/ and the outbox in outbox.db, creating
+// the directories they need.
+func (a *Agent) useDataDir() error {
+	dataDir := a.opts.DataDir
+	if dataDir == "" {
+		return nil
+	}
+	if a.opts.SpillDir == "" {
+		a.opts.SpillDir = filepath.Join(dataDir, "spill")
+	}
+	if a.opts.Outbox == "" {
+		a.opts.Outbox = filepath.Join(dataDir, "outbox.db")
+	}
+	for _, dir := range []string{dataDir, a.opts.SpillDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// charge accounts for n more bytes of feature, evicting entries to make
+// room. It fails with resources_exhausted when they don't fit even with
+// nothing left to evict.
+func (q *diskQuota) charge(feature string, n int64) error {
+	if q == nil {
+		return nil
+	}
+	for {
+		q.mu.Lock()
+		if q.max <= 0 || q.total()+n <= q.max {
+			q.used[feature] += n
+			q.mu.Unlock()
+			return nil
+		}
+		front := q.lru.Front()
+		if front == nil {
+			q.rejected++
+			total := q.total()
+			q.mu.Unlock()
+			return codedErrorf(codeResourcesExhausted, "disk usage would go over --max-disk-usage (%d of %d bytes in use)", total, q.max)
+		}
+		e := q.remove(front)
+		q.evictions[e.feature]++
+		q.mu.Unlock()
+		// Outside q.mu: the feature takes its own locks to evict, and
+		// may hold them while calling back in.
+		e.evict()
+	}
+}
+
+// release gives back n bytes of feature that charge accounted for.
+func (q *diskQuota) release(feature string, n int64) {
+	if q == nil || n == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.used[feature] -= n
+	q.mu.Unlock()
+}
+
+// track makes n bytes of feature, already charged, evictable by evict.
+// They are the most recently used.
+func (q *diskQuota) track(feature string, n int64, evict func()) *diskEntry {
+	if q == nil {
+		return nil
+	}
+	e := &diskEntry{feature: feature, size: n, evict: evict}
+	q.mu.Lock()
+	e.elem = q.lru.PushBack(e)
+	q.mu.Unlock()
+	return e
+}
+
+// forget releases e when its feature freed it itself. An entry that was
+// already evicted was released then.
+func (q *diskQuota) forget(e *diskEntry) {
+	if q == nil || e == nil {
+		return
+	}
+	q.mu.Lock()
+	if e.elem != nil {
+		q.remove(e.elem)
+	}
+	q.mu.Unlock()
+}
+
+// remove takes the entry at elem out of the LRU list and releases its
+// bytes. Callers hold q.mu.
+func (q *diskQuota) remove(elem *list.Element) *diskEntry {
+	e := q.lru.Remove(elem).(*diskEntry)
+	e.elem = nil
+	q.used[e.feature] -= e.size
+	return e
+}
+
+// total is the bytes in use. Callers hold q.mu.
+func (q *diskQuota) total() int64 {
+	var n int64
+	for _, u := range q.used {
+		n += u
+	}
+	return n
+}
+
+func (q *diskQuota) writeMetrics(w io.Writer) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	features := []string{diskOutbox, diskSpill}
+	fmt.Fprintln(w, "# HELP peekdb_disk_usage_bytes Bytes of spill files and spooled replies on disk, by feature.")
+	fmt.Fprintln(w, "# TYPE peekdb_disk_usage_bytes gauge")
+	for _, f := range features {
+		fmt.Fprintf(w, "peekdb_disk_usage_bytes{feature=%s} %d\n", promLabel(f), q.used[f])
+	}
+	if q.max > 0 {
+		fmt.Fprintln(w, "# HELP peekdb_disk_quota_bytes The --max-disk-usage limit.")
+		fmt.Fprintln(w, "# TYPE peekdb_disk_quota_bytes gauge")
+		fmt.Fprintf(w, "peekdb_disk_quota_bytes %d\n", q.max)
+	}
+	fmt.Fprintln(w, "# HELP peekdb_disk_evictions_total Entries dropped to stay under --max-disk-usage, by feature.")
+	fmt.Fprintln(w, "# TYPE peekdb_disk_evictions_total counter")
+	for _, f := range features {
+		fmt.Fprintf(w, "peekdb_disk_evictions_total{feature=%s} %d\n", promLabel(f), q.evictions[f])
+	}
+	fmt.Fprintln(w, "# HELP peekdb_disk_quota_rejections_total Writes refused because they didn't fit under --max-disk-usage.")
+	fmt.Fprintln(w, "# TYPE peekdb_disk_quota_rejections_total counter")
+	fmt.Fprintf(w, "peekdb_disk_quota_rejections_total %d\n", q.rejected)
+}
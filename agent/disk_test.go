@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiskQuota(t *testing.T) {
+	q := newDiskQuota(100)
+	var evicted []string
+	entry := func(name string, n int64) *diskEntry {
+		if err := q.charge(diskOutbox, n); err != nil {
+			t.Fatalf("charging %s: %v", name, err)
+		}
+		return q.track(diskOutbox, n, func() { evicted = append(evicted, name) })
+	}
+	entry("a", 30)
+	b := entry("b", 30)
+	entry("c", 30)
+
+	// b was freed by its feature, so it isn't evicted; a goes first.
+	q.forget(b)
+	if err := q.charge(diskSpill, 50); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(evicted, []string{"a"}) {
+		t.Errorf("expected a evicted, got %q", evicted)
+	}
+
+	// Spill bytes can't be evicted: with c gone there is still no room.
+	err := q.charge(diskSpill, 60)
+	if errorCode(err) != codeResourcesExhausted {
+		t.Fatalf("expected resources_exhausted, got %v", err)
+	}
+	if !slices.Equal(evicted, []string{"a", "c"}) {
+		t.Errorf("expected a and c evicted, got %q", evicted)
+	}
+	q.release(diskSpill, 50)
+	if err := q.charge(diskSpill, 60); err != nil {
+		t.Errorf("expected room once the spill was released, got %v", err)
+	}
+
+	var metrics bytes.Buffer
+	q.writeMetrics(&metrics)
+	for _, want := range []string{
+		`peekdb_disk_usage_bytes{feature="spill"} 60`,
+		`peekdb_disk_usage_bytes{feature="outbox"} 0`,
+		`peekdb_disk_evictions_total{feature="outbox"} 2`,
+		"peekdb_disk_quota_rejections_total 1",
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("expected %q in metrics:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestOutboxQuota(t *testing.T) {
+	reply := QueryResponse{ID: "q0", Type: "result"}
+	size, _ := json.Marshal(reply)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	o, err := openOutbox(path, 64<<20, newDiskQuota(int64(3*len(size))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"q1", "q2", "q3", "q4"} {
+		if err := o.push("acme", QueryResponse{ID: id, Type: "result"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close()
+
+	// Reopening charges what is queued again.
+	quota := newDiskQuota(int64(2 * len(size)))
+	if o, err = openOutbox(path, 64<<20, quota); err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	var got []string
+	if _, err := o.drain("acme", func(b []byte) error {
+		var r QueryResponse
+		json.Unmarshal(b, &r)
+		got = append(got, r.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"q3", "q4"}; !slices.Equal(got, want) {
+		t.Errorf("expected the oldest replies evicted, leaving %q, got %q", want, got)
+	}
+	if quota.used[diskOutbox] != 0 || o.size != 0 {
+		t.Errorf("expected a drained outbox to use nothing, got %d (outbox says %d)", quota.used[diskOutbox], o.size)
+	}
+}
+
+func TestSpillQuota(t *testing.T) {
+	quota := newDiskQuota(spillCharge)
+	lim := &resultLimit{id: "q1", max: 1, spill: true, dir: t.TempDir(), quota: quota}
+	rows := [][]any{{strings.Repeat("x", spillCharge/2)}}
+	if err := lim.overflow(rows); err != nil {
+		t.Fatal(err)
+	}
+	err := lim.spilled.write([]any{strings.Repeat("y", spillCharge)})
+	if errorCode(err) != codeResourcesExhausted {
+		t.Fatalf("expected resources_exhausted past the quota, got %v", err)
+	}
+	lim.spilled.remove()
+	if quota.used[diskSpill] != 0 {
+		t.Errorf("expected the removed spill file released, got %d bytes", quota.used[diskSpill])
+	}
+}
+
+func TestUseDataDir(t *testing.T) {
+	a := bareAgent(DefaultOptions(), nil)
+	a.opts.DataDir = filepath.Join(t.TempDir(), "peekdb")
+	a.opts.Outbox = "/var/spool/peekdb/outbox.db"
+	if err := a.useDataDir(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(a.opts.DataDir, "spill"); a.opts.SpillDir != want {
+		t.Errorf("expected spill files in %s, got %s", want, a.opts.SpillDir)
+	}
+	if a.opts.Outbox != "/var/spool/peekdb/outbox.db" {
+		t.Errorf("expected --outbox kept, got %s", a.opts.Outbox)
+	}
+	if fi, err := os.Stat(a.opts.SpillDir); err != nil || !fi.IsDir() {
+		t.Errorf("expected the spill directory created, got %v", err)
+	}
+}
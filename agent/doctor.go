@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+)
+
+// runDoctor opens every configured connection and reports on it without
+// connecting to the hub. It returns the process exit code: 1 if anything
+// failed, 0 otherwise, warnings included.
+func (a *Agent) runDoctor(w io.Writer) int {
+	fmt.Fprintln(w, "PeekDB Agent doctor")
+
+	cfg, err := readConfig(a.opts.ConfigPath)
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	if _, err := newScrubber(cfg.Scrub); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	if _, err := newAnonymizer(cfg.Anonymize); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	if err := a.connectDB(cfg); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	defer closeConnections(a.connections)
+	if _, err := newTenants(a, cfg.Tokens, a.connections); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+
+	code := 0
+	for _, c := range a.connections {
+		fmt.Fprintf(w, "\n%s (%s)\n", c.Name, c.Flavor())
+		fmt.Fprintln(w, "  ✓ connected")
+		for _, f := range checkPrivileges(c) {
+			mark := "✓"
+			switch f.Level {
+			case "warn":
+				mark = "!"
+			case "fail":
+				mark = "✗"
+				code = 1
+			}
+			fmt.Fprintf(w, "  %s %s: %s\n", mark, f.Check, f.Message)
+		}
+	}
+	return code
+}
@@ -0,0 +1,367 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// duckDB runs queries through the duckdb CLI. The Go driver needs cgo, which
+// our static release builds don't have, and the CLI's JSON output mode gives
+// us everything we need.
+type duckDB struct {
+	cli  string
+	path string // database file; empty for an in-memory database
+	init string // statements run before every query, e.g. views over data files
+}
+
+var dataFileReaders = map[string]string{
+	".parquet": "read_parquet",
+	".csv":     "read_csv_auto",
+	".tsv":     "read_csv_auto",
+	".json":    "read_json_auto",
+	".ndjson":  "read_json_auto",
+}
+
+var nonIdentChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// newDuckDB parses duckdb:///path/to/file. A .duckdb/.db file is opened
+// read-only; a Parquet, CSV or JSON file is exposed as a view named after the
+// file in an in-memory database. duckdb:// alone gives an empty in-memory
+// database where read_parquet() and friends can reach any file on the host.
+func newDuckDB(rawURL string) (*duckDB, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duckdb URL: %w", err)
+	}
+	d := &duckDB{cli: u.Query().Get("cli")}
+	if d.cli == "" {
+		d.cli = "duckdb"
+	}
+	if _, err := exec.LookPath(d.cli); err != nil {
+		return nil, fmt.Errorf("duckdb CLI not found (install it or pass ?cli=/path/to/duckdb): %w", err)
+	}
+
+	path := u.Host + u.Path
+	ext := strings.ToLower(filepath.Ext(path))
+	if reader, ok := dataFileReaders[ext]; ok {
+		view := nonIdentChars.ReplaceAllString(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), "_")
+		d.init = fmt.Sprintf("CREATE VIEW %q AS SELECT * FROM %s(%s);\n", view, reader, duckLiteral(path))
+	} else {
+		d.path = path
+	}
+	return d, nil
+}
+
+// run feeds script to the CLI, killing it if ctx is cancelled. The CLI
+// reads dot-commands such as .shell and .output from the same input, so a
+// script with a line starting with "." is refused, and -safe keeps the CLI
+// away from other files should one get through.
+func (d *duckDB) run(ctx context.Context, script string) ([]byte, error) {
+	if err := checkDuckDotCommands(d.init + script); err != nil {
+		return nil, err
+	}
+	args := []string{"-safe", "-json", "-bail"}
+	if d.path != "" {
+		args = append(args, "-readonly", d.path)
+	}
+	cmd := exec.CommandContext(ctx, d.cli, args...)
+	cmd.Stdin = strings.NewReader(d.init + script)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, &codedError{code: duckErrorCode(msg), msg: msg}
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// checkDuckDotCommands refuses a script with a line the CLI would read as a
+// dot-command, even one inside a multi-line string literal.
+func checkDuckDotCommands(script string) error {
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), ".") {
+			return codedErrorf(codeInvalidRequest, "a line starting with \".\" is a duckdb CLI command and is not allowed")
+		}
+	}
+	return nil
+}
+
+// duckErrorCode classifies a DuckDB error message by its "<Kind> Error:"
+// prefix.
+func duckErrorCode(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "Parser Error"), strings.HasPrefix(msg, "Binder Error"),
+		strings.HasPrefix(msg, "Catalog Error"):
+		return codeSyntaxError
+	case strings.HasPrefix(msg, "Permission Error"):
+		return codePermissionDenied
+	case strings.HasPrefix(msg, "Out of Memory Error"):
+		return codeResourcesExhausted
+	case strings.HasPrefix(msg, "INTERRUPT Error"):
+		return codeCanceled
+	}
+	return codeQueryFailed
+}
+
+func (d *duckDB) ping() error {
+	_, err := d.run(context.Background(), "SELECT 1;\n")
+	return err
+}
+
+func (d *duckDB) Flavor() string { return "duckdb" }
+
+func (d *duckDB) Close() error { return nil }
+
+func (d *duckDB) Query(msg Message) QueryResponse {
+	if e := unsupportedOption(d, msg); e != "" {
+		return QueryResponse{ID: msg.ID, Type: "result", Error: e, ErrorCode: codeNotSupported}
+	}
+	return d.query(msg.context(), msg.ID, msg.SQL, msg.Params)
+}
+
+func (d *duckDB) Schema(id, schema string) SchemaResponse {
+	return SchemaResponse{ID: id, Type: "schema", Error: "schema introspection is not supported for duckdb"}
+}
+
+// duckReadStatements are the statement kinds DuckDB connections run. An
+// in-memory database can't be opened read-only, and even a read-only one
+// lets COPY ... TO, EXPORT DATABASE and ATTACH write files, so anything but
+// a read is refused before the CLI sees it.
+var duckReadStatements = map[string]bool{"from": true, "summarize": true}
+
+func (d *duckDB) query(ctx context.Context, id, sqlQuery string, params []any) QueryResponse {
+	log.Printf("[query:%s] Executing on DuckDB: %s", id, logSQL(sqlQuery))
+	start := time.Now()
+
+	if err := checkDuckDotCommands(sqlQuery); err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		return queryError(id, err)
+	}
+	for _, stmt := range splitStatements(sqlQuery) {
+		if kind, _ := classifyStatement(stmt); !readStatements[kind] && !duckReadStatements[kind] {
+			err := codedErrorf(codePolicyDenied, "duckdb connections are read-only; %s is not allowed", strings.ToUpper(kind))
+			log.Printf("[query:%s] Error: %v", id, err)
+			return queryError(id, err)
+		}
+	}
+
+	stmt := strings.TrimRight(strings.TrimSpace(sqlQuery), ";")
+	script := stmt + ";\n"
+	literals := make([]string, len(params))
+	for i, p := range params {
+		literals[i] = duckLiteral(p)
+	}
+	if len(params) > 0 {
+		// The CLI has no bind API, so bind through a prepared statement with
+		// the parameters rendered as literals.
+		script = "PREPARE peekdb_stmt AS " + script +
+			"EXECUTE peekdb_stmt(" + strings.Join(literals, ", ") + ");\n"
+	}
+
+	out, err := d.run(ctx, script)
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		return queryError(id, err)
+	}
+	columns, results, err := decodeDuckJSON(out)
+	if err != nil {
+		log.Printf("[query:%s] Error: %v", id, err)
+		return queryError(id, err)
+	}
+	if len(results) == 0 {
+		columns = d.describe(ctx, stmt, literals)
+	}
+
+	log.Printf("[query:%s] Completed in %v, %d rows", id, time.Since(start), len(results))
+
+	return QueryResponse{
+		ID:      id,
+		Type:    "result",
+		Columns: columns,
+		Rows:    results,
+	}
+}
+
+// describe returns the columns stmt would return. The CLI prints nothing
+// for an empty result, so an empty result's columns come from DESCRIBE,
+// which takes no parameters: they are written into the statement instead.
+// A statement DESCRIBE can't handle, such as SHOW, has no columns.
+func (d *duckDB) describe(ctx context.Context, stmt string, literals []string) []string {
+	out, err := d.run(ctx, "DESCRIBE "+bindDuckLiterals(stmt, literals)+";\n")
+	if err != nil {
+		return nil
+	}
+	_, rows, err := decodeDuckJSON(out)
+	if err != nil {
+		return nil
+	}
+	var columns []string
+	for _, row := range rows {
+		if len(row) > 0 {
+			columns = append(columns, fmt.Sprint(row[0]))
+		}
+	}
+	return columns
+}
+
+// bindDuckLiterals replaces q's $n and ? parameters with literals, leaving
+// string literals, quoted identifiers and comments alone.
+func bindDuckLiterals(q string, literals []string) string {
+	if len(literals) == 0 {
+		return q
+	}
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(q[i+1:], c)
+			if end < 0 {
+				return b.String() + q[i:]
+			}
+			b.WriteString(q[i : i+end+2])
+			i += end + 1
+			continue
+		case strings.HasPrefix(q[i:], "--"), strings.HasPrefix(q[i:], "/*"):
+			close := "\n"
+			if c == '/' {
+				close = "*/"
+			}
+			end := strings.Index(q[i+2:], close)
+			if end < 0 {
+				return b.String() + q[i:]
+			}
+			end += 2 + len(close)
+			b.WriteString(q[i : i+end])
+			i += end - 1
+			continue
+		case c == '$':
+			j := i + 1
+			for j < len(q) && q[j] >= '0' && q[j] <= '9' {
+				j++
+			}
+			if n, err := strconv.Atoi(q[i+1 : j]); err == nil && n >= 1 && n <= len(literals) {
+				b.WriteString(literals[n-1])
+				i = j - 1
+				continue
+			}
+		case c == '?' && next < len(literals):
+			b.WriteString(literals[next])
+			next++
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// decodeDuckJSON reads the CLI's JSON output: an array of objects per
+// statement that returns rows. Keys are read in order so the column order
+// matches the query; only the last array is kept.
+func decodeDuckJSON(out []byte) ([]string, [][]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+
+	var columns []string
+	var results [][]any
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return columns, results, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if tok != json.Delim('[') {
+			return nil, nil, fmt.Errorf("unexpected duckdb output %v", tok)
+		}
+
+		columns, results = nil, nil
+		for dec.More() {
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+				return nil, nil, fmt.Errorf("unexpected duckdb row: %v", err)
+			}
+			var row []any
+			for i := 0; dec.More(); i++ {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, nil, err
+				}
+				var v any
+				if err := dec.Decode(&v); err != nil {
+					return nil, nil, err
+				}
+				if len(results) == 0 {
+					columns = append(columns, key.(string))
+				}
+				row = append(row, jsonValue(v))
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, nil, err
+			}
+			results = append(results, row)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// jsonValue turns json.Number (from a UseNumber decoder) into int64 or
+// float64, recursing into arrays and objects.
+func jsonValue(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return n
+		}
+		f, _ := val.Float64()
+		return f
+	case []any:
+		for i := range val {
+			val[i] = jsonValue(val[i])
+		}
+	case map[string]any:
+		for k := range val {
+			val[k] = jsonValue(val[k])
+		}
+	}
+	return v
+}
+
+func duckLiteral(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		return strconv.FormatBool(val)
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	case int:
+		return strconv.Itoa(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case string:
+		return "'" + strings.ReplaceAll(val, "'", "''") + "'"
+	default:
+		return "'" + strings.ReplaceAll(fmt.Sprint(val), "'", "''") + "'"
+	}
+}
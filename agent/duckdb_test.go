@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeDuckJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       string
+		expectedCols []string
+		expectedRows [][]any
+	}{
+		{
+			name:         "column order preserved",
+			output:       `[{"z":1,"a":"x","m":null},{"z":2,"a":"y","m":1.5}]`,
+			expectedCols: []string{"z", "a", "m"},
+			expectedRows: [][]any{{int64(1), "x", nil}, {int64(2), "y", 1.5}},
+		},
+		{
+			name:         "empty output",
+			output:       ``,
+			expectedCols: nil,
+			expectedRows: nil,
+		},
+		{
+			name:         "last statement wins",
+			output:       "[{\"a\":1}]\n[{\"b\":true}]\n",
+			expectedCols: []string{"b"},
+			expectedRows: [][]any{{true}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cols, rows, err := decodeDuckJSON([]byte(tc.output))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(cols, ",") != strings.Join(tc.expectedCols, ",") {
+				t.Errorf("columns = %v, want %v", cols, tc.expectedCols)
+			}
+			if len(rows) != len(tc.expectedRows) {
+				t.Fatalf("expected %d rows, got %d", len(tc.expectedRows), len(rows))
+			}
+			for i := range rows {
+				for j := range rows[i] {
+					if rows[i][j] != tc.expectedRows[i][j] {
+						t.Errorf("row %d col %d = %v (%T), want %v", i, j, rows[i][j], rows[i][j], tc.expectedRows[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDuckLiteral(t *testing.T) {
+	tests := []struct {
+		input    any
+		expected string
+	}{
+		{nil, "NULL"},
+		{true, "true"},
+		{float64(3), "3"},
+		{2.5, "2.5"},
+		{"it's", "'it''s'"},
+	}
+
+	for _, tc := range tests {
+		if result := duckLiteral(tc.input); result != tc.expected {
+			t.Errorf("duckLiteral(%v) = %q, want %q", tc.input, result, tc.expected)
+		}
+	}
+}
+
+func TestDuckDBQuery(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "duckdb")
+	// Stand-in CLI: records its arguments and the script it was given, and
+	// prints one row, none for a query on "empty", or DESCRIBE's output.
+	body := `#!/bin/sh
+echo "$@" > ` + filepath.Join(dir, "args") + `
+cat > ` + filepath.Join(dir, "stdin.sql") + `
+if grep -q '^DESCRIBE' ` + filepath.Join(dir, "stdin.sql") + `; then
+	echo '[{"column_name":"id","column_type":"BIGINT"},{"column_name":"name","column_type":"VARCHAR"}]'
+elif ! grep -q empty ` + filepath.Join(dir, "stdin.sql") + `; then
+	echo '[{"id":7,"name":"seven"}]'
+fi
+`
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDuckDB("duckdb:///data/My Export.parquet?cli=" + script)
+	if err != nil {
+		t.Fatalf("newDuckDB: %v", err)
+	}
+
+	resp := d.query(context.Background(), "d1", "SELECT * FROM My_Export WHERE id = $1", []any{float64(7)})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if len(resp.Rows) != 1 || resp.Rows[0][0] != int64(7) || resp.Columns[1] != "name" {
+		t.Errorf("unexpected result: %+v", resp)
+	}
+
+	sent, err := os.ReadFile(filepath.Join(dir, "stdin.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `CREATE VIEW "My_Export" AS SELECT * FROM read_parquet('/data/My Export.parquet');
+PREPARE peekdb_stmt AS SELECT * FROM My_Export WHERE id = $1;
+EXECUTE peekdb_stmt(7);
+`
+	if string(sent) != expected {
+		t.Errorf("script = %q, want %q", sent, expected)
+	}
+	if args, _ := os.ReadFile(filepath.Join(dir, "args")); !strings.HasPrefix(string(args), "-safe ") {
+		t.Errorf("expected the CLI to run in safe mode, got %q", args)
+	}
+
+	// An empty result takes its columns from DESCRIBE.
+	resp = d.query(context.Background(), "d2", "SELECT * FROM My_Export WHERE name = $1 AND 'empty' IS NOT NULL", []any{"it's"})
+	if resp.Error != "" || len(resp.Rows) != 0 || strings.Join(resp.Columns, ",") != "id,name" {
+		t.Errorf("unexpected empty result: %+v", resp)
+	}
+	if sent, _ := os.ReadFile(filepath.Join(dir, "stdin.sql")); !strings.HasSuffix(string(sent), "\nDESCRIBE SELECT * FROM My_Export WHERE name = 'it''s' AND 'empty' IS NOT NULL;\n") {
+		t.Errorf("unexpected DESCRIBE script %q", sent)
+	}
+
+	for q, code := range map[string]string{
+		"SELECT 1;\n.shell touch /tmp/owned":   codeInvalidRequest,
+		"SELECT 1;\n  .output /tmp/owned":      codeInvalidRequest,
+		"COPY (SELECT 1) TO '/tmp/owned.csv'":  codePolicyDenied,
+		"SELECT 1; ATTACH '/tmp/owned.duckdb'": codePolicyDenied,
+		"INSTALL httpfs":                       codePolicyDenied,
+	} {
+		if resp := d.query(context.Background(), "d3", q, nil); resp.ErrorCode != code {
+			t.Errorf("expected %q to be refused with %s, got %+v", q, code, resp)
+		}
+	}
+}
+
+func TestBindDuckLiterals(t *testing.T) {
+	tests := []struct {
+		q        string
+		literals []string
+		expected string
+	}{
+		{"SELECT $1, $2, $1", []string{"7", "'x'"}, "SELECT 7, 'x', 7"},
+		{"SELECT ?, ?", []string{"1", "2"}, "SELECT 1, 2"},
+		{"SELECT '$1 ?', \"$1\" -- $1\n, $1 /* ? */", []string{"7"}, "SELECT '$1 ?', \"$1\" -- $1\n, 7 /* ? */"},
+		{"SELECT $3", []string{"7"}, "SELECT $3"},
+		{"SELECT 'open $1", []string{"7"}, "SELECT 'open $1"},
+	}
+	for _, tc := range tests {
+		if got := bindDuckLiterals(tc.q, tc.literals); got != tc.expected {
+			t.Errorf("bindDuckLiterals(%q) = %q, want %q", tc.q, got, tc.expected)
+		}
+	}
+}
+
+func TestDuckDBQueryCanceled(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "duckdb")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDuckDB("duckdb://?cli=" + script)
+	if err != nil {
+		t.Fatalf("newDuckDB: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if resp := d.query(ctx, "d1", "SELECT 1", nil); resp.Error == "" || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the CLI to be killed, got %+v after %v", resp, time.Since(start))
+	}
+}
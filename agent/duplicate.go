@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Two agents running with the same token and agent ID, say a unit file
+// installed twice or a cloned VM, both take the hub's queries, and replies
+// interleave unpredictably. Each agent process therefore has an instance ID,
+// sent in the auth message with its agent ID, and looks for duplicates two
+// ways:
+//
+//   - on its own host, through a pid file per token and agent ID in the
+//     temporary directory;
+//   - through the hub, whose auth response lists the other instances
+//     connected with the same token and agent ID:
+//
+//     {"type": "auth", "success": true, "duplicates": [{"agent_id": "web-1", "instance_id": "9f2c..."}]}
+//
+// --on-duplicate says what to do about one: warn (the default) logs it;
+// refuse stops this agent, which exits with ExitDuplicate; takeover stops
+// the local one and asks the hub, with "takeover": true in the auth
+// message, to disconnect the others after sending them
+//
+//	{"type": "replaced", "instance_id": "<the new instance>"}
+//
+// An agent that is replaced stops rather than reconnecting, so two agents
+// both set to take over don't keep replacing each other.
+
+// DuplicateAgent is another agent connected with the same token and agent
+// ID.
+type DuplicateAgent struct {
+	AgentID    string `json:"agent_id"`
+	InstanceID string `json:"instance_id"`
+	// Addr is where the hub sees it connecting from, if it says.
+	Addr string `json:"addr,omitempty"`
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func checkOnDuplicate(mode string) error {
+	switch mode {
+	case "", "warn", "refuse", "takeover":
+		return nil
+	}
+	return fmt.Errorf("unknown --on-duplicate %q: expected warn, refuse or takeover", mode)
+}
+
+// instanceLock is the pid file that marks a token and agent ID as taken on
+// this host.
+type instanceLock struct {
+	path string
+	// id is the instance ID written to it.
+	id string
+}
+
+// instanceLockPath is the pid file for token and agentID; it hashes the
+// token, which stays out of file names.
+func instanceLockPath(token, agentID string) string {
+	sum := sha256.Sum256([]byte(token + "\x00" + agentID))
+	return filepath.Join(os.TempDir(), "peekdb-agent-"+hex.EncodeToString(sum[:8])+".pid")
+}
+
+// lockInstance takes the pid file for token and a's agent ID, handling an
+// agent that already holds it as --on-duplicate says. name labels log
+// lines.
+func (a *Agent) lockInstance(name, token string) (*instanceLock, error) {
+	agentID := a.opts.AgentID
+	l := &instanceLock{path: instanceLockPath(token, agentID), id: a.instanceID}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d %s\n", os.Getpid(), l.id)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return l, err
+		}
+		if !errors.Is(err, os.ErrExist) || attempt > 0 {
+			return nil, err
+		}
+
+		pid, other := readInstanceLock(l.path)
+		if pid == 0 || !processAlive(pid) {
+			// Left by an agent that didn't get to clean up.
+			os.Remove(l.path)
+			continue
+		}
+		msg := fmt.Sprintf("another agent (pid %d, instance %s) is running on this host with the same token and agent ID %q", pid, other, agentID)
+		if name != "" {
+			msg = fmt.Sprintf("[%s] %s", name, msg)
+		}
+		switch a.opts.OnDuplicate {
+		case "refuse":
+			return nil, withExitCode(ExitDuplicate, errors.New(msg+"; refusing to start (--on-duplicate refuse)"))
+		case "takeover":
+			if pid == os.Getpid() {
+				// Stopping the process would stop this agent too.
+				return nil, withExitCode(ExitDuplicate, errors.New(msg+", in this process; it can't be taken over"))
+			}
+			log.Printf("%s; stopping it (--on-duplicate takeover)", msg)
+			if err := stopProcess(pid, 15*time.Second); err != nil {
+				return nil, withExitCode(ExitDuplicate, fmt.Errorf("%s, and stopping it failed: %w", msg, err))
+			}
+			os.Remove(l.path)
+		default:
+			log.Printf("⚠ %s; replies may interleave. Give each agent its own --agent-id, or use --on-duplicate refuse", msg)
+			return nil, nil
+		}
+	}
+}
+
+// Close removes the pid file. A nil lock, for a duplicate that was only
+// warned about, holds nothing.
+func (l *instanceLock) Close() error {
+	if l == nil {
+		return nil
+	}
+	// Only remove our own: an agent that took over may have replaced it.
+	if _, id := readInstanceLock(l.path); id != l.id {
+		return nil
+	}
+	return os.Remove(l.path)
+}
+
+func readInstanceLock(path string) (pid int, id string) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return 0, ""
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) != 2 {
+		return 0, ""
+	}
+	pid, _ = strconv.Atoi(fields[0])
+	return pid, fields[1]
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// stopProcess asks pid to shut down and waits up to timeout for it to.
+func stopProcess(pid int, timeout time.Duration) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if !processAlive(pid) {
+			return nil
+		}
+	}
+	return fmt.Errorf("pid %d still running after %v", pid, timeout)
+}
+
+// duplicates handles the other instances a hub's auth response listed,
+// returning an error if t should disconnect and stop.
+func (t *tenant) duplicates(dups []DuplicateAgent) error {
+	if len(dups) == 0 {
+		return nil
+	}
+	var ids []string
+	for _, d := range dups {
+		id := d.InstanceID
+		if d.Addr != "" {
+			id += " from " + d.Addr
+		}
+		ids = append(ids, id)
+	}
+	msg := fmt.Sprintf("the hub reports %d other agent(s) connected with the same token and agent ID %q: %s", len(dups), t.agent.opts.AgentID, strings.Join(ids, ", "))
+	if t.agent.opts.OnDuplicate == "refuse" {
+		return withExitCode(ExitDuplicate, errors.New(msg+"; disconnecting (--on-duplicate refuse)"))
+	}
+	// With takeover, the hub has disconnected them and doesn't list them.
+	t.logf("⚠ %s; replies may interleave. Give each agent its own --agent-id, or use --on-duplicate refuse or takeover", msg)
+	return nil
+}
+
+// replaced is the error the agent agentID stops with when another instance
+// took over from it.
+func replaced(agentID, by string) error {
+	return withExitCode(ExitDuplicate, fmt.Errorf("replaced by another agent (instance %s) with the same token and agent ID %q", by, agentID))
+}
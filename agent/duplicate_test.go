@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLockInstance(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	path := instanceLockPath("tok", "web-1")
+	// This process stands in for another agent that is still running.
+	live := fmt.Sprintf("%d other\n", os.Getpid())
+
+	tests := []struct {
+		name     string
+		mode     string
+		existing string
+		locked   bool
+		code     int
+	}{
+		{"free", "refuse", "", true, ExitOK},
+		{"stale", "refuse", "99999999 other\n", true, ExitOK},
+		{"garbled", "refuse", "not a pid file", true, ExitOK},
+		{"warn", "warn", live, false, ExitOK},
+		{"refuse", "refuse", live, false, ExitDuplicate},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(path)
+			if tc.existing != "" {
+				if err := os.WriteFile(path, []byte(tc.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a := bareAgent(DefaultOptions(), nil)
+			a.opts.AgentID, a.opts.OnDuplicate = "web-1", tc.mode
+			l, err := a.lockInstance("", "tok")
+			if ExitCode(err) != tc.code {
+				t.Fatalf("expected exit code %d, got %v (%d)", tc.code, err, ExitCode(err))
+			}
+			if (l != nil) != tc.locked {
+				t.Fatalf("expected locked %v, got %v", tc.locked, l != nil)
+			}
+			if !tc.locked {
+				if _, id := readInstanceLock(path); id != "other" {
+					t.Errorf("expected the other agent's pid file kept, got instance %q", id)
+				}
+				return
+			}
+			if pid, id := readInstanceLock(path); pid != os.Getpid() || id != a.instanceID {
+				t.Errorf("expected our pid file, got pid %d instance %q", pid, id)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected Close to remove the pid file, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInstanceLockCloseKeepsOthers(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	a := bareAgent(DefaultOptions(), nil)
+	a.opts.AgentID = "web-1"
+	l, err := a.lockInstance("", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An agent that took over wrote its own.
+	if err := os.WriteFile(l.path, []byte("1 newer\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, id := readInstanceLock(l.path); id != "newer" {
+		t.Errorf("expected the other agent's pid file kept, got instance %q", id)
+	}
+	if err := (*instanceLock)(nil).Close(); err != nil {
+		t.Errorf("expected a nil lock to close, got %v", err)
+	}
+}
+
+func TestTenantDuplicates(t *testing.T) {
+	tn := testTenant()
+	tn.name = "acme"
+	dups := []DuplicateAgent{{AgentID: tn.agent.opts.AgentID, InstanceID: "9f2c", Addr: "10.0.0.7"}}
+
+	tn.agent.opts.OnDuplicate = "warn"
+	if err := tn.duplicates(dups); err != nil {
+		t.Errorf("expected warn to carry on, got %v", err)
+	}
+	tn.agent.opts.OnDuplicate = "refuse"
+	if err := tn.duplicates(nil); err != nil {
+		t.Errorf("expected no duplicates to carry on, got %v", err)
+	}
+	err := tn.duplicates(dups)
+	if ExitCode(err) != ExitDuplicate || !strings.Contains(err.Error(), "9f2c from 10.0.0.7") {
+		t.Errorf("expected refuse to stop with the duplicate named, got %v (%d)", err, ExitCode(err))
+	}
+}
+
+func TestRunReplaced(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer search.Close()
+	dh := newDevHub("dev")
+	hub := httptest.NewServer(dh.handler())
+	defer hub.Close()
+	hubURL := "ws" + strings.TrimPrefix(hub.URL, "http") + "/agent"
+
+	opts := DefaultOptions()
+	opts.Token = "dev"
+	opts.HubURL = hubURL
+	opts.DatabaseURL = "elasticsearch://" + strings.TrimPrefix(search.URL, "http://") + "?tls=false"
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		dh.mu.Lock()
+		connected := dh.agent != nil
+		dh.mu.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the agent never connected")
+		}
+	}
+
+	// A second agent with the same token, elsewhere, takes over.
+	conn, _, err := websocket.DefaultDialer.Dial(hubURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(Message{Type: "auth", Token: "dev", AgentID: opts.AgentID, InstanceID: "newer", Takeover: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if ExitCode(err) != ExitDuplicate || !strings.Contains(err.Error(), "replaced by another agent (instance newer)") {
+			t.Errorf("expected the agent to stop as replaced, got %v (%d)", err, ExitCode(err))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replaced agent kept running")
+	}
+}
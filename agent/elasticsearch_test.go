@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSearchClient(t *testing.T, opensearch bool, handler http.HandlerFunc) *searchClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &searchClient{baseURL: server.URL, opensearch: opensearch, http: server.Client(), user: "elastic", password: "pw"}
+}
+
+func TestSearchClientSQL(t *testing.T) {
+	tests := []struct {
+		name       string
+		opensearch bool
+		path       string
+		response   string
+	}{
+		{
+			name:     "elasticsearch",
+			path:     "/_sql",
+			response: `{"columns":[{"name":"host","type":"keyword"},{"name":"hits","type":"long"}],"rows":[["web-1",12],["web-2",3.5]],"cursor":"abc"}`,
+		},
+		{
+			name:       "opensearch",
+			opensearch: true,
+			path:       "/_plugins/_sql",
+			response:   `{"schema":[{"name":"host","type":"keyword"},{"name":"count(*)","alias":"hits","type":"long"}],"datarows":[["web-1",12],["web-2",3.5]],"cursor":"abc"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestSearchClient(t, tc.opensearch, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tc.path {
+					t.Errorf("unexpected path %s", r.URL.Path)
+				}
+				if user, pw, _ := r.BasicAuth(); user != "elastic" || pw != "pw" {
+					t.Errorf("missing basic auth")
+				}
+				var body map[string]any
+				json.NewDecoder(r.Body).Decode(&body)
+				if body["query"] != "SELECT host, count(*) hits FROM logs WHERE level = ? GROUP BY host" || body["fetch_size"] != float64(2) {
+					t.Errorf("unexpected body: %v", body)
+				}
+				io.WriteString(w, tc.response)
+			})
+
+			resp := c.sqlQuery(context.Background(), "e1", "SELECT host, count(*) hits FROM logs WHERE level = ? GROUP BY host", []any{"error"}, 2, "")
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if strings.Join(resp.Columns, ",") != "host,hits" {
+				t.Errorf("unexpected columns: %v", resp.Columns)
+			}
+			if len(resp.Rows) != 2 || resp.Rows[0][1] != int64(12) || resp.Rows[1][1] != 3.5 {
+				t.Errorf("unexpected rows: %v", resp.Rows)
+			}
+			if resp.Cursor != "abc" {
+				t.Errorf("expected cursor abc, got %q", resp.Cursor)
+			}
+		})
+	}
+}
+
+func TestSearchClientSQLCursorAndError(t *testing.T) {
+	c := newTestSearchClient(t, false, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["cursor"] == "abc" {
+			if _, ok := body["query"]; ok {
+				t.Errorf("cursor continuation must not resend the query")
+			}
+			io.WriteString(w, `{"rows":[["web-3",1]]}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"type":"verification_exception","reason":"Unknown index [nope]"},"status":400}`)
+	})
+
+	resp := c.sqlQuery(context.Background(), "e2", "", nil, 0, "abc")
+	if resp.Error != "" || len(resp.Rows) != 1 || resp.Cursor != "" {
+		t.Errorf("unexpected continuation result: %+v", resp)
+	}
+
+	resp = c.sqlQuery(context.Background(), "e3", "SELECT * FROM nope", nil, 0, "")
+	if resp.Error != "Unknown index [nope]" {
+		t.Errorf("expected reason from error body, got %q", resp.Error)
+	}
+}
+
+func TestSearchClientDSL(t *testing.T) {
+	c := newTestSearchClient(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs-2025/_search" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		io.WriteString(w, `{"hits":{"hits":[
+			{"_index":"logs-2025","_id":"1","_source":{"msg":"boot","host":{"name":"web-1","ip":"10.0.0.1"}}},
+			{"_index":"logs-2025","_id":"2","_source":{"msg":"down","status":503}}
+		]}}`)
+	})
+
+	resp := c.search(context.Background(), "e4", "logs-2025", json.RawMessage(`{"query":{"match_all":{}}}`))
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	expectedCols := "_index,_id,host.ip,host.name,msg,status"
+	if strings.Join(resp.Columns, ",") != expectedCols {
+		t.Errorf("columns = %v, want %s", resp.Columns, expectedCols)
+	}
+	if resp.Rows[0][3] != "web-1" || resp.Rows[0][5] != nil || resp.Rows[1][5] != int64(503) {
+		t.Errorf("unexpected rows: %v", resp.Rows)
+	}
+}
+
+func TestSearchClientIntrospect(t *testing.T) {
+	c := newTestSearchClient(t, false, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{
+			".kibana": {"mappings": {"properties": {"x": {"type": "text"}}}},
+			"logs": {"mappings": {"properties": {
+				"msg": {"type": "text"},
+				"host": {"properties": {"name": {"type": "keyword"}}}
+			}}}
+		}`)
+	})
+
+	tables, err := c.introspect(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tables) != 1 || tables[0].Name != "logs" || tables[0].Kind != "index" {
+		t.Fatalf("expected only the logs index, got %+v", tables)
+	}
+	cols := tables[0].Columns
+	if len(cols) != 2 || cols[0].Name != "host.name" || cols[0].Type != "keyword" || cols[1].Name != "msg" {
+		t.Errorf("unexpected columns: %+v", cols)
+	}
+}
+
+func TestSearchClientCancel(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	c := newTestSearchClient(t, false, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	})
+	t.Cleanup(func() { close(release) })
+	tn := testTenant(&connection{Name: "logs", Connector: c})
+
+	done := make(chan QueryResponse, 1)
+	go func() {
+		done <- tn.agent.execute(tn.conns[0], Message{ID: "q1", SQL: "SELECT * FROM logs", tenant: tn})
+	}()
+	<-received
+	if resp := cancelQuery(Message{ID: "k1", QueryID: "q1", tenant: tn}); resp.Error != "" {
+		t.Fatalf("unexpected cancel error: %s", resp.Error)
+	}
+
+	select {
+	case resp := <-done:
+		if resp.ErrorCode != codeCanceled {
+			t.Errorf("expected %s, got %+v", codeCanceled, resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not return after being cancelled")
+	}
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gocql/gocql"
+	"github.com/lib/pq"
+	"github.com/sijms/go-ora/v2/network"
+)
+
+// ErrorDetail carries the structured fields of a Postgres error alongside
+// the plain message, so the UI can show the hint and highlight the token at
+// Position.
+type ErrorDetail struct {
+	// Code is the five-character SQLSTATE, e.g. "42P01".
+	Code     string `json:"code"`
+	Severity string `json:"severity,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	// Position is the 1-based character (not byte) offset of the error in
+	// the query text, or 0 when the server gave none.
+	Position   int    `json:"position,omitempty"`
+	Where      string `json:"where,omitempty"`
+	Schema     string `json:"schema,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Column     string `json:"column,omitempty"`
+	DataType   string `json:"data_type,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+// errorDetail extracts the structured fields from a Postgres or CockroachDB
+// error, or returns nil for any other error.
+func errorDetail(err error) *ErrorDetail {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return nil
+	}
+	position, _ := strconv.Atoi(pqErr.Position)
+	return &ErrorDetail{
+		Code:       string(pqErr.Code),
+		Severity:   pqErr.Severity,
+		Detail:     pqErr.Detail,
+		Hint:       pqErr.Hint,
+		Position:   position,
+		Where:      pqErr.Where,
+		Schema:     pqErr.Schema,
+		Table:      pqErr.Table,
+		Column:     pqErr.Column,
+		DataType:   pqErr.DataTypeName,
+		Constraint: pqErr.Constraint,
+	}
+}
+
+// Error codes are the agent's own taxonomy, sent as error_code next to the
+// driver's message so the hub can react to failures without knowing each
+// database's error format.
+const (
+	codeAuthFailed         = "auth_failed"
+	codeSyntaxError        = "syntax_error"
+	codePermissionDenied   = "permission_denied"
+	codeTimeout            = "timeout"
+	codeCanceled           = "canceled"
+	codeConnectionLost     = "connection_lost"
+	codePolicyDenied       = "policy_denied"
+	codeTooLarge           = "too_large"
+	codeResourcesExhausted = "resources_exhausted"
+	codeNotSupported       = "not_supported"
+	codeInvalidRequest     = "invalid_request"
+	codeTooExpensive       = "query_too_expensive"
+	codeStandby            = "standby"
+	codeMaintenance        = "maintenance"
+	codeInternal           = "internal_error"
+	codeQueryFailed        = "query_failed"
+)
+
+// codedError is an error whose code is already known, either because the
+// agent raised it or because a connector translated it.
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string { return e.msg }
+
+func codedErrorf(code, format string, args ...any) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// httpError is a non-200 reply from an HTTP-based database API.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+// errorCode maps err onto the agent's error taxonomy. Errors it can't place
+// are codeQueryFailed.
+func errorCode(err error) string {
+	var coded *codedError
+	var pqErr *pq.Error
+	var oraErr *network.OracleError
+	var cqlErr gocql.RequestError
+	var httpErr *httpError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &coded):
+		return coded.code
+	case errors.As(err, &pqErr):
+		return pqErrorCode(pqErr)
+	case errors.As(err, &oraErr):
+		return oracleErrorCode(oraErr.ErrCode)
+	case errors.As(err, &cqlErr):
+		return cassandraErrorCode(cqlErr.Code())
+	case errors.As(err, &httpErr):
+		return httpErrorCode(httpErr.status)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, gocql.ErrTimeoutNoResponse):
+		return codeTimeout
+	case errors.Is(err, context.Canceled):
+		return codeCanceled
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return codeTimeout
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, gocql.ErrNoConnections):
+		return codeConnectionLost
+	}
+	return codeQueryFailed
+}
+
+func pqErrorCode(e *pq.Error) string {
+	switch code := string(e.Code); {
+	case code == "42501":
+		return codePermissionDenied
+	case code == "57014":
+		if strings.Contains(e.Message, "timeout") {
+			return codeTimeout
+		}
+		return codeCanceled
+	case code == "25006":
+		// read_only_sql_transaction
+		return codePermissionDenied
+	case strings.HasPrefix(code, "28"):
+		return codeAuthFailed
+	case strings.HasPrefix(code, "42"):
+		return codeSyntaxError
+	case strings.HasPrefix(code, "08"), strings.HasPrefix(code, "57P"):
+		return codeConnectionLost
+	case strings.HasPrefix(code, "53"):
+		return codeResourcesExhausted
+	case strings.HasPrefix(code, "54"):
+		return codeTooLarge
+	}
+	return codeQueryFailed
+}
+
+func oracleErrorCode(code int) string {
+	switch {
+	case code == 1017 || code == 28000 || code == 28001:
+		return codeAuthFailed
+	case code == 1031 || code == 1045:
+		return codePermissionDenied
+	case code == 1013:
+		return codeCanceled
+	case code == 12170 || code == 3136:
+		return codeTimeout
+	case code == 3113 || code == 3114 || code == 3135 || code == 12541 || code == 12514:
+		return codeConnectionLost
+	case code == 4030 || code == 4031 || code == 1652:
+		return codeResourcesExhausted
+	case code >= 900 && code < 1000:
+		return codeSyntaxError
+	}
+	return codeQueryFailed
+}
+
+func cassandraErrorCode(code int) string {
+	switch code {
+	case gocql.ErrCodeCredentials:
+		return codeAuthFailed
+	case gocql.ErrCodeUnauthorized:
+		return codePermissionDenied
+	case gocql.ErrCodeSyntax, gocql.ErrCodeInvalid:
+		return codeSyntaxError
+	case gocql.ErrCodeReadTimeout, gocql.ErrCodeWriteTimeout:
+		return codeTimeout
+	case gocql.ErrCodeUnavailable, gocql.ErrCodeOverloaded, gocql.ErrCodeBootstrapping:
+		return codeConnectionLost
+	}
+	return codeQueryFailed
+}
+
+func httpErrorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return codeAuthFailed
+	case http.StatusForbidden:
+		return codePermissionDenied
+	case http.StatusBadRequest:
+		return codeSyntaxError
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return codeTimeout
+	case http.StatusRequestEntityTooLarge:
+		return codeTooLarge
+	case http.StatusTooManyRequests:
+		return codeResourcesExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codeConnectionLost
+	}
+	return codeQueryFailed
+}
+
+// queryError builds the error result for a failed query.
+func queryError(id string, err error) QueryResponse {
+	return QueryResponse{ID: id, Type: "result", Error: err.Error(), ErrorCode: errorCode(err), ErrorDetail: errorDetail(err)}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/sijms/go-ora/v2/network"
+)
+
+func TestErrorDetail(t *testing.T) {
+	if d := errorDetail(errors.New("connection reset")); d != nil {
+		t.Errorf("expected nil for a non-Postgres error, got %+v", d)
+	}
+
+	d := errorDetail(&pq.Error{
+		Code:       "23505",
+		Severity:   "ERROR",
+		Message:    `duplicate key value violates unique constraint "users_email_key"`,
+		Detail:     "Key (email)=(a@example.com) already exists.",
+		Schema:     "public",
+		Table:      "users",
+		Constraint: "users_email_key",
+	})
+	want := ErrorDetail{
+		Code:       "23505",
+		Severity:   "ERROR",
+		Detail:     "Key (email)=(a@example.com) already exists.",
+		Schema:     "public",
+		Table:      "users",
+		Constraint: "users_email_key",
+	}
+	if d == nil || *d != want {
+		t.Errorf("expected %+v, got %+v", want, d)
+	}
+}
+
+func TestExecuteQueryErrorDetail(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	c := &sqlConnector{db: mockDB, flavor: "postgres"}
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT nme FROM users").WillReturnError(&pq.Error{
+		Code:     "42703",
+		Severity: "ERROR",
+		Message:  `column "nme" does not exist`,
+		Hint:     `Perhaps you meant to reference the column "users.name".`,
+		Position: "8",
+	})
+
+	resp := c.executeQuery(context.Background(), "e1", "SELECT nme FROM users", nil)
+	if resp.ErrorDetail == nil {
+		t.Fatal("expected error_detail")
+	}
+	if resp.ErrorDetail.Code != "42703" || resp.ErrorDetail.Position != 8 || resp.ErrorDetail.Hint == "" {
+		t.Errorf("unexpected error detail: %+v", resp.ErrorDetail)
+	}
+	if resp.ErrorCode != codeSyntaxError {
+		t.Errorf("expected error_code %s, got %q", codeSyntaxError, resp.ErrorCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"postgres syntax", &pq.Error{Code: "42601"}, codeSyntaxError},
+		{"postgres undefined table", &pq.Error{Code: "42P01"}, codeSyntaxError},
+		{"postgres permission", &pq.Error{Code: "42501"}, codePermissionDenied},
+		{"postgres auth", &pq.Error{Code: "28P01"}, codeAuthFailed},
+		{"postgres statement timeout", &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}, codeTimeout},
+		{"postgres cancel", &pq.Error{Code: "57014", Message: "canceling statement due to user request"}, codeCanceled},
+		{"postgres admin shutdown", &pq.Error{Code: "57P01"}, codeConnectionLost},
+		{"postgres out of memory", &pq.Error{Code: "53200"}, codeResourcesExhausted},
+		{"postgres unique violation", &pq.Error{Code: "23505"}, codeQueryFailed},
+		{"oracle auth", &network.OracleError{ErrCode: 1017}, codeAuthFailed},
+		{"oracle invalid identifier", &network.OracleError{ErrCode: 904}, codeSyntaxError},
+		{"oracle end of file", &network.OracleError{ErrCode: 3113}, codeConnectionLost},
+		{"http forbidden", &httpError{status: 403, msg: "Access Denied"}, codePermissionDenied},
+		{"http bad request", &httpError{status: 400, msg: "parsing_exception"}, codeSyntaxError},
+		{"context deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), codeTimeout},
+		{"context canceled", context.Canceled, codeCanceled},
+		{"bad connection", driver.ErrBadConn, codeConnectionLost},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, codeConnectionLost},
+		{"agent policy", codedErrorf(codePolicyDenied, "not allowed"), codePolicyDenied},
+		{"duckdb parser", &codedError{code: duckErrorCode("Parser Error: syntax error at or near \"SELEC\""), msg: ""}, codeSyntaxError},
+		{"unknown", errors.New("something odd"), codeQueryFailed},
+		{"nil", nil, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := errorCode(tc.err); got != tc.want {
+				t.Errorf("errorCode = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
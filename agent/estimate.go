@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"database/sql"
+	"log"
+	"math"
+)
+
+// CountEstimate answers an "estimate_count" message with the planner's
+// idea of how many rows a table has or a query returns, which costs a
+// catalog lookup or an EXPLAIN instead of a COUNT(*).
+type CountEstimate struct {
+	ID   string  `json:"id"`
+	Type string  `json:"type"`
+	Rows float64 `json:"rows"`
+	// Source is "reltuples" when the count came from the table's
+	// statistics, scaled to its current size, "partitions" when it is the
+	// sum of a partitioned table's partitions counted that way, and
+	// "explain" when it came from the plan.
+	Source string `json:"source,omitempty"`
+	Schema string `json:"schema,omitempty"`
+	Table  string `json:"table,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Partitions are the counts of a partitioned table's partitions that
+	// hold rows, those not partitioned themselves.
+	Partitions []Partition `json:"partitions,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// tableSizeQuery reads what the planner itself uses to estimate a table's
+// rows: the rows and pages at the last ANALYZE, and the pages now.
+const tableSizeQuery = `
+SELECT n.nspname, c.relname, c.relkind::text, c.reltuples::float8, c.relpages::float8,
+       (pg_relation_size(c.oid) / current_setting('block_size')::int)::float8
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.oid = $1::regclass`
+
+// partitionSizesQuery is tableSizeQuery for each leaf partition of a
+// partitioned table.
+const partitionSizesQuery = `
+SELECT n.nspname, c.relname, pg_get_expr(c.relpartbound, c.oid), pg_total_relation_size(c.oid),
+       c.reltuples::float8, c.relpages::float8,
+       (pg_relation_size(c.oid) / current_setting('block_size')::int)::float8
+FROM pg_partition_tree($1::regclass) t
+JOIN pg_class c ON c.oid = t.relid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE t.isleaf
+ORDER BY n.nspname, c.relname`
+
+// estimateCount answers an "estimate_count" message for the table
+// msg.Identifier names, written as in a statement, or the query in
+// msg.SQL.
+func estimateCount(msg Message) CountEstimate {
+	resp := CountEstimate{ID: msg.ID, Type: "count_estimate"}
+	fail := func(err error) CountEstimate {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return fail(codedErrorf(codeNotSupported, "estimate_count is not supported for %s", c.Flavor()))
+	}
+	if (msg.Identifier == "") == (msg.SQL == "") {
+		return fail(codedErrorf(codeInvalidRequest, "estimate_count needs either an identifier or sql"))
+	}
+	caps := msg.capabilities()
+
+	q := msg.SQL
+	if msg.Identifier != "" {
+		parts, err := identifierParts(msg.Identifier)
+		if err != nil {
+			return fail(err)
+		}
+		if len(parts) > 2 {
+			return fail(codedErrorf(codeInvalidRequest, "%q is not a table: expected table or schema.table", msg.Identifier))
+		}
+		d := dialectFor(sc.flavor)
+		table := d.qualifiedSQL(parts)
+		var kind string
+		var tuples, pages, current float64
+		if err := sc.db.QueryRowContext(msg.context(), tableSizeQuery, table).Scan(&resp.Schema, &resp.Table, &kind, &tuples, &pages, &current); err != nil {
+			return fail(err)
+		}
+		if !caps.schemaAllowed(resp.Schema) {
+			return fail(codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", resp.Schema))
+		}
+		// Like the planner, scale the density at the last ANALYZE to the
+		// table's size now. A partitioned table has no pages of its own,
+		// so its partitions are counted instead; a table never analyzed,
+		// or one with a partition never analyzed, is left to EXPLAIN.
+		if rows, ok := scaledRows(tuples, pages, current); ok {
+			resp.Rows, resp.Source = rows, "reltuples"
+			return resp
+		}
+		if kind == "p" {
+			parts, ok, err := partitionCounts(msg, sc, table)
+			if err != nil {
+				return fail(err)
+			}
+			if ok {
+				resp.Partitions, resp.Source = parts, "partitions"
+				for _, p := range parts {
+					resp.Rows += p.Rows
+				}
+				return resp
+			}
+		}
+		q = "SELECT * FROM " + d.quoted(resp.Schema) + "." + d.quoted(resp.Table)
+	} else {
+		if kind, _ := classifyStatements(q); !readStatements[kind] || !explainable[kind] {
+			return fail(codedErrorf(codeInvalidRequest, "only SELECT statements can be estimated"))
+		}
+		if err := caps.checkStatement(q); err != nil {
+			return fail(err)
+		}
+	}
+
+	est, err := sc.estimatePlan(msg.context(), q, msg.Params)
+	if err != nil {
+		log.Printf("[estimate:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	resp.Rows, resp.Source = est.PlanRows, "explain"
+	return resp
+}
+
+// scaledRows is the rows at the last ANALYZE scaled to the pages now, and
+// false for a table that has not been analyzed.
+func scaledRows(tuples, pages, current float64) (float64, bool) {
+	if tuples < 0 || pages <= 0 {
+		return 0, false
+	}
+	return math.Round(tuples / pages * current), true
+}
+
+// partitionCounts counts the rows of each leaf partition of table. It
+// returns false when one of them has not been analyzed, or is in a schema
+// the token may not see, and the count is left to EXPLAIN.
+func partitionCounts(msg Message, sc *sqlConnector, table string) ([]Partition, bool, error) {
+	rows, err := sc.db.QueryContext(msg.context(), partitionSizesQuery, table)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	caps := msg.capabilities()
+	var parts []Partition
+	complete := true
+	for rows.Next() {
+		var p Partition
+		var bound sql.NullString
+		var tuples, pages, current float64
+		if err := rows.Scan(&p.Schema, &p.Name, &bound, &p.SizeBytes, &tuples, &pages, &current); err != nil {
+			return nil, false, err
+		}
+		p.Bound = bound.String
+		var ok bool
+		if p.Rows, ok = scaledRows(tuples, pages, current); !ok {
+			// An empty partition has no pages to scale, and is empty.
+			ok = current == 0
+		}
+		complete = complete && ok && caps.schemaAllowed(p.Schema)
+		parts = append(parts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return parts, complete && len(parts) > 0, nil
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEstimateCount(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public"}})
+	sizes := []string{"nspname", "relname", "relkind", "reltuples", "relpages", "pages"}
+	partitions := []string{"nspname", "relname", "bound", "size", "reltuples", "relpages", "pages"}
+	plan := func(rows string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"QUERY PLAN"}).AddRow([]byte(`[{"Plan": {"Total Cost": 10, "Plan Rows": ` + rows + `}}]`))
+	}
+
+	tests := []struct {
+		name     string
+		msg      Message
+		size     *sqlmock.Rows
+		parts    *sqlmock.Rows
+		explain  string
+		plan     *sqlmock.Rows
+		rows     float64
+		source   string
+		wantCode string
+	}{
+		{
+			name:   "grown since analyzed",
+			msg:    Message{ID: "e1", Identifier: "events"},
+			size:   sqlmock.NewRows(sizes).AddRow("public", "events", "r", 4000000.0, 1000.0, 1050.0),
+			rows:   4200000,
+			source: "reltuples",
+		},
+		{
+			name:    "never analyzed",
+			msg:     Message{ID: "e2", Identifier: `"Audit Log"`},
+			size:    sqlmock.NewRows(sizes).AddRow("public", "Audit Log", "r", -1.0, 0.0, 12.0),
+			explain: `EXPLAIN (FORMAT JSON) SELECT * FROM "public"."Audit Log"`,
+			plan:    plan("1530"),
+			rows:    1530,
+			source:  "explain",
+		},
+		{
+			name: "partitioned",
+			msg:  Message{ID: "e8", Identifier: "measurements"},
+			size: sqlmock.NewRows(sizes).AddRow("public", "measurements", "p", -1.0, 0.0, 0.0),
+			parts: sqlmock.NewRows(partitions).
+				AddRow("public", "measurements_2025", "FOR VALUES FROM ('2025-01-01') TO ('2026-01-01')", 8192000, 1000.0, 100.0, 110.0).
+				AddRow("public", "measurements_2026", "FOR VALUES FROM ('2026-01-01') TO ('2027-01-01')", 0, -1.0, 0.0, 0.0),
+			rows:   1100,
+			source: "partitions",
+		},
+		{
+			name: "partition never analyzed",
+			msg:  Message{ID: "e9", Identifier: "measurements"},
+			size: sqlmock.NewRows(sizes).AddRow("public", "measurements", "p", -1.0, 0.0, 0.0),
+			parts: sqlmock.NewRows(partitions).
+				AddRow("public", "measurements_2025", "FOR VALUES FROM ('2025-01-01') TO ('2026-01-01')", 8192000, 1000.0, 100.0, 110.0).
+				AddRow("public", "measurements_2026", "FOR VALUES FROM ('2026-01-01') TO ('2027-01-01')", 81920, -1.0, 0.0, 10.0),
+			explain: `EXPLAIN (FORMAT JSON) SELECT * FROM "public"."measurements"`,
+			plan:    plan("1200"),
+			rows:    1200,
+			source:  "explain",
+		},
+		{
+			name:    "query",
+			msg:     Message{ID: "e3", SQL: "SELECT * FROM events WHERE kind = $1", Params: []any{"click"}},
+			explain: "EXPLAIN (FORMAT JSON) SELECT * FROM events WHERE kind = $1",
+			plan:    plan("250000"),
+			rows:    250000,
+			source:  "explain",
+		},
+		{
+			name:     "write",
+			msg:      Message{ID: "e4", SQL: "DELETE FROM events"},
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "query in another schema",
+			msg:      Message{ID: "e5", SQL: "SELECT * FROM hr.salaries"},
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "table in another schema",
+			msg:      Message{ID: "e6", Identifier: "hr.salaries"},
+			size:     sqlmock.NewRows(sizes).AddRow("hr", "salaries", "r", 10.0, 1.0, 1.0),
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "neither",
+			msg:      Message{ID: "e7"},
+			wantCode: codeInvalidRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.size != nil {
+				mock.ExpectQuery("FROM pg_class").WillReturnRows(tc.size)
+			}
+			if tc.parts != nil {
+				mock.ExpectQuery("pg_partition_tree").WillReturnRows(tc.parts)
+			}
+			if tc.plan != nil {
+				mock.ExpectQuery(regexp.QuoteMeta(tc.explain)).WillReturnRows(tc.plan)
+			}
+			resp := estimateCount(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			if tc.wantCode != "" {
+				if resp.ErrorCode != tc.wantCode {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+				return
+			}
+			if resp.Error != "" || resp.Rows != tc.rows || resp.Source != tc.source {
+				t.Errorf("expected %v rows from %s, got %+v", tc.rows, tc.source, resp)
+			}
+			if (tc.source == "partitions") != (len(resp.Partitions) > 0) {
+				t.Errorf("unexpected partitions: %+v", resp.Partitions)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package agent
+
+import "errors"
+
+// Exit codes of the peekdb-agent command, so that restart policies and
+// alerts can tell failures apart. 2 is a usage error, as with the flag
+// package.
+const (
+	ExitOK    = 0
+	ExitError = 1
+	// ExitConfig: the flags or the config file are invalid.
+	ExitConfig = 3
+	// ExitDatabase: a database could not be connected to at startup.
+	ExitDatabase = 4
+	// ExitAuth: the hub rejected the token.
+	ExitAuth = 5
+	// ExitHub: the hub could not be reached, or the connection to it was
+	// lost, and --fail-fast or --max-reconnects said not to keep trying.
+	ExitHub = 6
+	// ExitDuplicate: another agent runs with the same token and agent ID,
+	// and --on-duplicate refuse stopped this one, or one that took over
+	// replaced it.
+	ExitDuplicate = 7
+)
+
+// exitError gives err an exit code without changing its message.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// ExitCode returns the exit code for an error from New or Run: ExitOK for
+// nil, and ExitError for errors that have no code of their own.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return ExitError
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{errors.New("boom"), ExitError},
+		{withExitCode(ExitDatabase, errors.New("connection refused")), ExitDatabase},
+		{fmt.Errorf("hub: %w", withExitCode(ExitAuth, errors.New("authentication failed: bad token"))), ExitAuth},
+	}
+	for _, tc := range tests {
+		if got := ExitCode(tc.err); got != tc.want {
+			t.Errorf("ExitCode(%v): expected %d, got %d", tc.err, tc.want, got)
+		}
+	}
+	if err := withExitCode(ExitHub, errors.New("dial failed")); err.Error() != "dial failed" {
+		t.Errorf("expected the message unchanged, got %q", err)
+	}
+
+	_, err := New(Options{})
+	if ExitCode(err) != ExitConfig {
+		t.Errorf("expected New's errors to be ExitConfig, got %d for %v", ExitCode(err), err)
+	}
+}
+
+func TestServeGivesUp(t *testing.T) {
+	// Nothing listens here.
+	tn := testTenant()
+	tn.name, tn.hub = "acme", "ws://127.0.0.1:1/agent"
+
+	tests := []struct {
+		name          string
+		failFast      bool
+		maxReconnects int
+		err           string
+	}{
+		{"fail fast", true, 0, `hub for "acme": dial failed`},
+		{"max reconnects", false, 1, `hub for "acme": gave up after 2 attempts: dial failed`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tn.agent.opts.FailFast, tn.agent.opts.MaxReconnects = tc.failFast, tc.maxReconnects
+			done := make(chan error, 1)
+			go func() { done <- serve(context.Background(), tn) }()
+			select {
+			case err := <-done:
+				if ExitCode(err) != ExitHub || !strings.HasPrefix(err.Error(), tc.err) {
+					t.Errorf("expected %q with ExitHub, got %v (%d)", tc.err, err, ExitCode(err))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("serve kept retrying")
+			}
+		})
+	}
+}
+
+func TestRunFailsFastOnAuth(t *testing.T) {
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer search.Close()
+	hub := httptest.NewServer(newDevHub("dev").handler())
+	defer hub.Close()
+
+	opts := DefaultOptions()
+	opts.Token = "revoked"
+	opts.HubURL = "ws" + strings.TrimPrefix(hub.URL, "http") + "/agent"
+	opts.DatabaseURL = "elasticsearch://" + strings.TrimPrefix(search.URL, "http://") + "?tls=false"
+	opts.FailFast = true
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if ExitCode(err) != ExitAuth || !strings.Contains(err.Error(), "authentication failed") {
+			t.Errorf("expected an authentication failure, got %v (%d)", err, ExitCode(err))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept retrying a rejected token with --fail-fast")
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const explainTimeout = 10 * time.Second
+
+// planRelated reports whether err is one a query plan helps explain: out of
+// memory, disk full (usually temp files from a sort or hash) or a statement
+// timeout. Cancellations the user asked for are not.
+func planRelated(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "53200", "53100":
+		return true
+	case "57014":
+		return strings.Contains(pqErr.Message, "statement timeout")
+	}
+	return false
+}
+
+// explainFailure returns the EXPLAIN output for a query that failed with a
+// plan-related error, or "" when there is nothing to add. With the
+// explain_on_error setting the plan goes in the error response, to help
+// users see why the query was too expensive.
+func (c *sqlConnector) explainFailure(id, sqlQuery string, params []any, err error) string {
+	if !c.owner().currentExplainOnError() || c.flavor == "oracle" || !planRelated(err) {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+	rows, err := c.db.QueryContext(ctx, "EXPLAIN "+sqlQuery, params...)
+	if err != nil {
+		log.Printf("[query:%s] EXPLAIN failed: %v", id, err)
+		return ""
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			log.Printf("[query:%s] EXPLAIN failed: %v", id, err)
+			return ""
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[query:%s] EXPLAIN failed: %v", id, err)
+		return ""
+	}
+	return strings.Join(lines, "\n")
+}
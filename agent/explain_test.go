@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestPlanRelated(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"out of memory", &pq.Error{Code: "53200", Message: "out of memory"}, true},
+		{"disk full", &pq.Error{Code: "53100", Message: "could not write to file"}, true},
+		{"statement timeout", &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}, true},
+		{"user cancel", &pq.Error{Code: "57014", Message: "canceling statement due to user request"}, false},
+		{"syntax error", &pq.Error{Code: "42601", Message: "syntax error"}, false},
+		{"not a pq error", errors.New("connection reset"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := planRelated(tc.err); got != tc.want {
+				t.Errorf("planRelated = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExplainOnError(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	a := bareAgent(DefaultOptions(), nil)
+	a.settings.explainOnError = true
+	c := &sqlConnector{db: mockDB, flavor: "postgres", agent: a}
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT \\* FROM big ORDER BY x").
+		WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	mock.ExpectQuery("EXPLAIN SELECT \\* FROM big ORDER BY x").
+		WillReturnRows(sqlmock.NewRows([]string{"QUERY PLAN"}).
+			AddRow("Sort  (cost=1.00..2.00 rows=1000000 width=8)").
+			AddRow("  ->  Seq Scan on big  (cost=0.00..1.00 rows=1000000 width=8)"))
+
+	resp := c.executeQuery(context.Background(), "e1", "SELECT * FROM big ORDER BY x", nil)
+	if resp.Error == "" {
+		t.Fatal("expected an error")
+	}
+	want := "Sort  (cost=1.00..2.00 rows=1000000 width=8)\n  ->  Seq Scan on big  (cost=0.00..1.00 rows=1000000 width=8)"
+	if resp.Explain != want {
+		t.Errorf("expected plan %q, got %q", want, resp.Explain)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// fairScheduler admits queued queries by weighted round robin over the
+// users who sent them, rather than in arrival order, so one user's burst
+// of queries waits behind itself and not in front of everyone else. A
+// user whose weight is n gets up to n queries admitted per turn. Queries
+// without a user share one queue. An agent has one when
+// --max-concurrent-queries caps the queries running at once; a nil
+// fairScheduler admits them all at once.
+type fairScheduler struct {
+	limit   int
+	weights map[string]int
+
+	mu      sync.Mutex
+	running int
+	waiting map[string][]chan struct{}
+	// ring is the users with queries waiting, in turn order; next is
+	// whose turn it is and turns how many it has had so far.
+	ring  []string
+	next  int
+	turns int
+}
+
+func newFairScheduler(limit int, weights map[string]int) *fairScheduler {
+	if limit <= 0 {
+		return nil
+	}
+	return &fairScheduler{limit: limit, weights: weights, waiting: map[string][]chan struct{}{}}
+}
+
+func checkUserWeights(weights map[string]int) error {
+	for user, w := range weights {
+		if w < 1 {
+			return fmt.Errorf("user_weights: %q has weight %d; weights start at 1", user, w)
+		}
+	}
+	return nil
+}
+
+// acquire waits for a slot for one of user's queries, returning the func
+// that gives it back, or ctx's error if ctx ends first.
+func (s *fairScheduler) acquire(ctx context.Context, user string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	if s.running < s.limit && len(s.ring) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	ready := make(chan struct{})
+	if len(s.waiting[user]) == 0 {
+		s.ring = append(s.ring, user)
+	}
+	s.waiting[user] = append(s.waiting[user], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ready:
+		// Admitted as ctx ended: pass the slot on.
+		s.running--
+		s.admit()
+	default:
+		s.drop(user, ready)
+	}
+	return nil, ctx.Err()
+}
+
+func (s *fairScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.admit()
+}
+
+// admit starts waiting queries while there are free slots. Callers hold
+// s.mu.
+func (s *fairScheduler) admit() {
+	for s.running < s.limit && len(s.ring) > 0 {
+		user := s.ring[s.next]
+		q := s.waiting[user]
+		close(q[0])
+		s.running++
+		s.turns++
+		if len(q) == 1 {
+			delete(s.waiting, user)
+			s.removeFromRing(s.next)
+			continue
+		}
+		s.waiting[user] = q[1:]
+		if s.turns >= max(s.weights[user], 1) {
+			s.turns = 0
+			s.next = (s.next + 1) % len(s.ring)
+		}
+	}
+}
+
+// drop takes ready, whose query gave up, out of user's queue. Callers hold
+// s.mu.
+func (s *fairScheduler) drop(user string, ready chan struct{}) {
+	q := s.waiting[user]
+	for i, c := range q {
+		if c == ready {
+			q = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(q) > 0 {
+		s.waiting[user] = q
+		return
+	}
+	delete(s.waiting, user)
+	for i, u := range s.ring {
+		if u == user {
+			s.removeFromRing(i)
+			break
+		}
+	}
+}
+
+// removeFromRing removes the user at i, keeping next on the user whose
+// turn comes next. Callers hold s.mu.
+func (s *fairScheduler) removeFromRing(i int) {
+	s.ring = append(s.ring[:i], s.ring[i+1:]...)
+	if i < s.next {
+		s.next--
+	} else if i == s.next {
+		s.turns = 0
+	}
+	if s.next >= len(s.ring) {
+		s.next = 0
+	}
+}
+
+// counts returns the number of queries holding a slot and the number
+// waiting for one.
+func (s *fairScheduler) counts() (running, queued int) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.waiting {
+		queued += len(q)
+	}
+	return s.running, queued
+}
+
+func (s *fairScheduler) writeMetrics(w io.Writer) {
+	if s == nil {
+		return
+	}
+	running, queued := s.counts()
+	fmt.Fprintln(w, "# HELP peekdb_queries_running Queries holding one of --max-concurrent-queries' slots.")
+	fmt.Fprintln(w, "# TYPE peekdb_queries_running gauge")
+	fmt.Fprintf(w, "peekdb_queries_running %d\n", running)
+	fmt.Fprintln(w, "# HELP peekdb_queries_queued Queries waiting for a slot.")
+	fmt.Fprintln(w, "# TYPE peekdb_queries_queued gauge")
+	fmt.Fprintf(w, "peekdb_queries_queued %d\n", queued)
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFairSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		queued  []string
+		want    []string
+	}{
+		{"fifo for one user", nil, []string{"alice", "alice", "alice"}, []string{"alice", "alice", "alice"}},
+		{"round robin", nil, []string{"alice", "alice", "alice", "bob", "carol"}, []string{"alice", "bob", "carol", "alice", "alice"}},
+		{"weighted", map[string]int{"alice": 2}, []string{"alice", "alice", "alice", "bob", "bob"}, []string{"alice", "alice", "bob", "alice", "bob"}},
+		{"no user", nil, []string{"", "", "bob"}, []string{"", "bob", ""}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFairScheduler(1, tc.weights)
+			hold, err := s.acquire(context.Background(), "batch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			type admission struct {
+				user    string
+				release func()
+			}
+			admitted := make(chan admission)
+			for i, user := range tc.queued {
+				go func(user string) {
+					release, err := s.acquire(context.Background(), user)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					admitted <- admission{user, release}
+				}(user)
+				waitQueued(t, s, i+1)
+			}
+
+			hold()
+			var got []string
+			for range tc.queued {
+				a := <-admitted
+				got = append(got, a.user)
+				a.release()
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+			if running, queued := s.counts(); running != 0 || queued != 0 {
+				t.Errorf("expected an idle scheduler, got %d running and %d queued", running, queued)
+			}
+		})
+	}
+}
+
+func TestFairSchedulerCancel(t *testing.T) {
+	s := newFairScheduler(1, nil)
+	hold, _ := s.acquire(context.Background(), "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.acquire(ctx, "bob")
+		done <- err
+	}()
+	waitQueued(t, s, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the queued query to be cancelled, got %v", err)
+	}
+	if _, queued := s.counts(); queued != 0 {
+		t.Errorf("expected the cancelled query out of the queue, got %d queued", queued)
+	}
+	hold()
+	if release, err := s.acquire(context.Background(), "carol"); err != nil {
+		t.Errorf("expected the slot free again, got %v", err)
+	} else {
+		release()
+	}
+
+	// Without a limit there is no scheduler, and everything runs at once.
+	if s := newFairScheduler(0, nil); s != nil {
+		t.Errorf("expected no scheduler without a limit")
+	}
+}
+
+func waitQueued(t *testing.T, s *fairScheduler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, queued := s.counts(); queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued", n)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// normalizeSQL reduces a statement to its shape: literals, numbers and
+// parameters become ?, IN lists collapse to (...), comments go, bare words
+// are lower-cased and whitespace is collapsed. Two runs of the same query
+// with different values normalize alike, and the result carries no user
+// data, so it is what the logs and metrics show.
+func normalizeSQL(q string) string {
+	var b strings.Builder
+	space := false
+	// emit writes a token, one space after the previous one, except that
+	// commas, dots and closing parentheses hug what comes before them and
+	// nothing is spaced after an opening parenthesis or a dot. Whether a
+	// parenthesis is spaced from a word before it follows the source.
+	last := byte(0)
+	emit := func(s string) {
+		if b.Len() > 0 && last != '(' && last != '.' {
+			switch s {
+			case ",", ")", ".", ";":
+			case "(":
+				if space {
+					b.WriteByte(' ')
+				}
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		space = false
+		b.WriteString(s)
+		last = s[len(s)-1]
+	}
+
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '\'':
+			// Skip to the closing quote; '' is an escaped quote.
+			j := i + 1
+			for j < len(q) {
+				if q[j] == '\'' {
+					if j+1 < len(q) && q[j+1] == '\'' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			emit("?")
+			i = j
+		case c == '"' || c == '`':
+			end := strings.IndexByte(q[i+1:], c)
+			if end < 0 {
+				end = len(q) - i - 1
+			}
+			emit(q[i:min(i+end+2, len(q))])
+			i += end + 1
+		case c == '-' && i+1 < len(q) && q[i+1] == '-':
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				end = len(q) - i
+			}
+			i += end
+			space = true
+		case c == '/' && i+1 < len(q) && q[i+1] == '*':
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				end = len(q) - i - 2
+			}
+			i += end + 3
+			space = true
+		case isIdentByte(c):
+			j := i + 1
+			for j < len(q) && (isIdentByte(q[j]) || q[j] >= '0' && q[j] <= '9' || q[j] == '$') {
+				j++
+			}
+			emit(strings.ToLower(q[i:j]))
+			i = j - 1
+		case c >= '0' && c <= '9' || c == '$' || c == ':' && i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9' ||
+			c == '.' && last != '.' && !isIdentByte(last) && last != '"' && i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9':
+			j := i + 1
+			for j < len(q) && (q[j] >= '0' && q[j] <= '9' || q[j] == '.' || q[j] == 'e' || q[j] == 'E') {
+				j++
+			}
+			emit("?")
+			i = j - 1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+		case strings.IndexByte(sqlOperatorChars, c) >= 0:
+			j := i + 1
+			for j < len(q) && strings.IndexByte(sqlOperatorChars, q[j]) >= 0 {
+				j++
+			}
+			emit(q[i:j])
+			i = j - 1
+		default:
+			emit(string(c))
+		}
+	}
+
+	return collapseLists(strings.TrimSuffix(b.String(), ";"))
+}
+
+const sqlOperatorChars = "<>=!|&+-*/%^~@#:"
+
+// collapseLists turns (?, ?, ?) into (...) so IN lists of any length share
+// a fingerprint.
+func collapseLists(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "(?, ?")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		j := i + 2
+		for strings.HasPrefix(s[j:], ", ?") {
+			j += 3
+		}
+		if j < len(s) && s[j] == ')' {
+			b.WriteString(s[:i])
+			b.WriteString("(...)")
+			s = s[j+1:]
+			continue
+		}
+		b.WriteString(s[:j])
+		s = s[j:]
+	}
+}
+
+// fingerprint identifies a statement's shape: a hash of normalizeSQL.
+func fingerprint(q string) string {
+	return shapeFingerprint(normalizeSQL(q))
+}
+
+func shapeFingerprint(shape string) string {
+	h := fnv.New64a()
+	h.Write([]byte(shape))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// logSQL formats a statement for the log by its fingerprint and shape,
+// never its literal values.
+func logSQL(q string) string {
+	shape := normalizeSQL(q)
+	return fmt.Sprintf("[%s] %s", shapeFingerprint(shape), truncate(shape, 100))
+}
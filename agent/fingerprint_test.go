@@ -0,0 +1,42 @@
+package agent
+
+import "testing"
+
+func TestNormalizeSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{name: "literals", sql: "SELECT * FROM users WHERE id = 42 AND name = 'O''Brien'", expected: "select * from users where id = ? and name = ?"},
+		{name: "whitespace and case", sql: "select *\n  FROM   Users WHERE ID=$1", expected: "select * from users where id = ?"},
+		{name: "comments", sql: "SELECT a -- the a column\nFROM t /* hint */ WHERE b > 1.5e3;", expected: "select a from t where b > ?"},
+		{name: "in lists", sql: "SELECT * FROM t WHERE id IN (1, 2, 3) OR id IN ($1,$2)", expected: "select * from t where id in (...) or id in (...)"},
+		{name: "subquery kept", sql: "SELECT * FROM t WHERE a IN (SELECT b FROM u)", expected: "select * from t where a in (select b from u)"},
+		{name: "quoted identifiers kept", sql: `SELECT "Col" FROM s."T" WHERE z = :1`, expected: `select "Col" from s."T" where z = ?`},
+		{name: "casts and qualified names", sql: "SELECT t.col::int, .5 FROM t", expected: "select t.col :: int, ? from t"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeSQL(tc.sql); got != tc.expected {
+				t.Errorf("got      %q\nexpected %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := fingerprint("SELECT * FROM orders WHERE id = 1")
+	b := fingerprint("select *  from orders where id=2")
+	c := fingerprint("SELECT * FROM orders WHERE user_id = 1")
+	if a != b {
+		t.Errorf("expected the same shape to share a fingerprint: %s, %s", a, b)
+	}
+	if a == c {
+		t.Errorf("expected different shapes to differ: %s", a)
+	}
+	if len(a) != 16 {
+		t.Errorf("expected 16 hex digits, got %q", a)
+	}
+}
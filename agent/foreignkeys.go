@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ForeignKey is an edge of the schema's relationship graph: Columns of
+// Schema.Table reference RefColumns of RefSchema.RefTable, pairwise and in
+// key order. The two tables may be in different schemas, or the same
+// table.
+type ForeignKey struct {
+	Name       string   `json:"name"`
+	Schema     string   `json:"schema"`
+	Table      string   `json:"table"`
+	Columns    []string `json:"columns"`
+	RefSchema  string   `json:"ref_schema"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+	OnDelete   string   `json:"on_delete"`
+	OnUpdate   string   `json:"on_update"`
+}
+
+// fkActions names pg_constraint's confdeltype and confupdtype codes.
+var fkActions = map[string]string{
+	"a": "no action",
+	"r": "restrict",
+	"c": "cascade",
+	"n": "set null",
+	"d": "set default",
+}
+
+// foreignKeyQuery reads every foreign key with its columns in key order,
+// in one round trip however many tables there are.
+const foreignKeyQuery = `
+SELECT con.conname, n.nspname, c.relname,
+       array(SELECT a.attname FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+             JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+             ORDER BY k.ord)::text[],
+       rn.nspname, rc.relname,
+       array(SELECT a.attname FROM unnest(con.confkey) WITH ORDINALITY k(attnum, ord)
+             JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+             ORDER BY k.ord)::text[],
+       con.confdeltype::text, con.confupdtype::text
+FROM pg_constraint con
+JOIN pg_class c ON c.oid = con.conrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_class rc ON rc.oid = con.confrelid
+JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+WHERE con.contype = 'f'
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE '\_timescaledb%'
+ORDER BY n.nspname, c.relname, con.conname`
+
+// loadForeignKeys reads the foreign keys of the schema, or of every
+// schema when it is empty. With a schema, keys referencing its tables from
+// other schemas are included too, so its diagram shows them.
+func loadForeignKeys(q queryer, schema string) ([]ForeignKey, error) {
+	query, args := foreignKeyQuery, []any{}
+	if schema != "" {
+		query, args = strings.Replace(foreignKeyQuery, "ORDER BY", "  AND (n.nspname = $1 OR rn.nspname = $1)\nORDER BY", 1), []any{schema}
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ForeignKey{}
+	for rows.Next() {
+		var fk ForeignKey
+		var onDelete, onUpdate string
+		if err := rows.Scan(&fk.Name, &fk.Schema, &fk.Table, pq.Array(&fk.Columns),
+			&fk.RefSchema, &fk.RefTable, pq.Array(&fk.RefColumns), &onDelete, &onUpdate); err != nil {
+			return nil, err
+		}
+		fk.OnDelete, fk.OnUpdate = fkActions[onDelete], fkActions[onUpdate]
+		keys = append(keys, fk)
+	}
+	return keys, rows.Err()
+}
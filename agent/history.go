@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyBucket = []byte("history")
+
+// HistoryEntry is one query the agent ran. Like the logs it carries the
+// normalized statement, never the values in it.
+type HistoryEntry struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Connection  string    `json:"connection"`
+	Fingerprint string    `json:"fingerprint"`
+	Query       string    `json:"query"`
+	Status      string    `json:"status"` // ok, failed
+	ErrorCode   string    `json:"error_code,omitempty"`
+	Rows        int       `json:"rows"`
+	DurationMS  int64     `json:"duration_ms"`
+	StartedAt   time.Time `json:"started_at"`
+	Export      bool      `json:"export,omitempty"`
+}
+
+// HistoryResponse answers a "history" message with the token's recent
+// queries, newest first.
+type HistoryResponse struct {
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// queryHistory is a ring buffer of the last --history-size queries,
+// mirrored to disk when --history names a file, so it survives restarts.
+type queryHistory struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	next    int
+	db      *bolt.DB
+}
+
+func newQueryHistory(size int) *queryHistory {
+	return &queryHistory{entries: make([]HistoryEntry, 0, size)}
+}
+
+// openHistory returns a history kept in the bolt file at path, loaded with
+// the entries it already holds.
+func openHistory(path string, size int) (*queryHistory, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	h := newQueryHistory(size)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var e HistoryEntry
+			if json.Unmarshal(v, &e) == nil {
+				h.add(e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	h.db = db
+	return h, nil
+}
+
+func (h *queryHistory) Close() error {
+	if h.db == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+func (h *queryHistory) add(e HistoryEntry) {
+	if cap(h.entries) == 0 {
+		return
+	}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// record remembers a query that ran on connection for t, from start until
+// now, with resp as its outcome.
+func (h *queryHistory) record(t *tenant, connection, sqlQuery string, start time.Time, resp QueryResponse, export bool) {
+	shape := normalizeSQL(sqlQuery)
+	e := HistoryEntry{
+		ID:          resp.ID,
+		Connection:  connection,
+		Fingerprint: shapeFingerprint(shape),
+		Query:       truncate(shape, 200),
+		Status:      "ok",
+		Rows:        resp.rowCount(),
+		DurationMS:  time.Since(start).Milliseconds(),
+		StartedAt:   start,
+		Export:      export,
+	}
+	if t != nil {
+		e.Tenant = t.name
+	}
+	if resp.Error != "" {
+		e.Status, e.ErrorCode = "failed", resp.ErrorCode
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(e)
+	if h.db != nil && cap(h.entries) > 0 {
+		h.persist(e)
+	}
+}
+
+// persist appends e to the file and drops the entries that have fallen out
+// of the ring. Failures only cost the entry its survival across a restart.
+func (h *queryHistory) persist(e HistoryEntry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := b.Put(key, buf); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for excess := b.Stats().KeyN - cap(h.entries); excess > 0; excess-- {
+			c.First()
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not persist query history: %v", err)
+	}
+}
+
+// recent returns up to limit entries, newest first. With all false only
+// tenant's entries are included.
+func (h *queryHistory) recent(tenant string, all bool, limit int) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []HistoryEntry{}
+	n := len(h.entries)
+	for i := 0; i < n && len(out) < limit; i++ {
+		e := h.entries[(h.next-1-i+2*n)%n]
+		if all || e.Tenant == tenant {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// historyReport answers a "history" message; limit defaults to 50.
+func historyReport(msg Message) HistoryResponse {
+	limit := msg.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	tenantName := ""
+	if msg.tenant != nil {
+		tenantName = msg.tenant.name
+	}
+	return HistoryResponse{ID: msg.ID, Type: "history", Entries: msg.agent().history.recent(tenantName, false, limit)}
+}
+
+// historyHandler serves every token's history on the metrics address, for
+// operators on the agent's host.
+func (a *Agent) historyHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = a.opts.HistorySize
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.history.recent("", true, limit))
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryHistoryRing(t *testing.T) {
+	h := newQueryHistory(3)
+	acme := &tenant{name: "acme"}
+	start := time.Now()
+	for i, id := range []string{"q1", "q2", "q3", "q4"} {
+		tn := acme
+		if i == 2 {
+			tn = &tenant{name: "other"}
+		}
+		h.record(tn, "main", "SELECT * FROM t WHERE id = 42", start, QueryResponse{ID: id, Rows: [][]any{{1}}}, false)
+	}
+	h.record(acme, "main", "SELECT 1/0", start, QueryResponse{ID: "q5", Error: "division by zero", ErrorCode: codeQueryFailed}, false)
+
+	got := h.recent("acme", false, 10)
+	if len(got) != 2 || got[0].ID != "q5" || got[1].ID != "q4" {
+		t.Fatalf("expected q5 and q4, newest first, got %+v", got)
+	}
+	if got[0].Status != "failed" || got[0].ErrorCode != codeQueryFailed {
+		t.Errorf("expected q5 to have failed, got %+v", got[0])
+	}
+	if got[1].Query != "select * from t where id = ?" || got[1].Rows != 1 {
+		t.Errorf("expected the normalized query and row count, got %+v", got[1])
+	}
+	if all := h.recent("", true, 10); len(all) != 3 {
+		t.Errorf("expected the ring to hold 3 entries, got %d", len(all))
+	}
+}
+
+func TestQueryHistoryPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := openHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"q1", "q2", "q3"} {
+		h.record(nil, "main", "SELECT 1", time.Now(), QueryResponse{ID: id}, false)
+	}
+	h.Close()
+
+	h, err = openHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	got := h.recent("", false, 10)
+	if len(got) != 2 || got[0].ID != "q3" || got[1].ID != "q2" {
+		t.Errorf("expected q3 and q2 after reopening, got %+v", got)
+	}
+
+	a := bareAgent(DefaultOptions(), nil)
+	a.history = h
+	w := httptest.NewRecorder()
+	a.historyHandler(w, httptest.NewRequest("GET", "/history?limit=1", nil))
+	var served []HistoryEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 1 || served[0].ID != "q3" {
+		t.Errorf("expected the endpoint to serve q3, got %s", w.Body)
+	}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// The agent measures each hub connection so a slow query can be told apart
+// from a slow network. Its websocket pings carry the time they were sent,
+// which the pong echoes, giving the round trip. A hub that puts its clock
+// in the auth response's "time" also answers
+//
+//	{"type": "clock", "sent_at": T0}                  (agent)
+//	{"type": "clock", "sent_at": T0, "time": T1}      (hub)
+//
+// sent after each ping; the agent takes the hub's clock to have read T1
+// halfway through the exchange, and the difference from its own is the
+// skew. Status messages carry both.
+
+// ClockMessage asks the hub for its clock.
+type ClockMessage struct {
+	Type   string    `json:"type"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// hubClock is what the agent measured of a tenant's hub connection.
+type hubClock struct {
+	mu        sync.Mutex
+	rtt       time.Duration
+	skew      time.Duration
+	skewKnown bool
+}
+
+// pingPayload is the data of a ping sent at now.
+func pingPayload(now time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+}
+
+// pong records the round trip of the ping whose payload a pong echoed,
+// received at now. Pongs not carrying a time are ignored.
+func (c *hubClock) pong(payload []byte, now time.Time) {
+	if len(payload) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	if rtt := now.Sub(sent); rtt >= 0 {
+		c.mu.Lock()
+		c.rtt = rtt
+		c.mu.Unlock()
+	}
+}
+
+// observe records the hub's clock reading hubTime in an exchange that
+// began at sent and ended at received.
+func (c *hubClock) observe(sent, hubTime, received time.Time) {
+	rtt := received.Sub(sent)
+	if rtt < 0 || hubTime.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skew = hubTime.Sub(sent.Add(rtt / 2))
+	c.skewKnown = true
+}
+
+// reset forgets the measurements of a previous connection.
+func (c *hubClock) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rtt, c.skew, c.skewKnown = 0, 0, false
+}
+
+// fill adds the measurements to status.
+func (c *hubClock) fill(status *StatusMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status.HubRTTMillis = millis(c.rtt)
+	if c.skewKnown {
+		skew := millis(c.skew)
+		status.ClockSkewMillis = &skew
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHubClock(t *testing.T) {
+	t0 := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	var c hubClock
+	var status StatusMessage
+	c.fill(&status)
+	if status.HubRTTMillis != 0 || status.ClockSkewMillis != nil {
+		t.Fatalf("expected nothing measured yet, got %+v", status)
+	}
+
+	c.pong(pingPayload(t0), t0.Add(42500*time.Microsecond))
+	c.pong([]byte("not a time"), t0.Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		hubTime  time.Time
+		received time.Time
+		skew     float64
+	}{
+		{"in step", t0.Add(20 * time.Millisecond), t0.Add(40 * time.Millisecond), 0},
+		{"hub ahead", t0.Add(2*time.Second + 20*time.Millisecond), t0.Add(40 * time.Millisecond), 2000},
+		{"hub behind", t0.Add(-500 * time.Millisecond), t0.Add(100 * time.Millisecond), -550},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c.observe(t0, tc.hubTime, tc.received)
+			var status StatusMessage
+			c.fill(&status)
+			if status.HubRTTMillis != 42.5 {
+				t.Errorf("expected an RTT of 42.5ms, got %v", status.HubRTTMillis)
+			}
+			if status.ClockSkewMillis == nil || *status.ClockSkewMillis != tc.skew {
+				t.Errorf("expected a skew of %vms, got %v", tc.skew, status.ClockSkewMillis)
+			}
+		})
+	}
+
+	c.reset()
+	status = StatusMessage{}
+	c.fill(&status)
+	if status.HubRTTMillis != 0 || status.ClockSkewMillis != nil {
+		t.Errorf("expected reset to forget the measurements, got %+v", status)
+	}
+}
@@ -0,0 +1,273 @@
+package agent
+
+import "strings"
+
+// identDialect is how a database spells identifiers: the character that
+// quotes them, and how it folds the case of bare ones. Generated SQL, such
+// as stable_order's ORDER BY, quotes every identifier it writes, so the
+// name has to be the one the database stores: a bare Orders is "orders" on
+// Postgres and "ORDERS" on Oracle.
+type identDialect struct {
+	quote byte
+	// fold is what the database makes of a bare identifier; nil keeps it
+	// as written.
+	fold func(string) string
+}
+
+func dialectFor(flavor string) identDialect {
+	switch flavor {
+	case "postgres", "cockroach", "duckdb", "cassandra":
+		return identDialect{quote: '"', fold: strings.ToLower}
+	case "oracle":
+		return identDialect{quote: '"', fold: strings.ToUpper}
+	case "bigquery":
+		return identDialect{quote: '`'}
+	}
+	return identDialect{quote: '"'}
+}
+
+// name is the stored name of the identifier t.
+func (d identDialect) name(t sqlToken) string {
+	if t.quoted || d.fold == nil {
+		return t.text
+	}
+	return d.fold(t.text)
+}
+
+// quoted quotes name, doubling quotes inside it.
+func (d identDialect) quoted(name string) string {
+	q := string(d.quote)
+	return q + strings.ReplaceAll(name, q, q+q) + q
+}
+
+// sql writes name as it must appear in a statement: bare where that means
+// the same name, quoted otherwise.
+func (d identDialect) sql(name string) string {
+	if d.needsQuotes(name) {
+		return d.quoted(name)
+	}
+	return name
+}
+
+// needsQuotes reports whether name, written bare, would mean another name
+// or not parse: it has characters a bare identifier can't, starts with a
+// digit, has a case the database would fold, or is a reserved word.
+func (d identDialect) needsQuotes(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isIdentByte(c) && !(c >= '0' && c <= '9') && c != '$' {
+			return true
+		}
+	}
+	if d.fold != nil && d.fold(name) != name {
+		return true
+	}
+	return reservedWords[strings.ToUpper(name)]
+}
+
+// qualifiedSQL quotes each part of a dotted name and joins them.
+func (d identDialect) qualifiedSQL(parts []sqlToken) string {
+	out := make([]string, len(parts))
+	for i, p := range parts {
+		out[i] = d.quoted(d.name(p))
+	}
+	return strings.Join(out, ".")
+}
+
+// reservedWords are keywords that can't be bare identifiers in at least one
+// of the SQL databases the agent supports, so names spelled like them are
+// always quoted.
+var reservedWords = map[string]bool{
+	"ALL": true, "ALTER": true, "AND": true, "ANY": true, "ARRAY": true, "AS": true,
+	"ASC": true, "BETWEEN": true, "BOTH": true, "BY": true, "CASE": true, "CAST": true,
+	"CHECK": true, "COLUMN": true, "CONSTRAINT": true, "CREATE": true, "CROSS": true,
+	"CURRENT_DATE": true, "CURRENT_TIME": true, "CURRENT_TIMESTAMP": true, "CURRENT_USER": true,
+	"DEFAULT": true, "DELETE": true, "DESC": true, "DISTINCT": true, "DO": true, "DROP": true,
+	"ELSE": true, "END": true, "EXCEPT": true, "EXISTS": true, "FALSE": true, "FETCH": true,
+	"FOR": true, "FOREIGN": true, "FROM": true, "FULL": true, "GRANT": true, "GROUP": true,
+	"HAVING": true, "IN": true, "INNER": true, "INSERT": true, "INTERSECT": true, "INTO": true,
+	"IS": true, "JOIN": true, "LATERAL": true, "LEADING": true, "LEFT": true, "LIKE": true,
+	"LIMIT": true, "LEVEL": true, "MINUS": true, "NATURAL": true, "NOT": true, "NULL": true,
+	"OFFSET": true, "ON": true, "ONLY": true, "OR": true, "ORDER": true, "OUTER": true,
+	"PRIMARY": true, "REFERENCES": true, "RIGHT": true, "ROW": true, "ROWNUM": true, "ROWS": true,
+	"SELECT": true, "SESSION_USER": true, "SET": true, "SOME": true, "TABLE": true, "THEN": true,
+	"TO": true, "TRAILING": true, "TRUE": true, "UNION": true, "UNIQUE": true, "UPDATE": true,
+	"USER": true, "USING": true, "VALUES": true, "VIEW": true, "WHEN": true, "WHERE": true,
+	"WINDOW": true, "WITH": true,
+}
+
+// IdentifierResponse answers a "validate_identifier" message: how the
+// database reads the identifier as written, and how to write it.
+type IdentifierResponse struct {
+	ID    string            `json:"id"`
+	Type  string            `json:"type"`
+	Parts []IdentifierPart  `json:"parts,omitempty"`
+	SQL   string            `json:"sql,omitempty"`
+	Found *IdentifierTarget `json:"found,omitempty"`
+	// Suggestion is how to write a name in the schema that the identifier
+	// missed only by case.
+	Suggestion string `json:"suggestion,omitempty"`
+
+	Error      string `json:"error,omitempty"`
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// IdentifierPart is one part of a dotted identifier.
+type IdentifierPart struct {
+	// Name is the name the database stores, after case folding.
+	Name     string `json:"name"`
+	Quoted   bool   `json:"quoted"`
+	Reserved bool   `json:"reserved,omitempty"`
+	// NeedsQuotes is set when Name written bare would mean something
+	// else.
+	NeedsQuotes bool `json:"needs_quotes,omitempty"`
+}
+
+// IdentifierTarget is what an identifier names in the connection's schema.
+type IdentifierTarget struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Column string `json:"column,omitempty"`
+	Kind   string `json:"kind"`
+}
+
+// validateIdentifier answers a "validate_identifier" message. The
+// identifier is written as in a statement, e.g. public."Order Items", and
+// is a table, schema.table, table.column or schema.table.column; it is
+// looked up in the connection's schema unless "mode" is "syntax". The
+// reply's sql is the identifier quoted only where needed, or every part
+// quoted with "mode": "quote_all".
+func validateIdentifier(msg Message) IdentifierResponse {
+	fail := func(err error) IdentifierResponse {
+		return IdentifierResponse{ID: msg.ID, Type: "identifier", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return fail(err)
+	}
+	d := dialectFor(c.Flavor())
+	resp := IdentifierResponse{ID: msg.ID, Type: "identifier", Connection: c.Name}
+	names := make([]string, len(parts))
+	written := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = d.name(p)
+		resp.Parts = append(resp.Parts, IdentifierPart{
+			Name:        names[i],
+			Quoted:      p.quoted,
+			Reserved:    reservedWords[strings.ToUpper(names[i])],
+			NeedsQuotes: d.needsQuotes(names[i]),
+		})
+		written[i] = d.sql(names[i])
+		if msg.Mode == "quote_all" {
+			written[i] = d.quoted(names[i])
+		}
+	}
+	resp.SQL = strings.Join(written, ".")
+	if msg.Mode == "syntax" {
+		return resp
+	}
+
+	schema := c.Schema(msg.ID, "")
+	if schema.Error != "" {
+		resp.Error, resp.ErrorCode = schema.Error, schema.ErrorCode
+		return resp
+	}
+	msg.capabilities().filterSchema(&schema)
+	if found := lookupIdentifier(schema.Tables, names, false); found != nil {
+		resp.Found = found
+	} else if found := lookupIdentifier(schema.Tables, names, true); found != nil {
+		// Only the case differs: say how to write the name it meant.
+		var s []string
+		for _, n := range found.names(len(names)) {
+			s = append(s, d.sql(n))
+		}
+		resp.Suggestion = strings.Join(s, ".")
+	}
+	return resp
+}
+
+// names returns t's names in the shape of an identifier of n parts.
+func (t *IdentifierTarget) names(n int) []string {
+	switch {
+	case n == 1:
+		return []string{t.Table}
+	case n == 2 && t.Column == "":
+		return []string{t.Schema, t.Table}
+	case n == 2:
+		return []string{t.Table, t.Column}
+	}
+	return []string{t.Schema, t.Table, t.Column}
+}
+
+// identifierParts splits an identifier written as in a statement into its
+// dotted parts.
+func identifierParts(s string) ([]sqlToken, error) {
+	toks := sqlTokens(s)
+	var parts []sqlToken
+	for i, t := range toks {
+		if i%2 == 1 {
+			if t.text != "." || t.quoted {
+				return nil, codedErrorf(codeInvalidRequest, "%q is not an identifier", s)
+			}
+			continue
+		}
+		if !t.quoted && t.word() == "" {
+			return nil, codedErrorf(codeInvalidRequest, "%q is not an identifier", s)
+		}
+		parts = append(parts, t)
+	}
+	if len(parts) == 0 || len(toks)%2 == 0 || len(parts) > 3 {
+		return nil, codedErrorf(codeInvalidRequest, "%q is not an identifier: expected table, schema.table, table.column or schema.table.column", s)
+	}
+	return parts, nil
+}
+
+// lookupIdentifier finds the table or column names name in tables,
+// comparing case-insensitively if fold is set.
+func lookupIdentifier(tables []SchemaTable, names []string, fold bool) *IdentifierTarget {
+	eq := func(a, b string) bool { return a == b || fold && strings.EqualFold(a, b) }
+	column := func(t SchemaTable, name string) *IdentifierTarget {
+		for _, col := range t.Columns {
+			if eq(col.Name, name) {
+				return &IdentifierTarget{Schema: t.Schema, Table: t.Name, Column: col.Name, Kind: "column"}
+			}
+		}
+		return nil
+	}
+	for _, t := range tables {
+		switch len(names) {
+		case 1:
+			if eq(t.Name, names[0]) {
+				return &IdentifierTarget{Schema: t.Schema, Table: t.Name, Kind: t.Kind}
+			}
+		case 2:
+			if eq(t.Schema, names[0]) && eq(t.Name, names[1]) {
+				return &IdentifierTarget{Schema: t.Schema, Table: t.Name, Kind: t.Kind}
+			}
+		case 3:
+			if eq(t.Schema, names[0]) && eq(t.Name, names[1]) {
+				if found := column(t, names[2]); found != nil {
+					return found
+				}
+			}
+		}
+	}
+	if len(names) == 2 {
+		// table.column
+		for _, t := range tables {
+			if eq(t.Name, names[0]) {
+				if found := column(t, names[1]); found != nil {
+					return found
+				}
+			}
+		}
+	}
+	return nil
+}
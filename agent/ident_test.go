@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestIdentDialect(t *testing.T) {
+	tests := []struct {
+		flavor, name string
+		sql          string
+	}{
+		{"postgres", "orders", "orders"},
+		{"postgres", "Orders", `"Orders"`},
+		{"postgres", "order", `"order"`},
+		{"postgres", "line items", `"line items"`},
+		{"postgres", `say "hi"`, `"say ""hi"""`},
+		{"postgres", "2fa", `"2fa"`},
+		{"postgres", "total$", "total$"},
+		{"oracle", "ORDERS", "ORDERS"},
+		{"oracle", "orders", `"orders"`},
+		{"oracle", "LEVEL", `"LEVEL"`},
+		{"bigquery", "Orders", "Orders"},
+		{"bigquery", "my-table", "`my-table`"},
+	}
+	for _, tc := range tests {
+		if got := dialectFor(tc.flavor).sql(tc.name); got != tc.sql {
+			t.Errorf("%s %q: expected %s, got %s", tc.flavor, tc.name, tc.sql, got)
+		}
+	}
+}
+
+func TestIdentifierParts(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []sqlToken
+		ok   bool
+	}{
+		{`orders`, []sqlToken{{text: "orders", end: 6}}, true},
+		{`public."Order Items"`, []sqlToken{{text: "public", end: 6}, {text: "Order Items", quoted: true, end: 20}}, true},
+		{`a.b.c.d`, nil, false},
+		{`orders.`, nil, false},
+		{`orders o`, nil, false},
+		{`1`, nil, false},
+		{``, nil, false},
+	}
+	for _, tc := range tests {
+		got, err := identifierParts(tc.in)
+		if (err == nil) != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: expected %v (ok %v), got %v, %v", tc.in, tc.want, tc.ok, got, err)
+		}
+	}
+}
+
+func TestValidateIdentifier(t *testing.T) {
+	schema, _ := json.Marshal(SchemaResponse{Type: "schema", Tables: []SchemaTable{
+		{Schema: "public", Name: "Order Items", Kind: "table", Columns: []SchemaColumn{{Name: "user", Type: "text"}}},
+		{Schema: "public", Name: "Users", Kind: "view"},
+	}})
+	db := &replayDB{answers: map[string]json.RawMessage{replayKey("", "v1"): schema}}
+	tn := testTenant(&connection{Name: "main", Connector: &replayConnector{flavor: "postgres", db: db}})
+
+	tests := []struct {
+		name       string
+		identifier string
+		mode       string
+		sql        string
+		found      *IdentifierTarget
+		suggestion string
+	}{
+		{"table", `public."Order Items"`, "", `public."Order Items"`, &IdentifierTarget{Schema: "public", Table: "Order Items", Kind: "table"}, ""},
+		{"reserved column", `"Order Items"."user"`, "", `"Order Items"."user"`, &IdentifierTarget{Schema: "public", Table: "Order Items", Column: "user", Kind: "column"}, ""},
+		{"folded", `Users`, "", `users`, nil, `"Users"`},
+		{"quote all", `public.users`, "quote_all", `"public"."users"`, nil, `public."Users"`},
+		{"syntax only", `Nowhere`, "syntax", `nowhere`, nil, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := validateIdentifier(Message{ID: "v1", Type: "validate_identifier", Identifier: tc.identifier, Mode: tc.mode, tenant: tn})
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if resp.SQL != tc.sql || !reflect.DeepEqual(resp.Found, tc.found) || resp.Suggestion != tc.suggestion {
+				t.Errorf("expected %s, found %+v, suggestion %q; got %s, %+v, %q", tc.sql, tc.found, tc.suggestion, resp.SQL, resp.Found, resp.Suggestion)
+			}
+		})
+	}
+
+	resp := validateIdentifier(Message{ID: "v2", Identifier: "a b", tenant: tn})
+	if resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected an invalid identifier to be refused, got %+v", resp)
+	}
+}
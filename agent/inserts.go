@@ -0,0 +1,32 @@
+package agent
+
+// insertRow answers an "insert_row" message by adding a row with
+// msg.Values to the table msg.Identifier names, so an "add row" form never
+// writes SQL. The values are checked against the cached schema, like an
+// apply_changes insert, and the INSERT then runs as a query with the
+// message's ID: the token's policy and limits apply, it can be cancelled,
+// and the reply is the new row, as RETURNING * reads it back with its
+// defaults filled in.
+func insertRow(msg Message) QueryResponse {
+	c, err := msg.route()
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || (sc.flavor != "postgres" && sc.flavor != "cockroach") {
+		return queryError(msg.ID, codedErrorf(codeNotSupported, "insert_row is not supported for %s", c.Flavor()))
+	}
+	table, types, err := editableTable(c, msg)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	st, err := rowChangeStatement(dialectFor(sc.flavor), table, types, nil, RowChange{Op: "insert", Values: msg.Values})
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+
+	q := msg
+	q.Type, q.Identifier, q.Values = "query", "", nil
+	q.SQL, q.Params = st.sql+" RETURNING *", st.args
+	return runQuery(q)
+}
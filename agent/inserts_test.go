@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInsertRow(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+	tn := testTenant(
+		&connection{Name: "main", Connector: pg},
+		&connection{Name: "ro", ReadOnly: true, Connector: pg},
+	)
+	tn.setCapabilities(&Capabilities{})
+	now := "now()"
+	tn.agent.schemas.put(pg, SchemaResponse{
+		Tables: []SchemaTable{{Schema: "public", Name: "tickets", Kind: "table", Columns: []SchemaColumn{
+			{Name: "id", Type: "bigint", Identity: "always"},
+			{Name: "title", Type: "character varying(40)"},
+			{Name: "mood", Type: "mood", UserType: &TypeRef{Schema: "public", Name: "mood"}},
+			{Name: "labels", Type: "text[]", Nullable: true},
+			{Name: "opened_at", Type: "timestamp with time zone", Default: &now},
+		}}},
+		Types: []SchemaType{{Schema: "public", Name: "mood", Kind: "enum", Labels: []string{"sad", "happy"}}},
+	})
+
+	tests := []struct {
+		name     string
+		msg      Message
+		expect   func()
+		wantErr  string
+		wantCode string
+	}{
+		{
+			name: "inserted",
+			msg:  Message{ID: "i1", Identifier: "tickets", Values: map[string]any{"title": "Printer on fire", "mood": "sad", "labels": []any{"hw"}}},
+			expect: func() {
+				mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "public"."tickets" ("title", "mood", "labels") VALUES ($1, $2, $3) RETURNING *`)).
+					WithArgs("Printer on fire", "sad", `{"hw"}`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "mood", "labels", "opened_at"}).
+						AddRow(int64(1), "Printer on fire", "sad", "{hw}", "2026-10-17T09:00:00Z"))
+			},
+		},
+		{
+			name:     "missing required column",
+			msg:      Message{ID: "i2", Identifier: "tickets", Values: map[string]any{"title": "No mood"}},
+			wantErr:  `column "mood" is required: it can't be null and has no default`,
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "wrong type",
+			msg:      Message{ID: "i3", Identifier: "tickets", Values: map[string]any{"title": "x", "mood": "meh"}},
+			wantErr:  `column "mood": expected one of sad, happy, got "meh"`,
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "identity always",
+			msg:      Message{ID: "i4", Identifier: "tickets", Values: map[string]any{"id": float64(1), "title": "x", "mood": "sad"}},
+			wantCode: codeInvalidRequest,
+		},
+		{
+			name:     "read-only connection",
+			msg:      Message{ID: "i5", Identifier: "tickets", Target: "ro", Values: map[string]any{"title": "x", "mood": "sad"}},
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "unknown table",
+			msg:      Message{ID: "i6", Identifier: "nope", Values: map[string]any{"title": "x"}},
+			wantCode: codeInvalidRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.expect != nil {
+				tc.expect()
+			}
+			resp := insertRow(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			switch {
+			case tc.wantCode != "":
+				if resp.ErrorCode != tc.wantCode || tc.wantErr != "" && resp.Error != tc.wantErr {
+					t.Errorf("expected %s %q, got %+v", tc.wantCode, tc.wantErr, resp)
+				}
+			case resp.Error != "" || len(resp.Rows) != 1 || len(resp.Columns) != 5:
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
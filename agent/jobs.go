@@ -0,0 +1,576 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// jobProgressInterval is how often a running export reports its progress
+// to the hub.
+var jobProgressInterval = 5 * time.Second
+
+var (
+	jobsBucket    = []byte("jobs")
+	resultsBucket = []byte("results")
+	// cursorsBucket keeps publish jobs' cursors; see publish.go.
+	cursorsBucket = []byte("publish_cursors")
+)
+
+// Job is an export the hub started with an "export" message, or, with Kind
+// "scan_pii", a PII scan started with "scan_pii"; see pii.go. Jobs and their
+// results are stored on disk, so the hub can poll and fetch them after a
+// dropped connection, and jobs interrupted by a restart run again. Bytes
+// estimates the JSON size of the rows read, as rowBytes does; while the job
+// runs, Rows and Bytes are what it has read so far. Anonymized lists the
+// columns the configured anonymize rules rewrote.
+type Job struct {
+	ID         string    `json:"job_id"`
+	Kind       string    `json:"kind,omitempty"`
+	Tenant     string    `json:"-"`
+	Connection string    `json:"connection"`
+	SQL        string    `json:"sql,omitempty"`
+	Scan       *PIIScan  `json:"scan,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Params     []any     `json:"params,omitempty"`
+	Status     string    `json:"status"` // running, done, failed, cancelled
+	Rows       int       `json:"rows"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Anonymized []string  `json:"anonymized,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorCode  string    `json:"error_code,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+// storedJob is how a Job is written to disk; Tenant is kept out of replies
+// but must survive restarts.
+type storedJob struct {
+	Job
+	Tenant string `json:"tenant"`
+}
+
+// JobResponse answers "export" and "job_status" messages.
+type JobResponse struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Job       *Job   `json:"job,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+type jobResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// jobStore keeps an agent's export jobs in the bolt file of --jobs-db;
+// jobs are disabled without one.
+type jobStore struct {
+	db    *bolt.DB
+	agent *Agent
+
+	mu sync.Mutex
+	// resumed records the tenants whose interrupted jobs have been
+	// restarted, which happens once, on their first authentication.
+	resumed map[string]bool
+	// active holds the progress of the jobs running now.
+	active map[string]*fetchProgress
+}
+
+// fetchProgress counts the rows a query has read, for progress reports.
+// A nil fetchProgress counts nothing.
+type fetchProgress struct {
+	rows, bytes atomic.Int64
+}
+
+type progressKey struct{}
+
+// withProgress makes ctx's query count the rows it reads in p.
+func withProgress(ctx context.Context, p *fetchProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progressFrom returns the progress of ctx's query, or nil.
+func progressFrom(ctx context.Context) *fetchProgress {
+	p, _ := ctx.Value(progressKey{}).(*fetchProgress)
+	return p
+}
+
+func (p *fetchProgress) add(row []any) {
+	if p != nil {
+		p.rows.Add(1)
+		p.bytes.Add(rowBytes(row))
+	}
+}
+
+// reset starts the count again, for a retried statement.
+func (p *fetchProgress) reset() {
+	if p != nil {
+		p.rows.Store(0)
+		p.bytes.Store(0)
+	}
+}
+
+func (p *fetchProgress) counts() (rows int, bytes int64) {
+	if p == nil {
+		return 0, 0
+	}
+	return int(p.rows.Load()), p.bytes.Load()
+}
+
+// openJobStore opens the job store at path, for jobs a runs.
+func openJobStore(a *Agent, path string) (*jobStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{jobsBucket, resultsBucket, cursorsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &jobStore{db: db, agent: a, resumed: map[string]bool{}, active: map[string]*fetchProgress{}}
+	s.prune(time.Now())
+	return s, nil
+}
+
+func (s *jobStore) Close() error { return s.db.Close() }
+
+func (s *jobStore) put(j *Job) error {
+	buf, err := json.Marshal(storedJob{Job: *j, Tenant: j.Tenant})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), buf)
+	})
+}
+
+func decodeJob(buf []byte) (*Job, error) {
+	var sj storedJob
+	if err := json.Unmarshal(buf, &sj); err != nil {
+		return nil, err
+	}
+	sj.Job.Tenant = sj.Tenant
+	return &sj.Job, nil
+}
+
+// get returns the job with id if tenant owns it.
+func (s *jobStore) get(tenant, id string) (*Job, error) {
+	var j *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(jobsBucket).Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		var err error
+		j, err = decodeJob(buf)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if j == nil || j.Tenant != tenant {
+		return nil, codedErrorf(codeInvalidRequest, "job %q not found", id)
+	}
+	return j, nil
+}
+
+// finish records the outcome of a job and, on success, its rows.
+func (s *jobStore) finish(j *Job, result *jobResult) error {
+	buf, err := json.Marshal(storedJob{Job: *j, Tenant: j.Tenant})
+	if err != nil {
+		return err
+	}
+	var res []byte
+	if result != nil {
+		if res, err = json.Marshal(result); err != nil {
+			return err
+		}
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if res != nil {
+			if err := tx.Bucket(resultsBucket).Put([]byte(j.ID), res); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), buf)
+	})
+}
+
+// cursor returns the stored cursor of the publish job name, if any.
+func (s *jobStore) cursor(name string) (string, bool) {
+	var v []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		v = tx.Bucket(cursorsBucket).Get([]byte(name))
+		if v != nil {
+			v = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return string(v), v != nil
+}
+
+func (s *jobStore) setCursor(name, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cursorsBucket).Put([]byte(name), []byte(value))
+	})
+}
+
+func (s *jobStore) result(id string) (*jobResult, error) {
+	var r *jobResult
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(resultsBucket).Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		r = &jobResult{}
+		// Numbers stay exact, as they were stored.
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		return dec.Decode(r)
+	})
+	return r, err
+}
+
+// prune deletes jobs that finished more than --job-retention before now.
+func (s *jobStore) prune(now time.Time) {
+	retention := s.agent.opts.JobRetention
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		err := tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			j, err := decodeJob(v)
+			if err != nil || !j.FinishedAt.IsZero() && now.Sub(j.FinishedAt) > retention {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			tx.Bucket(jobsBucket).Delete(k)
+			tx.Bucket(resultsBucket).Delete(k)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not prune jobs: %v", err)
+	}
+}
+
+// interrupted lists tenant's jobs that were running when the agent stopped.
+func (s *jobStore) interrupted(tenant string) ([]*Job, error) {
+	var list []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			j, err := decodeJob(v)
+			if err == nil && j.Tenant == tenant && j.Status == "running" {
+				list = append(list, j)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+// resume restarts t's interrupted jobs the first time t authenticates, once
+// its capabilities are known, running them under ctx.
+func (s *jobStore) resume(ctx context.Context, t *tenant) {
+	s.mu.Lock()
+	done := s.resumed[t.name]
+	s.resumed[t.name] = true
+	s.mu.Unlock()
+	if done {
+		return
+	}
+
+	list, err := s.interrupted(t.name)
+	if err != nil {
+		t.logf("Could not read interrupted jobs: %v", err)
+		return
+	}
+	for _, j := range list {
+		t.logf("[job:%s] Resuming interrupted export", j.ID)
+		s.start(ctx, t, j)
+	}
+}
+
+// start runs j in the background, counted as work in flight for
+// maintenance mode from now rather than from when it gets going.
+func (s *jobStore) start(ctx context.Context, t *tenant, j *Job) {
+	done := s.agent.maintenance.begin()
+	go func() {
+		defer done()
+		s.run(ctx, t, j)
+	}()
+}
+
+// run executes j under ctx and stores its outcome. Exports are reads, so a
+// job cut short by a restart simply runs again from the start; one cut
+// short by ctx, on shutdown, is left running for the next start to resume.
+// One cancelled with a "cancel" message ends as cancelled.
+func (s *jobStore) run(ctx context.Context, t *tenant, j *Job) {
+	a := s.agent
+	defer a.reporter.reportPanic()
+	p := &fetchProgress{}
+	s.setActive(j.ID, p)
+	defer s.setActive(j.ID, nil)
+	msg := Message{Type: "query", ID: j.ID, SQL: j.SQL, Params: j.Params, Target: j.Connection, User: j.User, JobID: j.ID, tenant: t, ctx: withProgress(ctx, p)}
+	what := "export"
+	if j.Kind == "scan_pii" {
+		what = "PII scan"
+	}
+	log.Printf("[job:%s] Running %s on %q", j.ID, what, j.Connection)
+	start := time.Now()
+
+	stop := reportProgress(t, j, p)
+	var resp QueryResponse
+	c, err := msg.route()
+	switch {
+	case err != nil:
+		resp = queryError(j.ID, err)
+	case j.Kind == "scan_pii":
+		resp = scanPII(c, msg, *j.Scan)
+	case c.AggregateOnly:
+		// Checked again, for a job resumed after the connection became
+		// aggregate-only.
+		if msg.SQL, err = aggregateSQL(c, msg.SQL); err != nil {
+			resp = queryError(j.ID, err)
+		} else {
+			resp = a.execute(c, msg)
+		}
+	default:
+		resp = a.execute(c, msg)
+	}
+	stop()
+	if ctx.Err() != nil {
+		log.Printf("[job:%s] Interrupted by shutdown; it will resume on the next start", j.ID)
+		return
+	}
+
+	j.FinishedAt = time.Now()
+	if j.Kind == "" {
+		a.history.record(t, j.Connection, j.SQL, start, resp, true)
+	}
+	var result *jobResult
+	switch {
+	case resp.ErrorCode == codeCanceled:
+		j.Rows, j.Bytes = p.counts()
+		j.Status, j.Error, j.ErrorCode = "cancelled", what+" cancelled", codeCanceled
+		log.Printf("[job:%s] Cancelled after %d rows", j.ID, j.Rows)
+	case resp.Error != "":
+		j.Status, j.Error, j.ErrorCode = "failed", resp.Error, resp.ErrorCode
+		log.Printf("[job:%s] Failed: %s", j.ID, resp.Error)
+	default:
+		if j.Kind == "" {
+			msg.capabilities().limitRows(&resp)
+			j.Anonymized = a.anonymize.apply(c, &resp)
+			a.usage.record(j.Connection, j.SQL)
+		}
+		_, j.Bytes = p.counts()
+		j.Status, j.Rows = "done", len(resp.Rows)
+		result = &jobResult{Columns: resp.Columns, Rows: resp.Rows}
+		log.Printf("[job:%s] Completed in %v, %d rows", j.ID, time.Since(start), j.Rows)
+	}
+	if err := s.finish(j, result); err != nil {
+		log.Printf("[job:%s] Could not store result: %v", j.ID, err)
+	}
+	if t != nil {
+		// Tell the hub the job is over, now or, via the outbox, once it
+		// is back.
+		t.reply(Message{}, JobResponse{Type: "job_done", Job: j})
+	}
+	s.prune(time.Now())
+}
+
+func (s *jobStore) setActive(id string, p *fetchProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p == nil {
+		delete(s.active, id)
+	} else {
+		s.active[id] = p
+	}
+}
+
+// progress returns the progress of job id if it is running now.
+func (s *jobStore) progress(id string) *fetchProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[id]
+}
+
+// reportProgress sends t a "job_progress" message for j every
+// jobProgressInterval while the hub is connected, until the func it
+// returns is called. Progress isn't spooled: the next report supersedes
+// it.
+func reportProgress(t *tenant, j *Job, p *fetchProgress) func() {
+	if t == nil || jobProgressInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(jobProgressInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			if !t.connected() {
+				continue
+			}
+			snap := *j
+			snap.Rows, snap.Bytes = p.counts()
+			t.reply(Message{}, JobResponse{Type: "job_progress", Job: &snap})
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startExport starts an export job for msg and replies at once with its ID.
+func startExport(msg Message) JobResponse {
+	fail := func(err error) JobResponse {
+		log.Printf("[job:%s] Error: %v", msg.ID, err)
+		return JobResponse{ID: msg.ID, Type: "job", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	jobs := msg.agent().jobs
+	if jobs == nil {
+		return fail(codedErrorf(codeNotSupported, "export jobs are disabled; start the agent with --jobs-db"))
+	}
+	caps := msg.capabilities()
+	if !caps.CanExport {
+		return fail(codedErrorf(codePolicyDenied, "export is not allowed for this token"))
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	if kind, _ := classifyStatements(msg.SQL); !readStatements[kind] {
+		return fail(codedErrorf(codeInvalidRequest, "only reads can be exported, not %s statements", kind))
+	}
+	if err := caps.checkStatement(msg.SQL); err != nil {
+		return fail(err)
+	}
+	if c.AggregateOnly {
+		if _, err := aggregateSQL(c, msg.SQL); err != nil {
+			return fail(err)
+		}
+	}
+
+	j := &Job{
+		ID:         newJobID(),
+		Connection: c.Name,
+		SQL:        msg.SQL,
+		User:       msg.User,
+		Params:     msg.Params,
+		Status:     "running",
+		CreatedAt:  time.Now(),
+	}
+	if msg.tenant != nil {
+		j.Tenant = msg.tenant.name
+	}
+	if err := jobs.put(j); err != nil {
+		return fail(fmt.Errorf("could not store job: %w", err))
+	}
+	reply := *j
+	jobs.start(msg.context(), msg.tenant, j)
+	return JobResponse{ID: msg.ID, Type: "job", Job: &reply}
+}
+
+// jobStatus answers a "job_status" message, with the progress so far of a
+// running job.
+func jobStatus(msg Message) JobResponse {
+	j, err := lookupJob(msg)
+	if err != nil {
+		return JobResponse{ID: msg.ID, Type: "job", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	if j.Status == "running" {
+		j.Rows, j.Bytes = msg.agent().jobs.progress(j.ID).counts()
+	}
+	return JobResponse{ID: msg.ID, Type: "job", Job: j}
+}
+
+// jobResultPage answers a "job_result" message with up to limit rows of a
+// finished job from offset, as a result that may be chunked like any other.
+func jobResultPage(msg Message) QueryResponse {
+	j, err := lookupJob(msg)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	if j.Status != "done" {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "job %q is %s", j.ID, j.Status))
+	}
+	r, err := msg.agent().jobs.result(j.ID)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	if r == nil {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "job %q has no stored result", j.ID))
+	}
+
+	rows := r.Rows
+	if msg.Offset > 0 {
+		if msg.Offset > len(rows) {
+			rows = nil
+		} else {
+			rows = rows[msg.Offset:]
+		}
+	}
+	if msg.Limit > 0 && len(rows) > msg.Limit {
+		rows = rows[:msg.Limit]
+	}
+	resp := QueryResponse{ID: msg.ID, Type: "result", Columns: r.Columns, Rows: rows, Connection: j.Connection}
+	formatNumbers(&resp, msg.numberFormat())
+	return resp
+}
+
+func lookupJob(msg Message) (*Job, error) {
+	jobs := msg.agent().jobs
+	if jobs == nil {
+		return nil, codedErrorf(codeNotSupported, "export jobs are disabled; start the agent with --jobs-db")
+	}
+	if msg.JobID == "" {
+		return nil, codedErrorf(codeInvalidRequest, "job_id is required")
+	}
+	tenant := ""
+	if msg.tenant != nil {
+		tenant = msg.tenant.name
+	}
+	j, err := jobs.get(tenant, msg.JobID)
+	if err != nil && !errors.As(err, new(*codedError)) {
+		return nil, fmt.Errorf("could not read job: %w", err)
+	}
+	return j, err
+}
@@ -0,0 +1,291 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+)
+
+func TestExportJob(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.name = "acme"
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	store, err := openJobStore(tn.agent, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.agent.jobs = store
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT id FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3))
+
+	started := startExport(Message{ID: "e1", Type: "export", SQL: "SELECT id FROM orders", tenant: tn})
+	if started.Error != "" {
+		t.Fatalf("unexpected error: %s", started.Error)
+	}
+	jobID := started.Job.ID
+
+	var status JobResponse
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status = jobStatus(Message{ID: "s1", JobID: jobID, tenant: tn})
+		if status.Error != "" || status.Job.Status != "running" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Error != "" || status.Job.Status != "done" || status.Job.Rows != 3 {
+		t.Fatalf("expected a finished job with 3 rows, got %+v", status)
+	}
+
+	// Another token can't see the job.
+	other := jobStatus(Message{ID: "s2", JobID: jobID, tenant: &tenant{agent: tn.agent, name: "globex"}})
+	if other.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for another tenant's job, got %+v", codeInvalidRequest, other)
+	}
+
+	// The result survives reopening the store, and pages by offset and limit.
+	store.Close()
+	if tn.agent.jobs, err = openJobStore(tn.agent, path); err != nil {
+		t.Fatal(err)
+	}
+	defer tn.agent.jobs.Close()
+	page := jobResultPage(Message{ID: "r1", JobID: jobID, Offset: 1, Limit: 1, tenant: tn})
+	if page.Error != "" {
+		t.Fatalf("unexpected error: %s", page.Error)
+	}
+	if len(page.Rows) != 1 || page.Rows[0][0] != json.Number("2") {
+		t.Errorf("expected the second row, got %v", page.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestExportJobRefused(t *testing.T) {
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{flavor: "postgres"}})
+	if resp := startExport(Message{ID: "e1", SQL: "SELECT 1", tenant: tn}); resp.ErrorCode != codeNotSupported {
+		t.Errorf("expected %s without a jobs database, got %+v", codeNotSupported, resp)
+	}
+
+	store, err := openJobStore(tn.agent, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tn.agent.jobs = store
+
+	if resp := startExport(Message{ID: "e2", SQL: "DELETE FROM orders", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for a write, got %+v", codeInvalidRequest, resp)
+	}
+	tn.setCapabilities(&Capabilities{CanExport: false})
+	if resp := startExport(Message{ID: "e3", SQL: "SELECT 1", tenant: tn}); resp.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s without can_export, got %+v", codePolicyDenied, resp)
+	}
+}
+
+func TestJobStoreResumeAndPrune(t *testing.T) {
+	store, err := openJobStore(bareAgent(DefaultOptions(), nil), filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	running := &Job{ID: "a", Tenant: "acme", Status: "running", CreatedAt: now}
+	old := &Job{ID: "b", Tenant: "acme", Status: "done", CreatedAt: now.Add(-48 * time.Hour), FinishedAt: now.Add(-47 * time.Hour)}
+	recent := &Job{ID: "c", Tenant: "acme", Status: "done", CreatedAt: now, FinishedAt: now}
+	for _, j := range []*Job{running, old, recent} {
+		if err := store.put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := store.interrupted("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "a" {
+		t.Errorf("expected job a to be interrupted, got %+v", list)
+	}
+
+	store.prune(now)
+	if _, err := store.get("acme", "b"); err == nil {
+		t.Error("expected the old job to be pruned")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, err := store.get("acme", id); err != nil {
+			t.Errorf("expected job %s to be kept: %v", id, err)
+		}
+	}
+}
+
+func TestJobInterruptedByShutdown(t *testing.T) {
+	mockDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.name = "acme"
+	store, err := openJobStore(tn.agent, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	j := &Job{ID: "j1", Tenant: "acme", Connection: "main", SQL: "SELECT id FROM orders", Status: "running", CreatedAt: time.Now()}
+	if err := store.put(j); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.run(ctx, tn, j)
+
+	// The job stays running, to be resumed by the next start, rather than
+	// failing with the cancellation.
+	list, err := store.interrupted("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "j1" {
+		t.Errorf("expected job j1 to be left running, got %+v", list)
+	}
+}
+
+func TestExportJobCancel(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.name = "acme"
+	store, err := openJobStore(tn.agent, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tn.agent.jobs = store
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT id FROM orders").WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	started := startExport(Message{ID: "e1", Type: "export", SQL: "SELECT id FROM orders", tenant: tn})
+	if started.Error != "" {
+		t.Fatalf("unexpected error: %s", started.Error)
+	}
+	jobID := started.Job.ID
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cancelQuery(Message{ID: "c1", QueryID: jobID, tenant: tn}).Error != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the export's query to start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	var status JobResponse
+	for {
+		status = jobStatus(Message{ID: "s1", JobID: jobID, tenant: tn})
+		if status.Error != "" || status.Job.Status != "running" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Job == nil || status.Job.Status != "cancelled" || status.Job.ErrorCode != codeCanceled {
+		t.Errorf("expected a cancelled job, got %+v", status)
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	// Rows read count as they are fetched.
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "a").AddRow(2, "b"))
+	p := &fetchProgress{}
+	if _, _, _, err := fetchRows(mockDB, "postgres", "SELECT", nil, nil, nil, p); err != nil {
+		t.Fatal(err)
+	}
+	if rows, bytes := p.counts(); rows != 2 || bytes != 2*rowBytes([]any{int64(1), "a"}) {
+		t.Errorf("expected 2 rows counted, got %d rows of %d bytes", rows, bytes)
+	}
+
+	// job_status reports them while the job runs.
+	tn := testTenant()
+	tn.name = "acme"
+	store, err := openJobStore(tn.agent, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tn.agent.jobs = store
+	j := &Job{ID: "j1", Tenant: "acme", Connection: "main", Status: "running", CreatedAt: time.Now()}
+	if err := store.put(j); err != nil {
+		t.Fatal(err)
+	}
+	store.setActive(j.ID, p)
+	status := jobStatus(Message{ID: "s1", JobID: j.ID, tenant: tn})
+	if status.Job == nil || status.Job.Rows != 2 || status.Job.Bytes == 0 {
+		t.Errorf("expected the progress so far, got %+v", status)
+	}
+
+	// And the hub gets them every jobProgressInterval.
+	savedInterval := jobProgressInterval
+	defer func() { jobProgressInterval = savedInterval }()
+	jobProgressInterval = 10 * time.Millisecond
+	frames := make(chan JobResponse, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var f JobResponse
+			if err := conn.ReadJSON(&f); err != nil {
+				return
+			}
+			frames <- f
+		}
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tn.ws = conn
+	stop := reportProgress(tn, j, p)
+	select {
+	case f := <-frames:
+		if f.Type != "job_progress" || f.Job == nil || f.Job.ID != "j1" || f.Job.Rows != 2 {
+			t.Errorf("expected a job_progress with 2 rows, got %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a progress report")
+	}
+	stop()
+}
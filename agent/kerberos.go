@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Kerberos authenticates Postgres connections with GSSAPI. lib/pq asks a
+// registered GSS provider for each connection's token, and the provider
+// reads the ticket cache; the agent keeps that cache holding a valid
+// ticket, getting one from Keytab with kinit or renewing the one already
+// there, so connections opened days after startup still authenticate.
+type Kerberos struct {
+	// Principal is the agent's Kerberos identity, e.g.
+	// peekdb/agent01@EXAMPLE.COM; Keytab holds its key.
+	Principal string
+	Keytab    string
+	// CCache is the ticket cache file; empty means the default, from
+	// KRB5CCNAME or /tmp/krb5cc_<uid>.
+	CCache string
+	// Renew is how often to get a fresh ticket. It must be well inside
+	// the ticket lifetime the KDC grants, usually 10 hours.
+	Renew time.Duration
+}
+
+// kinitCommand is the MIT or Heimdal kinit the agent runs.
+var kinitCommand = "kinit"
+
+// newGSS is the GSS provider given to RegisterGSSProvider.
+var newGSS pq.NewGSSFunc
+
+// RegisterGSSProvider gives lib/pq the GSSAPI implementation Kerberos
+// authentication uses. The peekdb-agent command registers
+// github.com/lib/pq/auth/kerberos when built with -tags kerberos; programs
+// embedding the agent register it, or another provider, themselves.
+func RegisterGSSProvider(f pq.NewGSSFunc) {
+	newGSS = f
+	pq.RegisterGSSProvider(f)
+}
+
+func (k *Kerberos) enabled() bool {
+	return k.Principal != "" || k.Keytab != "" || k.CCache != ""
+}
+
+// check reports mistakes in the settings before anything connects.
+func (k *Kerberos) check() error {
+	if !k.enabled() {
+		return nil
+	}
+	if newGSS == nil {
+		return errors.New("this agent was built without Kerberos support: build it with -tags kerberos")
+	}
+	if k.Keytab != "" {
+		if k.Principal == "" {
+			return errors.New("a keytab needs --krb-principal to say which of its keys to use")
+		}
+		if _, err := os.Stat(k.Keytab); err != nil {
+			return fmt.Errorf("keytab: %w", err)
+		}
+	}
+	if k.Renew < time.Minute {
+		return fmt.Errorf("--krb-renew must be at least a minute, not %s", k.Renew)
+	}
+	if _, err := exec.LookPath(kinitCommand); err != nil {
+		return fmt.Errorf("renewing tickets needs %s on the PATH (install krb5-user or heimdal-clients): %w", kinitCommand, err)
+	}
+	return nil
+}
+
+// kinit gets a ticket from the keytab, or renews the cached one.
+func (k *Kerberos) kinit(ctx context.Context) error {
+	var args []string
+	if k.CCache != "" {
+		args = append(args, "-c", k.CCache)
+	}
+	if k.Keytab != "" {
+		args = append(args, "-k", "-t", k.Keytab, k.Principal)
+	} else {
+		args = append(args, "-R")
+		if k.Principal != "" {
+			args = append(args, k.Principal)
+		}
+	}
+	cmd := exec.CommandContext(ctx, kinitCommand, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", kinitCommand, err, msg)
+		}
+		return fmt.Errorf("%s: %w", kinitCommand, err)
+	}
+	return nil
+}
+
+// startKerberos points the GSS provider at the ticket cache of the
+// --krb-* flags, makes sure it holds a ticket, and renews it until ctx is
+// cancelled. The cache is process-wide, set through KRB5CCNAME, so Agents
+// running side by side share it.
+func (a *Agent) startKerberos(ctx context.Context) error {
+	k := a.opts.Kerberos
+	if !k.enabled() {
+		return nil
+	}
+	if k.CCache != "" {
+		os.Setenv("KRB5CCNAME", k.CCache)
+	}
+	if err := k.kinit(ctx); err != nil {
+		if k.Keytab != "" {
+			return fmt.Errorf("kerberos: %w", err)
+		}
+		// A ticket that can't be renewed may still be valid for a while.
+		log.Printf("⚠ Kerberos: could not renew the cached ticket: %v", err)
+	}
+	who := k.Principal
+	if who == "" {
+		who = "the cached principal"
+	}
+	log.Printf("Kerberos: authenticating as %s, renewing the ticket every %s", who, k.Renew)
+	go k.renew(ctx, a.reporter)
+	return nil
+}
+
+func (k Kerberos) renew(ctx context.Context, r *sentryReporter) {
+	defer r.reportPanic()
+	tick := time.NewTicker(k.Renew)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if err := k.kinit(ctx); err != nil && ctx.Err() == nil {
+			if k.Keytab != "" {
+				log.Printf("⚠ Kerberos: could not get a new ticket: %v", err)
+			} else {
+				log.Printf("⚠ Kerberos: could not renew the ticket, which new connections need; run kinit as the agent's user: %v", err)
+			}
+		}
+	}
+}
+
+// krbHint explains GSSAPI authentication failures.
+func krbHint(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no GSSAPI provider registered"):
+		return fmt.Errorf("%w (the server wants Kerberos: build the agent with -tags kerberos and set --krb-principal and --krb-keytab)", err)
+	case strings.Contains(msg, "kerberos error") || strings.Contains(msg, "KDC_ERR"):
+		return fmt.Errorf("%w (check the ticket cache with klist, and that the server's principal is postgres/<host>, or set krbsrvname or krbspn in the URL)", err)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// fakeKinit makes kinitCommand a script that appends its arguments to a
+// file, exiting with code, and returns that file.
+func fakeKinit(t *testing.T, code string) string {
+	t.Helper()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "kinit")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\necho 'kinit: Preauthentication failed' >&2\nexit "+code+"\n"), 0o755)
+	was := kinitCommand
+	kinitCommand = script
+	t.Cleanup(func() { kinitCommand = was })
+	return calls
+}
+
+func TestKerberosCheck(t *testing.T) {
+	fakeKinit(t, "0")
+	keytab := filepath.Join(t.TempDir(), "agent.keytab")
+	os.WriteFile(keytab, []byte{5, 2}, 0o600)
+	gssWas := newGSS
+	defer func() { newGSS = gssWas }()
+	newGSS = func() (pq.GSS, error) { return nil, errors.New("unused") }
+
+	tests := []struct {
+		name string
+		krb  Kerberos
+		err  string
+	}{
+		{"off", Kerberos{Renew: time.Hour}, ""},
+		{"keytab", Kerberos{Principal: "peekdb@EXAMPLE.COM", Keytab: keytab, Renew: time.Hour}, ""},
+		{"ticket cache", Kerberos{CCache: "/tmp/krb5cc_peekdb", Renew: time.Hour}, ""},
+		{"keytab without principal", Kerberos{Keytab: keytab, Renew: time.Hour}, "needs --krb-principal"},
+		{"missing keytab", Kerberos{Principal: "peekdb", Keytab: keytab + ".old", Renew: time.Hour}, "no such file"},
+		{"renewing too often", Kerberos{Principal: "peekdb", Keytab: keytab, Renew: time.Second}, "at least a minute"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.krb.check()
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	newGSS = nil
+	k := Kerberos{Principal: "peekdb", Keytab: keytab, Renew: time.Hour}
+	if err := k.check(); err == nil || !strings.Contains(err.Error(), "-tags kerberos") {
+		t.Errorf("expected an error about building without Kerberos, got %v", err)
+	}
+}
+
+func TestKerberosKinit(t *testing.T) {
+	tests := []struct {
+		krb  Kerberos
+		args string
+	}{
+		{Kerberos{Principal: "peekdb@EXAMPLE.COM", Keytab: "/etc/peekdb.keytab"}, "-k -t /etc/peekdb.keytab peekdb@EXAMPLE.COM"},
+		{Kerberos{Principal: "peekdb@EXAMPLE.COM", Keytab: "/etc/peekdb.keytab", CCache: "/tmp/cc"}, "-c /tmp/cc -k -t /etc/peekdb.keytab peekdb@EXAMPLE.COM"},
+		{Kerberos{CCache: "/tmp/cc"}, "-c /tmp/cc -R"},
+	}
+	for _, tc := range tests {
+		calls := fakeKinit(t, "0")
+		if err := tc.krb.kinit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := os.ReadFile(calls)
+		if got := strings.TrimSpace(string(buf)); got != tc.args {
+			t.Errorf("expected kinit %s, got %s", tc.args, got)
+		}
+	}
+
+	fakeKinit(t, "1")
+	k := Kerberos{Principal: "peekdb", Keytab: "/etc/peekdb.keytab"}
+	if err := k.kinit(context.Background()); err == nil || !strings.Contains(err.Error(), "Preauthentication failed") {
+		t.Errorf("expected kinit's message in the error, got %v", err)
+	}
+}
+
+func TestKerberosRenews(t *testing.T) {
+	calls := fakeKinit(t, "0")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Kerberos{CCache: "/tmp/cc", Renew: 10 * time.Millisecond}.renew(ctx, nil)
+	}()
+	// renew must have returned before fakeKinit's cleanup puts
+	// kinitCommand back.
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf, _ := os.ReadFile(calls)
+		if strings.Count(string(buf), "\n") >= 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the ticket renewed repeatedly, got kinit calls %q", buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartKerberosFailsWithoutTicket(t *testing.T) {
+	fakeKinit(t, "1")
+	a := bareAgent(DefaultOptions(), nil)
+	a.opts.Kerberos = Kerberos{Principal: "peekdb", Keytab: "/etc/peekdb.keytab", Renew: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := a.startKerberos(ctx); err == nil {
+		t.Error("expected startup to fail when the keytab gives no ticket")
+	}
+	// Without a keytab, a ticket that can't be renewed yet may still be good.
+	a.opts.Kerberos = Kerberos{CCache: filepath.Join(t.TempDir(), "cc"), Renew: time.Hour}
+	defer os.Unsetenv("KRB5CCNAME")
+	if err := a.startKerberos(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := os.Getenv("KRB5CCNAME"); got != a.opts.Kerberos.CCache {
+		t.Errorf("expected KRB5CCNAME %s, got %s", a.opts.Kerberos.CCache, got)
+	}
+}
+
+func TestKrbHint(t *testing.T) {
+	err := krbHint(errors.New("pq: kerberos error: no GSSAPI provider registered (import github.com/lib/pq/auth/kerberos)"))
+	if !strings.Contains(err.Error(), "-tags kerberos") {
+		t.Errorf("expected a hint about building with Kerberos, got %v", err)
+	}
+	if err := krbHint(errors.New("pq: password authentication failed")); strings.Contains(err.Error(), "klist") {
+		t.Errorf("expected no Kerberos hint, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const electionInterval = 10 * time.Second
+
+func defaultAgentID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "agent"
+	}
+	return host
+}
+
+// elector elects one leader among the agents whose connections to the same
+// Postgres database share a group. The leader holds a session-level advisory
+// lock on a connection of its own, so the database releases it as soon as
+// the leader stops or loses that connection, and another agent takes over
+// on its next attempt. Work that must run once, rather than once per agent,
+// should check isLeader; every agent serves interactive queries regardless.
+type elector struct {
+	name  string
+	group string
+	key   int64
+	db    *sql.DB
+
+	// agentID names this agent in the logs, and reporter gets a
+	// breadcrumb for each change of leader.
+	agentID  string
+	reporter *sentryReporter
+	// onLead, when set, is called each time this agent becomes leader.
+	onLead func()
+
+	mu     sync.Mutex
+	conn   *sql.Conn
+	leader bool
+	done   chan struct{}
+}
+
+func newElector(name, group string, db *sql.DB) *elector {
+	h := fnv.New64a()
+	h.Write([]byte("peekdb-agent:" + group))
+	return &elector{name: name, group: group, key: int64(h.Sum64()), db: db, done: make(chan struct{})}
+}
+
+func (e *elector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// step tries to take the lock, or checks that the session holding it is
+// still alive, and reports whether this agent leads afterwards.
+func (e *elector) step(ctx context.Context) bool {
+	e.mu.Lock()
+	was := e.leader
+	defer func() {
+		now := e.leader
+		e.mu.Unlock()
+		if now && !was && e.onLead != nil {
+			e.onLead()
+		}
+	}()
+
+	if e.conn != nil {
+		if err := e.conn.PingContext(ctx); err != nil {
+			log.Printf("[leader:%s] Lost the election connection: %v", e.name, err)
+			e.conn.Close()
+			e.conn, e.leader = nil, false
+		}
+	}
+	if e.conn == nil {
+		conn, err := e.db.Conn(ctx)
+		if err != nil {
+			log.Printf("[leader:%s] Could not connect: %v", e.name, err)
+			return false
+		}
+		var got bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&got); err != nil || !got {
+			if err != nil {
+				log.Printf("[leader:%s] Could not try the lock: %v", e.name, err)
+			}
+			conn.Close()
+			e.leader = false
+		} else {
+			e.conn, e.leader = conn, true
+		}
+	}
+
+	if e.leader != was {
+		if e.leader {
+			log.Printf("[leader:%s] %s is now the leader of %q", e.name, e.agentID, e.group)
+		} else {
+			log.Printf("[leader:%s] %s is no longer the leader of %q", e.name, e.agentID, e.group)
+		}
+		e.reporter.breadcrumb("leader", "%s leader=%v", e.name, e.leader)
+	}
+	return e.leader
+}
+
+func (e *elector) run(ctx context.Context) {
+	ticker := time.NewTicker(electionInterval)
+	defer ticker.Stop()
+	for {
+		stepCtx, cancel := context.WithTimeout(ctx, electionInterval)
+		e.step(stepCtx)
+		cancel()
+		select {
+		case <-e.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessions reports how many of the pool's connections the elector holds:
+// one while it holds the lock, none otherwise.
+func (e *elector) sessions() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		return 1
+	}
+	return 0
+}
+
+// Close gives up leadership, releasing the lock for the next agent at once.
+func (e *elector) Close() {
+	close(e.done)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn, e.leader = nil, false
+	}
+}
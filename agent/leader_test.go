@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestElector(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e := newElector("main", "billing", db)
+	if e.key != newElector("other", "billing", nil).key || e.key == newElector("main", "reports", nil).key {
+		t.Error("expected the lock key to depend on the group alone")
+	}
+	ctx := context.Background()
+
+	// Another agent leads.
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(e.key).WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+	if e.step(ctx) {
+		t.Error("expected to follow while the lock is taken")
+	}
+
+	// It goes away, and this agent takes over.
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(e.key).WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	if !e.step(ctx) {
+		t.Error("expected to lead once the lock is free")
+	}
+
+	// While the session lives, leading needs no new lock.
+	mock.ExpectPing()
+	if !e.step(ctx) {
+		t.Error("expected to keep leading")
+	}
+
+	// Losing the session loses the lead until the lock is won again.
+	mock.ExpectPing().WillReturnError(errors.New("connection reset"))
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(e.key).WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+	if e.step(ctx) || e.isLeader() {
+		t.Error("expected to step down after losing the session")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
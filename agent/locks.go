@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LocksResponse answers a "locks" message with every session that is
+// waiting on a lock or holding one that someone else waits for.
+type LocksResponse struct {
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Sessions []LockSession `json:"sessions"`
+	Error    string        `json:"error,omitempty"`
+
+	Connection string `json:"connection,omitempty"`
+}
+
+type LockSession struct {
+	PID          int     `json:"pid"`
+	User         string  `json:"user"`
+	Application  string  `json:"application"`
+	State        string  `json:"state"`
+	Query        string  `json:"query"`
+	QuerySeconds float64 `json:"query_seconds"`
+	// BlockedBy lists the PIDs holding the locks this session waits for;
+	// sessions that only block others have none.
+	BlockedBy     []int64 `json:"blocked_by"`
+	WaitEventType string  `json:"wait_event_type,omitempty"`
+	WaitEvent     string  `json:"wait_event,omitempty"`
+	LockType      string  `json:"lock_type,omitempty"`
+	LockMode      string  `json:"lock_mode,omitempty"`
+	Relation      string  `json:"relation,omitempty"`
+}
+
+const locksQuery = `
+WITH waiting AS (
+  SELECT pid, pg_blocking_pids(pid) AS blocked_by
+  FROM pg_stat_activity
+  WHERE cardinality(pg_blocking_pids(pid)) > 0
+)
+SELECT a.pid, coalesce(a.usename, ''), a.application_name, coalesce(a.state, ''),
+       coalesce(a.query, ''),
+       coalesce(extract(epoch FROM now() - a.query_start), 0)::float8,
+       coalesce(w.blocked_by, '{}'),
+       coalesce(a.wait_event_type, ''), coalesce(a.wait_event, ''),
+       coalesce(l.locktype, ''), coalesce(l.mode, ''), coalesce(l.relation::regclass::text, '')
+FROM pg_stat_activity a
+LEFT JOIN waiting w ON w.pid = a.pid
+LEFT JOIN pg_locks l ON l.pid = a.pid AND NOT l.granted
+WHERE a.pid IN (SELECT pid FROM waiting UNION SELECT unnest(blocked_by) FROM waiting)
+ORDER BY a.pid`
+
+func listLocks(msg Message) LocksResponse {
+	resp := LocksResponse{ID: msg.ID, Type: "locks"}
+	c, err := msg.route()
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		resp.Error = fmt.Sprintf("locks is not supported for %s", c.Flavor())
+		return resp
+	}
+
+	log.Printf("[locks:%s] Reading lock waits", msg.ID)
+	start := time.Now()
+	sessions, err := loadLockSessions(sc.db)
+	if err != nil {
+		log.Printf("[locks:%s] Error: %v", msg.ID, err)
+		resp.Error = err.Error()
+		return resp
+	}
+	log.Printf("[locks:%s] Completed in %v, %d sessions", msg.ID, time.Since(start), len(sessions))
+	resp.Sessions = sessions
+	return resp
+}
+
+func loadLockSessions(q queryer) ([]LockSession, error) {
+	rows, err := q.Query(locksQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []LockSession{}
+	for rows.Next() {
+		var s LockSession
+		var blockedBy pq.Int64Array
+		var app sql.NullString
+		if err := rows.Scan(&s.PID, &s.User, &app, &s.State, &s.Query, &s.QuerySeconds, &blockedBy,
+			&s.WaitEventType, &s.WaitEvent, &s.LockType, &s.LockMode, &s.Relation); err != nil {
+			return nil, err
+		}
+		s.Application = app.String
+		s.BlockedBy = []int64(blockedBy)
+		if s.BlockedBy == nil {
+			s.BlockedBy = []int64{}
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestListLocks(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(
+		&connection{Name: "default", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+		&connection{Name: "crdb", Connector: &sqlConnector{flavor: "cockroach"}},
+	)
+
+	cols := []string{"pid", "usename", "application_name", "state", "query", "query_seconds", "blocked_by",
+		"wait_event_type", "wait_event", "locktype", "mode", "relation"}
+	mock.ExpectQuery("WITH waiting AS").WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(101, "app", "psql", "idle in transaction", "UPDATE accounts SET balance = 0", 42.5, "{}", "Client", "ClientRead", "", "", "").
+		AddRow(202, "peekdb", nil, "active", "SELECT * FROM accounts FOR UPDATE", 3.0, "{101}", "Lock", "transactionid", "transactionid", "ShareLock", ""))
+
+	resp := listLocks(Message{ID: "l1", tenant: tn})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if resp.Type != "locks" || resp.Connection != "default" {
+		t.Errorf("unexpected response header: %+v", resp)
+	}
+	if len(resp.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(resp.Sessions))
+	}
+	blocker, waiter := resp.Sessions[0], resp.Sessions[1]
+	if blocker.PID != 101 || len(blocker.BlockedBy) != 0 || blocker.QuerySeconds != 42.5 {
+		t.Errorf("unexpected blocker: %+v", blocker)
+	}
+	if waiter.PID != 202 || len(waiter.BlockedBy) != 1 || waiter.BlockedBy[0] != 101 || waiter.LockMode != "ShareLock" {
+		t.Errorf("unexpected waiter: %+v", waiter)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	resp = listLocks(Message{ID: "l2", Target: "crdb", tenant: tn})
+	if resp.Error != "locks is not supported for cockroach" {
+		t.Errorf("unexpected error: %q", resp.Error)
+	}
+}
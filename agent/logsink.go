@@ -0,0 +1,352 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSinkConfig is one entry of the config file's "logs" list. The agent
+// writes every log line to each sink; with no list it logs to stderr.
+type LogSinkConfig struct {
+	// Type is stderr, file, syslog or webhook.
+	Type string `json:"type"`
+
+	// Path, for a file, is where the current log goes. The file is rotated
+	// to Path.<timestamp> once it grows past MaxSizeMB (default 100) or is
+	// older than MaxAge, keeping MaxBackups (default 5) rotated files.
+	Path       string   `json:"path,omitempty"`
+	MaxSizeMB  int      `json:"max_size_mb,omitempty"`
+	MaxAge     duration `json:"max_age,omitempty"`
+	MaxBackups int      `json:"max_backups,omitempty"`
+
+	// Network and Address reach a syslog daemon, e.g. "udp" and
+	// "logs.internal:514"; both empty means the local daemon. Tag defaults
+	// to peekdb-agent.
+	Network string `json:"network,omitempty"`
+	Address string `json:"address,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+
+	// URL receives batches of lines as JSON POSTs, with Headers added.
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// logSinks fans log lines out to every configured sink.
+type logSinks struct {
+	sinks []io.Writer
+}
+
+// logOutputs are the writers redirectLog has set on the standard logger,
+// the one in use last, and the logger's writer before the first.
+var logOutputs struct {
+	sync.Mutex
+	base  io.Writer
+	stack []*io.Writer
+}
+
+// redirectLog sends the standard logger to w until the returned function
+// is called. The logger is process-wide: while several Agents run, it
+// writes to the sinks of the one started last, and goes back to the
+// previous one's as each stops.
+func redirectLog(w io.Writer) func() {
+	logOutputs.Lock()
+	defer logOutputs.Unlock()
+	if len(logOutputs.stack) == 0 {
+		logOutputs.base = log.Writer()
+	}
+	e := &w
+	logOutputs.stack = append(logOutputs.stack, e)
+	log.SetOutput(w)
+	return func() {
+		logOutputs.Lock()
+		defer logOutputs.Unlock()
+		logOutputs.stack = slices.DeleteFunc(logOutputs.stack, func(o *io.Writer) bool { return o == e })
+		if n := len(logOutputs.stack); n > 0 {
+			log.SetOutput(*logOutputs.stack[n-1])
+		} else {
+			log.SetOutput(logOutputs.base)
+		}
+	}
+}
+
+// openLogSinks opens configs; name, the agent's --name, labels the lines
+// webhook sinks post.
+func openLogSinks(configs []LogSinkConfig, name string) (*logSinks, error) {
+	s := &logSinks{}
+	if len(configs) == 0 {
+		s.sinks = append(s.sinks, os.Stderr)
+		return s, nil
+	}
+	for i, cfg := range configs {
+		var w io.Writer
+		var err error
+		switch cfg.Type {
+		case "stderr":
+			w = os.Stderr
+		case "file":
+			w, err = openRotatingFile(cfg)
+		case "syslog":
+			w, err = openSyslog(cfg)
+		case "webhook":
+			w, err = newWebhookSink(cfg, name)
+		default:
+			err = fmt.Errorf("unknown type %q: expected stderr, file, syslog or webhook", cfg.Type)
+		}
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("log sink %d: %w", i+1, err)
+		}
+		s.sinks = append(s.sinks, w)
+	}
+	return s, nil
+}
+
+// Write sends p to every sink. A failing sink doesn't stop the others, and
+// there is nowhere to report the failure, so it is dropped.
+func (s *logSinks) Write(p []byte) (int, error) {
+	for _, w := range s.sinks {
+		w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s *logSinks) Close() error {
+	for _, w := range s.sinks {
+		if c, ok := w.(io.Closer); ok && w != os.Stderr {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// rotatingFile is a log file that is renamed aside and started afresh when
+// it gets too big or too old.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	created time.Time
+	now     func() time.Time
+}
+
+func openRotatingFile(cfg LogSinkConfig) (*rotatingFile, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file sink needs a path")
+	}
+	r := &rotatingFile{
+		path:       cfg.Path,
+		maxSize:    int64(cfg.MaxSizeMB) << 20,
+		maxAge:     time.Duration(cfg.MaxAge),
+		maxBackups: cfg.MaxBackups,
+		now:        time.Now,
+	}
+	if r.maxSize <= 0 {
+		r.maxSize = 100 << 20
+	}
+	if r.maxBackups <= 0 {
+		r.maxBackups = 5
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.created = f, info.Size(), r.now()
+	if info.Size() > 0 {
+		// Date a file left by an earlier run by its last write, so a
+		// restart doesn't reset its age.
+		r.created = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || r.maxAge > 0 && r.now().Sub(r.created) > r.maxAge) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and removes the oldest backups.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	backup := r.path + "." + r.now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	backups, _ := filepath.Glob(r.path + ".*")
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+const (
+	webhookBatch    = 100
+	webhookInterval = 5 * time.Second
+	webhookQueue    = 1000
+)
+
+// webhookSink posts log lines in batches from a background goroutine, so a
+// slow endpoint never holds up the agent. Lines beyond the queue are
+// dropped and counted in the next batch.
+type webhookSink struct {
+	agent   string
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	lines   chan string
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+	done    chan struct{}
+}
+
+func newWebhookSink(cfg LogSinkConfig, agent string) (*webhookSink, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("webhook sink needs an http or https url")
+	}
+	w := &webhookSink{
+		agent:   agent,
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		lines:   make(chan string, webhookQueue),
+		done:    make(chan struct{}),
+	}
+	go w.run(webhookInterval)
+	return w, nil
+}
+
+func (w *webhookSink) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	select {
+	case w.lines <- strings.TrimSuffix(string(p), "\n"):
+	default:
+		w.dropped++
+	}
+	return len(p), nil
+}
+
+func (w *webhookSink) run(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []string
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				w.post(batch)
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) < webhookBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		w.post(batch)
+		batch = batch[:0]
+	}
+}
+
+type webhookPayload struct {
+	Agent   string   `json:"agent,omitempty"`
+	Lines   []string `json:"lines"`
+	Dropped int      `json:"dropped,omitempty"`
+}
+
+func (w *webhookSink) post(batch []string) {
+	w.mu.Lock()
+	dropped := w.dropped
+	w.dropped = 0
+	w.mu.Unlock()
+	if len(batch) == 0 && dropped == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(webhookPayload{Agent: w.agent, Lines: batch, Dropped: dropped})
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// Logging the failure would feed it back into this sink.
+		fmt.Fprintf(os.Stderr, "log webhook failed: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "log webhook failed: %s\n", resp.Status)
+	}
+}
+
+// Close sends what is queued and stops the sender.
+func (w *webhookSink) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	r, err := openRotatingFile(LogSinkConfig{Path: path, MaxBackups: 2, MaxAge: duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.maxSize = 100
+
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return clock }
+	r.created = clock
+
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 2; i++ {
+		r.Write([]byte(line))
+	}
+	// The third line would take the file past 100 bytes.
+	clock = clock.Add(time.Second)
+	r.Write([]byte(line))
+	// An hour and a bit later the file is too old, however small.
+	clock = clock.Add(61 * time.Minute)
+	r.Write([]byte(line))
+	// A third rotation leaves only the two newest backups.
+	clock = clock.Add(61 * time.Minute)
+	r.Write([]byte(line))
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups, got %v", backups)
+	}
+	if cur, _ := os.ReadFile(path); string(cur) != line {
+		t.Errorf("expected the current file to hold one line, got %q", cur)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k" {
+			t.Errorf("expected the configured header, got %q", r.Header.Get("Authorization"))
+		}
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		if p.Agent != "web-1" {
+			t.Errorf("expected the lines labelled with the agent's name, got %q", p.Agent)
+		}
+		mu.Lock()
+		got = append(got, p.Lines...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	w, err := newWebhookSink(LogSinkConfig{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer k"}}, "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("one\n"))
+	w.Write([]byte("two\n"))
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("expected both lines on close, got %q", got)
+	}
+	if _, err := w.Write([]byte("late\n")); err == nil {
+		t.Error("expected a write after close to fail")
+	}
+}
+
+func TestOpenLogSinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []LogSinkConfig
+		wantErr bool
+	}{
+		{name: "default stderr"},
+		{name: "file and stderr", configs: []LogSinkConfig{{Type: "stderr"}, {Type: "file", Path: filepath.Join(t.TempDir(), "a.log")}}},
+		{name: "file without path", configs: []LogSinkConfig{{Type: "file"}}, wantErr: true},
+		{name: "webhook without url", configs: []LogSinkConfig{{Type: "webhook"}}, wantErr: true},
+		{name: "unknown type", configs: []LogSinkConfig{{Type: "kafka"}}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := openLogSinks(tc.configs, "")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			s.Close()
+		})
+	}
+}
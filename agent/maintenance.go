@@ -0,0 +1,251 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maintenanceState is an agent's maintenance mode: while it is on the
+// agent reports itself unavailable, finishes what it has started and
+// refuses new work, so the database can be patched without queries failing
+// mid-way. The local admin server at --admin-addr, which the "maintenance"
+// command talks to, turns it on and off.
+type maintenanceState struct {
+	mu       sync.Mutex
+	on       bool
+	since    time.Time
+	inFlight int
+	// onChange, if set, runs after maintenance is turned on or off.
+	onChange func()
+}
+
+// maintenanceAllowed are the messages answered in maintenance mode: none
+// of them start anything on a database.
+var maintenanceAllowed = map[string]bool{
+	"cancel":        true,
+	"promote":       true,
+	"history":       true,
+	"usage_report":  true,
+	"config_update": true,
+	"job_status":    true,
+	"job_result":    true,
+	"page":          true,
+	"alerts":        true,
+}
+
+// MaintenanceStatus is the admin server's reply, and what the maintenance
+// command prints.
+type MaintenanceStatus struct {
+	Maintenance bool       `json:"maintenance"`
+	Since       *time.Time `json:"since,omitempty"`
+	InFlight    int        `json:"in_flight"`
+	// Drained is set when turning maintenance on found nothing left in
+	// flight before the wait ran out.
+	Drained bool `json:"drained,omitempty"`
+}
+
+// admit returns the reply refusing msg in maintenance mode, or nil and a
+// func to call once msg has been handled. Checking and counting under one
+// lock means a drain never misses a message that got in.
+func (m *maintenanceState) admit(msg Message) (any, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.on && !maintenanceAllowed[msg.Type] {
+		return queryError(msg.ID, codedErrorf(codeMaintenance, "the agent is in maintenance mode and accepts no new work")), nil
+	}
+	m.inFlight++
+	return nil, m.finish
+}
+
+// begin counts work started other than by a message, such as an export
+// job, and returns the func to call when it is done.
+func (m *maintenanceState) begin() func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+	return m.finish
+}
+
+func (m *maintenanceState) finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+}
+
+func (m *maintenanceState) active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.on
+}
+
+// whenChanged sets f to run after maintenance is turned on or off.
+func (m *maintenanceState) whenChanged(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = f
+}
+
+// set turns maintenance on or off and, if that changed anything, logs it
+// and tells the hub.
+func (m *maintenanceState) set(on bool) {
+	m.mu.Lock()
+	changed, then := m.on != on, m.onChange
+	m.on = on
+	if changed && on {
+		m.since = time.Now()
+	}
+	m.mu.Unlock()
+	if !changed {
+		return
+	}
+	if on {
+		log.Printf("Maintenance mode on: refusing new work")
+	} else {
+		log.Printf("Maintenance mode off")
+	}
+	if then != nil {
+		then()
+	}
+}
+
+func (m *maintenanceState) status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MaintenanceStatus{Maintenance: m.on, InFlight: m.inFlight}
+	if m.on {
+		since := m.since
+		s.Since = &since
+	}
+	return s
+}
+
+// drain waits up to wait for the work in flight to finish and reports
+// whether it did.
+func (m *maintenanceState) drain(wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for {
+		if m.status().InFlight == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// maintenanceHandler serves the admin server's /maintenance: GET reports
+// the mode, POST with state=on or state=off changes it. Turning it on
+// waits for the work in flight, up to wait (default 5m), before replying.
+func (a *Agent) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	maintenance := a.maintenance
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		wait := 5 * time.Minute
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid wait %q", v), http.StatusBadRequest)
+				return
+			}
+			wait = d
+		}
+		switch state := r.URL.Query().Get("state"); state {
+		case "on":
+			maintenance.set(true)
+			drained := maintenance.drain(wait)
+			s := maintenance.status()
+			s.Drained = drained
+			writeMaintenanceStatus(w, s)
+			return
+		case "off":
+			maintenance.set(false)
+		default:
+			http.Error(w, fmt.Sprintf("state must be on or off, not %q", state), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	writeMaintenanceStatus(w, maintenance.status())
+}
+
+func writeMaintenanceStatus(w http.ResponseWriter, s MaintenanceStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// RunMaintenance is the "maintenance" command: it asks the agent at
+// --admin-addr to turn maintenance on or off, or reports it. It returns the
+// process exit code, 1 when the agent could not be reached or still had
+// work in flight when the wait ran out.
+func RunMaintenance(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("admin-addr", os.Getenv("PEEKDB_ADMIN_ADDR"), "Admin address of the running agent")
+	wait := fs.Duration("wait", 5*time.Minute, "How long to wait for work in flight to finish")
+	fs.Usage = func() {
+		fmt.Fprintln(w, "Usage: peekdb-agent maintenance on|off|status [--admin-addr addr] [--wait 5m]")
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *addr == "" {
+		fmt.Fprintln(w, "✗ Admin address required: --admin-addr or PEEKDB_ADMIN_ADDR env")
+		return 2
+	}
+
+	url := "http://" + *addr + "/maintenance"
+	var resp *http.Response
+	var err error
+	switch cmd {
+	case "on", "off":
+		resp, err = http.Post(fmt.Sprintf("%s?state=%s&wait=%s", url, cmd, *wait), "", nil)
+	case "status":
+		resp, err = http.Get(url)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(w, "✗ Could not reach the agent: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(w, "✗ The agent refused: %s\n", body)
+		return 1
+	}
+	var s MaintenanceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		fmt.Fprintf(w, "✗ Could not read the agent's reply: %v\n", err)
+		return 1
+	}
+
+	if !s.Maintenance {
+		fmt.Fprintf(w, "✓ Maintenance mode off; %d in flight\n", s.InFlight)
+		return 0
+	}
+	fmt.Fprintf(w, "✓ Maintenance mode on since %s\n", s.Since.Format(time.RFC3339))
+	if cmd == "on" && !s.Drained {
+		fmt.Fprintf(w, "✗ Still %d in flight after %v\n", s.InFlight, *wait)
+		return 1
+	}
+	fmt.Fprintf(w, "  %d in flight\n", s.InFlight)
+	return 0
+}
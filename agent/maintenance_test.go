@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceRefusesNewWork(t *testing.T) {
+	tn := testTenant()
+	tn.agent.maintenance.set(true)
+
+	resp, ok := handleMessage(Message{Type: "query", ID: "q1", SQL: "SELECT 1", tenant: tn}).(QueryResponse)
+	if !ok || resp.ErrorCode != codeMaintenance {
+		t.Fatalf("expected a maintenance refusal, got %+v", resp)
+	}
+	if _, ok := handleMessage(Message{Type: "history", ID: "h1", tenant: tn}).(HistoryResponse); !ok {
+		t.Error("expected history to be answered in maintenance mode")
+	}
+	if s := tn.agent.maintenance.status(); s.InFlight != 0 {
+		t.Errorf("expected nothing in flight, got %d", s.InFlight)
+	}
+}
+
+func TestMaintenanceDrain(t *testing.T) {
+	maintenance := &maintenanceState{}
+	_, done := maintenance.admit(Message{Type: "query", ID: "q1"})
+	maintenance.set(true)
+
+	if maintenance.drain(50 * time.Millisecond) {
+		t.Fatal("expected the drain to wait for the query in flight")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+	if !maintenance.drain(5 * time.Second) {
+		t.Error("expected the drain to finish with the query")
+	}
+}
+
+func TestMaintenanceCommand(t *testing.T) {
+	t.Setenv("PEEKDB_ADMIN_ADDR", "")
+	a := bareAgent(DefaultOptions(), nil)
+	srv := httptest.NewServer(http.HandlerFunc(a.maintenanceHandler))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+		wantOn   bool
+	}{
+		{name: "status", args: []string{"status", "--admin-addr", addr}, wantOut: "Maintenance mode off"},
+		{name: "on", args: []string{"on", "--admin-addr", addr, "--wait", "1s"}, wantOut: "0 in flight", wantOn: true},
+		{name: "status while on", args: []string{"status", "--admin-addr", addr}, wantOut: "Maintenance mode on", wantOn: true},
+		{name: "off", args: []string{"off", "--admin-addr", addr}, wantOut: "Maintenance mode off"},
+		{name: "unknown command", args: []string{"restart", "--admin-addr", addr}, wantCode: 2},
+		{name: "no address", args: []string{"on"}, wantCode: 2, wantOut: "Admin address required"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := RunMaintenance(tc.args, &out); code != tc.wantCode {
+				t.Fatalf("expected exit code %d, got %d: %s", tc.wantCode, code, out.String())
+			}
+			if !strings.Contains(out.String(), tc.wantOut) {
+				t.Errorf("expected output to contain %q, got %q", tc.wantOut, out.String())
+			}
+			if a.maintenance.active() != tc.wantOn {
+				t.Errorf("expected maintenance %v", tc.wantOn)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// MatViewsResponse answers a "matviews" message with the connection's
+// materialized views.
+type MatViewsResponse struct {
+	ID    string    `json:"id"`
+	Type  string    `json:"type"`
+	Views []MatView `json:"views"`
+	Error string    `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+type MatView struct {
+	Schema    string `json:"schema"`
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	Populated bool   `json:"populated"`
+	// UniqueIndex is set when the view has the unique index REFRESH ...
+	// CONCURRENTLY needs.
+	UniqueIndex bool    `json:"unique_index"`
+	SizeBytes   int64   `json:"size_bytes"`
+	Rows        float64 `json:"rows"`
+	// Postgres doesn't record refreshes, so LastRefresh is the last one
+	// this agent ran since it started, with how long it took.
+	LastRefresh           *time.Time `json:"last_refresh,omitempty"`
+	LastRefreshMillis     float64    `json:"last_refresh_ms,omitempty"`
+	LastRefreshConcurrent bool       `json:"last_refresh_concurrent,omitempty"`
+}
+
+const matViewsQuery = `
+SELECT m.schemaname, m.matviewname, m.matviewowner, m.ispopulated,
+       EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisunique AND i.indpred IS NULL AND i.indexprs IS NULL),
+       pg_total_relation_size(c.oid), greatest(c.reltuples, 0)::float8
+FROM pg_matviews m
+JOIN pg_namespace n ON n.nspname = m.schemaname
+JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = m.matviewname
+ORDER BY m.schemaname, m.matviewname`
+
+// refreshKey names a materialized view on one connector.
+type refreshKey struct {
+	connector    Connector
+	schema, name string
+}
+
+type refreshRecord struct {
+	at         time.Time
+	took       time.Duration
+	concurrent bool
+}
+
+// refreshLog remembers the last refresh of each view the agent ran.
+type refreshLog struct {
+	sync.Mutex
+	last map[refreshKey]refreshRecord
+}
+
+func newRefreshLog() *refreshLog {
+	return &refreshLog{last: map[refreshKey]refreshRecord{}}
+}
+
+// listMatViews answers a "matviews" message. Views in schemas the token
+// may not see are left out.
+func listMatViews(msg Message) MatViewsResponse {
+	resp := MatViewsResponse{ID: msg.ID, Type: "matviews"}
+	fail := func(err error) MatViewsResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return fail(codedErrorf(codeNotSupported, "matviews is not supported for %s", c.Flavor()))
+	}
+
+	log.Printf("[matviews:%s] Reading materialized views", msg.ID)
+	views, err := loadMatViews(sc)
+	if err != nil {
+		log.Printf("[matviews:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	caps := msg.capabilities()
+	resp.Views = []MatView{}
+	for _, v := range views {
+		if caps.schemaAllowed(v.Schema) {
+			resp.Views = append(resp.Views, v)
+		}
+	}
+	return resp
+}
+
+func loadMatViews(sc *sqlConnector) ([]MatView, error) {
+	rows, err := sc.db.Query(matViewsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []MatView
+	for rows.Next() {
+		var v MatView
+		if err := rows.Scan(&v.Schema, &v.Name, &v.Owner, &v.Populated, &v.UniqueIndex, &v.SizeBytes, &v.Rows); err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refreshes := sc.owner().refreshes
+	refreshes.Lock()
+	defer refreshes.Unlock()
+	for i, v := range views {
+		if r, ok := refreshes.last[refreshKey{sc, v.Schema, v.Name}]; ok {
+			at := r.at
+			views[i].LastRefresh, views[i].LastRefreshMillis, views[i].LastRefreshConcurrent = &at, millis(r.took), r.concurrent
+		}
+	}
+	return views, nil
+}
+
+// RefreshResponse answers a "refresh_matview" message.
+type RefreshResponse struct {
+	ID           string  `json:"id"`
+	Type         string  `json:"type"`
+	Schema       string  `json:"schema,omitempty"`
+	Name         string  `json:"name,omitempty"`
+	Concurrently bool    `json:"concurrently"`
+	Millis       float64 `json:"duration_ms,omitempty"`
+	Error        string  `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// refreshMatView runs REFRESH MATERIALIZED VIEW on msg.Identifier, a view
+// written as in a statement, CONCURRENTLY with mode "concurrently". Like
+// kill_session it needs admin on the connection, and every attempt is
+// audited. It runs as a query with the message's ID, so "cancel" stops
+// it.
+func refreshMatView(msg Message) RefreshResponse {
+	resp := RefreshResponse{ID: msg.ID, Type: "refresh_matview_result", Concurrently: msg.Mode == "concurrently"}
+	event := AuditEvent{Action: "refresh_matview", MessageID: msg.ID, Detail: msg.Identifier}
+	defer func() {
+		event.Connection = resp.Connection
+		event.Error = resp.Error
+		if resp.Concurrently {
+			event.Detail += " concurrently"
+		}
+		msg.agent().audit(event)
+	}()
+	fail := func(err error) RefreshResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	if !c.Admin {
+		return fail(codedErrorf(codePolicyDenied, "refresh_matview requires admin to be enabled for connection %q", c.Name))
+	}
+	caps := msg.capabilities()
+	if c.ReadOnly || caps.ReadOnly {
+		return fail(codedErrorf(codePolicyDenied, "refresh_matview is not allowed on a read-only connection"))
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return fail(codedErrorf(codeNotSupported, "refresh_matview is not supported for %s", c.Flavor()))
+	}
+	switch msg.Mode {
+	case "", "concurrently":
+	default:
+		return fail(codedErrorf(codeInvalidRequest, "unknown mode %q: expected concurrently or none", msg.Mode))
+	}
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return fail(err)
+	}
+	if len(parts) > 2 {
+		return fail(codedErrorf(codeInvalidRequest, "%q is not a materialized view: expected view or schema.view", msg.Identifier))
+	}
+
+	views, err := loadMatViews(sc)
+	if err != nil {
+		return fail(err)
+	}
+	d := dialectFor(sc.flavor)
+	v, err := findMatView(views, parts, d)
+	if err != nil {
+		return fail(err)
+	}
+	resp.Schema, resp.Name = v.Schema, v.Name
+	if !caps.schemaAllowed(v.Schema) {
+		return fail(codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", v.Schema))
+	}
+	if resp.Concurrently && (!v.Populated || !v.UniqueIndex) {
+		return fail(codedErrorf(codeInvalidRequest, "%s.%s can't be refreshed concurrently: that needs a populated view with a unique index", v.Schema, v.Name))
+	}
+
+	stmt := "REFRESH MATERIALIZED VIEW "
+	if resp.Concurrently {
+		stmt += "CONCURRENTLY "
+	}
+	stmt += d.quoted(v.Schema) + "." + d.quoted(v.Name)
+
+	ctx, done := msg.agent().running.start(msg.context(), msg.ID, msg.tenant, sc)
+	defer done()
+	log.Printf("[refresh:%s] %s", msg.ID, stmt)
+	start := time.Now()
+	if _, err := sc.db.ExecContext(ctx, stmt); err != nil {
+		log.Printf("[refresh:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	took := time.Since(start)
+	resp.Millis = millis(took)
+	log.Printf("[refresh:%s] Completed in %v", msg.ID, took)
+
+	refreshes := sc.owner().refreshes
+	refreshes.Lock()
+	refreshes.last[refreshKey{sc, v.Schema, v.Name}] = refreshRecord{at: start, took: took, concurrent: resp.Concurrently}
+	refreshes.Unlock()
+	return resp
+}
+
+// findMatView finds the view parts name among views. A bare name must be
+// the only view so named.
+func findMatView(views []MatView, parts []sqlToken, d identDialect) (MatView, error) {
+	name := d.name(parts[len(parts)-1])
+	var schema string
+	if len(parts) == 2 {
+		schema = d.name(parts[0])
+	}
+	var found []MatView
+	for _, v := range views {
+		if v.Name == name && (schema == "" || v.Schema == schema) {
+			found = append(found, v)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return MatView{}, codedErrorf(codeInvalidRequest, "materialized view %s not found", d.qualifiedSQL(parts))
+	case 1:
+		return found[0], nil
+	}
+	var schemas []string
+	for _, v := range found {
+		schemas = append(schemas, v.Schema)
+	}
+	return MatView{}, codedErrorf(codeInvalidRequest, "materialized view %s is in more than one schema (%v); qualify it", d.qualifiedSQL(parts), schemas)
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func matViewRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"schemaname", "matviewname", "matviewowner", "ispopulated", "unique", "size", "rows"}).
+		AddRow("public", "daily_sales", "app", true, true, 8192, 31).
+		AddRow("public", "Top Customers", "app", true, false, 16384, 100).
+		AddRow("reporting", "daily_sales", "app", false, true, 0, 0).
+		AddRow("secret", "payroll", "app", true, true, 8192, 12)
+}
+
+func TestListMatViews(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public", "reporting"}})
+	mock.ExpectQuery("FROM pg_matviews").WillReturnRows(matViewRows())
+
+	resp := listMatViews(Message{ID: "m1", tenant: tn})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	var got []string
+	for _, v := range resp.Views {
+		got = append(got, v.Schema+"."+v.Name)
+	}
+	if want := "public.daily_sales public.Top Customers reporting.daily_sales"; strings.Join(got, " ") != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	crdb := testTenant(&connection{Name: "crdb", Connector: &sqlConnector{db: mockDB, flavor: "cockroach"}})
+	if resp := listMatViews(Message{ID: "m2", tenant: crdb}); resp.ErrorCode != codeNotSupported {
+		t.Errorf("expected %s on cockroach, got %+v", codeNotSupported, resp)
+	}
+}
+
+func TestRefreshMatView(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+
+	tn := testTenant(
+		&connection{Name: "prod", Admin: true, Connector: pg},
+		&connection{Name: "replica", Admin: true, ReadOnly: true, Connector: pg},
+		&connection{Name: "plain", Connector: pg},
+	)
+	tn.agent.opts.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	pg.agent = tn.agent
+
+	tests := []struct {
+		name     string
+		msg      Message
+		refresh  string
+		wantErr  string
+		wantCode string
+	}{
+		{
+			name:    "qualified",
+			msg:     Message{ID: "r1", Identifier: "public.daily_sales"},
+			refresh: `REFRESH MATERIALIZED VIEW "public"."daily_sales"`,
+		},
+		{
+			name:    "concurrently, quoted",
+			msg:     Message{ID: "r2", Identifier: `"Top Customers"`, Mode: "concurrently"},
+			wantErr: `public.Top Customers can't be refreshed concurrently: that needs a populated view with a unique index`,
+		},
+		{
+			name:    "concurrently",
+			msg:     Message{ID: "r3", Identifier: "Public.Daily_Sales", Mode: "concurrently"},
+			refresh: `REFRESH MATERIALIZED VIEW CONCURRENTLY "public"."daily_sales"`,
+		},
+		{
+			name:    "ambiguous",
+			msg:     Message{ID: "r4", Identifier: "daily_sales"},
+			wantErr: `materialized view "daily_sales" is in more than one schema ([public reporting]); qualify it`,
+		},
+		{
+			name:    "missing",
+			msg:     Message{ID: "r5", Identifier: "public.nope"},
+			wantErr: `materialized view "public"."nope" not found`,
+		},
+		{
+			name:     "admin disabled",
+			msg:      Message{ID: "r6", Identifier: "public.daily_sales", Target: "plain"},
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "read-only",
+			msg:      Message{ID: "r7", Identifier: "public.daily_sales", Target: "replica"},
+			wantCode: codePolicyDenied,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.wantCode == "" {
+				mock.ExpectQuery("FROM pg_matviews").WillReturnRows(matViewRows())
+			}
+			if tc.refresh != "" {
+				mock.ExpectExec(regexp.QuoteMeta(tc.refresh)).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			resp := refreshMatView(tc.msg)
+			if tc.wantCode != "" {
+				if resp.ErrorCode != tc.wantCode {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+			} else if resp.Error != tc.wantErr {
+				t.Errorf("error = %q, want %q", resp.Error, tc.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+
+	// The listing shows the refresh the agent ran.
+	mock.ExpectQuery("FROM pg_matviews").WillReturnRows(matViewRows())
+	resp := listMatViews(Message{ID: "m1", tenant: tn})
+	if v := resp.Views[0]; v.LastRefresh == nil || !v.LastRefreshConcurrent {
+		t.Errorf("expected the concurrent refresh recorded, got %+v", v)
+	}
+
+	log, err := os.ReadFile(tn.agent.opts.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(log), `"action":"refresh_matview"`); n != len(tests) {
+		t.Errorf("expected %d audited refreshes, got %d:\n%s", len(tests), n, log)
+	}
+	if !strings.Contains(string(log), `"detail":"Public.Daily_Sales concurrently"`) {
+		t.Errorf("expected the concurrent refresh audited, got:\n%s", log)
+	}
+}
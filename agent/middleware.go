@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query is a query message on its way to the connection it targets.
+// Middleware may change the message, e.g. rewrite its SQL, before passing
+// the query on.
+type Query struct {
+	Message
+	// Connection is the name of the connection the query runs on, and
+	// Flavor its database.
+	Connection string
+	Flavor     string
+
+	conn *connection
+}
+
+// QueryHandler runs a query and returns its response.
+type QueryHandler func(q *Query) QueryResponse
+
+// QueryMiddleware is one step around running a query: it can refuse the
+// query, change it, change its response, or watch both go by. Wrap returns
+// a handler that does so and calls next to run the query.
+type QueryMiddleware interface {
+	Name() string
+	Wrap(next QueryHandler) QueryHandler
+}
+
+// QueryMiddlewareFactory builds a middleware from its "options" in the
+// config file, which are nil when it has none.
+type QueryMiddlewareFactory func(options json.RawMessage) (QueryMiddleware, error)
+
+// QueryMiddlewareConfig adds a registered middleware to the chain.
+type QueryMiddlewareConfig struct {
+	Name    string          `json:"name"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+var middlewareFactories = struct {
+	sync.Mutex
+	byName map[string]QueryMiddlewareFactory
+}{byName: map[string]QueryMiddlewareFactory{}}
+
+// RegisterQueryMiddleware makes a middleware available to the config
+// file's query_middleware under name. Programs embedding the agent call it
+// before New, typically from an init function.
+func RegisterQueryMiddleware(name string, f QueryMiddlewareFactory) {
+	middlewareFactories.Lock()
+	defer middlewareFactories.Unlock()
+	if _, ok := middlewareFactories.byName[name]; ok {
+		panic(fmt.Sprintf("query middleware %q registered twice", name))
+	}
+	middlewareFactories.byName[name] = f
+}
+
+// buildQueryMiddleware returns the middleware the config file lists, in
+// order.
+func buildQueryMiddleware(configs []QueryMiddlewareConfig) ([]QueryMiddleware, error) {
+	middlewareFactories.Lock()
+	defer middlewareFactories.Unlock()
+	var mws []QueryMiddleware
+	for i, cfg := range configs {
+		f, ok := middlewareFactories.byName[cfg.Name]
+		if !ok {
+			return nil, fmt.Errorf("query middleware %d: unknown middleware %q", i+1, cfg.Name)
+		}
+		mw, err := f(cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("query middleware %q: %w", cfg.Name, err)
+		}
+		mws = append(mws, mw)
+	}
+	return mws, nil
+}
+
+// queryChain builds the handler a query runs through. The policy checks
+// come first, so nothing runs a query the connection or token forbids;
+// then review, which holds DDL until it is confirmed; then shared
+// results, which keep the response as it would be sent; then extra, the
+// configured middleware, outermost first; then the built-in steps that
+// shape the response, and finally execute.
+func (a *Agent) queryChain(extra []QueryMiddleware) QueryHandler {
+	mws := append([]QueryMiddleware{policyMiddleware{}, reviewMiddleware{a}, sharedMiddleware{a}}, extra...)
+	mws = append(mws, annotationsMiddleware{a}, numbersMiddleware{}, limitsMiddleware{a}, historyMiddleware{a})
+	h := QueryHandler(func(q *Query) QueryResponse {
+		resp := a.execute(q.conn, q.Message)
+		resp.Connection = q.Connection
+		return resp
+	})
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i].Wrap(h)
+	}
+	return h
+}
+
+// policyMiddleware refuses writes on read-only connections and statements
+// the token's capabilities don't allow, and on aggregate-only connections
+// holds queries to their minimum group size.
+type policyMiddleware struct{}
+
+func (policyMiddleware) Name() string { return "policy" }
+
+func (policyMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		if q.SQL == "" {
+			return next(q)
+		}
+		if kind, _ := classifyStatements(q.SQL); q.conn.ReadOnly && !readStatements[kind] {
+			return queryError(q.ID, codedErrorf(codePolicyDenied, "connection %q is read-only; %s statements are not allowed", q.Connection, strings.ToUpper(kind)))
+		}
+		if err := q.capabilities().checkStatement(q.SQL); err != nil {
+			return queryError(q.ID, err)
+		}
+		if q.conn.AggregateOnly {
+			sql, err := aggregateSQL(q.conn, q.SQL)
+			if err != nil {
+				return queryError(q.ID, err)
+			}
+			q.SQL = sql
+		}
+		return next(q)
+	}
+}
+
+// numbersMiddleware writes numbers in the format the token asked for.
+type numbersMiddleware struct{}
+
+func (numbersMiddleware) Name() string { return "numbers" }
+
+func (numbersMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		resp := next(q)
+		formatNumbers(&resp, q.numberFormat())
+		resp.eachResultSet(func(r *QueryResponse) { formatNumbers(r, q.numberFormat()) })
+		return resp
+	}
+}
+
+// limitsMiddleware applies the token's max_rows and --max-cell-bytes.
+type limitsMiddleware struct{ a *Agent }
+
+func (limitsMiddleware) Name() string { return "limits" }
+
+func (m limitsMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		resp := next(q)
+		q.capabilities().limitRows(&resp)
+		m.a.truncateCells(&resp)
+		resp.eachResultSet(func(r *QueryResponse) {
+			q.capabilities().limitRows(r)
+			m.a.truncateCells(r)
+		})
+		return resp
+	}
+}
+
+// historyMiddleware records the query in the history and the usage
+// statistics, and logs it if it was slow.
+type historyMiddleware struct{ a *Agent }
+
+func (historyMiddleware) Name() string { return "history" }
+
+func (m historyMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		start := time.Now()
+		resp := next(q)
+		if q.SQL != "" {
+			m.a.history.record(q.tenant, q.Connection, q.SQL, start, resp, false)
+			if resp.Error == "" {
+				m.a.usage.record(q.Connection, q.SQL)
+			}
+		}
+		if elapsed, slowQuery := time.Since(start), m.a.currentSlowQuery(); slowQuery > 0 && elapsed >= slowQuery {
+			log.Printf("[slow:%s] %v on %q: %s params=%v", q.ID, elapsed.Round(time.Millisecond), q.Connection,
+				logSQL(q.SQL), m.a.currentScrub().queryParams(q.SQL, q.Params, q.Sensitive))
+		}
+		return resp
+	}
+}
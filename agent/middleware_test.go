@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// tagMiddleware rewrites each query's SQL and counts the rows it sees.
+type tagMiddleware struct {
+	tag  string
+	seen []int
+}
+
+func (m *tagMiddleware) Name() string { return "tag" }
+
+func (m *tagMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		if strings.Contains(q.SQL, "secret") {
+			return queryError(q.ID, codedErrorf(codePolicyDenied, "no secrets"))
+		}
+		q.SQL += " -- " + m.tag
+		resp := next(q)
+		m.seen = append(m.seen, len(resp.Rows))
+		return resp
+	}
+}
+
+func TestQueryMiddleware(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tag := &tagMiddleware{tag: "tagged"}
+	tn := testTenant(
+		&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+		&connection{Name: "replica", ReadOnly: true, Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+	)
+	tn.agent.handler = tn.agent.queryChain([]QueryMiddleware{tag})
+	tn.setCapabilities(&Capabilities{MaxRows: 2})
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT id FROM orders -- tagged").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3))
+	resp := runQuery(Message{ID: "q1", Type: "query", SQL: "SELECT id FROM orders", Target: "main", tenant: tn})
+	if resp.Error != "" || resp.Connection != "main" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	// The middleware sees the response after the built-in limits.
+	if len(resp.Rows) != 2 || len(tag.seen) != 1 || tag.seen[0] != 2 {
+		t.Errorf("expected 2 rows, seen as 2, got %d rows, seen %v", len(resp.Rows), tag.seen)
+	}
+
+	// A middleware can refuse a query.
+	resp = runQuery(Message{ID: "q2", Type: "query", SQL: "SELECT secret FROM users", Target: "main", tenant: tn})
+	if resp.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s from the middleware, got %+v", codePolicyDenied, resp)
+	}
+
+	// The policy checks run before any middleware.
+	resp = runQuery(Message{ID: "q3", Type: "query", SQL: "DELETE FROM orders", Target: "replica", tenant: tn})
+	if resp.ErrorCode != codePolicyDenied || len(tag.seen) != 1 {
+		t.Errorf("expected the read-only refusal before the middleware, got %+v, seen %v", resp, tag.seen)
+	}
+	// Every statement counts, not just the first, and a COMMIT would end
+	// the read-only transaction.
+	for _, sql := range []string{
+		"SELECT 1; DELETE FROM orders",
+		"WITH d AS (DELETE FROM orders RETURNING *) SELECT * FROM d",
+		"SELECT 1; COMMIT; DROP TABLE orders",
+	} {
+		if resp := runQuery(Message{ID: "q4", Type: "query", SQL: sql, Target: "replica", tenant: tn}); resp.ErrorCode != codePolicyDenied {
+			t.Errorf("expected %q to be refused on the read-only connection, got %+v", sql, resp)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+var registerTag sync.Once
+
+func TestBuildQueryMiddleware(t *testing.T) {
+	registerTag.Do(func() {
+		RegisterQueryMiddleware("test-tag", func(options json.RawMessage) (QueryMiddleware, error) {
+			var opts struct{ Tag string }
+			if err := json.Unmarshal(options, &opts); err != nil || opts.Tag == "" {
+				return nil, errors.New("tag is required")
+			}
+			return &tagMiddleware{tag: opts.Tag}, nil
+		})
+	})
+
+	tests := []struct {
+		name    string
+		configs []QueryMiddlewareConfig
+		err     string
+	}{
+		{"registered", []QueryMiddlewareConfig{{Name: "test-tag", Options: json.RawMessage(`{"tag": "x"}`)}}, ""},
+		{"bad options", []QueryMiddlewareConfig{{Name: "test-tag", Options: json.RawMessage(`{}`)}}, "tag is required"},
+		{"unknown", []QueryMiddlewareConfig{{Name: "cache"}}, `unknown middleware "cache"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mws, err := buildQueryMiddleware(tc.configs)
+			if tc.err == "" {
+				if err != nil || len(mws) != 1 || mws[0].(*tagMiddleware).tag != "x" {
+					t.Errorf("expected the tag middleware, got %v (%v)", mws, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
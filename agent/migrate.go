@@ -0,0 +1,431 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are kept the way golang-migrate keeps them, so the agent and
+// the migrate CLI can take turns on the same database: files named
+// {version}_{title}.up.sql and {version}_{title}.down.sql, and a
+// schema_migrations table holding one row, the version last applied and
+// whether it failed partway ("dirty").
+
+// migrationFileName matches a migration file's name: its version, title
+// and direction.
+var migrationFileName = regexp.MustCompile(`^([0-9]+)_(.*)\.(down|up)\.(.*)$`)
+
+// nilVersion is golang-migrate's version of a database with no migration
+// applied.
+const nilVersion = -1
+
+// migrationsTable is the table golang-migrate keeps the version in.
+const migrationsTable = "schema_migrations"
+
+// advisoryLockSalt is golang-migrate's salt for its advisory lock ID.
+const advisoryLockSalt uint32 = 1486364155
+
+// MigrationFile is a migration file sent by the hub, named like the files
+// in a migrations directory.
+type MigrationFile struct {
+	Name string `json:"name"`
+	SQL  string `json:"sql"`
+}
+
+// MigrateResponse answers a "migrate" message. Version is the database's
+// version after the migrations ran, or before for a status or dry run;
+// null means no migration has been applied. Dirty is set when a migration
+// failed partway and its version must be fixed by hand.
+type MigrateResponse struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Direction  string            `json:"direction"`
+	Version    *int64            `json:"version"`
+	Dirty      bool              `json:"dirty"`
+	Migrations []MigrationResult `json:"migrations,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// MigrationResult is what became of one migration. Status is "applied",
+// "failed", "not_run" when an earlier one failed, or "pending" for a
+// status or dry run, which also describes its statements the way a DDL
+// review does.
+type MigrationResult struct {
+	Version     int64               `json:"version"`
+	Name        string              `json:"name"`
+	Status      string              `json:"status"`
+	Statements  []ReviewedStatement `json:"statements,omitempty"`
+	Destructive bool                `json:"destructive,omitempty"`
+	Millis      int64               `json:"millis,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	ErrorCode   string              `json:"error_code,omitempty"`
+	ErrorDetail *ErrorDetail        `json:"error_detail,omitempty"`
+}
+
+// migration is one version's up and down files; either may be missing.
+type migration struct {
+	version  int64
+	name     string
+	up, down *string
+}
+
+// parseMigrations pairs up migration files by version, in version order.
+func parseMigrations(files []MigrationFile) ([]migration, error) {
+	byVersion := map[int64]*migration{}
+	for _, f := range files {
+		m := migrationFileName.FindStringSubmatch(f.Name)
+		if m == nil {
+			return nil, codedErrorf(codeInvalidRequest, "migration %q: expected a name like 1_create_users.up.sql", f.Name)
+		}
+		v, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, codedErrorf(codeInvalidRequest, "migration %q: version out of range", f.Name)
+		}
+		mig, ok := byVersion[v]
+		if !ok {
+			mig = &migration{version: v, name: m[2]}
+			byVersion[v] = mig
+		}
+		body := f.SQL
+		dir := &mig.up
+		if m[3] == "down" {
+			dir = &mig.down
+		}
+		if *dir != nil {
+			return nil, codedErrorf(codeInvalidRequest, "migration %q: version %d has two %s migrations", f.Name, v, m[3])
+		}
+		*dir = &body
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// readMigrationDir reads the migration files in dir. Other files are
+// skipped, as golang-migrate skips them.
+func readMigrationDir(dir string) ([]MigrationFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []MigrationFile
+	for _, e := range entries {
+		if e.IsDir() || !migrationFileName.MatchString(e.Name()) {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, MigrationFile{Name: e.Name(), SQL: string(buf)})
+	}
+	return files, nil
+}
+
+// migrationStep is a migration to run: its body, and the version the
+// database is at once it ran.
+type migrationStep struct {
+	migration
+	body   string
+	target int64
+}
+
+// planMigrations returns the steps that take a database at version from
+// up, or down, by steps migrations; 0 steps up applies every pending
+// migration, and 0 steps down reverts one.
+func planMigrations(migrations []migration, from int64, direction string, steps int) ([]migrationStep, error) {
+	var plan []migrationStep
+	switch direction {
+	case "up", "status":
+		for _, m := range migrations {
+			if m.version <= from || m.up == nil {
+				continue
+			}
+			if direction == "up" && steps > 0 && len(plan) == steps {
+				break
+			}
+			plan = append(plan, migrationStep{migration: m, body: *m.up, target: m.version})
+		}
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		i := len(migrations) - 1
+		for i >= 0 && migrations[i].version > from {
+			i--
+		}
+		if from != nilVersion && (i < 0 || migrations[i].version != from) {
+			return nil, codedErrorf(codeInvalidRequest, "the database is at version %d, which no migration file has", from)
+		}
+		for ; i >= 0 && len(plan) < steps; i-- {
+			m := migrations[i]
+			if m.down == nil {
+				return nil, codedErrorf(codeInvalidRequest, "migration %d_%s has no down migration", m.version, m.name)
+			}
+			target := int64(nilVersion)
+			if i > 0 {
+				target = migrations[i-1].version
+			}
+			plan = append(plan, migrationStep{migration: m, body: *m.down, target: target})
+		}
+	default:
+		return nil, codedErrorf(codeInvalidRequest, "unknown direction %q: expected up, down or status", direction)
+	}
+	return plan, nil
+}
+
+// runMigrations answers a "migrate" message: it applies or reverts the
+// migrations in msg.Migrations, or in the connection's migrations
+// directory when the message has none, and records the version in
+// schema_migrations. Each migration runs as one batch, outside a
+// transaction, as golang-migrate runs it; the version is marked dirty
+// while it runs, so one that fails partway stops every later run until it
+// is fixed. A dry run or "status" only lists what would run. Up and down
+// runs are audited, dry runs included.
+func runMigrations(msg Message) MigrateResponse {
+	direction := msg.Direction
+	if direction == "" {
+		direction = "status"
+	}
+	resp := MigrateResponse{ID: msg.ID, Type: "migrate_result", Direction: direction}
+	if direction != "status" {
+		event := AuditEvent{Action: "migrate", MessageID: msg.ID}
+		defer func() {
+			event.Connection, event.Error = resp.Connection, resp.Error
+			var names []string
+			for _, r := range resp.Migrations {
+				names = append(names, fmt.Sprintf("%d_%s", r.Version, r.Name))
+			}
+			event.Detail = direction + " " + strings.Join(names, ", ")
+			if msg.DryRun {
+				event.Detail += " (dry run)"
+			}
+			msg.agent().audit(event)
+		}()
+	}
+	fail := func(err error) MigrateResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	caps := msg.capabilities()
+	if direction != "status" && (c.ReadOnly || caps.ReadOnly) {
+		return fail(codedErrorf(codePolicyDenied, "migrate is not allowed on a read-only connection"))
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || (sc.flavor != "postgres" && sc.flavor != "cockroach") {
+		return fail(codedErrorf(codeNotSupported, "migrate is not supported for %s", c.Flavor()))
+	}
+	if msg.Steps < 0 {
+		return fail(codedErrorf(codeInvalidRequest, "steps must not be negative"))
+	}
+	files := msg.Migrations
+	if len(files) == 0 {
+		if c.MigrationsDir == "" {
+			return fail(codedErrorf(codeInvalidRequest, "connection %q has no migrations directory; send the migrations with the message", c.Name))
+		}
+		if files, err = readMigrationDir(c.MigrationsDir); err != nil {
+			log.Printf("[migrate:%s] Error: %v", msg.ID, err)
+			return fail(codedErrorf(codeInternal, "could not read the migrations directory"))
+		}
+	}
+	migrations, err := parseMigrations(files)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, done := msg.agent().running.start(msg.context(), msg.ID, msg.tenant, sc)
+	defer done()
+	conn, err := sc.db.Conn(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	if sc.flavor == "postgres" {
+		var pid int
+		if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err == nil {
+			setBackendPID(ctx, msg.ID, pid)
+		}
+	}
+
+	changing := direction != "status" && !msg.DryRun
+	if changing {
+		unlock, err := lockMigrations(ctx, conn, sc.flavor)
+		if err != nil {
+			return fail(err)
+		}
+		defer unlock()
+	}
+	version, dirty, err := migrationVersion(ctx, conn, changing)
+	if err != nil {
+		return fail(err)
+	}
+	resp.Version, resp.Dirty = versionPtr(version), dirty
+	if dirty && direction != "status" {
+		return fail(codedErrorf(codeInvalidRequest, "the database is dirty at version %d: a migration failed partway; fix it by hand, then set dirty to false in %s", version, migrationsTable))
+	}
+	plan, err := planMigrations(migrations, version, direction, msg.Steps)
+	if err != nil {
+		return fail(err)
+	}
+
+	resp.Migrations = make([]MigrationResult, len(plan))
+	for i, step := range plan {
+		r := &resp.Migrations[i]
+		*r = MigrationResult{Version: step.version, Name: step.name, Status: "not_run"}
+		for _, stmt := range splitStatements(step.body) {
+			if direction != "status" {
+				if err := caps.checkStatement(stmt); err != nil {
+					return fail(fmt.Errorf("migration %d_%s: %w", step.version, step.name, err))
+				}
+			}
+			if !changing {
+				s, _ := reviewStatement(stmt)
+				r.Statements = append(r.Statements, s)
+				r.Destructive = r.Destructive || s.Destructive
+			}
+		}
+		if !changing {
+			r.Status = "pending"
+		}
+	}
+	if !changing {
+		return resp
+	}
+
+	for i, step := range plan {
+		r := &resp.Migrations[i]
+		log.Printf("[migrate:%s] %s %d_%s", msg.ID, direction, step.version, step.name)
+		start := time.Now()
+		err := applyMigration(ctx, conn, step)
+		r.Millis = time.Since(start).Milliseconds()
+		if err != nil {
+			log.Printf("[migrate:%s] Error: %v", msg.ID, err)
+			r.Status, r.Error, r.ErrorCode, r.ErrorDetail = "failed", err.Error(), errorCode(err), errorDetail(err)
+			resp.Dirty = true
+			resp.Error = fmt.Sprintf("migration %d_%s failed: %v", step.version, step.name, err)
+			resp.ErrorCode = errorCode(err)
+			return resp
+		}
+		r.Status = "applied"
+		resp.Version = versionPtr(step.target)
+	}
+	return resp
+}
+
+// applyMigration runs one step, marking its target version dirty until it
+// succeeds, as golang-migrate does.
+func applyMigration(ctx context.Context, conn *sql.Conn, step migrationStep) error {
+	if err := setMigrationVersion(ctx, conn, step.target, true); err != nil {
+		return err
+	}
+	if strings.TrimSpace(step.body) != "" {
+		if _, err := conn.ExecContext(ctx, step.body); err != nil {
+			return err
+		}
+	}
+	return setMigrationVersion(ctx, conn, step.target, false)
+}
+
+// lockMigrations takes the advisory lock golang-migrate takes, so two
+// runs on one Postgres database wait for each other. CockroachDB has no
+// advisory locks, and runs there aren't serialized.
+func lockMigrations(ctx context.Context, conn *sql.Conn, flavor string) (unlock func(), err error) {
+	if flavor != "postgres" {
+		return func() {}, nil
+	}
+	var db, schema string
+	if err := conn.QueryRowContext(ctx, "SELECT current_database(), current_schema()").Scan(&db, &schema); err != nil {
+		return nil, err
+	}
+	id := advisoryLockID(db, schema, migrationsTable)
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", id); err != nil {
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", id); err != nil {
+			log.Printf("[migrate] Could not release the migration lock: %v", err)
+		}
+	}, nil
+}
+
+// advisoryLockID is golang-migrate's lock ID for the migrations table
+// names in database db.
+func advisoryLockID(db string, names ...string) string {
+	sum := crc32.ChecksumIEEE([]byte(strings.Join(append(names, db), "\x00")))
+	return strconv.FormatUint(uint64(sum*advisoryLockSalt), 10)
+}
+
+// migrationVersion reads the database's version, creating the migrations
+// table first when create is set. Without it, a missing table reads as no
+// migration applied.
+func migrationVersion(ctx context.Context, conn *sql.Conn, create bool) (int64, bool, error) {
+	if create {
+		if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrationsTable+" (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)"); err != nil {
+			return 0, false, err
+		}
+	} else {
+		var exists bool
+		if err := conn.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", migrationsTable).Scan(&exists); err != nil {
+			return 0, false, err
+		}
+		if !exists {
+			return nilVersion, false, nil
+		}
+	}
+	var version int64
+	var dirty bool
+	err := conn.QueryRowContext(ctx, "SELECT version, dirty FROM "+migrationsTable+" LIMIT 1").Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return nilVersion, false, nil
+	}
+	return version, dirty, err
+}
+
+// setMigrationVersion replaces the migrations table's row. Like
+// golang-migrate, it keeps a row for no version only while it is dirty.
+func setMigrationVersion(ctx context.Context, conn *sql.Conn, version int64, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "TRUNCATE "+migrationsTable); err != nil {
+		return err
+	}
+	if version >= 0 || dirty {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+migrationsTable+" (version, dirty) VALUES ($1, $2)", version, dirty); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// versionPtr is v for a response: nil for no version.
+func versionPtr(v int64) *int64 {
+	if v == nilVersion {
+		return nil
+	}
+	return &v
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestPlanMigrations(t *testing.T) {
+	migrations, err := parseMigrations([]MigrationFile{
+		{Name: "3_add_index.up.sql", SQL: "CREATE INDEX ON users (email)"},
+		{Name: "1_init.up.sql", SQL: "CREATE TABLE users (id int)"},
+		{Name: "1_init.down.sql", SQL: "DROP TABLE users"},
+		{Name: "2_add_email.up.sql", SQL: "ALTER TABLE users ADD email text"},
+		{Name: "2_add_email.down.sql", SQL: "ALTER TABLE users DROP email"},
+	})
+	if err != nil {
+		t.Fatalf("parseMigrations: %v", err)
+	}
+	tests := []struct {
+		from      int64
+		direction string
+		steps     int
+		want      []int64
+		targets   []int64
+		wantErr   string
+	}{
+		{from: nilVersion, direction: "up", want: []int64{1, 2, 3}, targets: []int64{1, 2, 3}},
+		{from: 1, direction: "up", steps: 1, want: []int64{2}, targets: []int64{2}},
+		{from: 3, direction: "up"},
+		{from: 1, direction: "status", steps: 1, want: []int64{2, 3}, targets: []int64{2, 3}},
+		{from: 2, direction: "down", want: []int64{2}, targets: []int64{1}},
+		{from: 2, direction: "down", steps: 5, want: []int64{2, 1}, targets: []int64{1, nilVersion}},
+		{from: 3, direction: "down", wantErr: "migration 3_add_index has no down migration"},
+		{from: 7, direction: "down", wantErr: "the database is at version 7, which no migration file has"},
+		{from: nilVersion, direction: "down"},
+		{from: 1, direction: "sideways", wantErr: `unknown direction "sideways": expected up, down or status`},
+	}
+	for _, tc := range tests {
+		plan, err := planMigrations(migrations, tc.from, tc.direction, tc.steps)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("%s from %d: got %v, want %q", tc.direction, tc.from, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(plan) != len(tc.want) {
+			t.Errorf("%s from %d: got %+v, %v, want versions %v", tc.direction, tc.from, plan, err, tc.want)
+			continue
+		}
+		for i, step := range plan {
+			if step.version != tc.want[i] || step.target != tc.targets[i] {
+				t.Errorf("%s from %d: step %d is %d to %d, want %d to %d", tc.direction, tc.from, i+1, step.version, step.target, tc.want[i], tc.targets[i])
+			}
+		}
+	}
+
+	for _, files := range [][]MigrationFile{
+		{{Name: "init.up.sql"}},
+		{{Name: "1_a.up.sql"}, {Name: "1_b.up.sql"}},
+	} {
+		if _, err := parseMigrations(files); errorCode(err) != codeInvalidRequest {
+			t.Errorf("parseMigrations(%v): expected %s, got %v", files, codeInvalidRequest, err)
+		}
+	}
+}
+
+func TestReadMigrationDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"1_init.up.sql":   "CREATE TABLE t (id int)",
+		"1_init.down.sql": "DROP TABLE t",
+		"README.md":       "# migrations",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := readMigrationDir(dir)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected the two migration files, got %+v, %v", files, err)
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "1_init.up.sql"), []byte("CREATE TABLE users (id int)"), 0o644)
+	os.WriteFile(filepath.Join(dir, "2_drop_users.up.sql"), []byte("DROP TABLE users"), 0o644)
+
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+	tn := testTenant(
+		&connection{Name: "main", MigrationsDir: dir, Connector: pg},
+		&connection{Name: "ro", ReadOnly: true, Connector: pg},
+	)
+	pid := func() {
+		mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	}
+	lock := func() {
+		mock.ExpectQuery(`SELECT current_database\(\), current_schema\(\)`).WillReturnRows(sqlmock.NewRows([]string{"db", "schema"}).AddRow("app", "public"))
+		mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).WithArgs(advisoryLockID("app", "public", migrationsTable)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	unlock := func() {
+		mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	setVersion := func(v int64, dirty bool) {
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)")).WithArgs(v, dirty).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	version := func(rows *sqlmock.Rows) {
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT version, dirty FROM schema_migrations").WillReturnRows(rows)
+	}
+
+	// A dry run lists the pending migrations without touching the database.
+	pid()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	resp := runMigrations(Message{ID: "m1", Direction: "up", DryRun: true, tenant: tn})
+	if resp.Error != "" || resp.Version != nil || len(resp.Migrations) != 2 || resp.Migrations[0].Status != "pending" || !resp.Migrations[1].Destructive {
+		t.Errorf("unexpected dry run: %+v", resp)
+	}
+
+	// Up applies the first migration and stops at the failing one,
+	// leaving the database dirty.
+	pid()
+	lock()
+	version(sqlmock.NewRows([]string{"version", "dirty"}))
+	setVersion(1, true)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE users (id int)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	setVersion(1, false)
+	setVersion(2, true)
+	mock.ExpectExec("DROP TABLE users").WillReturnError(&pq.Error{Code: "2BP01", Message: "cannot drop table users because other objects depend on it"})
+	unlock()
+	resp = runMigrations(Message{ID: "m2", Direction: "up", tenant: tn})
+	if resp.Error == "" || !resp.Dirty || resp.Version == nil || *resp.Version != 1 {
+		t.Errorf("expected a failure at version 2 after applying 1, got %+v", resp)
+	}
+	if len(resp.Migrations) != 2 || resp.Migrations[0].Status != "applied" || resp.Migrations[1].Status != "failed" {
+		t.Errorf("unexpected results: %+v", resp.Migrations)
+	}
+
+	// A dirty database refuses to migrate until it is fixed.
+	pid()
+	lock()
+	version(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(2, true))
+	unlock()
+	resp = runMigrations(Message{ID: "m3", Direction: "up", tenant: tn})
+	if resp.ErrorCode != codeInvalidRequest || !resp.Dirty {
+		t.Errorf("expected a dirty database to be refused, got %+v", resp)
+	}
+
+	// Migrations sent with the message replace the directory's.
+	pid()
+	lock()
+	version(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(1, false))
+	setVersion(nilVersion, true)
+	mock.ExpectExec("DROP TABLE users").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("TRUNCATE schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	unlock()
+	resp = runMigrations(Message{ID: "m4", Direction: "down", tenant: tn, Migrations: []MigrationFile{
+		{Name: "1_init.up.sql", SQL: "CREATE TABLE users (id int)"},
+		{Name: "1_init.down.sql", SQL: "DROP TABLE users"},
+	}})
+	if resp.Error != "" || resp.Version != nil || len(resp.Migrations) != 1 || resp.Migrations[0].Status != "applied" {
+		t.Errorf("unexpected down: %+v", resp)
+	}
+
+	if resp := runMigrations(Message{ID: "m5", Direction: "up", Target: "ro", tenant: tn}); resp.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s on a read-only connection, got %+v", codePolicyDenied, resp)
+	}
+
+	// A read-only connection still reports its status.
+	pid()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT version, dirty FROM schema_migrations").WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(1, false))
+	resp = runMigrations(Message{ID: "m6", Target: "ro", Migrations: []MigrationFile{{Name: "2_drop.up.sql", SQL: "DROP TABLE users"}}, tenant: tn})
+	if resp.Error != "" || resp.Direction != "status" || len(resp.Migrations) != 1 || resp.Migrations[0].Status != "pending" {
+		t.Errorf("unexpected status: %+v", resp)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func checkIPFamily(family string) error {
+	switch family {
+	case "", "any", "ipv4", "ipv6":
+		return nil
+	}
+	return fmt.Errorf("unknown IP family %q: expected ipv4, ipv6 or any", family)
+}
+
+// tcpNetwork is the network to dial for "tcp" in family, which is
+// --ip-family: "ipv4", "ipv6", or empty for both.
+func tcpNetwork(family string) string {
+	switch family {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// familyDialer dials TCP in family, and anything else, such as unix
+// sockets, as asked. It is a lib/pq Dialer and a gocql Dialer.
+type familyDialer struct {
+	net.Dialer
+	family string
+}
+
+func (d *familyDialer) network(network string) string {
+	if network == "tcp" {
+		return tcpNetwork(d.family)
+	}
+	return network
+}
+
+func (d *familyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *familyDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *familyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.Dialer.DialContext(ctx, d.network(network), address)
+}
+
+func newFamilyDialer(family string) *familyDialer {
+	return &familyDialer{Dialer: net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, family: family}
+}
+
+// hubDialer is websocket.DefaultDialer dialing in family.
+func hubDialer(family string) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		NetDialContext:   newFamilyDialer(family).DialContext,
+	}
+}
+
+// httpTransport is http.DefaultTransport dialing in family.
+func httpTransport(family string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newFamilyDialer(family).DialContext
+	return t
+}
+
+// checkURLHost checks the host of a URL for mistakes that otherwise fail
+// later and confusingly: an IPv6 address without the brackets URLs need, a
+// link-local address without the zone naming its interface (written %25 in
+// URLs), and an address outside family. what names the URL in errors.
+func checkURLHost(what, rawURL, family string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// Not a URL, e.g. a key=value DSN; the driver reports problems.
+		return nil
+	}
+	if !strings.HasPrefix(u.Host, "[") && strings.Count(u.Host, ":") > 1 {
+		return fmt.Errorf("%s: IPv6 address %q must be in brackets, e.g. [2001:db8::1]:5432", what, u.Host)
+	}
+	addr, err := netip.ParseAddr(u.Hostname())
+	if err != nil {
+		return nil
+	}
+	if addr.Is6() && addr.IsLinkLocalUnicast() && addr.Zone() == "" {
+		return fmt.Errorf("%s: link-local address %s needs its interface, e.g. [%s%%25eth0]", what, addr, addr)
+	}
+	if family == "ipv4" && addr.Is6() && !addr.Is4In6() {
+		return fmt.Errorf("%s: %s is an IPv6 address, but --ip-family is ipv4", what, addr)
+	}
+	if family == "ipv6" && addr.Is4() {
+		return fmt.Errorf("%s: %s is an IPv4 address, but --ip-family is ipv6", what, addr)
+	}
+	return nil
+}
+
+// pqURL fixes up a Postgres URL for lib/pq, which can't parse a socket
+// directory as the host (see pqSocketURL), and keeps the brackets of an
+// IPv6 host that has no port and then can't dial it.
+func pqURL(rawURL string) string {
+	if s, ok := pqSocketURL(rawURL); ok {
+		return s
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.HasPrefix(u.Host, "[") || u.Port() != "" {
+		return rawURL
+	}
+	u.Host += ":5432"
+	return u.String()
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckURLHost(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		family string
+		err    string
+	}{
+		{"hostname", "postgres://u@db.internal:5432/app", "ipv6", ""},
+		{"key=value DSN", "host=fe80::1 dbname=app", "", ""},
+		{"bracketed", "postgres://u@[2001:db8::1]:5432/app", "", ""},
+		{"link-local with zone", "postgres://u@[fe80::1%25eth0]:5432/app", "ipv6", ""},
+		{"hub with zone", "ws://[fe80::1%25eth0]:8765/agent", "", ""},
+		{"no brackets", "postgres://u@2001:db8::1:5432/app", "", "must be in brackets"},
+		{"link-local without zone", "postgres://u@[fe80::1]:5432/app", "", "needs its interface, e.g. [fe80::1%25eth0]"},
+		{"IPv4 under ipv6", "postgres://u@10.0.0.5/app", "ipv6", "is an IPv4 address"},
+		{"IPv6 under ipv4", "wss://[2001:db8::1]/agent", "ipv4", "is an IPv6 address"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkURLHost("database URL", tc.url, tc.family)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestPQURL(t *testing.T) {
+	tests := map[string]string{
+		"postgres://u@[2001:db8::1]/app":          "postgres://u@[2001:db8::1]:5432/app",
+		"postgres://u@[fe80::1%25eth0]/app":       "postgres://u@[fe80::1%25eth0]:5432/app",
+		"postgres://u@[2001:db8::1]:6432/app":     "postgres://u@[2001:db8::1]:6432/app",
+		"postgres://u@db.internal/app?sslmode=on": "postgres://u@db.internal/app?sslmode=on",
+		"host=/var/run/postgresql dbname=app":     "host=/var/run/postgresql dbname=app",
+	}
+	for in, want := range tests {
+		if got := pqURL(in); got != want {
+			t.Errorf("pqURL(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestFamilyDialer(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no IPv4 loopback")
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	tests := []struct {
+		family string
+		ok     bool
+	}{
+		{"", true},
+		{"ipv4", true},
+		{"ipv6", false},
+	}
+	for _, tc := range tests {
+		c, err := newFamilyDialer(tc.family).Dial("tcp", ln.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("family %q: expected ok=%t, got %v", tc.family, tc.ok, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/lib/pq"
+)
+
+// maxNotices caps the notices kept for one query, so a script that raises
+// one per row doesn't grow the reply without bound.
+const maxNotices = 100
+
+// Notice is a message the database sent while running a query rather than
+// a row or an error, such as a PL/pgSQL RAISE NOTICE or WARNING.
+type Notice struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	// Where is the PL/pgSQL call stack that raised it.
+	Where string `json:"where,omitempty"`
+}
+
+// noticeLog collects the notices of one query: the first maxNotices, and
+// a count of the rest.
+type noticeLog struct {
+	notices []Notice
+	dropped int
+}
+
+func (l *noticeLog) add(e *pq.Error) {
+	if len(l.notices) >= maxNotices {
+		l.dropped++
+		return
+	}
+	l.notices = append(l.notices, Notice{
+		Severity: e.Severity,
+		Code:     string(e.Code),
+		Message:  e.Message,
+		Detail:   e.Detail,
+		Hint:     e.Hint,
+		Where:    e.Where,
+	})
+}
+
+// reset forgets the notices of an attempt that is about to be retried.
+func (l *noticeLog) reset() { l.notices, l.dropped = nil, 0 }
+
+// captureNotices adds the notices conn receives to l until the returned
+// func is called, which must happen before conn goes back to the pool.
+// Only lib/pq reports notices; on other drivers it does nothing.
+func (c *sqlConnector) captureNotices(conn *sql.Conn, l *noticeLog) (stop func()) {
+	stop = func() {}
+	if _, ok := c.db.Driver().(*pq.Driver); !ok {
+		return stop
+	}
+	conn.Raw(func(dc any) error {
+		pq.SetNoticeHandler(dc.(driver.Conn), l.add)
+		stop = func() {
+			conn.Raw(func(dc any) error {
+				pq.SetNoticeHandler(dc.(driver.Conn), nil)
+				return nil
+			})
+		}
+		return nil
+	})
+	return stop
+}
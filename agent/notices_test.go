@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestNoticeLog(t *testing.T) {
+	var l noticeLog
+	l.add(&pq.Error{Severity: "WARNING", Code: "01000", Message: "table is empty", Where: "PL/pgSQL function cleanup() line 4 at RAISE"})
+	for i := 0; i < maxNotices+4; i++ {
+		l.add(&pq.Error{Severity: "NOTICE", Code: "00000", Message: "deleted batch"})
+	}
+	if len(l.notices) != maxNotices || l.dropped != 5 {
+		t.Fatalf("expected %d notices and 5 dropped, got %d and %d", maxNotices, len(l.notices), l.dropped)
+	}
+	want := Notice{Severity: "WARNING", Code: "01000", Message: "table is empty", Where: "PL/pgSQL function cleanup() line 4 at RAISE"}
+	if l.notices[0] != want {
+		t.Errorf("got %+v, want %+v", l.notices[0], want)
+	}
+	l.reset()
+	if l.notices != nil || l.dropped != 0 {
+		t.Errorf("expected reset to forget everything, got %+v", l)
+	}
+}
+
+func TestCaptureNoticesOtherDriver(t *testing.T) {
+	mockDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	conn, err := mockDB.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	c := &sqlConnector{db: mockDB, flavor: "postgres"}
+	var l noticeLog
+	// A driver other than lib/pq must be left alone rather than panic.
+	c.captureNotices(conn, &l)()
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Number formats a token can ask for in its auth response. JavaScript
+// reads every JSON number as a float64, so integers beyond 2^53 lose
+// digits, and decimals get binary rounding; with "string" the agent sends
+// those as strings instead, with the columns' database types alongside.
+const (
+	numberFormatNative = "native"
+	numberFormatString = "string"
+)
+
+// numberFormats are advertised in the auth message.
+var numberFormats = []string{numberFormatNative, numberFormatString}
+
+// maxSafeInteger is the largest integer a float64 holds exactly.
+const maxSafeInteger = 1<<53 - 1
+
+// formatNumbers applies format to resp. With "string", integers outside
+// ±(2^53-1) and every non-integer become their exact decimal text, and the
+// column types stay on the reply so the hub can tell a numeric string from
+// text; otherwise resp keeps native numbers and loses its column types.
+func formatNumbers(resp *QueryResponse, format string) {
+	if format != numberFormatString {
+		resp.ColumnTypes = nil
+		return
+	}
+	for _, row := range resp.Rows {
+		for i, v := range row {
+			row[i] = numberString(v)
+		}
+	}
+}
+
+// numberString returns v as a string if JavaScript would misread it, and
+// unchanged otherwise.
+func numberString(v any) any {
+	switch n := v.(type) {
+	case int64:
+		if n > maxSafeInteger || n < -maxSafeInteger {
+			return strconv.FormatInt(n, 10)
+		}
+	case uint64:
+		if n > maxSafeInteger {
+			return strconv.FormatUint(n, 10)
+		}
+	case float64:
+		return formatFloat(n, 64)
+	case float32:
+		return formatFloat(float64(n), 32)
+	case json.Number:
+		// Stored export results are decoded as json.Numbers.
+		s := n.String()
+		if strings.ContainsAny(s, ".eE") {
+			return s
+		}
+		if i, err := n.Int64(); err != nil || i > maxSafeInteger || i < -maxSafeInteger {
+			return s
+		}
+	}
+	return v
+}
+
+// formatFloat writes f as the shortest decimal that reads back as the same
+// value, as encoding/json does; NaN and the infinities, which JSON numbers
+// can't carry at all, are written as "NaN", "Infinity" and "-Infinity".
+func formatFloat(f float64, bits int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	return strconv.FormatFloat(f, format, -1, bits)
+}
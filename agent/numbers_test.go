@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNumberString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want any
+	}{
+		{name: "small int", in: int64(42), want: int64(42)},
+		{name: "largest safe int", in: int64(1<<53 - 1), want: int64(1<<53 - 1)},
+		{name: "large int", in: int64(1 << 53), want: "9007199254740992"},
+		{name: "large negative int", in: int64(-1 << 60), want: "-1152921504606846976"},
+		{name: "large uint", in: uint64(math.MaxUint64), want: "18446744073709551615"},
+		{name: "decimal", in: 0.1, want: "0.1"},
+		{name: "whole float", in: 3.0, want: "3"},
+		{name: "tiny float", in: 1.5e-9, want: "1.5e-09"},
+		{name: "float32", in: float32(0.1), want: "0.1"},
+		{name: "NaN", in: math.NaN(), want: "NaN"},
+		{name: "stored int", in: json.Number("7"), want: json.Number("7")},
+		{name: "stored large int", in: json.Number("12345678901234567890"), want: "12345678901234567890"},
+		{name: "stored decimal", in: json.Number("1.25"), want: "1.25"},
+		{name: "text", in: "12345678901234567890", want: "12345678901234567890"},
+		{name: "null", in: nil, want: nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := numberString(tc.in); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("numberString(%v) = %#v, want %#v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatNumbers(t *testing.T) {
+	resp := QueryResponse{Rows: [][]any{{int64(1 << 60), 2.5}}, ColumnTypes: []string{"int8", "float8"}}
+	formatNumbers(&resp, numberFormatString)
+	if resp.Rows[0][0] != "1152921504606846976" || resp.Rows[0][1] != "2.5" || len(resp.ColumnTypes) != 2 {
+		t.Errorf("expected strings and column types, got %+v", resp)
+	}
+
+	resp = QueryResponse{Rows: [][]any{{int64(1 << 60)}}, ColumnTypes: []string{"int8"}}
+	formatNumbers(&resp, "")
+	if resp.Rows[0][0] != int64(1<<60) || resp.ColumnTypes != nil {
+		t.Errorf("expected native numbers and no column types, got %+v", resp)
+	}
+}
+
+func TestNumberFormatNegotiated(t *testing.T) {
+	tn := testTenant()
+	tn.setNumberFormat("string")
+	if f := (Message{tenant: tn}).numberFormat(); f != numberFormatString {
+		t.Errorf("expected the string format, got %q", f)
+	}
+	tn.setNumberFormat("bignum")
+	if f := (Message{tenant: tn}).numberFormat(); f != "" {
+		t.Errorf("expected an unknown format to fall back to native, got %q", f)
+	}
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestOraclePlaceholders(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "dollar params rewritten",
+			input:    "SELECT * FROM emp WHERE id = $1 AND dept = $2",
+			expected: "SELECT * FROM emp WHERE id = :1 AND dept = :2",
+		},
+		{
+			name:     "colon params unchanged",
+			input:    "SELECT * FROM emp WHERE id = :1",
+			expected: "SELECT * FROM emp WHERE id = :1",
+		},
+		{
+			name:     "literals and identifiers untouched",
+			input:    `SELECT '$1', "col$1" FROM t WHERE x = $1`,
+			expected: `SELECT '$1', "col$1" FROM t WHERE x = :1`,
+		},
+		{
+			name:     "comments untouched",
+			input:    "SELECT 1 -- costs $5\nFROM dual /* $2 */ WHERE a = $1",
+			expected: "SELECT 1 -- costs $5\nFROM dual /* $2 */ WHERE a = :1",
+		},
+		{
+			name:     "unterminated literal",
+			input:    "SELECT 'abc $1",
+			expected: "SELECT 'abc $1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := oraclePlaceholders(tc.input); result != tc.expected {
+				t.Errorf("oraclePlaceholders(%q) = %q, want %q", tc.input, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteQuery_OracleTypes(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	c := &sqlConnector{db: mockDB, flavor: "oracle"}
+
+	hired := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("ID").OfType("NUMBER", ""),
+		sqlmock.NewColumn("SALARY").OfType("NUMBER", ""),
+		sqlmock.NewColumn("BIG").OfType("NUMBER", ""),
+		sqlmock.NewColumn("NOTES").OfType("CLOB", ""),
+		sqlmock.NewColumn("HIRED").OfType("DATE", ""),
+		sqlmock.NewColumn("CODE").OfType("VARCHAR2", ""),
+	).AddRow("42", "1234.5", "123456789012345678901234", []byte("long text"), hired, "007")
+	mock.ExpectQuery("SELECT (.+) FROM emp").WillReturnRows(rows)
+
+	resp := c.executeQuery(context.Background(), "o1", "SELECT * FROM emp", nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	row := resp.Rows[0]
+	expected := []any{int64(42), 1234.5, "123456789012345678901234", "long text", "2020-03-01T00:00:00Z", "007"}
+	for i, want := range expected {
+		if row[i] != want {
+			t.Errorf("column %s = %v (%T), want %v (%T)", resp.Columns[i], row[i], row[i], want, want)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
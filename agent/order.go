@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"strings"
+)
+
+// primaryKeyQuery lists a table's primary key columns in key order.
+const primaryKeyQuery = `
+SELECT a.attname
+FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::regclass AND i.indisprimary
+ORDER BY array_position(i.indkey::int2[], a.attnum)`
+
+// primaryKey returns the primary key columns of table, a name quoted for
+// Postgres, in key order.
+func primaryKey(sc *sqlConnector, table string) ([]string, error) {
+	rows, err := sc.db.Query(primaryKeyQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var key []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		key = append(key, col)
+	}
+	return key, rows.Err()
+}
+
+// aggregates are the functions whose presence in the select list means the
+// query returns grouped rows, which a primary key can't order.
+var aggregates = map[string]bool{
+	"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true,
+	"ARRAY_AGG": true, "STRING_AGG": true, "JSON_AGG": true, "JSONB_AGG": true,
+	"BOOL_AND": true, "BOOL_OR": true, "EVERY": true,
+}
+
+// orderTarget finds where a tie-breaker can go in q: the single table it
+// reads, the name to qualify its columns with, the offset to insert at, and
+// whether q already has an ORDER BY. ok is false for anything but a plain
+// SELECT from one table: joins, subqueries, CTEs, DISTINCT, grouping and
+// set operations are left alone.
+func orderTarget(q string) (table tableRef, qualifier sqlToken, at int, ordered, ok bool) {
+	toks := sqlTokens(q)
+	if len(toks) == 0 || toks[0].word() != "SELECT" {
+		return
+	}
+	refs := tableRefs(toks)
+	if len(refs) != 1 || refs[0].keyword != "FROM" {
+		return
+	}
+	table = refs[0]
+
+	at = len(strings.TrimRight(strings.TrimSpace(q), "; \t\n\r"))
+	depth := 0
+	for i, t := range toks {
+		switch t.text {
+		case "(":
+			depth++
+			continue
+		case ")":
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		w := t.word()
+		switch {
+		case w == "DISTINCT" && i == 1, w == "GROUP", w == "HAVING", w == "UNION",
+			w == "EXCEPT", w == "INTERSECT", w == "JOIN", w == "SELECT" && i > 0:
+			return
+		case aggregates[w] && i+1 < len(toks) && toks[i+1].text == "(":
+			return
+		case w == "ORDER" && i+1 < len(toks) && toks[i+1].word() == "BY":
+			ordered = true
+		case w == "LIMIT" || w == "OFFSET" || w == "FETCH" || w == "FOR":
+			if start := t.end - len(t.text); start < at {
+				at = start
+			}
+		}
+	}
+	if at < table.aliasEnd {
+		return
+	}
+
+	qualifier = table.parts[len(table.parts)-1]
+	if table.aliasEnd != table.nameEnd {
+		for _, t := range toks {
+			if t.end == table.aliasEnd {
+				qualifier = t
+			}
+		}
+	}
+	return table, qualifier, at, ordered, true
+}
+
+// stableOrder appends q's table's primary key to its ORDER BY, or adds one,
+// so that LIMIT/OFFSET pages neither repeat nor skip rows that tie on the
+// requested order. It returns q unchanged, and no columns, when the query
+// isn't one it can safely rewrite or the table has no primary key.
+func (c *sqlConnector) stableOrder(ctx context.Context, q string) (string, []string, error) {
+	table, qualifier, at, ordered, ok := orderTarget(q)
+	if !ok {
+		return q, nil, nil
+	}
+
+	d := dialectFor(c.flavor)
+	rows, err := c.db.QueryContext(ctx, primaryKeyQuery, d.qualifiedSQL(table.parts))
+	if err != nil {
+		return q, nil, err
+	}
+	defer rows.Close()
+	var cols, terms []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return q, nil, err
+		}
+		cols = append(cols, col)
+		terms = append(terms, d.quoted(d.name(qualifier))+"."+d.quoted(col))
+	}
+	if err := rows.Err(); err != nil || len(cols) == 0 {
+		return q, nil, err
+	}
+
+	head := strings.TrimRight(q[:at], " \t\n\r")
+	if line := head[strings.LastIndexByte(head, '\n')+1:]; strings.Contains(line, "--") {
+		// Don't let a trailing line comment swallow the clause.
+		head += "\n"
+	} else if !ordered {
+		head += " "
+	}
+	clause := "ORDER BY "
+	if ordered {
+		clause = ", "
+	}
+	out := head + clause + strings.Join(terms, ", ")
+	if tail := strings.TrimLeft(q[at:], " \t\n\r"); tail != "" {
+		out += " " + tail
+	}
+	return out, cols, nil
+}
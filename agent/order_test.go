@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStableOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		table    string
+		pk       []string
+		expected string
+	}{
+		{
+			name:     "no order",
+			sql:      "SELECT * FROM orders LIMIT 50 OFFSET 100",
+			table:    `"orders"`,
+			pk:       []string{"id"},
+			expected: `SELECT * FROM orders ORDER BY "orders"."id" LIMIT 50 OFFSET 100`,
+		},
+		{
+			name:     "existing order and alias",
+			sql:      "SELECT o.total AS id FROM shop.orders o ORDER BY o.created_at DESC LIMIT 50;",
+			table:    `"shop"."orders"`,
+			pk:       []string{"region", "id"},
+			expected: `SELECT o.total AS id FROM shop.orders o ORDER BY o.created_at DESC, "o"."region", "o"."id" LIMIT 50;`,
+		},
+		{
+			name:     "no limit",
+			sql:      "SELECT * FROM events WHERE kind = 'click'",
+			table:    `"events"`,
+			pk:       []string{"id"},
+			expected: `SELECT * FROM events WHERE kind = 'click' ORDER BY "events"."id"`,
+		},
+		{
+			name:     "trailing line comment",
+			sql:      "SELECT * FROM events -- recent\nLIMIT 10",
+			table:    `"events"`,
+			pk:       []string{"id"},
+			expected: "SELECT * FROM events -- recent\nORDER BY \"events\".\"id\" LIMIT 10",
+		},
+		{
+			name:     "window order is not the query's",
+			sql:      "SELECT id, row_number() OVER (ORDER BY ts) FROM events LIMIT 10",
+			table:    `"events"`,
+			pk:       []string{"id"},
+			expected: `SELECT id, row_number() OVER (ORDER BY ts) FROM events ORDER BY "events"."id" LIMIT 10`,
+		},
+		{
+			name:     "mixed case and reserved words",
+			sql:      `SELECT * FROM "Sales"."Order ""Items""" AS "User" LIMIT 5`,
+			table:    `"Sales"."Order ""Items"""`,
+			pk:       []string{"Line"},
+			expected: `SELECT * FROM "Sales"."Order ""Items""" AS "User" ORDER BY "User"."Line" LIMIT 5`,
+		},
+		{
+			name:     "bare names fold",
+			sql:      `SELECT * FROM Shop.Orders LIMIT 5`,
+			table:    `"shop"."orders"`,
+			pk:       []string{"id"},
+			expected: `SELECT * FROM Shop.Orders ORDER BY "orders"."id" LIMIT 5`,
+		},
+		{name: "no primary key", sql: "SELECT * FROM logs LIMIT 10", table: `"logs"`, expected: "SELECT * FROM logs LIMIT 10"},
+		{name: "join", sql: "SELECT * FROM a JOIN b ON a.id = b.a_id LIMIT 10", expected: "SELECT * FROM a JOIN b ON a.id = b.a_id LIMIT 10"},
+		{name: "aggregate", sql: "SELECT count(*) FROM orders", expected: "SELECT count(*) FROM orders"},
+		{name: "group by", sql: "SELECT kind FROM events GROUP BY kind", expected: "SELECT kind FROM events GROUP BY kind"},
+		{name: "distinct", sql: "SELECT DISTINCT kind FROM events", expected: "SELECT DISTINCT kind FROM events"},
+		{name: "union", sql: "SELECT id FROM a UNION SELECT id FROM a", expected: "SELECT id FROM a UNION SELECT id FROM a"},
+		{name: "cte", sql: "WITH x AS (SELECT 1) SELECT * FROM x", expected: "WITH x AS (SELECT 1) SELECT * FROM x"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tc.table != "" {
+				rows := sqlmock.NewRows([]string{"attname"})
+				for _, c := range tc.pk {
+					rows.AddRow(c)
+				}
+				mock.ExpectQuery("FROM pg_index").WithArgs(tc.table).WillReturnRows(rows)
+			}
+
+			c := &sqlConnector{db: db, flavor: "postgres"}
+			got, cols, err := c.stableOrder(context.Background(), tc.sql)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("got      %q\nexpected %q", got, tc.expected)
+			}
+			if !reflect.DeepEqual(cols, tc.pk) {
+				t.Errorf("expected tie-breaker %v, got %v", tc.pk, cols)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
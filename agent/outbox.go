@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// outbox is a disk-backed queue of replies that couldn't be sent, one
+// bucket per token, delivered in order when that token reconnects. It is
+// the bolt file of --outbox; without one replies are dropped. Queued
+// replies count against quota, which may evict the oldest.
+type outbox struct {
+	db *bolt.DB
+	// max caps the spooled replies across all tokens.
+	max   int64
+	quota *diskQuota
+
+	mu      sync.Mutex
+	size    int64
+	entries map[outboxKey]*diskEntry
+}
+
+// outboxKey locates a queued reply.
+type outboxKey struct {
+	bucket, key string
+}
+
+func openOutbox(path string, max int64, quota *diskQuota) (*outbox, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	o := &outbox{db: db, max: max, quota: quota, entries: map[outboxKey]*diskEntry{}}
+	type queued struct {
+		k outboxKey
+		n int64
+	}
+	var replies []queued
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				replies = append(replies, queued{outboxKey{string(name), string(k)}, int64(len(v))})
+				o.size += int64(len(v))
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, r := range replies {
+		if err := o.quota.charge(diskOutbox, r.n); err != nil {
+			o.evict(r.k)
+			continue
+		}
+		o.track(r.k, r.n)
+	}
+	return o, nil
+}
+
+// track makes a queued reply of n bytes evictable by the disk quota.
+func (o *outbox) track(k outboxKey, n int64) {
+	if e := o.quota.track(diskOutbox, n, func() { o.evict(k) }); e != nil {
+		o.entries[k] = e
+	}
+}
+
+// evict drops a queued reply to make room on disk; the hub asks again
+// for what it doesn't get.
+func (o *outbox) evict(k outboxKey) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var n int64
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(k.bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(k.key))
+		if v == nil {
+			return nil
+		}
+		n = int64(len(v))
+		return b.Delete([]byte(k.key))
+	})
+	if err != nil {
+		log.Printf("[outbox] Could not evict a spooled reply: %v", err)
+		return
+	}
+	o.size -= n
+	delete(o.entries, k)
+	if n > 0 {
+		log.Printf("[outbox] Evicted the oldest spooled reply for %q to stay under --max-disk-usage", strings.TrimPrefix(k.bucket, "outbox:"))
+	}
+}
+
+func (o *outbox) Close() error { return o.db.Close() }
+
+// outboxBucket names a token's queue; the default token's name is empty,
+// which bolt doesn't allow as a bucket name.
+func outboxBucket(tenant string) []byte {
+	return []byte("outbox:" + tenant)
+}
+
+// push queues v for tenant. It fails, leaving the queue as it is, when v
+// would take the outbox over its size limit or doesn't fit in the disk
+// quota.
+func (o *outbox) push(tenant string, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	n := int64(len(buf))
+	// Before o.mu: making room may evict older replies.
+	if err := o.quota.charge(diskOutbox, n); err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size+n > o.max {
+		o.quota.release(diskOutbox, n)
+		return fmt.Errorf("outbox is full (%d of %d bytes)", o.size, o.max)
+	}
+	k := outboxKey{bucket: string(outboxBucket(tenant))}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(k.bucket))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		k.key = string(binary.BigEndian.AppendUint64(nil, seq))
+		return b.Put([]byte(k.key), buf)
+	})
+	if err != nil {
+		o.quota.release(diskOutbox, n)
+		return err
+	}
+	o.size += n
+	o.track(k, n)
+	return nil
+}
+
+// drain sends tenant's queued replies oldest first, removing each once sent.
+// It stops at the first send error and leaves the rest queued.
+func (o *outbox) drain(tenant string, send func([]byte) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var sent [][]byte
+	var sendErr error
+	var freed int64
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket(tenant))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			// A send error still commits the deletions of what went out.
+			if sendErr = send(v); sendErr != nil {
+				break
+			}
+			sent = append(sent, append([]byte(nil), k...))
+			freed += int64(len(v))
+		}
+		for _, k := range sent {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	o.size -= freed
+	for _, k := range sent {
+		k := outboxKey{string(outboxBucket(tenant)), string(k)}
+		o.quota.forget(o.entries[k])
+		delete(o.entries, k)
+	}
+	return len(sent), sendErr
+}
+
+// spoolReply keeps a reply that couldn't be written for delivery after the
+// next reconnect. Blob downloads are streamed, not stored; the hub asks again.
+func (t *tenant) spoolReply(resp any) {
+	if qr, ok := resp.(QueryResponse); ok && qr.spill != nil {
+		// Too big to spool; the hub must ask again.
+		qr.spill.remove()
+		log.Printf("[outbox] Dropping undeliverable spilled result for %q", t.name)
+		return
+	}
+	spool := t.agent.spool
+	if _, ok := resp.(*blobDownload); ok || spool == nil {
+		log.Printf("[outbox] Dropping undeliverable reply for %q", t.name)
+		return
+	}
+	if err := spool.push(t.name, resp); err != nil {
+		log.Printf("[outbox] Dropping undeliverable reply for %q: %v", t.name, err)
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	o, err := openOutbox(path, 64<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"q1", "q2", "q3"} {
+		if err := o.push("acme", QueryResponse{ID: id, Type: "result"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.push("globex", QueryResponse{ID: "g1", Type: "result"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first delivery breaks after one reply; the rest stay queued.
+	var got []string
+	sendErr := errors.New("connection reset")
+	n, err := o.drain("acme", func(b []byte) error {
+		if len(got) == 1 {
+			return sendErr
+		}
+		var r QueryResponse
+		json.Unmarshal(b, &r)
+		got = append(got, r.ID)
+		return nil
+	})
+	if n != 1 || !errors.Is(err, sendErr) {
+		t.Fatalf("expected 1 reply sent and the send error, got %d, %v", n, err)
+	}
+
+	// What's left survives a restart and arrives in order.
+	o.Close()
+	if o, err = openOutbox(path, 64<<20, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	n, err = o.drain("acme", func(b []byte) error {
+		var r QueryResponse
+		json.Unmarshal(b, &r)
+		got = append(got, r.ID)
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 replies, got %d, %v", n, err)
+	}
+	if len(got) != 3 || got[0] != "q1" || got[1] != "q2" || got[2] != "q3" {
+		t.Errorf("expected q1, q2, q3 in order, got %v", got)
+	}
+
+	if n, _ := o.drain("acme", func([]byte) error { return nil }); n != 0 {
+		t.Errorf("expected an empty queue, got %d replies", n)
+	}
+	if n, _ := o.drain("globex", func([]byte) error { return nil }); n != 1 {
+		t.Errorf("expected globex's reply to be kept apart, got %d replies", n)
+	}
+	if o.size != 0 {
+		t.Errorf("expected size 0 after draining, got %d", o.size)
+	}
+}
+
+func TestOutboxSizeLimit(t *testing.T) {
+	o, err := openOutbox(filepath.Join(t.TempDir(), "outbox.db"), 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	if err := o.push("", QueryResponse{ID: "small", Type: "result"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	big := QueryResponse{ID: "big", Type: "result", Rows: [][]any{{string(make([]byte, 200))}}}
+	if err := o.push("", big); err == nil {
+		t.Error("expected a reply over the limit to be refused")
+	}
+}
+
+func TestTenantReplySpoolsWhileDisconnected(t *testing.T) {
+	o, err := openOutbox(filepath.Join(t.TempDir(), "outbox.db"), 64<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	tn := testTenant()
+	tn.name = "acme"
+	tn.agent.spool = o
+	tn.reply(Message{ID: "q1"}, QueryResponse{ID: "q1", Type: "result"})
+	tn.reply(Message{ID: "b1"}, &blobDownload{id: "b1"})
+
+	n, err := o.drain("acme", func([]byte) error { return nil })
+	if err != nil || n != 1 {
+		t.Errorf("expected the result, and not the blob, to be spooled; got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,110 @@
+package agent
+
+import "database/sql"
+
+// Partition is one partition of a partitioned table: its bound, e.g.
+// FOR VALUES FROM ('2026-01-01') TO ('2026-02-01') or DEFAULT, and its
+// size on disk and planner row estimate. A partition that is partitioned
+// itself has a Key and Partitions of its own.
+type Partition struct {
+	Schema     string      `json:"schema"`
+	Name       string      `json:"name"`
+	Bound      string      `json:"bound"`
+	SizeBytes  int64       `json:"size_bytes"`
+	Rows       float64     `json:"rows"`
+	Key        string      `json:"key,omitempty"`
+	Partitions []Partition `json:"partitions,omitempty"`
+}
+
+// partitionsQuery reads every partition with its parent and the parent's
+// partition key, e.g. RANGE (created_at).
+const partitionsQuery = `
+SELECT pn.nspname, p.relname, pg_get_partkeydef(p.oid), n.nspname, c.relname,
+       pg_get_expr(c.relpartbound, c.oid), pg_get_partkeydef(c.oid),
+       pg_total_relation_size(c.oid), greatest(c.reltuples, 0)::float8
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_class p ON p.oid = i.inhparent
+JOIN pg_namespace pn ON pn.oid = p.relnamespace
+WHERE c.relispartition
+ORDER BY pn.nspname, p.relname, c.relname`
+
+// nestPartitions moves the partitions in tables under their parents, so a
+// table partitioned by month is one entry with its months, not one entry
+// per month. The tables left are returned.
+func nestPartitions(q queryer, tables []SchemaTable) ([]SchemaTable, error) {
+	rows, err := q.Query(partitionsQuery)
+	if err != nil {
+		return tables, err
+	}
+	defer rows.Close()
+
+	children := map[[2]string][]Partition{}
+	keys := map[[2]string]string{}
+	parentOf := map[[2]string][2]string{}
+	for rows.Next() {
+		var parent [2]string
+		var p Partition
+		var parentKey, bound, key sql.NullString
+		if err := rows.Scan(&parent[0], &parent[1], &parentKey, &p.Schema, &p.Name, &bound, &key, &p.SizeBytes, &p.Rows); err != nil {
+			return tables, err
+		}
+		p.Bound, p.Key = bound.String, key.String
+		children[parent] = append(children[parent], p)
+		keys[parent] = parentKey.String
+		parentOf[[2]string{p.Schema, p.Name}] = parent
+	}
+	if err := rows.Err(); err != nil {
+		return tables, err
+	}
+
+	var tree func(n [2]string) []Partition
+	tree = func(n [2]string) []Partition {
+		parts := children[n]
+		for i := range parts {
+			parts[i].Partitions = tree([2]string{parts[i].Schema, parts[i].Name})
+		}
+		return parts
+	}
+	listed := map[[2]string]bool{}
+	for _, t := range tables {
+		listed[[2]string{t.Schema, t.Name}] = true
+	}
+	// A partition is left out when its root is listed, which it is not
+	// when a schema filter leaves the root out.
+	root := func(n [2]string) [2]string {
+		for {
+			p, ok := parentOf[n]
+			if !ok {
+				return n
+			}
+			n = p
+		}
+	}
+	kept := tables[:0]
+	for _, t := range tables {
+		n := [2]string{t.Schema, t.Name}
+		if _, ok := parentOf[n]; ok && listed[root(n)] {
+			continue
+		}
+		if t.Kind == "partitioned_table" {
+			t.PartitionKey, t.Partitions = keys[n], tree(n)
+		}
+		kept = append(kept, t)
+	}
+	return kept, nil
+}
+
+// allowedPartitions returns the partitions in parts, at any depth, in
+// schemas c allows, without changing parts.
+func (c Capabilities) allowedPartitions(parts []Partition) []Partition {
+	var allowed []Partition
+	for _, p := range parts {
+		if c.schemaAllowed(p.Schema) {
+			p.Partitions = c.allowedPartitions(p.Partitions)
+			allowed = append(allowed, p)
+		}
+	}
+	return allowed
+}
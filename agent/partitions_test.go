@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNestPartitions(t *testing.T) {
+	columns := []string{"parent_schema", "parent", "parent_key", "schema", "name", "bound", "key", "size", "rows"}
+	tests := []struct {
+		name   string
+		tables []string
+		check  func(*testing.T, []SchemaTable)
+	}{
+		{
+			name:   "nested under the parent",
+			tables: []string{"events", "events_2025", "events_2026", "events_2026_eu", "events_2026_us", "users"},
+			check: func(t *testing.T, tables []SchemaTable) {
+				if len(tables) != 2 || tables[0].Name != "events" || tables[1].Name != "users" {
+					t.Fatalf("expected events and users, got %+v", tables)
+				}
+				events := tables[0]
+				if events.PartitionKey != "RANGE (created_at)" || len(events.Partitions) != 2 {
+					t.Fatalf("unexpected events: %+v", events)
+				}
+				y2025, y2026 := events.Partitions[0], events.Partitions[1]
+				if y2025.Bound != "FOR VALUES FROM ('2025-01-01') TO ('2026-01-01')" || y2025.SizeBytes != 8192 || y2025.Rows != 100 || len(y2025.Partitions) != 0 {
+					t.Errorf("unexpected 2025 partition: %+v", y2025)
+				}
+				if y2026.Key != "LIST (region)" || len(y2026.Partitions) != 2 || y2026.Partitions[1].Bound != "DEFAULT" {
+					t.Errorf("unexpected 2026 partition: %+v", y2026)
+				}
+				if tables[1].Partitions != nil {
+					t.Errorf("users is not partitioned: %+v", tables[1])
+				}
+			},
+		},
+		{
+			name:   "parent filtered out",
+			tables: []string{"events_2026_eu", "events_2026_us"},
+			check: func(t *testing.T, tables []SchemaTable) {
+				if len(tables) != 2 {
+					t.Errorf("expected partitions without their parent to stay listed, got %+v", tables)
+				}
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+			mock.ExpectQuery("FROM pg_inherits").WillReturnRows(sqlmock.NewRows(columns).
+				AddRow("public", "events", "RANGE (created_at)", "public", "events_2025", "FOR VALUES FROM ('2025-01-01') TO ('2026-01-01')", nil, 8192, 100.0).
+				AddRow("public", "events", "RANGE (created_at)", "public", "events_2026", "FOR VALUES FROM ('2026-01-01') TO ('2027-01-01')", "LIST (region)", 0, 0.0).
+				AddRow("public", "events_2026", "LIST (region)", "public", "events_2026_eu", "FOR VALUES IN ('eu')", nil, 16384, 250.0).
+				AddRow("public", "events_2026", "LIST (region)", "public", "events_2026_us", "DEFAULT", nil, 24576, 400.0))
+
+			var tables []SchemaTable
+			for _, name := range tc.tables {
+				kind := "table"
+				if name == "events" || name == "events_2026" {
+					kind = "partitioned_table"
+				}
+				tables = append(tables, SchemaTable{Schema: "public", Name: name, Kind: kind})
+			}
+			tables, err = nestPartitions(mockDB, tables)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tc.check(t, tables)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
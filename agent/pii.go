@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Rows a PII scan reads from each table by default, and at most.
+const (
+	defaultPIISampleRows = 1000
+	maxPIISampleRows     = 10000
+)
+
+// PIIScan is what a scan_pii message asks to scan: the tables of Schemas,
+// or every schema the token may read, narrowed to Tables ("table" or
+// "schema.table") when given, reading up to SampleRows rows of each.
+type PIIScan struct {
+	Schemas    []string `json:"schemas,omitempty"`
+	Tables     []string `json:"tables,omitempty"`
+	SampleRows int      `json:"sample_rows,omitempty"`
+}
+
+// piiReportColumns are the columns of a scan's report, one row per column
+// that looks like it holds personal data. Rule is an AnonymizeRule that
+// would mask the column, for the config file.
+var piiReportColumns = []string{"schema", "table", "column", "type", "category", "confidence", "matched", "sampled", "name_hint", "rule"}
+
+// piiDetector recognizes one category of personal data in a value, and a
+// column named for it.
+type piiDetector struct {
+	category string
+	value    *regexp.Regexp
+	// valid, if set, checks a match further, such as a card number's
+	// check digit.
+	valid func(string) bool
+	name  *regexp.Regexp
+	// rule masks a column of the category.
+	rule AnonymizeRule
+}
+
+// piiDetectors are tried in order, and a value counts for the first whose
+// pattern it matches, if it passes that detector's check, so the narrower
+// patterns come first: an SSN would also pass for a phone number, and a
+// long number that fails the card check is more likely an ID than either.
+var piiDetectors = []piiDetector{
+	{
+		category: "email",
+		value:    regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+		name:     regexp.MustCompile(`(?i)e_?mail`),
+		rule:     AnonymizeRule{Transform: "fake", Fake: "email"},
+	},
+	{
+		category: "ssn",
+		value:    regexp.MustCompile(`\b(?:00[1-9]|0[1-9][0-9]|[1-578][0-9]{2}|6[0-57-9][0-9]|66[0-57-9])-(?:0[1-9]|[1-9][0-9])-(?:000[1-9]|00[1-9][0-9]|0[1-9][0-9]{2}|[1-9][0-9]{3})\b`),
+		name:     regexp.MustCompile(`(?i)ssn|social_?sec|tax_?id`),
+		rule:     AnonymizeRule{Transform: "hash"},
+	},
+	{
+		category: "card_number",
+		value:    regexp.MustCompile(`\b[0-9](?:[ -]?[0-9]){12,18}\b`),
+		valid:    luhnValid,
+		name:     regexp.MustCompile(`(?i)card|\bpan\b|cc_?num`),
+		rule:     AnonymizeRule{Transform: "null"},
+	},
+	{
+		category: "phone",
+		value:    regexp.MustCompile(`(?:\+[0-9]{1,3}[ .-]?)?(?:\([0-9]{2,4}\)[ .-]?|[0-9]{2,4}[ .-])[0-9]{3,4}[ .-]?[0-9]{3,4}\b`),
+		name:     regexp.MustCompile(`(?i)phone|mobile|\bcell|\bfax\b|msisdn`),
+		rule:     AnonymizeRule{Transform: "fake", Fake: "phone"},
+	},
+}
+
+// piiColumnsQuery lists the text columns of tables, partitioned tables
+// (whose partitions are scanned through them), materialized views and
+// foreign tables, in the schemas $1 names or, when it is empty, in every
+// schema but the system's.
+const piiColumnsQuery = `
+SELECT n.nspname, c.relname, a.attname, format_type(a.atttypid, a.atttypmod)
+FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_type t ON t.oid = a.atttypid
+WHERE c.relkind IN ('r', 'p', 'm', 'f') AND NOT c.relispartition
+  AND a.attnum > 0 AND NOT a.attisdropped AND t.typcategory = 'S'
+  AND n.nspname <> 'information_schema' AND n.nspname NOT LIKE 'pg\_%'
+  AND (cardinality($1::text[]) = 0 OR n.nspname = ANY($1))
+ORDER BY n.nspname, c.relname, a.attnum`
+
+// piiTable is a table to scan and its text columns.
+type piiTable struct {
+	schema, name string
+	columns      []string
+	types        []string
+}
+
+// startPIIScan answers a "scan_pii" message by starting a job that scans
+// the connection msg targets, replying at once with the job. The report
+// is the job's result, fetched with job_result like an export's rows. It
+// holds counts, never the values themselves, so tokens need not be able
+// to export; the schemas the token may read still apply.
+func startPIIScan(msg Message) JobResponse {
+	fail := func(err error) JobResponse {
+		log.Printf("[job:%s] Error: %v", msg.ID, err)
+		return JobResponse{ID: msg.ID, Type: "job", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	jobs := msg.agent().jobs
+	if jobs == nil {
+		return fail(codedErrorf(codeNotSupported, "jobs are disabled; start the agent with --jobs-db"))
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	if sc, ok := c.Connector.(*sqlConnector); !ok || sc.flavor != "postgres" {
+		return fail(codedErrorf(codeNotSupported, "scan_pii is not supported for %s", c.Flavor()))
+	}
+	scan := PIIScan{}
+	if msg.Scan != nil {
+		scan = *msg.Scan
+	}
+	if scan.SampleRows < 0 || scan.SampleRows > maxPIISampleRows {
+		return fail(codedErrorf(codeInvalidRequest, "sample_rows must be between 1 and %d, got %d", maxPIISampleRows, scan.SampleRows))
+	}
+	for _, t := range scan.Tables {
+		if parts, err := identifierParts(t); err != nil || len(parts) > 2 {
+			return fail(codedErrorf(codeInvalidRequest, "%q is not a table: expected table or schema.table", t))
+		}
+	}
+
+	j := &Job{
+		ID:         newJobID(),
+		Kind:       "scan_pii",
+		Connection: c.Name,
+		User:       msg.User,
+		Scan:       &scan,
+		Status:     "running",
+		CreatedAt:  time.Now(),
+	}
+	if msg.tenant != nil {
+		j.Tenant = msg.tenant.name
+	}
+	if err := jobs.put(j); err != nil {
+		return fail(fmt.Errorf("could not store job: %w", err))
+	}
+	reply := *j
+	jobs.start(msg.context(), msg.tenant, j)
+	return JobResponse{ID: msg.ID, Type: "job", Job: &reply}
+}
+
+// scanPII runs the scan of job msg.JobID on c, returning its report as a
+// result. It is registered as a running query under the job's ID for the
+// whole scan, so "cancel" stops it between tables as well as during one.
+func scanPII(c *connection, msg Message, scan PIIScan) QueryResponse {
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return queryError(msg.ID, codedErrorf(codeNotSupported, "scan_pii is not supported for %s", c.Flavor()))
+	}
+	limit := scan.SampleRows
+	if limit == 0 {
+		limit = defaultPIISampleRows
+	}
+	ctx, done := msg.agent().running.start(msg.context(), msg.ID, msg.tenant, sc)
+	defer done()
+	fail := func(err error) QueryResponse {
+		resp := queryError(msg.ID, err)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			resp.ErrorCode = codeCanceled
+		}
+		return resp
+	}
+
+	tables, err := piiTables(ctx, sc, scan, msg.capabilities())
+	if err != nil {
+		return fail(err)
+	}
+	resp := QueryResponse{ID: msg.ID, Type: "result", Columns: piiReportColumns, Rows: [][]any{}, Connection: c.Name}
+	d := dialectFor(sc.flavor)
+	for _, t := range tables {
+		cols := make([]string, len(t.columns))
+		for i, col := range t.columns {
+			cols[i] = d.quoted(col)
+		}
+		q := msg
+		q.SQL = fmt.Sprintf("SELECT %s FROM %s.%s LIMIT %d", strings.Join(cols, ", "), d.quoted(t.schema), d.quoted(t.name), limit)
+		q.Params = nil
+		sample := sc.QueryContext(ctx, q)
+		if sample.Error != "" {
+			if ctx.Err() != nil {
+				return fail(ctx.Err())
+			}
+			// A table the agent can't read, say for lack of a grant,
+			// doesn't end the scan.
+			log.Printf("[job:%s] Skipping %s.%s: %s", msg.ID, t.schema, t.name, sample.Error)
+			continue
+		}
+		for i := range t.columns {
+			values := make([]any, len(sample.Rows))
+			for r, row := range sample.Rows {
+				values[r] = row[i]
+			}
+			if row := classifyPIIColumn(c, t, i, values); row != nil {
+				resp.Rows = append(resp.Rows, row)
+			}
+		}
+	}
+	return resp
+}
+
+// piiTables lists the tables scan covers that caps may read.
+func piiTables(ctx context.Context, sc *sqlConnector, scan PIIScan, caps Capabilities) ([]*piiTable, error) {
+	rows, err := sc.db.QueryContext(ctx, piiColumnsQuery, pq.Array(scan.Schemas))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	d := dialectFor(sc.flavor)
+	var tables []*piiTable
+	for rows.Next() {
+		var schema, table, column, typ string
+		if err := rows.Scan(&schema, &table, &column, &typ); err != nil {
+			return nil, err
+		}
+		if !caps.schemaAllowed(schema) || !piiTableWanted(d, scan.Tables, schema, table) {
+			continue
+		}
+		if n := len(tables); n == 0 || tables[n-1].schema != schema || tables[n-1].name != table {
+			tables = append(tables, &piiTable{schema: schema, name: table})
+		}
+		t := tables[len(tables)-1]
+		t.columns = append(t.columns, column)
+		t.types = append(t.types, typ)
+	}
+	return tables, rows.Err()
+}
+
+// piiTableWanted reports whether schema.table is one of wanted, or wanted
+// is empty.
+func piiTableWanted(d identDialect, wanted []string, schema, table string) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, w := range wanted {
+		parts, _ := identifierParts(w)
+		switch {
+		case len(parts) == 1 && d.name(parts[0]) == table:
+			return true
+		case len(parts) == 2 && d.name(parts[0]) == schema && d.name(parts[1]) == table:
+			return true
+		}
+	}
+	return false
+}
+
+// classifyPIIColumn returns the report row for column i of t, given its
+// sampled values, or nil if it doesn't look like personal data. The
+// column's category is the one most of its matching values have; its
+// confidence is high when most of the non-null values match, or some do
+// and the column is named for the category, medium when a good share
+// match or the name alone fits, and low otherwise.
+func classifyPIIColumn(c *connection, t *piiTable, i int, values []any) []any {
+	column := t.columns[i]
+	counts := make([]int, len(piiDetectors))
+	sampled := 0
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || strings.TrimSpace(s) == "" {
+			continue
+		}
+		sampled++
+		for k, det := range piiDetectors {
+			if m := det.value.FindString(s); m != "" {
+				if det.valid == nil || det.valid(m) {
+					counts[k]++
+				}
+				break
+			}
+		}
+	}
+
+	best := -1
+	for k := range piiDetectors {
+		if counts[k] > 0 && (best < 0 || counts[k] > counts[best]) {
+			best = k
+		}
+	}
+	if best < 0 {
+		// No value matched: only a telling name flags the column.
+		for k, det := range piiDetectors {
+			if det.name.MatchString(column) {
+				best = k
+				break
+			}
+		}
+		if best < 0 {
+			return nil
+		}
+	}
+	det := piiDetectors[best]
+	hint := det.name.MatchString(column)
+	share := 0.0
+	if sampled > 0 {
+		share = float64(counts[best]) / float64(sampled)
+	}
+	confidence := "low"
+	switch {
+	case share >= 0.8, share > 0 && hint:
+		confidence = "high"
+	case share >= 0.3, hint:
+		confidence = "medium"
+	}
+
+	rule := det.rule
+	rule.Column = "^" + regexp.QuoteMeta(column) + "$"
+	rule.Connections = []string{c.Name}
+	return []any{t.schema, t.name, column, t.types[i], det.category, confidence, counts[best], sampled, hint, rule}
+}
+
+// luhnValid reports whether the digits of s pass the Luhn check every
+// card number does.
+func luhnValid(s string) bool {
+	var digits []int
+	for _, ch := range s {
+		if ch >= '0' && ch <= '9' {
+			digits = append(digits, int(ch-'0'))
+		}
+	}
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return len(digits) >= 13 && sum%10 == 0
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClassifyPIIColumn(t *testing.T) {
+	c := &connection{Name: "main"}
+	tests := []struct {
+		column     string
+		values     []any
+		category   string
+		confidence string
+	}{
+		{column: "contact", values: []any{"ann@corp.com", "bob@corp.co.uk", nil, ""}, category: "email", confidence: "high"},
+		{column: "notes", values: []any{"call +1 (415) 555-0134 after 5", "paid", "ok", "fine"}, category: "phone", confidence: "low"},
+		{column: "tax_id", values: []any{"123-45-6789", "000-12-3456"}, category: "ssn", confidence: "high"},
+		{column: "ref", values: []any{"4111 1111 1111 1111", "4111 1111 1111 1112"}, category: "card_number", confidence: "medium"},
+		{column: "mobile", values: []any{nil}, category: "phone", confidence: "medium"},
+		{column: "status", values: []any{"active", "4111 1111 1111 1112"}},
+	}
+	for _, tc := range tests {
+		tbl := &piiTable{schema: "public", name: "people", columns: []string{tc.column}, types: []string{"text"}}
+		row := classifyPIIColumn(c, tbl, 0, tc.values)
+		if tc.category == "" {
+			if row != nil {
+				t.Errorf("%s: expected no finding, got %v", tc.column, row)
+			}
+			continue
+		}
+		if row == nil || row[4] != tc.category || row[5] != tc.confidence {
+			t.Errorf("%s: got %v, want %s with %s confidence", tc.column, row, tc.category, tc.confidence)
+			continue
+		}
+		if r := row[9].(AnonymizeRule); r.Column != "^"+tc.column+"$" || r.check() != nil {
+			t.Errorf("%s: unexpected rule %+v", tc.column, r)
+		}
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	for s, want := range map[string]bool{
+		"4111111111111111":    true,
+		"4111-1111-1111-1111": true,
+		"4111111111111112":    false,
+		"0":                   false,
+	} {
+		if got := luhnValid(s); got != want {
+			t.Errorf("luhnValid(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestPIIScanJob(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	tn := testTenant(
+		&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}},
+		&connection{Name: "ora", Connector: &sqlConnector{flavor: "oracle"}},
+	)
+	tn.name = "acme"
+	store, err := openJobStore(tn.agent, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tn.agent.jobs = store
+
+	if resp := startPIIScan(Message{ID: "p1", Target: "ora", tenant: tn}); resp.ErrorCode != codeNotSupported {
+		t.Errorf("expected %s, got %+v", codeNotSupported, resp)
+	}
+	if resp := startPIIScan(Message{ID: "p2", Scan: &PIIScan{SampleRows: 50000}, tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s, got %+v", codeInvalidRequest, resp)
+	}
+
+	mock.ExpectQuery("SELECT n.nspname, c.relname, a.attname").WillReturnRows(sqlmock.NewRows([]string{"nspname", "relname", "attname", "type"}).
+		AddRow("public", "users", "email", "text").
+		AddRow("public", "users", "nickname", "text").
+		AddRow("public", "orders", "note", "text").
+		AddRow("audit", "log", "who", "text"))
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "email", "nickname" FROM "public"."users" LIMIT 100`)).WillReturnRows(sqlmock.NewRows([]string{"email", "nickname"}).
+		AddRow("ann@corp.com", "annie").
+		AddRow("bob@corp.com", "bobby"))
+	j := &Job{ID: "j1", Kind: "scan_pii", Tenant: "acme", Connection: "main", Scan: &PIIScan{Tables: []string{"users"}, SampleRows: 100}, Status: "running", CreatedAt: time.Now()}
+	store.run(context.Background(), tn, j)
+
+	if j.Status != "done" || j.Rows != 1 {
+		t.Fatalf("expected a finished scan with one finding, got %+v", j)
+	}
+	page := jobResultPage(Message{ID: "r1", JobID: "j1", tenant: tn})
+	if page.Error != "" || len(page.Rows) != 1 || page.Rows[0][2] != "email" || page.Rows[0][5] != "high" {
+		t.Errorf("unexpected report: %+v", page)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Adapter plugins let third parties add databases without forking the agent.
+// For a DATABASE_URL scheme with no built-in connector, e.g. firebird://, the
+// agent starts peekdb-adapter-firebird from the PATH and speaks JSON-RPC 2.0
+// to it over stdin/stdout, one JSON object per line:
+//
+//	initialize {"url": "..."}          -> {"flavor": "firebird"}
+//	query      <the query message>     -> {"columns": [...], "rows": [[...]], "cursor": "..."}
+//	schema     {"schema": "..."}       -> {"tables": [...]}
+//	shutdown   {}                      -> {}
+//
+// Anything the adapter writes to stderr ends up in the agent log. An adapter
+// that exits is restarted on the next request.
+
+const pluginPrefix = "peekdb-adapter-"
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int64  `json:"id"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    struct {
+			// ErrorCode is one of the agent's error codes, e.g.
+			// "syntax_error"; see errors.go.
+			ErrorCode string `json:"error_code"`
+		} `json:"data"`
+	} `json:"error"`
+}
+
+type pluginConnector struct {
+	argv   []string
+	url    string
+	flavor string
+
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	cmd     *exec.Cmd
+	nextID  int64
+	pending map[int64]chan rpcResponse
+}
+
+func startPlugin(scheme, rawURL string) (*pluginConnector, error) {
+	path, err := exec.LookPath(pluginPrefix + scheme)
+	if err != nil {
+		return nil, fmt.Errorf("no built-in connector for %s:// and no %s%s adapter on PATH", scheme, pluginPrefix, scheme)
+	}
+	return newPlugin(rawURL, scheme, path)
+}
+
+func newPlugin(rawURL, flavor string, argv ...string) (*pluginConnector, error) {
+	p := &pluginConnector{argv: argv, url: rawURL, flavor: flavor}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// start launches the adapter and sends initialize. Callers hold no lock.
+func (p *pluginConnector) start() error {
+	cmd := exec.Command(p.argv[0], p.argv[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start adapter: %w", err)
+	}
+	log.Printf("Started adapter %s (pid %d)", p.argv[0], cmd.Process.Pid)
+
+	p.mu.Lock()
+	p.cmd, p.stdin = cmd, stdin
+	p.pending = map[int64]chan rpcResponse{}
+	p.mu.Unlock()
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[adapter:%s] %s", p.flavor, scanner.Text())
+		}
+	}()
+	go p.readLoop(cmd, stdout)
+
+	var init struct {
+		Flavor string `json:"flavor"`
+	}
+	if err := p.call(context.Background(), "initialize", map[string]string{"url": p.url}, &init); err != nil {
+		p.Close()
+		return fmt.Errorf("adapter initialize: %w", err)
+	}
+	if init.Flavor != "" {
+		p.flavor = init.Flavor
+	}
+	return nil
+}
+
+func (p *pluginConnector) readLoop(cmd *exec.Cmd, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	for scanner.Scan() {
+		var resp rpcResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			log.Printf("[adapter:%s] Ignoring malformed response: %v", p.flavor, err)
+			continue
+		}
+		p.mu.Lock()
+		ch := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+
+	err := cmd.Wait()
+	log.Printf("[adapter:%s] Exited: %v", p.flavor, err)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == cmd {
+		p.cmd, p.stdin = nil, nil
+	}
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+}
+
+// call sends one request to the adapter and waits for its response, or until
+// ctx is cancelled. A late response to an abandoned request is dropped.
+func (p *pluginConnector) call(ctx context.Context, method string, params, result any) error {
+	p.mu.Lock()
+	if p.cmd == nil {
+		p.mu.Unlock()
+		if method == "initialize" {
+			return errors.New("adapter exited")
+		}
+		if err := p.start(); err != nil {
+			return err
+		}
+		p.mu.Lock()
+	}
+	p.nextID++
+	id := p.nextID
+	ch := make(chan rpcResponse, 1)
+	p.pending[id] = ch
+	buf, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err == nil {
+		_, err = p.stdin.Write(append(buf, '\n'))
+	}
+	if err != nil {
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("adapter write: %w", err)
+	}
+
+	var resp rpcResponse
+	var ok bool
+	select {
+	case resp, ok = <-ch:
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+	if !ok {
+		return errors.New("adapter exited")
+	}
+	if resp.Error != nil {
+		code := resp.Error.Data.ErrorCode
+		if code == "" {
+			code = codeQueryFailed
+		}
+		return &codedError{code: code, msg: resp.Error.Message}
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+func (p *pluginConnector) Flavor() string { return p.flavor }
+
+func (p *pluginConnector) Query(msg Message) QueryResponse {
+	return p.QueryContext(context.Background(), msg)
+}
+
+func (p *pluginConnector) QueryContext(ctx context.Context, msg Message) QueryResponse {
+	log.Printf("[query:%s] Executing on adapter %s: %s", msg.ID, p.flavor, logSQL(msg.SQL))
+	start := time.Now()
+
+	var resp QueryResponse
+	if err := p.call(ctx, "query", msg, &resp); err != nil {
+		log.Printf("[query:%s] Error: %v", msg.ID, err)
+		return queryError(msg.ID, err)
+	}
+	resp.ID, resp.Type = msg.ID, "result"
+
+	log.Printf("[query:%s] Completed in %v, %d rows", msg.ID, time.Since(start), len(resp.Rows))
+	return resp
+}
+
+func (p *pluginConnector) Schema(id, schema string) SchemaResponse {
+	var resp struct {
+		Tables []SchemaTable `json:"tables"`
+	}
+	err := p.call(context.Background(), "schema", map[string]string{"schema": schema}, &resp)
+	return schemaResponse(id, resp.Tables, err)
+}
+
+// Close asks the adapter to shut down and kills it if it doesn't exit.
+func (p *pluginConnector) Close() error {
+	p.mu.Lock()
+	cmd, stdin := p.cmd, p.stdin
+	p.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.call(context.Background(), "shutdown", struct{}{}, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+	stdin.Close()
+	time.AfterFunc(5*time.Second, func() { cmd.Process.Kill() })
+	return nil
+}
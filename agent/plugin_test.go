@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestPluginHelperProcess is not a real test: it is re-executed by the tests
+// below to act as an adapter plugin.
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("PEEKDB_TEST_ADAPTER") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(scanner.Bytes(), &req)
+
+		var result any
+		var rpcErr any
+		switch req.Method {
+		case "initialize":
+			result = map[string]string{"flavor": "fakedb"}
+		case "query":
+			var msg Message
+			json.Unmarshal(req.Params, &msg)
+			if msg.SQL == "crash" {
+				os.Exit(3)
+			}
+			if msg.SQL == "bad" {
+				rpcErr = map[string]any{"code": 1, "message": "syntax error near bad"}
+				break
+			}
+			result = map[string]any{"columns": []string{"echo"}, "rows": [][]any{{msg.SQL}}}
+		case "schema":
+			result = map[string]any{"tables": []map[string]any{{"schema": "main", "name": "things", "kind": "table"}}}
+		case "shutdown":
+			result = struct{}{}
+		}
+		out, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result, "error": rpcErr})
+		fmt.Println(string(out))
+		if req.Method == "shutdown" {
+			os.Exit(0)
+		}
+	}
+	os.Exit(0)
+}
+
+func startTestPlugin(t *testing.T) *pluginConnector {
+	t.Setenv("PEEKDB_TEST_ADAPTER", "1")
+	p, err := newPlugin("fakedb://local", "fakedb", os.Args[0], "-test.run=TestPluginHelperProcess")
+	if err != nil {
+		t.Fatalf("newPlugin: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPluginConnector(t *testing.T) {
+	p := startTestPlugin(t)
+
+	if p.Flavor() != "fakedb" {
+		t.Errorf("expected flavor from initialize, got %q", p.Flavor())
+	}
+
+	resp := p.Query(Message{Type: "query", ID: "p1", SQL: "SELECT 1"})
+	if resp.Error != "" || resp.ID != "p1" || resp.Type != "result" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if len(resp.Rows) != 1 || resp.Rows[0][0] != "SELECT 1" {
+		t.Errorf("unexpected rows: %v", resp.Rows)
+	}
+
+	resp = p.Query(Message{Type: "query", ID: "p2", SQL: "bad"})
+	if resp.Error != "syntax error near bad" {
+		t.Errorf("expected adapter error, got %q", resp.Error)
+	}
+
+	schema := p.Schema("s1", "")
+	if schema.Error != "" || len(schema.Tables) != 1 || schema.Tables[0].Name != "things" {
+		t.Errorf("unexpected schema: %+v", schema)
+	}
+}
+
+func TestPluginConnector_Restart(t *testing.T) {
+	p := startTestPlugin(t)
+
+	resp := p.Query(Message{Type: "query", ID: "p1", SQL: "crash"})
+	if resp.Error != "adapter exited" {
+		t.Fatalf("expected adapter exited error, got %+v", resp)
+	}
+
+	resp = p.Query(Message{Type: "query", ID: "p2", SQL: "SELECT 2"})
+	if resp.Error != "" || len(resp.Rows) != 1 {
+		t.Errorf("expected adapter to be restarted, got %+v", resp)
+	}
+}
+
+func TestStartPlugin_Missing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if _, err := openConnector("nosuchdb://host", "postgres", nil, ""); err == nil {
+		t.Errorf("expected error for unknown scheme without adapter")
+	}
+}
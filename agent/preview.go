@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Rows a preview_table message returns without a limit, and at most.
+const (
+	defaultPreviewRows = 100
+	maxPreviewRows     = 1000
+)
+
+// TablePreview accompanies the rows of a preview_table message: the table
+// they came from, how they were ordered, and each column's statistics.
+type TablePreview struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	// RowEstimate is the planner's estimate of the table's rows, summed
+	// over the partitions of a partitioned table.
+	RowEstimate float64 `json:"row_estimate"`
+	// Order is "recent" when the rows are newest first by a creation
+	// timestamp, "primary_key" when they are in key order, and "none"
+	// when the table has neither; OrderBy lists the columns.
+	Order   string   `json:"order"`
+	OrderBy []string `json:"order_by,omitempty"`
+	// Analyzed is false when the table has no statistics yet, and the
+	// columns have only their names and types.
+	Analyzed bool          `json:"analyzed"`
+	Columns  []ColumnStats `json:"column_stats"`
+}
+
+// ColumnStats is what pg_stats says about a column. Min and Max are the
+// ends of its histogram, so they are approximate, and missing for a
+// column whose values all fit in its most common values.
+type ColumnStats struct {
+	Name             string   `json:"name"`
+	Type             string   `json:"type"`
+	NullFraction     *float64 `json:"null_frac,omitempty"`
+	DistinctEstimate *float64 `json:"distinct_estimate,omitempty"`
+	Min              *string  `json:"min,omitempty"`
+	Max              *string  `json:"max,omitempty"`
+}
+
+const previewTableQuery = `
+SELECT n.nspname, c.relname,
+       CASE WHEN c.relkind = 'p' THEN
+         (SELECT coalesce(sum(greatest(l.reltuples, 0)), 0) FROM pg_partition_tree(c.oid) t
+          JOIN pg_class l ON l.oid = t.relid WHERE t.isleaf)
+       ELSE greatest(c.reltuples, 0) END::float8
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.oid = $1::regclass`
+
+// previewColumnsQuery reads the columns with their statistics. A
+// partitioned table's statistics cover its partitions, so they are the
+// inherited ones.
+const previewColumnsQuery = `
+SELECT a.attname, format_type(a.atttypid, a.atttypmod), s.null_frac, s.n_distinct,
+       (s.histogram_bounds::text::text[])[1],
+       (s.histogram_bounds::text::text[])[array_length(s.histogram_bounds::text::text[], 1)]
+FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = c.relname
+  AND s.attname = a.attname AND s.inherited = (c.relkind = 'p')
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`
+
+// recencyColumns are the names of creation timestamps, most telling
+// first. A preview shows the newest rows by the first the table has.
+var recencyColumns = []string{"created_at", "inserted_at", "created_on", "created", "creation_time"}
+
+// previewTable answers a "preview_table" message with the first rows of
+// the table msg.Identifier names, written as in a statement, and its
+// column statistics, so the table browser needs one message instead of
+// several queries. The rows are read as a query with the message's ID,
+// so the token's limits apply and "cancel" stops it.
+func previewTable(msg Message) QueryResponse {
+	c, err := msg.route()
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return queryError(msg.ID, codedErrorf(codeNotSupported, "preview_table is not supported for %s", c.Flavor()))
+	}
+	limit := msg.Limit
+	if limit == 0 {
+		limit = defaultPreviewRows
+	}
+	if limit < 0 || limit > maxPreviewRows {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "limit must be between 1 and %d, got %d", maxPreviewRows, msg.Limit))
+	}
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	if len(parts) > 2 {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "%q is not a table: expected table or schema.table", msg.Identifier))
+	}
+	d := dialectFor(sc.flavor)
+	table := d.qualifiedSQL(parts)
+
+	log.Printf("[preview:%s] Reading %s", msg.ID, table)
+	p, err := loadPreview(sc, table)
+	if err != nil {
+		log.Printf("[preview:%s] Error: %v", msg.ID, err)
+		return queryError(msg.ID, err)
+	}
+	if !msg.capabilities().schemaAllowed(p.Schema) {
+		return queryError(msg.ID, codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", p.Schema))
+	}
+
+	q := msg
+	q.Type, q.Identifier, q.Limit = "query", "", 0
+	q.SQL = previewSQL(d, p, limit)
+	resp := runQuery(q)
+	if resp.Error == "" {
+		resp.Preview = p
+	}
+	return resp
+}
+
+// loadPreview reads what a preview says about table, a name quoted for
+// Postgres.
+func loadPreview(sc *sqlConnector, table string) (*TablePreview, error) {
+	p := &TablePreview{Order: "none", Columns: []ColumnStats{}}
+	if err := sc.db.QueryRow(previewTableQuery, table).Scan(&p.Schema, &p.Table, &p.RowEstimate); err != nil {
+		return nil, err
+	}
+
+	pk, err := primaryKey(sc, table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sc.db.Query(previewColumnsQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recent string
+	for rows.Next() {
+		var col ColumnStats
+		var nullFrac, distinct sql.NullFloat64
+		var lo, hi sql.NullString
+		if err := rows.Scan(&col.Name, &col.Type, &nullFrac, &distinct, &lo, &hi); err != nil {
+			return nil, err
+		}
+		if nullFrac.Valid {
+			p.Analyzed = true
+			col.NullFraction = &nullFrac.Float64
+		}
+		if distinct.Valid {
+			// A negative n_distinct is a fraction of the rows, for
+			// columns whose distinct values grow with the table.
+			n := distinct.Float64
+			if n < 0 {
+				n = math.Round(-n * p.RowEstimate)
+			}
+			col.DistinctEstimate = &n
+		}
+		if lo.Valid {
+			col.Min = &lo.String
+		}
+		if hi.Valid {
+			col.Max = &hi.String
+		}
+		if isTimestamp(col.Type) && slices.Contains(recencyColumns, col.Name) &&
+			(recent == "" || slices.Index(recencyColumns, col.Name) < slices.Index(recencyColumns, recent)) {
+			recent = col.Name
+		}
+		p.Columns = append(p.Columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case recent != "":
+		p.Order, p.OrderBy = "recent", []string{recent}
+	case len(pk) > 0:
+		p.Order, p.OrderBy = "primary_key", pk
+	}
+	return p, nil
+}
+
+func isTimestamp(typ string) bool {
+	return strings.HasPrefix(typ, "timestamp") || typ == "date"
+}
+
+// previewSQL is the query that reads p's first limit rows in its order.
+func previewSQL(d identDialect, p *TablePreview, limit int) string {
+	q := "SELECT * FROM " + d.quoted(p.Schema) + "." + d.quoted(p.Table)
+	var terms []string
+	for _, col := range p.OrderBy {
+		term := d.quoted(col)
+		if p.Order == "recent" {
+			term += " DESC NULLS LAST"
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) > 0 {
+		q += " ORDER BY " + strings.Join(terms, ", ")
+	}
+	return fmt.Sprintf("%s LIMIT %d", q, limit)
+}
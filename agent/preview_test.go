@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPreviewTable(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public", "Sales"}})
+
+	columns := []string{"attname", "type", "null_frac", "n_distinct", "min", "max"}
+	tests := []struct {
+		name     string
+		msg      Message
+		table    string
+		schema   string
+		relname  string
+		pk       []string
+		columns  *sqlmock.Rows
+		sql      string
+		order    []string
+		wantCode string
+	}{
+		{
+			name:    "newest first",
+			msg:     Message{ID: "p1", Identifier: "orders"},
+			table:   `"orders"`,
+			schema:  "public",
+			relname: "orders",
+			pk:      []string{"id"},
+			columns: sqlmock.NewRows(columns).
+				AddRow("id", "bigint", 0.0, -1.0, "1", "1000").
+				AddRow("updated_at", "timestamp with time zone", 0.0, -0.5, nil, nil).
+				AddRow("created_at", "timestamp with time zone", 0.25, -0.5, "2026-01-01", "2026-10-17"),
+			sql:   `SELECT * FROM "public"."orders" ORDER BY "created_at" DESC NULLS LAST LIMIT 100`,
+			order: []string{"created_at"},
+		},
+		{
+			name:    "primary key",
+			msg:     Message{ID: "p2", Identifier: `"Sales"."Order Items"`, Limit: 5},
+			table:   `"Sales"."Order Items"`,
+			schema:  "Sales",
+			relname: "Order Items",
+			pk:      []string{"order_id", "line"},
+			columns: sqlmock.NewRows(columns).
+				AddRow("order_id", "bigint", nil, nil, nil, nil).
+				AddRow("line", "integer", nil, nil, nil, nil).
+				AddRow("created_at", "text", nil, nil, nil, nil),
+			sql:   `SELECT * FROM "Sales"."Order Items" ORDER BY "order_id", "line" LIMIT 5`,
+			order: []string{"order_id", "line"},
+		},
+		{
+			name:     "schema not allowed",
+			msg:      Message{ID: "p3", Identifier: "secret.payroll"},
+			table:    `"secret"."payroll"`,
+			schema:   "secret",
+			relname:  "payroll",
+			wantCode: codePolicyDenied,
+		},
+		{
+			name:     "limit too high",
+			msg:      Message{ID: "p4", Identifier: "orders", Limit: maxPreviewRows + 1},
+			wantCode: codeInvalidRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.msg.tenant = tn
+			if tc.table != "" {
+				mock.ExpectQuery("FROM pg_class").WithArgs(tc.table).
+					WillReturnRows(sqlmock.NewRows([]string{"nspname", "relname", "reltuples"}).AddRow(tc.schema, tc.relname, 2000.0))
+				pk := sqlmock.NewRows([]string{"attname"})
+				for _, col := range tc.pk {
+					pk.AddRow(col)
+				}
+				mock.ExpectQuery("i.indisprimary").WithArgs(tc.table).WillReturnRows(pk)
+				if tc.columns == nil {
+					tc.columns = sqlmock.NewRows(columns)
+				}
+				mock.ExpectQuery("FROM pg_attribute").WithArgs(tc.table).WillReturnRows(tc.columns)
+			}
+			if tc.sql != "" {
+				mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+				mock.ExpectQuery(regexp.QuoteMeta(tc.sql)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			}
+			resp := previewTable(tc.msg)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+			if tc.wantCode != "" {
+				if resp.ErrorCode != tc.wantCode {
+					t.Errorf("expected %s, got %+v", tc.wantCode, resp)
+				}
+				return
+			}
+			if resp.Error != "" || resp.Preview == nil {
+				t.Fatalf("expected a preview, got %+v", resp)
+			}
+			if !slices.Equal(resp.Preview.OrderBy, tc.order) {
+				t.Errorf("expected order by %q, got %q", tc.order, resp.Preview.OrderBy)
+			}
+		})
+	}
+}
+
+func TestPreviewStats(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery("FROM pg_class").
+		WillReturnRows(sqlmock.NewRows([]string{"nspname", "relname", "reltuples"}).AddRow("public", "orders", 2000.0))
+	mock.ExpectQuery("i.indisprimary").WillReturnRows(sqlmock.NewRows([]string{"attname"}))
+	mock.ExpectQuery("FROM pg_attribute").WillReturnRows(sqlmock.NewRows([]string{"attname", "type", "null_frac", "n_distinct", "min", "max"}).
+		AddRow("status", "text", 0.1, 4.0, nil, nil).
+		AddRow("email", "text", 0.0, -0.5, "a@example.com", "z@example.com"))
+
+	p, err := loadPreview(&sqlConnector{db: mockDB, flavor: "postgres"}, `"orders"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Analyzed || p.Order != "none" || len(p.Columns) != 2 {
+		t.Fatalf("unexpected preview: %+v", p)
+	}
+	status, email := p.Columns[0], p.Columns[1]
+	if *status.NullFraction != 0.1 || *status.DistinctEstimate != 4 || status.Min != nil {
+		t.Errorf("unexpected status stats: %+v", status)
+	}
+	// A negative n_distinct is a fraction of the estimated rows.
+	if *email.DistinctEstimate != 1000 || *email.Min != "a@example.com" || *email.Max != "z@example.com" {
+		t.Errorf("unexpected email stats: %+v", email)
+	}
+	if got := previewSQL(dialectFor("postgres"), p, 10); got != `SELECT * FROM "public"."orders" LIMIT 10` {
+		t.Errorf("unexpected query %q", got)
+	}
+}
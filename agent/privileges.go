@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PrivilegeFinding is one result of checking what a connection's database
+// user is allowed to do.
+type PrivilegeFinding struct {
+	Connection string `json:"connection"`
+	Check      string `json:"check"`
+	// Level is "ok", "warn" or "fail".
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+const roleQuery = `
+SELECT current_user, rolsuper, rolcreaterole, rolcreatedb, rolbypassrls
+FROM pg_roles
+WHERE rolname = current_user`
+
+const tablePrivilegesQuery = `
+SELECT n.nspname || '.' || c.relname,
+       has_table_privilege(c.oid, 'SELECT'),
+       has_table_privilege(c.oid, 'INSERT') OR has_table_privilege(c.oid, 'UPDATE')
+         OR has_table_privilege(c.oid, 'DELETE') OR has_table_privilege(c.oid, 'TRUNCATE')
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg\_%'
+ORDER BY 1`
+
+// checkPrivileges inspects the database user behind c. A user with more
+// power than it needs is a warning, not an error: the agent still works, but
+// read-only mode leans on the database to refuse writes, and a superuser
+// can simply switch that off.
+func checkPrivileges(c *connection) []PrivilegeFinding {
+	finding := func(check, level, format string, args ...any) PrivilegeFinding {
+		return PrivilegeFinding{Connection: c.Name, Check: check, Level: level, Message: fmt.Sprintf(format, args...)}
+	}
+
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return []PrivilegeFinding{finding("privileges", "ok", "privilege checks are not available for %s", c.Flavor())}
+	}
+
+	var findings []PrivilegeFinding
+
+	var user string
+	var super, createRole, createDB, bypassRLS bool
+	if err := sc.db.QueryRow(roleQuery).Scan(&user, &super, &createRole, &createDB, &bypassRLS); err != nil {
+		return append(findings, finding("role", "fail", "could not read role attributes: %v", err))
+	}
+	switch {
+	case super && sc.readOnly:
+		findings = append(findings, finding("role", "warn",
+			"%s is a SUPERUSER; read-only mode cannot stop a superuser from writing. Use a role with only SELECT privileges", user))
+	case super:
+		findings = append(findings, finding("role", "warn",
+			"%s is a SUPERUSER; anyone with access to this connection in PeekDB can do anything to the database", user))
+	default:
+		var extra []string
+		if createRole {
+			extra = append(extra, "CREATEROLE")
+		}
+		if createDB {
+			extra = append(extra, "CREATEDB")
+		}
+		if bypassRLS {
+			extra = append(extra, "BYPASSRLS")
+		}
+		if len(extra) > 0 {
+			findings = append(findings, finding("role", "warn", "%s has %s, which PeekDB does not need", user, strings.Join(extra, ", ")))
+		} else {
+			findings = append(findings, finding("role", "ok", "%s is an ordinary role", user))
+		}
+	}
+
+	rows, err := sc.db.Query(tablePrivilegesQuery)
+	if err != nil {
+		return append(findings, finding("tables", "fail", "could not read table privileges: %v", err))
+	}
+	defer rows.Close()
+	var readable int
+	var writable []string
+	for rows.Next() {
+		var name string
+		var canRead, canWrite bool
+		if err := rows.Scan(&name, &canRead, &canWrite); err != nil {
+			return append(findings, finding("tables", "fail", "could not read table privileges: %v", err))
+		}
+		if canRead {
+			readable++
+		}
+		if canWrite {
+			writable = append(writable, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return append(findings, finding("tables", "fail", "could not read table privileges: %v", err))
+	}
+
+	if readable == 0 {
+		findings = append(findings, finding("select", "warn", "%s cannot SELECT from any table", user))
+	} else {
+		findings = append(findings, finding("select", "ok", "%s can SELECT from %d tables and views", user, readable))
+	}
+
+	switch {
+	case len(writable) == 0:
+		findings = append(findings, finding("write", "ok", "%s has no write privileges on any table", user))
+	case sc.readOnly:
+		sample := writable
+		if len(sample) > 5 {
+			sample = append(sample[:5:5], fmt.Sprintf("and %d more", len(writable)-5))
+		}
+		findings = append(findings, finding("write", "warn",
+			"read-only mode is on but %s can write to %d tables (%s); grant it SELECT only", user, len(writable), strings.Join(sample, ", ")))
+	default:
+		findings = append(findings, finding("write", "ok", "%s can write to %d tables", user, len(writable)))
+	}
+	return findings
+}
+
+// logPrivilegeFindings writes the checks to the log, making warnings and
+// failures stand out.
+func logPrivilegeFindings(findings []PrivilegeFinding) {
+	for _, f := range findings {
+		switch f.Level {
+		case "ok":
+			log.Printf("[privileges:%s] %s", f.Connection, f.Message)
+		default:
+			log.Printf("[privileges:%s] *** %s: %s ***", f.Connection, strings.ToUpper(f.Level), f.Message)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckPrivileges(t *testing.T) {
+	roleCols := []string{"current_user", "rolsuper", "rolcreaterole", "rolcreatedb", "rolbypassrls"}
+	tableCols := []string{"name", "select", "write"}
+
+	tests := []struct {
+		name      string
+		readOnly  bool
+		mockSetup func(sqlmock.Sqlmock)
+		expected  map[string]string // check -> level
+		contains  string
+	}{
+		{
+			name:     "select-only role",
+			readOnly: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM pg_roles").WillReturnRows(sqlmock.NewRows(roleCols).AddRow("peekdb", false, false, false, false))
+				mock.ExpectQuery("has_table_privilege").WillReturnRows(sqlmock.NewRows(tableCols).
+					AddRow("public.orders", true, false).
+					AddRow("public.users", true, false))
+			},
+			expected: map[string]string{"role": "ok", "select": "ok", "write": "ok"},
+		},
+		{
+			name:     "superuser in read-only mode",
+			readOnly: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM pg_roles").WillReturnRows(sqlmock.NewRows(roleCols).AddRow("postgres", true, true, true, true))
+				mock.ExpectQuery("has_table_privilege").WillReturnRows(sqlmock.NewRows(tableCols).
+					AddRow("public.orders", true, true))
+			},
+			expected: map[string]string{"role": "warn", "select": "ok", "write": "warn"},
+			contains: "read-only mode cannot stop a superuser",
+		},
+		{
+			name: "writer without read-only mode",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM pg_roles").WillReturnRows(sqlmock.NewRows(roleCols).AddRow("app", false, false, true, false))
+				mock.ExpectQuery("has_table_privilege").WillReturnRows(sqlmock.NewRows(tableCols).
+					AddRow("public.orders", true, true))
+			},
+			expected: map[string]string{"role": "warn", "select": "ok", "write": "ok"},
+			contains: "CREATEDB",
+		},
+		{
+			name: "nothing readable",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM pg_roles").WillReturnRows(sqlmock.NewRows(roleCols).AddRow("nobody", false, false, false, false))
+				mock.ExpectQuery("has_table_privilege").WillReturnRows(sqlmock.NewRows(tableCols))
+			},
+			expected: map[string]string{"role": "ok", "select": "warn", "write": "ok"},
+		},
+		{
+			name: "role lookup fails",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM pg_roles").WillReturnError(errors.New("permission denied for table pg_authid"))
+			},
+			expected: map[string]string{"role": "fail"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+			tc.mockSetup(mock)
+
+			c := &connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres", readOnly: tc.readOnly}}
+			findings := checkPrivileges(c)
+
+			got := map[string]string{}
+			var messages []string
+			for _, f := range findings {
+				got[f.Check] = f.Level
+				messages = append(messages, f.Message)
+			}
+			if len(got) != len(tc.expected) {
+				t.Errorf("expected checks %v, got %v", tc.expected, got)
+			}
+			for check, level := range tc.expected {
+				if got[check] != level {
+					t.Errorf("%s: expected level %q, got %q", check, level, got[check])
+				}
+			}
+			if tc.contains != "" && !strings.Contains(strings.Join(messages, "\n"), tc.contains) {
+				t.Errorf("expected a message containing %q, got %q", tc.contains, messages)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckPrivilegesOtherFlavors(t *testing.T) {
+	c := &connection{Name: "crdb", Connector: &sqlConnector{flavor: "cockroach"}}
+	findings := checkPrivileges(c)
+	if len(findings) != 1 || findings[0].Level != "ok" {
+		t.Errorf("expected a single skipped check, got %+v", findings)
+	}
+}
+
+func TestReadOnlyConnection(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	sc := &sqlConnector{db: mockDB, flavor: "postgres", readOnly: true}
+	tn := testTenant(&connection{Name: "main", ReadOnly: true, Connector: sc})
+
+	resp := runQuery(Message{ID: "r1", Type: "query", SQL: "DELETE FROM orders", tenant: tn})
+	if resp.ErrorCode != codePolicyDenied {
+		t.Errorf("expected %s for a write, got %q (%s)", codePolicyDenied, resp.ErrorCode, resp.Error)
+	}
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectRollback()
+
+	result := sc.executeQuery(context.Background(), "r2", "SELECT id FROM orders", nil)
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	if len(result.Rows) != 1 {
+		t.Errorf("expected 1 row, got %d", len(result.Rows))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// PublishConfig runs SQL on Connection every Every and sends each row it
+// returns, as a JSON object, to Sink on Topic: a Kafka topic or a NATS
+// subject. Key names the column whose value keys each Kafka message.
+type PublishConfig struct {
+	Name       string   `json:"name"`
+	Connection string   `json:"connection"`
+	SQL        string   `json:"sql"`
+	Every      duration `json:"every"`
+	Sink       string   `json:"sink"`
+	Topic      string   `json:"topic"`
+	Key        string   `json:"key,omitempty"`
+	// Cursor names a column that grows as rows are added or changed,
+	// such as updated_at or id, to publish changes rather than every row.
+	// Its value in the last row published is passed to the next run as
+	// $1, NULL on the first, and kept in --jobs-db across restarts.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// check reports mistakes in the settings before anything connects.
+func (p *PublishConfig) check() error {
+	switch {
+	case p.Name == "" || p.Connection == "" || p.SQL == "" || p.Sink == "" || p.Topic == "":
+		return fmt.Errorf("name, connection, sql, sink and topic are required")
+	case time.Duration(p.Every) < 10*time.Second:
+		return fmt.Errorf("every must be at least 10s")
+	}
+	return nil
+}
+
+// publishJob is a configured publish job and the cursor it has reached.
+type publishJob struct {
+	PublishConfig
+	conn *connection
+	sink sink
+	// cursor is nil until a run with a cursor publishes a row.
+	cursor *string
+}
+
+// publishScheduler runs the configured publish jobs.
+type publishScheduler struct {
+	ctx   context.Context
+	agent *Agent
+	jobs  map[string]*publishJob
+	sinks map[string]sink
+}
+
+// startPublishing checks the publish jobs against the sinks and a's
+// connections and runs them until ctx is cancelled. Cursors are read from
+// a's job store when there is one.
+func startPublishing(ctx context.Context, a *Agent, sinks []SinkConfig, configs []PublishConfig) (*publishScheduler, error) {
+	s := &publishScheduler{ctx: ctx, agent: a, jobs: map[string]*publishJob{}, sinks: map[string]sink{}}
+	types := map[string]string{}
+	for _, cfg := range sinks {
+		if s.sinks[cfg.Name] != nil {
+			return nil, fmt.Errorf("sink %q is defined twice", cfg.Name)
+		}
+		s.sinks[cfg.Name] = openSink(cfg, a.opts.Version)
+		types[cfg.Name] = cfg.Type
+	}
+	for _, cfg := range configs {
+		if s.jobs[cfg.Name] != nil {
+			return nil, fmt.Errorf("publish job %q is defined twice", cfg.Name)
+		}
+		var conn *connection
+		for _, c := range a.connections {
+			if c.Name == cfg.Connection {
+				conn = c
+			}
+		}
+		if conn == nil {
+			return nil, fmt.Errorf("publish job %q: no connection is named %q", cfg.Name, cfg.Connection)
+		}
+		if s.sinks[cfg.Sink] == nil {
+			return nil, fmt.Errorf("publish job %q: no sink is named %q", cfg.Name, cfg.Sink)
+		}
+		if cfg.Key != "" && types[cfg.Sink] != "kafka" {
+			return nil, fmt.Errorf("publish job %q: key is only supported for kafka sinks", cfg.Name)
+		}
+		if _, ok := conn.Connector.(*sqlConnector); ok {
+			if kind, _ := classifyStatements(cfg.SQL); !readStatements[kind] {
+				return nil, fmt.Errorf("publish job %q: sql must be a read, not %s", cfg.Name, strings.ToUpper(kind))
+			}
+		}
+		j := &publishJob{PublishConfig: cfg, conn: conn, sink: s.sinks[cfg.Sink]}
+		if a.jobs != nil && cfg.Cursor != "" {
+			if v, ok := a.jobs.cursor(cfg.Name); ok {
+				j.cursor = &v
+			}
+		}
+		s.jobs[cfg.Name] = j
+	}
+	for _, j := range s.jobs {
+		log.Printf("Publish %q: %s every %s to %s %q", j.Name, j.Connection, time.Duration(j.Every), j.Sink, j.Topic)
+		go s.schedule(j)
+	}
+	return s, nil
+}
+
+// Close closes the sinks' connections.
+func (s *publishScheduler) Close() {
+	for _, k := range s.sinks {
+		k.Close()
+	}
+}
+
+// schedule runs j every Every. A standby agent, one in maintenance mode,
+// or one that isn't the connection's elected leader skips the run, so
+// agents sharing a connection don't publish twice.
+func (s *publishScheduler) schedule(j *publishJob) {
+	a := s.agent
+	defer a.reporter.reportPanic()
+	ticker := time.NewTicker(time.Duration(j.Every))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if sc, ok := j.conn.Connector.(*sqlConnector); !a.standby.active() || a.maintenance.active() || ok && sc.elector != nil && !sc.elector.isLeader() {
+			continue
+		}
+		done := a.maintenance.begin()
+		s.run(j)
+		done()
+	}
+}
+
+// run publishes the rows of one run of j and moves its cursor on once the
+// sink has them all, so a failed run is retried from the same place: rows
+// are delivered at least once. Anonymization rules apply, as to exports.
+func (s *publishScheduler) run(j *publishJob) (int, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(j.Every))
+	defer cancel()
+	n, next, err := j.publish(ctx, s.agent)
+	if s.ctx.Err() != nil {
+		return 0, s.ctx.Err()
+	}
+	if err != nil {
+		log.Printf("[publish:%s] Failed: %v", j.Name, err)
+		s.agent.audit(AuditEvent{Action: "publish", Connection: j.Connection, Detail: j.Name + ": " + j.Sink + " " + j.Topic, Error: err.Error()})
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if j.Cursor != "" {
+		j.cursor = &next
+		if jobs := s.agent.jobs; jobs != nil {
+			if err := jobs.setCursor(j.Name, next); err != nil {
+				log.Printf("[publish:%s] Could not store cursor: %v", j.Name, err)
+			}
+		}
+	}
+	log.Printf("[publish:%s] Published %d rows to %s %q", j.Name, n, j.Sink, j.Topic)
+	s.agent.audit(AuditEvent{Action: "publish", Connection: j.Connection, Detail: fmt.Sprintf("%s: %d rows to %s %s", j.Name, n, j.Sink, j.Topic)})
+	return n, nil
+}
+
+// publish runs j's query on a and sends its rows, returning how many it
+// sent and the cursor's new value.
+func (j *publishJob) publish(ctx context.Context, a *Agent) (int, string, error) {
+	msg := Message{Type: "query", ID: "publish:" + j.Name, SQL: j.SQL, ctx: ctx}
+	if j.Cursor != "" {
+		var param any
+		if j.cursor != nil {
+			param = *j.cursor
+		}
+		msg.Params = []any{param}
+	}
+	resp := a.execute(j.conn, msg)
+	if resp.Error != "" {
+		return 0, "", fmt.Errorf("%s", resp.Error)
+	}
+	key, cur := -1, -1
+	for i, c := range resp.Columns {
+		if c == j.Key {
+			key = i
+		}
+		if c == j.Cursor {
+			cur = i
+		}
+	}
+	switch {
+	case j.Key != "" && key < 0:
+		return 0, "", fmt.Errorf("the query returned no %q column for the key", j.Key)
+	case j.Cursor != "" && cur < 0:
+		return 0, "", fmt.Errorf("the query returned no %q column for the cursor", j.Cursor)
+	case len(resp.Rows) == 0:
+		return 0, "", nil
+	}
+	// The cursor is read before anonymization can change it.
+	var next string
+	if cur >= 0 {
+		next = cursorString(resp.Rows[len(resp.Rows)-1][cur])
+	}
+	a.anonymize.apply(j.conn, &resp)
+
+	msgs := make([]sinkMessage, 0, len(resp.Rows))
+	for _, row := range resp.Rows {
+		obj := make(map[string]any, len(row))
+		for i, v := range row {
+			obj[resp.Columns[i]] = v
+		}
+		buf, err := json.Marshal(obj)
+		if err != nil {
+			return 0, "", err
+		}
+		m := sinkMessage{Value: buf}
+		if key >= 0 && row[key] != nil {
+			m.Key = cursorString(row[key])
+		}
+		msgs = append(msgs, m)
+	}
+	if err := j.sink.publish(ctx, j.Topic, msgs); err != nil {
+		return 0, "", err
+	}
+	return len(msgs), next, nil
+}
+
+// cursorString is v as text the database reads back as the same value.
+func cursorString(v any) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeSink records what is published to it, or fails with err.
+type fakeSink struct {
+	topics []string
+	msgs   []sinkMessage
+	err    error
+}
+
+func (f *fakeSink) publish(ctx context.Context, topic string, msgs []sinkMessage) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.topics = append(f.topics, topic)
+	f.msgs = append(f.msgs, msgs...)
+	return nil
+}
+
+func (f *fakeSink) Close() error { return nil }
+
+func TestPublishConfigCheck(t *testing.T) {
+	ok := PublishConfig{Name: "orders", Connection: "main", SQL: "SELECT * FROM orders", Every: duration(time.Minute), Sink: "events", Topic: "orders"}
+	tests := []struct {
+		change func(*PublishConfig)
+		err    string
+	}{
+		{change: func(*PublishConfig) {}},
+		{change: func(p *PublishConfig) { p.Topic = "" }, err: "name, connection, sql, sink and topic are required"},
+		{change: func(p *PublishConfig) { p.Every = duration(time.Second) }, err: "every must be at least 10s"},
+	}
+	for _, tc := range tests {
+		p := ok
+		tc.change(&p)
+		err := p.check()
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Errorf("check(%+v) = %v, want %q", p, err, tc.err)
+		}
+	}
+
+	conn := &connection{Name: "main", Connector: &sqlConnector{flavor: "postgres"}}
+	sinks := []SinkConfig{{Name: "events", Type: "kafka", Brokers: []string{"kafka:9092"}}, {Name: "bus", Type: "nats", URL: "nats://nats"}}
+	for _, cfg := range []PublishConfig{
+		{Name: "x", Connection: "nope", SQL: "SELECT 1", Sink: "events", Topic: "t"},
+		{Name: "x", Connection: "main", SQL: "SELECT 1", Sink: "nope", Topic: "t"},
+		{Name: "x", Connection: "main", SQL: "SELECT 1", Sink: "bus", Topic: "t", Key: "id"},
+		{Name: "x", Connection: "main", SQL: "UPDATE orders SET sent = true", Sink: "events", Topic: "t"},
+	} {
+		if _, err := startPublishing(context.Background(), testAgent(conn), sinks, []PublishConfig{cfg}); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		}
+	}
+}
+
+func TestPublishRun(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	conn := &connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}}
+	a := testAgent(conn)
+	store, err := openJobStore(a, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	a.jobs = store
+	a.anonymize, _ = newAnonymizer(&AnonymizeConfig{Rules: []AnonymizeRule{{Column: "^email$", Transform: "null"}}})
+
+	sink := &fakeSink{}
+	sql := "SELECT id, email, updated_at FROM orders WHERE $1::timestamptz IS NULL OR updated_at > $1 ORDER BY updated_at"
+	j := &publishJob{PublishConfig: PublishConfig{Name: "orders", Connection: "main", SQL: sql, Every: duration(time.Minute), Sink: "events", Topic: "orders", Key: "id", Cursor: "updated_at"},
+		conn: conn, sink: sink}
+	s := &publishScheduler{ctx: context.Background(), agent: a, jobs: map[string]*publishJob{"orders": j}}
+
+	t1 := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery(regexp.QuoteMeta(sql)).WithArgs(nil).WillReturnRows(sqlmock.NewRows([]string{"id", "email", "updated_at"}).
+		AddRow(int64(7), "ann@corp.com", t1).
+		AddRow(int64(8), "bob@corp.com", t2))
+	if n, err := s.run(j); err != nil || n != 2 {
+		t.Fatalf("run = %d, %v, want 2 rows", n, err)
+	}
+	if len(sink.msgs) != 2 || sink.topics[0] != "orders" || sink.msgs[0].Key != "7" ||
+		string(sink.msgs[1].Value) != `{"email":null,"id":8,"updated_at":"2026-10-17T09:01:00Z"}` {
+		t.Errorf("unexpected messages: %q", sink.msgs)
+	}
+	if v, ok := store.cursor("orders"); !ok || v != "2026-10-17T09:01:00Z" {
+		t.Errorf("expected the cursor to be stored, got %q, %v", v, ok)
+	}
+
+	// A failed publish leaves the cursor where it was.
+	sink.err = errors.New("broker down")
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery(regexp.QuoteMeta(sql)).WithArgs("2026-10-17T09:01:00Z").WillReturnRows(sqlmock.NewRows([]string{"id", "email", "updated_at"}).
+		AddRow(int64(9), "cy@corp.com", t2.Add(time.Minute)))
+	if _, err := s.run(j); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if *j.cursor != "2026-10-17T09:01:00Z" {
+		t.Errorf("expected the cursor to stay, got %q", *j.cursor)
+	}
+
+	// The stored cursor is picked up again after a restart.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted, err := startPublishing(ctx, a, []SinkConfig{{Name: "events", Type: "kafka", Brokers: []string{"kafka:9092"}}},
+		[]PublishConfig{{Name: "orders", Connection: "main", SQL: sql, Every: duration(time.Hour), Sink: "events", Topic: "orders", Cursor: "updated_at"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := restarted.jobs["orders"].cursor; c == nil || *c != "2026-10-17T09:01:00Z" {
+		t.Errorf("expected the stored cursor, got %v", c)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Record is one line of a recording. Dir is "in" for messages from the
+// hub, "auth" for its auth response, "out" for frames to it and "db" for
+// what a connector answered a query or schema request with, before the
+// agent's own limits and formatting, which is what lets a replay stand in
+// for the database.
+type Record struct {
+	At     time.Time       `json:"at"`
+	Tenant string          `json:"tenant,omitempty"`
+	Dir    string          `json:"dir"`
+	Frame  json.RawMessage `json:"frame,omitempty"`
+	// Binary holds binary frames, such as blob data, base64-encoded.
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// recorder appends Records to a file. Recordings hold SQL and result rows
+// unscrubbed, so the file is only readable by the agent's user.
+type recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// record appends v as a frame in direction dir; it does nothing on a nil
+// recorder, so callers needn't check whether recording is on.
+func (r *recorder) record(t *tenant, dir string, v any) {
+	if r == nil {
+		return
+	}
+	frame, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Could not record %s frame: %v", dir, err)
+		return
+	}
+	r.write(Record{At: time.Now().UTC(), Tenant: tenantName(t), Dir: dir, Frame: frame})
+}
+
+func (r *recorder) write(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("Could not write recording: %v", err)
+	}
+}
+
+// writer returns w, recording every frame written to it as "out".
+func (r *recorder) writer(t *tenant, w replyWriter) replyWriter {
+	if r == nil {
+		return w
+	}
+	return &tapWriter{r: r, t: t, w: w}
+}
+
+// tapWriter records frames on their way to w.
+type tapWriter struct {
+	r *recorder
+	t *tenant
+	w replyWriter
+}
+
+func (rw *tapWriter) WriteJSON(v any) error {
+	rw.r.record(rw.t, "out", v)
+	return rw.w.WriteJSON(v)
+}
+
+func (rw *tapWriter) WriteMessage(messageType int, data []byte) error {
+	rw.r.write(Record{At: time.Now().UTC(), Tenant: tenantName(rw.t), Dir: "out", Binary: data})
+	return rw.w.WriteMessage(messageType, data)
+}
+
+// NextWriter streams a message to w, through w's own NextWriter when it
+// has one, and records it once it is complete. The recording needs the
+// whole frame, so the tap keeps a copy of it, as WriteJSON does.
+func (rw *tapWriter) NextWriter(messageType int) (io.WriteCloser, error) {
+	ts := &tapStream{rw: rw, messageType: messageType}
+	if sw, ok := rw.w.(streamWriter); ok {
+		mw, err := sw.NextWriter(messageType)
+		if err != nil {
+			return nil, err
+		}
+		ts.w = mw
+	}
+	return ts, nil
+}
+
+// tapStream is one message on its way through a tapWriter. Without a
+// writer of its own, the message is sent whole when it is closed.
+type tapStream struct {
+	rw          *tapWriter
+	messageType int
+	w           io.WriteCloser
+	buf         bytes.Buffer
+}
+
+func (ts *tapStream) Write(p []byte) (int, error) {
+	ts.buf.Write(p)
+	if ts.w == nil {
+		return len(p), nil
+	}
+	return ts.w.Write(p)
+}
+
+func (ts *tapStream) Close() error {
+	rec := Record{At: time.Now().UTC(), Tenant: tenantName(ts.rw.t), Dir: "out"}
+	if ts.messageType == websocket.TextMessage {
+		rec.Frame = ts.buf.Bytes()
+	} else {
+		rec.Binary = ts.buf.Bytes()
+	}
+	ts.rw.r.write(rec)
+	if ts.w == nil {
+		return ts.rw.w.WriteMessage(ts.messageType, ts.buf.Bytes())
+	}
+	return ts.w.Close()
+}
+
+func (rw *tapWriter) throttled() time.Duration {
+	return throttledTime(rw.w)
+}
+
+func tenantName(t *tenant) string {
+	if t == nil {
+		return ""
+	}
+	return t.name
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// replSession runs statements typed at the "repl" command as if a hub had
+// sent them on a token with caps, through the same query chain.
+type replSession struct {
+	tenant *tenant
+	target string
+	seq    int
+	w      io.Writer
+}
+
+// run executes one statement and prints its result.
+func (s *replSession) run(sqlQuery string) {
+	s.seq++
+	resp := runQuery(Message{ID: fmt.Sprintf("repl-%d", s.seq), Type: "query", SQL: sqlQuery, Target: s.target, tenant: s.tenant})
+	if resp.Error != "" {
+		fmt.Fprintf(s.w, "ERROR:  %s", resp.Error)
+		if resp.ErrorCode != "" {
+			fmt.Fprintf(s.w, " (%s)", resp.ErrorCode)
+		}
+		fmt.Fprintln(s.w)
+		return
+	}
+	if len(resp.Columns) == 0 {
+		fmt.Fprintln(s.w, "OK")
+		return
+	}
+	printTable(s.w, resp.Columns, resp.Rows)
+	noun := "rows"
+	if len(resp.Rows) == 1 {
+		noun = "row"
+	}
+	fmt.Fprintf(s.w, "(%d %s)\n", len(resp.Rows), noun)
+	for _, a := range resp.Annotations {
+		fmt.Fprintf(s.w, "Note: %s\n", a.Text)
+	}
+}
+
+// command handles a backslash command, returning false to quit.
+func (s *replSession) command(line string) bool {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case `\q`:
+		return false
+	case `\l`:
+		for _, c := range s.tenant.conns {
+			mark := " "
+			if c.Name == s.target {
+				mark = "*"
+			}
+			fmt.Fprintf(s.w, "%s %s (%s)\n", mark, c.Name, c.Flavor())
+		}
+	case `\c`:
+		if len(fields) != 2 {
+			fmt.Fprintln(s.w, `Usage: \c connection`)
+			break
+		}
+		if _, err := (Message{Target: fields[1], tenant: s.tenant}).route(); err != nil {
+			fmt.Fprintf(s.w, "ERROR:  %v\n", err)
+			break
+		}
+		s.target = fields[1]
+		fmt.Fprintf(s.w, "Now on %q\n", s.target)
+	default:
+		fmt.Fprintln(s.w, `Commands: \l lists connections, \c name switches, \q quits; end statements with ;`)
+	}
+	return true
+}
+
+// scanStatements reads input as psql does: statements end with a
+// semicolon and may span lines, and a line starting with a backslash is a
+// command. prompt is called before each line with whether a statement is
+// under way; f returns false to stop.
+func scanStatements(in io.Reader, prompt func(continued bool), f func(stmt string, command bool) bool) error {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	var buf strings.Builder
+	prompt(false)
+	for sc.Scan() {
+		line := sc.Text()
+		if buf.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			if !f(strings.TrimSpace(line), true) {
+				return nil
+			}
+			prompt(false)
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		stmt := strings.TrimSpace(buf.String())
+		if !strings.HasSuffix(stmt, ";") {
+			prompt(stmt != "")
+			if stmt == "" {
+				buf.Reset()
+			}
+			continue
+		}
+		buf.Reset()
+		if !f(strings.TrimSuffix(stmt, ";"), false) {
+			return nil
+		}
+		prompt(false)
+	}
+	if stmt := strings.TrimSpace(buf.String()); stmt != "" {
+		f(stmt, false)
+	}
+	return sc.Err()
+}
+
+// printTable writes rows aligned under their columns, as psql does.
+func printTable(w io.Writer, columns []string, rows [][]any) {
+	cells := make([][]string, len(rows))
+	widths := make([]int, len(columns))
+	for i, c := range columns {
+		widths[i] = utf8.RuneCountInString(c)
+	}
+	for r, row := range rows {
+		cells[r] = make([]string, len(row))
+		for i, v := range row {
+			s := ""
+			if v != nil {
+				s = strings.ReplaceAll(fmt.Sprint(v), "\n", `\n`)
+			}
+			cells[r][i] = s
+			if i < len(widths) {
+				widths[i] = max(widths[i], utf8.RuneCountInString(s))
+			}
+		}
+	}
+	line := func(values []string) {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = " " + v + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v)) + " "
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(parts, "|"), " "))
+	}
+	line(columns)
+	rules := make([]string, len(columns))
+	for i, n := range widths {
+		rules[i] = strings.Repeat("-", n+2)
+	}
+	fmt.Fprintln(w, strings.Join(rules, "+"))
+	for _, row := range cells {
+		line(row)
+	}
+}
+
+// RunRepl is the "repl" command: an interactive prompt that runs SQL through
+// the agent's query chain, policy checks, middleware, limits and history,
+// under the capabilities its flags give, so operators can check that a
+// configuration allows and refuses what it should. It returns the process
+// exit code.
+func RunRepl(args []string, in io.Reader, w io.Writer) int {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	fs.SetOutput(w)
+	url := fs.String("db", os.Getenv("DATABASE_URL"), "Database connection URL")
+	dbFlavor := fs.String("flavor", "postgres", "Postgres-protocol dialect: postgres or cockroach")
+	cfgPath := fs.String("config", os.Getenv("PEEKDB_CONFIG"), "Path to JSON config file, for its connections and query_middleware (optional)")
+	target := fs.String("target", "", "Connection to start on; defaults to the first")
+	var caps Capabilities
+	fs.BoolVar(&caps.ReadOnly, "read-only", false, "Run as a token with read_only")
+	fs.IntVar(&caps.MaxRows, "max-rows", 0, "Run as a token with this max_rows")
+	schemas := fs.String("allowed-schemas", "", "Run as a token with these allowed_schemas, comma-separated")
+	opts := DefaultOptions()
+	fs.IntVar(&opts.MaxCellBytes, "max-cell-bytes", opts.MaxCellBytes, "Truncate text cells longer than this; 0 disables")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *url == "" && *cfgPath == "" {
+		fmt.Fprintln(w, "Usage: peekdb-agent repl --db URL | --config FILE [--read-only] [--max-rows n] [--allowed-schemas a,b]")
+		return 2
+	}
+	if *schemas != "" {
+		caps.AllowedSchemas = strings.Split(*schemas, ",")
+	}
+
+	cfg := &Config{}
+	if *cfgPath != "" {
+		var err error
+		if cfg, err = loadConfig(*cfgPath); err != nil {
+			fmt.Fprintf(w, "✗ %v\n", err)
+			return 1
+		}
+	}
+	mws, err := buildQueryMiddleware(cfg.QueryMiddleware)
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	a := bareAgent(opts, mws)
+
+	var configs []ConnectionConfig
+	if *url != "" {
+		dsn, err := resolveSecret(*url)
+		if err != nil {
+			fmt.Fprintf(w, "✗ --db: %v\n", err)
+			return 1
+		}
+		configs = append(configs, ConnectionConfig{Name: "default", URL: dsn, Flavor: *dbFlavor})
+	}
+	// The agent's own log lines would interleave with the results.
+	log.SetOutput(io.Discard)
+	conns, err := a.openConnections(append(configs, cfg.Connections...))
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	defer closeConnections(conns)
+	if len(conns) == 0 {
+		fmt.Fprintln(w, "✗ no connections configured")
+		return 1
+	}
+
+	s := &replSession{tenant: &tenant{agent: a, name: "repl", conns: conns}, target: *target, w: w}
+	s.tenant.setCapabilities(&caps)
+	if s.target == "" {
+		s.target = conns[0].Name
+	}
+	if _, err := (Message{Target: s.target, tenant: s.tenant}).route(); err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "Connected to %q; read_only=%t max_rows=%d. \\? for help.\n", s.target, caps.ReadOnly, caps.MaxRows)
+	prompt := func(continued bool) {
+		mark := "=>"
+		if continued {
+			mark = "->"
+		}
+		fmt.Fprintf(w, "%s%s ", s.target, mark)
+	}
+	err = scanStatements(in, prompt, func(stmt string, command bool) bool {
+		if command {
+			return s.command(stmt)
+		}
+		s.run(stmt)
+		return true
+	})
+	fmt.Fprintln(w)
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestScanStatements(t *testing.T) {
+	input := "SELECT 1;\n\\l\nSELECT *\n  FROM orders\n WHERE id = 1;\n\n\\q\nSELECT 2;\n"
+	var got []string
+	prompts := 0
+	err := scanStatements(strings.NewReader(input), func(bool) { prompts++ }, func(stmt string, command bool) bool {
+		if command {
+			got = append(got, "cmd:"+stmt)
+			return stmt != `\q`
+		}
+		got = append(got, stmt)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"SELECT 1", `cmd:\l`, "SELECT *\n  FROM orders\n WHERE id = 1", `cmd:\q`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if prompts != 7 {
+		t.Errorf("expected 7 prompts, got %d", prompts)
+	}
+}
+
+func TestReplSession(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	var out bytes.Buffer
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.name = "repl"
+	s := &replSession{tenant: tn, target: "main", w: &out}
+	s.tenant.setCapabilities(&Capabilities{ReadOnly: true, MaxRows: 2})
+
+	s.run("DELETE FROM orders")
+	if !strings.Contains(out.String(), "ERROR:  this token is read-only") || !strings.Contains(out.String(), "(policy_denied)") {
+		t.Errorf("expected the read-only refusal, got %q", out.String())
+	}
+
+	out.Reset()
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, status FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).
+		AddRow(1, "shipped").AddRow(2, "pending").AddRow(3, "pending"))
+	mock.ExpectRollback()
+	s.run("SELECT id, status FROM orders")
+	want := " id | status\n" +
+		"----+---------\n" +
+		" 1  | shipped\n" +
+		" 2  | pending\n" +
+		"(2 rows)\n" +
+		"Note: Result cut to 2 rows, the token's max_rows\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+
+	out.Reset()
+	if !s.command(`\c replica`) || s.target != "main" || !strings.Contains(out.String(), "ERROR:") {
+		t.Errorf("expected an unknown connection to be refused, got %q on %s", out.String(), s.target)
+	}
+	if s.command(`\q`) {
+		t.Error(`expected \q to quit`)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+)
+
+// replayed are the messages a replay runs again. Each either has its
+// database answer in the recording or needs no database at all; anything
+// else depends on timing or on a live database and is skipped.
+var replayed = map[string]bool{
+	"query":         true,
+	"fetch":         true,
+	"schema":        true,
+	"config_update": true,
+}
+
+// ReplayMismatch is a message whose replies differ from the recording.
+type ReplayMismatch struct {
+	Tenant string
+	ID     string
+	Want   []json.RawMessage
+	Got    []json.RawMessage
+}
+
+// ReplayReport sums up a replay.
+type ReplayReport struct {
+	Replayed   int
+	Skipped    int
+	Mismatches []ReplayMismatch
+}
+
+// replayDB stands in for the databases of a recording: it answers each
+// query and schema request with what the real connector answered.
+type replayDB struct {
+	answers map[string]json.RawMessage
+}
+
+func replayKey(tenant, id string) string { return tenant + "\x00" + id }
+
+// replayConnector is a connection's Connector during a replay.
+type replayConnector struct {
+	flavor string
+	tenant string
+	db     *replayDB
+}
+
+func (c *replayConnector) Flavor() string { return c.flavor }
+func (c *replayConnector) Close() error   { return nil }
+
+func (c *replayConnector) Query(msg Message) QueryResponse {
+	var resp QueryResponse
+	if err := c.answer(msg.ID, &resp); err != nil {
+		return queryError(msg.ID, err)
+	}
+	return resp
+}
+
+func (c *replayConnector) Schema(id, schema string) SchemaResponse {
+	var resp SchemaResponse
+	if err := c.answer(id, &resp); err != nil {
+		return SchemaResponse{ID: id, Type: "schema", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	return resp
+}
+
+// answer decodes the recorded answer to id into v. Numbers stay
+// json.Numbers so they are written back exactly as recorded.
+func (c *replayConnector) answer(id string, v any) error {
+	buf, ok := c.db.answers[replayKey(c.tenant, id)]
+	if !ok {
+		return codedErrorf(codeQueryFailed, "the recording has no database answer for %q", id)
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// captureWriter collects the frames a reply is written as.
+type captureWriter struct {
+	frames []json.RawMessage
+}
+
+func (w *captureWriter) WriteJSON(v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.frames = append(w.frames, buf)
+	return nil
+}
+
+func (w *captureWriter) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage {
+		w.frames = append(w.frames, append(json.RawMessage(nil), data...))
+	}
+	return nil
+}
+
+// readRecording reads the Records of a recording, in order.
+func readRecording(r io.Reader) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
+
+// replay runs the hub's messages in records through the agent again, with
+// the recorded database answers in place of the databases, and compares
+// the replies with the recorded ones. The connections and capabilities of
+// each tenant come from its recorded status and auth frames; the tenants
+// belong to a.
+func replay(a *Agent, records []Record) (ReplayReport, error) {
+	var report ReplayReport
+	db := &replayDB{answers: map[string]json.RawMessage{}}
+	replies := map[string][]json.RawMessage{}
+	for _, rec := range records {
+		switch rec.Dir {
+		case "db":
+			var f struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(rec.Frame, &f)
+			db.answers[replayKey(rec.Tenant, f.ID)] = rec.Frame
+		case "out":
+			var f struct {
+				ID   string `json:"id"`
+				Type string `json:"type"`
+			}
+			if rec.Frame == nil || json.Unmarshal(rec.Frame, &f) != nil || f.Type == "status" {
+				continue
+			}
+			key := replayKey(rec.Tenant, f.ID)
+			replies[key] = append(replies[key], rec.Frame)
+		}
+	}
+
+	tenants := map[string]*tenant{}
+	get := func(name string) *tenant {
+		if tenants[name] == nil {
+			tenants[name] = &tenant{agent: a, name: name}
+		}
+		return tenants[name]
+	}
+	for _, rec := range records {
+		t := get(rec.Tenant)
+		switch rec.Dir {
+		case "out":
+			var status StatusMessage
+			if rec.Frame == nil || json.Unmarshal(rec.Frame, &status) != nil || status.Type != "status" {
+				continue
+			}
+			t.conns = nil
+			for _, cs := range status.Connections {
+				t.conns = append(t.conns, &connection{
+					Name:      cs.Name,
+					Labels:    cs.Labels,
+					Admin:     cs.Admin,
+					ReadOnly:  cs.ReadOnly,
+					Connector: &replayConnector{flavor: cs.Flavor, tenant: rec.Tenant, db: db},
+				})
+			}
+		case "auth":
+			var auth AuthResponse
+			if err := json.Unmarshal(rec.Frame, &auth); err != nil {
+				return report, fmt.Errorf("auth response at %s: %w", rec.At, err)
+			}
+			t.caps = auth.Capabilities
+		case "in":
+			var msg Message
+			if err := json.Unmarshal(rec.Frame, &msg); err != nil {
+				return report, fmt.Errorf("message at %s: %w", rec.At, err)
+			}
+			if !replayed[msg.Type] {
+				report.Skipped++
+				continue
+			}
+			report.Replayed++
+			msg.tenant = t
+			w := &captureWriter{}
+			if resp := handleMessage(msg); resp != nil {
+				if err := writeReply(w, msg, resp); err != nil {
+					return report, err
+				}
+			}
+			want := replies[replayKey(rec.Tenant, msg.ID)]
+			if !sameFrames(want, w.frames) {
+				report.Mismatches = append(report.Mismatches, ReplayMismatch{Tenant: rec.Tenant, ID: msg.ID, Want: want, Got: w.frames})
+			}
+		}
+	}
+	return report, nil
+}
+
+// sameFrames compares frames by their JSON values, so key order and
+// spacing don't matter. Timings differ on every run and are left out.
+func sameFrames(a, b []json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		var va, vb map[string]any
+		if json.Unmarshal(a[i], &va) != nil || json.Unmarshal(b[i], &vb) != nil {
+			return false
+		}
+		delete(va, "timing")
+		delete(vb, "timing")
+		if !reflect.DeepEqual(va, vb) {
+			return false
+		}
+	}
+	return true
+}
+
+// RunReplay is the "replay" command. It returns the process exit code: 1
+// when a reply differs from the recording or the recording can't be read.
+func RunReplay(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(w)
+	opts := DefaultOptions()
+	fs.IntVar(&opts.MaxCellBytes, "max-cell-bytes", opts.MaxCellBytes, "The --max-cell-bytes the recording agent ran with")
+	fs.Usage = func() {
+		fmt.Fprintln(w, "Usage: peekdb-agent replay [--max-cell-bytes n] recording.jsonl")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	records, err := readRecording(f)
+	if err != nil {
+		fmt.Fprintf(w, "✗ Could not read %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	report, err := replay(bareAgent(opts, nil), records)
+	if err != nil {
+		fmt.Fprintf(w, "✗ Replay failed: %v\n", err)
+		return 1
+	}
+
+	for _, m := range report.Mismatches {
+		fmt.Fprintf(w, "✗ %s", m.ID)
+		if m.Tenant != "" {
+			fmt.Fprintf(w, " (%s)", m.Tenant)
+		}
+		fmt.Fprintln(w, ": replies differ")
+		for _, f := range m.Want {
+			fmt.Fprintf(w, "    recorded: %s\n", f)
+		}
+		for _, f := range m.Got {
+			fmt.Fprintf(w, "    replayed: %s\n", f)
+		}
+	}
+	mark := "✓"
+	if len(report.Mismatches) > 0 {
+		mark = "✗"
+	}
+	fmt.Fprintf(w, "%s %d replayed, %d skipped, %d differ\n", mark, report.Replayed, report.Skipped, len(report.Mismatches))
+	if len(report.Mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// recordSession records a short session against sqlmock the way connect
+// and tenant.reply would, and returns the recording's path.
+func recordSession(t *testing.T) string {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	recording, err := openRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recording.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	tn.name = "acme"
+	tn.agent.recording = recording
+	caps := &Capabilities{ReadOnly: true, MaxRows: 2}
+	tn.setCapabilities(caps)
+	recording.record(tn, "auth", AuthResponse{Type: "auth", Success: true, Capabilities: caps})
+	recording.record(tn, "out", StatusMessage{Type: "status", Connections: []ConnectionStatus{{Name: "main", Flavor: "postgres"}}})
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3))
+	mock.ExpectRollback()
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT nope").WillReturnError(os.ErrDeadlineExceeded)
+	mock.ExpectRollback()
+
+	for _, msg := range []Message{
+		{Type: "query", ID: "q1", SQL: "SELECT id FROM orders", ChunkSize: 1},
+		{Type: "query", ID: "q2", SQL: "DELETE FROM orders"},
+		{Type: "query", ID: "q3", SQL: "SELECT nope"},
+		{Type: "locks", ID: "l1"},
+	} {
+		recording.record(tn, "in", msg)
+		if msg.Type == "locks" {
+			continue
+		}
+		msg.tenant = tn
+		if err := writeReply(recording.writer(tn, &captureWriter{}), msg, handleMessage(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	buf, err := os.ReadFile(recordSession(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := readRecording(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := replay(bareAgent(DefaultOptions(), nil), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Replayed != 3 || report.Skipped != 1 || len(report.Mismatches) != 0 {
+		t.Fatalf("expected 3 matching replays and 1 skip, got %+v", report)
+	}
+
+	// A hub granting more rows than it did when recording changes q1's
+	// replies, and the replay says so.
+	for i, rec := range records {
+		if rec.Dir == "auth" {
+			records[i].Frame = json.RawMessage(`{"type":"auth","success":true,"capabilities":{"read_only":true,"max_rows":3}}`)
+		}
+	}
+	report, err = replay(bareAgent(DefaultOptions(), nil), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].ID != "q1" {
+		t.Errorf("expected q1 to differ, got %+v", report.Mismatches)
+	}
+}
+
+// TestReplayRecordings replays the recordings kept as regression tests.
+func TestReplayRecordings(t *testing.T) {
+	paths, _ := filepath.Glob(filepath.Join("testdata", "replay", "*.jsonl"))
+	if len(paths) == 0 {
+		t.Fatal("expected recordings in testdata/replay")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			var out bytes.Buffer
+			if code := RunReplay([]string{path}, &out); code != 0 {
+				t.Errorf("replay failed:\n%s", out.String())
+			}
+			if !strings.Contains(out.String(), "0 differ") {
+				t.Errorf("expected no differences, got %s", out.String())
+			}
+		})
+	}
+}
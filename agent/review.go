@@ -0,0 +1,321 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// reviewTTL is how long a reviewed query waits for its confirm message.
+var reviewTTL = 10 * time.Minute
+
+// DDLReview is the reply to a query held for review: what each of its
+// statements would change, for the user to check before a "confirm"
+// message with the query's ID runs it.
+type DDLReview struct {
+	Statements []ReviewedStatement `json:"statements"`
+	// Destructive is set when any statement drops or empties something,
+	// or changes a column's type.
+	Destructive bool      `json:"destructive"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// ReviewedStatement is one statement of a reviewed query. Kind is its
+// verb and object type, such as "drop table" or "create index", or for a
+// statement that isn't DDL the kind classifyStatement gives it. Objects
+// are the names it changes, folded the way Postgres folds them; Reasons
+// say why it is destructive.
+type ReviewedStatement struct {
+	Statement   string   `json:"statement"`
+	Kind        string   `json:"kind"`
+	Objects     []string `json:"objects,omitempty"`
+	Destructive bool     `json:"destructive,omitempty"`
+	Reasons     []string `json:"reasons,omitempty"`
+}
+
+// ddlVerbs are the leading words of the statements review holds.
+var ddlVerbs = map[string]bool{
+	"CREATE": true, "ALTER": true, "DROP": true, "TRUNCATE": true,
+	"COMMENT": true, "GRANT": true, "REVOKE": true, "RENAME": true,
+}
+
+// ddlModifiers are the words between a DDL verb and its object type, or
+// after the type, that say nothing about what is changed.
+var ddlModifiers = map[string]bool{
+	"OR": true, "REPLACE": true, "UNIQUE": true, "TEMP": true, "TEMPORARY": true,
+	"UNLOGGED": true, "GLOBAL": true, "LOCAL": true, "CONCURRENTLY": true,
+	"IF": true, "NOT": true, "EXISTS": true, "ONLY": true,
+}
+
+// ddlTypePrefixes start object types written in two words, such as
+// MATERIALIZED VIEW.
+var ddlTypePrefixes = map[string]bool{"MATERIALIZED": true, "FOREIGN": true, "EVENT": true}
+
+// reviewMiddleware holds DDL for review when the query asks for it or its
+// connection has review_ddl set, and lets it through once confirmed.
+type reviewMiddleware struct{ a *Agent }
+
+func (reviewMiddleware) Name() string { return "review" }
+
+func (m reviewMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		if q.SQL == "" || q.confirmed || !q.Review && !q.conn.ReviewDDL {
+			return next(q)
+		}
+		review := reviewSQL(q.SQL)
+		if review == nil {
+			return next(q)
+		}
+		review.ExpiresAt = m.a.reviews.hold(q.Message)
+		return QueryResponse{ID: q.ID, Type: "review", Connection: q.Connection, Review: review}
+	}
+}
+
+// reviewSQL describes the statements of q, or returns nil when none of them
+// is DDL.
+func reviewSQL(q string) *DDLReview {
+	review := &DDLReview{}
+	ddl := false
+	for _, stmt := range splitStatements(q) {
+		s, isDDL := reviewStatement(stmt)
+		ddl = ddl || isDDL
+		review.Destructive = review.Destructive || s.Destructive
+		review.Statements = append(review.Statements, s)
+	}
+	if !ddl {
+		return nil
+	}
+	return review
+}
+
+// reviewStatement describes one statement and reports whether it is DDL.
+func reviewStatement(stmt string) (ReviewedStatement, bool) {
+	s := ReviewedStatement{Statement: stmt}
+	toks := sqlTokens(stmt)
+	if len(toks) == 0 || !ddlVerbs[toks[0].word()] {
+		s.Kind, s.Objects = classifyStatement(stmt)
+		return s, false
+	}
+	verb := toks[0].word()
+	s.Kind = strings.ToLower(verb)
+	if verb != "CREATE" && verb != "ALTER" && verb != "DROP" && verb != "TRUNCATE" {
+		// GRANT, COMMENT and the like change no data, and what they
+		// name is too varied to pick out.
+		return s, true
+	}
+
+	i := 1
+	for i < len(toks) && ddlModifiers[toks[i].word()] {
+		i++
+	}
+	typ := ""
+	if i < len(toks) && toks[i].word() != "" {
+		typ = toks[i].word()
+		if ddlTypePrefixes[typ] && i+1 < len(toks) {
+			i++
+			typ += " " + toks[i].word()
+		}
+		i++
+	}
+	if verb == "TRUNCATE" && typ != "TABLE" {
+		// TRUNCATE's TABLE is optional, so the word was the first table.
+		if typ != "" {
+			i--
+		}
+		typ = "TABLE"
+	}
+	s.Kind += " " + strings.ToLower(typ)
+	for i < len(toks) && ddlModifiers[toks[i].word()] {
+		i++
+	}
+
+	// The names changed: a list for DROP and TRUNCATE, one name otherwise,
+	// and for an index the table after ON too.
+	for i < len(toks) {
+		name, next := qualifiedName(toks, i)
+		if name == "" {
+			break
+		}
+		s.Objects = append(s.Objects, name)
+		i = next
+		if (verb != "DROP" && verb != "TRUNCATE") || i >= len(toks) || toks[i].text != "," {
+			break
+		}
+		i++
+	}
+	if typ == "INDEX" {
+		for j := i; j+1 < len(toks); j++ {
+			if toks[j].word() == "ON" {
+				if name, _ := qualifiedName(toks, j+1); name != "" {
+					s.Objects = append(s.Objects, name)
+				}
+				break
+			}
+		}
+	}
+
+	switch verb {
+	case "DROP":
+		reason := "drops " + strings.ToLower(typ) + " " + strings.Join(s.Objects, ", ")
+		if toks[len(toks)-1].word() == "CASCADE" {
+			reason += " and everything that depends on it"
+		}
+		s.Reasons = []string{reason}
+	case "TRUNCATE":
+		s.Reasons = []string{"deletes every row of " + strings.Join(s.Objects, ", ")}
+	case "ALTER":
+		s.Reasons = alterReasons(toks[i:])
+	}
+	s.Destructive = len(s.Reasons) > 0
+	return s, true
+}
+
+// alterReasons finds the destructive actions of an ALTER statement, whose
+// tokens after the altered object's name are toks: dropping a column or
+// constraint, and changing a column's type.
+func alterReasons(toks []sqlToken) []string {
+	var reasons []string
+	for i := 0; i+1 < len(toks); i++ {
+		switch toks[i].word() {
+		case "DROP":
+			j := i + 1
+			what := "column"
+			switch toks[j].word() {
+			case "COLUMN":
+				j++
+			case "CONSTRAINT":
+				what = "constraint"
+				j++
+			case "PRIMARY":
+				reasons = append(reasons, "drops the primary key")
+				continue
+			case "DEFAULT", "NOT", "IDENTITY", "EXPRESSION":
+				continue
+			}
+			for j < len(toks) && ddlModifiers[toks[j].word()] {
+				j++
+			}
+			if j < len(toks) {
+				reasons = append(reasons, "drops "+what+" "+identName(toks[j]))
+			}
+		case "TYPE":
+			// ALTER [COLUMN] name [SET DATA] TYPE type
+			j := i - 1
+			for j > 0 && (toks[j].word() == "DATA" || toks[j].word() == "SET") {
+				j--
+			}
+			if j > 0 && (toks[j-1].word() == "COLUMN" || toks[j-1].word() == "ALTER") {
+				reasons = append(reasons, "changes the type of column "+identName(toks[j]))
+			}
+		}
+	}
+	return reasons
+}
+
+// splitStatements splits q at the semicolons that end its statements,
+// skipping those in string literals, quoted identifiers, comments and
+// dollar-quoted bodies, and drops empty statements.
+func splitStatements(q string) []string {
+	var stmts []string
+	start := 0
+	add := func(end int) {
+		if s := strings.TrimSpace(q[start:end]); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	for i := 0; i < len(q); i++ {
+		skip := func(close string, from int) {
+			end := strings.Index(q[from:], close)
+			if end < 0 {
+				i = len(q)
+				return
+			}
+			i = from + end + len(close) - 1
+		}
+		switch c := q[i]; {
+		case c == '\'' || c == '"':
+			// A doubled quote closes and reopens the literal, which
+			// comes to the same thing.
+			skip(string(c), i+1)
+		case c == '-' && strings.HasPrefix(q[i:], "--"):
+			skip("\n", i)
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			skip("*/", i+2)
+		case c == '$':
+			j := i + 1
+			for j < len(q) && (isIdentByte(q[j]) || q[j] >= '0' && q[j] <= '9') {
+				j++
+			}
+			if j < len(q) && q[j] == '$' && (j == i+1 || !(q[i+1] >= '0' && q[i+1] <= '9')) {
+				skip(q[i:j+1], j+1)
+			}
+		case c == ';':
+			add(i)
+			start = i + 1
+		}
+	}
+	add(len(q))
+	return stmts
+}
+
+type reviewKey struct {
+	tenant *tenant
+	id     string
+}
+
+type heldReview struct {
+	msg     Message
+	expires time.Time
+}
+
+// heldReviews holds the queries waiting for a confirm message, by tenant
+// and query ID.
+type heldReviews struct {
+	mu   sync.Mutex
+	held map[reviewKey]heldReview
+}
+
+func newHeldReviews() *heldReviews {
+	return &heldReviews{held: map[reviewKey]heldReview{}}
+}
+
+// hold keeps msg until it is confirmed or expires, and returns when that
+// is.
+func (r *heldReviews) hold(msg Message) time.Time {
+	now := time.Now()
+	expires := now.Add(reviewTTL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, h := range r.held {
+		if now.After(h.expires) {
+			delete(r.held, k)
+		}
+	}
+	r.held[reviewKey{msg.tenant, msg.ID}] = heldReview{msg: msg, expires: expires}
+	return expires.UTC().Truncate(time.Second)
+}
+
+// take removes and returns the query held under id for t.
+func (r *heldReviews) take(t *tenant, id string) (Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := reviewKey{t, id}
+	h, ok := r.held[k]
+	delete(r.held, k)
+	if !ok || time.Now().After(h.expires) {
+		return Message{}, false
+	}
+	return h.msg, true
+}
+
+// confirmQuery answers a "confirm" message by running the query held for
+// review under the same ID, as it was sent.
+func confirmQuery(msg Message) QueryResponse {
+	held, ok := msg.agent().reviews.take(msg.tenant, msg.ID)
+	if !ok {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "no query %q is waiting for confirmation; it may have expired", msg.ID))
+	}
+	held.confirmed = true
+	held.ctx, held.received = msg.ctx, msg.received
+	return runQuery(held)
+}
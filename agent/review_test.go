@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"DROP TABLE a; DROP TABLE b;", []string{"DROP TABLE a", "DROP TABLE b"}},
+		{"SELECT ';' AS x -- ;\n; ", []string{"SELECT ';' AS x -- ;"}},
+		{`CREATE TABLE "a;b" (x int) /* ; */`, []string{`CREATE TABLE "a;b" (x int) /* ; */`}},
+		{"CREATE FUNCTION f() RETURNS void AS $body$ BEGIN DELETE FROM t; END $body$ LANGUAGE plpgsql; SELECT $1",
+			[]string{"CREATE FUNCTION f() RETURNS void AS $body$ BEGIN DELETE FROM t; END $body$ LANGUAGE plpgsql", "SELECT $1"}},
+		{"DO $$ BEGIN PERFORM 1; END $$", []string{"DO $$ BEGIN PERFORM 1; END $$"}},
+		{" ; ", nil},
+	}
+	for _, tc := range tests {
+		if got := splitStatements(tc.sql); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitStatements(%q) = %q, want %q", tc.sql, got, tc.want)
+		}
+	}
+}
+
+func TestReviewStatement(t *testing.T) {
+	tests := []struct {
+		sql     string
+		kind    string
+		objects []string
+		reasons []string
+		ddl     bool
+	}{
+		{sql: "DROP TABLE IF EXISTS public.orders, Items CASCADE", kind: "drop table", objects: []string{"public.orders", "items"},
+			reasons: []string{"drops table public.orders, items and everything that depends on it"}, ddl: true},
+		{sql: "drop materialized view sales_mv", kind: "drop materialized view", objects: []string{"sales_mv"},
+			reasons: []string{"drops materialized view sales_mv"}, ddl: true},
+		{sql: "TRUNCATE ONLY logs, audit", kind: "truncate table", objects: []string{"logs", "audit"},
+			reasons: []string{"deletes every row of logs, audit"}, ddl: true},
+		{sql: "CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS users_email ON public.users (email)", kind: "create index",
+			objects: []string{"users_email", "public.users"}, ddl: true},
+		{sql: `CREATE OR REPLACE VIEW "Active" AS SELECT * FROM users`, kind: "create view", objects: []string{"Active"}, ddl: true},
+		{sql: "ALTER TABLE users ADD COLUMN age int, ALTER COLUMN name DROP NOT NULL", kind: "alter table", objects: []string{"users"}, ddl: true},
+		{sql: "ALTER TABLE users DROP COLUMN IF EXISTS age, DROP CONSTRAINT users_email_key, ALTER name SET DATA TYPE varchar(10)",
+			kind: "alter table", objects: []string{"users"},
+			reasons: []string{"drops column age", "drops constraint users_email_key", "changes the type of column name"}, ddl: true},
+		{sql: "GRANT SELECT ON users TO analyst", kind: "grant", ddl: true},
+		{sql: "DELETE FROM users", kind: "delete", objects: []string{"users"}},
+	}
+	for _, tc := range tests {
+		s, ddl := reviewStatement(tc.sql)
+		if s.Kind != tc.kind || !reflect.DeepEqual(s.Objects, tc.objects) || !reflect.DeepEqual(s.Reasons, tc.reasons) ||
+			s.Destructive != (tc.reasons != nil) || ddl != tc.ddl {
+			t.Errorf("reviewStatement(%q) = %+v, %v", tc.sql, s, ddl)
+		}
+	}
+}
+
+func TestReviewAndConfirm(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+	tn := testTenant(
+		&connection{Name: "main", Connector: pg},
+		&connection{Name: "guarded", ReviewDDL: true, Connector: pg},
+	)
+	other := &tenant{agent: tn.agent, conns: tn.conns}
+
+	// A query that asks for review is held, and nothing runs.
+	resp := runQuery(Message{ID: "r1", Type: "query", SQL: "CREATE INDEX ON users (email); DROP TABLE old_users", Review: true, tenant: tn})
+	if resp.Type != "review" || resp.Review == nil || !resp.Review.Destructive || len(resp.Review.Statements) != 2 {
+		t.Fatalf("expected a destructive review, got %+v", resp)
+	}
+	if resp.Review.ExpiresAt.Before(time.Now()) {
+		t.Errorf("expected a future expiry, got %v", resp.Review.ExpiresAt)
+	}
+
+	// Another token can't confirm it.
+	if resp := confirmQuery(Message{ID: "r1", Type: "confirm", tenant: other}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for another token, got %+v", codeInvalidRequest, resp)
+	}
+
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("CREATE INDEX ON users").WillReturnRows(sqlmock.NewRows(nil))
+	resp = confirmQuery(Message{ID: "r1", Type: "confirm", tenant: tn})
+	if resp.Error != "" || resp.Type == "review" {
+		t.Errorf("expected the confirmed query to run, got %+v", resp)
+	}
+
+	// A query is confirmed once.
+	if resp := confirmQuery(Message{ID: "r1", Type: "confirm", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for a second confirm, got %+v", codeInvalidRequest, resp)
+	}
+
+	// review_ddl holds DDL on its connection without asking, but lets
+	// other statements through.
+	resp = runQuery(Message{ID: "r2", Type: "query", SQL: "ALTER TABLE users ADD COLUMN age int", Target: "guarded", tenant: tn})
+	if resp.Type != "review" || resp.Review.Destructive {
+		t.Errorf("expected a review that isn't destructive, got %+v", resp)
+	}
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"x"}).AddRow(1))
+	resp = runQuery(Message{ID: "r3", Type: "query", SQL: "SELECT 1", Target: "guarded", tenant: tn})
+	if resp.Type == "review" || len(resp.Rows) != 1 {
+		t.Errorf("expected the select to run, got %+v", resp)
+	}
+
+	// An expired review can't be confirmed.
+	defer func(ttl time.Duration) { reviewTTL = ttl }(reviewTTL)
+	reviewTTL = -time.Second
+	runQuery(Message{ID: "r4", Type: "query", SQL: "DROP TABLE users", Review: true, tenant: tn})
+	if resp := confirmQuery(Message{ID: "r4", Type: "confirm", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for an expired review, got %+v", codeInvalidRequest, resp)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// connection is a named database the hub can address.
+type connection struct {
+	Name   string
+	Labels map[string]string
+	Admin  bool
+	// ReadOnly refuses statements that aren't reads; SQL connectors also
+	// run queries in read-only transactions.
+	ReadOnly bool
+	// ReviewDDL holds queries with DDL until they are confirmed.
+	ReviewDDL bool
+	// MigrationsDir holds the connection's migration files, if any.
+	MigrationsDir string
+	// AggregateOnly answers only aggregate queries whose groups cover at
+	// least MinGroupSize rows; see aggregate.go.
+	AggregateOnly bool
+	MinGroupSize  int
+	Connector
+}
+
+// openConnections opens the databases configs describe for a. The first
+// one is the default for messages that don't name a target.
+func (a *Agent) openConnections(configs []ConnectionConfig) ([]*connection, error) {
+	seen := map[string]bool{}
+	for _, cfg := range configs {
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("connection %q is defined twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+	}
+
+	var opened []*connection
+	for _, cfg := range configs {
+		flavor := cfg.Flavor
+		if flavor == "" {
+			flavor = "postgres"
+		}
+		if flavor != "postgres" && flavor != "cockroach" {
+			closeConnections(opened)
+			return nil, fmt.Errorf("connection %q: unknown flavor %q: expected postgres or cockroach", cfg.Name, flavor)
+		}
+
+		dsn := cfg.URL
+		if s := urlScheme(dsn); s == "" || s == "postgres" || s == "postgresql" {
+			var err error
+			if cfg.TLS != nil {
+				if dsn, err = cfg.TLS.apply(dsn); err != nil {
+					closeConnections(opened)
+					return nil, fmt.Errorf("connection %q: tls: %w", cfg.Name, err)
+				}
+			}
+			if err = checkVerifyFull(dsn, a.opts.RequireVerifyFull); err != nil {
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: %w", cfg.Name, err)
+			}
+		} else if cfg.TLS != nil {
+			closeConnections(opened)
+			return nil, fmt.Errorf("connection %q: tls is only supported for postgres and cockroach", cfg.Name)
+		}
+		var password passwordFunc
+		if cfg.AzureAD != nil {
+			if s := urlScheme(dsn); s != "" && s != "postgres" && s != "postgresql" {
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: azure_ad is only supported for postgres", cfg.Name)
+			}
+			if err := cfg.AzureAD.check(); err != nil {
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: azure_ad: %w", cfg.Name, err)
+			}
+			password = newAzureTokens(*cfg.AzureAD, a.opts.IPFamily).password
+		}
+
+		a.progressf("Connecting to database %q...", cfg.Name)
+		c, err := openConnector(dsn, flavor, password, a.opts.IPFamily)
+		if err != nil {
+			closeConnections(opened)
+			return nil, fmt.Errorf("connection %q: %w", cfg.Name, err)
+		}
+		sc, ok := c.(*sqlConnector)
+		if ok {
+			sc.agent = a
+			if cfg.IdleTimeout > 0 {
+				sc.setIdleTimeout(time.Duration(cfg.IdleTimeout))
+			}
+			sc.readOnly = cfg.ReadOnly || cfg.AggregateOnly
+		}
+		if cfg.LeaderElection != "" {
+			if !ok || sc.flavor != "postgres" {
+				c.Close()
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: leader_election is only supported for postgres", cfg.Name)
+			}
+			sc.elector = newElector(cfg.Name, cfg.LeaderElection, sc.db)
+			sc.elector.agentID, sc.elector.reporter = a.opts.AgentID, a.reporter
+		}
+		if cfg.CostLimit != nil {
+			if !ok || sc.flavor != "postgres" {
+				c.Close()
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: cost_limit is only supported for postgres", cfg.Name)
+			}
+			sc.costLimit = cfg.CostLimit
+		}
+		if len(cfg.SessionSettings) > 0 {
+			if !ok || sc.flavor == "oracle" {
+				c.Close()
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: session_settings are only supported for postgres and cockroach", cfg.Name)
+			}
+			if sc.settings, err = parseSessionSettings(cfg.SessionSettings); err != nil {
+				c.Close()
+				closeConnections(opened)
+				return nil, fmt.Errorf("connection %q: %w", cfg.Name, err)
+			}
+		}
+		opened = append(opened, &connection{Name: cfg.Name, Labels: cfg.Labels, Admin: cfg.Admin, ReadOnly: cfg.ReadOnly || cfg.AggregateOnly, ReviewDDL: cfg.ReviewDDL,
+			MigrationsDir: cfg.Migrations, AggregateOnly: cfg.AggregateOnly, MinGroupSize: cfg.MinGroupSize, Connector: c})
+	}
+	return opened, nil
+}
+
+func closeConnections(conns []*connection) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// route picks the connection among conns a message is addressed to. target may be empty
+// (the default connection), a name, a glob over names such as "analytics.*",
+// or a label selector such as "env=staging,team=data". It must match exactly
+// one connection.
+func route(conns []*connection, target string) (*connection, error) {
+	if len(conns) == 0 {
+		return nil, codedErrorf(codeInvalidRequest, "no databases configured")
+	}
+	if target == "" {
+		return conns[0], nil
+	}
+
+	var matched []*connection
+	for _, c := range conns {
+		if c.matches(target) {
+			matched = append(matched, c)
+		}
+	}
+
+	switch len(matched) {
+	case 1:
+		return matched[0], nil
+	case 0:
+		names := make([]string, len(conns))
+		for i, c := range conns {
+			names[i] = c.Name
+		}
+		sort.Strings(names)
+		return nil, codedErrorf(codeInvalidRequest, "no connection matches target %q (available: %s)", target, strings.Join(names, ", "))
+	default:
+		names := make([]string, len(matched))
+		for i, c := range matched {
+			names[i] = c.Name
+		}
+		return nil, codedErrorf(codeInvalidRequest, "target %q is ambiguous: matches %s", target, strings.Join(names, ", "))
+	}
+}
+
+func (c *connection) matches(target string) bool {
+	if !strings.Contains(target, "=") {
+		ok, _ := path.Match(target, c.Name)
+		return ok
+	}
+	for _, term := range strings.Split(target, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(term), "=")
+		if c.Labels[strings.TrimSpace(key)] != strings.TrimSpace(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	connections := []*connection{
+		{Name: "default"},
+		{Name: "analytics.events", Labels: map[string]string{"env": "prod", "team": "data"}},
+		{Name: "analytics.staging", Labels: map[string]string{"env": "staging", "team": "data"}},
+	}
+
+	testCases := []struct {
+		target  string
+		want    string
+		wantErr string
+	}{
+		{target: "", want: "default"},
+		{target: "analytics.events", want: "analytics.events"},
+		{target: "analytics.st*", want: "analytics.staging"},
+		{target: "env=staging", want: "analytics.staging"},
+		{target: "team=data, env=prod", want: "analytics.events"},
+		{target: "analytics.*", wantErr: "ambiguous"},
+		{target: "team=data", wantErr: "ambiguous"},
+		{target: "billing", wantErr: "available: analytics.events, analytics.staging, default"},
+		{target: "env=dev", wantErr: "no connection matches"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			c, err := route(connections, tc.target)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.Name != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, c.Name)
+			}
+		})
+	}
+}
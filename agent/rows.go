@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxRowBlock caps how many rows' cells fetchRows allocates at once. Blocks
+// start small and double, so a one-row result stays cheap.
+const maxRowBlock = 256
+
+// cell scans one column straight from the driver's value into its JSON
+// form. Scanning through a sql.Scanner skips the copy database/sql makes
+// of []byte values for *any destinations, and the conversion below then
+// copies them once, into a string.
+type cell struct {
+	v any
+	// typeName is the column's Oracle type, for oracleValue; empty for
+	// other flavors.
+	typeName string
+}
+
+func (c *cell) Scan(src any) error {
+	switch val := src.(type) {
+	case []byte:
+		c.v = string(val)
+	case time.Time:
+		c.v = val.Format(time.RFC3339)
+	default:
+		c.v = val
+	}
+	if c.typeName != "" {
+		c.v = oracleValue(c.typeName, c.v)
+	}
+	return nil
+}
+
+// fetchRows runs sqlQuery and returns its columns, their database types
+// (nil if the driver reports none) and its rows converted for JSON. The scan destinations are reused across rows, and rows are cut
+// from blocks of many rows' cells, so a row costs one allocation per
+// text value and little else. With lim, rows beyond its size go to a
+// spill file, set in lim, or fail the query; see resultLimit. tm, if set,
+// gets the time to the first row and the time reading them, and p the rows
+// read so far.
+func fetchRows(q queryer, flavor, sqlQuery string, params []any, lim *resultLimit, tm *queryTimer, p *fetchProgress) ([]string, []string, [][]any, error) {
+	start := time.Now()
+	rows, err := q.Query(sqlQuery, params...)
+	tm.record(phaseExecute, start)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+	start = time.Now()
+	defer tm.record(phaseFetch, start)
+	return readRows(rows, flavor, lim, p)
+}
+
+// fetchResults is fetchRows for a statement that may return several
+// result sets, such as a batch of queries. The first is returned as
+// fetchRows returns it; the rest come back as result sets, each held to
+// --max-result-bytes of its own without spilling. Drivers return further
+// sets only for some statements: lib/pq, for one sent without parameters.
+func fetchResults(q queryer, flavor, sqlQuery string, params []any, lim *resultLimit, tm *queryTimer, p *fetchProgress) (_ []string, _ []string, _ [][]any, _ []ResultSet, err error) {
+	defer func() {
+		if lim != nil && lim.spilled != nil && err != nil {
+			lim.spilled.remove()
+			lim.spilled = nil
+		}
+	}()
+	start := time.Now()
+	rows, err := q.Query(sqlQuery, params...)
+	tm.record(phaseExecute, start)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer rows.Close()
+	start = time.Now()
+	defer tm.record(phaseFetch, start)
+	columns, types, results, err := readRows(rows, flavor, lim, p)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var sets []ResultSet
+	for rows.NextResultSet() {
+		var set ResultSet
+		set.Columns, set.ColumnTypes, set.Rows, err = readRows(rows, flavor, lim.another("set"), nil)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		sets = append(sets, set)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return columns, types, results, sets, nil
+}
+
+// readRows reads the current result set of rows; see fetchRows.
+func readRows(rows *sql.Rows, flavor string, lim *resultLimit, p *fetchProgress) (_ []string, _ []string, _ [][]any, err error) {
+	defer func() {
+		if lim != nil && lim.spilled != nil && err != nil {
+			lim.spilled.remove()
+			lim.spilled = nil
+		}
+	}()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	types := columnTypeNames(rows)
+	n := len(columns)
+
+	cells := make([]cell, n)
+	dest := make([]any, n)
+	for i := range cells {
+		dest[i] = &cells[i]
+	}
+	if flavor == "oracle" {
+		for i, name := range types {
+			cells[i].typeName = name
+		}
+	}
+
+	p.reset()
+	var results [][]any
+	var block []any
+	blockRows := 8
+	var size int64
+	spillRow := make([]any, n)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, nil, err
+		}
+		if lim != nil && lim.spilled != nil {
+			for i := range cells {
+				spillRow[i] = cells[i].v
+			}
+			if err := lim.spilled.write(spillRow); err != nil {
+				return nil, nil, nil, fmt.Errorf("spill result: %w", err)
+			}
+			p.add(spillRow)
+			continue
+		}
+		if len(block) < n {
+			block = make([]any, blockRows*n)
+			results = growRows(results, blockRows)
+			blockRows = min(2*blockRows, maxRowBlock)
+		}
+		// The full slice expression keeps an append to one row from
+		// overwriting the next.
+		row := block[:n:n]
+		block = block[n:]
+		for i := range cells {
+			row[i] = cells[i].v
+		}
+		results = append(results, row)
+		p.add(row)
+		if lim != nil {
+			if size += rowBytes(row); size > lim.max {
+				if err := lim.overflow(results); err != nil {
+					return nil, nil, nil, err
+				}
+				results, block = nil, nil
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	if lim != nil && lim.spilled != nil {
+		if err := lim.spilled.finish(); err != nil {
+			return nil, nil, nil, fmt.Errorf("spill result: %w", err)
+		}
+	}
+	return columns, columnTypeTags(types), results, nil
+}
+
+// columnTypeTags returns types in lower case, the form replies carry them
+// in, or nil when the driver named none of them.
+func columnTypeTags(types []string) []string {
+	var tags []string
+	for i, t := range types {
+		if t != "" && tags == nil {
+			tags = make([]string, len(types))
+		}
+		if tags != nil {
+			tags[i] = strings.ToLower(t)
+		}
+	}
+	return tags
+}
+
+// growRows makes room in rows for n more without reallocating.
+func growRows(rows [][]any, n int) [][]any {
+	if cap(rows)-len(rows) >= n {
+		return rows
+	}
+	grown := make([][]any, len(rows), 2*len(rows)+n)
+	copy(grown, rows)
+	return grown
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFetchRows(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "blob", "at", "ok"}).
+		AddRow(int64(1), "alice", []byte("raw"), at, true).
+		AddRow(int64(2), "", nil, nil, false).
+		AddRow(nil, "carol", []byte{}, at, nil))
+
+	columns, _, rows, err := fetchRows(mockDB, "postgres", "SELECT", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]any{
+		{int64(1), "alice", "raw", "2026-01-02T03:04:05Z", true},
+		{int64(2), "", nil, nil, false},
+		{nil, "carol", "", "2026-01-02T03:04:05Z", nil},
+	}
+	if len(columns) != 5 || !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected %v, got %v", want, rows)
+	}
+	// Rows share storage; appending to one must not overwrite the next.
+	_ = append(rows[0], "extra")
+	if rows[1][0] != int64(2) {
+		t.Errorf("expected rows to stay independent, got %v", rows[1])
+	}
+}
+
+func TestFetchResults(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	mock.ExpectQuery("SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(int64(1)).AddRow(int64(2)),
+		sqlmock.NewRows([]string{"name", "count"}).AddRow("alice", int64(3)),
+		sqlmock.NewRows([]string{"total"}),
+	)
+
+	columns, _, rows, sets, err := fetchResults(mockDB, "postgres", "SELECT", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(columns, []string{"id"}) || len(rows) != 2 {
+		t.Errorf("unexpected first result: %v %v", columns, rows)
+	}
+	if len(sets) != 2 {
+		t.Fatalf("expected 2 more result sets, got %+v", sets)
+	}
+	if !reflect.DeepEqual(sets[0].Columns, []string{"name", "count"}) || !reflect.DeepEqual(sets[0].Rows, [][]any{{"alice", int64(3)}}) {
+		t.Errorf("unexpected second result: %+v", sets[0])
+	}
+	if !reflect.DeepEqual(sets[1].Columns, []string{"total"}) || len(sets[1].Rows) != 0 {
+		t.Errorf("unexpected third result: %+v", sets[1])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func benchmarkFetchRows(b *testing.B, nrows, ncols int) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	columns := make([]string, ncols)
+	row := make([]driver.Value, ncols)
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+		switch i % 4 {
+		case 0:
+			row[i] = int64(i)
+		case 1:
+			row[i] = []byte("some text value")
+		case 2:
+			row[i] = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		default:
+			row[i] = 3.25
+		}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rows := sqlmock.NewRows(columns)
+		for j := 0; j < nrows; j++ {
+			rows.AddRow(row...)
+		}
+		mock.ExpectQuery("SELECT").WillReturnRows(rows)
+		b.StartTimer()
+		if _, _, _, err := fetchRows(mockDB, "postgres", "SELECT", nil, nil, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFetchRowsNarrow(b *testing.B) { benchmarkFetchRows(b, 1000, 4) }
+func BenchmarkFetchRowsWide(b *testing.B)   { benchmarkFetchRows(b, 1000, 40) }
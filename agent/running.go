@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// contextQuerier is implemented by connectors whose queries stop when their
+// context is cancelled.
+type contextQuerier interface {
+	QueryContext(ctx context.Context, msg Message) QueryResponse
+}
+
+// runningQuery is a query in flight, registered so a "cancel" message can
+// stop it.
+type runningQuery struct {
+	cancel     context.CancelFunc
+	connector  Connector
+	backendPID int
+	// tenant is the token that started the query; only it may cancel it.
+	tenant *tenant
+}
+
+// runningQueries are an Agent's queries in flight, by ID.
+type runningQueries struct {
+	sync.Mutex
+	queries map[string]*runningQuery
+}
+
+func newRunningQueries() *runningQueries {
+	return &runningQueries{queries: map[string]*runningQuery{}}
+}
+
+type runningKey struct{}
+
+// start registers query id and returns the context it runs under, derived
+// from parent, and the func that unregisters it.
+func (r *runningQueries) start(parent context.Context, id string, t *tenant, c Connector) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	r.Lock()
+	r.queries[id] = &runningQuery{cancel: cancel, connector: c, tenant: t}
+	r.Unlock()
+	return context.WithValue(ctx, runningKey{}, r), func() {
+		cancel()
+		r.Lock()
+		delete(r.queries, id)
+		r.Unlock()
+	}
+}
+
+// setBackendPID records the database session serving query id, running
+// under ctx.
+func setBackendPID(ctx context.Context, id string, pid int) {
+	r, _ := ctx.Value(runningKey{}).(*runningQueries)
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if q, ok := r.queries[id]; ok {
+		q.backendPID = pid
+	}
+}
+
+// CancelResponse answers a "cancel" message.
+type CancelResponse struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	QueryID    string `json:"query_id"`
+	BackendPID int    `json:"backend_pid,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// cancelQuery stops the running query msg.QueryID. With no mode its context
+// is cancelled, which has the driver ask the server to cancel. Mode "cancel"
+// or "terminate" additionally calls pg_cancel_backend or
+// pg_terminate_backend on the query's session from a separate admin
+// connection, for sessions that don't respond, e.g. while stuck on a lock.
+func cancelQuery(msg Message) CancelResponse {
+	resp := CancelResponse{ID: msg.ID, Type: "cancel_result", QueryID: msg.QueryID}
+
+	running := msg.agent().running
+	running.Lock()
+	q, ok := running.queries[msg.QueryID]
+	ok = ok && q.tenant == msg.tenant
+	var pid int
+	if ok {
+		pid = q.backendPID
+	}
+	running.Unlock()
+	if !ok {
+		resp.Error = fmt.Sprintf("query %q is not running", msg.QueryID)
+		return resp
+	}
+	resp.BackendPID = pid
+
+	var fn string
+	switch msg.Mode {
+	case "":
+	case "cancel":
+		fn = "pg_cancel_backend"
+	case "terminate":
+		fn = "pg_terminate_backend"
+	default:
+		resp.Error = fmt.Sprintf("unknown cancel mode %q: expected cancel or terminate", msg.Mode)
+		return resp
+	}
+
+	log.Printf("[query:%s] Cancelling (mode %q, backend pid %d)", msg.QueryID, msg.Mode, pid)
+	q.cancel()
+	if fn == "" {
+		return resp
+	}
+
+	sc, ok := q.connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" || pid == 0 {
+		resp.Error = fmt.Sprintf("%s is only available for postgres queries with a known backend pid", msg.Mode)
+		return resp
+	}
+	if err := sc.signalBackend(fn, pid); err != nil {
+		log.Printf("[query:%s] %s failed: %v", msg.QueryID, fn, err)
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// signalBackend runs fn (pg_cancel_backend or pg_terminate_backend) for pid
+// on a fresh connection, so it works even when the pool is exhausted by the
+// very queries being cancelled.
+func (c *sqlConnector) signalBackend(fn string, pid int) error {
+	admin, err := openDB(c.driver, c.dsn, c.password, c.family)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	var ok bool
+	if err := admin.QueryRow("SELECT "+fn+"($1)", pid).Scan(&ok); err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+	if !ok {
+		return fmt.Errorf("%s(%d) returned false: the session may have already ended", fn, pid)
+	}
+	return nil
+}
+
+// connQueryer runs queries on a single connection under ctx.
+type connQueryer struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (q connQueryer) Query(query string, args ...any) (*sql.Rows, error) {
+	return q.conn.QueryContext(q.ctx, query, args...)
+}
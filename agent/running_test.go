@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCancelQuery(t *testing.T) {
+	adminDB, mock, err := sqlmock.NewWithDSN("peekdb-cancel-test")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer adminDB.Close()
+	c := &sqlConnector{db: adminDB, flavor: "postgres", driver: "sqlmock", dsn: "peekdb-cancel-test"}
+
+	testCases := []struct {
+		name      string
+		mode      string
+		connector Connector
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   string
+	}{
+		{
+			name:      "context only",
+			connector: c,
+			mockSetup: func(sqlmock.Sqlmock) {},
+		},
+		{
+			name:      "terminate",
+			mode:      "terminate",
+			connector: c,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT pg_terminate_backend\(\$1\)`).WithArgs(4242).
+					WillReturnRows(sqlmock.NewRows([]string{"pg_terminate_backend"}).AddRow(true))
+			},
+		},
+		{
+			name:      "session already gone",
+			mode:      "cancel",
+			connector: c,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT pg_cancel_backend\(\$1\)`).WithArgs(4242).
+					WillReturnRows(sqlmock.NewRows([]string{"pg_cancel_backend"}).AddRow(false))
+			},
+			wantErr: "returned false",
+		},
+		{
+			name:      "not postgres",
+			mode:      "cancel",
+			connector: &sqlConnector{flavor: "oracle"},
+			mockSetup: func(sqlmock.Sqlmock) {},
+			wantErr:   "only available for postgres",
+		},
+		{
+			name:      "unknown mode",
+			mode:      "nuke",
+			connector: c,
+			mockSetup: func(sqlmock.Sqlmock) {},
+			wantErr:   "unknown cancel mode",
+		},
+	}
+
+	tn := testTenant()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, done := tn.agent.running.start(context.Background(), "q1", tn, tc.connector)
+			defer done()
+			setBackendPID(ctx, "q1", 4242)
+			tc.mockSetup(mock)
+
+			resp := cancelQuery(Message{ID: "k1", QueryID: "q1", Mode: tc.mode, tenant: tn})
+			if tc.wantErr != "" {
+				if !strings.Contains(resp.Error, tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %q", tc.wantErr, resp.Error)
+				}
+			} else if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if tc.mode != "nuke" && ctx.Err() == nil {
+				t.Error("expected the query context to be cancelled")
+			}
+			if resp.BackendPID != 4242 || resp.QueryID != "q1" {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+
+	resp := cancelQuery(Message{ID: "k2", QueryID: "q9", tenant: tn})
+	if resp.Error != `query "q9" is not running` {
+		t.Errorf("unexpected error for unknown query: %q", resp.Error)
+	}
+}
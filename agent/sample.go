@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SampleOption asks for a query to read a random sample of each table it
+// scans instead of all of it.
+type SampleOption struct {
+	Percent float64 `json:"percent"`
+	// Method is "system" (the default), which samples whole pages and is
+	// fast, or "bernoulli", which samples rows and is more even.
+	Method string `json:"method,omitempty"`
+	// Seed makes the sample repeatable.
+	Seed *int `json:"seed,omitempty"`
+}
+
+// sampleQuery rewrites q so every table after FROM or JOIN is sampled the
+// way flavor spells it. Subqueries, functions and CTE names are left alone;
+// tables inside them are sampled where they are scanned.
+func sampleQuery(q, flavor string, s SampleOption) (string, error) {
+	if s.Percent <= 0 || s.Percent > 100 {
+		return "", codedErrorf(codeInvalidRequest, "sample percent must be more than 0 and at most 100, got %v", s.Percent)
+	}
+	method := strings.ToLower(s.Method)
+	if method != "" && method != "system" && method != "bernoulli" {
+		return "", codedErrorf(codeInvalidRequest, "unknown sample method %q: expected system or bernoulli", s.Method)
+	}
+	if kind, _ := classifyStatement(q); kind != "select" {
+		return "", codedErrorf(codeInvalidRequest, "only SELECT statements can be sampled")
+	}
+
+	percent := strconv.FormatFloat(s.Percent, 'f', -1, 64)
+	var clause string
+	var afterAlias bool
+	switch flavor {
+	case "postgres":
+		// TABLESAMPLE follows the alias: FROM t AS x TABLESAMPLE ...
+		if method == "" {
+			method = "system"
+		}
+		clause = fmt.Sprintf(" TABLESAMPLE %s (%s)", strings.ToUpper(method), percent)
+		if s.Seed != nil {
+			clause += fmt.Sprintf(" REPEATABLE (%d)", *s.Seed)
+		}
+		afterAlias = true
+	case "oracle":
+		// SAMPLE precedes the alias: FROM t SAMPLE BLOCK (1) x
+		clause = fmt.Sprintf(" SAMPLE BLOCK (%s)", percent)
+		if method == "bernoulli" {
+			clause = fmt.Sprintf(" SAMPLE (%s)", percent)
+		}
+		if s.Seed != nil {
+			clause += fmt.Sprintf(" SEED (%d)", *s.Seed)
+		}
+	default:
+		return "", codedErrorf(codeNotSupported, "sample is not supported for %s", flavor)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, r := range tableRefs(sqlTokens(q)) {
+		if r.keyword != "FROM" && r.keyword != "JOIN" {
+			continue
+		}
+		at := r.nameEnd
+		if afterAlias {
+			at = r.aliasEnd
+		}
+		b.WriteString(q[last:at])
+		b.WriteString(clause)
+		last = at
+	}
+	if last == 0 {
+		return "", codedErrorf(codeInvalidRequest, "the query reads no tables to sample")
+	}
+	b.WriteString(q[last:])
+	return b.String(), nil
+}
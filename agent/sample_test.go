@@ -0,0 +1,76 @@
+package agent
+
+import "testing"
+
+func TestSampleQuery(t *testing.T) {
+	seed := 7
+	tests := []struct {
+		name     string
+		flavor   string
+		sql      string
+		sample   SampleOption
+		expected string
+		code     string
+	}{
+		{
+			name:     "single table",
+			flavor:   "postgres",
+			sql:      "SELECT * FROM events WHERE kind = 'click'",
+			sample:   SampleOption{Percent: 1},
+			expected: "SELECT * FROM events TABLESAMPLE SYSTEM (1) WHERE kind = 'click'",
+		},
+		{
+			name:     "aliases and joins",
+			flavor:   "postgres",
+			sql:      "SELECT * FROM public.orders AS o JOIN users u ON u.id = o.user_id",
+			sample:   SampleOption{Percent: 0.5, Method: "bernoulli", Seed: &seed},
+			expected: "SELECT * FROM public.orders AS o TABLESAMPLE BERNOULLI (0.5) REPEATABLE (7) JOIN users u TABLESAMPLE BERNOULLI (0.5) REPEATABLE (7) ON u.id = o.user_id",
+		},
+		{
+			name:     "subquery and cte left alone",
+			flavor:   "postgres",
+			sql:      "WITH recent AS (SELECT * FROM events) SELECT count(*) FROM recent, (SELECT 1) s",
+			sample:   SampleOption{Percent: 10},
+			expected: "WITH recent AS (SELECT * FROM events TABLESAMPLE SYSTEM (10)) SELECT count(*) FROM recent, (SELECT 1) s",
+		},
+		{
+			name:     "oracle sample before alias",
+			flavor:   "oracle",
+			sql:      "SELECT * FROM emp e WHERE e.sal > 1000",
+			sample:   SampleOption{Percent: 5, Method: "bernoulli"},
+			expected: "SELECT * FROM emp SAMPLE (5) e WHERE e.sal > 1000",
+		},
+		{
+			name:     "oracle block sample",
+			flavor:   "oracle",
+			sql:      "SELECT * FROM emp",
+			sample:   SampleOption{Percent: 5, Seed: &seed},
+			expected: "SELECT * FROM emp SAMPLE BLOCK (5) SEED (7)",
+		},
+		{name: "percent out of range", flavor: "postgres", sql: "SELECT * FROM t", sample: SampleOption{Percent: 150}, code: codeInvalidRequest},
+		{name: "not a select", flavor: "postgres", sql: "DELETE FROM t", sample: SampleOption{Percent: 1}, code: codeInvalidRequest},
+		{name: "no tables", flavor: "postgres", sql: "SELECT 1", sample: SampleOption{Percent: 1}, code: codeInvalidRequest},
+		{name: "cockroach", flavor: "cockroach", sql: "SELECT * FROM t", sample: SampleOption{Percent: 1}, code: codeNotSupported},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := sampleQuery(tc.sql, tc.flavor, tc.sample)
+			if tc.code != "" {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				if code := errorCode(err); code != tc.code {
+					t.Errorf("expected %s, got %s (%v)", tc.code, code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("got      %q\nexpected %q", got, tc.expected)
+			}
+		})
+	}
+}
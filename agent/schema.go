@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// SchemaResponse answers a "schema" message with the tables, views and
+// columns visible to the agent's database user.
+type SchemaResponse struct {
+	ID     string        `json:"id"`
+	Type   string        `json:"type"`
+	Tables []SchemaTable `json:"tables,omitempty"`
+	Error  string        `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+	// ForeignKeys is the relationship graph between Tables, for drawing
+	// entity-relationship diagrams; see foreignkeys.go.
+	ForeignKeys []ForeignKey `json:"foreign_keys,omitempty"`
+	// Types are the enums, domains and composite types the columns can
+	// have; see types.go.
+	Types []SchemaType `json:"types,omitempty"`
+	// Sequences are the sequences with how close each is to running out;
+	// see sequences.go.
+	Sequences []Sequence `json:"sequences,omitempty"`
+}
+
+type SchemaTable struct {
+	Schema  string         `json:"schema"`
+	Name    string         `json:"name"`
+	Kind    string         `json:"kind"`
+	Columns []SchemaColumn `json:"columns"`
+	Comment string         `json:"comment,omitempty"`
+
+	Hypertable *Hypertable `json:"hypertable,omitempty"`
+
+	// A partitioned table has its partition key and its partitions, which
+	// are not listed as tables of their own; see partitions.go.
+	PartitionKey string      `json:"partition_key,omitempty"`
+	Partitions   []Partition `json:"partitions,omitempty"`
+}
+
+type SchemaColumn struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default,omitempty"`
+	Comment  string  `json:"comment,omitempty"`
+
+	// UserType names the column's type when it is user-defined, so an
+	// enum column can be edited with a list of its labels.
+	UserType *TypeRef `json:"user_type,omitempty"`
+	// Identity is "always" or "by_default" for an identity column.
+	Identity string `json:"identity,omitempty"`
+}
+
+var relKinds = map[string]string{
+	"r": "table",
+	"v": "view",
+	"m": "materialized_view",
+	"f": "foreign_table",
+	"p": "partitioned_table",
+}
+
+const schemaQuery = `
+SELECT n.nspname, c.relname, c.relkind::text, a.attname,
+       format_type(a.atttypid, a.atttypmod), NOT a.attnotnull,
+       pg_get_expr(d.adbin, d.adrelid), obj_description(c.oid, 'pg_class'),
+       col_description(c.oid, a.attnum),
+       CASE WHEN t.typtype IN ('e', 'd', 'c') THEN tn.nspname END,
+       CASE WHEN t.typtype IN ('e', 'd', 'c') THEN t.typname END
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+LEFT JOIN pg_attrdef d ON d.adrelid = c.oid AND d.adnum = a.attnum
+LEFT JOIN pg_type t ON t.oid = a.atttypid
+LEFT JOIN pg_namespace tn ON tn.oid = t.typnamespace
+WHERE c.relkind IN ('r', 'v', 'm', 'f', 'p')
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND n.nspname NOT LIKE '\_timescaledb%'
+ORDER BY n.nspname, c.relname, a.attnum`
+
+// Schema lists every visible table, or only those in schema when one is
+// given.
+func (c *sqlConnector) Schema(id, schema string) SchemaResponse {
+	if c.flavor == "oracle" {
+		return SchemaResponse{ID: id, Type: "schema", Error: "schema introspection is not supported for oracle", ErrorCode: codeNotSupported}
+	}
+	log.Printf("[schema:%s] Introspecting", id)
+	start := time.Now()
+
+	tables, err := loadTables(c.db, schema)
+	if err != nil {
+		log.Printf("[schema:%s] Error: %v", id, err)
+		return SchemaResponse{ID: id, Type: "schema", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+
+	if err := attachHypertables(c.db, tables); err != nil {
+		// Timescale metadata is an extra; still return the plain schema.
+		log.Printf("[schema:%s] Could not read hypertables: %v", id, err)
+	}
+	if tables, err = nestPartitions(c.db, tables); err != nil {
+		log.Printf("[schema:%s] Could not read partitions: %v", id, err)
+	}
+	keys, err := loadForeignKeys(c.db, schema)
+	if err != nil {
+		// As are the relationships.
+		log.Printf("[schema:%s] Could not read foreign keys: %v", id, err)
+	}
+
+	types, err := loadTypes(c.db, schema)
+	if err != nil {
+		log.Printf("[schema:%s] Could not read types: %v", id, err)
+	}
+	seqs, err := loadSequences(c.db, schema, tables)
+	if err != nil {
+		log.Printf("[schema:%s] Could not read sequences: %v", id, err)
+	}
+
+	log.Printf("[schema:%s] Completed in %v, %d tables, %d foreign keys, %d types, %d sequences",
+		id, time.Since(start), len(tables), len(keys), len(types), len(seqs))
+	return SchemaResponse{ID: id, Type: "schema", Tables: tables, ForeignKeys: keys, Types: types, Sequences: seqs}
+}
+
+// schemaResponse wraps the result of a connector's introspection.
+func schemaResponse(id string, tables []SchemaTable, err error) SchemaResponse {
+	if err != nil {
+		log.Printf("[schema:%s] Error: %v", id, err)
+		return SchemaResponse{ID: id, Type: "schema", Error: err.Error(), ErrorCode: errorCode(err)}
+	}
+	return SchemaResponse{ID: id, Type: "schema", Tables: tables}
+}
+
+func loadTables(q queryer, schema string) ([]SchemaTable, error) {
+	query, args := schemaQuery, []any{}
+	if schema != "" {
+		query, args = strings.Replace(schemaQuery, "ORDER BY", "  AND n.nspname = $1\nORDER BY", 1), []any{schema}
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []SchemaTable
+	for rows.Next() {
+		var schema, name, kind string
+		var col SchemaColumn
+		var def, tableComment, colComment, typeSchema, typeName sql.NullString
+		if err := rows.Scan(&schema, &name, &kind, &col.Name, &col.Type, &col.Nullable, &def, &tableComment, &colComment,
+			&typeSchema, &typeName); err != nil {
+			return nil, err
+		}
+		if def.Valid {
+			col.Default = &def.String
+		}
+		if typeName.Valid {
+			col.UserType = &TypeRef{Schema: typeSchema.String, Name: typeName.String}
+		}
+		col.Comment = colComment.String
+
+		last := len(tables) - 1
+		if last < 0 || tables[last].Schema != schema || tables[last].Name != name {
+			tables = append(tables, SchemaTable{Schema: schema, Name: name, Kind: relKinds[kind], Comment: tableComment.String})
+			last++
+		}
+		tables[last].Columns = append(tables[last].Columns, col)
+	}
+	return tables, rows.Err()
+}
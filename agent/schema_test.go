@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestIntrospectSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		timescale   bool
+		checkResult func(*testing.T, SchemaResponse)
+	}{
+		{
+			name: "plain postgres",
+			checkResult: func(t *testing.T, resp SchemaResponse) {
+				if len(resp.Tables) != 2 {
+					t.Fatalf("expected 2 tables, got %d", len(resp.Tables))
+				}
+				users := resp.Tables[0]
+				if users.Name != "users" || users.Kind != "table" || len(users.Columns) != 3 {
+					t.Errorf("unexpected users table: %+v", users)
+				}
+				if users.Columns[0].Default == nil || *users.Columns[0].Default != "nextval('users_id_seq'::regclass)" {
+					t.Errorf("expected id default, got %v", users.Columns[0].Default)
+				}
+				if !users.Columns[1].Nullable {
+					t.Errorf("expected email to be nullable")
+				}
+				if users.Comment != "People who can sign in" || users.Columns[0].Comment != "" || users.Columns[1].Comment != "Where receipts go" {
+					t.Errorf("unexpected comments: %+v", users)
+				}
+				if resp.Tables[1].Kind != "view" || resp.Tables[1].Hypertable != nil {
+					t.Errorf("unexpected second table: %+v", resp.Tables[1])
+				}
+				if len(resp.ForeignKeys) != 2 {
+					t.Fatalf("expected 2 foreign keys, got %+v", resp.ForeignKeys)
+				}
+				if ref := users.Columns[2].UserType; ref == nil || ref.Name != "user_status" || users.Columns[1].UserType != nil {
+					t.Errorf("expected status to be a user_status, got %+v", users.Columns)
+				}
+				if users.Columns[0].Identity != "always" || users.Columns[1].Identity != "" {
+					t.Errorf("expected id to be an identity column, got %+v", users.Columns)
+				}
+				if len(resp.Sequences) != 1 || resp.Sequences[0].Limit != math.MaxInt32 {
+					t.Errorf("expected users_id_seq limited by its integer column, got %+v", resp.Sequences)
+				}
+				if len(resp.Types) != 3 {
+					t.Fatalf("expected 3 types, got %+v", resp.Types)
+				}
+				composite, domain, enum := resp.Types[0], resp.Types[1], resp.Types[2]
+				if composite.Kind != "composite" || len(composite.Attributes) != 2 || composite.Attributes[1].Type != "character varying(10)" {
+					t.Errorf("unexpected composite: %+v", composite)
+				}
+				if domain.Kind != "domain" || domain.BaseType != "text" || !domain.NotNull || !slices.Equal(domain.Checks, []string{"CHECK ((VALUE ~~ '%@%'::text))"}) {
+					t.Errorf("unexpected domain: %+v", domain)
+				}
+				if enum.Kind != "enum" || !slices.Equal(enum.Labels, []string{"invited", "active", "on hold"}) || enum.Comment == "" {
+					t.Errorf("unexpected enum: %+v", enum)
+				}
+				fk := resp.ForeignKeys[1]
+				if fk.RefSchema != "billing" || !slices.Equal(fk.Columns, []string{"account_id", "region"}) ||
+					!slices.Equal(fk.RefColumns, []string{"id", "region"}) || fk.OnDelete != "cascade" || fk.OnUpdate != "no action" {
+					t.Errorf("unexpected composite key: %+v", fk)
+				}
+			},
+		},
+		{
+			name:      "timescale hypertable",
+			timescale: true,
+			checkResult: func(t *testing.T, resp SchemaResponse) {
+				if resp.Tables[0].Hypertable != nil {
+					t.Errorf("users should not be a hypertable")
+				}
+				h := resp.Tables[1].Hypertable
+				if h == nil {
+					t.Fatalf("expected hypertable metadata on metrics")
+				}
+				if h.TimeColumn != "ts" || h.NumChunks != 12 || h.CompressedChunks != 10 || !h.CompressionEnabled {
+					t.Errorf("unexpected hypertable: %+v", h)
+				}
+				if h.RetainFor == nil || *h.RetainFor != "90 days" || h.CompressAfter == nil || *h.CompressAfter != "7 days" {
+					t.Errorf("unexpected policies: %+v", h)
+				}
+				if h.OldestChunk == nil || *h.OldestChunk != "2025-01-01T00:00:00Z" {
+					t.Errorf("unexpected oldest chunk: %v", h.OldestChunk)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+
+			c := &sqlConnector{db: mockDB, flavor: "postgres"}
+
+			second, kind := "active_users", "v"
+			if tc.timescale {
+				second, kind = "metrics", "r"
+			}
+			mock.ExpectQuery("SELECT n.nspname, c.relname").WillReturnRows(
+				sqlmock.NewRows([]string{"nspname", "relname", "relkind", "attname", "type", "nullable", "default", "table_comment", "column_comment", "type_schema", "type_name"}).
+					AddRow("public", "users", "r", "id", "integer", false, "nextval('users_id_seq'::regclass)", "People who can sign in", nil, nil, nil).
+					AddRow("public", "users", "r", "email", "text", true, nil, "People who can sign in", "Where receipts go", nil, nil).
+					AddRow("public", "users", "r", "status", "user_status", false, nil, "People who can sign in", nil, "public", "user_status").
+					AddRow("public", second, kind, "id", "integer", true, nil, nil, nil, nil, nil))
+			mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tc.timescale))
+			if tc.timescale {
+				start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+				mock.ExpectQuery("FROM timescaledb_information.hypertables").WillReturnRows(
+					sqlmock.NewRows([]string{"schema", "name", "column", "interval", "chunks", "compression", "compressed", "oldest", "newest", "compress_after", "drop_after"}).
+						AddRow("public", "metrics", "ts", "7 days", 12, true, 10, start, start.AddDate(0, 3, 0), "7 days", "90 days"))
+			}
+			mock.ExpectQuery("FROM pg_inherits").WillReturnRows(sqlmock.NewRows(nil))
+
+			mock.ExpectQuery("FROM pg_constraint").WillReturnRows(
+				sqlmock.NewRows([]string{"conname", "nspname", "relname", "columns", "ref_nspname", "ref_relname", "ref_columns", "on_delete", "on_update"}).
+					AddRow("users_manager_fkey", "public", "users", "{manager_id}", "public", "users", "{id}", "n", "a").
+					AddRow("users_account_fkey", "public", "users", "{account_id,region}", "billing", "accounts", "{id,region}", "c", "a"))
+			mock.ExpectQuery("FROM pg_type").WillReturnRows(
+				sqlmock.NewRows([]string{"nspname", "typname", "typtype", "comment", "labels", "base", "not_null", "default", "checks", "attrs", "attr_types"}).
+					AddRow("public", "address", "c", nil, "{}", nil, false, nil, "{}", "{street,zip}", "{text,\"character varying(10)\"}").
+					AddRow("public", "email", "d", nil, "{}", "text", true, nil, "{\"CHECK ((VALUE ~~ '%@%'::text))\"}", "{}", "{}").
+					AddRow("public", "user_status", "e", "Where a user is in signup", "{invited,active,\"on hold\"}", nil, false, nil, "{}", "{}", "{}"))
+			mock.ExpectQuery("FROM pg_sequences").WillReturnRows(
+				sqlmock.NewRows([]string{"schemaname", "sequencename", "data_type", "start", "increment", "min", "max", "cycle", "last_value",
+					"readable", "owner_schema", "owner_table", "owner_column", "owner_type", "identity"}).
+					AddRow("public", "users_id_seq", "bigint", 1, 1, 1, int64(math.MaxInt64), false, 2000000000, true, "public", "users", "id", "integer", "a"))
+
+			resp := c.Schema("s1", "")
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if resp.ID != "s1" || resp.Type != "schema" {
+				t.Errorf("unexpected envelope: %q %q", resp.ID, resp.Type)
+			}
+			tc.checkResult(t, resp)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Scratch databases are copies of a backup, restored next to the
+// database it was taken from for trying out destructive queries. Each is
+// named scratchPrefix plus a random suffix and served as a connection of
+// that name to the tokens serving its source. Its source and expiry are
+// kept in the database's comment, so an agent that restarts finds it
+// again, and drops it when it expires.
+
+const scratchPrefix = "peekdb_scratch_"
+
+// scratchCommentPrefix starts the comment that marks a scratch database.
+const scratchCommentPrefix = "peekdb scratch:"
+
+var (
+	// defaultScratchTTL is how long a scratch database lives unless the
+	// message says, and maxScratchTTL the longest it may ask for.
+	defaultScratchTTL = 24 * time.Hour
+	maxScratchTTL     = 7 * 24 * time.Hour
+	// scratchSweepInterval is how often expired scratch databases are
+	// dropped.
+	scratchSweepInterval = 5 * time.Minute
+
+	pgRestoreCommand = "pg_restore"
+	psqlCommand      = "psql"
+)
+
+// ScratchResponse answers a "restore_scratch" message, and a
+// "drop_scratch" one as "scratch_dropped". Database is the scratch
+// database, and the connection to target for querying it.
+type ScratchResponse struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Database   string    `json:"database,omitempty"`
+	Connection string    `json:"connection,omitempty"`
+	Dump       string    `json:"dump,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	Millis     int64     `json:"millis,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorCode  string    `json:"error_code,omitempty"`
+}
+
+// scratchDB is a scratch database being served.
+type scratchDB struct {
+	conn    *connection
+	source  *connection
+	expires time.Time
+}
+
+// scratchRegistry holds the scratch databases being served, by name, and
+// the tenants to tell when they come and go.
+type scratchRegistry struct {
+	mu      sync.Mutex
+	dbs     map[string]*scratchDB
+	tenants []*tenant
+}
+
+func newScratchRegistry() *scratchRegistry {
+	return &scratchRegistry{dbs: map[string]*scratchDB{}}
+}
+
+// lookup returns the scratch database named target, if t may use it.
+func (r *scratchRegistry) lookup(t *tenant, target string) *scratchDB {
+	if !strings.HasPrefix(target, scratchPrefix) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	db := r.dbs[target]
+	if db == nil || (t != nil && !t.serves(db.source)) {
+		return nil
+	}
+	return db
+}
+
+// servedBy lists the scratch databases t may use, by name.
+func (r *scratchRegistry) servedBy(t *tenant) []*connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var conns []*connection
+	for _, db := range r.dbs {
+		if t.serves(db.source) {
+			conns = append(conns, db.conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Name < conns[j].Name })
+	return conns
+}
+
+func (r *scratchRegistry) has(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dbs[name] != nil
+}
+
+// add starts serving db and tells the tenants.
+func (r *scratchRegistry) add(db *scratchDB) {
+	r.mu.Lock()
+	r.dbs[db.conn.Name] = db
+	tenants := r.tenants
+	r.mu.Unlock()
+	for _, t := range tenants {
+		t.sendStatus()
+	}
+}
+
+// remove stops serving the scratch database name, if it is served, and
+// tells the tenants.
+func (r *scratchRegistry) remove(name string) {
+	r.mu.Lock()
+	db := r.dbs[name]
+	delete(r.dbs, name)
+	tenants := r.tenants
+	r.mu.Unlock()
+	if db == nil {
+		return
+	}
+	db.conn.Close()
+	for _, t := range tenants {
+		t.sendStatus()
+	}
+}
+
+// closeAll stops serving every scratch database, leaving them to expire.
+func (r *scratchRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, db := range r.dbs {
+		db.conn.Close()
+		delete(r.dbs, name)
+	}
+	r.tenants = nil
+}
+
+// restoreScratch answers a "restore_scratch" message: it creates a scratch
+// database on the admin connection msg targets and restores a dump of the
+// configured backup msg.Backup into it, msg.Dump or the newest one. The
+// database is dropped after msg.TTL, or defaultScratchTTL. Every attempt
+// is audited.
+func restoreScratch(msg Message) ScratchResponse {
+	resp := ScratchResponse{ID: msg.ID, Type: "scratch_database"}
+	event := AuditEvent{Action: "restore_scratch", MessageID: msg.ID}
+	defer func() {
+		event.Connection, event.Error = resp.Connection, resp.Error
+		event.Detail = strings.TrimSpace(fmt.Sprintf("backup=%s dump=%s database=%s", msg.Backup, resp.Dump, resp.Database))
+		msg.agent().audit(event)
+	}()
+	fail := func(err error) ScratchResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	switch {
+	case !ok || sc.flavor != "postgres":
+		return fail(codedErrorf(codeNotSupported, "restore_scratch is not supported for %s", c.Flavor()))
+	case strings.HasPrefix(c.Name, scratchPrefix):
+		return fail(codedErrorf(codeInvalidRequest, "%s is a scratch database; target the connection it was restored from", c.Name))
+	case !c.Admin:
+		return fail(codedErrorf(codePolicyDenied, "restore_scratch needs a connection with admin enabled"))
+	case c.ReadOnly || msg.capabilities().ReadOnly:
+		return fail(codedErrorf(codePolicyDenied, "restore_scratch is not allowed on a read-only connection"))
+	}
+	ttl := defaultScratchTTL
+	if msg.TTL != "" {
+		if ttl, err = time.ParseDuration(msg.TTL); err != nil || ttl <= 0 || ttl > maxScratchTTL {
+			return fail(codedErrorf(codeInvalidRequest, "ttl must be a duration such as \"4h\", at most %s", maxScratchTTL))
+		}
+	}
+
+	var j *backupJob
+	if backups := msg.agent().backups; backups != nil {
+		j = backups.jobs[msg.Backup]
+	}
+	if j == nil || (msg.tenant != nil && !msg.tenant.serves(j.conn)) {
+		return fail(codedErrorf(codeInvalidRequest, "no backup %q is configured", msg.Backup))
+	}
+	ctx, done := msg.agent().running.start(msg.context(), msg.ID, msg.tenant, sc)
+	defer done()
+	file, cleanup, err := fetchDump(ctx, j, msg.Dump)
+	if err != nil {
+		return fail(err)
+	}
+	defer cleanup()
+	resp.Dump = filepath.Base(file)
+
+	start := time.Now()
+	name := scratchPrefix + newJobID()
+	expires := start.Add(ttl).UTC().Truncate(time.Second)
+	resp.Database = name
+	comment := fmt.Sprintf("%s source=%s expires=%s dump=%s", scratchCommentPrefix, c.Name, expires.Format(time.RFC3339), resp.Dump)
+	log.Printf("[scratch:%s] Restoring %s into %s", msg.ID, resp.Dump, name)
+	if _, err := sc.db.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(name)); err != nil {
+		return fail(err)
+	}
+	conn, err := func() (*connection, error) {
+		if _, err := sc.db.ExecContext(ctx, "COMMENT ON DATABASE "+pq.QuoteIdentifier(name)+" IS "+pq.QuoteLiteral(comment)); err != nil {
+			return nil, err
+		}
+		dsn, err := scratchDSN(sc.dsn, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := restoreDump(ctx, sc, dsn, file, j.BackupConfig); err != nil {
+			return nil, err
+		}
+		return openScratch(c, name, dsn, expires)
+	}()
+	if err != nil {
+		log.Printf("[scratch:%s] Error: %v", msg.ID, err)
+		if err := dropScratchDatabase(sc, name); err != nil {
+			log.Printf("[scratch:%s] Could not drop %s: %v", msg.ID, name, err)
+		}
+		return fail(err)
+	}
+	msg.agent().scratch.add(&scratchDB{conn: conn, source: c, expires: expires})
+	resp.ExpiresAt, resp.Millis = expires, time.Since(start).Milliseconds()
+	log.Printf("[scratch:%s] Restored %s in %v; it expires at %s", msg.ID, name, time.Since(start).Round(time.Millisecond), expires.Format(time.RFC3339))
+	return resp
+}
+
+// fetchDump finds the dump of j named dump, or its newest one, and
+// returns a local file holding it and the func that removes any copy it
+// made.
+func fetchDump(ctx context.Context, j *backupJob, dump string) (string, func(), error) {
+	name := filepath.Base(dump)
+	valid := strings.HasPrefix(name, j.Name+"-") && strings.HasSuffix(name, j.ext())
+	if !strings.HasPrefix(j.Path, "s3://") {
+		files := backupFiles(j.Path, j.Name, j.ext())
+		if dump == "" && len(files) > 0 {
+			return files[len(files)-1], func() {}, nil
+		}
+		for _, f := range files {
+			if filepath.Base(f) == name {
+				return f, func() {}, nil
+			}
+		}
+		return "", nil, codedErrorf(codeInvalidRequest, "backup %q has no dump %q", j.Name, dump)
+	}
+	if !valid {
+		return "", nil, codedErrorf(codeInvalidRequest, "backup %q is on S3; dump must name one of its files, such as %s-20261017T023000Z%s", j.Name, j.Name, j.ext())
+	}
+	file := filepath.Join(os.TempDir(), "peekdb-"+newJobID()+"-"+name)
+	cmd := exec.CommandContext(ctx, awsCommand, "s3", "cp", "--only-show-errors", strings.TrimSuffix(j.Path, "/")+"/"+name, file)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(file)
+		return "", nil, commandError(awsCommand, err, stderr.String())
+	}
+	return file, func() { os.Remove(file) }, nil
+}
+
+// restoreDump restores file, a dump in b's format, into the database dsn
+// names: a custom dump with pg_restore, plain SQL with psql. Owners and
+// privileges are left out, so the restore needs no roles beyond the
+// agent's own, and the first error stops it.
+func restoreDump(ctx context.Context, sc *sqlConnector, dsn, file string, b BackupConfig) error {
+	conn, password, err := dumpConnString(dsn)
+	if err != nil {
+		return err
+	}
+	if sc.password != nil {
+		if password, err = sc.password(ctx); err != nil {
+			return err
+		}
+	}
+	var cmd *exec.Cmd
+	if b.Format == "plain" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var in io.Reader = f
+		if b.Compression != "none" {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			in = gz
+		}
+		cmd = exec.CommandContext(ctx, psqlCommand, "--dbname="+conn, "--no-password", "--no-psqlrc", "--quiet", "--set=ON_ERROR_STOP=1")
+		cmd.Stdin = in
+	} else {
+		cmd = exec.CommandContext(ctx, pgRestoreCommand, "--dbname="+conn, "--no-password", "--no-owner", "--no-privileges", "--exit-on-error", file)
+	}
+	cmd.Env = os.Environ()
+	if password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+password)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError(filepath.Base(cmd.Path), err, stderr.String())
+	}
+	return nil
+}
+
+// scratchDSN is dsn, a URL or key=value pairs, with its database changed
+// to name.
+func scratchDSN(dsn, name string) (string, error) {
+	if urlScheme(dsn) != "" {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		u.Path, u.RawPath = "/"+name, ""
+		return u.String(), nil
+	}
+	parts := []string{"dbname=" + name}
+	for _, kv := range splitConnInfo(dsn) {
+		if !strings.HasPrefix(kv, "dbname=") {
+			parts = append(parts, kv)
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// openScratch connects to source's scratch database name, which dsn
+// reaches, serving it as a writable connection of that name.
+func openScratch(source *connection, name, dsn string, expires time.Time) (*connection, error) {
+	sc := source.Connector.(*sqlConnector)
+	c, err := openSQL(sc.driver, dsn, "postgres", sc.password, sc.family)
+	if err != nil {
+		return nil, err
+	}
+	c.agent = sc.agent
+	return &connection{
+		Name:      name,
+		Labels:    map[string]string{"scratch_of": source.Name, "expires_at": expires.Format(time.RFC3339)},
+		Connector: c,
+	}, nil
+}
+
+// dropScratchDatabase stops serving the scratch database name and drops
+// it, ending the sessions still using it.
+func dropScratchDatabase(sc *sqlConnector, name string) error {
+	sc.owner().scratch.remove(name)
+	ctx := context.Background()
+	if _, err := sc.db.ExecContext(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()", name); err != nil {
+		return err
+	}
+	_, err := sc.db.ExecContext(ctx, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(name))
+	return err
+}
+
+// dropScratch answers a "drop_scratch" message by dropping the scratch
+// database msg.Target names before it expires. It is audited.
+func dropScratch(msg Message) ScratchResponse {
+	resp := ScratchResponse{ID: msg.ID, Type: "scratch_dropped", Database: msg.Target}
+	event := AuditEvent{Action: "drop_scratch", MessageID: msg.ID, Detail: msg.Target}
+	defer func() {
+		event.Connection, event.Error = resp.Connection, resp.Error
+		msg.agent().audit(event)
+	}()
+	db := msg.agent().scratch.lookup(msg.tenant, msg.Target)
+	if db == nil {
+		err := codedErrorf(codeInvalidRequest, "no scratch database %q", msg.Target)
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+	resp.Connection = db.source.Name
+	if err := dropScratchDatabase(db.source.Connector.(*sqlConnector), msg.Target); err != nil {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+	}
+	return resp
+}
+
+// parseScratchComment reads a scratch database's comment, returning its
+// source connection and expiry; ok is false for other comments.
+func parseScratchComment(comment string) (source string, expires time.Time, ok bool) {
+	rest, ok := strings.CutPrefix(comment, scratchCommentPrefix)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	for _, kv := range strings.Fields(rest) {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "source":
+			source = v
+		case "expires":
+			expires, _ = time.Parse(time.RFC3339, v)
+		}
+	}
+	return source, expires, source != "" && !expires.IsZero()
+}
+
+// startScratchSweeper serves the scratch databases of a's connections that
+// are still live and drops those that expired, now and every
+// scratchSweepInterval until ctx is cancelled.
+func (a *Agent) startScratchSweeper(ctx context.Context, tenants []*tenant) {
+	a.scratch.mu.Lock()
+	a.scratch.tenants = tenants
+	a.scratch.mu.Unlock()
+	for _, c := range a.connections {
+		if sc, ok := c.Connector.(*sqlConnector); ok && sc.flavor == "postgres" && c.Admin {
+			go a.sweepScratch(ctx, c)
+		}
+	}
+}
+
+func (a *Agent) sweepScratch(ctx context.Context, c *connection) {
+	defer a.reporter.reportPanic()
+	tick := time.NewTicker(scratchSweepInterval)
+	defer tick.Stop()
+	for {
+		sc := c.Connector.(*sqlConnector)
+		if a.standby.active() && (sc.elector == nil || sc.elector.isLeader()) {
+			if err := sweepScratchOnce(ctx, c, time.Now()); err != nil && ctx.Err() == nil {
+				log.Printf("[scratch] Could not check the scratch databases of %q: %v", c.Name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// sweepScratchOnce drops c's scratch databases that expired by now and
+// serves the others.
+func sweepScratchOnce(ctx context.Context, c *connection, now time.Time) error {
+	sc := c.Connector.(*sqlConnector)
+	rows, err := sc.db.QueryContext(ctx, `SELECT datname, coalesce(shobj_description(oid, 'pg_database'), '')
+FROM pg_database WHERE datname LIKE $1`, strings.ReplaceAll(scratchPrefix, "_", `\_`)+"%")
+	if err != nil {
+		return err
+	}
+	type found struct {
+		name    string
+		expires time.Time
+	}
+	var dbs []found
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			rows.Close()
+			return err
+		}
+		if source, expires, ok := parseScratchComment(comment); ok && source == c.Name {
+			dbs = append(dbs, found{name, expires})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, db := range dbs {
+		if !now.Before(db.expires) {
+			log.Printf("[scratch] Dropping %s, which expired at %s", db.name, db.expires.Format(time.RFC3339))
+			err := dropScratchDatabase(sc, db.name)
+			sc.owner().audit(AuditEvent{Action: "drop_scratch", Connection: c.Name, Detail: db.name + " (expired)", Error: errorString(err)})
+			if err != nil {
+				log.Printf("[scratch] Could not drop %s: %v", db.name, err)
+			}
+			continue
+		}
+		if sc.owner().scratch.has(db.name) {
+			continue
+		}
+		dsn, err := scratchDSN(sc.dsn, db.name)
+		if err != nil {
+			return err
+		}
+		conn, err := openScratch(c, db.name, dsn, db.expires)
+		if err != nil {
+			log.Printf("[scratch] Could not connect to %s: %v", db.name, err)
+			continue
+		}
+		sc.owner().scratch.add(&scratchDB{conn: conn, source: c, expires: db.expires})
+	}
+	return nil
+}
+
+// errorString is err's message, or "" for nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
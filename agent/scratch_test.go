@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeRestore makes pgRestoreCommand a script that writes its arguments
+// and PGPASSWORD to out, and exits with code.
+func fakeRestore(t *testing.T, code string) (out string) {
+	t.Helper()
+	dir := t.TempDir()
+	out = filepath.Join(dir, "args")
+	script := filepath.Join(dir, "pg_restore")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$@ password=$PGPASSWORD\" > "+out+"\necho 'pg_restore: error: could not execute query' >&2\nexit "+code+"\n"), 0o755)
+	was := pgRestoreCommand
+	pgRestoreCommand = script
+	t.Cleanup(func() { pgRestoreCommand = was })
+	return out
+}
+
+func TestScratchDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"postgres://peek:s3cret@db:5432/app?sslmode=require", "postgres://peek:s3cret@db:5432/peekdb_scratch_x?sslmode=require"},
+		{"postgres://db", "postgres://db/peekdb_scratch_x"},
+		{"host=db dbname=app user=peek", "dbname=peekdb_scratch_x host=db user=peek"},
+	}
+	for _, tc := range tests {
+		if got, err := scratchDSN(tc.dsn, "peekdb_scratch_x"); err != nil || got != tc.want {
+			t.Errorf("scratchDSN(%q) = %q, %v, want %q", tc.dsn, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseScratchComment(t *testing.T) {
+	expires := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		comment string
+		source  string
+		ok      bool
+	}{
+		{"peekdb scratch: source=main expires=2026-10-18T09:00:00Z dump=nightly-20261017T023000Z.dump", "main", true},
+		{"peekdb scratch: source=main", "", false},
+		{"copy of main", "", false},
+	}
+	for _, tc := range tests {
+		source, got, ok := parseScratchComment(tc.comment)
+		if ok != tc.ok || ok && (source != tc.source || !got.Equal(expires)) {
+			t.Errorf("parseScratchComment(%q) = %q, %v, %v", tc.comment, source, got, ok)
+		}
+	}
+}
+
+func TestRestoreScratch(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "nightly-20261016T023000Z.dump"), nil, 0o600)
+	os.WriteFile(filepath.Join(dir, "nightly-20261017T023000Z.dump"), nil, 0o600)
+	sc := &sqlConnector{db: mockDB, flavor: "postgres", dsn: "postgres://peek:s3cret@db/app"}
+	main := &connection{Name: "main", Admin: true, Connector: sc}
+	plain := &connection{Name: "plain", Connector: sc}
+	tn := testTenant(main, plain)
+	sc.agent = tn.agent
+	tn.agent.backups = &backupScheduler{agent: tn.agent, jobs: map[string]*backupJob{
+		"nightly": {BackupConfig: BackupConfig{Name: "nightly", Connection: "main", Path: dir}, conn: main, sc: sc},
+	}}
+
+	tests := []struct {
+		msg  Message
+		code string
+	}{
+		{Message{ID: "s1", Target: "plain", Backup: "nightly", tenant: tn}, codePolicyDenied},
+		{Message{ID: "s2", Backup: "weekly", tenant: tn}, codeInvalidRequest},
+		{Message{ID: "s3", Backup: "nightly", TTL: "30d", tenant: tn}, codeInvalidRequest},
+		{Message{ID: "s4", Backup: "nightly", Dump: "nightly-20261001T023000Z.dump", tenant: tn}, codeInvalidRequest},
+	}
+	for _, tc := range tests {
+		if resp := restoreScratch(tc.msg); resp.ErrorCode != tc.code {
+			t.Errorf("%s: expected %s, got %+v", tc.msg.ID, tc.code, resp)
+		}
+	}
+
+	// A failed restore drops the database it created.
+	out := fakeRestore(t, "1")
+	mock.ExpectExec(`CREATE DATABASE "peekdb_scratch_[0-9a-f]{16}"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`COMMENT ON DATABASE "peekdb_scratch_[0-9a-f]{16}" IS 'peekdb scratch: source=main expires=\S+ dump=nightly-20261017T023000Z.dump'`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP DATABASE IF EXISTS "peekdb_scratch_[0-9a-f]{16}"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	resp := restoreScratch(Message{ID: "s5", Backup: "nightly", TTL: "2h", tenant: tn})
+	if !strings.HasSuffix(resp.Error, "pg_restore: error: could not execute query") || resp.Dump != "nightly-20261017T023000Z.dump" {
+		t.Errorf("unexpected failed restore: %+v", resp)
+	}
+	args, _ := os.ReadFile(out)
+	if !strings.HasPrefix(string(args), "--dbname=postgres://peek@db/"+resp.Database+" --no-password --no-owner") || !strings.HasSuffix(strings.TrimSpace(string(args)), "password=s3cret") {
+		t.Errorf("unexpected pg_restore call: %s", args)
+	}
+	if tn.agent.scratch.has(resp.Database) {
+		t.Errorf("expected %s not to be served", resp.Database)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestScratchRouting(t *testing.T) {
+	main := &connection{Name: "main", Connector: &sqlConnector{flavor: "postgres"}}
+	other := &connection{Name: "other", Connector: &sqlConnector{flavor: "postgres"}}
+	db := &connection{Name: "peekdb_scratch_0123456789abcdef", Connector: &sqlConnector{flavor: "postgres"}}
+	a := testAgent(main, other)
+	a.scratch.add(&scratchDB{conn: db, source: main})
+
+	if c, err := (Message{Target: db.Name, tenant: &tenant{agent: a, conns: []*connection{main}}}).route(); err != nil || c != db {
+		t.Errorf("expected the scratch database of a served connection to route, got %v, %v", c, err)
+	}
+	if c, err := (Message{Target: db.Name, tenant: &tenant{agent: a, conns: []*connection{other}}}).route(); err == nil {
+		t.Errorf("expected another token's scratch database not to route, got %v", c)
+	}
+	if resp := dropScratch(Message{ID: "d1", Target: db.Name, tenant: &tenant{agent: a, conns: []*connection{other}}}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s dropping another token's scratch database, got %+v", codeInvalidRequest, resp)
+	}
+}
+
+func TestSweepScratch(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	c := &connection{Name: "main", Admin: true, Connector: &sqlConnector{db: mockDB, flavor: "postgres", dsn: "postgres://db/app"}}
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT datname, coalesce\\(shobj_description").WithArgs(`peekdb\_scratch\_%`).WillReturnRows(sqlmock.NewRows([]string{"datname", "comment"}).
+		AddRow("peekdb_scratch_aaaaaaaaaaaaaaaa", "peekdb scratch: source=main expires=2026-10-17T11:00:00Z dump=x.dump").
+		AddRow("peekdb_scratch_bbbbbbbbbbbbbbbb", "peekdb scratch: source=other expires=2026-10-17T11:00:00Z dump=x.dump").
+		AddRow("peekdb_scratch_cccccccccccccccc", ""))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_terminate_backend(pid)")).WithArgs("peekdb_scratch_aaaaaaaaaaaaaaaa").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP DATABASE IF EXISTS "peekdb_scratch_aaaaaaaaaaaaaaaa"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := sweepScratchOnce(context.Background(), c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ScrubConfig says which query parameters and values must never reach a
+// log. It is the "scrub" object of the config file.
+type ScrubConfig struct {
+	// Params are 1-based parameter positions to redact in every query.
+	Params []int `json:"params,omitempty"`
+	// Columns are regular expressions over column names; a parameter
+	// compared with, or inserted into, a matching column is redacted.
+	Columns []string `json:"columns,omitempty"`
+	// Values are regular expressions redacted wherever they match: in
+	// parameters, and in every log line, error messages included.
+	Values []string `json:"values,omitempty"`
+}
+
+const redacted = "[REDACTED]"
+
+type scrubber struct {
+	params  map[int]bool
+	columns []*regexp.Regexp
+	values  []*regexp.Regexp
+}
+
+func newScrubber(cfg *ScrubConfig) (*scrubber, error) {
+	s := &scrubber{params: map[int]bool{}}
+	if cfg == nil {
+		return s, nil
+	}
+	for _, p := range cfg.Params {
+		s.params[p] = true
+	}
+	for _, expr := range cfg.Columns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("scrub column pattern %q: %w", expr, err)
+		}
+		s.columns = append(s.columns, re)
+	}
+	for _, expr := range cfg.Values {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("scrub value pattern %q: %w", expr, err)
+		}
+		s.values = append(s.values, re)
+	}
+	return s, nil
+}
+
+// text redacts value patterns in s.
+func (s *scrubber) text(str string) string {
+	if s == nil {
+		return str
+	}
+	for _, re := range s.values {
+		str = re.ReplaceAllString(str, redacted)
+	}
+	return str
+}
+
+// queryParams returns params fit for a log: all redacted for a sensitive
+// query, otherwise those at a configured position, bound to a matching
+// column or matching a value pattern.
+func (s *scrubber) queryParams(q string, params []any, sensitive bool) []any {
+	out := make([]any, len(params))
+	var columns map[int]string
+	if s != nil && len(s.columns) > 0 {
+		columns = paramColumns(q)
+	}
+	for i, p := range params {
+		out[i] = p
+		switch {
+		case sensitive:
+			out[i] = redacted
+		case s == nil:
+		case s.params[i+1]:
+			out[i] = redacted
+		case s.matchesColumn(columns[i+1]):
+			out[i] = redacted
+		default:
+			if str := fmt.Sprint(p); s.text(str) != str {
+				out[i] = redacted
+			}
+		}
+	}
+	return out
+}
+
+func (s *scrubber) matchesColumn(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, re := range s.columns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	paramRef        = `[$:](\d+)`
+	columnRef       = `([\w$]+|"[^"]+")`
+	comparison      = `\s*(?:=|<>|!=|<=|>=|<|>|(?i:\s(?:NOT\s+)?I?LIKE\s))\s*`
+	columnThenParam = regexp.MustCompile(columnRef + comparison + paramRef)
+	paramThenColumn = regexp.MustCompile(paramRef + comparison + `(?:[\w$]+\.)*` + columnRef)
+	columnInList    = regexp.MustCompile(`(?i)` + columnRef + `\s+(?:NOT\s+)?IN\s*\(([^()]*)\)`)
+	insertColumns   = regexp.MustCompile(`(?is)INSERT\s+INTO\s+[\w$."]+\s*\(([^()]*)\)\s*VALUES\s*\(([^()]*)\)`)
+	paramRefs       = regexp.MustCompile(paramRef)
+)
+
+// paramColumns maps parameter positions to the column each is compared
+// with or inserted into, as far as simple patterns can tell.
+func paramColumns(q string) map[int]string {
+	cols := map[int]string{}
+	set := func(param, column string) {
+		if n, err := strconv.Atoi(param); err == nil {
+			cols[n] = strings.Trim(column, `"`)
+		}
+	}
+	for _, m := range columnThenParam.FindAllStringSubmatch(q, -1) {
+		set(m[2], m[1])
+	}
+	for _, m := range paramThenColumn.FindAllStringSubmatch(q, -1) {
+		set(m[1], m[2])
+	}
+	for _, m := range columnInList.FindAllStringSubmatch(q, -1) {
+		for _, p := range paramRefs.FindAllStringSubmatch(m[2], -1) {
+			set(p[1], m[1])
+		}
+	}
+	for _, m := range insertColumns.FindAllStringSubmatch(q, -1) {
+		names := strings.Split(m[1], ",")
+		for i, v := range strings.Split(m[2], ",") {
+			if p := paramRefs.FindStringSubmatch(v); p != nil && i < len(names) {
+				set(p[1], strings.TrimSpace(names[i]))
+			}
+		}
+	}
+	return cols
+}
+
+// scrubWriter redacts the value patterns scrub returns from everything
+// written through it; the agent's log goes through one.
+type scrubWriter struct {
+	w     io.Writer
+	scrub func() *scrubber
+}
+
+func (sw scrubWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(sw.w, sw.scrub().text(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestScrubQueryParams(t *testing.T) {
+	s, err := newScrubber(&ScrubConfig{
+		Params:  []int{3},
+		Columns: []string{`(?i)^(ssn|card_number)$`},
+		Values:  []string{`\b\d{4}-\d{4}-\d{4}-\d{4}\b`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		sql       string
+		params    []any
+		sensitive bool
+		expected  []any
+	}{
+		{
+			name:     "by position",
+			sql:      "SELECT * FROM t WHERE a = $1 AND b = $2 AND c = $3",
+			params:   []any{1, "x", "secret"},
+			expected: []any{1, "x", redacted},
+		},
+		{
+			name:     "by column",
+			sql:      `SELECT * FROM people p WHERE p."SSN" = $1 OR $2 = p.card_number OR name LIKE $4`,
+			params:   []any{"123-45-6789", "4111", nil, "Ann%"},
+			expected: []any{redacted, redacted, redacted, "Ann%"},
+		},
+		{
+			name:     "in list and insert",
+			sql:      "INSERT INTO cards (owner, card_number) VALUES ($1, $2); SELECT 1 WHERE ssn IN ($3, $4)",
+			params:   []any{"ann", "4111", "a", "b"},
+			expected: []any{"ann", redacted, redacted, redacted},
+		},
+		{
+			name:     "by value",
+			sql:      "SELECT * FROM t WHERE note = $1 AND n = $2",
+			params:   []any{"paid with 4111-1111-1111-1111", 7},
+			expected: []any{redacted, 7},
+		},
+		{
+			name:      "sensitive query",
+			sql:       "SELECT * FROM t WHERE a = $1",
+			params:    []any{1},
+			sensitive: true,
+			expected:  []any{redacted},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := s.queryParams(tc.sql, tc.params, tc.sensitive)
+			if len(got) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+			for i := range got {
+				if got[i] != tc.expected[i] {
+					t.Errorf("param %d: expected %v, got %v", i+1, tc.expected[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScrubWriter(t *testing.T) {
+	s, err := newScrubber(&ScrubConfig{Values: []string{`\b\d{16}\b`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(scrubWriter{&buf, func() *scrubber { return s }})
+	defer log.SetOutput(os.Stderr)
+
+	log.Printf(`[query:q1] Error: invalid input syntax for type integer: "4111111111111111"`)
+	if bytes.Contains(buf.Bytes(), []byte("4111111111111111")) {
+		t.Errorf("expected the card number to be redacted, got %q", buf.String())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(redacted)) {
+		t.Errorf("expected %s in %q", redacted, buf.String())
+	}
+}
+
+func TestNewScrubberInvalidPattern(t *testing.T) {
+	if _, err := newScrubber(&ScrubConfig{Columns: []string{"("}}); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
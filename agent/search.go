@@ -0,0 +1,307 @@
+package agent
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// schemaCacheTTL is how long search_schema answers from a connection's
+// last introspection before running it again. A "schema" message for the
+// whole connection refreshes it too.
+const schemaCacheTTL = 5 * time.Minute
+
+// Results a search_schema message returns without a limit, and at most.
+const (
+	defaultSearchResults = 50
+	maxSearchResults     = 500
+)
+
+type cachedSchema struct {
+	resp SchemaResponse
+	at   time.Time
+}
+
+// schemaCache holds each connector's last full introspection, unfiltered.
+type schemaCache struct {
+	sync.Mutex
+	m map[Connector]cachedSchema
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{m: map[Connector]cachedSchema{}}
+}
+
+// put keeps resp, an introspection of every schema on c, for
+// search_schema. Entries past their TTL, such as those of connectors a
+// config update replaced, are dropped.
+func (s *schemaCache) put(c Connector, resp SchemaResponse) {
+	if resp.Error != "" {
+		return
+	}
+	resp = resp.clone()
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for k, e := range s.m {
+		if now.Sub(e.at) > schemaCacheTTL {
+			delete(s.m, k)
+		}
+	}
+	s.m[c] = cachedSchema{resp: resp, at: now}
+}
+
+// forget drops c's cached introspection, after a change to the schema the
+// agent made itself.
+func (s *schemaCache) forget(c Connector) {
+	s.Lock()
+	delete(s.m, c)
+	s.Unlock()
+}
+
+// clone copies r's lists, so filtering one copy leaves the other whole.
+func (r SchemaResponse) clone() SchemaResponse {
+	r.Tables, r.ForeignKeys = slices.Clone(r.Tables), slices.Clone(r.ForeignKeys)
+	r.Types, r.Sequences = slices.Clone(r.Types), slices.Clone(r.Sequences)
+	return r
+}
+
+// get returns c's cached introspection, running it when there is none or
+// it is too old. The result is a copy the caller may filter.
+func (s *schemaCache) get(c *connection, id string) (SchemaResponse, time.Time) {
+	s.Lock()
+	e, ok := s.m[c.Connector]
+	s.Unlock()
+	if !ok || time.Since(e.at) > schemaCacheTTL {
+		resp := c.Schema(id, "")
+		s.put(c.Connector, resp)
+		return resp, time.Now()
+	}
+	return e.resp.clone(), e.at
+}
+
+// SchemaSearchResponse answers a "search_schema" message with the tables
+// and columns whose names or comments best match msg.Search, best first.
+type SchemaSearchResponse struct {
+	ID      string        `json:"id"`
+	Type    string        `json:"type"`
+	Results []SchemaMatch `json:"results"`
+	// Total counts every match, of which Results are the best.
+	Total int    `json:"total"`
+	Error string `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+	// SchemaAt is when the schema searched was read from the database.
+	SchemaAt *time.Time `json:"schema_at,omitempty"`
+}
+
+// SchemaMatch is a table or column that matched a search. Positions are
+// the indexes, in runes, of the matched characters in the name matched:
+// Column for a column, Table otherwise, or Comment when In is "comment".
+type SchemaMatch struct {
+	Kind      string `json:"kind"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	Column    string `json:"column,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	In        string `json:"in,omitempty"`
+	Score     int    `json:"score"`
+	Positions []int  `json:"positions"`
+}
+
+// commentScore is what a search found in a comment scores: less than any
+// match of a name, and more at the start of a word.
+const commentScore = 100
+
+// searchSchema answers a "search_schema" message. The search matches
+// names fuzzily, so "ordit" finds order_items; with a dot, the part before
+// it must match the table's schema or the column's table, as in
+// "sales.ord" or "orders.cust". Without one, tables and columns whose
+// comments contain the search match too, below any name. Only schemas
+// the token may see are searched.
+func searchSchema(msg Message) SchemaSearchResponse {
+	resp := SchemaSearchResponse{ID: msg.ID, Type: "schema_search"}
+	fail := func(err error) SchemaSearchResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	search := strings.TrimSpace(msg.Search)
+	if search == "" {
+		return fail(codedErrorf(codeInvalidRequest, "search_schema needs a search"))
+	}
+	limit := msg.Limit
+	if limit == 0 {
+		limit = defaultSearchResults
+	}
+	if limit < 0 || limit > maxSearchResults {
+		return fail(codedErrorf(codeInvalidRequest, "limit must be between 1 and %d, got %d", maxSearchResults, msg.Limit))
+	}
+
+	schema, at := msg.agent().schemas.get(c, msg.ID)
+	if schema.Error != "" {
+		resp.Error, resp.ErrorCode = schema.Error, schema.ErrorCode
+		return resp
+	}
+	resp.SchemaAt = &at
+	msg.capabilities().filterSchema(&schema)
+
+	start := time.Now()
+	resp.Results = matchSchema(schema.Tables, search)
+	resp.Total = len(resp.Results)
+	if len(resp.Results) > limit {
+		resp.Results = resp.Results[:limit]
+	}
+	log.Printf("[search:%s] %d matches in %v", msg.ID, resp.Total, time.Since(start))
+	return resp
+}
+
+// matchSchema returns every table and column of tables matching search,
+// best first. Among equal scores tables come before columns, and shorter
+// names first.
+func matchSchema(tables []SchemaTable, search string) []SchemaMatch {
+	parent, name := "", search
+	if i := strings.LastIndexByte(search, '.'); i >= 0 {
+		parent, name = search[:i], search[i+1:]
+	}
+	// matchBoth scores n, and p against the parent when the search has
+	// one. A search ending in a dot lists everything under the parent.
+	matchBoth := func(p, n string) (int, []int, bool) {
+		score, positions, ok := 0, []int{}, true
+		if name != "" {
+			score, positions, ok = fuzzyMatch(name, n)
+		}
+		if ok && parent != "" {
+			var ps int
+			ps, _, ok = fuzzyMatch(parent, p)
+			score += ps
+		}
+		return score, positions, ok
+	}
+
+	// match fills in m's score from its name, or failing that, for a
+	// search without a dot, from comment.
+	match := func(m SchemaMatch, p, n, comment string) (SchemaMatch, bool) {
+		var ok bool
+		if m.Score, m.Positions, ok = matchBoth(p, n); ok || parent != "" {
+			return m, ok
+		}
+		c, s := []rune(strings.ToLower(comment)), []rune(strings.ToLower(search))
+		i := runeIndex(c, s)
+		if i < 0 {
+			return m, false
+		}
+		m.In, m.Score, m.Positions = "comment", commentScore/2, make([]int, len(s))
+		if wordStart([]rune(comment), i) {
+			m.Score = commentScore
+		}
+		for j := range m.Positions {
+			m.Positions[j] = i + j
+		}
+		return m, true
+	}
+
+	results := []SchemaMatch{}
+	for _, t := range tables {
+		m := SchemaMatch{Kind: t.Kind, Schema: t.Schema, Table: t.Name, Comment: t.Comment}
+		if m, ok := match(m, t.Schema, t.Name, t.Comment); ok {
+			results = append(results, m)
+		}
+		for _, col := range t.Columns {
+			m := SchemaMatch{Kind: "column", Schema: t.Schema, Table: t.Name, Column: col.Name, Type: col.Type, Comment: col.Comment}
+			if m, ok := match(m, t.Name, col.Name, col.Comment); ok {
+				results = append(results, m)
+			}
+		}
+	}
+	slices.SortStableFunc(results, func(a, b SchemaMatch) int {
+		if a.Score != b.Score {
+			return b.Score - a.Score
+		}
+		if (a.Column == "") != (b.Column == "") {
+			if a.Column == "" {
+				return -1
+			}
+			return 1
+		}
+		return len(a.Column+a.Table) - len(b.Column+b.Table)
+	})
+	return results
+}
+
+// fuzzyMatch reports whether every character of pattern appears in name,
+// in order and ignoring case, with a score that ranks an exact name over
+// a prefix, a prefix over a substring, and a substring over scattered
+// characters, which score more the more of them start words.
+func fuzzyMatch(pattern, name string) (int, []int, bool) {
+	p, n := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(name))
+	if len(p) > len(n) {
+		return 0, nil, false
+	}
+	if i := runeIndex(n, p); i >= 0 {
+		positions := make([]int, len(p))
+		for j := range positions {
+			positions[j] = i + j
+		}
+		switch {
+		case len(p) == len(n):
+			return 1000, positions, true
+		case i == 0:
+			return 800, positions, true
+		case wordStart([]rune(name), i):
+			return 700, positions, true
+		}
+		return 600, positions, true
+	}
+
+	orig := []rune(name)
+	positions := make([]int, 0, len(p))
+	score, j := 300, 0
+	for i := 0; i < len(n) && j < len(p); i++ {
+		if n[i] != p[j] {
+			continue
+		}
+		switch {
+		case wordStart(orig, i):
+			score += 20
+		case len(positions) > 0 && positions[len(positions)-1] == i-1:
+			score += 10
+		case len(positions) > 0:
+			score -= min(i-positions[len(positions)-1]-1, 10)
+		}
+		positions = append(positions, i)
+		j++
+	}
+	if j < len(p) {
+		return 0, nil, false
+	}
+	return max(min(score, 599), commentScore+1), positions, true
+}
+
+// wordStart reports whether name[i] begins a word: the first character,
+// one after a separator, or a capital after a lower-case letter.
+func wordStart(name []rune, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := name[i-1]
+	return strings.ContainsRune("_-. $", prev) || unicode.IsUpper(name[i]) && unicode.IsLower(prev)
+}
+
+func runeIndex(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if slices.Equal(s[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
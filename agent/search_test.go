@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		name      string
+		ok        bool
+		positions []int
+	}{
+		{"orders", "Orders", true, []int{0, 1, 2, 3, 4, 5}},
+		{"ord", "order_items", true, []int{0, 1, 2}},
+		{"items", "order_items", true, []int{6, 7, 8, 9, 10}},
+		{"ordit", "order_items", true, []int{0, 1, 2, 6, 7}},
+		{"oi", "orderItems", true, []int{0, 5}},
+		{"io", "order_items", false, nil},
+		{"orders_x", "orders", false, nil},
+	}
+	for _, tc := range tests {
+		_, positions, ok := fuzzyMatch(tc.pattern, tc.name)
+		if ok != tc.ok || !slices.Equal(positions, tc.positions) {
+			t.Errorf("fuzzyMatch(%q, %q) = %v %v, want %v %v", tc.pattern, tc.name, positions, ok, tc.positions, tc.ok)
+		}
+	}
+
+	// Exact beats prefix beats word beats substring beats scattered.
+	last := 0
+	for i, name := range []string{"order", "orders", "open_orders", "reorders", "o_r_d_e_r"} {
+		score, _, _ := fuzzyMatch("order", name)
+		if i > 0 && score >= last {
+			t.Errorf("expected %q to score under %d, got %d", name, last, score)
+		}
+		last = score
+	}
+}
+
+func TestSearchSchema(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	pg := &sqlConnector{db: mockDB, flavor: "postgres"}
+	tn := testTenant(&connection{Name: "main", Connector: pg})
+	tn.setCapabilities(&Capabilities{AllowedSchemas: []string{"public", "sales"}})
+
+	// The schema is read once, then searched from the cache.
+	mock.ExpectQuery("SELECT n.nspname, c.relname").WillReturnRows(
+		sqlmock.NewRows([]string{"nspname", "relname", "relkind", "attname", "type", "nullable", "default", "table_comment", "column_comment", "type_schema", "type_name"}).
+			AddRow("hr", "orders", "r", "id", "integer", false, nil, nil, nil, nil, nil).
+			AddRow("public", "customers", "r", "id", "integer", false, nil, "Buyers, synced from the CRM", nil, nil, nil).
+			AddRow("public", "customers", "r", "last_order_at", "timestamp", true, nil, "Buyers, synced from the CRM", nil, nil, nil).
+			AddRow("public", "order_items", "r", "order_id", "integer", false, nil, nil, nil, nil, nil).
+			AddRow("sales", "orders", "r", "customer_id", "integer", false, nil, nil, nil, nil, nil))
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("FROM pg_inherits").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("FROM pg_constraint").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("FROM pg_type").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("FROM pg_sequences").WillReturnRows(sqlmock.NewRows(nil))
+
+	tests := []struct {
+		search string
+		limit  int
+		want   []string
+		total  int
+	}{
+		{"orders", 0, []string{"sales.orders", "public.order_items"}, 2},
+		{"ord", 0, []string{"sales.orders", "public.order_items", "public.order_items.order_id",
+			"public.customers.last_order_at", "sales.orders.customer_id"}, 5},
+		{"ordit", 0, []string{"public.order_items"}, 1},
+		{"orders.cust", 0, []string{"sales.orders.customer_id"}, 1},
+		{"sales.", 0, []string{"sales.orders"}, 1},
+		{"ord", 2, []string{"sales.orders", "public.order_items"}, 5},
+		{"crm", 0, []string{"public.customers"}, 1},
+	}
+	for _, tc := range tests {
+		resp := searchSchema(Message{ID: "s1", Search: tc.search, Limit: tc.limit, tenant: tn})
+		if resp.Error != "" {
+			t.Fatalf("%q: unexpected error: %s", tc.search, resp.Error)
+		}
+		var got []string
+		for _, m := range resp.Results {
+			name := m.Schema + "." + m.Table
+			if m.Column != "" {
+				name += "." + m.Column
+			}
+			got = append(got, name)
+		}
+		if !slices.Equal(got, tc.want) || resp.Total != tc.total {
+			t.Errorf("%q: expected %q of %d, got %q of %d", tc.search, tc.want, tc.total, got, resp.Total)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	if resp := searchSchema(Message{ID: "s2", Search: " ", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected %s for an empty search, got %+v", codeInvalidRequest, resp)
+	}
+}
@@ -0,0 +1,340 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The secrets store keeps DSNs and tokens encrypted at rest, so they need
+// not sit in plaintext in unit files, config files or shell history:
+//
+//	peekdb-agent secrets set db-url        (reads the value from stdin)
+//	peekdb-agent --db secret:db-url --token secret:token
+//	{"url": "${secret:orders-url}"}        (in the --config file)
+//
+// Each value is sealed with AES-256-GCM under a random key that lives in its
+// own file, so the store can be backed up or copied without the key, and
+// the key can come from somewhere else entirely, such as a systemd
+// credential. The store is PEEKDB_SECRETS, by default secrets.json in the
+// user's config directory, and the key PEEKDB_SECRETS_KEY_FILE, by default
+// the store's path with .key appended.
+
+// secretStore is the secrets file.
+type secretStore struct {
+	path, keyPath string
+	// Secrets maps names to base64 nonce and ciphertext.
+	Secrets map[string]string `json:"secrets"`
+}
+
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// defaultSecretsPaths returns the store and key the agent reads.
+func defaultSecretsPaths() (path, keyPath string) {
+	path = os.Getenv("PEEKDB_SECRETS")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			dir = "."
+		}
+		path = filepath.Join(dir, "peekdb", "secrets.json")
+	}
+	keyPath = os.Getenv("PEEKDB_SECRETS_KEY_FILE")
+	if keyPath == "" {
+		keyPath = path + ".key"
+	}
+	return path, keyPath
+}
+
+// openSecrets reads the store at path; a missing store is empty.
+func openSecrets(path, keyPath string) (*secretStore, error) {
+	s := &secretStore{path: path, keyPath: keyPath, Secrets: map[string]string{}}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, s); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if s.Secrets == nil {
+		s.Secrets = map[string]string{}
+	}
+	return s, nil
+}
+
+// aead returns the cipher under the store's key, creating the key if
+// create is set and there is none.
+func (s *secretStore) aead(create bool) (cipher.AEAD, error) {
+	key, err := os.ReadFile(s.keyPath)
+	if errors.Is(err, os.ErrNotExist) && create {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(s.keyPath), 0o700); err != nil {
+			return nil, err
+		}
+		// O_EXCL: never replace a key, which would lose every secret.
+		f, err := os.OpenFile(s.keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(key); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("secrets key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secrets key %s must be 32 bytes, not %d", s.keyPath, len(key))
+	}
+	if fi, err := os.Stat(s.keyPath); err == nil && fi.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("secrets key %s is readable by other users; chmod 600 it", s.keyPath)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// get decrypts the secret called name.
+func (s *secretStore) get(name string) (string, error) {
+	sealed, ok := s.Secrets[name]
+	if !ok {
+		return "", fmt.Errorf("no secret %q in %s", name, s.path)
+	}
+	aead, err := s.aead(false)
+	if err != nil {
+		return "", err
+	}
+	buf, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(buf) < aead.NonceSize() {
+		return "", fmt.Errorf("secret %q is corrupt", name)
+	}
+	// The name is authenticated too, so values can't be swapped around.
+	plain, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q can't be decrypted with %s: is it the key it was stored with?", name, s.keyPath)
+	}
+	return string(plain), nil
+}
+
+// set encrypts value as name and saves the store.
+func (s *secretStore) set(name, value string) error {
+	if !secretName.MatchString(name) {
+		return fmt.Errorf("secret name %q may only use letters, digits, '.', '_' and '-'", name)
+	}
+	aead, err := s.aead(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	s.Secrets[name] = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(name)))
+	return s.save()
+}
+
+// remove deletes name and saves the store.
+func (s *secretStore) remove(name string) error {
+	if _, ok := s.Secrets[name]; !ok {
+		return fmt.Errorf("no secret %q in %s", name, s.path)
+	}
+	delete(s.Secrets, name)
+	return s.save()
+}
+
+// save writes the store through a temporary file, so a crash leaves the
+// old or the new store and never half of one.
+func (s *secretStore) save() error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(buf, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// resolveSecret returns value, or the secret it names as "secret:NAME".
+func resolveSecret(value string) (string, error) {
+	name, ok := strings.CutPrefix(value, "secret:")
+	if !ok {
+		return value, nil
+	}
+	s, err := openSecrets(defaultSecretsPaths())
+	if err != nil {
+		return "", err
+	}
+	return s.get(name)
+}
+
+// expandConfig expands ${VAR} in a config file from the environment, and
+// ${secret:NAME} from the secrets store. Anything else, such as a bare $VAR
+// or a $1 in a regular expression, is left as written. Values are escaped
+// for the JSON string they land in.
+func expandConfig(text string) (string, error) {
+	var store *secretStore
+	var b strings.Builder
+	for {
+		i := strings.Index(text, "${")
+		if i < 0 {
+			break
+		}
+		end := strings.IndexByte(text[i+2:], '}')
+		if end < 0 {
+			break
+		}
+		name := text[i+2 : i+2+end]
+		b.WriteString(text[:i])
+		text = text[i+2+end+1:]
+
+		secret, isSecret := strings.CutPrefix(name, "secret:")
+		switch {
+		case isSecret && secret != "":
+			if store == nil {
+				var err error
+				if store, err = openSecrets(defaultSecretsPaths()); err != nil {
+					return "", err
+				}
+			}
+			v, err := store.get(secret)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(jsonEscape(v))
+		case isEnvName(name):
+			b.WriteString(jsonEscape(os.Getenv(name)))
+		default:
+			b.WriteString("${" + name + "}")
+		}
+	}
+	b.WriteString(text)
+	return b.String(), nil
+}
+
+// isEnvName reports whether s can name an environment variable.
+func isEnvName(s string) bool {
+	for i, r := range s {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// jsonEscape escapes s for use inside a JSON string.
+func jsonEscape(s string) string {
+	buf, _ := json.Marshal(s)
+	return string(buf[1 : len(buf)-1])
+}
+
+// RunSecrets manages the secrets store, returning the process exit code.
+func RunSecrets(args []string, in io.Reader, w io.Writer) int {
+	fs := flag.NewFlagSet("secrets", flag.ContinueOnError)
+	fs.SetOutput(w)
+	defPath, _ := defaultSecretsPaths()
+	path := fs.String("store", defPath, "Secrets file")
+	keyPath := fs.String("key", os.Getenv("PEEKDB_SECRETS_KEY_FILE"), "Key file (default the store with .key appended)")
+	fs.Usage = func() {
+		fmt.Fprintln(w, "Usage: peekdb-agent secrets set NAME [--store FILE] [--key FILE] < value")
+		fmt.Fprintln(w, "       peekdb-agent secrets list|rm NAME|check NAME")
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	cmd := args[0]
+	var name string
+	if cmd != "list" {
+		if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+			fs.Usage()
+			return 2
+		}
+		name = args[1]
+		args = args[1:]
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *keyPath == "" {
+		*keyPath = *path + ".key"
+	}
+	s, err := openSecrets(*path, *keyPath)
+	if err != nil {
+		fmt.Fprintf(w, "✗ %v\n", err)
+		return 1
+	}
+
+	switch cmd {
+	case "set":
+		// The value comes from stdin, never the command line, which
+		// would keep it in the shell history and show it in ps.
+		value, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(w, "✗ Could not read the value: %v\n", err)
+			return 1
+		}
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			fmt.Fprintln(w, "✗ No value on stdin")
+			return 1
+		}
+		if err := s.set(name, value); err != nil {
+			fmt.Fprintf(w, "✗ %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "✓ Stored %s in %s; use it as secret:%s\n", name, *path, name)
+	case "rm":
+		if err := s.remove(name); err != nil {
+			fmt.Fprintf(w, "✗ %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "✓ Removed %s\n", name)
+	case "check":
+		if _, err := s.get(name); err != nil {
+			fmt.Fprintf(w, "✗ %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "✓ %s decrypts\n", name)
+	case "list":
+		names := make([]string, 0, len(s.Secrets))
+		for n := range s.Secrets {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		for _, n := range names {
+			fmt.Fprintln(w, n)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxBreadcrumbs = 50
+
+// sentryReporter sends events to Sentry's store API. Events carry the
+// agent version, a stack trace and the last breadcrumbs, which name message
+// types, IDs and fingerprints but never SQL text or parameters. Its methods
+// do nothing on a nil reporter, which is what an agent without
+// --sentry-dsn has.
+type sentryReporter struct {
+	endpoint string
+	auth     string
+	client   *http.Client
+	// release is the agent version and name its --name, for the event.
+	release, name string
+	// scrub masks the text of the event; see ScrubConfig.
+	scrub func() *scrubber
+
+	mu          sync.Mutex
+	breadcrumbs []sentryBreadcrumb
+}
+
+func newSentryReporter(dsn, version string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sentry dsn: %w", err)
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" || u.Host == "" {
+		return nil, fmt.Errorf("sentry dsn must look like https://<key>@<host>/<project>")
+	}
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	return &sentryReporter{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=peekdb-agent/%s, sentry_key=%s",
+			version, u.User.Username()),
+		client:  &http.Client{Timeout: 5 * time.Second},
+		release: version,
+		scrub:   func() *scrubber { return nil },
+	}, nil
+}
+
+type sentryBreadcrumb struct {
+	Timestamp float64 `json:"timestamp"`
+	Category  string  `json:"category"`
+	Message   string  `json:"message"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryEvent struct {
+	EventID    string            `json:"event_id"`
+	Timestamp  string            `json:"timestamp"`
+	Level      string            `json:"level"`
+	Platform   string            `json:"platform"`
+	Release    string            `json:"release"`
+	ServerName string            `json:"server_name,omitempty"`
+	Tags       map[string]string `json:"tags"`
+	Exception  struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Breadcrumbs struct {
+		Values []sentryBreadcrumb `json:"values"`
+	} `json:"breadcrumbs"`
+}
+
+// breadcrumb records something that happened, for context in the next
+// event. Callers must not pass SQL text or parameter values.
+func (r *sentryReporter) breadcrumb(category, format string, args ...any) {
+	if r == nil {
+		return
+	}
+	b := sentryBreadcrumb{
+		Timestamp: float64(time.Now().UnixMilli()) / 1000,
+		Category:  category,
+		Message:   fmt.Sprintf(format, args...),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.breadcrumbs = append(r.breadcrumbs, b)
+	if len(r.breadcrumbs) > maxBreadcrumbs {
+		r.breadcrumbs = r.breadcrumbs[len(r.breadcrumbs)-maxBreadcrumbs:]
+	}
+}
+
+// event builds an event whose stack starts skip frames above its caller or,
+// while panicking, at the frame that panicked.
+func (r *sentryReporter) event(level, kind, value string, skip int) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	host, _ := os.Hostname()
+
+	e := sentryEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Level:      level,
+		Platform:   "go",
+		Release:    r.release,
+		ServerName: host,
+		Tags:       map[string]string{"os": runtime.GOOS, "arch": runtime.GOARCH, "go": runtime.Version()},
+	}
+	if r.name != "" {
+		e.Tags["name"] = r.name
+	}
+
+	ex := sentryException{Type: kind, Value: r.scrub().text(value)}
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip+2, pcs)])
+	for {
+		f, more := frames.Next()
+		if f.Function == "runtime.gopanic" {
+			// Everything so far is recovery; the stack of interest
+			// starts where the panic was raised.
+			ex.Stacktrace.Frames = nil
+			continue
+		}
+		ex.Stacktrace.Frames = append(ex.Stacktrace.Frames, sentryFrame{
+			Function: f.Function,
+			Filename: f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "main.") || strings.HasPrefix(f.Function, "github.com/peekdb/agent/"),
+		})
+		if !more {
+			break
+		}
+	}
+	// Sentry lists frames oldest first.
+	for i, j := 0, len(ex.Stacktrace.Frames)-1; i < j; i, j = i+1, j-1 {
+		ex.Stacktrace.Frames[i], ex.Stacktrace.Frames[j] = ex.Stacktrace.Frames[j], ex.Stacktrace.Frames[i]
+	}
+	e.Exception.Values = []sentryException{ex}
+
+	r.mu.Lock()
+	e.Breadcrumbs.Values = append([]sentryBreadcrumb(nil), r.breadcrumbs...)
+	r.mu.Unlock()
+	return e
+}
+
+func (r *sentryReporter) send(e sentryEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry: %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *sentryReporter) sendAsync(e sentryEvent) {
+	go func() {
+		if err := r.send(e); err != nil {
+			fmt.Fprintf(os.Stderr, "Error report failed: %v\n", err)
+		}
+	}()
+}
+
+// reportError sends err in the background. It is for failures worth
+// waking someone for, not for queries that fail.
+func (r *sentryReporter) reportError(err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.sendAsync(r.event("error", fmt.Sprintf("%T", err), err.Error(), 1))
+}
+
+// reportRecovered sends a panic the agent recovered from, in the
+// background. Call it from the deferred function that recovered.
+func (r *sentryReporter) reportRecovered(v any) {
+	if r == nil {
+		return
+	}
+	r.sendAsync(r.event("error", "panic", fmt.Sprint(v), 1))
+}
+
+// reportPanic, deferred at the top of a goroutine, sends a panic to Sentry
+// before letting it crash the agent as it would have anyway.
+func (r *sentryReporter) reportPanic() {
+	if r == nil {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+	e := r.event("fatal", "panic", fmt.Sprint(v), 1)
+	if err := r.send(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Crash report failed: %v\n", err)
+	}
+	panic(v)
+}
+
+// reportFatal reports err, which stops the agent starting, and returns it,
+// so an agent that never starts is noticed.
+func (r *sentryReporter) reportFatal(err error) error {
+	if r != nil {
+		if err := r.send(r.event("fatal", "startup", err.Error(), 1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error report failed: %v\n", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewSentryReporter(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		endpoint string
+		wantErr  bool
+	}{
+		{"https://abc@o1.ingest.sentry.io/42", "https://o1.ingest.sentry.io/api/42/store/", false},
+		{"http://abc@localhost:9000/sentry/7", "http://localhost:9000/sentry/api/7/store/", false},
+		{"https://o1.ingest.sentry.io/42", "", true},
+		{"https://abc@o1.ingest.sentry.io/", "", true},
+	}
+	for _, tt := range tests {
+		r, err := newSentryReporter(tt.dsn, "dev")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.dsn, tt.wantErr, err)
+			continue
+		}
+		if err == nil && r.endpoint != tt.endpoint {
+			t.Errorf("%s: expected endpoint %s, got %s", tt.dsn, tt.endpoint, r.endpoint)
+		}
+	}
+}
+
+func TestReportPanic(t *testing.T) {
+	events := make(chan sentryEvent, 1)
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("X-Sentry-Auth")
+		var e sentryEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer srv.Close()
+
+	r, err := newSentryReporter(strings.Replace(srv.URL, "://", "://key@", 1)+"/1", "v1.9.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxBreadcrumbs+5; i++ {
+		r.breadcrumb("message", "query id=%q", "q1")
+	}
+
+	func() {
+		defer func() {
+			if v := recover(); v != "boom" {
+				t.Errorf("expected the panic to continue, got %v", v)
+			}
+		}()
+		defer r.reportPanic()
+		panic("boom")
+	}()
+
+	e := <-events
+	if !strings.Contains(auth, "sentry_key=key") {
+		t.Errorf("expected the DSN key in the auth header, got %q", auth)
+	}
+	if e.Level != "fatal" || e.Release != "v1.9.0" {
+		t.Errorf("expected a fatal event for v1.9.0, got %s for %s", e.Level, e.Release)
+	}
+	if len(e.Breadcrumbs.Values) != maxBreadcrumbs {
+		t.Errorf("expected %d breadcrumbs, got %d", maxBreadcrumbs, len(e.Breadcrumbs.Values))
+	}
+	ex := e.Exception.Values[0]
+	frames := ex.Stacktrace.Frames
+	if ex.Value != "boom" || !strings.Contains(frames[len(frames)-1].Function, "TestReportPanic") {
+		t.Errorf("expected the stack to end where the panic happened, got %+v", frames[len(frames)-1])
+	}
+}
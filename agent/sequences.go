@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+)
+
+// Sequence is a sequence with how far it has gone. LastValue and
+// NextValue are missing when the agent's user may not read it. A sequence
+// owned by a column, as serial and identity columns' are, names it in
+// OwnedBy; Identity is "always" or "by_default" for an identity column.
+type Sequence struct {
+	Schema    string  `json:"schema"`
+	Name      string  `json:"name"`
+	DataType  string  `json:"data_type"`
+	Start     int64   `json:"start"`
+	Increment int64   `json:"increment"`
+	Min       int64   `json:"min"`
+	Max       int64   `json:"max"`
+	Cycle     bool    `json:"cycle"`
+	LastValue *int64  `json:"last_value,omitempty"`
+	NextValue *int64  `json:"next_value,omitempty"`
+	OwnedBy   *Owner  `json:"owned_by,omitempty"`
+	Identity  string  `json:"identity,omitempty"`
+	Limit     int64   `json:"limit"`
+	Remaining *int64  `json:"remaining,omitempty"`
+	Used      float64 `json:"used_fraction"`
+}
+
+// Owner is the column a sequence belongs to.
+type Owner struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Type   string `json:"type"`
+}
+
+var identityKinds = map[string]string{
+	"a": "always",
+	"d": "by_default",
+}
+
+// integerRanges are the values a column of each integer type can hold.
+// Sequences made before Postgres 10 are all bigint, so an integer serial
+// column runs out long before its sequence does.
+var integerRanges = map[string][2]int64{
+	"smallint": {math.MinInt16, math.MaxInt16},
+	"integer":  {math.MinInt32, math.MaxInt32},
+	"bigint":   {math.MinInt64, math.MaxInt64},
+}
+
+const sequencesQuery = `
+SELECT s.schemaname, s.sequencename, s.data_type::text, s.start_value, s.increment_by,
+       s.min_value, s.max_value, s.cycle, s.last_value,
+       has_sequence_privilege(c.oid, 'SELECT') OR has_sequence_privilege(c.oid, 'USAGE'),
+       tn.nspname, t.relname, a.attname, format_type(a.atttypid, a.atttypmod), a.attidentity::text
+FROM pg_sequences s
+JOIN pg_namespace n ON n.nspname = s.schemaname
+JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = s.sequencename
+LEFT JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = c.oid
+  AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')
+LEFT JOIN pg_class t ON t.oid = d.refobjid
+LEFT JOIN pg_namespace tn ON tn.oid = t.relnamespace
+LEFT JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+WHERE s.schemaname NOT IN ('pg_catalog', 'information_schema')
+  AND s.schemaname NOT LIKE '\_timescaledb%'
+ORDER BY s.schemaname, s.sequencename`
+
+// loadSequences reads the sequences in schema, or in every schema when it
+// is empty, and marks the identity columns of tables.
+func loadSequences(q queryer, schema string, tables []SchemaTable) ([]Sequence, error) {
+	query, args := sequencesQuery, []any{}
+	if schema != "" {
+		query, args = strings.Replace(sequencesQuery, "ORDER BY", "  AND s.schemaname = $1\nORDER BY", 1), []any{schema}
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seqs []Sequence
+	for rows.Next() {
+		var s Sequence
+		var last sql.NullInt64
+		var readable bool
+		var ownerSchema, ownerTable, ownerColumn, ownerType, identity sql.NullString
+		if err := rows.Scan(&s.Schema, &s.Name, &s.DataType, &s.Start, &s.Increment, &s.Min, &s.Max, &s.Cycle, &last,
+			&readable, &ownerSchema, &ownerTable, &ownerColumn, &ownerType, &identity); err != nil {
+			return nil, err
+		}
+		if ownerColumn.Valid {
+			s.OwnedBy = &Owner{Schema: ownerSchema.String, Table: ownerTable.String, Column: ownerColumn.String, Type: ownerType.String}
+			s.Identity = identityKinds[identity.String]
+		}
+		if last.Valid {
+			s.LastValue = &last.Int64
+		}
+		s.measure(readable)
+		seqs = append(seqs, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byColumn := map[Owner]string{}
+	for _, s := range seqs {
+		if s.Identity != "" {
+			byColumn[Owner{Schema: s.OwnedBy.Schema, Table: s.OwnedBy.Table, Column: s.OwnedBy.Column}] = s.Identity
+		}
+	}
+	for i, t := range tables {
+		for j, col := range t.Columns {
+			tables[i].Columns[j].Identity = byColumn[Owner{Schema: t.Schema, Table: t.Name, Column: col.Name}]
+		}
+	}
+	return seqs, nil
+}
+
+// measure works out how far s has to go: the limit it counts towards,
+// which its owning column's type can make tighter than its own, the value
+// nextval would return, and how many values remain.
+func (s *Sequence) measure(readable bool) {
+	lo, hi := s.Min, s.Max
+	if s.OwnedBy != nil {
+		if r, ok := integerRanges[s.OwnedBy.Type]; ok {
+			lo, hi = max(lo, r[0]), min(hi, r[1])
+		}
+	}
+	s.Limit = hi
+	if s.Increment < 0 {
+		s.Limit = lo
+	}
+	if !readable || s.Increment == 0 {
+		return
+	}
+
+	// pg_sequences has no last value until nextval is first called.
+	next, done := s.Start, false
+	if s.LastValue != nil {
+		last := *s.LastValue
+		done = s.Increment > 0 && last > s.Limit-s.Increment || s.Increment < 0 && last < s.Limit-s.Increment
+		if !done {
+			next = last + s.Increment
+		}
+	}
+	done = done || s.Increment > 0 && next > s.Limit || s.Increment < 0 && next < s.Limit
+	remaining := int64(0)
+	if !done {
+		remaining = int64((float64(s.Limit)-float64(next))/float64(s.Increment)) + 1
+		s.NextValue = &next
+	} else if s.Cycle {
+		// A cycling sequence starts over instead of failing.
+		next = lo
+		if s.Increment < 0 {
+			next = hi
+		}
+		s.NextValue = &next
+	}
+	s.Remaining = &remaining
+	total := math.Floor((float64(s.Limit)-float64(s.Start))/float64(s.Increment)) + 1
+	if total > 0 {
+		s.Used = 1 - float64(remaining)/total
+	}
+}
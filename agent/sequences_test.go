@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSequenceMeasure(t *testing.T) {
+	int64p := func(n int64) *int64 { return &n }
+	serial := &Owner{Schema: "public", Table: "orders", Column: "id", Type: "integer"}
+	tests := []struct {
+		name      string
+		seq       Sequence
+		readable  bool
+		limit     int64
+		next      *int64
+		remaining *int64
+		used      float64
+	}{
+		{
+			name:      "integer column on a bigint sequence",
+			seq:       Sequence{Start: 1, Increment: 1, Min: 1, Max: math.MaxInt64, LastValue: int64p(1610612736), OwnedBy: serial},
+			readable:  true,
+			limit:     math.MaxInt32,
+			next:      int64p(1610612737),
+			remaining: int64p(536870911),
+			used:      0.75,
+		},
+		{
+			name:      "never called",
+			seq:       Sequence{Start: 1, Increment: 1, Min: 1, Max: 100},
+			readable:  true,
+			limit:     100,
+			next:      int64p(1),
+			remaining: int64p(100),
+		},
+		{
+			name:      "exhausted",
+			seq:       Sequence{Start: 1, Increment: 1, Min: 1, Max: math.MaxInt64, LastValue: int64p(math.MaxInt64)},
+			readable:  true,
+			limit:     math.MaxInt64,
+			remaining: int64p(0),
+			used:      1,
+		},
+		{
+			name:      "descending",
+			seq:       Sequence{Start: -1, Increment: -10, Min: -100, Max: -1, LastValue: int64p(-81)},
+			readable:  true,
+			limit:     -100,
+			next:      int64p(-91),
+			remaining: int64p(1),
+			used:      0.9,
+		},
+		{
+			name:      "cycles",
+			seq:       Sequence{Start: 1, Increment: 1, Min: 1, Max: 10, LastValue: int64p(10), Cycle: true},
+			readable:  true,
+			limit:     10,
+			next:      int64p(1),
+			remaining: int64p(0),
+			used:      1,
+		},
+		{
+			name:  "not readable",
+			seq:   Sequence{Start: 1, Increment: 1, Min: 1, Max: 100, OwnedBy: serial},
+			limit: 100,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.seq
+			s.measure(tc.readable)
+			if s.Limit != tc.limit || !equalPtr(s.NextValue, tc.next) || !equalPtr(s.Remaining, tc.remaining) || math.Abs(s.Used-tc.used) > 1e-9 {
+				t.Errorf("got limit %d, next %v, remaining %v, used %v", s.Limit, deref(s.NextValue), deref(s.Remaining), s.Used)
+			}
+		})
+	}
+}
+
+func equalPtr(a, b *int64) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func deref(p *int64) any {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
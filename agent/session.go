@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// Queries fall into classes, each of which can run with its own Postgres
+// session settings: exports (see jobs.go) are "export", everything else is
+// "interactive".
+var queryClasses = map[string]bool{"interactive": true, "export": true}
+
+func queryClass(msg Message) string {
+	if msg.JobID != "" {
+		return "export"
+	}
+	return "interactive"
+}
+
+// sessionSetting is a GUC applied with SET LOCAL for the duration of one
+// query's transaction, e.g. statement_timeout = 30s.
+type sessionSetting struct {
+	name, value string
+}
+
+var settingName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// parseSessionSettings validates a connection's session_settings, keyed by
+// query class and then setting name, and orders each class's settings by
+// name.
+func parseSessionSettings(cfg map[string]map[string]string) (map[string][]sessionSetting, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	out := map[string][]sessionSetting{}
+	for class, settings := range cfg {
+		if !queryClasses[class] {
+			return nil, fmt.Errorf("unknown query class %q: expected interactive or export", class)
+		}
+		for name, value := range settings {
+			if !settingName.MatchString(name) {
+				return nil, fmt.Errorf("invalid setting name %q", name)
+			}
+			out[class] = append(out[class], sessionSetting{name: name, value: value})
+		}
+		sort.Slice(out[class], func(i, j int) bool { return out[class][i].name < out[class][j].name })
+	}
+	return out, nil
+}
+
+// setLocal applies settings inside tx; they end with it.
+func setLocal(ctx context.Context, tx *sql.Tx, settings []sessionSetting) error {
+	for _, s := range settings {
+		if _, err := tx.ExecContext(ctx, "SET LOCAL "+s.name+" = "+pq.QuoteLiteral(s.value)); err != nil {
+			return fmt.Errorf("set %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseSessionSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]map[string]string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "both classes", cfg: map[string]map[string]string{
+			"interactive": {"statement_timeout": "30s", "work_mem": "64MB"},
+			"export":      {"statement_timeout": "10min"},
+		}},
+		{name: "custom setting", cfg: map[string]map[string]string{"interactive": {"app.tenant": "acme"}}},
+		{name: "unknown class", cfg: map[string]map[string]string{"batch": {"work_mem": "1GB"}}, wantErr: true},
+		{name: "injection in name", cfg: map[string]map[string]string{"interactive": {"work_mem = 1; DROP TABLE t; --": "x"}}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseSessionSettings(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSessionSettingsApplied(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	settings, err := parseSessionSettings(map[string]map[string]string{
+		"interactive": {"work_mem": "64MB", "statement_timeout": "30s"},
+		"export":      {"statement_timeout": "10min"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &sqlConnector{db: db, flavor: "postgres", settings: settings}
+
+	// Interactive: both settings, in name order, then the query, committed
+	// because the connection can write.
+	mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = '30s'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL work_mem = '64MB'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectCommit()
+	if resp := c.Query(Message{ID: "q1", SQL: "SELECT 1"}); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+
+	// Export: its own timeout only.
+	mock.ExpectQuery("SELECT pg_backend_pid\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = '10min'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 2").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(2))
+	mock.ExpectCommit()
+	if resp := c.Query(Message{ID: "j1", JobID: "j1", SQL: "SELECT 2"}); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if c.session != nil {
+		t.Error("expected the shared connector to be left without per-query settings")
+	}
+}
@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings are the agent-wide, non-secret options the hub can change at
+// runtime with a "config_update" message. Absent settings keep their value.
+type Settings struct {
+	MaxCellBytes   *int      `json:"max_cell_bytes,omitempty"`
+	SlowQuery      *duration `json:"slow_query,omitempty"`
+	ExplainOnError *bool     `json:"explain_on_error,omitempty"`
+	QueryComment   *string   `json:"query_comment,omitempty"`
+	// Scrub replaces the masking rules for logs; see ScrubConfig.
+	Scrub *ScrubConfig `json:"scrub,omitempty"`
+}
+
+// liveSettings are the Settings an Agent runs with, starting from its
+// Options. mu guards them once the agent is serving; read them through the
+// accessors.
+type liveSettings struct {
+	mu      sync.RWMutex
+	version int64
+	// locked are the settings of the --settings-override file, a JSON
+	// file of Settings the operator keeps for themselves: they are
+	// applied at startup and config_update can't change them.
+	locked map[string]bool
+
+	maxCellBytes   int
+	slowQuery      time.Duration
+	explainOnError bool
+	queryComment   string
+	// scrub applies the configured rules; nil redacts only the parameters
+	// of queries the hub marks sensitive.
+	scrub *scrubber
+}
+
+func newLiveSettings(o Options) liveSettings {
+	return liveSettings{locked: map[string]bool{}, maxCellBytes: o.MaxCellBytes, slowQuery: o.SlowQuery,
+		explainOnError: o.ExplainOnError, queryComment: o.QueryComment}
+}
+
+func (a *Agent) currentMaxCellBytes() int {
+	a.settings.mu.RLock()
+	defer a.settings.mu.RUnlock()
+	return a.settings.maxCellBytes
+}
+
+func (a *Agent) currentSlowQuery() time.Duration {
+	a.settings.mu.RLock()
+	defer a.settings.mu.RUnlock()
+	return a.settings.slowQuery
+}
+
+func (a *Agent) currentExplainOnError() bool {
+	a.settings.mu.RLock()
+	defer a.settings.mu.RUnlock()
+	return a.settings.explainOnError
+}
+
+func (a *Agent) currentQueryComment() string {
+	a.settings.mu.RLock()
+	defer a.settings.mu.RUnlock()
+	return a.settings.queryComment
+}
+
+func (a *Agent) currentScrub() *scrubber {
+	a.settings.mu.RLock()
+	defer a.settings.mu.RUnlock()
+	return a.settings.scrub
+}
+
+// names lists the settings s sets, by their JSON names.
+func (s *Settings) names() []string {
+	var names []string
+	if s.MaxCellBytes != nil {
+		names = append(names, "max_cell_bytes")
+	}
+	if s.SlowQuery != nil {
+		names = append(names, "slow_query")
+	}
+	if s.ExplainOnError != nil {
+		names = append(names, "explain_on_error")
+	}
+	if s.QueryComment != nil {
+		names = append(names, "query_comment")
+	}
+	if s.Scrub != nil {
+		names = append(names, "scrub")
+	}
+	return names
+}
+
+// without returns s minus the named settings.
+func (s Settings) without(names map[string]bool) Settings {
+	if names["max_cell_bytes"] {
+		s.MaxCellBytes = nil
+	}
+	if names["slow_query"] {
+		s.SlowQuery = nil
+	}
+	if names["explain_on_error"] {
+		s.ExplainOnError = nil
+	}
+	if names["query_comment"] {
+		s.QueryComment = nil
+	}
+	if names["scrub"] {
+		s.Scrub = nil
+	}
+	return s
+}
+
+// apply validates s and, only if all of it is valid, applies it to l. The
+// caller holds l.mu.
+func (s Settings) apply(l *liveSettings) error {
+	if s.MaxCellBytes != nil && *s.MaxCellBytes < 0 {
+		return fmt.Errorf("max_cell_bytes must not be negative")
+	}
+	if s.SlowQuery != nil && *s.SlowQuery < 0 {
+		return fmt.Errorf("slow_query must not be negative")
+	}
+	if s.QueryComment != nil {
+		if err := checkQueryComment(*s.QueryComment); err != nil {
+			return err
+		}
+	}
+	var sc *scrubber
+	if s.Scrub != nil {
+		var err error
+		if sc, err = newScrubber(s.Scrub); err != nil {
+			return err
+		}
+	}
+
+	if s.MaxCellBytes != nil {
+		l.maxCellBytes = *s.MaxCellBytes
+	}
+	if s.SlowQuery != nil {
+		l.slowQuery = time.Duration(*s.SlowQuery)
+	}
+	if s.ExplainOnError != nil {
+		l.explainOnError = *s.ExplainOnError
+	}
+	if s.QueryComment != nil {
+		l.queryComment = *s.QueryComment
+	}
+	if sc != nil {
+		l.scrub = sc
+	}
+	return nil
+}
+
+func decodeSettings(buf []byte) (Settings, error) {
+	var s Settings
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&s)
+	return s, err
+}
+
+// loadSettingsOverride applies the override file and locks its settings
+// against config_update.
+func (a *Agent) loadSettingsOverride(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s, err := decodeSettings(buf)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	l := &a.settings
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := s.apply(l); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, name := range s.names() {
+		l.locked[name] = true
+	}
+	return nil
+}
+
+// ConfigUpdateResponse answers a "config_update" message. Refused lists
+// the settings the override file keeps from the hub; the rest of the
+// update still applies.
+type ConfigUpdateResponse struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	Version   int64    `json:"version"`
+	Applied   []string `json:"applied"`
+	Refused   []string `json:"refused,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	ErrorCode string   `json:"error_code,omitempty"`
+}
+
+// configUpdate applies the settings in a "config_update" message. Versions
+// must increase; an update that isn't newer than the current settings, or
+// that has any invalid or unknown setting, changes nothing.
+func configUpdate(msg Message) ConfigUpdateResponse {
+	a := msg.agent()
+	resp := ConfigUpdateResponse{ID: msg.ID, Type: "config_update", Version: a.currentSettingsVersion(), Applied: []string{}}
+	fail := func(err error) ConfigUpdateResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		log.Printf("[config] Rejected version %d: %v", msg.Version, err)
+		return resp
+	}
+
+	s, err := decodeSettings(msg.Settings)
+	if err != nil {
+		return fail(codedErrorf(codeInvalidRequest, "invalid settings: %v", err))
+	}
+
+	l := &a.settings
+	l.mu.Lock()
+	if msg.Version <= l.version {
+		l.mu.Unlock()
+		return fail(codedErrorf(codeInvalidRequest, "version %d is not newer than %d", msg.Version, l.version))
+	}
+	for _, name := range s.names() {
+		if l.locked[name] {
+			resp.Refused = append(resp.Refused, name)
+		} else {
+			resp.Applied = append(resp.Applied, name)
+		}
+	}
+	err = s.without(l.locked).apply(l)
+	if err == nil {
+		l.version = msg.Version
+		resp.Version = msg.Version
+	}
+	l.mu.Unlock()
+
+	if err != nil {
+		resp.Applied, resp.Refused = []string{}, nil
+		return fail(codedErrorf(codeInvalidRequest, "%v", err))
+	}
+	log.Printf("[config] Applied version %d: %s", msg.Version, strings.Join(resp.Applied, ", "))
+	if len(resp.Refused) > 0 {
+		log.Printf("[config] Kept local settings: %s", strings.Join(resp.Refused, ", "))
+	}
+	return resp
+}
+
+func (a *Agent) currentSettingsVersion() int64 {
+	a.settings.mu.RLock()
+	defer a.settings.mu.RUnlock()
+	return a.settings.version
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigUpdate(t *testing.T) {
+	tn := testTenant()
+	a := tn.agent
+	path := filepath.Join(t.TempDir(), "override.json")
+	os.WriteFile(path, []byte(`{"query_comment": "peekdb:{query_id}"}`), 0o600)
+	if err := a.loadSettingsOverride(path); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(version int64, settings string) ConfigUpdateResponse {
+		return configUpdate(Message{Type: "config_update", ID: "c1", Version: version, Settings: json.RawMessage(settings), tenant: tn})
+	}
+
+	resp := update(1, `{"max_cell_bytes": 4096, "slow_query": "3s", "query_comment": "x"}`)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if !reflect.DeepEqual(resp.Applied, []string{"max_cell_bytes", "slow_query"}) || !reflect.DeepEqual(resp.Refused, []string{"query_comment"}) {
+		t.Errorf("expected the override to keep query_comment, got applied %v refused %v", resp.Applied, resp.Refused)
+	}
+	if a.currentMaxCellBytes() != 4096 || a.currentSlowQuery() != 3*time.Second || a.currentQueryComment() != "peekdb:{query_id}" {
+		t.Errorf("unexpected settings: %d %v %q", a.currentMaxCellBytes(), a.currentSlowQuery(), a.currentQueryComment())
+	}
+
+	tests := []struct {
+		name     string
+		version  int64
+		settings string
+	}{
+		{name: "stale version", version: 1, settings: `{"max_cell_bytes": 10}`},
+		{name: "unknown setting", version: 2, settings: `{"schedules": []}`},
+		{name: "invalid rule", version: 2, settings: `{"max_cell_bytes": 10, "scrub": {"values": ["("]}}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := update(tc.version, tc.settings)
+			if resp.ErrorCode != codeInvalidRequest {
+				t.Errorf("expected %s, got %+v", codeInvalidRequest, resp)
+			}
+			if a.currentMaxCellBytes() != 4096 || resp.Version != 1 {
+				t.Errorf("expected nothing to change, got max_cell_bytes %d at version %d", a.currentMaxCellBytes(), resp.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// Shared results let several people on the hub page through one query's
+// result independently. A query message with "shared": true runs once and
+// the agent keeps its rows; its reply is the first page for the viewer who
+// sent it. Each "page" message then returns the next page for its viewer:
+//
+//	{"type": "query", "id": "q1", "sql": "...", "shared": true, "viewer_id": "alice", "page_size": 50}
+//	{"type": "page", "id": "p1", "query_id": "q1", "viewer_id": "bob", "page_size": 50}
+//	{"type": "page", "id": "p2", "query_id": "q1", "viewer_id": "bob", "from": 0}
+//
+// A viewer is its viewer_id, or its user when there is none, and starts at
+// the first row; "from" moves it. A result is dropped when it hasn't been
+// paged for --shared-result-ttl, or when the same query ID runs again.
+
+// maxSharedResults caps the results kept at once; the least recently paged
+// goes first.
+const maxSharedResults = 64
+
+// defaultSharedPageSize is the page size when a message doesn't give one.
+const defaultSharedPageSize = 100
+
+// SharedPage places a page of a shared result.
+type SharedPage struct {
+	ViewerID string `json:"viewer_id,omitempty"`
+	// Offset is the page's first row in the whole result, and TotalRows
+	// the whole result's size.
+	Offset    int  `json:"offset"`
+	TotalRows int  `json:"total_rows"`
+	More      bool `json:"more"`
+}
+
+type sharedKey struct {
+	tenant *tenant
+	id     string
+}
+
+// sharedResult is a query's whole response and where each viewer is in
+// it.
+type sharedResult struct {
+	resp    QueryResponse
+	viewers map[string]int
+	used    time.Time
+}
+
+type sharedResults struct {
+	mu sync.Mutex
+	// ttl is how long a result is kept after its last page.
+	ttl  time.Duration
+	byID map[sharedKey]*sharedResult
+}
+
+func newSharedResults(ttl time.Duration) *sharedResults {
+	return &sharedResults{ttl: ttl, byID: map[sharedKey]*sharedResult{}}
+}
+
+// sharedMiddleware keeps the result of a shared query and replies with its
+// first page. It runs inside the policy checks and outside everything that
+// shapes the response, so the rows it keeps are the ones a viewer would
+// have been sent.
+type sharedMiddleware struct{ a *Agent }
+
+func (sharedMiddleware) Name() string { return "shared" }
+
+func (m sharedMiddleware) Wrap(next QueryHandler) QueryHandler {
+	return func(q *Query) QueryResponse {
+		if !q.Shared {
+			return next(q)
+		}
+		if q.Flavor == "elasticsearch" || q.Flavor == "cassandra" {
+			return queryError(q.ID, codedErrorf(codeNotSupported, "shared is not supported for %s, which pages results itself", q.Flavor))
+		}
+		if q.ID == "" {
+			return queryError(q.ID, codedErrorf(codeInvalidRequest, "a shared query needs an id"))
+		}
+		pageSize := q.PageSize
+		// The whole result is kept in memory, so it can't spill.
+		q.PageSize, q.Spill = 0, false
+		resp := next(q)
+		if resp.Error != "" {
+			return resp
+		}
+		r := m.a.shared.put(q.tenant, q.ID, resp)
+		return m.a.shared.page(r, q.viewer(), pageSize, nil)
+	}
+}
+
+// put keeps resp as the shared result id, replacing an earlier run.
+func (s *sharedResults) put(t *tenant, id string, resp QueryResponse) *sharedResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.prune(now)
+	if len(s.byID) >= maxSharedResults {
+		var oldest sharedKey
+		for k, r := range s.byID {
+			if oldest.id == "" || r.used.Before(s.byID[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(s.byID, oldest)
+	}
+	r := &sharedResult{resp: resp, viewers: map[string]int{}, used: now}
+	s.byID[sharedKey{t, id}] = r
+	return r
+}
+
+// prune drops results not paged for s.ttl. Callers hold s.mu.
+func (s *sharedResults) prune(now time.Time) {
+	for k, r := range s.byID {
+		if now.Sub(r.used) > s.ttl {
+			delete(s.byID, k)
+		}
+	}
+}
+
+// page returns viewer's next pageSize rows of r, from from if it is set,
+// and moves the viewer past them.
+func (s *sharedResults) page(r *sharedResult, viewer string, pageSize int, from *int) QueryResponse {
+	if pageSize <= 0 {
+		pageSize = defaultSharedPageSize
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := len(r.resp.Rows)
+	start := r.viewers[viewer]
+	if from != nil {
+		start = *from
+	}
+	start = min(max(start, 0), total)
+	end := min(start+pageSize, total)
+	r.viewers[viewer] = end
+	r.used = time.Now()
+
+	resp := r.resp
+	resp.Rows = r.resp.Rows[start:end]
+	resp.Truncated = nil
+	for _, tc := range r.resp.Truncated {
+		if tc.Row >= start && tc.Row < end {
+			tc.Row -= start
+			resp.Truncated = append(resp.Truncated, tc)
+		}
+	}
+	resp.Page = &SharedPage{ViewerID: viewer, Offset: start, TotalRows: total, More: end < total}
+	return resp
+}
+
+// sharedPage answers a "page" message with its viewer's next page of a
+// shared result.
+func sharedPage(msg Message) QueryResponse {
+	if msg.QueryID == "" {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "query_id is required"))
+	}
+	shared := msg.agent().shared
+	shared.mu.Lock()
+	shared.prune(time.Now())
+	r := shared.byID[sharedKey{msg.tenant, msg.QueryID}]
+	shared.mu.Unlock()
+	if r == nil {
+		return queryError(msg.ID, codedErrorf(codeInvalidRequest, "no shared result for query %q; it may have expired, so run it again", msg.QueryID))
+	}
+	p := shared.page(r, msg.viewer(), msg.PageSize, msg.From)
+	// Only the first page says how the query ran.
+	return QueryResponse{ID: msg.ID, Type: "result", Columns: p.Columns, ColumnTypes: p.ColumnTypes, Rows: p.Rows,
+		Truncated: p.Truncated, Connection: p.Connection, RowLimit: p.RowLimit, Page: p.Page}
+}
+
+// viewer is who is paging through a shared result.
+func (m Message) viewer() string {
+	if m.ViewerID != "" {
+		return m.ViewerID
+	}
+	return m.User
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSharedResultPaging(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	// The query runs once, however many viewers page through it.
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT id FROM orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3).AddRow(4).AddRow(5))
+	resp := runQuery(Message{ID: "q1", Type: "query", SQL: "SELECT id FROM orders", Shared: true, ViewerID: "alice", PageSize: 2, tenant: tn})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	zero := 0
+	tests := []struct {
+		name   string
+		msg    Message
+		first  any
+		rows   int
+		offset int
+		more   bool
+	}{
+		{"first page", Message{}, int64(1), 2, 0, true},
+		{"another viewer starts at the top", Message{ViewerID: "bob"}, int64(1), 2, 0, true},
+		{"alice carries on", Message{ViewerID: "alice"}, int64(3), 2, 2, true},
+		{"user stands in for viewer_id", Message{User: "bob", PageSize: 10}, int64(3), 3, 2, false},
+		{"alice's last page", Message{ViewerID: "alice", PageSize: 10}, int64(5), 1, 4, false},
+		{"from rewinds", Message{ViewerID: "alice", From: &zero, PageSize: 1}, int64(1), 1, 0, true},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if i > 0 {
+				tc.msg.Type, tc.msg.ID, tc.msg.QueryID, tc.msg.tenant = "page", "p", "q1", tn
+				if tc.msg.PageSize == 0 {
+					tc.msg.PageSize = 2
+				}
+				resp = sharedPage(tc.msg)
+			}
+			if resp.Error != "" {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if len(resp.Rows) != tc.rows || resp.Rows[0][0] != tc.first {
+				t.Errorf("expected %d rows from %v, got %v", tc.rows, tc.first, resp.Rows)
+			}
+			if p := resp.Page; p == nil || p.Offset != tc.offset || p.TotalRows != 5 || p.More != tc.more {
+				t.Errorf("expected offset %d of 5, more %v, got %+v", tc.offset, tc.more, p)
+			}
+		})
+	}
+
+	// Other tokens don't see it.
+	if resp := sharedPage(Message{ID: "p", QueryID: "q1", ViewerID: "alice", tenant: &tenant{agent: tn.agent}}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected another tenant's page to be refused, got %+v", resp)
+	}
+}
+
+func TestSharedResultExpires(t *testing.T) {
+	tn := testTenant()
+	tn.agent.shared.put(tn, "q1", QueryResponse{ID: "q1", Type: "result", Rows: [][]any{{1}}})
+	tn.agent.shared.ttl = -1
+	if resp := sharedPage(Message{ID: "p", QueryID: "q1", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected an expired result to be gone, got %+v", resp)
+	}
+}
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kcatCommand is the Kafka producer Kafka sinks run.
+var kcatCommand = "kcat"
+
+// sinkTimeout bounds one publish to a sink.
+const sinkTimeout = 30 * time.Second
+
+// SinkConfig is somewhere publish jobs send rows: a Kafka cluster, reached
+// with kcat, or a NATS server.
+type SinkConfig struct {
+	Name string `json:"name"`
+	// Type is "kafka" or "nats".
+	Type string `json:"type"`
+	// Brokers are a Kafka sink's bootstrap servers, and Options the
+	// librdkafka settings it needs, such as sasl.username; they go to
+	// kcat in a file, never on its command line.
+	Brokers []string          `json:"brokers,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+	// URL is a NATS sink's server, nats:// or, for TLS, tls://, with its
+	// user and password or token, if any.
+	URL string `json:"url,omitempty"`
+}
+
+// check reports mistakes in the settings before anything connects.
+func (s *SinkConfig) check() error {
+	switch {
+	case s.Name == "":
+		return fmt.Errorf("name is required")
+	case s.Type == "kafka":
+		if len(s.Brokers) == 0 && s.Options["bootstrap.servers"] == "" {
+			return fmt.Errorf("a kafka sink needs brokers")
+		}
+		if s.URL != "" {
+			return fmt.Errorf("url is only for nats sinks; kafka sinks take brokers")
+		}
+	case s.Type == "nats":
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+			return fmt.Errorf("a nats sink needs a nats:// or tls:// url")
+		}
+		if len(s.Brokers) > 0 || len(s.Options) > 0 {
+			return fmt.Errorf("brokers and options are only for kafka sinks")
+		}
+	default:
+		return fmt.Errorf("unknown type %q: expected kafka or nats", s.Type)
+	}
+	return nil
+}
+
+// sinkMessage is one message for a sink; Key is empty for none.
+type sinkMessage struct {
+	Key   string
+	Value []byte
+}
+
+// sink publishes messages to a topic, or subject, returning once the
+// sink has accepted all of them.
+type sink interface {
+	publish(ctx context.Context, topic string, msgs []sinkMessage) error
+	Close() error
+}
+
+// openSink returns the sink of cfg; version, the agent's release, is what
+// a NATS sink tells its server.
+func openSink(cfg SinkConfig, version string) sink {
+	if cfg.Type == "nats" {
+		u, _ := url.Parse(cfg.URL)
+		return &natsSink{url: u, version: version}
+	}
+	return &kafkaSink{cfg: cfg}
+}
+
+// kafkaSink produces messages with kcat, one run per publish, so the agent
+// needs no Kafka client of its own.
+type kafkaSink struct {
+	cfg SinkConfig
+}
+
+func (k *kafkaSink) publish(ctx context.Context, topic string, msgs []sinkMessage) error {
+	conf, err := k.writeConfig()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(conf)
+
+	var in bytes.Buffer
+	keyed := false
+	for _, m := range msgs {
+		if m.Key != "" {
+			keyed = true
+		}
+	}
+	for _, m := range msgs {
+		if keyed {
+			// Values are JSON, which never holds a raw tab or newline;
+			// a key could, and would be split wrongly.
+			if strings.ContainsAny(m.Key, "\t\n") {
+				return fmt.Errorf("key %q contains a tab or newline", m.Key)
+			}
+			in.WriteString(m.Key)
+			in.WriteByte('\t')
+		}
+		in.Write(m.Value)
+		in.WriteByte('\n')
+	}
+	args := []string{"-P", "-F", conf, "-t", topic}
+	if keyed {
+		args = append(args, "-K", "\t")
+	}
+	ctx, cancel := context.WithTimeout(ctx, sinkTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, kcatCommand, args...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stderr = &in, &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError(kcatCommand, err, stderr.String())
+	}
+	// kcat reports some delivery failures without failing.
+	if strings.Contains(stderr.String(), "% ERROR") {
+		return commandError(kcatCommand, fmt.Errorf("delivery failed"), stderr.String())
+	}
+	return nil
+}
+
+// writeConfig writes the sink's librdkafka settings to a file only the
+// agent can read, for kcat's -F.
+func (k *kafkaSink) writeConfig() (string, error) {
+	f, err := os.CreateTemp("", "peekdb-kcat-*.conf")
+	if err != nil {
+		return "", err
+	}
+	opts := map[string]string{}
+	if len(k.cfg.Brokers) > 0 {
+		opts["bootstrap.servers"] = strings.Join(k.cfg.Brokers, ",")
+	}
+	for key, v := range k.cfg.Options {
+		opts[key] = v
+	}
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(f, "%s=%s\n", key, opts[key])
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (k *kafkaSink) Close() error { return nil }
+
+// natsSink publishes over NATS's text protocol, keeping its connection
+// between publishes and dialling again after a failure. NATS messages
+// have no key.
+type natsSink struct {
+	url     *url.URL
+	version string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (n *natsSink) publish(ctx context.Context, subject string, msgs []sinkMessage) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.send(ctx, subject, msgs)
+	if err != nil && n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	return err
+}
+
+// send writes msgs, then a PING, and waits for the PONG, by which time
+// the server has handled everything before it.
+func (n *natsSink) send(ctx context.Context, subject string, msgs []sinkMessage) error {
+	if strings.ContainsAny(subject, " \t\r\n") || subject == "" {
+		return fmt.Errorf("invalid nats subject %q", subject)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > sinkTimeout {
+		deadline = time.Now().Add(sinkTimeout)
+	}
+	if n.conn == nil {
+		if err := n.dial(deadline); err != nil {
+			return err
+		}
+	}
+	n.conn.SetDeadline(deadline)
+	w := bufio.NewWriter(n.conn)
+	for _, m := range msgs {
+		fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(m.Value))
+		w.Write(m.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return n.awaitPong()
+}
+
+// dial connects and introduces the agent, with the URL's credentials.
+func (n *natsSink) dial(deadline time.Time) error {
+	host := n.url.Host
+	if n.url.Port() == "" {
+		host = net.JoinHostPort(n.url.Hostname(), "4222")
+	}
+	d := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if n.url.Scheme == "tls" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: n.url.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	opts := map[string]any{"verbose": false, "pedantic": false, "lang": "go", "name": "peekdb-agent", "version": n.version}
+	if u := n.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			opts["user"], opts["pass"] = u.Username(), pass
+		} else {
+			opts["auth_token"] = u.Username()
+		}
+	}
+	buf, _ := json.Marshal(opts)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", buf); err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn, n.r = conn, r
+	return nil
+}
+
+// awaitPong reads until the server's PONG, failing on an -ERR, such as a
+// refused CONNECT or a message over the server's size limit.
+func (n *natsSink) awaitPong() error {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		}
+	}
+}
+
+func (n *natsSink) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
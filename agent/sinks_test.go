@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSinkConfigCheck(t *testing.T) {
+	tests := []struct {
+		sink SinkConfig
+		err  string
+	}{
+		{sink: SinkConfig{Name: "events", Type: "kafka", Brokers: []string{"kafka:9092"}}},
+		{sink: SinkConfig{Name: "events", Type: "kafka", Options: map[string]string{"bootstrap.servers": "kafka:9092"}}},
+		{sink: SinkConfig{Name: "bus", Type: "nats", URL: "nats://token@nats:4222"}},
+		{sink: SinkConfig{Type: "nats"}, err: "name is required"},
+		{sink: SinkConfig{Name: "events", Type: "kafka"}, err: "a kafka sink needs brokers"},
+		{sink: SinkConfig{Name: "bus", Type: "nats", URL: "http://nats:4222"}, err: "a nats sink needs a nats:// or tls:// url"},
+		{sink: SinkConfig{Name: "bus", Type: "nats", URL: "nats://nats", Brokers: []string{"x"}}, err: "brokers and options are only for kafka sinks"},
+		{sink: SinkConfig{Name: "q", Type: "sqs"}, err: `unknown type "sqs": expected kafka or nats`},
+	}
+	for _, tc := range tests {
+		err := tc.sink.check()
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Errorf("check(%+v) = %v, want %q", tc.sink, err, tc.err)
+		}
+	}
+}
+
+// fakeKcat makes kcatCommand a script that copies its arguments, its -F
+// config and its input to out, writes stderr, and exits with code.
+func fakeKcat(t *testing.T, out, stderr, code string) {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "kcat")
+	os.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" > `+out+`
+while [ $# -gt 0 ]; do [ "$1" = -F ] && cat "$2" >> `+out+`; shift; done
+cat >> `+out+`
+echo '`+stderr+`' >&2
+exit `+code+"\n"), 0o755)
+	was := kcatCommand
+	kcatCommand = script
+	t.Cleanup(func() { kcatCommand = was })
+}
+
+func TestKafkaSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	fakeKcat(t, out, "", "0")
+	k := openSink(SinkConfig{Name: "events", Type: "kafka", Brokers: []string{"k1:9092", "k2:9092"}, Options: map[string]string{"sasl.password": "s3cret"}}, "test")
+	err := k.publish(context.Background(), "orders", []sinkMessage{{Key: "7", Value: []byte(`{"id":7}`)}, {Value: []byte(`{"id":8}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(out)
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "-P -F ") || !strings.HasSuffix(lines[0], " -t orders -K \t") || strings.Contains(lines[0], "s3cret") {
+		t.Fatalf("unexpected kcat call: %q", got)
+	}
+	if lines[1] != "bootstrap.servers=k1:9092,k2:9092" || lines[2] != "sasl.password=s3cret" || lines[3] != "7\t{\"id\":7}" || lines[4] != "\t{\"id\":8}" {
+		t.Errorf("unexpected kcat config or input: %q", lines[1:])
+	}
+	if _, err := os.Stat(strings.Fields(lines[0])[2]); !os.IsNotExist(err) {
+		t.Errorf("expected the config file to be removed, got %v", err)
+	}
+
+	if err := k.publish(context.Background(), "orders", []sinkMessage{{Key: "a\tb", Value: []byte("{}")}}); err == nil {
+		t.Error("expected a key with a tab to be refused")
+	}
+	fakeKcat(t, out, "% ERROR: Local: Unknown topic", "0")
+	if err := k.publish(context.Background(), "nope", []sinkMessage{{Value: []byte("{}")}}); err == nil || !strings.Contains(err.Error(), "Unknown topic") {
+		t.Errorf("expected a delivery error, got %v", err)
+	}
+}
+
+// fakeNATS accepts one connection at a time, records what it is sent,
+// and answers PINGs; with reject, the first connection's PUBs fail.
+func fakeNATS(t *testing.T, reject bool) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				line = strings.TrimSpace(line)
+				switch {
+				case line == "PING":
+					fmt.Fprintf(conn, "PONG\r\n")
+				case strings.HasPrefix(line, "PUB "):
+					var subject string
+					var n int
+					fmt.Sscanf(line, "PUB %s %d", &subject, &n)
+					payload := make([]byte, n+2)
+					io.ReadFull(r, payload)
+					if reject {
+						fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to %s'\r\n", subject)
+						continue
+					}
+					got <- subject + " " + string(payload[:n])
+				default:
+					got <- line
+				}
+			}
+			conn.Close()
+			reject = false
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestNATSSink(t *testing.T) {
+	addr, got := fakeNATS(t, true)
+	n := openSink(SinkConfig{Name: "bus", Type: "nats", URL: "nats://peek:s3cret@" + addr}, "test")
+	defer n.Close()
+	msgs := []sinkMessage{{Value: []byte(`{"id":7}`)}, {Value: []byte(`{"id":8}`)}}
+	if err := n.publish(context.Background(), "orders.changed", msgs); err == nil || err.Error() != "nats: Permissions Violation for Publish to orders.changed" {
+		t.Fatalf("expected the server's error, got %v", err)
+	}
+	if connect := <-got; !strings.HasPrefix(connect, "CONNECT ") || !strings.Contains(connect, `"user":"peek"`) || !strings.Contains(connect, `"pass":"s3cret"`) {
+		t.Errorf("unexpected CONNECT: %s", connect)
+	}
+
+	// The failed connection is dropped and the next publish dials again.
+	if err := n.publish(context.Background(), "orders.changed", msgs); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for len(lines) < 3 {
+		lines = append(lines, <-got)
+	}
+	if lines[1] != `orders.changed {"id":7}` || lines[2] != `orders.changed {"id":8}` {
+		t.Errorf("unexpected messages: %q", lines)
+	}
+	if err := n.publish(context.Background(), "bad subject", msgs); err == nil {
+		t.Error("expected a subject with a space to be refused")
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"os/user"
+	"strings"
+)
+
+// Postgres listens on a unix socket as well as TCP, and hosts that allow
+// no TCP connections only there. libpq, and so psql, take the socket's
+// directory as the host, percent-encoded in a URL:
+//
+//	postgres://app@%2Fvar%2Frun%2Fpostgresql/mydb
+//
+// Go's URL parser rejects that host, and lib/pq with it, so pqSocketURL
+// moves it to the host parameter, which lib/pq reads as a socket directory
+// like any host starting with "/".
+
+// pqSocketURL rewrites a URL whose host is an encoded socket directory to
+// carry it as ?host= instead, reporting whether it did.
+func pqSocketURL(rawURL string) (string, bool) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok || (scheme != "postgres" && scheme != "postgresql") {
+		return rawURL, false
+	}
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, tail := rest[:end], rest[end:]
+	userinfo, host := "", authority
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, host = authority[:i+1], authority[i+1:]
+	}
+	if !strings.HasPrefix(strings.ToUpper(host), "%2F") {
+		return rawURL, false
+	}
+	port := ""
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host, port = host[:i], host[i:]
+	}
+	dir, err := url.PathUnescape(host)
+	if err != nil {
+		return rawURL, false
+	}
+
+	path, query, _ := strings.Cut(tail, "?")
+	if query != "" {
+		query += "&"
+	}
+	query += "host=" + url.QueryEscape(dir)
+	return scheme + "://" + userinfo + port + path + "?" + query, true
+}
+
+// peerAuthHint explains a failed peer authentication, where Postgres
+// checks the database user against the OS user the agent runs as.
+func peerAuthHint(err error) error {
+	if err == nil || !strings.Contains(err.Error(), "Peer authentication failed") {
+		return err
+	}
+	name := "unknown"
+	if u, uerr := user.Current(); uerr == nil {
+		name = u.Username
+	}
+	return fmt.Errorf("%w (peer authentication needs the database user to match the OS user the agent runs as, %q, or a pg_ident.conf mapping)", err, name)
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestPQSocketURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		host string
+		port uint16
+		user string
+		db   string
+	}{
+		{"postgres://app@%2Fvar%2Frun%2Fpostgresql/mydb", "/var/run/postgresql", 5432, "app", "mydb"},
+		{"postgresql://app:secret@%2ftmp:5433/mydb?application_name=peekdb", "/tmp", 5433, "app", "mydb"},
+		{"postgres://%2Fvar%2Frun%2Fpostgresql", "/var/run/postgresql", 5432, "", ""},
+		{"postgres://app@/mydb?host=/var/run/postgresql", "/var/run/postgresql", 5432, "app", "mydb"},
+		{"host=/var/run/postgresql dbname=mydb", "/var/run/postgresql", 5432, "", "mydb"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			cfg, err := pq.NewConfig(pqURL(tc.url))
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %v", pqURL(tc.url), err)
+			}
+			if cfg.Host != tc.host || cfg.Port != tc.port || cfg.Database != tc.db || tc.user != "" && cfg.User != tc.user {
+				t.Errorf("expected %s:%d user %q db %q, got %s:%d user %q db %q", tc.host, tc.port, tc.user, tc.db, cfg.Host, cfg.Port, cfg.User, cfg.Database)
+			}
+		})
+	}
+
+	if _, ok := pqSocketURL("postgres://app@db.internal/mydb"); ok {
+		t.Error("expected a TCP URL to be left alone")
+	}
+}
+
+func TestOpenDBSocket(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", filepath.Join(dir, ".s.PGSQL.5432"))
+	if err != nil {
+		t.Skipf("no unix sockets: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan bool, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- true
+			c.Close()
+		}
+	}()
+
+	// The socket is dialed as is, whatever the IP family.
+	db, err := openDB("postgres", "postgres://app@"+strings.ReplaceAll(dir, "/", "%2F")+"/mydb", nil, "ipv6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Ping()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the agent to connect to the socket")
+	}
+}
+
+func TestPeerAuthHint(t *testing.T) {
+	peer := &pq.Error{Code: "28000", Message: `Peer authentication failed for user "app"`}
+	err := peerAuthHint(peer)
+	if !strings.Contains(err.Error(), "OS user the agent runs as") {
+		t.Errorf("expected a hint, got %v", err)
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || errorCode(err) != errorCode(peer) {
+		t.Errorf("expected the hint to keep the driver error, got %v", err)
+	}
+	if other := errors.New("connection refused"); peerAuthHint(other) != other {
+		t.Error("expected other errors to be left alone")
+	}
+}
@@ -0,0 +1,251 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// spillCharge is how much of the disk quota a spill file takes at a time.
+const spillCharge = 64 << 10
+
+// spillChunkRows is the chunk size of spilled results sent to a message
+// without its own chunk_size.
+const spillChunkRows = 1000
+
+type spillKey struct{}
+
+// withSpill marks ctx's query as allowed to spill.
+func withSpill(ctx context.Context) context.Context {
+	return context.WithValue(ctx, spillKey{}, true)
+}
+
+// resultLimit is how much of query id's result fetchRows may hold, and
+// where it put the rest.
+type resultLimit struct {
+	id    string
+	max   int64
+	spill bool
+	// dir is where spill files go, and quota what they are charged to.
+	dir   string
+	quota *diskQuota
+	// spilled is set once the rows went to disk.
+	spilled *spilledRows
+}
+
+// resultLimit returns the limit for query id running under ctx, or nil if
+// results are unlimited. --max-result-bytes caps the rows of a Postgres or
+// CockroachDB result the agent holds in memory, as estimated by rowBytes.
+// Bigger results fail with too_large, unless the query asked to spill and
+// there is a --spill-dir: then the rows go to a file there and are
+// streamed to the hub from it.
+func (a *Agent) resultLimit(ctx context.Context, id string) *resultLimit {
+	if a.opts.MaxResultBytes <= 0 {
+		return nil
+	}
+	spill, _ := ctx.Value(spillKey{}).(bool)
+	return &resultLimit{id: id, max: a.opts.MaxResultBytes, spill: spill && a.opts.SpillDir != "", dir: a.opts.SpillDir, quota: a.quota}
+}
+
+// another returns the limit for another result set of the same query,
+// which is held to the same size and doesn't spill.
+func (l *resultLimit) another(id string) *resultLimit {
+	if l == nil {
+		return nil
+	}
+	return &resultLimit{id: id, max: l.max}
+}
+
+// overflow is called when rows, the result so far, went over the limit.
+// It moves them to a spill file or fails the query.
+func (l *resultLimit) overflow(rows [][]any) error {
+	if !l.spill {
+		return codedErrorf(codeTooLarge, "result is larger than %d bytes; set \"spill\" on the query to stream it from disk, or add a LIMIT", l.max)
+	}
+	s, err := newSpill(l.dir, l.quota)
+	if err != nil {
+		return fmt.Errorf("spill result: %w", err)
+	}
+	log.Printf("[query:%s] Result is over %d bytes; spilling rows to %s", l.id, l.max, s.path)
+	for _, row := range rows {
+		if err := s.write(row); err != nil {
+			s.remove()
+			return fmt.Errorf("spill result: %w", err)
+		}
+	}
+	l.spilled = s
+	return nil
+}
+
+// rowBytes estimates the JSON size of row.
+func rowBytes(row []any) int64 {
+	n := int64(2)
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			n += int64(len(v)) + 3
+		case []byte:
+			n += int64(len(v))*4/3 + 3
+		default:
+			n += 9
+		}
+	}
+	return n
+}
+
+// spilledRows are a result's rows kept on disk, one JSON array per line.
+type spilledRows struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	rows int
+	// size is the bytes written, charged those taken from the disk quota.
+	size, charged int64
+	// limit, when set, is the most rows sent; see Capabilities.limitRows.
+	limit int
+	quota *diskQuota
+}
+
+func newSpill(dir string, quota *diskQuota) (*spilledRows, error) {
+	f, err := os.CreateTemp(dir, "peekdb-spill-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &spilledRows{path: f.Name(), f: f, w: bufio.NewWriterSize(f, 64*1024), quota: quota}, nil
+}
+
+func (s *spilledRows) write(row []any) error {
+	buf, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	s.size += int64(len(buf)) + 1
+	for s.size > s.charged {
+		if err := s.quota.charge(diskSpill, spillCharge); err != nil {
+			return err
+		}
+		s.charged += spillCharge
+	}
+	s.w.Write(buf)
+	s.rows++
+	return s.w.WriteByte('\n')
+}
+
+// finish flushes the rows written so far to disk.
+func (s *spilledRows) finish() error {
+	return s.w.Flush()
+}
+
+// count is the number of rows that will be sent.
+func (s *spilledRows) count() int {
+	if s.limit > 0 && s.limit < s.rows {
+		return s.limit
+	}
+	return s.rows
+}
+
+// each reads the rows back in batches of size and passes them to f.
+func (s *spilledRows) each(size int, f func(rows [][]any) error) error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReaderSize(s.f, 64*1024))
+	dec.UseNumber()
+	left := s.count()
+	for left > 0 {
+		batch := make([][]any, 0, min(size, left))
+		for len(batch) < cap(batch) {
+			var row []any
+			if err := dec.Decode(&row); err != nil {
+				return fmt.Errorf("read spilled rows: %w", err)
+			}
+			batch = append(batch, row)
+		}
+		left -= len(batch)
+		if err := f(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spilledRows) remove() {
+	s.quota.release(diskSpill, s.charged)
+	s.charged = 0
+	s.f.Close()
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Could not remove spill file %s: %v", s.path, err)
+	}
+}
+
+// rowCount is the number of rows resp sends, spilled or not.
+func (resp QueryResponse) rowCount() int {
+	if resp.spill != nil {
+		return resp.spill.count()
+	}
+	return len(resp.Rows)
+}
+
+// writeSpilled sends a spilled result as chunks, as writeChunks does, and
+// removes its file. Cell truncation and the number format apply to each
+// chunk as it is read back, since the rows were never in the response.
+func writeSpilled(w replyWriter, msg Message, resp QueryResponse) error {
+	defer resp.spill.remove()
+	a := msg.agent()
+	start := time.Now()
+	size := msg.ChunkSize
+	if size <= 0 {
+		size = spillChunkRows
+	}
+	var crc uint32
+	seq, sent := 0, 0
+	err := resp.spill.each(size, func(rows [][]any) error {
+		part := QueryResponse{ID: resp.ID, Rows: rows}
+		a.truncateCellsFrom(&part, sent)
+		formatNumbers(&part, msg.numberFormat())
+		resp.Truncated = append(resp.Truncated, part.Truncated...)
+		for _, row := range rows {
+			buf, err := json.Marshal(row)
+			if err != nil {
+				return fmt.Errorf("encode row: %w", err)
+			}
+			crc = crc32.Update(crc, castagnoli, append(buf, '\n'))
+		}
+		chunk := ResultChunk{ID: resp.ID, Type: "result_chunk", Seq: seq, Rows: rows}
+		if seq == 0 {
+			chunk.Columns, chunk.ColumnTypes = resp.Columns, resp.ColumnTypes
+		}
+		seq++
+		sent += len(rows)
+		return w.WriteJSON(chunk)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[query:%s] Sent %d spilled rows in %d chunks", resp.ID, sent, seq)
+	a.annotateTruncated(&resp, len(resp.Truncated))
+	end := resultEnd(resp, seq, sent, fmt.Sprintf("crc32c:%08x", crc))
+	end.Spilled = true
+	end.Timing = resp.Timing.withSerialize(start, w)
+	return w.WriteJSON(end)
+}
+
+// cleanSpillDir removes the spill files in dir left by an agent that
+// stopped while sending them.
+func cleanSpillDir(dir string) {
+	if dir == "" {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "peekdb-spill-*.jsonl"))
+	for _, p := range paths {
+		os.Remove(p)
+	}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSpill(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	dir := t.TempDir()
+	sc := &sqlConnector{db: mockDB, flavor: "postgres"}
+	tn := testTenant(&connection{Name: "main", Connector: sc})
+	tn.agent.opts.MaxResultBytes, tn.agent.opts.SpillDir = 100, dir
+	sc.agent = tn.agent
+	tn.setCapabilities(&Capabilities{MaxRows: 40})
+	expect := func() {
+		rows := sqlmock.NewRowsWithColumnDefinition(sqlmock.NewColumn("id").OfType("INT8", int64(0)), sqlmock.NewColumn("name").OfType("TEXT", ""))
+		for i := 0; i < 50; i++ {
+			rows.AddRow(i, strings.Repeat("x", 10))
+		}
+		mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+		mock.ExpectQuery("SELECT id, name FROM orders").WillReturnRows(rows)
+	}
+
+	// Without asking to spill, the result is too large.
+	expect()
+	resp := runQuery(Message{ID: "q1", Type: "query", SQL: "SELECT id, name FROM orders", tenant: tn})
+	if resp.ErrorCode != codeTooLarge {
+		t.Fatalf("expected %s, got %+v", codeTooLarge, resp)
+	}
+
+	tn.setNumberFormat("string")
+	expect()
+	msg := Message{ID: "q2", Type: "query", SQL: "SELECT id, name FROM orders", Spill: true, ChunkSize: 15, tenant: tn}
+	resp = runQuery(msg)
+	if resp.Error != "" || resp.spill == nil || len(resp.Rows) != 0 {
+		t.Fatalf("expected a spilled result, got %+v", resp)
+	}
+	if resp.RowLimit != 40 || resp.rowCount() != 40 {
+		t.Errorf("expected max_rows to cut the spilled rows to 40, got row_limit %d, %d rows", resp.RowLimit, resp.rowCount())
+	}
+
+	w := &recordingWriter{}
+	if err := writeReply(w, msg, resp); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	rows := 0
+	for _, f := range w.frames {
+		types = append(types, f["type"].(string))
+		if f["type"] == "result_chunk" {
+			rows += len(f["rows"].([]any))
+		}
+	}
+	if strings.Join(types, ",") != "result_chunk,result_chunk,result_chunk,result_end" || rows != 40 {
+		t.Errorf("expected 40 rows in 3 chunks then the end, got %v with %d rows", types, rows)
+	}
+	if end := w.frames[len(w.frames)-1]; end["spilled"] != true || end["row_count"] != float64(40) {
+		t.Errorf("expected a spilled result_end with 40 rows, got %v", end)
+	}
+	// The fields that aren't rows survive the trip through the file.
+	if types, _ := w.frames[0]["column_types"].([]any); len(types) != 2 {
+		t.Errorf("expected column_types on the first chunk, got %v", w.frames[0])
+	}
+	if end := w.frames[len(w.frames)-1]; end["row_limit"] != float64(40) || end["backend_pid"] != float64(4242) {
+		t.Errorf("expected row_limit and backend_pid on result_end, got %v", end)
+	}
+	if _, err := os.Stat(resp.spill.path); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed, got %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("expected an empty spill directory, got %v", left)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package agent
+
+import (
+	"strings"
+)
+
+// This is not a full SQL parser. It tokenizes a statement well enough to
+// tell what kind of statement it is and which tables it names, which is all
+// the usage accounting needs. Dialect details it doesn't know about degrade
+// to a missed or extra table name, never an error.
+
+type sqlToken struct {
+	text   string
+	quoted bool
+	// end is the offset just past the token in the statement.
+	end int
+}
+
+// word returns the token upper-cased when it is a bare word, or "" for
+// quoted identifiers and punctuation.
+func (t sqlToken) word() string {
+	if t.quoted || t.text == "" || !isIdentByte(t.text[0]) {
+		return ""
+	}
+	return strings.ToUpper(t.text)
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// sqlTokens splits q into words, quoted identifiers and single-character
+// punctuation. String literals, numbers, parameters and comments are dropped.
+func sqlTokens(q string) []sqlToken {
+	var toks []sqlToken
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '\'':
+			end := strings.IndexByte(q[i+1:], '\'')
+			for end >= 0 && i+end+2 < len(q) && q[i+end+2] == '\'' {
+				// '' escapes a quote inside the literal.
+				next := strings.IndexByte(q[i+end+3:], '\'')
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += next + 2
+			}
+			if end < 0 {
+				return toks
+			}
+			i += end + 1
+		case c == '"' || c == '`':
+			// A doubled quote is a quote inside the identifier.
+			var text strings.Builder
+			j := i + 1
+			for {
+				end := strings.IndexByte(q[j:], c)
+				if end < 0 {
+					return toks
+				}
+				text.WriteString(q[j : j+end])
+				j += end + 1
+				if j == len(q) || q[j] != c {
+					break
+				}
+				text.WriteByte(c)
+				j++
+			}
+			toks = append(toks, sqlToken{text: text.String(), quoted: true, end: j})
+			i = j - 1
+		case c == '-' && i+1 < len(q) && q[i+1] == '-':
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				return toks
+			}
+			i += end
+		case c == '/' && i+1 < len(q) && q[i+1] == '*':
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				return toks
+			}
+			i += end + 3
+		case isIdentByte(c):
+			j := i + 1
+			for j < len(q) && (isIdentByte(q[j]) || q[j] >= '0' && q[j] <= '9' || q[j] == '$') {
+				j++
+			}
+			toks = append(toks, sqlToken{text: q[i:j], end: j})
+			i = j - 1
+		case c >= '0' && c <= '9' || c == '$' || c == ':' && i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9':
+			j := i + 1
+			for j < len(q) && (q[j] >= '0' && q[j] <= '9' || q[j] == '.') {
+				j++
+			}
+			i = j - 1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			toks = append(toks, sqlToken{text: q[i : i+1], end: i + 1})
+		}
+	}
+	return toks
+}
+
+// aliasStop lists the words that can follow a table name without being its
+// alias.
+var aliasStop = map[string]bool{
+	"WHERE": true, "JOIN": true, "LEFT": true, "RIGHT": true, "INNER": true,
+	"OUTER": true, "FULL": true, "CROSS": true, "NATURAL": true, "ON": true,
+	"USING": true, "GROUP": true, "ORDER": true, "LIMIT": true, "OFFSET": true,
+	"HAVING": true, "UNION": true, "EXCEPT": true, "INTERSECT": true, "SET": true,
+	"VALUES": true, "SELECT": true, "RETURNING": true, "WINDOW": true,
+	"FETCH": true, "FOR": true, "DEFAULT": true, "OVERRIDING": true,
+	"TABLESAMPLE": true, "WITH": true, "AS": true,
+}
+
+// readStatements are the statement kinds a read-only connection accepts.
+var readStatements = map[string]bool{
+	"select":   true,
+	"show":     true,
+	"explain":  true,
+	"describe": true,
+	"values":   true,
+	"table":    true,
+}
+
+// classifyStatement returns the lower-case statement kind ("select",
+// "insert", "update", "delete", or the leading keyword of anything else) and
+// the tables the statement reads or writes, as written in the query.
+func classifyStatement(q string) (string, []string) {
+	toks := sqlTokens(q)
+
+	kind := ""
+	depth := 0
+	for _, t := range toks {
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		switch w := t.word(); w {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE":
+			if depth == 0 && kind == "" {
+				kind = strings.ToLower(w)
+			}
+		}
+	}
+	if kind == "" && len(toks) > 0 {
+		if w := toks[0].word(); w != "" {
+			kind = strings.ToLower(w)
+		} else if len(toks) > 1 && toks[1].word() == "SELECT" {
+			kind = "select"
+		}
+	}
+	if kind == "" {
+		kind = "other"
+	}
+
+	var tables []string
+	seen := map[string]bool{}
+	for _, r := range tableRefs(toks) {
+		if !seen[r.name] {
+			seen[r.name] = true
+			tables = append(tables, r.name)
+		}
+	}
+	return kind, tables
+}
+
+// classifyStatements is classifyStatement for everything q runs: each of
+// its statements, and data-modifying statements nested in them, such as a
+// DELETE in a WITH clause. The kind is the first statement's unless
+// something in q isn't a read, in which case it is the first such kind, so
+// a read-only check can't be passed by following a SELECT with a COMMIT or
+// a DELETE. The tables are those of every statement.
+func classifyStatements(q string) (string, []string) {
+	kind := ""
+	var tables []string
+	seen := map[string]bool{}
+	for _, stmt := range splitStatements(q) {
+		k, ts := classifyStatement(stmt)
+		if readStatements[k] {
+			k = nestedWrite(stmt, k)
+		}
+		if kind == "" || readStatements[kind] && !readStatements[k] {
+			kind = k
+		}
+		for _, t := range ts {
+			if !seen[t] {
+				seen[t] = true
+				tables = append(tables, t)
+			}
+		}
+	}
+	if kind == "" {
+		kind = "other"
+	}
+	return kind, tables
+}
+
+// nestedWrite returns the kind of the first INSERT, UPDATE, DELETE or MERGE
+// anywhere in stmt, or kind when there is none. SELECT ... FOR UPDATE and
+// FOR NO KEY UPDATE only lock rows.
+func nestedWrite(stmt, kind string) string {
+	toks := sqlTokens(stmt)
+	for i, t := range toks {
+		switch w := t.word(); w {
+		case "UPDATE":
+			if i > 0 && (toks[i-1].word() == "FOR" || toks[i-1].word() == "KEY") {
+				continue
+			}
+			fallthrough
+		case "INSERT", "DELETE", "MERGE":
+			return strings.ToLower(w)
+		}
+	}
+	return kind
+}
+
+// tableRef is a table named after FROM, JOIN, INTO or UPDATE.
+type tableRef struct {
+	name    string
+	keyword string
+	// parts are the name's identifiers, as written.
+	parts []sqlToken
+	// nameEnd and aliasEnd are the offsets just past the name and past its
+	// alias, or the name again when there is none.
+	nameEnd, aliasEnd int
+}
+
+// tableRefs lists the table references in toks, in order, leaving out
+// names introduced by WITH.
+func tableRefs(toks []sqlToken) []tableRef {
+	ctes := map[string]bool{}
+	for i := 0; i+2 < len(toks); i++ {
+		if toks[i+1].word() == "AS" && toks[i+2].text == "(" && (toks[i].quoted || toks[i].word() != "") {
+			ctes[identName(toks[i])] = true
+		}
+	}
+
+	var refs []tableRef
+
+	// funcs tracks, for each open parenthesis, whether it belongs to a
+	// function call such as EXTRACT(YEAR FROM ts); FROM inside one doesn't
+	// introduce a table.
+	var funcs []bool
+	inFunc := func() bool { return len(funcs) > 0 && funcs[len(funcs)-1] }
+
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		switch t.text {
+		case "(":
+			isFunc := i > 0 && (toks[i-1].quoted || toks[i-1].word() != "" && !aliasStop[toks[i-1].word()])
+			if i+1 < len(toks) {
+				switch toks[i+1].word() {
+				case "SELECT", "WITH", "VALUES":
+					isFunc = false
+				}
+			}
+			funcs = append(funcs, isFunc)
+			continue
+		case ")":
+			if len(funcs) > 0 {
+				funcs = funcs[:len(funcs)-1]
+			}
+			continue
+		}
+
+		w := t.word()
+		switch w {
+		case "FROM", "JOIN", "INTO", "UPDATE":
+		default:
+			continue
+		}
+		if inFunc() {
+			continue
+		}
+		if w == "UPDATE" && i > 0 {
+			// FOR UPDATE and ON CONFLICT DO UPDATE don't name a table.
+			if p := toks[i-1].word(); p == "FOR" || p == "DO" {
+				continue
+			}
+		}
+
+		for {
+			i++
+			for i < len(toks) && (toks[i].word() == "ONLY" || toks[i].word() == "LATERAL") {
+				i++
+			}
+			name, next := qualifiedName(toks, i)
+			if name == "" || w != "INTO" && next < len(toks) && toks[next].text == "(" {
+				// A subquery or a set-returning function. After INTO the
+				// parenthesis is the column list instead.
+				i--
+				break
+			}
+			ref := tableRef{name: name, keyword: w, nameEnd: toks[next-1].end}
+			for _, t := range toks[i:next] {
+				if t.quoted || t.text != "." {
+					ref.parts = append(ref.parts, t)
+				}
+			}
+			i = next
+			if i < len(toks) && toks[i].word() == "AS" {
+				i++
+			}
+			if i < len(toks) && (toks[i].quoted || toks[i].word() != "" && !aliasStop[toks[i].word()]) {
+				i++
+			}
+			ref.aliasEnd = toks[i-1].end
+			if !ctes[name] {
+				refs = append(refs, ref)
+			}
+			if w != "FROM" || i >= len(toks) || toks[i].text != "," {
+				i--
+				break
+			}
+		}
+	}
+	return refs
+}
+
+// qualifiedName reads a possibly dotted name starting at toks[i] and returns
+// it with the index of the token after it.
+func qualifiedName(toks []sqlToken, i int) (string, int) {
+	var parts []string
+	for i < len(toks) {
+		t := toks[i]
+		if !t.quoted && (t.word() == "" || aliasStop[t.word()]) {
+			break
+		}
+		parts = append(parts, identName(t))
+		i++
+		if i+1 < len(toks) && toks[i].text == "." {
+			i++
+			continue
+		}
+		break
+	}
+	return strings.Join(parts, "."), i
+}
+
+// identName folds bare identifiers to lower case the way Postgres does and
+// keeps quoted ones verbatim.
+func identName(t sqlToken) string {
+	if t.quoted {
+		return t.text
+	}
+	return strings.ToLower(t.text)
+}
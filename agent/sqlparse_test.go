@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassifyStatement(t *testing.T) {
+	testCases := []struct {
+		name       string
+		sql        string
+		wantKind   string
+		wantTables []string
+	}{
+		{
+			name:       "simple select",
+			sql:        "SELECT * FROM users WHERE id = $1",
+			wantKind:   "select",
+			wantTables: []string{"users"},
+		},
+		{
+			name:       "joins and aliases",
+			sql:        "SELECT o.id FROM public.orders o JOIN Users AS u ON u.id = o.user_id LEFT JOIN \"Line Items\" li ON li.order_id = o.id",
+			wantKind:   "select",
+			wantTables: []string{"public.orders", "users", "Line Items"},
+		},
+		{
+			name:       "doubled quotes",
+			sql:        `SELECT * FROM "Sales ""EU""".orders JOIN "a""" ON true`,
+			wantKind:   "select",
+			wantTables: []string{`Sales "EU".orders`, `a"`},
+		},
+		{
+			name:       "comma list",
+			sql:        "SELECT 1 FROM a x, b AS y, c WHERE x.id = y.id",
+			wantKind:   "select",
+			wantTables: []string{"a", "b", "c"},
+		},
+		{
+			name:       "cte and subquery",
+			sql:        "WITH recent AS (SELECT * FROM events WHERE ts > now() - interval '1 day') SELECT * FROM recent WHERE user_id IN (SELECT id FROM users)",
+			wantKind:   "select",
+			wantTables: []string{"events", "users"},
+		},
+		{
+			name:       "function with from",
+			sql:        "SELECT extract(year FROM created_at), substring(name from 2) FROM accounts",
+			wantKind:   "select",
+			wantTables: []string{"accounts"},
+		},
+		{
+			name:       "insert with columns",
+			sql:        "INSERT INTO audit (who, what) VALUES ($1, 'FROM nowhere')",
+			wantKind:   "insert",
+			wantTables: []string{"audit"},
+		},
+		{
+			name:       "insert select with upsert",
+			sql:        "INSERT INTO totals SELECT * FROM staging ON CONFLICT (id) DO UPDATE SET n = excluded.n",
+			wantKind:   "insert",
+			wantTables: []string{"totals", "staging"},
+		},
+		{
+			name:       "update",
+			sql:        "-- bump\nUPDATE ONLY inventory SET qty = qty - 1 WHERE sku = 'it''s'",
+			wantKind:   "update",
+			wantTables: []string{"inventory"},
+		},
+		{
+			name:       "delete",
+			sql:        "DELETE FROM sessions /* FROM comment */ WHERE expires < now()",
+			wantKind:   "delete",
+			wantTables: []string{"sessions"},
+		},
+		{
+			name:       "select for update",
+			sql:        "SELECT * FROM jobs FOR UPDATE SKIP LOCKED",
+			wantKind:   "select",
+			wantTables: []string{"jobs"},
+		},
+		{
+			name:     "other statement",
+			sql:      "create index on users (email)",
+			wantKind: "create",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kind, tables := classifyStatement(tc.sql)
+			if kind != tc.wantKind {
+				t.Errorf("expected kind %q, got %q", tc.wantKind, kind)
+			}
+			if !reflect.DeepEqual(tables, tc.wantTables) {
+				t.Errorf("expected tables %q, got %q", tc.wantTables, tables)
+			}
+		})
+	}
+}
+
+func TestClassifyStatements(t *testing.T) {
+	testCases := []struct {
+		sql        string
+		wantKind   string
+		wantTables []string
+	}{
+		{sql: "SELECT * FROM a; SELECT * FROM b", wantKind: "select", wantTables: []string{"a", "b"}},
+		{sql: "SELECT 1; DELETE FROM users", wantKind: "delete", wantTables: []string{"users"}},
+		{sql: "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", wantKind: "delete", wantTables: []string{"users"}},
+		{sql: "SELECT 1; COMMIT; DROP TABLE users", wantKind: "commit"},
+		{sql: "SELECT * FROM jobs FOR NO KEY UPDATE; SELECT * FROM locks FOR UPDATE", wantKind: "select", wantTables: []string{"jobs", "locks"}},
+		{sql: "SELECT 'DELETE FROM users; COMMIT'", wantKind: "select"},
+		{sql: "", wantKind: "other"},
+	}
+	for _, tc := range testCases {
+		kind, tables := classifyStatements(tc.sql)
+		if kind != tc.wantKind || !reflect.DeepEqual(tables, tc.wantTables) {
+			t.Errorf("classifyStatements(%q) = %q, %q, want %q, %q", tc.sql, kind, tables, tc.wantKind, tc.wantTables)
+		}
+	}
+}
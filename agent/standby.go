@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"log"
+	"sync"
+)
+
+// standbyState tracks an agent started with --standby as a warm standby:
+// connected and authenticated, but refusing work until promoted by the
+// hub, with a "promote" message, or by winning leader election once the
+// primary's lock is gone.
+type standbyState struct {
+	mu      sync.Mutex
+	waiting bool
+	// onPromote, if set, runs once the standby is promoted.
+	onPromote func()
+}
+
+// standbyAllowed are the messages a standby answers: none of them run
+// anything on a database.
+var standbyAllowed = map[string]bool{
+	"promote":       true,
+	"cancel":        true,
+	"history":       true,
+	"usage_report":  true,
+	"config_update": true,
+}
+
+func (s *standbyState) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.waiting
+}
+
+func (s *standbyState) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting = true
+}
+
+// whenPromoted sets f to run once the standby is promoted.
+func (s *standbyState) whenPromoted(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onPromote = f
+}
+
+// promote starts serving, if the agent wasn't already, and logs why, also
+// to r.
+func (s *standbyState) promote(reason string, r *sentryReporter) {
+	s.mu.Lock()
+	was, then := s.waiting, s.onPromote
+	s.waiting = false
+	s.mu.Unlock()
+	if was {
+		log.Printf("Promoted from standby: %s", reason)
+		r.breadcrumb("standby", "promoted: %s", reason)
+		if then != nil {
+			then()
+		}
+	}
+}
+
+// StandbyResponse answers a "promote" message.
+type StandbyResponse struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Standby bool   `json:"standby"`
+}
+
+func promote(msg Message) StandbyResponse {
+	a := msg.agent()
+	a.standby.promote("the hub asked", a.reporter)
+	return StandbyResponse{ID: msg.ID, Type: "promote", Standby: !a.standby.active()}
+}
+
+// refuseOnStandby returns the reply for a message a waiting standby won't
+// serve, or nil to handle it.
+func refuseOnStandby(msg Message) any {
+	if msg.agent().standby.active() || standbyAllowed[msg.Type] {
+		return nil
+	}
+	return queryError(msg.ID, codedErrorf(codeStandby, "this agent is a standby and serves nothing until promoted"))
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStandby(t *testing.T) {
+	tn := testTenant()
+	tn.agent.standby.wait()
+
+	resp, ok := handleMessage(Message{Type: "query", ID: "q1", SQL: "SELECT 1", tenant: tn}).(QueryResponse)
+	if !ok || resp.ErrorCode != codeStandby {
+		t.Fatalf("expected a standby refusal, got %+v", resp)
+	}
+	if _, ok := handleMessage(Message{Type: "history", ID: "h1", tenant: tn}).(HistoryResponse); !ok {
+		t.Error("expected a standby to answer history")
+	}
+
+	if r := handleMessage(Message{Type: "promote", ID: "p1", tenant: tn}).(StandbyResponse); r.Standby {
+		t.Errorf("expected promotion, got %+v", r)
+	}
+	if resp := refuseOnStandby(Message{Type: "query", ID: "q2", tenant: tn}); resp != nil {
+		t.Errorf("expected queries to be served after promotion, got %+v", resp)
+	}
+}
+
+func TestStandbyPromotedByElection(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	standby := &standbyState{}
+	standby.wait()
+
+	e := newElector("main", "billing", db)
+	e.onLead = func() { standby.promote("elected", nil) }
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock`).WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	e.step(context.Background())
+	if !standby.active() {
+		t.Error("expected winning the election to promote the standby")
+	}
+}
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressf logs a startup or connection progress line unless --quiet,
+// which leaves warnings, errors and queries.
+func (a *Agent) progressf(format string, args ...any) {
+	if !a.opts.Quiet {
+		log.Printf(format, args...)
+	}
+}
+
+func (t *tenant) progressf(format string, args ...any) {
+	if !t.agent.opts.Quiet {
+		t.logf(format, args...)
+	}
+}
+
+// StartupStatus is what --status-json writes once the agent has started,
+// or failed to: whether each database connection opened and each token
+// authenticated with its hub. OK is true when all of them did.
+type StartupStatus struct {
+	OK          bool                `json:"ok"`
+	Version     string              `json:"version"`
+	AgentID     string              `json:"agent_id"`
+	Error       string              `json:"error,omitempty"`
+	Connections []ConnectionStartup `json:"connections"`
+	Hubs        []HubStartup        `json:"hubs"`
+}
+
+type ConnectionStartup struct {
+	Name   string `json:"name"`
+	Flavor string `json:"flavor"`
+	OK     bool   `json:"ok"`
+}
+
+type HubStartup struct {
+	// Tenant is the token's name from the config; empty for --token.
+	Tenant string `json:"tenant,omitempty"`
+	Hub    string `json:"hub"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startupWait is how long the report waits for every hub to answer.
+var startupWait = 2 * time.Minute
+
+// startupReport collects the StartupStatus and writes it once to path,
+// "-" meaning stdout. A nil report collects nothing.
+type startupReport struct {
+	path string
+
+	mu      sync.Mutex
+	status  StartupStatus
+	pending map[*tenant]int // index into status.Hubs
+	written bool
+	done    chan struct{}
+}
+
+func newStartupReport(path, agentID, version string) *startupReport {
+	if path == "" {
+		return nil
+	}
+	return &startupReport{path: path, status: StartupStatus{Version: version, AgentID: agentID, Connections: []ConnectionStartup{}, Hubs: []HubStartup{}}}
+}
+
+// fail writes the report for an agent that couldn't start.
+func (r *startupReport) fail(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Error = err.Error()
+	r.write()
+}
+
+// started records the open connections and the tenants about to connect,
+// and writes the report once each tenant has reported, after
+// startupWait, or when ctx is cancelled, whichever is first.
+func (r *startupReport) started(ctx context.Context, conns []*connection, tenants []*tenant) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	for _, c := range conns {
+		r.status.Connections = append(r.status.Connections, ConnectionStartup{Name: c.Name, Flavor: c.Flavor(), OK: true})
+	}
+	r.pending = map[*tenant]int{}
+	for _, t := range tenants {
+		r.pending[t] = len(r.status.Hubs)
+		r.status.Hubs = append(r.status.Hubs, HubStartup{Tenant: t.name, Hub: t.hubURL(), Error: "no answer from the hub yet"})
+	}
+	r.done = make(chan struct{})
+	if len(r.pending) == 0 {
+		close(r.done)
+	}
+	r.mu.Unlock()
+
+	go func() {
+		select {
+		case <-r.done:
+		case <-time.After(startupWait):
+		case <-ctx.Done():
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.write()
+	}()
+}
+
+// hub records how t's first hub connection went: err is nil once it
+// authenticated. Later connections don't change the report.
+func (r *startupReport) hub(t *tenant, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.pending[t]
+	if !ok {
+		return
+	}
+	delete(r.pending, t)
+	h := &r.status.Hubs[i]
+	h.OK, h.Error = err == nil, ""
+	if err != nil {
+		h.Error = err.Error()
+	}
+	if len(r.pending) == 0 {
+		close(r.done)
+	}
+}
+
+// write writes the report if it hasn't been. Callers hold r.mu.
+func (r *startupReport) write() {
+	if r.written {
+		return
+	}
+	r.written = true
+	s := &r.status
+	s.OK = s.Error == "" && len(s.Hubs) > 0
+	for _, h := range s.Hubs {
+		s.OK = s.OK && h.OK
+	}
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("Could not write the startup status: %v", err)
+		return
+	}
+	buf = append(buf, '\n')
+	if r.path == "-" {
+		os.Stdout.Write(buf)
+		return
+	}
+	// Written whole and then renamed, so nothing polling for the file
+	// reads half of it.
+	tmp := r.path + ".tmp"
+	err = os.WriteFile(tmp, buf, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, r.path)
+	}
+	if err != nil {
+		log.Printf("Could not write the startup status to %s: %v", r.path, err)
+	}
+}
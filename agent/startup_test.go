@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readStartup(t *testing.T, path string) (StartupStatus, bool) {
+	t.Helper()
+	var s StartupStatus
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return s, false
+	}
+	if err := json.Unmarshal(buf, &s); err != nil {
+		t.Fatalf("startup status is not JSON: %v: %s", err, buf)
+	}
+	return s, true
+}
+
+func TestStartupReport(t *testing.T) {
+	dir := t.TempDir()
+	conns := []*connection{{Name: "main", Connector: &sqlConnector{flavor: "postgres"}}}
+	main := testTenant(conns...)
+	a := main.agent
+	a.opts.HubURL, a.opts.AgentID, a.opts.Version = "wss://hub.example.com/agent", "web-1", "v1.9.0"
+	eu := &tenant{agent: a, name: "eu", hub: "wss://eu.example.com/agent"}
+
+	path := filepath.Join(dir, "ok.json")
+	r := newStartupReport(path, "web-1", "v1.9.0")
+	r.started(context.Background(), conns, []*tenant{main, eu})
+	r.hub(eu, errors.New("authentication failed: bad token"))
+	if _, ok := readStartup(t, path); ok {
+		t.Fatal("expected no report until every hub has answered")
+	}
+	// A later failure of a tenant that connected doesn't change anything.
+	r.hub(main, nil)
+	r.hub(main, errors.New("read failed"))
+
+	var s StartupStatus
+	var ok bool
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		s, ok = readStartup(t, path)
+	}
+	want := StartupStatus{
+		OK:          false,
+		Version:     "v1.9.0",
+		AgentID:     "web-1",
+		Connections: []ConnectionStartup{{Name: "main", Flavor: "postgres", OK: true}},
+		Hubs: []HubStartup{
+			{Hub: "wss://hub.example.com/agent", OK: true},
+			{Tenant: "eu", Hub: "wss://eu.example.com/agent", Error: "authentication failed: bad token"},
+		},
+	}
+	if got, _ := json.Marshal(s); string(got) != string(must(json.Marshal(want))) {
+		t.Errorf("expected %s, got %s", must(json.Marshal(want)), got)
+	}
+
+	// An agent that can't start says why.
+	path = filepath.Join(dir, "fail.json")
+	newStartupReport(path, "web-1", "v1.9.0").fail(errors.New("database connection failed: connection refused"))
+	if s, _ := readStartup(t, path); s.OK || s.Error != "database connection failed: connection refused" {
+		t.Errorf("expected the failure reported, got %+v", s)
+	}
+
+	// A hub that never answers is reported as such.
+	wait := startupWait
+	startupWait = 10 * time.Millisecond
+	defer func() { startupWait = wait }()
+	path = filepath.Join(dir, "slow.json")
+	newStartupReport(path, "web-1", "v1.9.0").started(context.Background(), conns, []*tenant{main})
+	ok = false
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		s, ok = readStartup(t, path)
+	}
+	if s.OK || len(s.Hubs) != 1 || s.Hubs[0].Error != "no answer from the hub yet" {
+		t.Errorf("expected the silent hub reported, got %+v", s)
+	}
+}
+
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestQuietStatusJSON(t *testing.T) {
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer search.Close()
+	hub := httptest.NewServer(newDevHub("dev").handler())
+	defer hub.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(t.TempDir(), "status.json")
+	opts := DefaultOptions()
+	opts.Token = "dev"
+	opts.HubURL = "ws" + strings.TrimPrefix(hub.URL, "http") + "/agent"
+	opts.DatabaseURL = "elasticsearch://" + strings.TrimPrefix(search.URL, "http://") + "?tls=false"
+	opts.Quiet, opts.StatusJSON = true, path
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	var s StartupStatus
+	var ok bool
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		s, ok = readStartup(t, path)
+	}
+	cancel()
+	<-done
+	if !s.OK || len(s.Connections) != 1 || s.Connections[0].Flavor != "elasticsearch" || len(s.Hubs) != 1 || !s.Hubs[0].OK {
+		t.Errorf("expected a successful startup, got %+v", s)
+	}
+	for _, line := range []string{"starting", "Authenticating", "Ready and waiting"} {
+		if strings.Contains(logs.String(), line) {
+			t.Errorf("expected --quiet to leave %q out of the log, got:\n%s", line, logs.String())
+		}
+	}
+}
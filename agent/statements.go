@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TopQueriesResponse answers a "top_queries" message from the
+// pg_stat_statements extension.
+type TopQueriesResponse struct {
+	ID      string     `json:"id"`
+	Type    string     `json:"type"`
+	Queries []TopQuery `json:"queries"`
+	Error   string     `json:"error,omitempty"`
+
+	Connection string `json:"connection,omitempty"`
+}
+
+type TopQuery struct {
+	QueryID     string  `json:"query_id"`
+	Query       string  `json:"query"`
+	Calls       int64   `json:"calls"`
+	TotalMillis float64 `json:"total_ms"`
+	MeanMillis  float64 `json:"mean_ms"`
+	Rows        int64   `json:"rows"`
+	SharedHit   int64   `json:"shared_blks_hit"`
+	SharedRead  int64   `json:"shared_blks_read"`
+	// IOBlocks sums blocks read and written: shared, local and temp.
+	IOBlocks int64 `json:"io_blocks"`
+}
+
+const (
+	defaultTopQueries = 20
+	maxTopQueries     = 500
+	statusTopQueries  = 10
+)
+
+// topQueryOrder maps the order_by values the hub may send onto columns of
+// the query below.
+var topQueryOrder = map[string]string{
+	"":           "total_ms",
+	"total_time": "total_ms",
+	"mean_time":  "mean_ms",
+	"calls":      "calls",
+	"io":         "io_blocks",
+}
+
+func topQueries(msg Message) TopQueriesResponse {
+	resp := TopQueriesResponse{ID: msg.ID, Type: "top_queries"}
+	c, err := msg.route()
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		resp.Error = fmt.Sprintf("top_queries is not supported for %s", c.Flavor())
+		return resp
+	}
+
+	limit := msg.Limit
+	if limit <= 0 {
+		limit = defaultTopQueries
+	}
+	if limit > maxTopQueries {
+		limit = maxTopQueries
+	}
+
+	log.Printf("[top_queries:%s] Reading pg_stat_statements", msg.ID)
+	start := time.Now()
+	queries, err := loadTopQueries(sc.db, msg.OrderBy, limit)
+	if err != nil {
+		log.Printf("[top_queries:%s] Error: %v", msg.ID, err)
+		resp.Error = err.Error()
+		return resp
+	}
+	log.Printf("[top_queries:%s] Completed in %v, %d queries", msg.ID, time.Since(start), len(queries))
+	resp.Queries = queries
+	return resp
+}
+
+// errNoStatStatements is returned when the extension isn't installed in the
+// connected database.
+var errNoStatStatements = errors.New("pg_stat_statements is not installed in this database")
+
+func loadTopQueries(q queryer, orderBy string, limit int) ([]TopQuery, error) {
+	order, ok := topQueryOrder[orderBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown order_by %q: expected total_time, mean_time, calls or io", orderBy)
+	}
+
+	version, err := statStatementsVersion(q)
+	if err != nil {
+		return nil, err
+	}
+	// Version 1.8 (Postgres 13) split planning from execution time.
+	totalCol, meanCol := "total_exec_time", "mean_exec_time"
+	if versionLess(version, "1.8") {
+		totalCol, meanCol = "total_time", "mean_time"
+	}
+
+	rows, err := q.Query(fmt.Sprintf(`
+SELECT coalesce(queryid::text, ''), query, calls, %s AS total_ms, %s AS mean_ms, rows,
+       shared_blks_hit, shared_blks_read,
+       shared_blks_read + shared_blks_written + local_blks_read + local_blks_written
+         + temp_blks_read + temp_blks_written AS io_blocks
+FROM pg_stat_statements
+WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+ORDER BY %s DESC
+LIMIT $1`, totalCol, meanCol, order), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := []TopQuery{}
+	for rows.Next() {
+		var t TopQuery
+		if err := rows.Scan(&t.QueryID, &t.Query, &t.Calls, &t.TotalMillis, &t.MeanMillis, &t.Rows,
+			&t.SharedHit, &t.SharedRead, &t.IOBlocks); err != nil {
+			return nil, err
+		}
+		queries = append(queries, t)
+	}
+	return queries, rows.Err()
+}
+
+func statStatementsVersion(q queryer) (string, error) {
+	rows, err := q.Query("SELECT extversion FROM pg_extension WHERE extname = 'pg_stat_statements'")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var version sql.NullString
+	if rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return "", err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if !version.Valid {
+		return "", errNoStatStatements
+	}
+	return version.String, nil
+}
+
+// versionLess compares dotted numeric versions such as "1.10" and "1.8".
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
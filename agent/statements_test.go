@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadTopQueries(t *testing.T) {
+	cols := []string{"queryid", "query", "calls", "total_ms", "mean_ms", "rows",
+		"shared_blks_hit", "shared_blks_read", "io_blocks"}
+
+	testCases := []struct {
+		name      string
+		orderBy   string
+		mockSetup func(sqlmock.Sqlmock)
+		wantLen   int
+		wantErr   string
+	}{
+		{
+			name:    "postgres 13 columns",
+			orderBy: "calls",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT extversion FROM pg_extension").
+					WillReturnRows(sqlmock.NewRows([]string{"extversion"}).AddRow("1.10"))
+				mock.ExpectQuery(`total_exec_time AS total_ms, mean_exec_time AS mean_ms(.|\n)*ORDER BY calls DESC`).
+					WithArgs(5).
+					WillReturnRows(sqlmock.NewRows(cols).
+						AddRow("-123", "SELECT * FROM users WHERE id = $1", 900, 1500.5, 1.67, 900, 4000, 12, 30).
+						AddRow("456", "UPDATE users SET seen = now()", 10, 99.0, 9.9, 10, 50, 2, 7))
+			},
+			wantLen: 2,
+		},
+		{
+			name: "older extension",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT extversion FROM pg_extension").
+					WillReturnRows(sqlmock.NewRows([]string{"extversion"}).AddRow("1.7"))
+				mock.ExpectQuery(`total_time AS total_ms, mean_time AS mean_ms(.|\n)*ORDER BY total_ms DESC`).
+					WithArgs(5).
+					WillReturnRows(sqlmock.NewRows(cols))
+			},
+			wantLen: 0,
+		},
+		{
+			name: "not installed",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT extversion FROM pg_extension").
+					WillReturnRows(sqlmock.NewRows([]string{"extversion"}))
+			},
+			wantErr: "pg_stat_statements is not installed in this database",
+		},
+		{
+			name:      "bad order",
+			orderBy:   "random",
+			mockSetup: func(sqlmock.Sqlmock) {},
+			wantErr:   `unknown order_by "random": expected total_time, mean_time, calls or io`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer mockDB.Close()
+			tc.mockSetup(mock)
+
+			queries, err := loadTopQueries(mockDB, tc.orderBy, 5)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(queries) != tc.wantLen {
+					t.Fatalf("expected %d queries, got %d", tc.wantLen, len(queries))
+				}
+				if tc.wantLen > 0 && (queries[0].QueryID != "-123" || queries[0].Calls != 900 || queries[0].IOBlocks != 30) {
+					t.Errorf("unexpected first query: %+v", queries[0])
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.7", "1.8", true},
+		{"1.10", "1.8", false},
+		{"1.8", "1.8", false},
+		{"1", "1.8", true},
+	}
+	for _, tc := range testCases {
+		if got := versionLess(tc.a, tc.b); got != tc.want {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
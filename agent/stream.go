@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamWriter is implemented by reply writers that can hand out a writer
+// for one message, as websocket connections do.
+type streamWriter interface {
+	NextWriter(messageType int) (io.WriteCloser, error)
+}
+
+// streamResult writes resp as one text message, encoding its rows a batch
+// at a time straight into the message. WriteJSON would first encode the
+// whole result into a buffer as large as the message. This saves only that
+// encoded copy, and not under --record, whose tap keeps the frame to
+// record it: rows are not streamed from the database. They are all read
+// into resp before the reply is written, since limits, masking and
+// anonymization work on the complete result.
+func streamResult(w streamWriter, resp QueryResponse) error {
+	mw, err := w.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(mw, 32*1024)
+	err = writeResult(bw, resp, w)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := mw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// marshalResult is json.Marshal for a result, with its serialize time.
+func marshalResult(resp QueryResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	if err := writeResult(bw, resp, nil); err != nil {
+		return nil, err
+	}
+	bw.Flush()
+	return buf.Bytes(), nil
+}
+
+// streamBatch is how many rows are encoded at a time: enough to keep the
+// per-call cost of encoding/json small, few enough to keep the buffer so.
+const streamBatch = 256
+
+// writeResult writes resp as a JSON object. The rows come first, so the
+// other fields, encoded as usual, can carry the time the rows took in
+// resp.Timing, including any wait for the message writer w.
+func writeResult(bw *bufio.Writer, resp QueryResponse, w any) error {
+	start := time.Now()
+	rows := resp.Rows
+	resp.Rows = nil
+	if len(rows) > 0 {
+		bw.WriteString(`{"rows":[`)
+		for i := 0; i < len(rows); i += streamBatch {
+			buf, err := json.Marshal(rows[i:min(i+streamBatch, len(rows))])
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			// Drop the batch's own brackets.
+			bw.Write(buf[1 : len(buf)-1])
+		}
+		bw.WriteByte(']')
+	}
+	resp.Timing = resp.Timing.withSerialize(start, w)
+	head, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		_, err = bw.Write(head)
+		return err
+	}
+	if len(head) > 2 {
+		bw.WriteByte(',')
+	}
+	_, err = bw.Write(head[1:])
+	return err
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// bufferWriter is a streamWriter keeping each message whole.
+type bufferWriter struct {
+	messages []*bytes.Buffer
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func (w *bufferWriter) NextWriter(messageType int) (io.WriteCloser, error) {
+	buf := &bytes.Buffer{}
+	w.messages = append(w.messages, buf)
+	return nopCloser{buf}, nil
+}
+
+func (w *bufferWriter) WriteJSON(v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.messages = append(w.messages, bytes.NewBuffer(buf))
+	return nil
+}
+
+func (w *bufferWriter) WriteMessage(messageType int, data []byte) error {
+	w.messages = append(w.messages, bytes.NewBuffer(data))
+	return nil
+}
+
+func TestStreamResult(t *testing.T) {
+	tests := []struct {
+		name string
+		resp QueryResponse
+	}{
+		{name: "rows", resp: QueryResponse{ID: "q1", Type: "result", Columns: []string{"id", "name"}, Rows: [][]any{{1, "a<b"}, {2, nil}}, Connection: "main", RowLimit: 2}},
+		{name: "no rows", resp: QueryResponse{ID: "q2", Type: "result", Columns: []string{"id"}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &bufferWriter{}
+			if err := writeReply(w, Message{ID: tc.resp.ID}, tc.resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(w.messages) != 1 {
+				t.Fatalf("expected one message, got %d", len(w.messages))
+			}
+			want, _ := json.Marshal(tc.resp)
+			var got, expected any
+			if err := json.Unmarshal(w.messages[0].Bytes(), &got); err != nil {
+				t.Fatalf("invalid JSON %q: %v", w.messages[0], err)
+			}
+			json.Unmarshal(want, &expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected %s, got %s", want, w.messages[0])
+			}
+		})
+	}
+}
+
+func TestStreamResultRecorded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	r, err := openRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	resp := QueryResponse{ID: "q1", Type: "result", Columns: []string{"id"}, Rows: [][]any{{1}, {2}}}
+	streamed, whole := &bufferWriter{}, &captureWriter{}
+	for _, w := range []replyWriter{streamed, whole} {
+		if err := writeReply(r.writer(nil, w), Message{ID: resp.ID}, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := readRecording(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tap passes the stream through rather than sending the result
+	// with WriteJSON, and a writer without NextWriter gets it whole.
+	if len(streamed.messages) != 1 || len(whole.frames) != 1 || len(records) != 2 ||
+		records[0].Dir != "out" || string(records[0].Frame) != streamed.messages[0].String() ||
+		string(records[1].Frame) != string(whole.frames[0]) {
+		t.Errorf("unexpected recording %+v of %q and %q", records, streamed.messages, whole.frames)
+	}
+}
+
+type discardStream struct{}
+
+func (discardStream) NextWriter(messageType int) (io.WriteCloser, error) {
+	return nopCloser{io.Discard}, nil
+}
+
+func (discardStream) WriteJSON(v any) error {
+	// As gorilla/websocket's WriteJSON does.
+	return json.NewEncoder(io.Discard).Encode(v)
+}
+
+func (discardStream) WriteMessage(messageType int, data []byte) error { return nil }
+
+func bigResult() QueryResponse {
+	resp := QueryResponse{ID: "q1", Type: "result", Columns: []string{"id", "name", "note"}}
+	for i := 0; i < 10000; i++ {
+		resp.Rows = append(resp.Rows, []any{i, "some name", "a longer note that takes up a little space"})
+	}
+	return resp
+}
+
+func BenchmarkWriteResultJSON(b *testing.B) {
+	resp := bigResult()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		discardStream{}.WriteJSON(resp)
+	}
+}
+
+func BenchmarkWriteResultStreamed(b *testing.B) {
+	resp := bigResult()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		streamResult(discardStream{}, resp)
+	}
+}
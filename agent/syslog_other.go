@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package agent
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(LogSinkConfig) (io.Writer, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
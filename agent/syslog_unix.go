@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package agent
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog(cfg LogSinkConfig) (io.Writer, error) {
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "peekdb-agent"
+	}
+	return syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
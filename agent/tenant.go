@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// tenant is one registration with the hub: a token and the connections it
+// may use. Usually there is one, for --token and every connection; a config
+// file can list more, so one agent serves several workspaces.
+type tenant struct {
+	// agent is the Agent the tenant belongs to.
+	agent *Agent
+	// name labels the tenant's log lines and status; tokens stay out of logs.
+	name  string
+	token string
+	conns []*connection
+	// hub is the hub URL the token registers with; empty means --hub.
+	hub string
+
+	// writeMu serialises writes to ws, the hub connection, which is nil
+	// while disconnected.
+	writeMu sync.Mutex
+	ws      *websocket.Conn
+
+	mu sync.RWMutex
+	// caps holds the capabilities from the last auth response; nil means
+	// the hub sent none and nothing is restricted.
+	caps *Capabilities
+	// numberFormat is the number format the last auth response picked.
+	numberFormat string
+
+	clock hubClock
+	// sessions counts the hub connections that authenticated.
+	sessions atomic.Int64
+}
+
+// newTenants maps each configured token to the connections its targets
+// select. An empty list of targets means every connection.
+func newTenants(a *Agent, configs []TokenConfig, conns []*connection) ([]*tenant, error) {
+	var tenants []*tenant
+	seen := map[string]bool{}
+	for i, cfg := range configs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("token %d", i+1)
+		}
+		// Jobs and spooled replies are kept by tenant name.
+		if seen[name] {
+			return nil, fmt.Errorf("token name %q is used twice", name)
+		}
+		seen[name] = true
+		t := &tenant{agent: a, name: name, token: cfg.Token, hub: cfg.Hub}
+		if len(cfg.Connections) == 0 {
+			t.conns = conns
+		}
+		for _, target := range cfg.Connections {
+			matched := false
+			for _, c := range conns {
+				if c.matches(target) && !t.serves(c) {
+					t.conns = append(t.conns, c)
+				}
+				matched = matched || c.matches(target)
+			}
+			if !matched {
+				return nil, fmt.Errorf("%s: no connection matches %q", name, target)
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+func (t *tenant) hubURL() string {
+	if t.hub != "" {
+		return t.hub
+	}
+	return t.agent.opts.HubURL
+}
+
+func (t *tenant) serves(c *connection) bool {
+	for _, s := range t.conns {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tenant) logf(format string, args ...any) {
+	if t.name != "" {
+		format = "[" + t.name + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// attach makes conn the tenant's hub connection, first delivering the
+// replies spooled while it was away.
+func (t *tenant) attach(conn *websocket.Conn) error {
+	a := t.agent
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if a.spool != nil {
+		// Replies spool behind the delivery until t.ws is set, so it
+		// keeps writeMu throughout.
+		w := a.uploads.writer(conn, nil)
+		n, err := a.spool.drain(t.name, func(b []byte) error {
+			return w.WriteMessage(websocket.TextMessage, b)
+		})
+		if n > 0 {
+			t.logf("Delivered %d spooled replies", n)
+		}
+		if err != nil {
+			return fmt.Errorf("outbox delivery failed: %w", err)
+		}
+	}
+	t.ws = conn
+	return nil
+}
+
+func (t *tenant) detach() {
+	t.writeMu.Lock()
+	t.ws = nil
+	t.writeMu.Unlock()
+}
+
+// connected reports whether the tenant is attached to the hub.
+func (t *tenant) connected() bool {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.ws != nil
+}
+
+// status is the agent's status as sent to t's hub.
+func (t *tenant) status() StatusMessage {
+	status := t.agent.status(append(t.conns[:len(t.conns):len(t.conns)], t.agent.scratch.servedBy(t)...))
+	t.clock.fill(&status)
+	return status
+}
+
+// sendStatus sends the agent's status now, if the tenant is connected,
+// rather than waiting for the next interval.
+func (t *tenant) sendStatus() {
+	if !t.connected() {
+		return
+	}
+	status := t.status()
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.ws != nil {
+		t.agent.recording.record(t, "out", status)
+		if err := t.ws.WriteJSON(status); err != nil {
+			t.logf("Status send failed: %v", err)
+		}
+	}
+}
+
+// reply writes resp to the hub, or spools it when the hub is unreachable.
+// A failed write closes the connection, which ends the read loop and
+// reconnects. Under --max-upload-mbps writeMu is let go while a frame
+// waits, so the connection may have been detached by the time it fails.
+func (t *tenant) reply(msg Message, resp any) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if ws := t.ws; ws != nil {
+		a := t.agent
+		err := writeReply(a.recording.writer(t, a.uploads.writer(ws, &t.writeMu)), msg, resp)
+		if err == nil {
+			return
+		}
+		t.logf("Write failed: %v", err)
+		ws.Close()
+		if t.ws == ws {
+			t.ws = nil
+		}
+	}
+	t.spoolReply(resp)
+}
+
+// setCapabilities replaces the capabilities after each authentication.
+func (t *tenant) setCapabilities(c *Capabilities) {
+	t.mu.Lock()
+	t.caps = c
+	t.mu.Unlock()
+	if c != nil {
+		t.progressf("Hub capabilities: read_only=%t max_rows=%d allowed_schemas=%v can_export=%t",
+			c.ReadOnly, c.MaxRows, c.AllowedSchemas, c.CanExport)
+	}
+}
+
+// setNumberFormat records the number format an auth response picked; an
+// empty or unknown one means native numbers.
+func (t *tenant) setNumberFormat(f string) {
+	if f != "" && f != numberFormatNative && f != numberFormatString {
+		t.logf("Unknown number format %q; sending native numbers", f)
+		f = ""
+	}
+	t.mu.Lock()
+	t.numberFormat = f
+	t.mu.Unlock()
+}
+
+// capabilities returns the current capabilities, with no restrictions when
+// the hub sent none.
+func (t *tenant) capabilities() Capabilities {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.caps == nil {
+		return Capabilities{CanExport: true}
+	}
+	return *t.caps
+}
+
+// agent returns the Agent msg came in through. Messages built without a
+// tenant, or with one that has no Agent, as in tests, get a bare Agent of
+// their own.
+func (m Message) agent() *Agent {
+	if m.tenant == nil || m.tenant.agent == nil {
+		return bareAgent(DefaultOptions(), nil)
+	}
+	return m.tenant.agent
+}
+
+// route picks the connection msg is addressed to among those its tenant
+// serves, and the scratch databases restored from them. Messages built
+// without a tenant reach no connection.
+func (m Message) route() (*connection, error) {
+	if m.tenant == nil {
+		return route(nil, m.Target)
+	}
+	if db := m.agent().scratch.lookup(m.tenant, m.Target); db != nil {
+		return db.conn, nil
+	}
+	return route(m.tenant.conns, m.Target)
+}
+
+// capabilities returns what msg's token may do.
+func (m Message) capabilities() Capabilities {
+	if m.tenant == nil {
+		return Capabilities{CanExport: true}
+	}
+	return m.tenant.capabilities()
+}
+
+// numberFormat returns the number format msg's token asked for.
+func (m Message) numberFormat() string {
+	if m.tenant == nil {
+		return ""
+	}
+	m.tenant.mu.RLock()
+	defer m.tenant.mu.RUnlock()
+	return m.tenant.numberFormat
+}
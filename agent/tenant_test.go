@@ -0,0 +1,132 @@
+package agent
+
+import "testing"
+
+// testAgent returns an Agent with the default options whose connections
+// are conns.
+func testAgent(conns ...*connection) *Agent {
+	a := bareAgent(DefaultOptions(), nil)
+	a.connections = conns
+	return a
+}
+
+// testTenant returns a tenant serving conns, of a new Agent with the
+// default options.
+func testTenant(conns ...*connection) *tenant {
+	return &tenant{agent: testAgent(conns...), conns: conns}
+}
+
+func TestNewTenants(t *testing.T) {
+	conns := []*connection{
+		{Name: "acme.orders", Labels: map[string]string{"team": "acme"}},
+		{Name: "acme.events", Labels: map[string]string{"team": "acme"}},
+		{Name: "globex", Labels: map[string]string{"team": "globex"}},
+	}
+
+	tests := []struct {
+		name     string
+		configs  []TokenConfig
+		expected [][]string
+		wantErr  bool
+	}{
+		{
+			name: "selected by glob and label",
+			configs: []TokenConfig{
+				{Name: "acme", Token: "a", Connections: []string{"acme.*", "team=acme"}},
+				{Name: "globex", Token: "g", Connections: []string{"globex"}},
+			},
+			expected: [][]string{{"acme.orders", "acme.events"}, {"globex"}},
+		},
+		{
+			name:     "no targets serves everything",
+			configs:  []TokenConfig{{Token: "x"}},
+			expected: [][]string{{"acme.orders", "acme.events", "globex"}},
+		},
+		{
+			name: "same workspace on two hubs",
+			configs: []TokenConfig{
+				{Name: "us", Token: "u", Hub: "wss://us.example.com/agent"},
+				{Name: "eu", Token: "e", Hub: "wss://eu.example.com/agent"},
+			},
+			expected: [][]string{{"acme.orders", "acme.events", "globex"}, {"acme.orders", "acme.events", "globex"}},
+		},
+		{
+			name:    "duplicate names",
+			configs: []TokenConfig{{Name: "us", Token: "a"}, {Name: "us", Token: "b"}},
+			wantErr: true,
+		},
+		{
+			name:    "target matching nothing",
+			configs: []TokenConfig{{Name: "initech", Token: "i", Connections: []string{"initech.*"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tenants, err := newTenants(bareAgent(DefaultOptions(), nil), tc.configs, conns)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(tenants) != len(tc.expected) {
+				t.Fatalf("expected %d tenants, got %d", len(tc.expected), len(tenants))
+			}
+			for i, want := range tc.expected {
+				var got []string
+				for _, c := range tenants[i].conns {
+					got = append(got, c.Name)
+				}
+				if len(got) != len(want) {
+					t.Errorf("tenant %d: expected %v, got %v", i, want, got)
+					continue
+				}
+				for j := range want {
+					if got[j] != want[j] {
+						t.Errorf("tenant %d: expected %v, got %v", i, want, got)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTenantHub(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HubURL = "wss://hub.example.com/agent"
+	tenants, err := newTenants(bareAgent(opts, nil), []TokenConfig{{Token: "a"}, {Token: "b", Hub: "wss://eu.example.com/agent"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tenants[0].hubURL(); got != opts.HubURL {
+		t.Errorf("expected the --hub default, got %s", got)
+	}
+	if got := tenants[1].hubURL(); got != "wss://eu.example.com/agent" {
+		t.Errorf("expected the token's own hub, got %s", got)
+	}
+}
+
+func TestTenantRouting(t *testing.T) {
+	acme := &connection{Name: "acme"}
+	globex := &connection{Name: "globex"}
+
+	tn := testTenant(globex)
+	if c, err := (Message{tenant: tn}).route(); err != nil || c != globex {
+		t.Errorf("expected the tenant's default to be globex, got %v, %v", c, err)
+	}
+	if _, err := (Message{Target: "acme", tenant: tn}).route(); err == nil {
+		t.Error("expected a tenant not to reach another tenant's connection")
+	}
+	if c, err := (Message{Target: "acme", tenant: testTenant(acme, globex)}).route(); err != nil || c != acme {
+		t.Errorf("expected a tenant serving every connection to reach acme, got %v, %v", c, err)
+	}
+	if _, err := (Message{Target: "acme"}).route(); err == nil {
+		t.Error("expected a message without a tenant to reach no connection")
+	}
+}
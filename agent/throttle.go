@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// uploadLimiter is a token bucket over the bytes sent to hubs. Writers
+// reserve the bytes of each frame before sending it and sleep off any
+// shortfall, so one big export is spread out in time and the frames of
+// other replies, which reserve in turn, are not stuck behind all of it:
+// a writer lets go of its connection's lock while a frame waits. An agent
+// has one when --max-upload-mbps caps the rate replies are sent to
+// its hubs; a nil uploadLimiter sends them as fast as the connection takes
+// them.
+type uploadLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// sent and waited add up every reservation, for the metrics.
+	sent   int64
+	waited time.Duration
+}
+
+func newUploadLimiter(mbps float64) *uploadLimiter {
+	if mbps <= 0 {
+		return nil
+	}
+	rate := mbps * 1e6 / 8
+	// A quarter of a second's worth lets small replies through unpaced.
+	burst := rate / 4
+	return &uploadLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func checkMaxUploadMbps(mbps float64) error {
+	if mbps < 0 {
+		return fmt.Errorf("--max-upload-mbps must not be negative, got %g", mbps)
+	}
+	return nil
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait
+// before sending them.
+func (l *uploadLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	l.sent += int64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.waited += d
+	return d
+}
+
+// hubWriter is a hub connection, as *websocket.Conn is.
+type hubWriter interface {
+	replyWriter
+	streamWriter
+}
+
+// writer paces what is written to w, or returns w itself when uploads
+// are uncapped. mu, when not nil, is the lock the caller holds for writing
+// to w; see uploadWriter.
+func (l *uploadLimiter) writer(w hubWriter, mu sync.Locker) hubWriter {
+	if l == nil {
+		return w
+	}
+	return &uploadWriter{l: l, w: w, mu: mu}
+}
+
+// uploadWriter is one reply's way to the hub under the limiter. It keeps
+// the time the reply has waited, which the result's timing reports.
+//
+// A whole frame waits with mu released, so other replies to the same hub
+// can send theirs in between, such as between the chunks of an export.
+// A streamed message waits holding it: the connection can't start another
+// message until that one is closed.
+type uploadWriter struct {
+	l      *uploadLimiter
+	w      hubWriter
+	mu     sync.Locker
+	waited time.Duration
+}
+
+func (u *uploadWriter) wait(n int, release bool) {
+	d := u.l.reserve(n)
+	if d <= 0 {
+		return
+	}
+	if release && u.mu != nil {
+		u.mu.Unlock()
+		time.Sleep(d)
+		u.mu.Lock()
+	} else {
+		time.Sleep(d)
+	}
+	u.waited += d
+}
+
+func (u *uploadWriter) WriteJSON(v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return u.WriteMessage(websocket.TextMessage, buf)
+}
+
+func (u *uploadWriter) WriteMessage(messageType int, data []byte) error {
+	u.wait(len(data), true)
+	return u.w.WriteMessage(messageType, data)
+}
+
+func (u *uploadWriter) NextWriter(messageType int) (io.WriteCloser, error) {
+	mw, err := u.w.NextWriter(messageType)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadStream{u: u, w: mw}, nil
+}
+
+func (u *uploadWriter) throttled() time.Duration {
+	return u.waited
+}
+
+// uploadStream paces a message written in pieces, as streamResult does.
+type uploadStream struct {
+	u *uploadWriter
+	w io.WriteCloser
+}
+
+func (s *uploadStream) Write(p []byte) (int, error) {
+	s.u.wait(len(p), false)
+	return s.w.Write(p)
+}
+
+func (s *uploadStream) Close() error {
+	return s.w.Close()
+}
+
+// throttledTime returns how long the reply written to w has waited for
+// upload bandwidth so far.
+func throttledTime(w any) time.Duration {
+	if tw, ok := w.(interface{ throttled() time.Duration }); ok {
+		return tw.throttled()
+	}
+	return 0
+}
+
+func (l *uploadLimiter) writeMetrics(w io.Writer) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	sent, waited := l.sent, l.waited
+	l.mu.Unlock()
+	fmt.Fprintln(w, "# HELP peekdb_upload_bytes_total Bytes of replies sent to hubs under --max-upload-mbps.")
+	fmt.Fprintln(w, "# TYPE peekdb_upload_bytes_total counter")
+	fmt.Fprintf(w, "peekdb_upload_bytes_total %d\n", sent)
+	fmt.Fprintln(w, "# HELP peekdb_upload_throttled_seconds_total Time replies waited for upload bandwidth.")
+	fmt.Fprintln(w, "# TYPE peekdb_upload_throttled_seconds_total counter")
+	fmt.Fprintf(w, "peekdb_upload_throttled_seconds_total %g\n", waited.Seconds())
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadLimiterReserve(t *testing.T) {
+	// 0.8 Mbps is 100,000 bytes a second, with a 25,000 byte burst.
+	l := newUploadLimiter(0.8)
+	tests := []struct {
+		name  string
+		bytes int
+		want  time.Duration
+	}{
+		{"within the burst", 20000, 0},
+		{"past the burst", 15000, 100 * time.Millisecond},
+		{"behind the last", 10000, 200 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		got := l.reserve(tc.bytes)
+		if got < tc.want-20*time.Millisecond || got > tc.want {
+			t.Errorf("%s: expected a wait of about %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	if l := newUploadLimiter(0); l != nil {
+		t.Error("expected no limiter without a cap")
+	}
+	if err := checkMaxUploadMbps(-1); err == nil {
+		t.Error("expected a negative cap to be refused")
+	}
+}
+
+func TestUploadThrottleTiming(t *testing.T) {
+	rows := make([][]any, 200)
+	for i := range rows {
+		rows[i] = []any{i, strings.Repeat("x", 200)}
+	}
+	resp := QueryResponse{ID: "q1", Type: "result", Columns: []string{"id", "pad"}, Rows: rows, Timing: &QueryTiming{}}
+
+	tests := []struct {
+		name    string
+		limiter *uploadLimiter
+		msg     Message
+		min     time.Duration
+	}{
+		{"uncapped", nil, Message{ChunkSize: 50}, 0},
+		{"chunked", newUploadLimiter(0.8), Message{ChunkSize: 50}, 100 * time.Millisecond},
+		{"streamed", newUploadLimiter(0.8), Message{}, 100 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bw := &bufferWriter{}
+			w := tc.limiter.writer(bw, nil)
+			start := time.Now()
+			if err := writeReply(w, tc.msg, resp); err != nil {
+				t.Fatal(err)
+			}
+			if took := time.Since(start); took < tc.min {
+				t.Errorf("expected sending to take at least %v, took %v", tc.min, took)
+			}
+			var last struct {
+				Timing *QueryTiming
+			}
+			if err := json.Unmarshal(bw.messages[len(bw.messages)-1].Bytes(), &last); err != nil {
+				t.Fatal(err)
+			}
+			if last.Timing == nil {
+				t.Fatal("expected a timing")
+			}
+			if tc.limiter == nil && last.Timing.ThrottledMillis != 0 {
+				t.Errorf("expected nothing throttled, got %+v", last.Timing)
+			}
+			// A streamed result's timing is written before the last of
+			// its message, so it counts only the waits before that.
+			if tc.limiter != nil && (last.Timing.ThrottledMillis <= 0 || last.Timing.ThrottledMillis > last.Timing.SerializeMillis) {
+				t.Errorf("expected part of serializing throttled, got %+v", last.Timing)
+			}
+		})
+	}
+}
+
+func TestUploadWaitReleasesLock(t *testing.T) {
+	rows := make([][]any, 200)
+	for i := range rows {
+		rows[i] = []any{i, strings.Repeat("x", 200)}
+	}
+	resp := QueryResponse{ID: "q1", Type: "result", Columns: []string{"id", "pad"}, Rows: rows}
+
+	// The export's later chunks wait about 150ms in all; another reply
+	// sent meanwhile goes out between them rather than after the export.
+	var mu sync.Mutex
+	bw := &bufferWriter{}
+	done := make(chan error, 1)
+	mu.Lock()
+	go func() {
+		defer mu.Unlock()
+		done <- writeReply(newUploadLimiter(0.8).writer(bw, &mu), Message{ChunkSize: 50}, resp)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	bw.WriteJSON(QueryResponse{ID: "q2", Type: "result"})
+	mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, m := range bw.messages {
+		var frame struct{ ID string }
+		json.Unmarshal(m.Bytes(), &frame)
+		ids = append(ids, frame.ID)
+	}
+	if len(ids) != 6 || ids[len(ids)-1] != "q1" || !strings.Contains(strings.Join(ids, ","), "q2") {
+		t.Errorf("expected q2 sent between the chunks of q1, got %v", ids)
+	}
+}
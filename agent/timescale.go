@@ -0,0 +1,288 @@
+package agent
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Hypertable describes a TimescaleDB hypertable: its partitioning, chunk
+// layout, and the compression and retention policies applied to it.
+type Hypertable struct {
+	TimeColumn         string  `json:"time_column,omitempty"`
+	ChunkInterval      string  `json:"chunk_interval,omitempty"`
+	NumChunks          int     `json:"num_chunks"`
+	CompressedChunks   int     `json:"compressed_chunks"`
+	OldestChunk        *string `json:"oldest_chunk,omitempty"`
+	NewestChunk        *string `json:"newest_chunk,omitempty"`
+	CompressionEnabled bool    `json:"compression_enabled"`
+	CompressAfter      *string `json:"compress_after,omitempty"`
+	RetainFor          *string `json:"retain_for,omitempty"`
+}
+
+const hypertableQuery = `
+SELECT h.hypertable_schema, h.hypertable_name, d.column_name, d.time_interval::text,
+       h.num_chunks, h.compression_enabled,
+       (SELECT count(*) FROM timescaledb_information.chunks c
+         WHERE c.hypertable_schema = h.hypertable_schema AND c.hypertable_name = h.hypertable_name
+           AND c.is_compressed),
+       (SELECT min(c.range_start) FROM timescaledb_information.chunks c
+         WHERE c.hypertable_schema = h.hypertable_schema AND c.hypertable_name = h.hypertable_name),
+       (SELECT max(c.range_end) FROM timescaledb_information.chunks c
+         WHERE c.hypertable_schema = h.hypertable_schema AND c.hypertable_name = h.hypertable_name),
+       (SELECT j.config->>'compress_after' FROM timescaledb_information.jobs j
+         WHERE j.hypertable_schema = h.hypertable_schema AND j.hypertable_name = h.hypertable_name
+           AND j.proc_name = 'policy_compression' LIMIT 1),
+       (SELECT j.config->>'drop_after' FROM timescaledb_information.jobs j
+         WHERE j.hypertable_schema = h.hypertable_schema AND j.hypertable_name = h.hypertable_name
+           AND j.proc_name = 'policy_retention' LIMIT 1)
+FROM timescaledb_information.hypertables h
+LEFT JOIN timescaledb_information.dimensions d
+  ON d.hypertable_schema = h.hypertable_schema AND d.hypertable_name = h.hypertable_name
+ AND d.dimension_number = 1`
+
+// attachHypertables fills in Hypertable for tables managed by TimescaleDB.
+// It is a no-op when the extension is not installed.
+func attachHypertables(q queryer, tables []SchemaTable) error {
+	installed, err := timescaleInstalled(q)
+	if err != nil || !installed {
+		return err
+	}
+
+	byName := make(map[[2]string]*SchemaTable, len(tables))
+	for i := range tables {
+		byName[[2]string{tables[i].Schema, tables[i].Name}] = &tables[i]
+	}
+
+	rows, err := q.Query(hypertableQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schema, name string
+		var timeColumn, interval, compressAfter, dropAfter sql.NullString
+		var oldest, newest sql.NullTime
+		var h Hypertable
+		if err := rows.Scan(&schema, &name, &timeColumn, &interval, &h.NumChunks, &h.CompressionEnabled,
+			&h.CompressedChunks, &oldest, &newest, &compressAfter, &dropAfter); err != nil {
+			return err
+		}
+		h.TimeColumn = timeColumn.String
+		h.ChunkInterval = interval.String
+		h.OldestChunk = formatNullTime(oldest)
+		h.NewestChunk = formatNullTime(newest)
+		if compressAfter.Valid {
+			h.CompressAfter = &compressAfter.String
+		}
+		if dropAfter.Valid {
+			h.RetainFor = &dropAfter.String
+		}
+
+		if t, ok := byName[[2]string{schema, name}]; ok {
+			t.Hypertable = &h
+		}
+	}
+	return rows.Err()
+}
+
+func timescaleInstalled(q queryer) (bool, error) {
+	var installed bool
+	rows, err := q.Query("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&installed)
+	}
+	return installed, err
+}
+
+// TimeBucketsResponse answers a "time_buckets" message with a hypertable's
+// chunks grouped by time_bucket, so the UI can show which stretches of
+// time are compressed and which the retention policy is about to drop.
+type TimeBucketsResponse struct {
+	ID      string       `json:"id"`
+	Type    string       `json:"type"`
+	Schema  string       `json:"schema,omitempty"`
+	Name    string       `json:"name,omitempty"`
+	Bucket  string       `json:"bucket,omitempty"`
+	Buckets []TimeBucket `json:"buckets"`
+	// CompressAfter and RetainFor are the hypertable's policies, as in
+	// the schema's Hypertable.
+	CompressAfter *string `json:"compress_after,omitempty"`
+	RetainFor     *string `json:"retain_for,omitempty"`
+	Error         string  `json:"error,omitempty"`
+
+	ErrorCode  string `json:"error_code,omitempty"`
+	Connection string `json:"connection,omitempty"`
+}
+
+// TimeBucket is the chunks starting in one bucket.
+type TimeBucket struct {
+	Start            time.Time `json:"start"`
+	Chunks           int       `json:"chunks"`
+	CompressedChunks int       `json:"compressed_chunks"`
+	Bytes            int64     `json:"bytes"`
+	// CompressionDue is set when some of the chunks are old enough for
+	// the compression policy but not compressed yet, and Expired when all
+	// of them are past the retention policy; both are absent without the
+	// policy.
+	CompressionDue *bool `json:"compression_due,omitempty"`
+	Expired        *bool `json:"expired,omitempty"`
+}
+
+const findHypertableQuery = `
+SELECT hypertable_schema, hypertable_name FROM timescaledb_information.hypertables
+WHERE hypertable_name = $1`
+
+const timeBucketsQuery = `
+SELECT time_bucket($3::interval, c.range_start), count(*),
+       count(*) FILTER (WHERE c.is_compressed),
+       coalesce(sum(s.total_bytes), 0)::bigint,
+       bool_or(NOT c.is_compressed AND c.range_end <= now() - $4::interval),
+       bool_and(c.range_end <= now() - $5::interval)
+FROM timescaledb_information.chunks c
+LEFT JOIN chunks_detailed_size(format('%I.%I', $1::text, $2::text)::regclass) s
+  ON s.chunk_schema = c.chunk_schema AND s.chunk_name = c.chunk_name
+WHERE c.hypertable_schema = $1 AND c.hypertable_name = $2 AND c.range_start IS NOT NULL
+GROUP BY 1
+ORDER BY 1`
+
+// timeBuckets answers a "time_buckets" message for the hypertable
+// msg.Identifier names, written as in a statement. Bucket is an interval
+// such as "1 day" and defaults to the chunk interval.
+func timeBuckets(msg Message) TimeBucketsResponse {
+	resp := TimeBucketsResponse{ID: msg.ID, Type: "time_buckets"}
+	fail := func(err error) TimeBucketsResponse {
+		resp.Error, resp.ErrorCode = err.Error(), errorCode(err)
+		return resp
+	}
+	c, err := msg.route()
+	if err != nil {
+		return fail(err)
+	}
+	resp.Connection = c.Name
+	sc, ok := c.Connector.(*sqlConnector)
+	if !ok || sc.flavor != "postgres" {
+		return fail(codedErrorf(codeNotSupported, "time_buckets is not supported for %s", c.Flavor()))
+	}
+	parts, err := identifierParts(msg.Identifier)
+	if err != nil {
+		return fail(err)
+	}
+	if len(parts) > 2 {
+		return fail(codedErrorf(codeInvalidRequest, "%q is not a hypertable: expected table or schema.table", msg.Identifier))
+	}
+	if installed, err := timescaleInstalled(sc.db); err != nil || !installed {
+		if err == nil {
+			err = codedErrorf(codeNotSupported, "time_buckets needs the timescaledb extension")
+		}
+		return fail(err)
+	}
+	d := dialectFor(sc.flavor)
+	t, err := findHypertable(sc.db, parts, d)
+	if err != nil {
+		return fail(err)
+	}
+	resp.Schema, resp.Name = t.Schema, t.Name
+	if !msg.capabilities().schemaAllowed(t.Schema) {
+		return fail(codedErrorf(codePolicyDenied, "schema %q is not allowed for this token", t.Schema))
+	}
+	tables := []SchemaTable{t}
+	if err := attachHypertables(sc.db, tables); err != nil {
+		return fail(err)
+	}
+	h := tables[0].Hypertable
+	if h == nil || h.ChunkInterval == "" {
+		return fail(codedErrorf(codeNotSupported, "%s.%s is not partitioned by time", t.Schema, t.Name))
+	}
+	resp.CompressAfter, resp.RetainFor = h.CompressAfter, h.RetainFor
+	resp.Bucket = msg.Bucket
+	if resp.Bucket == "" {
+		resp.Bucket = h.ChunkInterval
+	}
+
+	log.Printf("[time_buckets:%s] Reading %s.%s by %s", msg.ID, t.Schema, t.Name, resp.Bucket)
+	var compressAfter, retainFor any
+	if h.CompressAfter != nil {
+		compressAfter = *h.CompressAfter
+	}
+	if h.RetainFor != nil {
+		retainFor = *h.RetainFor
+	}
+	rows, err := sc.db.QueryContext(msg.context(), timeBucketsQuery, t.Schema, t.Name, resp.Bucket, compressAfter, retainFor)
+	if err != nil {
+		log.Printf("[time_buckets:%s] Error: %v", msg.ID, err)
+		return fail(err)
+	}
+	defer rows.Close()
+	resp.Buckets = []TimeBucket{}
+	for rows.Next() {
+		var b TimeBucket
+		var due, expired sql.NullBool
+		if err := rows.Scan(&b.Start, &b.Chunks, &b.CompressedChunks, &b.Bytes, &due, &expired); err != nil {
+			return fail(err)
+		}
+		if due.Valid {
+			b.CompressionDue = &due.Bool
+		}
+		if expired.Valid {
+			b.Expired = &expired.Bool
+		}
+		resp.Buckets = append(resp.Buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return fail(err)
+	}
+	return resp
+}
+
+// findHypertable finds the hypertable parts names; a bare name must be
+// unique across schemas.
+func findHypertable(q queryer, parts []sqlToken, d identDialect) (SchemaTable, error) {
+	name := d.name(parts[len(parts)-1])
+	var schema string
+	if len(parts) == 2 {
+		schema = d.name(parts[0])
+	}
+	rows, err := q.Query(findHypertableQuery, name)
+	if err != nil {
+		return SchemaTable{}, err
+	}
+	defer rows.Close()
+	var found []SchemaTable
+	for rows.Next() {
+		var t SchemaTable
+		if err := rows.Scan(&t.Schema, &t.Name); err != nil {
+			return SchemaTable{}, err
+		}
+		if schema == "" || t.Schema == schema {
+			found = append(found, t)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return SchemaTable{}, err
+	}
+	switch len(found) {
+	case 0:
+		return SchemaTable{}, codedErrorf(codeInvalidRequest, "hypertable %s not found", d.qualifiedSQL(parts))
+	case 1:
+		return found[0], nil
+	}
+	var schemas []string
+	for _, t := range found {
+		schemas = append(schemas, t.Schema)
+	}
+	return SchemaTable{}, codedErrorf(codeInvalidRequest, "hypertable %s is in more than one schema (%v); qualify it", d.qualifiedSQL(parts), schemas)
+}
+
+func formatNullTime(t sql.NullTime) *string {
+	if !t.Valid {
+		return nil
+	}
+	s := t.Time.Format(time.RFC3339)
+	return &s
+}
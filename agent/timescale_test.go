@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTimeBuckets(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+
+	installed := func() {
+		mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	}
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	installed()
+	mock.ExpectQuery("FROM timescaledb_information.hypertables\\s+WHERE hypertable_name").WithArgs("metrics").
+		WillReturnRows(sqlmock.NewRows([]string{"schema", "name"}).AddRow("public", "metrics").AddRow("archive", "metrics"))
+	installed()
+	mock.ExpectQuery("FROM timescaledb_information.hypertables").WillReturnRows(
+		sqlmock.NewRows([]string{"schema", "name", "column", "interval", "chunks", "compression", "compressed", "oldest", "newest", "compress_after", "drop_after"}).
+			AddRow("public", "metrics", "ts", "1 day", 3, true, 1, start, start.AddDate(0, 0, 3), "2 days", nil).
+			AddRow("archive", "metrics", "ts", "7 days", 1, false, 0, start, start.AddDate(0, 0, 7), nil, nil))
+	mock.ExpectQuery("time_bucket").WithArgs("public", "metrics", "7 days", "2 days", driver.Value(nil)).WillReturnRows(
+		sqlmock.NewRows([]string{"bucket", "chunks", "compressed", "bytes", "due", "expired"}).
+			AddRow(start, 3, 1, int64(3<<20), true, nil))
+
+	resp := timeBuckets(Message{ID: "t1", Identifier: "public.metrics", Bucket: "7 days", tenant: tn})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if resp.Schema != "public" || resp.Bucket != "7 days" || resp.CompressAfter == nil || *resp.CompressAfter != "2 days" || resp.RetainFor != nil {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if len(resp.Buckets) != 1 {
+		t.Fatalf("expected one bucket, got %+v", resp.Buckets)
+	}
+	b := resp.Buckets[0]
+	if !b.Start.Equal(start) || b.Chunks != 3 || b.CompressedChunks != 1 || b.Bytes != 3<<20 ||
+		b.CompressionDue == nil || !*b.CompressionDue || b.Expired != nil {
+		t.Errorf("unexpected bucket: %+v", b)
+	}
+
+	// A bare name in two schemas has to be qualified.
+	installed()
+	mock.ExpectQuery("WHERE hypertable_name").WithArgs("metrics").
+		WillReturnRows(sqlmock.NewRows([]string{"schema", "name"}).AddRow("public", "metrics").AddRow("archive", "metrics"))
+	if resp := timeBuckets(Message{ID: "t2", Identifier: "metrics", tenant: tn}); resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("expected an ambiguous name to be refused, got %+v", resp)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	if resp := timeBuckets(Message{ID: "t3", Identifier: "metrics", tenant: tn}); resp.ErrorCode != codeNotSupported {
+		t.Errorf("expected %s without timescaledb, got %+v", codeNotSupported, resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
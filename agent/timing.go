@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+// QueryTiming splits the time a query took into where it went, in
+// milliseconds. Queue is from the message arriving to the query starting;
+// Connect is getting a database connection, including reopening one an
+// idle policy closed; Execute is until the database started returning
+// rows, and Fetch reading them. Connectors that don't tell execute and
+// fetch apart count both as Execute. Serialize is encoding the result and
+// handing it to the hub connection; for a chunked result, result_end
+// carries it. Throttled is the part of Serialize spent waiting for upload
+// bandwidth under --max-upload-mbps, and is left out when the result
+// wasn't held back.
+type QueryTiming struct {
+	QueueMillis     float64 `json:"queue_ms"`
+	ConnectMillis   float64 `json:"connect_ms"`
+	ExecuteMillis   float64 `json:"execute_ms"`
+	FetchMillis     float64 `json:"fetch_ms"`
+	SerializeMillis float64 `json:"serialize_ms"`
+	ThrottledMillis float64 `json:"throttled_ms,omitempty"`
+}
+
+// Phases a queryTimer measures.
+const (
+	phaseQueue = iota
+	phaseConnect
+	phaseExecute
+	phaseFetch
+	phases
+)
+
+// queryTimer adds up a query's time by phase. A nil timer measures
+// nothing.
+type queryTimer struct {
+	d [phases]time.Duration
+}
+
+type timerKey struct{}
+
+// withTimer makes ctx's query report its time to tm.
+func withTimer(ctx context.Context, tm *queryTimer) context.Context {
+	return context.WithValue(ctx, timerKey{}, tm)
+}
+
+// timerFrom returns the timer of ctx's query, or nil.
+func timerFrom(ctx context.Context) *queryTimer {
+	tm, _ := ctx.Value(timerKey{}).(*queryTimer)
+	return tm
+}
+
+// record adds the time since start to phase. Retried statements add up.
+func (tm *queryTimer) record(phase int, start time.Time) {
+	if tm != nil {
+		tm.d[phase] += time.Since(start)
+	}
+}
+
+// settle counts what a connector spent since start as Execute if it
+// reported nothing itself.
+func (tm *queryTimer) settle(start time.Time) {
+	if tm != nil && tm.d[phaseExecute] == 0 && tm.d[phaseFetch] == 0 {
+		tm.d[phaseExecute] = max(time.Since(start)-tm.d[phaseConnect], 0)
+	}
+}
+
+func (tm *queryTimer) timing() *QueryTiming {
+	return &QueryTiming{
+		QueueMillis:   millis(tm.d[phaseQueue]),
+		ConnectMillis: millis(tm.d[phaseConnect]),
+		ExecuteMillis: millis(tm.d[phaseExecute]),
+		FetchMillis:   millis(tm.d[phaseFetch]),
+	}
+}
+
+// withSerialize returns a copy of t with Serialize set to the time since
+// start and Throttled to the time the reply written to w has waited so
+// far, or nil if t is.
+func (t *QueryTiming) withSerialize(start time.Time, w any) *QueryTiming {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.SerializeMillis = millis(time.Since(start))
+	c.ThrottledMillis = millis(throttledTime(w))
+	return &c
+}
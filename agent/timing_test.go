@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestQueryTiming(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{db: mockDB, flavor: "postgres"}})
+	mock.ExpectQuery(`SELECT pg_backend_pid\(\)`).WillReturnRows(sqlmock.NewRows([]string{"pg_backend_pid"}).AddRow(4242))
+	mock.ExpectQuery("SELECT id FROM orders").WillDelayFor(20 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+
+	msg := Message{ID: "q1", Type: "query", SQL: "SELECT id FROM orders", tenant: tn, received: time.Now().Add(-30 * time.Millisecond)}
+	resp := runQuery(msg)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	tm := resp.Timing
+	if tm == nil {
+		t.Fatal("expected a timing")
+	}
+	if tm.QueueMillis < 30 || tm.ExecuteMillis < 20 || tm.SerializeMillis != 0 {
+		t.Errorf("expected >=30ms queued, >=20ms executing and nothing serialized yet, got %+v", tm)
+	}
+
+	// Enough rows that encoding them takes measurable time.
+	resp.Columns, resp.Rows = bigResult().Columns, bigResult().Rows
+
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"streamed", Message{}},
+		{"chunked", Message{ChunkSize: 1000}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &bufferWriter{}
+			if err := writeReply(w, tc.msg, resp); err != nil {
+				t.Fatal(err)
+			}
+			var last struct {
+				Rows   [][]any
+				Timing *QueryTiming
+			}
+			if err := json.Unmarshal(w.messages[len(w.messages)-1].Bytes(), &last); err != nil {
+				t.Fatalf("invalid JSON %q: %v", w.messages[len(w.messages)-1], err)
+			}
+			if last.Timing == nil || last.Timing.QueueMillis != tm.QueueMillis || last.Timing.SerializeMillis <= 0 {
+				t.Errorf("expected the timing with serialize_ms set, got %+v", last.Timing)
+			}
+		})
+	}
+	if resp.Timing.SerializeMillis != 0 {
+		t.Error("expected writing the reply to leave the response's timing alone")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SchemaType is a user-defined type: an enum with its Labels in sort
+// order, a domain over BaseType with its constraints, or a composite type
+// with its Attributes.
+type SchemaType struct {
+	Schema  string `json:"schema"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Comment string `json:"comment,omitempty"`
+
+	Labels []string `json:"labels,omitempty"`
+
+	BaseType string   `json:"base_type,omitempty"`
+	NotNull  bool     `json:"not_null,omitempty"`
+	Default  *string  `json:"default,omitempty"`
+	Checks   []string `json:"checks,omitempty"`
+
+	Attributes []SchemaColumn `json:"attributes,omitempty"`
+}
+
+// TypeRef names the user-defined type of a column: an entry of the
+// schema's types, or a table for a column of a table's row type.
+type TypeRef struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+}
+
+var typeKinds = map[string]string{
+	"e": "enum",
+	"d": "domain",
+	"c": "composite",
+}
+
+// typesQuery reads enums, domains and the composite types made by CREATE
+// TYPE, leaving out those every table has as its row type.
+const typesQuery = `
+SELECT n.nspname, t.typname, t.typtype::text, obj_description(t.oid, 'pg_type'),
+       array(SELECT e.enumlabel FROM pg_enum e WHERE e.enumtypid = t.oid ORDER BY e.enumsortorder)::text[],
+       CASE WHEN t.typtype = 'd' THEN format_type(t.typbasetype, t.typtypmod) END,
+       t.typnotnull, t.typdefault,
+       array(SELECT pg_get_constraintdef(c.oid) FROM pg_constraint c WHERE c.contypid = t.oid ORDER BY c.conname)::text[],
+       array(SELECT a.attname FROM pg_attribute a
+             WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum)::text[],
+       array(SELECT format_type(a.atttypid, a.atttypmod) FROM pg_attribute a
+             WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum)::text[]
+FROM pg_type t
+JOIN pg_namespace n ON n.oid = t.typnamespace
+LEFT JOIN pg_class r ON r.oid = t.typrelid
+WHERE (t.typtype IN ('e', 'd') OR t.typtype = 'c' AND r.relkind = 'c')
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND n.nspname NOT LIKE '\_timescaledb%'
+ORDER BY n.nspname, t.typname`
+
+// loadTypes reads the user-defined types in schema, or in every schema
+// when it is empty.
+func loadTypes(q queryer, schema string) ([]SchemaType, error) {
+	query, args := typesQuery, []any{}
+	if schema != "" {
+		query, args = strings.Replace(typesQuery, "ORDER BY n.nspname", "  AND n.nspname = $1\nORDER BY n.nspname", 1), []any{schema}
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []SchemaType
+	for rows.Next() {
+		var t SchemaType
+		var kind string
+		var comment, base, def sql.NullString
+		var attrs, attrTypes []string
+		if err := rows.Scan(&t.Schema, &t.Name, &kind, &comment, pq.Array(&t.Labels), &base, &t.NotNull, &def,
+			pq.Array(&t.Checks), pq.Array(&attrs), pq.Array(&attrTypes)); err != nil {
+			return nil, err
+		}
+		t.Kind, t.Comment, t.BaseType = typeKinds[kind], comment.String, base.String
+		if def.Valid {
+			t.Default = &def.String
+		}
+		for i, name := range attrs {
+			if i < len(attrTypes) {
+				t.Attributes = append(t.Attributes, SchemaColumn{Name: name, Type: attrTypes[i], Nullable: true})
+			}
+		}
+		types = append(types, t)
+	}
+	return types, rows.Err()
+}
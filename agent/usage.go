@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type usageKey struct {
+	connection, table, statement string
+}
+
+// maxShapes bounds the query shapes tracked per connection; later new
+// shapes are counted under the fingerprint "other".
+const maxShapes = 500
+
+type shapeKey struct {
+	connection, fingerprint string
+}
+
+type shapeStats struct {
+	query string
+	count int64
+}
+
+// usageStats counts the statements an agent has run, per connection and
+// statement kind, how often each table was touched by each kind, and how
+// often each query shape ran (see fingerprint). Counts live in memory and
+// start from zero when the agent restarts.
+type usageStats struct {
+	mu         sync.Mutex
+	statements map[usageKey]int64
+	tables     map[usageKey]int64
+	shapes     map[shapeKey]*shapeStats
+	shapeCount map[string]int
+}
+
+func newUsageStats() *usageStats {
+	return &usageStats{
+		statements: map[usageKey]int64{},
+		tables:     map[usageKey]int64{},
+		shapes:     map[shapeKey]*shapeStats{},
+		shapeCount: map[string]int{},
+	}
+}
+
+// record classifies a statement that ran on connection and counts it.
+func (u *usageStats) record(connection, sqlQuery string) {
+	kind, tables := classifyStatement(sqlQuery)
+	shape := normalizeSQL(sqlQuery)
+	fp := shapeFingerprint(shape)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.statements[usageKey{connection: connection, statement: kind}]++
+	for _, t := range tables {
+		u.tables[usageKey{connection: connection, table: t, statement: kind}]++
+	}
+
+	k := shapeKey{connection: connection, fingerprint: fp}
+	s, ok := u.shapes[k]
+	if !ok {
+		if u.shapeCount[connection] >= maxShapes {
+			k.fingerprint, shape = "other", ""
+			s = u.shapes[k]
+		}
+		if s == nil {
+			s = &shapeStats{query: truncate(shape, 200)}
+			u.shapes[k] = s
+			u.shapeCount[connection]++
+		}
+	}
+	s.count++
+}
+
+// UsageReport answers a "usage_report" message.
+type UsageReport struct {
+	ID         string           `json:"id"`
+	Type       string           `json:"type"`
+	Statements []StatementUsage `json:"statements"`
+	Tables     []TableUsage     `json:"tables"`
+	Shapes     []ShapeUsage     `json:"shapes"`
+}
+
+type StatementUsage struct {
+	Connection string `json:"connection"`
+	Statement  string `json:"statement"`
+	Count      int64  `json:"count"`
+}
+
+type TableUsage struct {
+	Connection string `json:"connection"`
+	Table      string `json:"table"`
+	Statement  string `json:"statement"`
+	Count      int64  `json:"count"`
+}
+
+// ShapeUsage counts the runs of one query shape: the normalized statement,
+// with literal values replaced by ?.
+type ShapeUsage struct {
+	Connection  string `json:"connection"`
+	Fingerprint string `json:"fingerprint"`
+	Query       string `json:"query"`
+	Count       int64  `json:"count"`
+}
+
+func (u *usageStats) report(id string) UsageReport {
+	r := UsageReport{ID: id, Type: "usage_report", Statements: []StatementUsage{}, Tables: []TableUsage{}, Shapes: []ShapeUsage{}}
+
+	u.mu.Lock()
+	for k, n := range u.statements {
+		r.Statements = append(r.Statements, StatementUsage{Connection: k.connection, Statement: k.statement, Count: n})
+	}
+	for k, n := range u.tables {
+		r.Tables = append(r.Tables, TableUsage{Connection: k.connection, Table: k.table, Statement: k.statement, Count: n})
+	}
+	for k, s := range u.shapes {
+		r.Shapes = append(r.Shapes, ShapeUsage{Connection: k.connection, Fingerprint: k.fingerprint, Query: s.query, Count: s.count})
+	}
+	u.mu.Unlock()
+
+	sort.Slice(r.Statements, func(i, j int) bool {
+		a, b := r.Statements[i], r.Statements[j]
+		if a.Connection != b.Connection {
+			return a.Connection < b.Connection
+		}
+		return a.Statement < b.Statement
+	})
+	sort.Slice(r.Tables, func(i, j int) bool {
+		a, b := r.Tables[i], r.Tables[j]
+		if a.Connection != b.Connection {
+			return a.Connection < b.Connection
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		return a.Statement < b.Statement
+	})
+	sort.Slice(r.Shapes, func(i, j int) bool {
+		a, b := r.Shapes[i], r.Shapes[j]
+		if a.Connection != b.Connection {
+			return a.Connection < b.Connection
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Fingerprint < b.Fingerprint
+	})
+	return r
+}
+
+// writeMetrics renders the counters in the Prometheus text format.
+func (u *usageStats) writeMetrics(w io.Writer) {
+	r := u.report("")
+
+	fmt.Fprintln(w, "# HELP peekdb_statements_total Statements run by the agent, by kind.")
+	fmt.Fprintln(w, "# TYPE peekdb_statements_total counter")
+	for _, s := range r.Statements {
+		fmt.Fprintf(w, "peekdb_statements_total{connection=%s,statement=%s} %d\n",
+			promLabel(s.Connection), promLabel(s.Statement), s.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP peekdb_table_access_total Statements that named a table, by table and kind.")
+	fmt.Fprintln(w, "# TYPE peekdb_table_access_total counter")
+	for _, t := range r.Tables {
+		fmt.Fprintf(w, "peekdb_table_access_total{connection=%s,table=%s,statement=%s} %d\n",
+			promLabel(t.Connection), promLabel(t.Table), promLabel(t.Statement), t.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP peekdb_query_shape_total Statements run by the agent, by query fingerprint.")
+	fmt.Fprintln(w, "# TYPE peekdb_query_shape_total counter")
+	for _, s := range r.Shapes {
+		fmt.Fprintf(w, "peekdb_query_shape_total{connection=%s,fingerprint=%s} %d\n",
+			promLabel(s.Connection), promLabel(s.Fingerprint), s.Count)
+	}
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(v string) string {
+	return `"` + promEscaper.Replace(v) + `"`
+}
+
+func (a *Agent) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	a.usage.writeMetrics(w)
+	a.scheduler.writeMetrics(w)
+	a.uploads.writeMetrics(w)
+	a.quota.writeMetrics(w)
+}
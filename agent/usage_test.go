@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsageStats(t *testing.T) {
+	u := newUsageStats()
+	u.record("default", "SELECT * FROM users")
+	u.record("default", "SELECT * FROM users JOIN orders ON orders.user_id = users.id")
+	u.record("default", "UPDATE users SET name = $1")
+	u.record("analytics", "SELECT 1")
+
+	r := u.report("u1")
+	if r.ID != "u1" || r.Type != "usage_report" {
+		t.Fatalf("unexpected header: %+v", r)
+	}
+
+	wantStatements := []StatementUsage{
+		{Connection: "analytics", Statement: "select", Count: 1},
+		{Connection: "default", Statement: "select", Count: 2},
+		{Connection: "default", Statement: "update", Count: 1},
+	}
+	if len(r.Statements) != len(wantStatements) {
+		t.Fatalf("expected %d statement rows, got %+v", len(wantStatements), r.Statements)
+	}
+	for i, want := range wantStatements {
+		if r.Statements[i] != want {
+			t.Errorf("statement %d: expected %+v, got %+v", i, want, r.Statements[i])
+		}
+	}
+
+	wantTables := []TableUsage{
+		{Connection: "default", Table: "orders", Statement: "select", Count: 1},
+		{Connection: "default", Table: "users", Statement: "select", Count: 2},
+		{Connection: "default", Table: "users", Statement: "update", Count: 1},
+	}
+	if len(r.Tables) != len(wantTables) {
+		t.Fatalf("expected %d table rows, got %+v", len(wantTables), r.Tables)
+	}
+	for i, want := range wantTables {
+		if r.Tables[i] != want {
+			t.Errorf("table %d: expected %+v, got %+v", i, want, r.Tables[i])
+		}
+	}
+
+	if len(r.Shapes) != 4 {
+		t.Errorf("expected 4 query shapes, got %+v", r.Shapes)
+	}
+	for _, s := range r.Shapes {
+		if s.Fingerprint != fingerprint(s.Query) {
+			t.Errorf("shape %q: fingerprint %s doesn't match its query", s.Query, s.Fingerprint)
+		}
+	}
+
+	var b strings.Builder
+	u.writeMetrics(&b)
+	for _, line := range []string{
+		`peekdb_statements_total{connection="default",statement="select"} 2`,
+		`peekdb_table_access_total{connection="default",table="users",statement="update"} 1`,
+		`peekdb_query_shape_total{connection="analytics",fingerprint="` + fingerprint("SELECT 1") + `"} 1`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("metrics missing %q:\n%s", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// integerBits are the sizes of Postgres's integer types.
+var integerBits = map[string]int{"smallint": 16, "integer": 32, "bigint": 64}
+
+// checkValue reports whether v, a value decoded from JSON, can go in a
+// column of type typ, as format_type writes it; user is the column's
+// user-defined type, if any. It catches what a form gets wrong, such as
+// text in a number field or a label an enum doesn't have, before the
+// statement runs. Types it doesn't know take any value, and the database
+// has the last word. Null is for the caller to check.
+func checkValue(typ string, user *SchemaType, v any) error {
+	if v == nil {
+		return nil
+	}
+	if elem, ok := strings.CutSuffix(typ, "[]"); ok {
+		switch v := v.(type) {
+		case []any:
+			for i, e := range v {
+				if err := checkValue(elem, user, e); err != nil {
+					return fmt.Errorf("element %d: %w", i+1, err)
+				}
+			}
+			return nil
+		case string:
+			// An array literal, such as '{a,b}', is for Postgres to read.
+			return nil
+		}
+		return fmt.Errorf("expected an array, got %s", jsonKind(v))
+	}
+	if user != nil {
+		switch user.Kind {
+		case "enum":
+			if s, ok := v.(string); !ok || !slices.Contains(user.Labels, s) {
+				return fmt.Errorf("expected one of %s, got %s", strings.Join(user.Labels, ", "), describeValue(v))
+			}
+			return nil
+		case "domain":
+			return checkValue(user.BaseType, nil, v)
+		}
+		return nil
+	}
+
+	name, length := typeName(typ)
+	switch name {
+	case "smallint", "integer", "bigint":
+		bits := integerBits[name]
+		limit := math.Ldexp(1, bits-1)
+		switch v := v.(type) {
+		case float64:
+			if v != math.Trunc(v) || v < -limit || v >= limit {
+				return fmt.Errorf("expected a %d-bit integer, got %v", bits, v)
+			}
+			return nil
+		case string:
+			if _, err := strconv.ParseInt(strings.TrimSpace(v), 10, bits); err != nil {
+				return fmt.Errorf("expected a %d-bit integer, got %q", bits, v)
+			}
+			return nil
+		}
+		return fmt.Errorf("expected an integer, got %s", jsonKind(v))
+	case "numeric", "real", "double precision":
+		switch v := v.(type) {
+		case float64:
+			return nil
+		case string:
+			if _, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return fmt.Errorf("expected a number, got %q", v)
+			}
+			return nil
+		}
+		return fmt.Errorf("expected a number, got %s", jsonKind(v))
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("expected true or false, got %s", jsonKind(v))
+		}
+		return nil
+	case "text", "character varying", "character", "citext", "name":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %s", jsonKind(v))
+		}
+		if n := utf8.RuneCountInString(s); length > 0 && n > length {
+			return fmt.Errorf("expected at most %d characters, got %d", length, n)
+		}
+		return nil
+	case "uuid":
+		s, ok := v.(string)
+		if !ok || !isUUID(s) {
+			return fmt.Errorf("expected a UUID, got %s", describeValue(v))
+		}
+		return nil
+	case "date", "time without time zone", "time with time zone", "timestamp without time zone",
+		"timestamp with time zone", "interval", "bytea", "inet", "cidr", "macaddr":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("expected a string, got %s", jsonKind(v))
+		}
+		return nil
+	}
+	return nil
+}
+
+// typeName splits a type as format_type writes it into its name without
+// modifiers, such as "timestamp with time zone" for "timestamp(3) with
+// time zone", and its length, for character types, or 0.
+func typeName(typ string) (string, int) {
+	open := strings.IndexByte(typ, '(')
+	close := strings.IndexByte(typ, ')')
+	if open < 0 || close < open {
+		return typ, 0
+	}
+	name := strings.TrimSpace(typ[:open] + typ[close+1:])
+	length := 0
+	if strings.HasPrefix(name, "character") {
+		length, _ = strconv.Atoi(typ[open+1 : close])
+	}
+	return name, length
+}
+
+// isUUID reports whether s is a UUID in any of the forms Postgres reads:
+// 32 hex digits, optionally in braces and with hyphens between groups.
+func isUUID(s string) bool {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	n := 0
+	for i, r := range s {
+		switch {
+		case r == '-' && i > 0 && i < len(s)-1 && s[i-1] != '-':
+		case '0' <= r && r <= '9', 'a' <= r && r <= 'f', 'A' <= r && r <= 'F':
+			n++
+		default:
+			return false
+		}
+	}
+	return n == 32
+}
+
+// jsonKind names the JSON type of v.
+func jsonKind(v any) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []any:
+		return "an array"
+	case map[string]any:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// describeValue is v for an error message: a string quoted, anything else
+// by its JSON type.
+func describeValue(v any) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return jsonKind(v)
+}
+
+// userType returns the schema's entry for col's user-defined type, or nil.
+func userType(types []SchemaType, col SchemaColumn) *SchemaType {
+	if col.UserType == nil {
+		return nil
+	}
+	for i, t := range types {
+		if t.Schema == col.UserType.Schema && t.Name == col.UserType.Name {
+			return &types[i]
+		}
+	}
+	return nil
+}
+
+// required reports whether an insert must give col a value: it can't be
+// null and has neither a default nor an identity to fill it in.
+func required(col SchemaColumn) bool {
+	return !col.Nullable && col.Default == nil && col.Identity == ""
+}
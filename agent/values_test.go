@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestCheckValue(t *testing.T) {
+	mood := &SchemaType{Schema: "public", Name: "mood", Kind: "enum", Labels: []string{"sad", "ok", "happy"}}
+	email := &SchemaType{Schema: "public", Name: "email", Kind: "domain", BaseType: "character varying(6)"}
+	tests := []struct {
+		typ     string
+		user    *SchemaType
+		value   any
+		wantErr string
+	}{
+		{typ: "integer", value: float64(42)},
+		{typ: "integer", value: "42"},
+		{typ: "integer", value: 1.5, wantErr: "expected a 32-bit integer, got 1.5"},
+		{typ: "smallint", value: float64(40000), wantErr: "expected a 16-bit integer, got 40000"},
+		{typ: "smallint", value: float64(-32768)},
+		{typ: "bigint", value: "12345678901234567890", wantErr: `expected a 64-bit integer, got "12345678901234567890"`},
+		{typ: "integer", value: true, wantErr: "expected an integer, got a boolean"},
+		{typ: "numeric(10,2)", value: "19.99"},
+		{typ: "double precision", value: "lots", wantErr: `expected a number, got "lots"`},
+		{typ: "boolean", value: "yes", wantErr: "expected true or false, got a string"},
+		{typ: "character varying(5)", value: "héllo"},
+		{typ: "character varying(5)", value: "hello!", wantErr: "expected at most 5 characters, got 6"},
+		{typ: "text", value: float64(1), wantErr: "expected a string, got a number"},
+		{typ: "uuid", value: "0b5e6a1c-3f7d-4c2a-9e8b-1d2f3a4b5c6d"},
+		{typ: "uuid", value: "{0b5e6a1c3f7d4c2a9e8b1d2f3a4b5c6d}"},
+		{typ: "uuid", value: "0b5e6a1c", wantErr: `expected a UUID, got "0b5e6a1c"`},
+		{typ: "timestamp(3) with time zone", value: "2026-10-17T09:00:00Z"},
+		{typ: "date", value: float64(20261017), wantErr: "expected a string, got a number"},
+		{typ: "jsonb", value: map[string]any{"a": []any{1.0}}},
+		{typ: "integer[]", value: []any{float64(1), "2"}},
+		{typ: "integer[]", value: []any{float64(1), "x"}, wantErr: `element 2: expected a 32-bit integer, got "x"`},
+		{typ: "integer[]", value: "{1,2}"},
+		{typ: "text[]", value: "a"},
+		{typ: "text[]", value: float64(1), wantErr: "expected an array, got a number"},
+		{typ: "mood", user: mood, value: "happy"},
+		{typ: "mood", user: mood, value: "glad", wantErr: `expected one of sad, ok, happy, got "glad"`},
+		{typ: "email", user: email, value: "toolong", wantErr: "expected at most 6 characters, got 7"},
+		{typ: "tsvector", value: float64(1)},
+		{typ: "integer", value: nil},
+	}
+	for _, tc := range tests {
+		err := checkValue(tc.typ, tc.user, tc.value)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("checkValue(%q, %#v): unexpected error: %v", tc.typ, tc.value, err)
+		case tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr):
+			t.Errorf("checkValue(%q, %#v) = %v, want %q", tc.typ, tc.value, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// hubPingInterval is how often the agent pings the hub. A hub connection
+// that answers neither pings nor with messages for three intervals is
+// presumed dead and restarted by the watchdog.
+const hubPingInterval = 30 * time.Second
+
+// watchdog restarts subsystems that stop making progress. A subsystem
+// registers with watch, reports progress with beat, and is restarted, by
+// calling its restart func, when it has gone timeout without a beat.
+type watchdog struct {
+	mu      sync.Mutex
+	watched map[string]*watched
+}
+
+type watched struct {
+	last    time.Time
+	timeout time.Duration
+	restart func()
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{watched: map[string]*watched{}}
+}
+
+func (w *watchdog) watch(name string, timeout time.Duration, restart func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watched[name] = &watched{last: time.Now(), timeout: timeout, restart: restart}
+}
+
+func (w *watchdog) unwatch(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.watched, name)
+}
+
+func (w *watchdog) beat(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if s := w.watched[name]; s != nil {
+		s.last = time.Now()
+	}
+}
+
+// check restarts every subsystem that has been silent past its timeout at
+// now, leaving a breadcrumb with r for each, and returns their names.
+func (w *watchdog) check(now time.Time, r *sentryReporter) []string {
+	var stuck []string
+	var restarts []func()
+	w.mu.Lock()
+	for name, s := range w.watched {
+		if now.Sub(s.last) > s.timeout {
+			stuck = append(stuck, name)
+			restarts = append(restarts, s.restart)
+			// Give the restart a full timeout to take effect.
+			s.last = now
+		}
+	}
+	w.mu.Unlock()
+
+	for i, name := range stuck {
+		log.Printf("[watchdog] %s made no progress; restarting it", name)
+		r.breadcrumb("watchdog", "restarting %s", name)
+		restarts[i]()
+	}
+	return stuck
+}
+
+func (w *watchdog) run(ctx context.Context, interval time.Duration, r *sentryReporter) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.check(now, r)
+		}
+	}
+}
+
+// panicError turns a recovered panic into an error for the reply, logging
+// it with its stack and reporting it to Sentry. prefix is the log prefix of
+// the work that panicked, e.g. "query:q1".
+func (a *Agent) panicError(prefix string, v any) error {
+	log.Printf("[%s] Panic: %v\n%s", prefix, v, debug.Stack())
+	a.reporter.reportRecovered(v)
+	return codedErrorf(codeInternal, "internal error: %v", v)
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdogRestartsStuckSubsystems(t *testing.T) {
+	w := newWatchdog()
+	restarted := map[string]int{}
+	w.watch("hub", time.Minute, func() { restarted["hub"]++ })
+	w.watch("quiet", time.Hour, func() { restarted["quiet"]++ })
+
+	now := time.Now()
+	if stuck := w.check(now.Add(30*time.Second), nil); len(stuck) != 0 {
+		t.Errorf("expected nothing restarted yet, got %v", stuck)
+	}
+	w.beat("hub")
+	w.check(time.Now().Add(2*time.Minute), nil)
+	if restarted["hub"] != 1 || restarted["quiet"] != 0 {
+		t.Errorf("expected only hub restarted, got %v", restarted)
+	}
+
+	w.unwatch("hub")
+	w.check(time.Now().Add(10*time.Minute), nil)
+	if restarted["hub"] != 1 {
+		t.Errorf("expected no restarts after unwatch, got %v", restarted)
+	}
+}
+
+func TestRunQueryRecoversPanic(t *testing.T) {
+	// Without a database the connector dereferences a nil *sql.DB.
+	tn := testTenant(&connection{Name: "main", Connector: &sqlConnector{flavor: "postgres"}})
+
+	resp := runQuery(Message{Type: "query", ID: "q1", SQL: "SELECT 1", tenant: tn})
+	if resp.ErrorCode != codeInternal {
+		t.Errorf("expected %s, got %q (%s)", codeInternal, resp.ErrorCode, resp.Error)
+	}
+
+	tn.agent.running.Lock()
+	_, ok := tn.agent.running.queries["q1"]
+	tn.agent.running.Unlock()
+	if ok {
+		t.Error("expected the query to be unregistered after the panic")
+	}
+}
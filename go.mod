@@ -4,6 +4,16 @@ go 1.21
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/gocql/gocql v1.7.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/lib/pq v1.11.2
+	github.com/sijms/go-ora/v2 v2.8.24
+	go.etcd.io/bbolt v1.3.10
+	gopkg.in/inf.v0 v0.9.1
+)
+
+require (
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
@@ -0,0 +1,17 @@
+//go:build kerberos
+
+package main
+
+import (
+	"github.com/lib/pq"
+	"github.com/lib/pq/auth/kerberos"
+	"github.com/peekdb/agent/agent"
+)
+
+// Kerberos support pulls in gokrb5, so only builds that ask for it have it:
+//
+//	go get github.com/lib/pq/auth/kerberos
+//	go build -tags kerberos
+func init() {
+	agent.RegisterGSSProvider(func() (pq.GSS, error) { return kerberos.NewGSS() })
+}
@@ -1,213 +1,74 @@
+// Command peekdb-agent connects databases to PeekDB. The agent itself is
+// package agent; this is its command line.
 package main
 
 import (
-	"database/sql"
+	"context"
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/gorilla/websocket"
-	_ "github.com/lib/pq"
+	"github.com/peekdb/agent/agent"
 )
 
+// version is the agent's release, and commit and date the commit and time
+// it was built from, set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=... -X main.date=...".
 var (
-	hubURL      = "wss://connect.peekdb.com/agent"
-	token       string
-	databaseURL string
-	connName    string
-	db          *sql.DB
+	version = "dev"
+	commit  string
+	date    string
 )
 
-type Message struct {
-	Type   string `json:"type"`
-	ID     string `json:"id,omitempty"`
-	Token  string `json:"token,omitempty"`
-	SQL    string `json:"sql,omitempty"`
-	Params []any  `json:"params,omitempty"`
-}
-
-type AuthResponse struct {
-	Type    string `json:"type"`
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
-}
-
-type QueryResponse struct {
-	ID      string   `json:"id"`
-	Type    string   `json:"type"`
-	Columns []string `json:"columns,omitempty"`
-	Rows    [][]any  `json:"rows,omitempty"`
-	Error   string   `json:"error,omitempty"`
-}
-
-func connectDB() error {
-	var err error
-	db, err = sql.Open("postgres", databaseURL)
-	if err != nil {
-		return err
-	}
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-	return db.Ping()
-}
-
-func executeQuery(id, sqlQuery string, params []any) QueryResponse {
-	log.Printf("[query:%s] Executing: %s", id, truncate(sqlQuery, 100))
-	start := time.Now()
-
-	rows, err := db.Query(sqlQuery, params...)
-	if err != nil {
-		log.Printf("[query:%s] Error: %v", id, err)
-		return QueryResponse{ID: id, Type: "result", Error: err.Error()}
-	}
-	defer rows.Close()
-
-	columns, err := rows.Columns()
-	if err != nil {
-		return QueryResponse{ID: id, Type: "result", Error: err.Error()}
-	}
-
-	var results [][]any
-	for rows.Next() {
-		values := make([]any, len(columns))
-		valuePtrs := make([]any, len(columns))
-		for i := range values {
-			valuePtrs[i] = &values[i]
-		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
-			return QueryResponse{ID: id, Type: "result", Error: err.Error()}
-		}
-
-		// Convert values for JSON serialization
-		row := make([]any, len(columns))
-		for i, v := range values {
-			switch val := v.(type) {
-			case []byte:
-				row[i] = string(val)
-			case time.Time:
-				row[i] = val.Format(time.RFC3339)
-			default:
-				row[i] = val
-			}
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "maintenance":
+			os.Exit(agent.RunMaintenance(os.Args[2:], os.Stdout))
+		case "replay":
+			os.Exit(agent.RunReplay(os.Args[2:], os.Stdout))
+		case "dev-hub":
+			os.Exit(agent.RunDevHub(os.Args[2:], os.Stdout))
+		case "bench":
+			os.Exit(agent.RunBench(os.Args[2:], os.Stdout))
+		case "secrets":
+			os.Exit(agent.RunSecrets(os.Args[2:], os.Stdin, os.Stdout))
+		case "repl":
+			os.Exit(agent.RunRepl(os.Args[2:], os.Stdin, os.Stdout))
+		case "version":
+			os.Exit(agent.RunVersion(os.Args[2:], agent.BuildInfo{Version: version, Commit: commit, Date: date}, os.Stdout))
 		}
-		results = append(results, row)
 	}
-
-	log.Printf("[query:%s] Completed in %v, %d rows", id, time.Since(start), len(results))
-
-	return QueryResponse{
-		ID:      id,
-		Type:    "result",
-		Columns: columns,
-		Rows:    results,
+	doctor := len(os.Args) > 1 && os.Args[1] == "doctor"
+	if doctor {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
 	}
-}
 
-func truncate(s string, n int) string {
-	if len(s) <= n {
-		return s
-	}
-	return s[:n] + "..."
-}
-
-func connect() error {
-	log.Printf("Connecting to hub: %s", hubURL)
-
-	conn, _, err := websocket.DefaultDialer.Dial(hubURL, nil)
-	if err != nil {
-		return fmt.Errorf("dial failed: %w", err)
-	}
-	defer conn.Close()
-
-	// Send auth
-	log.Println("Authenticating...")
-	if err := conn.WriteJSON(Message{Type: "auth", Token: token}); err != nil {
-		return fmt.Errorf("auth send failed: %w", err)
-	}
-
-	// Wait for auth response
-	var authResp AuthResponse
-	if err := conn.ReadJSON(&authResp); err != nil {
-		return fmt.Errorf("auth read failed: %w", err)
-	}
-	if !authResp.Success {
-		return fmt.Errorf("authentication failed: %s", authResp.Error)
-	}
-	log.Println("✓ Authenticated successfully")
-	log.Println("Ready and waiting for queries...")
-
-	// Main loop
-	for {
-		var msg Message
-		if err := conn.ReadJSON(&msg); err != nil {
-			return fmt.Errorf("read failed: %w", err)
-		}
-
-		if msg.Type == "query" {
-			resp := executeQuery(msg.ID, msg.SQL, msg.Params)
-			if err := conn.WriteJSON(resp); err != nil {
-				return fmt.Errorf("write failed: %w", err)
-			}
-		}
-	}
-}
-
-func main() {
-	flag.StringVar(&token, "token", os.Getenv("PEEKDB_TOKEN"), "PeekDB connection token")
-	flag.StringVar(&databaseURL, "db", os.Getenv("DATABASE_URL"), "Database connection URL")
-	flag.StringVar(&hubURL, "hub", hubURL, "Hub WebSocket URL")
-	flag.StringVar(&connName, "name", "", "Connection name (optional)")
+	opts := agent.DefaultOptions()
+	opts.Version, opts.Commit, opts.BuildDate = version, commit, date
+	opts.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	if token == "" {
-		log.Fatal("Token required: --token or PEEKDB_TOKEN env")
-	}
-	if databaseURL == "" {
-		log.Fatal("Database URL required: --db or DATABASE_URL env")
+	if doctor {
+		if opts.DatabaseURL == "" && opts.ConfigPath == "" {
+			log.Fatal("Database URL required: --db or DATABASE_URL env, or connections in --config")
+		}
+		os.Exit(agent.Doctor(opts, os.Stdout))
 	}
 
-	log.Println("PeekDB Agent starting...")
-	log.Printf("Hub: %s", hubURL)
-
-	// Connect to database
-	log.Println("Connecting to database...")
-	if err := connectDB(); err != nil {
-		log.Fatalf("Database connection failed: %v", err)
+	a, err := agent.New(opts)
+	if err != nil {
+		log.Print(err)
+		os.Exit(agent.ExitCode(err))
 	}
-	log.Println("✓ Database connected")
-
-	// Handle shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigCh
-		log.Println("Shutting down...")
-		if db != nil {
-			db.Close()
-		}
-		os.Exit(0)
-	}()
-
-	// Connect with reconnect loop
-	backoff := time.Second
-	for {
-		if err := connect(); err != nil {
-			log.Printf("Connection error: %v", err)
-			log.Printf("Reconnecting in %v...", backoff)
-			time.Sleep(backoff)
-			// Exponential backoff capped at 60s
-			backoff *= 2
-			if backoff > 60*time.Second {
-				backoff = 60 * time.Second
-			}
-		} else {
-			backoff = time.Second // Reset on successful connection
-		}
+	// Everything the agent runs derives its context from ctx, which is
+	// cancelled on SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := a.Run(ctx); err != nil {
+		log.Print(err)
+		os.Exit(agent.ExitCode(err))
 	}
 }